@@ -0,0 +1,329 @@
+// Command bench measures the ingest path, so a parser or insert regression
+// shows up before a release rather than on a processor's month-end file:
+//
+//	go run ./cmd/bench ingest [-rows 10000,100000,1000000] [-formats csv_a,json_b]
+//	                          [-workers 1] [-count 1] [-save bench.json]
+//	                          [-baseline bench.json] [-max-regression 20]
+//
+// For each format and row count it generates a report of that many records,
+// parses it with ingestion.Parse and inserts the records into a fresh
+// database the way an ingest does, and reports both phases' rows per second
+// and allocations per row. With -workers N the rows are split over N files
+// parsed at once, as the ingest worker pool does; inserts are serialized the
+// way the service serializes them. With -baseline it fails when a phase got
+// slower or allocates more than -max-regression percent against the saved
+// results.
+//
+// It stands in for Benchmark functions: like the golden and scenario
+// runners, the checks of this repository are commands, and a fixed row count
+// per case suits million-row inserts better than b.N.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/wakala/reconciler/internal/domain"
+	"github.com/wakala/reconciler/internal/ingestion"
+	"github.com/wakala/reconciler/internal/repository"
+)
+
+// formats are the built-in parsers' formats, in the order they are run.
+var formats = []string{"csv_a", "json_b", "csv_c", "csv_mpesa"}
+
+var processors = map[string]domain.Processor{
+	"csv_a":     domain.ProcessorAfriPay,
+	"json_b":    domain.ProcessorNairaGateway,
+	"csv_c":     domain.ProcessorCapePay,
+	"csv_mpesa": domain.ProcessorMPesa,
+}
+
+func main() {
+	if len(os.Args) < 2 || os.Args[1] != "ingest" {
+		fmt.Fprintln(os.Stderr, "usage: bench ingest [flags]")
+		os.Exit(2)
+	}
+	fs := flag.NewFlagSet("ingest", flag.ExitOnError)
+	rowsFlag := fs.String("rows", "10000,100000,1000000", "comma-separated record counts")
+	formatsFlag := fs.String("formats", strings.Join(formats, ","), "comma-separated formats")
+	workers := fs.Int("workers", 1, "files parsed at once; the rows are split between them")
+	count := fs.Int("count", 1, "runs of each case; each phase's fastest run is reported")
+	dir := fs.String("dir", "", "directory of the benchmark databases (default the temp directory)")
+	save := fs.String("save", "", "write the results as JSON to this file")
+	baseline := fs.String("baseline", "", "compare with results saved by -save")
+	maxRegression := fs.Float64("max-regression", 20, "percent a phase may be slower, or allocate more, than the baseline")
+	fs.Parse(os.Args[2:])
+
+	sizes, err := parseSizes(*rowsFlag)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "-rows: %v\n", err)
+		os.Exit(2)
+	}
+	var selected []string
+	for _, f := range strings.Split(*formatsFlag, ",") {
+		f = strings.TrimSpace(f)
+		if _, ok := processors[f]; !ok {
+			fmt.Fprintf(os.Stderr, "-formats: unknown format %q, use %s\n", f, strings.Join(formats, ", "))
+			os.Exit(2)
+		}
+		selected = append(selected, f)
+	}
+	if *workers < 1 || *count < 1 {
+		fmt.Fprintln(os.Stderr, "-workers and -count must be at least 1")
+		os.Exit(2)
+	}
+	// Parser warnings and the repositories' logging would be timed too.
+	log.SetOutput(io.Discard)
+
+	var base map[string]result
+	if *baseline != "" {
+		if base, err = loadResults(*baseline); err != nil {
+			fmt.Fprintf(os.Stderr, "-baseline: %v\n", err)
+			os.Exit(2)
+		}
+	}
+
+	fmt.Printf("%-10s %9s  %13s %10s %9s  %13s %10s %9s\n",
+		"format", "rows", "parse rows/s", "allocs/row", "B/row", "insert rows/s", "allocs/row", "B/row")
+	var results []result
+	failed := 0
+	for _, format := range selected {
+		for _, rows := range sizes {
+			var best result
+			for i := 0; i < *count; i++ {
+				r, err := runCase(format, rows, *workers, *dir)
+				if err != nil {
+					fmt.Printf("FAIL %s %d rows: %v\n", format, rows, err)
+					os.Exit(1)
+				}
+				if i == 0 {
+					best = r
+					continue
+				}
+				if r.Parse.RowsPerSec > best.Parse.RowsPerSec {
+					best.Parse = r.Parse
+				}
+				if r.Insert.RowsPerSec > best.Insert.RowsPerSec {
+					best.Insert = r.Insert
+				}
+			}
+			results = append(results, best)
+			fmt.Printf("%-10s %9d  %13.0f %10.1f %9.0f  %13.0f %10.1f %9.0f\n", best.Format, best.Rows,
+				best.Parse.RowsPerSec, best.Parse.AllocsPerRow, best.Parse.BytesPerRow,
+				best.Insert.RowsPerSec, best.Insert.AllocsPerRow, best.Insert.BytesPerRow)
+			if base != nil {
+				for _, msg := range compare(best, base, *maxRegression) {
+					fmt.Printf("FAIL %s %d rows: %s\n", best.Format, best.Rows, msg)
+					failed++
+				}
+			}
+		}
+	}
+
+	if *save != "" {
+		data, err := json.MarshalIndent(results, "", "  ")
+		if err == nil {
+			err = os.WriteFile(*save, append(data, '\n'), 0o644)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "-save: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	if failed > 0 {
+		fmt.Printf("%d regressions over %.0f%% against %s\n", failed, *maxRegression, *baseline)
+		os.Exit(1)
+	}
+}
+
+func parseSizes(v string) ([]int, error) {
+	var sizes []int
+	for _, s := range strings.Split(v, ",") {
+		n, err := strconv.Atoi(strings.TrimSpace(s))
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("invalid row count %q", s)
+		}
+		sizes = append(sizes, n)
+	}
+	return sizes, nil
+}
+
+// result is one case's measurements, as -save writes them.
+type result struct {
+	Format  string `json:"format"`
+	Rows    int    `json:"rows"`
+	Workers int    `json:"workers"`
+	Parse   phase  `json:"parse"`
+	Insert  phase  `json:"insert"`
+}
+
+type phase struct {
+	Seconds      float64 `json:"seconds"`
+	RowsPerSec   float64 `json:"rows_per_sec"`
+	AllocsPerRow float64 `json:"allocs_per_row"`
+	BytesPerRow  float64 `json:"bytes_per_row"`
+}
+
+func (r result) key() string {
+	return fmt.Sprintf("%s/%d/%d", r.Format, r.Rows, r.Workers)
+}
+
+func loadResults(path string) (map[string]result, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var results []result
+	if err := json.Unmarshal(data, &results); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	byKey := make(map[string]result, len(results))
+	for _, r := range results {
+		byKey[r.key()] = r
+	}
+	return byKey, nil
+}
+
+// compare lists how r regressed by more than pct percent against the
+// baseline case with the same format, rows and workers. A case the baseline
+// does not have passes.
+func compare(r result, base map[string]result, pct float64) []string {
+	b, ok := base[r.key()]
+	if !ok {
+		return nil
+	}
+	var msgs []string
+	check := func(name string, got, was phase) {
+		if was.RowsPerSec > 0 && got.RowsPerSec < was.RowsPerSec*(1-pct/100) {
+			msgs = append(msgs, fmt.Sprintf("%s %.0f rows/s, baseline %.0f", name, got.RowsPerSec, was.RowsPerSec))
+		}
+		if was.AllocsPerRow > 0 && got.AllocsPerRow > was.AllocsPerRow*(1+pct/100) {
+			msgs = append(msgs, fmt.Sprintf("%s %.1f allocs/row, baseline %.1f", name, got.AllocsPerRow, was.AllocsPerRow))
+		}
+	}
+	check("parse", r.Parse, b.Parse)
+	check("insert", r.Insert, b.Insert)
+	return msgs
+}
+
+// runCase generates rows records of format split over workers files, then
+// times parsing them all at once and inserting them into a new database.
+func runCase(format string, rows, workers int, dir string) (result, error) {
+	workers = min(workers, rows)
+	files := make([][]byte, workers)
+	first := 0
+	for i := range files {
+		n := rows / workers
+		if i < rows%workers {
+			n++
+		}
+		files[i] = generate(format, i, first, n)
+		first += n
+	}
+
+	parsed := make([]*ingestion.ParseResult, workers)
+	errs := make([]error, workers)
+	parse, err := measure(rows, func() error {
+		var wg sync.WaitGroup
+		for i := range files {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				parsed[i], errs[i] = ingestion.Parse(format, files[i], reportID(format, i))
+			}(i)
+		}
+		wg.Wait()
+		for _, err := range errs {
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return result{}, err
+	}
+	files = nil
+	got := 0
+	for _, p := range parsed {
+		got += len(p.Records)
+	}
+	if got != rows {
+		return result{}, fmt.Errorf("parsed %d records, want %d", got, rows)
+	}
+
+	tmp, err := os.MkdirTemp(dir, "wakala-bench-")
+	if err != nil {
+		return result{}, err
+	}
+	defer os.RemoveAll(tmp)
+	db, err := repository.InitDB(filepath.Join(tmp, "wakala.db"))
+	if err != nil {
+		return result{}, err
+	}
+	defer db.Close()
+	repo := repository.NewSettlementRepo(db)
+
+	insert, err := measure(rows, func() error {
+		for i, p := range parsed {
+			now := time.Now()
+			if err := repo.InsertReport(&domain.SettlementReport{
+				ID:          reportID(format, i),
+				Processor:   processors[format],
+				ReportDate:  now,
+				BatchID:     p.BatchID,
+				FileHash:    reportID(format, i),
+				RecordCount: len(p.Records),
+				IngestedAt:  now,
+			}); err != nil {
+				return fmt.Errorf("insert report: %w", err)
+			}
+			n, err := repo.InsertRecords(p.Records)
+			if err != nil {
+				return fmt.Errorf("insert records: %w", err)
+			}
+			if n != len(p.Records) {
+				return fmt.Errorf("inserted %d of %d records", n, len(p.Records))
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return result{}, err
+	}
+	return result{Format: format, Rows: rows, Workers: workers, Parse: parse, Insert: insert}, nil
+}
+
+// measure runs fn after a collection, so earlier garbage is not charged to
+// it, and reports its throughput and heap allocations per row.
+func measure(rows int, fn func() error) (phase, error) {
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	start := time.Now()
+	if err := fn(); err != nil {
+		return phase{}, err
+	}
+	elapsed := time.Since(start).Seconds()
+	runtime.ReadMemStats(&after)
+	return phase{
+		Seconds:      elapsed,
+		RowsPerSec:   float64(rows) / elapsed,
+		AllocsPerRow: float64(after.Mallocs-before.Mallocs) / float64(rows),
+		BytesPerRow:  float64(after.TotalAlloc-before.TotalAlloc) / float64(rows),
+	}, nil
+}
+
+func reportID(format string, file int) string {
+	return fmt.Sprintf("BENCH-%s-%d", strings.ToUpper(format), file)
+}
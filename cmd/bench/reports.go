@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"time"
+
+	"github.com/wakala/reconciler/internal/testgen"
+)
+
+// benchDay is the settlement day of every generated record.
+var benchDay = time.Date(2024, 1, 15, 0, 0, 0, 0, time.UTC)
+
+// amounts returns record i's gross amount and fee, varied so the parsers
+// see numbers of different lengths.
+func amounts(i int) (gross, fee float64) {
+	gross = float64(100+(i*7919)%500000) + float64(i%100)/100
+	fee = float64(int(gross*1.5)) / 100
+	return gross, fee
+}
+
+// generate renders records first to first+n-1 of format as file number
+// file. References are unique across the files of one case.
+func generate(format string, file, first, n int) []byte {
+	batch := fmt.Sprintf("BENCH-%d", file)
+	switch format {
+	case "csv_a":
+		return writeDelimited(',', []string{
+			"transaction_id", "merchant_ref", "settlement_date",
+			"gross_amount_kes", "fee_kes", "net_kes", "batch_id",
+		}, "AP", batch, first, n)
+	case "csv_c":
+		return writeDelimited('|', []string{
+			"TXREF", "MERCHANT", "SETTLE_DATE",
+			"AMOUNT_ZAR", "DEDUCTIONS_ZAR", "NET_ZAR", "BATCH",
+		}, "CP", batch, first, n)
+	case "json_b":
+		return writeNairaGatewayJSON(batch, first, n)
+	case "csv_mpesa":
+		return writeMPesaStatement(first, n)
+	}
+	panic("no generator for " + format)
+}
+
+func writeDelimited(comma rune, header []string, prefix, batch string, first, n int) []byte {
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	w.Comma = comma
+	w.Write(header)
+	day := benchDay.Format("2006-01-02")
+	for i := first; i < first+n; i++ {
+		gross, fee := amounts(i)
+		w.Write([]string{
+			fmt.Sprintf("%s-TXN-%08d", prefix, i),
+			fmt.Sprintf("M%03d", i%200),
+			day,
+			fmt.Sprintf("%.2f", gross),
+			fmt.Sprintf("%.2f", fee),
+			fmt.Sprintf("%.2f", gross-fee),
+			batch,
+		})
+	}
+	w.Flush()
+	return buf.Bytes()
+}
+
+func writeNairaGatewayJSON(batch string, first, n int) []byte {
+	type record struct {
+		Ref           string  `json:"ref"`
+		MerchantID    string  `json:"merchant_id"`
+		AmountNGN     float64 `json:"amount_ngn"`
+		ProcessingFee float64 `json:"processing_fee_ngn"`
+		PayoutNGN     float64 `json:"payout_ngn"`
+		SettledAt     string  `json:"settled_at"`
+	}
+	const endOfDayWAT = "T23:59:59+01:00"
+	day := benchDay.Format("2006-01-02") + endOfDayWAT
+	out := struct {
+		BatchID        string   `json:"batch_id"`
+		SettlementDate string   `json:"settlement_date"`
+		Records        []record `json:"records"`
+	}{BatchID: batch, SettlementDate: day, Records: make([]record, 0, n)}
+	for i := first; i < first+n; i++ {
+		gross, fee := amounts(i)
+		out.Records = append(out.Records, record{
+			Ref:           fmt.Sprintf("NG-TXN-%08d", i),
+			MerchantID:    fmt.Sprintf("M%03d", i%200),
+			AmountNGN:     gross,
+			ProcessingFee: fee,
+			PayoutNGN:     float64(int((gross-fee)*100+0.5)) / 100,
+			SettledAt:     day,
+		})
+	}
+	data, err := testgen.MarshalIndent(out)
+	if err != nil {
+		panic(err)
+	}
+	return data
+}
+
+// writeMPesaStatement renders n Pay Bill payments, each followed by the
+// charge linked to it, after the export's preamble.
+func writeMPesaStatement(first, n int) []byte {
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	w.Write([]string{"Account Holder:", "WAKALA PAYMENTS LTD"})
+	w.Write([]string{"Short Code:", "600123"})
+	w.Write([]string{"Time Period:", "15-01-2024 - 16-01-2024"})
+	w.Write([]string{
+		"Receipt No.", "Completion Time", "Initiation Time", "Details", "Transaction Status",
+		"Paid In", "Withdrawn", "Balance", "Balance Confirmed", "Reason Type",
+		"Other Party Info", "Linked Transaction ID", "A/C No.",
+	})
+	for i := first; i < first+n; i++ {
+		gross, fee := amounts(i)
+		at := benchDay.Add(time.Duration(i%86400) * time.Second).Format("2006-01-02 15:04:05")
+		receipt := fmt.Sprintf("BP%08d", i)
+		account := fmt.Sprintf("WKL-%d", i)
+		party := "2547****0412 - JANE WANJIKU"
+		w.Write([]string{
+			receipt, at, at, "Pay Bill from " + party + " Acc. " + account, "Completed",
+			mpesaAmount(gross), "", "", "true", "Pay Bill", party, "", account,
+		})
+		w.Write([]string{
+			fmt.Sprintf("BC%08d", i), at, at, "Pay Bill Charge", "Completed",
+			"", mpesaAmount(-fee), "", "true", "Pay Bill Charge", "", receipt, "",
+		})
+	}
+	w.Flush()
+	return buf.Bytes()
+}
+
+// mpesaAmount formats v with thousands separators, as the export does.
+func mpesaAmount(v float64) string {
+	s := fmt.Sprintf("%.2f", v)
+	sign := ""
+	if s[0] == '-' {
+		sign, s = "-", s[1:]
+	}
+	whole, cents := s[:len(s)-3], s[len(s)-3:]
+	for i := len(whole) - 3; i > 0; i -= 3 {
+		whole = whole[:i] + "," + whole[i:]
+	}
+	return sign + whole + cents
+}
@@ -0,0 +1,73 @@
+// Command purge applies the data retention policy to the database once and
+// prints the purge report as JSON. It reads DB_PATH, the RETENTION_*
+// variables, the column encryption keys and the BLOB_* store like the
+// server, and is meant to be run from cron, alongside a running server or
+// not.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"log"
+	"os"
+	"time"
+
+	"github.com/wakala/reconciler/internal/blob"
+	"github.com/wakala/reconciler/internal/repository"
+	"github.com/wakala/reconciler/internal/retention"
+)
+
+func main() {
+	dryRun := flag.Bool("dry-run", false, "report what would be purged without changing anything")
+	by := flag.String("by", "purge-cli", "who requested the purge, recorded in the report")
+	flag.Parse()
+
+	policy, err := retention.PolicyFromEnv()
+	if err != nil {
+		log.Fatalf("Invalid retention policy: %v", err)
+	}
+	if policy == nil {
+		log.Fatalf("No retention policy: set RETENTION_DAYS or RETENTION_DAYS_BY_PROCESSOR")
+	}
+
+	columnKeys, err := repository.ColumnKeysFromEnv()
+	if err != nil {
+		log.Fatalf("Invalid column encryption config: %v", err)
+	}
+	if columnKeys != nil {
+		columnCipher, err := repository.NewColumnCipher(columnKeys)
+		if err != nil {
+			log.Fatalf("Invalid column encryption config: %v", err)
+		}
+		repository.SetColumnCipher(columnCipher)
+	}
+
+	dbPath := os.Getenv("DB_PATH")
+	if dbPath == "" {
+		dbPath = "wakala.db"
+	}
+	db, err := repository.InitDB(dbPath)
+	if err != nil {
+		log.Fatalf("Failed to init DB: %v", err)
+	}
+	defer db.Close()
+
+	blobStore, err := blob.FromEnv()
+	if err != nil {
+		log.Fatalf("Invalid blob store config: %v", err)
+	}
+	repo := repository.NewRetentionRepo(db)
+	if blobStore != nil {
+		repo.SetBlobStore(blobStore)
+	}
+
+	report, err := policy.Purge(repo, time.Now(), *by, *dryRun)
+	if err != nil {
+		log.Fatalf("Purge failed: %v", err)
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(report); err != nil {
+		log.Fatalf("Write report: %v", err)
+	}
+}
@@ -0,0 +1,248 @@
+// Command sandbox serves stand-ins for the processors' endpoints, so an
+// integration environment can run the pull, ingest and reconcile loop
+// without access to a real processor. The data is generated by testgen from
+// -seed and is the same on every start:
+//
+//	GET /nairagateway/v1/settlements  the NairaGateway settlements API
+//	GET /files/                       the report files, as the processors'
+//	GET /files/{name}                 drop directories would hold them
+//	GET /transactions.json            the Wakala transactions they settle
+//	GET /expected                     what reconciliation should find
+//
+// With the default seed the data is that of testdata/.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+
+	"github.com/wakala/reconciler/internal/domain"
+	"github.com/wakala/reconciler/internal/testgen"
+)
+
+// maxPerPage bounds per_page like the real API does.
+const maxPerPage = 500
+
+func main() {
+	addr := flag.String("addr", "127.0.0.1:9090", "address to listen on")
+	seed := flag.Int64("seed", testgen.Default().Seed, "seed of the generated data")
+	token := flag.String("token", "sandbox-token", "bearer token the NairaGateway API accepts")
+	flag.Parse()
+
+	s := testgen.Default()
+	s.Seed = *seed
+	ds, err := testgen.Generate(s)
+	if err != nil {
+		log.Fatalf("Generate data: %v", err)
+	}
+	sb, err := newSandbox(ds, *token)
+	if err != nil {
+		log.Fatalf("Build sandbox: %v", err)
+	}
+
+	r := chi.NewRouter()
+	r.Use(middleware.Logger)
+	r.Use(middleware.Recoverer)
+	r.Get("/nairagateway/v1/settlements", sb.settlements)
+	r.Get("/files/", sb.listFiles)
+	r.Get("/files/{name}", sb.getFile)
+	r.Get("/transactions.json", sb.transactions)
+	r.Get("/expected", sb.expected)
+
+	log.Printf("Processor sandbox (seed %d) listening on %s", *seed, *addr)
+	for _, rep := range ds.Reports {
+		log.Printf("  %-13s %3d records  /files/%s", rep.Processor, rep.Records, rep.Filename)
+	}
+	log.Printf("  NairaGateway API: NAIRAGATEWAY_API_URL=http://%s/nairagateway/v1 NAIRAGATEWAY_API_TOKEN=%s", *addr, *token)
+	if err := http.ListenAndServe(*addr, r); err != nil {
+		log.Fatalf("Server failed: %v", err)
+	}
+}
+
+// apiSettlement is a settlement as the NairaGateway API returns it.
+type apiSettlement struct {
+	Ref           string  `json:"ref"`
+	MerchantID    string  `json:"merchant_id"`
+	AmountNGN     float64 `json:"amount_ngn"`
+	ProcessingFee float64 `json:"processing_fee_ngn"`
+	PayoutNGN     float64 `json:"payout_ngn"`
+	SettledAt     string  `json:"settled_at"`
+	BatchID       string  `json:"batch_id"`
+	UpdatedAt     string  `json:"updated_at"`
+
+	updated time.Time
+}
+
+type sandbox struct {
+	ds    *testgen.Dataset
+	token string
+	// api holds the NairaGateway report's records by updated_at.
+	api []apiSettlement
+}
+
+// newSandbox serves ds. The NairaGateway API returns the records of its
+// generated json_b report, each last updated when it settled.
+func newSandbox(ds *testgen.Dataset, token string) (*sandbox, error) {
+	sb := &sandbox{ds: ds, token: token}
+	for _, rep := range ds.Reports {
+		if rep.Processor != domain.ProcessorNairaGateway {
+			continue
+		}
+		var file struct {
+			BatchID string          `json:"batch_id"`
+			Records []apiSettlement `json:"records"`
+		}
+		if err := json.Unmarshal(rep.Data, &file); err != nil {
+			return nil, fmt.Errorf("read %s: %w", rep.Filename, err)
+		}
+		for _, rec := range file.Records {
+			settled, err := time.Parse(time.RFC3339, rec.SettledAt)
+			if err != nil {
+				return nil, fmt.Errorf("%s: settled_at of %s: %w", rep.Filename, rec.Ref, err)
+			}
+			rec.BatchID = file.BatchID
+			rec.updated = settled.UTC()
+			rec.UpdatedAt = rec.updated.Format(time.RFC3339)
+			sb.api = append(sb.api, rec)
+		}
+	}
+	sort.SliceStable(sb.api, func(i, j int) bool { return sb.api[i].updated.Before(sb.api[j].updated) })
+	return sb, nil
+}
+
+// settlements serves GET /settlements?updated_since=&page=&per_page= as
+// the NairaGateway API does: updated_since is inclusive, pages start at 1
+// and a page past the last is empty.
+func (sb *sandbox) settlements(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Authorization") != "Bearer "+sb.token {
+		writeError(w, http.StatusUnauthorized, "invalid or missing bearer token")
+		return
+	}
+	q := r.URL.Query()
+	var since time.Time
+	if v := q.Get("updated_since"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid updated_since: use RFC3339")
+			return
+		}
+		since = t
+	}
+	page, ok := intParam(q.Get("page"), 1, 1<<30)
+	if !ok {
+		writeError(w, http.StatusBadRequest, "invalid page")
+		return
+	}
+	perPage, ok := intParam(q.Get("per_page"), 100, maxPerPage)
+	if !ok {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid per_page: must be between 1 and %d", maxPerPage))
+		return
+	}
+
+	var matching []apiSettlement
+	for _, s := range sb.api {
+		if !s.updated.Before(since) {
+			matching = append(matching, s)
+		}
+	}
+	totalPages := (len(matching) + perPage - 1) / perPage
+	data := []apiSettlement{}
+	if start := (page - 1) * perPage; start < len(matching) {
+		data = matching[start:min(start+perPage, len(matching))]
+	}
+
+	var body struct {
+		Data []apiSettlement `json:"data"`
+		Meta struct {
+			Page       int `json:"page"`
+			PerPage    int `json:"per_page"`
+			Total      int `json:"total"`
+			TotalPages int `json:"total_pages"`
+		} `json:"meta"`
+	}
+	body.Data = data
+	body.Meta.Page, body.Meta.PerPage = page, perPage
+	body.Meta.Total, body.Meta.TotalPages = len(matching), totalPages
+	writeJSON(w, http.StatusOK, body)
+}
+
+// intParam parses an optional positive query parameter no greater than max.
+func intParam(v string, def, max int) (int, bool) {
+	if v == "" {
+		return def, true
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 1 || n > max {
+		return 0, false
+	}
+	return n, true
+}
+
+// listFiles serves the report files' names with the processor and format
+// each is ingested as.
+func (sb *sandbox) listFiles(w http.ResponseWriter, r *http.Request) {
+	type file struct {
+		Name      string           `json:"name"`
+		Processor domain.Processor `json:"processor"`
+		Format    string           `json:"format"`
+		Records   int              `json:"records"`
+		Size      int              `json:"size"`
+	}
+	files := make([]file, 0, len(sb.ds.Reports))
+	for _, rep := range sb.ds.Reports {
+		files = append(files, file{rep.Filename, rep.Processor, rep.Format, rep.Records, len(rep.Data)})
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"files": files})
+}
+
+func (sb *sandbox) getFile(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "name")
+	for _, rep := range sb.ds.Reports {
+		if rep.Filename != name {
+			continue
+		}
+		contentType := "text/csv"
+		if strings.HasSuffix(name, ".json") {
+			contentType = "application/json"
+		}
+		w.Header().Set("Content-Type", contentType)
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name))
+		w.Write(rep.Data)
+		return
+	}
+	writeError(w, http.StatusNotFound, "no such file: "+name)
+}
+
+func (sb *sandbox) transactions(w http.ResponseWriter, r *http.Request) {
+	data, err := testgen.MarshalIndent(sb.ds.Transactions)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
+
+func (sb *sandbox) expected(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, sb.ds.Expected)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, map[string]string{"error": msg})
+}
@@ -1,21 +1,49 @@
 package main
 
 import (
+	"context"
+	"database/sql"
 	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"strings"
+	"syscall"
 
 	"github.com/wakala/reconciler/internal/api"
+	"github.com/wakala/reconciler/internal/blob"
+	"github.com/wakala/reconciler/internal/config"
+	"github.com/wakala/reconciler/internal/connector"
+	"github.com/wakala/reconciler/internal/currency"
+	"github.com/wakala/reconciler/internal/digest"
 	"github.com/wakala/reconciler/internal/domain"
 	"github.com/wakala/reconciler/internal/ingestion"
+	"github.com/wakala/reconciler/internal/jira"
+	"github.com/wakala/reconciler/internal/leader"
+	"github.com/wakala/reconciler/internal/live"
+	"github.com/wakala/reconciler/internal/mailbox"
+	"github.com/wakala/reconciler/internal/maintenance"
+	"github.com/wakala/reconciler/internal/notify"
 	"github.com/wakala/reconciler/internal/reconciliation"
 	"github.com/wakala/reconciler/internal/repository"
+	"github.com/wakala/reconciler/internal/retention"
+	"github.com/wakala/reconciler/internal/retry"
 )
 
 func main() {
+	// Settings in CONFIG_FILE override the environment. Read them first, so
+	// that everything below sees them.
+	reloader, err := config.Load()
+	if err != nil {
+		log.Fatalf("Invalid config file: %v", err)
+	}
+	if reloader != nil {
+		log.Printf("Loaded %d settings from %s", reloader.Keys(), reloader.Path())
+	}
+
 	port := os.Getenv("PORT")
 	if port == "" {
 		port = "8080"
@@ -26,6 +54,21 @@ func main() {
 		dbPath = "wakala.db"
 	}
 
+	// Encrypt processor references at rest when keys are configured. This
+	// must happen before InitDB, which may quarantine transactions.
+	columnKeys, err := repository.ColumnKeysFromEnv()
+	if err != nil {
+		log.Fatalf("Invalid column encryption config: %v", err)
+	}
+	if columnKeys != nil {
+		columnCipher, err := repository.NewColumnCipher(columnKeys)
+		if err != nil {
+			log.Fatalf("Invalid column encryption config: %v", err)
+		}
+		repository.SetColumnCipher(columnCipher)
+		log.Printf("Encrypting processor references with key %s (%d keys configured)", columnCipher.ActiveKeyID(), len(columnKeys))
+	}
+
 	log.Printf("Initializing database at %s", dbPath)
 	db, err := repository.InitDB(dbPath)
 	if err != nil {
@@ -33,21 +76,276 @@ func main() {
 	}
 	defer db.Close()
 
+	// A reconciliation query that stops using its index still works, but
+	// slows down with every transaction, so say so at startup.
+	problems, err := repository.CheckQueryPlans(db)
+	if err != nil {
+		log.Fatalf("Failed to check query plans: %v", err)
+	}
+	for _, p := range problems {
+		log.Printf("WARNING: query plan: %s", p)
+	}
+
+	// Load historical FX rates used by backfill ingestion.
+	if fxPath := os.Getenv("FX_HISTORY_FILE"); fxPath != "" {
+		if err := loadRateHistory(fxPath); err != nil {
+			log.Fatalf("Failed to load FX history: %v", err)
+		}
+	}
+
+	// Retry and circuit-break calls to outside systems, with per-integration
+	// overrides of the default policy.
+	retryOverrides, err := retry.OverridesFromEnv()
+	if err != nil {
+		log.Fatalf("Invalid retry config: %v", err)
+	}
+	retry.Configure(retryOverrides)
+
+	// Keep report files and snapshots in a blob store rather than in the
+	// database and SNAPSHOT_DIR when one is configured.
+	blobStore, err := blob.FromEnv()
+	if err != nil {
+		log.Fatalf("Invalid blob store config: %v", err)
+	}
+	if blobStore != nil {
+		log.Printf("Blob store: %s", blobStore)
+	}
+
+	// Bound the dashboard, list and summary reads, and log the slow ones.
+	queryLimits, err := repository.QueryLimitsFromEnv()
+	if err != nil {
+		log.Fatalf("Invalid query limits: %v", err)
+	}
+	repository.SetQueryLimits(queryLimits)
+
 	// Create repositories.
 	txnRepo := repository.NewTransactionRepo(db)
 	settRepo := repository.NewSettlementRepo(db)
 	discRepo := repository.NewDiscrepancyRepo(db)
+	tolRepo := repository.NewToleranceRepo(db)
+	filterRepo := repository.NewSavedFilterRepo(db)
+	viewRepo := repository.NewDashboardViewRepo(db)
+	alertRepo := repository.NewAlertRepo(db)
+	connectorRepo := repository.NewConnectorRepo(db)
+	idemRepo := repository.NewIdempotencyRepo(db)
+	certRepo := repository.NewCertificateRepo(db)
+	periodRepo := repository.NewPeriodRepo(db)
+	transformRepo := repository.NewTransformRepo(db)
+	contactRepo := repository.NewProcessorContactRepo(db)
+	ruleFlagRepo := repository.NewRuleFlagRepo(db)
+	routingRepo := repository.NewRoutingRuleRepo(db)
+	uow := repository.NewUnitOfWork(db)
+	if blobStore != nil {
+		settRepo.SetBlobStore(blobStore)
+		uow.SetBlobStore(blobStore)
+	}
+
+	// Route dashboard and list queries to a read-only pool when configured.
+	if readPath := os.Getenv("READ_DB_PATH"); readPath != "" {
+		readDB, err := repository.OpenReadOnly(readPath)
+		if err != nil {
+			log.Fatalf("Failed to open read-only DB: %v", err)
+		}
+		defer readDB.Close()
+		txnRepo.SetReader(readDB)
+		settRepo.SetReader(readDB)
+		discRepo.SetReader(readDB)
+		log.Printf("Routing read queries to %s (read-only)", readPath)
+	}
 
 	// Create services.
-	reconSvc := reconciliation.NewService(txnRepo, settRepo, discRepo)
-	ingestionSvc := ingestion.NewService(settRepo, txnRepo, discRepo, reconSvc)
+	reconSvc := reconciliation.NewService(txnRepo, settRepo, discRepo, tolRepo, uow)
+	ingestionSvc := ingestion.NewService(settRepo, txnRepo, discRepo, alertRepo, periodRepo, transformRepo, reconSvc, uow)
+
+	tolerances, err := reconciliation.TolerancesFromEnv()
+	if err != nil {
+		log.Fatalf("Invalid tolerance config: %v", err)
+	}
+	reconSvc.SetTolerances(tolerances)
+
+	// Hold payouts to merchants with too much in open high-severity
+	// discrepancies. Set up with the webhook before severities are
+	// regraded, since that re-evaluates the holds.
+	holdCfg, err := reconciliation.PayoutHoldConfigFromEnv()
+	if err != nil {
+		log.Fatalf("Invalid payout hold config: %v", err)
+	}
+	reconSvc.SetPayoutHoldConfig(holdCfg)
+
+	// Send transaction.settled and payout hold events downstream when
+	// SETTLEMENT_WEBHOOK_URL is set.
+	if sender := notify.NewWebhookSenderFromEnv(); sender != nil {
+		reconSvc.SetSettlementWebhook(sender)
+		log.Printf("Sending transaction.settled and payout hold webhooks to %s", os.Getenv("SETTLEMENT_WEBHOOK_URL"))
+	}
+
+	// Push dashboard deltas to GET /api/v1/dashboard/live.
+	feed := live.NewHub()
+	reconSvc.SetLiveFeed(feed)
+	ingestionSvc.SetLiveFeed(feed)
+
+	// Grade discrepancies by the configured severity rules, and regrade the
+	// ones already stored in case the rules changed since the last start.
+	severityRules, err := reconciliation.SeverityRulesFromEnv()
+	if err != nil {
+		log.Fatalf("Invalid severity rules: %v", err)
+	}
+	reconSvc.SetSeverityRules(severityRules)
+	if _, err := reconSvc.RecalculateSeverities("system"); err != nil {
+		log.Printf("WARNING: severity recalculation failed: %v", err)
+	}
+
+	// Raise alerts on aggregate anomalies after every reconciliation run,
+	// emailing them when ALERT_RECIPIENTS and SMTP_ADDR are both set.
+	anomalyCfg, err := reconciliation.AnomalyConfigFromEnv()
+	if err != nil {
+		log.Fatalf("Invalid anomaly config: %v", err)
+	}
+	alertNotifier := notify.NewAlertNotifierFromEnv(notify.NewMailerFromEnv(), contactRepo)
+	reconSvc.SetAnomalyDetection(alertRepo, anomalyCfg, alertNotifier)
+	ingestionSvc.SetAlertNotifier(alertNotifier)
+
+	// Email the owners routing rules assign new discrepancies to, when
+	// SMTP_ADDR is set.
+	reconSvc.SetAssignmentNotifier(notify.NewAssignmentNotifier(notify.NewMailerFromEnv(), contactRepo))
+
+	// Score match suggestions for orphaned settlement records.
+	suggestionCfg, err := reconciliation.SuggestionConfigFromEnv()
+	if err != nil {
+		log.Fatalf("Invalid match suggestion config: %v", err)
+	}
+	reconSvc.SetSuggestionConfig(suggestionCfg)
+
+	// Hold the transactions of large batches pending approval.
+	approvalRules, err := reconciliation.BatchApprovalRulesFromEnv()
+	if err != nil {
+		log.Fatalf("Invalid batch approval config: %v", err)
+	}
+	reconSvc.SetBatchApprovalRules(approvalRules)
 
-	// Seed transactions if DB is empty.
+	// Group discrepancies sharing a batch, or a merchant and type, into
+	// cases.
+	caseGrouping, err := reconciliation.CaseGroupingFromEnv()
+	if err != nil {
+		log.Fatalf("Invalid case grouping config: %v", err)
+	}
+	reconSvc.SetCaseGrouping(caseGrouping)
+
+	// Tag, and resolve, amount mismatches that are only rounding.
+	rounding, err := reconciliation.RoundingFromEnv()
+	if err != nil {
+		log.Fatalf("Invalid rounding config: %v", err)
+	}
+	reconSvc.SetRounding(rounding)
+
+	// Let consecutive ingests share one reconciliation run.
+	debounce, err := reconciliation.DebounceFromEnv()
+	if err != nil {
+		log.Fatalf("Invalid reconciliation debounce: %v", err)
+	}
+	if debounce > 0 {
+		reconSvc.SetDebounce(debounce)
+		log.Printf("Reconciliation after ingest is debounced by %s", debounce)
+	}
+
+	poolCfg, err := ingestion.PoolConfigFromEnv()
+	if err != nil {
+		log.Fatalf("Invalid ingestion pool config: %v", err)
+	}
+	externalParsers, err := ingestion.ExternalParsersFromEnv()
+	if err != nil {
+		log.Fatalf("Invalid external parser config: %v", err)
+	}
+	ingestion.RegisterExternalParsers(externalParsers)
+	for _, proc := range ingestion.ExternalParserProcessors() {
+		log.Printf("External parser for %s: %s", proc, externalParsers[proc])
+	}
+	decryptionKeys, err := ingestion.DecryptionKeysFromEnv()
+	if err != nil {
+		log.Fatalf("Invalid PGP decryption key config: %v", err)
+	}
+	ingestion.RegisterDecryptionKeys(decryptionKeys)
+	for _, proc := range ingestion.DecryptionKeyProcessors() {
+		log.Printf("PGP-encrypted reports from %s are decrypted with key %s",
+			proc, strings.Join(ingestion.DecryptionKeyIDs(proc), ", "))
+	}
+	verification, err := ingestion.VerificationFromEnv()
+	if err != nil {
+		log.Fatalf("Invalid report verification config: %v", err)
+	}
+	ingestion.RegisterVerification(verification)
+	for _, proc := range ingestion.SigningKeyProcessors() {
+		log.Printf("Report signatures from %s are checked against key %s",
+			proc, strings.Join(ingestion.SigningKeyIDs(proc), ", "))
+	}
+	for proc := range verification.Required {
+		log.Printf("Reports from %s are rejected without a checksum or signature file", proc)
+	}
+	numberFormats, err := ingestion.NumberFormatsFromEnv()
+	if err != nil {
+		log.Fatalf("Invalid amount format config: %v", err)
+	}
+	ingestion.RegisterNumberFormats(numberFormats)
+	for proc, f := range numberFormats {
+		log.Printf("Amounts for %s are read in %s number format", proc, f)
+	}
+	amountUnits, err := ingestion.AmountUnitsFromEnv()
+	if err != nil {
+		log.Fatalf("Invalid amount unit config: %v", err)
+	}
+	ingestion.RegisterAmountUnits(amountUnits)
+	for proc, u := range amountUnits {
+		log.Printf("Amounts for %s are read in %s units", proc, u)
+	}
+	withholdingRates, err := ingestion.WithholdingRatesFromEnv()
+	if err != nil {
+		log.Fatalf("Invalid withholding tax config: %v", err)
+	}
+	ingestion.RegisterWithholdingRates(withholdingRates)
+	for country, rate := range withholdingRates {
+		log.Printf("Tax withheld on fees in %s is checked at %.4g%%", country, rate*100)
+	}
+	amountPolicies, err := ingestion.AmountPoliciesFromEnv()
+	if err != nil {
+		log.Fatalf("Invalid amount policy config: %v", err)
+	}
+	ingestion.RegisterAmountPolicies(amountPolicies)
+	for proc, p := range amountPolicies {
+		log.Printf("Amount policy for %s: negative=%s zero=%s", proc, p.Negative, p.Zero)
+	}
+	settlementDays, err := ingestion.SettlementDaysFromEnv()
+	if err != nil {
+		log.Fatalf("Invalid settlement days: %v", err)
+	}
+	ingestion.RegisterSettlementDays(settlementDays)
+	for proc, d := range settlementDays {
+		log.Printf("Batches from %s are expected on %s", proc, d)
+	}
+
+	ingestPool := ingestion.NewPool(ingestionSvc, poolCfg)
+	deadLetterRepo := repository.NewDeadLetterRepo(db)
+	if blobStore != nil {
+		deadLetterRepo.SetBlobStore(blobStore)
+	}
+	ingestPool.SetDeadLetters(deadLetterRepo)
+	ingestPool.Start(context.Background())
+
+	// Seed transactions if DB is empty, unless a purge emptied it.
 	count, err := txnRepo.Count()
 	if err != nil {
 		log.Fatalf("Failed to count transactions: %v", err)
 	}
-	if count == 0 {
+	retentionRepo := repository.NewRetentionRepo(db)
+	if blobStore != nil {
+		retentionRepo.SetBlobStore(blobStore)
+	}
+	purges, err := retentionRepo.CountReports()
+	if err != nil {
+		log.Fatalf("Failed to count purge reports: %v", err)
+	}
+	if count == 0 && purges > 0 {
+		log.Printf("Database has no transactions after %d purges, skipping seed", purges)
+	} else if count == 0 {
 		log.Println("Database is empty, seeding transactions from testdata...")
 		if err := seedTransactions(txnRepo); err != nil {
 			log.Printf("WARNING: Failed to seed transactions: %v", err)
@@ -55,9 +353,230 @@ func main() {
 	} else {
 		log.Printf("Database already has %d transactions, skipping seed", count)
 	}
+	if n, err := txnRepo.CountQuarantined(); err != nil {
+		log.Fatalf("Failed to count quarantined transactions: %v", err)
+	} else if n > 0 {
+		log.Printf("WARNING: %d transactions reusing a processor reference are quarantined; review them at GET /api/v1/transactions/quarantined", n)
+	}
+
+	// Background jobs run on every instance, or with leader election only on
+	// the instance holding the scheduler lease.
+	leaderCfg, err := leader.ConfigFromEnv()
+	if err != nil {
+		log.Fatalf("Invalid leader election config: %v", err)
+	}
+	var elector *leader.Elector
+	if leaderCfg != nil {
+		elector = leader.NewElector(repository.NewLeaseRepo(db), *leaderCfg)
+	}
+	background := func(name string, run func(context.Context)) {
+		if elector != nil {
+			elector.Go(name, run)
+			return
+		}
+		go run(context.Background())
+	}
+
+	// Start the email digest scheduler if configured.
+	digestCfg, err := digest.ConfigFromEnv()
+	if err != nil {
+		log.Fatalf("Invalid digest config: %v", err)
+	}
+	var digestSvc *digest.Service
+	if digestCfg != nil {
+		mailer := notify.NewMailerFromEnv()
+		if mailer == nil {
+			log.Printf("WARNING: DIGEST_RECIPIENTS set but SMTP_ADDR is not; digests disabled")
+		} else {
+			digestSvc = digest.NewService(txnRepo, settRepo, discRepo, mailer, digestCfg)
+			background("digest", digestSvc.Run)
+		}
+	}
+
+	// Start polling processor APIs if any connector is configured.
+	connectorRunner, err := newConnectorRunner(ingestionSvc, connectorRepo)
+	if err != nil {
+		log.Fatalf("Invalid connector config: %v", err)
+	}
+	if connectorRunner != nil {
+		background("connectors", connectorRunner.Run)
+	}
+
+	// Start polling the report mailbox if configured.
+	mailPoller, err := mailbox.NewPollerFromEnv(ingestPool, connectorRepo)
+	if err != nil {
+		log.Fatalf("Invalid mailbox config: %v", err)
+	}
+	if mailPoller != nil {
+		background("mailbox", mailPoller.Run)
+	}
+
+	// Sync serious discrepancies with Jira issues if configured.
+	jiraCfg, err := jira.ConfigFromEnv()
+	if err != nil {
+		log.Fatalf("Invalid Jira config: %v", err)
+	}
+	var jiraSync *jira.Syncer
+	if jiraCfg != nil {
+		jiraSync = jira.NewSyncer(jiraCfg, repository.NewUnitOfWork(db), repository.NewJiraIssueRepo(db), contactRepo)
+		reconSvc.SetJiraSync(jiraSync)
+		background("jira", jiraSync.Run)
+	}
+
+	for _, st := range retry.All() {
+		circuit := "the circuit never opens"
+		if st.Policy.BreakerThreshold > 0 {
+			circuit = fmt.Sprintf("%d consecutive failures open the circuit for %s", st.Policy.BreakerThreshold, st.Policy.BreakerCooldown)
+		}
+		log.Printf("Calls to %s are tried %d times, backing off from %s to at most %s; %s",
+			st.Name, st.Policy.Attempts, st.Policy.Backoff, st.Policy.MaxBackoff, circuit)
+	}
 
 	// Create router.
-	router := api.NewRouter(txnRepo, settRepo, discRepo, ingestionSvc)
+	// Users allowed to call admin-only endpoints (X-User-ID).
+	admins := api.ParseAdminUsers(os.Getenv("ADMIN_USER_IDS"))
+	// Processors allowed to push settlement events, with their signing secrets.
+	webhookSecrets := api.ParseWebhookSecrets(os.Getenv("WEBHOOK_SECRETS"))
+
+	// Save and restore whole-database snapshots when a directory or a blob
+	// store is configured.
+	var snapshotRepo *repository.SnapshotRepo
+	snapshotDir := os.Getenv("SNAPSHOT_DIR")
+	if blobStore != nil {
+		snapshotRepo = repository.NewBlobSnapshotRepo(db, blobStore, snapshotDir)
+	} else if snapshotDir != "" {
+		snapshotRepo = repository.NewSnapshotRepo(db, snapshotDir)
+	}
+
+	// Checkpoint the WAL and refresh planner statistics on a schedule,
+	// vacuuming in the quiet window when one is configured.
+	maintCfg, err := maintenance.ConfigFromEnv()
+	if err != nil {
+		log.Fatalf("Invalid maintenance config: %v", err)
+	}
+	walPath := dbPath
+	if dbPath == ":memory:" {
+		walPath = ""
+	}
+	var maintSvc *maintenance.Service
+	if maintCfg != nil {
+		maintSvc = maintenance.NewService(db, walPath, maintCfg)
+		background("maintenance", maintSvc.Run)
+	}
+	if elector != nil {
+		log.Printf("Leader election on: instance %s runs background jobs while it holds the %s lease (TTL %s)",
+			elector.InstanceID(), leader.LeaseName, leaderCfg.TTL)
+		go elector.Run(context.Background())
+	}
+
+	var encryptionRepo *repository.EncryptionRepo
+	if columnKeys != nil {
+		encryptionRepo = repository.NewEncryptionRepo(db)
+		if blobStore != nil {
+			encryptionRepo.SetBlobStore(blobStore)
+		}
+		status, err := encryptionRepo.Status()
+		if err != nil {
+			log.Fatalf("Failed to check column encryption: %v", err)
+		}
+		if status.Pending > 0 {
+			log.Printf("WARNING: %d processor references are not encrypted with key %s; run POST /api/v1/admin/encryption/rotate", status.Pending, status.ActiveKey)
+		}
+	}
+
+	// Purge data past its retention on request; cmd/purge does the same
+	// from cron.
+	retentionPolicy, err := retention.PolicyFromEnv()
+	if err != nil {
+		log.Fatalf("Invalid retention policy: %v", err)
+	}
+	if retentionPolicy != nil {
+		log.Printf("Retention policy: %s after %d days (by processor: %v)", retentionPolicy.Mode, retentionPolicy.Days, retentionPolicy.ByProcessor)
+	}
+
+	// ETags on the dashboard and summary endpoints.
+	dataVersion, err := repository.NewDataVersion(db)
+	if err != nil {
+		log.Fatalf("Failed to init data version: %v", err)
+	}
+
+	router := api.NewRouter(api.Deps{
+		TxnRepo:        txnRepo,
+		SettRepo:       settRepo,
+		DiscRepo:       discRepo,
+		TolRepo:        tolRepo,
+		FilterRepo:     filterRepo,
+		ViewRepo:       viewRepo,
+		AlertRepo:      alertRepo,
+		IdemRepo:       idemRepo,
+		CertRepo:       certRepo,
+		PeriodRepo:     periodRepo,
+		TransformRepo:  transformRepo,
+		RuleFlagRepo:   ruleFlagRepo,
+		RoutingRepo:    routingRepo,
+		CaseRepo:       repository.NewCaseRepo(db),
+		ContactRepo:    contactRepo,
+		ReconSvc:       reconSvc,
+		IngestionSvc:   ingestionSvc,
+		IngestPool:     ingestPool,
+		Connectors:     connectorRunner,
+		Mailbox:        mailPoller,
+		JiraSync:       jiraSync,
+		Admins:         admins,
+		WebhookSecrets: webhookSecrets,
+		Snapshots:      snapshotRepo,
+		Maintenance:    maintSvc,
+		Encryption:     encryptionRepo,
+		RetentionRepo:  retentionRepo,
+		Retention:      retentionPolicy,
+		Diagnostics:    repository.NewDiagnosticsRepo(db, walPath),
+		Versions:       dataVersion,
+		Elector:        elector,
+		Reloader:       reloader,
+		Feed:           feed,
+	})
+
+	// Reload the config file on SIGHUP, or on POST /admin/config/reload.
+	if reloader != nil {
+		registerReloads(reloader, reconSvc, ingestionSvc, digestSvc, connectorRunner, maintSvc, jiraSync, contactRepo)
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		go func() {
+			for range hup {
+				reloader.Reload("SIGHUP")
+			}
+		}()
+	}
+
+	// Serve a separate training dataset under /sandbox when configured.
+	var handler http.Handler = router
+	sandboxPath := os.Getenv("SANDBOX_DB_PATH")
+	if sandboxPath != "" {
+		if sandboxPath != ":memory:" && filepath.Clean(sandboxPath) == filepath.Clean(dbPath) {
+			log.Fatalf("SANDBOX_DB_PATH must not be the same database as DB_PATH")
+		}
+		sandboxDB, sandboxRouter, err := newSandboxRouter(sandboxPath, admins, tolerances)
+		if err != nil {
+			log.Fatalf("Failed to init sandbox: %v", err)
+		}
+		defer sandboxDB.Close()
+
+		mux := http.NewServeMux()
+		mux.Handle("/sandbox/", http.StripPrefix("/sandbox", sandboxRouter))
+		mux.Handle("/", router)
+		handler = mux
+	}
+
+	// CORS for the browser dashboard and gzip/deflate responses, for both
+	// the production and sandbox APIs.
+	httpCfg, err := api.HTTPConfigFromEnv()
+	if err != nil {
+		log.Fatalf("Invalid HTTP config: %v", err)
+	}
+	handler = httpCfg.Wrap(handler)
+	if len(httpCfg.AllowedOrigins) > 0 {
+		log.Printf("CORS allowed origins: %s", strings.Join(httpCfg.AllowedOrigins, ", "))
+	}
 
 	log.Printf("Wakala Cross-Border Settlement Reconciler")
 	log.Printf("Listening on http://localhost:%s", port)
@@ -65,19 +584,396 @@ func main() {
 	log.Printf("")
 	log.Printf("Endpoints:")
 	log.Printf("  POST   /api/v1/reports/ingest")
+	log.Printf("  POST   /api/v1/reports/ingest/batch")
+	log.Printf("  POST   /api/v1/reports/preview")
+	log.Printf("  POST   /api/v1/validate-file")
+	log.Printf("  GET    /api/v1/reports/jobs/{id}")
+	log.Printf("  GET    /api/v1/reports/dead-letters")
+	log.Printf("  GET    /api/v1/reports/dead-letters/{id}")
+	log.Printf("  GET    /api/v1/reports/dead-letters/{id}/raw")
+	log.Printf("  POST   /api/v1/reports/dead-letters/{id}/retry")
+	log.Printf("  POST   /api/v1/reports/dead-letters/{id}/discard")
+	log.Printf("  GET    /api/v1/reports/{id}")
+	log.Printf("  GET    /api/v1/connectors")
+	log.Printf("  POST   /api/v1/connectors/{name}/pull")
+	log.Printf("  GET    /api/v1/mailbox")
+	log.Printf("  POST   /api/v1/mailbox/poll")
+	log.Printf("  POST   /api/v1/webhooks/jira")
+	log.Printf("  GET    /api/v1/admin/jira")
+	log.Printf("  POST   /api/v1/admin/jira/sync")
+	log.Printf("  POST   /api/v1/reconciliation/run")
+	log.Printf("  GET    /api/v1/reconciliation/pending")
+	log.Printf("  POST   /api/v1/reconciliation/flush")
 	log.Printf("  GET    /api/v1/transactions")
+	log.Printf("  GET    /api/v1/transactions/export")
+	log.Printf("  GET    /api/v1/transactions/quarantined")
+	log.Printf("  DELETE /api/v1/transactions/quarantined/{id}")
 	log.Printf("  GET    /api/v1/transactions/{id}/settlement-status")
+	log.Printf("  POST   /api/v1/transactions/{id}/amendments")
+	log.Printf("  GET    /api/v1/transactions/{id}/amendments")
+	log.Printf("  GET    /api/v1/transfers")
+	log.Printf("  GET    /api/v1/transfers/{id}")
 	log.Printf("  GET    /api/v1/discrepancies")
+	log.Printf("  GET    /api/v1/discrepancies/export")
 	log.Printf("  GET    /api/v1/discrepancies/summary")
+	log.Printf("  GET    /api/v1/discrepancies/{id}")
+	log.Printf("  POST   /api/v1/discrepancies/{id}/tags")
+	log.Printf("  DELETE /api/v1/discrepancies/{id}/tags/{tag}")
+	log.Printf("  GET    /api/v1/discrepancies/{id}/activity")
+	log.Printf("  GET    /api/v1/discrepancies/{id}/investigate")
+	log.Printf("  POST   /api/v1/discrepancies/recalculate-severity")
+	log.Printf("  GET    /api/v1/cases")
+	log.Printf("  POST   /api/v1/cases")
+	log.Printf("  GET    /api/v1/cases/{id}")
+	log.Printf("  POST   /api/v1/cases/{id}/discrepancies")
+	log.Printf("  DELETE /api/v1/cases/{id}/discrepancies/{discID}")
+	log.Printf("  POST   /api/v1/cases/{id}/resolve")
+	log.Printf("  POST   /api/v1/cases/{id}/reopen")
+	log.Printf("  GET    /api/v1/saved-filters")
+	log.Printf("  POST   /api/v1/saved-filters")
+	log.Printf("  DELETE /api/v1/saved-filters/{id}")
+	log.Printf("  GET    /api/v1/views")
+	log.Printf("  POST   /api/v1/views")
+	log.Printf("  GET    /api/v1/views/{id}")
+	log.Printf("  PUT    /api/v1/views/{id}")
+	log.Printf("  DELETE /api/v1/views/{id}")
 	log.Printf("  GET    /api/v1/settlements")
+	log.Printf("  GET    /api/v1/settlements/export")
+	log.Printf("  GET    /api/v1/settlements/unmatched")
+	log.Printf("  GET    /api/v1/settlements/unmatched/feedback")
+	log.Printf("  PATCH  /api/v1/settlements/{id}")
+	log.Printf("  GET    /api/v1/settlements/{id}/corrections")
+	log.Printf("  POST   /api/v1/settlements/{id}/suggestions/{txnID}/accept")
+	log.Printf("  POST   /api/v1/settlements/{id}/suggestions/{txnID}/reject")
+	log.Printf("  GET    /api/v1/batches")
+	log.Printf("  GET    /api/v1/batches/approvals")
+	log.Printf("  GET    /api/v1/batches/balances")
+	log.Printf("  POST   /api/v1/batches/{processor}/{batchID}/approve")
+	log.Printf("  GET    /api/v1/batches/{processor}/{batchID}")
+	log.Printf("  POST   /api/v1/batches/{processor}/{batchID}/certificates")
+	log.Printf("  GET    /api/v1/batches/{processor}/{batchID}/certificates")
+	log.Printf("  GET    /api/v1/certificates/{id}")
+	log.Printf("  POST   /api/v1/certificates/{id}/sign-off")
+	log.Printf("  GET    /api/v1/alerts")
 	log.Printf("  GET    /api/v1/dashboard")
+	log.Printf("  GET    /api/v1/dashboard/top-offenders")
+	log.Printf("  GET    /api/v1/dashboard/live (WebSocket)")
+	log.Printf("  GET    /api/v1/periods")
+	log.Printf("  GET    /api/v1/periods/{period}")
+	log.Printf("  POST   /api/v1/periods/{period}/close")
+	log.Printf("  POST   /api/v1/periods/{period}/reopen")
+	log.Printf("  GET    /api/v1/adjustments")
+	log.Printf("  POST   /api/v1/adjustments/{id}/approve")
+	log.Printf("  POST   /api/v1/adjustments/{id}/reject")
+	log.Printf("  GET    /api/v1/analytics/discrepancy-flow")
+	log.Printf("  GET    /api/v1/analytics/fees")
+	log.Printf("  GET    /api/v1/analytics/mismatch-deltas")
+	log.Printf("  GET    /api/v1/merchants/tolerances")
+	log.Printf("  GET    /api/v1/merchants/payout-holds")
+	log.Printf("  GET    /api/v1/merchants/{id}/payout-hold")
+	log.Printf("  PUT    /api/v1/merchants/{id}/tolerance")
+	log.Printf("  DELETE /api/v1/merchants/{id}/tolerance")
+	log.Printf("  POST   /api/v1/webhooks/{processor}/settlements")
+	log.Printf("  GET    /api/v1/transforms")
+	log.Printf("  GET    /api/v1/transforms/{processor}")
+	log.Printf("  PUT    /api/v1/transforms/{processor}")
+	log.Printf("  DELETE /api/v1/transforms/{processor}")
+	log.Printf("  GET    /api/v1/processor-contacts")
+	log.Printf("  GET    /api/v1/processor-contacts/{processor}")
+	log.Printf("  PUT    /api/v1/processor-contacts/{processor}")
+	log.Printf("  DELETE /api/v1/processor-contacts/{processor}")
+	log.Printf("  GET    /api/v1/admin/rules")
+	log.Printf("  PUT    /api/v1/admin/rules/{rule}")
+	log.Printf("  DELETE /api/v1/admin/rules/{rule}")
+	if snapshotRepo != nil {
+		log.Printf("  GET    /api/v1/admin/snapshots")
+		log.Printf("  POST   /api/v1/admin/snapshots")
+		log.Printf("  POST   /api/v1/admin/snapshots/{name}/restore")
+	}
+	if maintSvc != nil {
+		log.Printf("  GET    /api/v1/admin/maintenance")
+		log.Printf("  POST   /api/v1/admin/maintenance/run")
+	}
+	log.Printf("  GET    /api/v1/admin/config-bundle")
+	log.Printf("  PUT    /api/v1/admin/config-bundle")
+	if reloader != nil {
+		log.Printf("  GET    /api/v1/admin/config")
+		log.Printf("  POST   /api/v1/admin/config/reload")
+	}
+	if encryptionRepo != nil {
+		log.Printf("  GET    /api/v1/admin/encryption")
+		log.Printf("  POST   /api/v1/admin/encryption/rotate")
+	}
+	log.Printf("  GET    /api/v1/admin/diagnostics")
+	log.Printf("  GET    /metrics")
+	log.Printf("  POST   /api/v1/admin/rebuild")
+	log.Printf("  GET    /api/v1/admin/retention")
+	log.Printf("  GET    /api/v1/admin/retention/reports")
+	if retentionPolicy != nil {
+		log.Printf("  POST   /api/v1/admin/retention/purge")
+	}
+	if sandboxPath != "" {
+		log.Printf("")
+		log.Printf("Sandbox (%s): the same API under /sandbox/api/v1, plus", sandboxPath)
+		log.Printf("  POST   /sandbox/api/v1/simulate")
+	}
 
-	if err := http.ListenAndServe(":"+port, router); err != nil {
+	if err := http.ListenAndServe(":"+port, handler); err != nil {
 		log.Fatalf("Server failed: %v", err)
 	}
 }
 
+// newSandboxRouter opens the sandbox database and builds a complete,
+// separate API on it. Connectors, digests and seeding are not started for the
+// sandbox; its data comes from POST /simulate or manual uploads.
+func newSandboxRouter(path string, admins map[string]bool, tolerances reconciliation.Tolerances) (*sql.DB, http.Handler, error) {
+	db, err := repository.InitDB(path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	txnRepo := repository.NewTransactionRepo(db)
+	settRepo := repository.NewSettlementRepo(db)
+	discRepo := repository.NewDiscrepancyRepo(db)
+	tolRepo := repository.NewToleranceRepo(db)
+	alertRepo := repository.NewAlertRepo(db)
+	periodRepo := repository.NewPeriodRepo(db)
+	transformRepo := repository.NewTransformRepo(db)
+	ruleFlagRepo := repository.NewRuleFlagRepo(db)
+	routingRepo := repository.NewRoutingRuleRepo(db)
+
+	uow := repository.NewUnitOfWork(db)
+	reconSvc := reconciliation.NewService(txnRepo, settRepo, discRepo, tolRepo, uow)
+	reconSvc.SetTolerances(tolerances)
+	ingestionSvc := ingestion.NewService(settRepo, txnRepo, discRepo, alertRepo, periodRepo, transformRepo, reconSvc, uow)
+	ingestPool := ingestion.NewPool(ingestionSvc, ingestion.PoolConfig{Workers: 1})
+	ingestPool.SetDeadLetters(repository.NewDeadLetterRepo(db))
+	ingestPool.Start(context.Background())
+
+	log.Printf("Sandbox database at %s", path)
+	return db, api.NewRouter(api.Deps{
+		TxnRepo:       txnRepo,
+		SettRepo:      settRepo,
+		DiscRepo:      discRepo,
+		TolRepo:       tolRepo,
+		FilterRepo:    repository.NewSavedFilterRepo(db),
+		ViewRepo:      repository.NewDashboardViewRepo(db),
+		AlertRepo:     alertRepo,
+		IdemRepo:      repository.NewIdempotencyRepo(db),
+		CertRepo:      repository.NewCertificateRepo(db),
+		PeriodRepo:    periodRepo,
+		TransformRepo: transformRepo,
+		RuleFlagRepo:  ruleFlagRepo,
+		RoutingRepo:   routingRepo,
+		CaseRepo:      repository.NewCaseRepo(db),
+		ContactRepo:   repository.NewProcessorContactRepo(db),
+		ReconSvc:      reconSvc,
+		IngestionSvc:  ingestionSvc,
+		IngestPool:    ingestPool,
+		Admins:        admins,
+		SandboxDB:     db,
+	}), nil
+}
+
+// registerReloads lets a config reload change the settings of the running
+// subsystems: tolerances and alert thresholds, where notifications go, and
+// the digest, connector, maintenance and Jira schedules. A subsystem that is off
+// stays off, and one that is on stays on, until a restart.
+func registerReloads(reloader *config.Reloader, reconSvc *reconciliation.Service, ingestionSvc *ingestion.Service,
+	digestSvc *digest.Service, connectorRunner *connector.Runner, maintSvc *maintenance.Service, jiraSync *jira.Syncer,
+	contactRepo *repository.ProcessorContactRepo) {
+	smtpKeys := []string{"SMTP_ADDR", "SMTP_USERNAME", "SMTP_PASSWORD", "SMTP_FROM"}
+
+	reloader.Register(config.Subsystem{
+		Name: "reconciliation",
+		Keys: []string{
+			"MISMATCH_PCT_TOLERANCE", "MISMATCH_ABS_TOLERANCE_USD", "SETTLEMENT_WINDOW_HOURS", "FEE_SCHEDULE_VERSION",
+			"SEVERITY_HIGH_USD", "SEVERITY_MEDIUM_USD", "SEVERITY_CRITICAL_DIFF_USD", "SEVERITY_HIGH_DIFF_PCT",
+			"ANOMALY_VOLUME_DROP_PCT", "ANOMALY_ORPHAN_RATE_PCT", "ANOMALY_TRAILING_DAYS", "ANOMALY_MIN_RECORDS",
+			"MATCH_SUGGESTION_WEIGHTS", "MATCH_SUGGESTION_MIN_SCORE",
+			"PAYOUT_HOLD_MIN_SEVERITY", "PAYOUT_HOLD_THRESHOLD_USD",
+			"BATCH_APPROVAL_MIN_RECORDS", "BATCH_APPROVAL_MIN_USD", "CASE_AUTO_GROUP_MIN",
+			"ROUNDING_MAX_USD", "ROUNDING_AUTO_RESOLVE",
+		},
+		Prepare: func() (func(), error) {
+			tolerances, err := reconciliation.TolerancesFromEnv()
+			if err != nil {
+				return nil, err
+			}
+			rules, err := reconciliation.SeverityRulesFromEnv()
+			if err != nil {
+				return nil, err
+			}
+			anomaly, err := reconciliation.AnomalyConfigFromEnv()
+			if err != nil {
+				return nil, err
+			}
+			suggestions, err := reconciliation.SuggestionConfigFromEnv()
+			if err != nil {
+				return nil, err
+			}
+			holds, err := reconciliation.PayoutHoldConfigFromEnv()
+			if err != nil {
+				return nil, err
+			}
+			approvals, err := reconciliation.BatchApprovalRulesFromEnv()
+			if err != nil {
+				return nil, err
+			}
+			cases, err := reconciliation.CaseGroupingFromEnv()
+			if err != nil {
+				return nil, err
+			}
+			rounding, err := reconciliation.RoundingFromEnv()
+			if err != nil {
+				return nil, err
+			}
+			return func() {
+				reconSvc.Reconfigure(reconciliation.Settings{
+					Tolerances: tolerances, Severity: rules, Anomaly: anomaly, Suggestions: suggestions, PayoutHolds: holds, Approvals: approvals,
+					Cases: cases, Rounding: rounding,
+				})
+				if _, err := reconSvc.RecalculateSeverities("system"); err != nil {
+					log.Printf("WARNING: severity recalculation failed: %v", err)
+				}
+			}, nil
+		},
+	})
+
+	reloader.Register(config.Subsystem{
+		Name: "notifications",
+		Keys: append([]string{"ALERT_RECIPIENTS", "SETTLEMENT_WEBHOOK_URL", "SETTLEMENT_WEBHOOK_SECRET"}, smtpKeys...),
+		Prepare: func() (func(), error) {
+			alertNotifier := notify.NewAlertNotifierFromEnv(notify.NewMailerFromEnv(), contactRepo)
+			assignNotifier := notify.NewAssignmentNotifier(notify.NewMailerFromEnv(), contactRepo)
+			webhook := notify.NewWebhookSenderFromEnv()
+			return func() {
+				reconSvc.SetNotifications(alertNotifier, webhook)
+				reconSvc.SetAssignmentNotifier(assignNotifier)
+				ingestionSvc.SetAlertNotifier(alertNotifier)
+			}, nil
+		},
+	})
+
+	if digestSvc != nil {
+		reloader.Register(config.Subsystem{
+			Name: "digest",
+			Keys: append([]string{"DIGEST_RECIPIENTS", "DIGEST_SCHEDULE", "DIGEST_HOUR", "DIGEST_WEEKDAY", "DIGEST_HTML", "DIGEST_ATTACH_CSV"}, smtpKeys...),
+			Prepare: func() (func(), error) {
+				cfg, err := digest.ConfigFromEnv()
+				if err != nil {
+					return nil, err
+				}
+				if cfg == nil {
+					return nil, fmt.Errorf("DIGEST_RECIPIENTS cannot be removed without a restart")
+				}
+				mailer := notify.NewMailerFromEnv()
+				if mailer == nil {
+					return nil, fmt.Errorf("SMTP_ADDR cannot be removed while digests are sent; remove DIGEST_RECIPIENTS and restart")
+				}
+				return func() { digestSvc.Reconfigure(mailer, cfg) }, nil
+			},
+		})
+	}
+
+	if connectorRunner != nil {
+		reloader.Register(config.Subsystem{
+			Name: "connectors",
+			Keys: []string{"CONNECTOR_POLL_INTERVAL"},
+			Prepare: func() (func(), error) {
+				interval, err := connector.IntervalFromEnv()
+				if err != nil {
+					return nil, err
+				}
+				return func() { connectorRunner.SetInterval(interval) }, nil
+			},
+		})
+	}
+
+	if maintSvc != nil {
+		reloader.Register(config.Subsystem{
+			Name: "maintenance",
+			Keys: []string{"DB_MAINTENANCE_INTERVAL", "DB_VACUUM_WINDOW", "DB_VACUUM_MIN_FREE_PCT"},
+			Prepare: func() (func(), error) {
+				cfg, err := maintenance.ConfigFromEnv()
+				if err != nil {
+					return nil, err
+				}
+				if cfg == nil {
+					return nil, fmt.Errorf("DB_MAINTENANCE_INTERVAL cannot be turned off without a restart")
+				}
+				return func() { maintSvc.SetConfig(cfg) }, nil
+			},
+		})
+	}
+
+	if jiraSync != nil {
+		reloader.Register(config.Subsystem{
+			Name: "jira",
+			Keys: []string{
+				"JIRA_BASE_URL", "JIRA_EMAIL", "JIRA_API_TOKEN", "JIRA_PROJECT", "JIRA_ISSUE_TYPE", "JIRA_LABELS",
+				"JIRA_MIN_SEVERITY", "JIRA_PRIORITIES", "JIRA_RESOLVED_STATUSES", "JIRA_RESOLVE_TRANSITION",
+				"JIRA_REOPEN_TRANSITION", "JIRA_WEBHOOK_SECRET", "JIRA_SYNC_INTERVAL", "JIRA_MAX_ISSUES_PER_SYNC",
+			},
+			Prepare: func() (func(), error) {
+				cfg, err := jira.ConfigFromEnv()
+				if err != nil {
+					return nil, err
+				}
+				if cfg == nil {
+					return nil, fmt.Errorf("JIRA_BASE_URL cannot be removed without a restart")
+				}
+				return func() { jiraSync.SetConfig(cfg) }, nil
+			},
+		})
+	}
+}
+
+// newConnectorRunner returns a runner for every processor API connector
+// configured in the environment, or nil if there are none.
+func newConnectorRunner(ingestionSvc *ingestion.Service, repo *repository.ConnectorRepo) (*connector.Runner, error) {
+	var connectors []connector.Connector
+
+	ng, err := connector.NewNairaGatewayFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	if ng != nil {
+		connectors = append(connectors, ng)
+	}
+
+	if len(connectors) == 0 {
+		return nil, nil
+	}
+	interval, err := connector.IntervalFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	return connector.NewRunner(ingestionSvc, repo, interval, connectors...), nil
+}
+
+func loadRateHistory(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	n, err := currency.LoadRateHistory(f)
+	if err != nil {
+		return err
+	}
+	log.Printf("Loaded %d historical FX rates from %s", n, path)
+	return nil
+}
+
 func seedTransactions(repo *repository.TransactionRepo) error {
+	// SEED_TRANSACTIONS_FILE names the only file to seed from, e.g. the
+	// transactions of a processor sandbox started with another seed.
+	if path := os.Getenv("SEED_TRANSACTIONS_FILE"); path != "" {
+		return seedTransactionsFrom(repo, []string{path})
+	}
+
 	// Try multiple possible locations for testdata.
 	candidates := []string{
 		"testdata/transactions.json",
@@ -92,7 +988,12 @@ func seedTransactions(repo *repository.TransactionRepo) error {
 			filepath.Join(dir, "..", "..", "testdata", "transactions.json"),
 		)
 	}
+	return seedTransactionsFrom(repo, candidates)
+}
 
+// seedTransactionsFrom inserts the transactions of the first of candidates
+// that can be read.
+func seedTransactionsFrom(repo *repository.TransactionRepo, candidates []string) error {
 	var data []byte
 	var loadErr error
 	for _, path := range candidates {
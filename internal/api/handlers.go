@@ -1,26 +1,102 @@
 package api
 
 import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/csv"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"log"
 	"math"
+	"mime"
+	"mime/multipart"
 	"net/http"
+	"net/mail"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/go-chi/chi/v5"
 
+	"github.com/wakala/reconciler/internal/config"
+	"github.com/wakala/reconciler/internal/connector"
+	"github.com/wakala/reconciler/internal/currency"
+	"github.com/wakala/reconciler/internal/domain"
 	"github.com/wakala/reconciler/internal/ingestion"
+	"github.com/wakala/reconciler/internal/jira"
+	"github.com/wakala/reconciler/internal/leader"
+	"github.com/wakala/reconciler/internal/live"
+	"github.com/wakala/reconciler/internal/mailbox"
+	"github.com/wakala/reconciler/internal/maintenance"
+	"github.com/wakala/reconciler/internal/notify"
+	"github.com/wakala/reconciler/internal/pdf"
+	"github.com/wakala/reconciler/internal/reconciliation"
 	"github.com/wakala/reconciler/internal/repository"
+	"github.com/wakala/reconciler/internal/retention"
+	"github.com/wakala/reconciler/internal/retry"
+	"github.com/wakala/reconciler/internal/testgen"
 )
 
 // Handlers groups all HTTP handler methods and their dependencies.
 type Handlers struct {
-	txnRepo      *repository.TransactionRepo
-	settRepo     *repository.SettlementRepo
-	discRepo     *repository.DiscrepancyRepo
-	ingestionSvc *ingestion.Service
+	txnRepo       *repository.TransactionRepo
+	settRepo      *repository.SettlementRepo
+	discRepo      *repository.DiscrepancyRepo
+	tolRepo       *repository.ToleranceRepo
+	filterRepo    *repository.SavedFilterRepo
+	viewRepo      *repository.DashboardViewRepo
+	alertRepo     *repository.AlertRepo
+	certRepo      *repository.CertificateRepo
+	periodRepo    *repository.PeriodRepo
+	transformRepo *repository.TransformRepo
+	ruleFlagRepo  *repository.RuleFlagRepo
+	routingRepo   *repository.RoutingRuleRepo
+	caseRepo      *repository.CaseRepo
+	contactRepo   *repository.ProcessorContactRepo
+	reconSvc      *reconciliation.Service
+	ingestionSvc  *ingestion.Service
+	ingestPool    *ingestion.Pool
+	connectors    *connector.Runner
+	// mailbox is set when MAILBOX_IMAP_URL is configured.
+	mailbox *mailbox.Poller
+	// jiraSync is set when JIRA_BASE_URL is configured.
+	jiraSync *jira.Syncer
+	idemRepo *repository.IdempotencyRepo
+	admins   map[string]bool
+	// webhookSecrets holds each processor's signing secret; processors
+	// without one cannot push settlement events.
+	webhookSecrets map[string]string
+	// sandboxDB is set only on the sandbox server and enables /simulate.
+	sandboxDB *sql.DB
+	// snapshots is set when SNAPSHOT_DIR is configured.
+	snapshots *repository.SnapshotRepo
+	// maintenance is set unless DB_MAINTENANCE_INTERVAL is off.
+	maintenance *maintenance.Service
+	// encryption is set when column encryption keys are configured.
+	encryption    *repository.EncryptionRepo
+	retentionRepo *repository.RetentionRepo
+	// retention is nil when no retention policy is configured.
+	retention   *retention.Policy
+	diagnostics *repository.DiagnosticsRepo
+	// versions is nil when ETags are not computed.
+	versions *repository.DataVersion
+	// elector is set when LEADER_ELECTION is on.
+	elector *leader.Elector
+	// reloader is set when CONFIG_FILE is.
+	reloader *config.Reloader
+	// feed serves GET /dashboard/live; nil turns it off.
+	feed *live.Hub
 }
 
 // --- helpers ---
@@ -36,6 +112,21 @@ func writeError(w http.ResponseWriter, status int, msg string) {
 	writeJSON(w, status, map[string]string{"error": msg})
 }
 
+// writeServerError writes err as a 500, or as a 503 when a database read
+// ran past the query timeout, which a narrower query may stay within.
+func writeServerError(w http.ResponseWriter, err error) {
+	status, msg := serverError(err)
+	writeError(w, status, msg)
+}
+
+// serverError is the status and message writeServerError writes for err.
+func serverError(err error) (int, string) {
+	if repository.IsQueryTimeout(err) {
+		return http.StatusServiceUnavailable, "query took too long: narrow the filters or lower the limit"
+	}
+	return http.StatusInternalServerError, err.Error()
+}
+
 func parseTime(s string) *time.Time {
 	if s == "" {
 		return nil
@@ -61,282 +152,6396 @@ func parseIntDefault(s string, def int) int {
 	return v
 }
 
+// maxListLimit caps the limit of the list endpoints, whose responses echo
+// the limit applied. The exports stream every matching row instead.
+const maxListLimit = 500
+
+// parseLimit reads a list endpoint's limit: def when absent or invalid,
+// and at most maxListLimit.
+func parseLimit(s string, def int) int {
+	return min(parseIntDefault(s, def), maxListLimit)
+}
+
 func roundUSD(v float64) float64 {
 	return math.Round(v*100) / 100
 }
 
+// notModified sets an ETag on a response that depends only on the database
+// and the query string, derived from the last reconciliation run and the
+// data version, and answers a matching If-None-Match with 304 before any
+// query runs. It reports whether the response was written. The version is
+// read before the data, so a write committed in between gives a newer body
+// an older ETag and the next request fetches it again, never the reverse.
+// The ETag is weak because the same body may be sent compressed or not.
+func (h *Handlers) notModified(w http.ResponseWriter, r *http.Request) bool {
+	return h.notModifiedFor(w, r, "")
+}
+
+// notModifiedFor is notModified for a response that also depends on key,
+// such as the caller's dashboard view.
+func (h *Handlers) notModifiedFor(w http.ResponseWriter, r *http.Request, key string) bool {
+	if h.versions == nil {
+		return false
+	}
+	version, err := h.versions.Current()
+	if err != nil {
+		log.Printf("[api] WARNING: no ETag: %v", err)
+		return false
+	}
+	var runID int64
+	if run := h.reconSvc.LastRun(); run != nil {
+		runID = run.ID
+	}
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%d|%s|%s|%s", runID, version, r.URL.RawQuery, key)))
+	etag := `W/"` + hex.EncodeToString(sum[:12]) + `"`
+
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", "no-cache")
+	for _, candidate := range strings.Split(r.Header.Get("If-None-Match"), ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(etag, "W/") {
+			w.WriteHeader(http.StatusNotModified)
+			return true
+		}
+	}
+	return false
+}
+
+// requestUser returns the caller's user ID from the X-User-ID header. The API
+// is internal-only, so the header is trusted as-is.
+func requestUser(r *http.Request) string {
+	return strings.TrimSpace(r.Header.Get("X-User-ID"))
+}
+
+// requireAdmin reports whether the caller is an admin. Otherwise it writes a
+// 401 or 403 and returns false.
+func (h *Handlers) requireAdmin(w http.ResponseWriter, r *http.Request) bool {
+	user := requestUser(r)
+	if user == "" {
+		writeError(w, http.StatusUnauthorized, "X-User-ID header is required")
+		return false
+	}
+	if !h.admins[user] {
+		writeError(w, http.StatusForbidden, "admin only")
+		return false
+	}
+	return true
+}
+
+// ParseAdminUsers turns a comma-separated list of user IDs (ADMIN_USER_IDS)
+// into a set.
+func ParseAdminUsers(s string) map[string]bool {
+	admins := make(map[string]bool)
+	for _, id := range strings.Split(s, ",") {
+		if id = strings.TrimSpace(id); id != "" {
+			admins[id] = true
+		}
+	}
+	return admins
+}
+
+// ParseWebhookSecrets turns a comma-separated list of processor=secret pairs
+// (WEBHOOK_SECRETS) into a map. Entries without a secret are ignored.
+func ParseWebhookSecrets(s string) map[string]string {
+	secrets := make(map[string]string)
+	for _, pair := range strings.Split(s, ",") {
+		proc, secret, _ := strings.Cut(strings.TrimSpace(pair), "=")
+		if proc, secret = strings.TrimSpace(proc), strings.TrimSpace(secret); proc != "" && secret != "" {
+			secrets[proc] = secret
+		}
+	}
+	return secrets
+}
+
+// normalizeTag lowercases and trims a tag, returning "" if it is unusable.
+func normalizeTag(tag string) string {
+	tag = strings.ToLower(strings.TrimSpace(tag))
+	if len(tag) > 64 {
+		return ""
+	}
+	return tag
+}
+
+// discrepancyFilterParams are the list query parameters that may be stored
+// in a saved filter.
+var discrepancyFilterParams = map[string]bool{
+	"type": true, "severity": true, "processor": true, "merchant_id": true,
+	"batch_id": true, "tag": true, "team": true, "assignee": true, "ticket_id": true,
+	"status": true, "case_id": true, "from": true, "to": true, "limit": true,
+}
+
 // --- IngestReport ---
 
-func (h *Handlers) IngestReport(w http.ResponseWriter, r *http.Request) {
+// reportUpload is the validated content of a report upload form.
+type reportUpload struct {
+	data      []byte
+	filename  string
+	processor string
+	format    string
+	sidecars  []ingestion.Sidecar
+}
+
+// readReportUpload parses and validates the multipart form shared by the
+// ingest and preview endpoints. On failure it writes the error response and
+// returns nil.
+func readReportUpload(w http.ResponseWriter, r *http.Request) *reportUpload {
 	// Accept multipart form.
 	if err := r.ParseMultipartForm(32 << 20); err != nil {
 		writeError(w, http.StatusBadRequest, "invalid multipart form: "+err.Error())
-		return
+		return nil
 	}
 
 	processor := r.FormValue("processor")
 	format := r.FormValue("format")
 	if processor == "" || format == "" {
 		writeError(w, http.StatusBadRequest, "processor and format are required")
-		return
+		return nil
 	}
 
-	validProcessors := map[string]bool{"afripay": true, "nairagateway": true, "capepay": true}
-	if !validProcessors[processor] {
-		writeError(w, http.StatusBadRequest,
-			"invalid processor: must be one of afripay, nairagateway, capepay")
-		return
-	}
-	validFormats := map[string]bool{"csv_a": true, "json_b": true, "csv_c": true}
-	if !validFormats[format] {
-		writeError(w, http.StatusBadRequest,
-			"invalid format: must be one of csv_a, json_b, csv_c")
-		return
+	if msg := reportTypeError(processor, format); msg != "" {
+		writeError(w, http.StatusBadRequest, msg)
+		return nil
 	}
 
-	file, _, err := r.FormFile("file")
+	file, fh, err := r.FormFile("file")
 	if err != nil {
 		writeError(w, http.StatusBadRequest, "file field is required: "+err.Error())
-		return
+		return nil
 	}
 	defer file.Close()
 
 	data, err := io.ReadAll(file)
 	if err != nil {
 		writeError(w, http.StatusInternalServerError, "read file: "+err.Error())
-		return
+		return nil
 	}
 
-	result, err := h.ingestionSvc.IngestReport(data, processor, format)
+	sidecars, err := readSidecars(r.MultipartForm.File["sidecar"])
 	if err != nil {
-		writeError(w, http.StatusUnprocessableEntity, err.Error())
-		return
+		writeError(w, http.StatusInternalServerError, "read sidecar: "+err.Error())
+		return nil
 	}
 
-	writeJSON(w, http.StatusOK, result)
+	return &reportUpload{data: data, filename: fh.Filename, processor: processor, format: format, sidecars: sidecars}
 }
 
-// --- ListTransactions ---
-
-func (h *Handlers) ListTransactions(w http.ResponseWriter, r *http.Request) {
-	q := r.URL.Query()
-	filter := repository.TransactionFilter{
-		Processor: q.Get("processor"),
-		Status:    q.Get("status"),
-		Currency:  q.Get("currency"),
-		From:      parseTime(q.Get("from")),
-		To:        parseTime(q.Get("to")),
-		Page:      parseIntDefault(q.Get("page"), 1),
-		Limit:     parseIntDefault(q.Get("limit"), 50),
+// readSidecars reads the checksum and signature files uploaded with a
+// report.
+func readSidecars(headers []*multipart.FileHeader) ([]ingestion.Sidecar, error) {
+	var sidecars []ingestion.Sidecar
+	for _, fh := range headers {
+		f, err := fh.Open()
+		if err != nil {
+			return nil, err
+		}
+		data, err := io.ReadAll(f)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+		sidecars = append(sidecars, ingestion.Sidecar{Filename: fh.Filename, Data: data})
 	}
+	return sidecars, nil
+}
 
-	txns, total, err := h.txnRepo.List(filter)
-	if err != nil {
-		writeError(w, http.StatusInternalServerError, err.Error())
-		return
+func validProcessor(processor string) bool {
+	switch processor {
+	case "afripay", "nairagateway", "capepay", "mpesa":
+		return true
 	}
-
-	writeJSON(w, http.StatusOK, map[string]any{
-		"transactions": txns,
-		"total":        total,
-		"page":         filter.Page,
-		"limit":        filter.Limit,
-	})
+	return false
 }
 
-// --- GetTransactionSettlementStatus ---
+// reportTypeError checks an upload's processor and format, returning the
+// error message for an invalid one or "" if both are valid.
+func reportTypeError(processor, format string) string {
+	if !validProcessor(processor) {
+		return "invalid processor: must be one of afripay, nairagateway, capepay, mpesa"
+	}
+	if format == ingestion.FormatExternal {
+		if !ingestion.HasExternalParser(domain.Processor(processor)) {
+			return "invalid format: no external parser is registered for " + processor
+		}
+		return ""
+	}
+	validFormats := map[string]bool{"csv_a": true, "json_b": true, "csv_c": true, "csv_mpesa": true}
+	if !validFormats[format] {
+		return "invalid format: must be one of csv_a, json_b, csv_c, csv_mpesa"
+	}
+	if err := ingestion.CheckFormat(domain.Processor(processor), format); err != nil {
+		return err.Error()
+	}
+	return ""
+}
 
-func (h *Handlers) GetTransactionSettlementStatus(w http.ResponseWriter, r *http.Request) {
-	id := chi.URLParam(r, "id")
-	if id == "" {
-		writeError(w, http.StatusBadRequest, "id is required")
+func (h *Handlers) IngestReport(w http.ResponseWriter, r *http.Request) {
+	up := readReportUpload(w, r)
+	if up == nil {
 		return
 	}
 
-	txn, err := h.txnRepo.GetByID(id)
-	if err != nil {
-		writeError(w, http.StatusNotFound, "transaction not found")
+	opts := ingestion.IngestOptions{Filename: up.filename, Sidecars: up.sidecars}
+	switch r.FormValue("mode") {
+	case "", "live":
+	case "backfill":
+		opts.Backfill = true
+	default:
+		writeError(w, http.StatusBadRequest, "invalid mode: must be live or backfill")
 		return
 	}
 
-	settlements, err := h.settRepo.GetByTransactionID(id)
-	if err != nil {
-		writeError(w, http.StatusInternalServerError, err.Error())
+	async := r.FormValue("async") == "true"
+
+	// Nobody waits on an async job, so it is retried and dead-lettered
+	// rather than failing once.
+	submit := h.ingestPool.Submit
+	if async {
+		submit = h.ingestPool.SubmitAsync
+	}
+
+	key := r.Header.Get("Idempotency-Key")
+	if key == "" {
+		job := submit(up.data, up.processor, up.format, opts)
+		h.respondIngestJob(w, r, job, async, "")
 		return
 	}
 
-	discrepancies, err := h.discRepo.GetByTransactionID(id)
+	// A retried request with the same key gets the original job (or its
+	// stored response) instead of a new one.
+	fingerprint := ingestFingerprint(up, r.FormValue("mode"), async)
+	rec, claimed, err := h.idemRepo.Claim(ingestIdempotencyScope, key, fingerprint, time.Now().UTC())
 	if err != nil {
-		writeError(w, http.StatusInternalServerError, err.Error())
+		writeServerError(w, err)
+		return
+	}
+	if !claimed {
+		h.replayIngest(w, r, rec, fingerprint, async)
 		return
 	}
 
-	writeJSON(w, http.StatusOK, map[string]any{
-		"transaction":   txn,
-		"settlements":   settlements,
-		"discrepancies": discrepancies,
-	})
+	job := submit(up.data, up.processor, up.format, opts)
+	if err := h.idemRepo.SetJob(ingestIdempotencyScope, key, job.ID); err != nil {
+		log.Printf("[api] WARNING: link idempotency key to job %s: %v", job.ID, err)
+	}
+	h.respondIngestJob(w, r, job, async, key)
 }
 
-// --- ListDiscrepancies ---
+// batchManifestEntry names the processor and format of one uploaded file of
+// a batch ingest.
+type batchManifestEntry struct {
+	File      string `json:"file"`
+	Processor string `json:"processor"`
+	Format    string `json:"format"`
+}
 
-func (h *Handlers) ListDiscrepancies(w http.ResponseWriter, r *http.Request) {
-	q := r.URL.Query()
-	filter := repository.DiscrepancyFilter{
-		Type:      q.Get("type"),
-		Severity:  q.Get("severity"),
-		Processor: q.Get("processor"),
-		From:      parseTime(q.Get("from")),
-		To:        parseTime(q.Get("to")),
-		Page:      parseIntDefault(q.Get("page"), 1),
-		Limit:     parseIntDefault(q.Get("limit"), 50),
+// IngestReportBatch ingests several report files from one multipart request
+// and reconciles once after the last. Each file's processor and format come
+// either from a manifest field, a JSON array matched to the uploads by
+// filename and ingested in manifest order, or from processor and format
+// fields repeated once per file, in upload order. A sidecar field is the
+// checksum or signature file of the upload it is named after, such as
+// "report.csv.sha256" for "report.csv". Files are ingested synchronously,
+// bypassing the ingestion pool. An Idempotency-Key is honoured as on
+// IngestReport, under its own scope.
+func (h *Handlers) IngestReportBatch(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseMultipartForm(32 << 20); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid multipart form: "+err.Error())
+		return
 	}
 
-	discs, total, err := h.discRepo.List(filter)
-	if err != nil {
-		writeError(w, http.StatusInternalServerError, err.Error())
+	var opts ingestion.IngestOptions
+	switch r.FormValue("mode") {
+	case "", "live":
+	case "backfill":
+		opts.Backfill = true
+	default:
+		writeError(w, http.StatusBadRequest, "invalid mode: must be live or backfill")
 		return
 	}
 
-	// Calculate total impact for the result set.
-	var totalImpact float64
-	for _, d := range discs {
-		totalImpact += math.Abs(d.DifferenceUSD)
+	uploads := r.MultipartForm.File["file"]
+	if len(uploads) == 0 {
+		writeError(w, http.StatusBadRequest, "at least one file field is required")
+		return
 	}
 
-	writeJSON(w, http.StatusOK, map[string]any{
-		"discrepancies":   discs,
-		"total":           total,
-		"page":            filter.Page,
-		"limit":           filter.Limit,
-		"total_impact_usd": roundUSD(totalImpact),
-	})
-}
+	// Pair each upload with its processor and format, in ingest order.
+	var entries []batchManifestEntry
+	var headers []*multipart.FileHeader
+	if manifest := r.FormValue("manifest"); manifest != "" {
+		if err := json.Unmarshal([]byte(manifest), &entries); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid manifest: "+err.Error())
+			return
+		}
+		if len(entries) != len(uploads) {
+			writeError(w, http.StatusBadRequest,
+				fmt.Sprintf("manifest lists %d files but %d were uploaded", len(entries), len(uploads)))
+			return
+		}
+		byName := make(map[string]*multipart.FileHeader, len(uploads))
+		for _, fh := range uploads {
+			if byName[fh.Filename] != nil {
+				writeError(w, http.StatusBadRequest, fmt.Sprintf("file %q was uploaded twice", fh.Filename))
+				return
+			}
+			byName[fh.Filename] = fh
+		}
+		for _, e := range entries {
+			fh := byName[e.File]
+			if fh == nil {
+				writeError(w, http.StatusBadRequest, fmt.Sprintf("manifest file %q was not uploaded", e.File))
+				return
+			}
+			delete(byName, e.File)
+			headers = append(headers, fh)
+		}
+	} else {
+		processors := r.MultipartForm.Value["processor"]
+		formats := r.MultipartForm.Value["format"]
+		if len(processors) != len(uploads) || len(formats) != len(uploads) {
+			writeError(w, http.StatusBadRequest,
+				"give one processor and one format per file, or a manifest")
+			return
+		}
+		for i, fh := range uploads {
+			entries = append(entries, batchManifestEntry{File: fh.Filename, Processor: processors[i], Format: formats[i]})
+		}
+		headers = uploads
+	}
 
-// --- GetDiscrepancySummary ---
+	files := make([]ingestion.BatchFile, 0, len(entries))
+	for i, e := range entries {
+		if msg := reportTypeError(e.Processor, e.Format); msg != "" {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("file %q: %s", e.File, msg))
+			return
+		}
+		f, err := headers[i].Open()
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "read file: "+err.Error())
+			return
+		}
+		data, err := io.ReadAll(f)
+		f.Close()
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "read file: "+err.Error())
+			return
+		}
+		files = append(files, ingestion.BatchFile{Filename: e.File, Processor: e.Processor, Format: e.Format, Data: data})
+	}
 
-func (h *Handlers) GetDiscrepancySummary(w http.ResponseWriter, r *http.Request) {
-	summary, err := h.discRepo.GetSummary()
+	sidecars, err := readSidecars(r.MultipartForm.File["sidecar"])
 	if err != nil {
-		writeError(w, http.StatusInternalServerError, err.Error())
+		writeError(w, http.StatusInternalServerError, "read sidecar: "+err.Error())
 		return
 	}
+	for _, sc := range sidecars {
+		base, _ := ingestion.SidecarOf(sc.Filename)
+		i := slices.IndexFunc(files, func(f ingestion.BatchFile) bool { return base != "" && f.Filename == base })
+		if i < 0 {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("sidecar %q is not named after an uploaded file", sc.Filename))
+			return
+		}
+		files[i].Sidecars = append(files[i].Sidecars, sc)
+	}
 
-	writeJSON(w, http.StatusOK, summary)
+	// A retried batch with the same key gets the stored response instead
+	// of ingesting the files again.
+	key := r.Header.Get("Idempotency-Key")
+	if key != "" {
+		fingerprint := batchFingerprint(files, r.FormValue("mode"))
+		rec, claimed, err := h.idemRepo.Claim(batchIdempotencyScope, key, fingerprint, time.Now().UTC())
+		if err != nil {
+			writeServerError(w, err)
+			return
+		}
+		if !claimed {
+			if !replayStored(w, rec, fingerprint) {
+				writeError(w, http.StatusConflict,
+					"a request with this Idempotency-Key is still being processed")
+			}
+			return
+		}
+	}
+
+	// The batch runs to the end even if the client goes away, so its
+	// response is always stored for the key.
+	var status int
+	var body any
+	result, err := h.ingestionSvc.IngestBatch(files, opts)
+	if err != nil {
+		var msg string
+		status, msg = serverError(err)
+		body = map[string]string{"error": msg}
+	} else {
+		status, body = http.StatusOK, result
+		if result.Failed == len(files) {
+			status = http.StatusUnprocessableEntity
+		}
+	}
+	if key != "" {
+		h.storeIdempotentResponse(batchIdempotencyScope, key, status, body)
+	}
+	writeJSON(w, status, body)
 }
 
-// --- GetDashboard ---
+// batchIdempotencyScope namespaces Idempotency-Key values for batch ingests.
+const batchIdempotencyScope = "POST /reports/ingest/batch"
 
-func (h *Handlers) GetDashboard(w http.ResponseWriter, r *http.Request) {
-	stats, err := h.txnRepo.GetDashboardStats()
-	if err != nil {
-		writeError(w, http.StatusInternalServerError, err.Error())
-		return
+// batchFingerprint is ingestFingerprint for a batch: the mode and, in ingest
+// order, each file's name, processor, format, content and sidecars.
+func batchFingerprint(files []ingestion.BatchFile, mode string) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\n", mode)
+	for _, f := range files {
+		fmt.Fprintf(h, "\n%s\n%s\n%s\n%x", f.Filename, f.Processor, f.Format, sha256.Sum256(f.Data))
+		for _, sc := range f.Sidecars {
+			fmt.Fprintf(h, "\n%s\n%x", sc.Filename, sha256.Sum256(sc.Data))
+		}
 	}
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
 
-	discSummary, err := h.discRepo.GetSummary()
-	if err != nil {
-		writeError(w, http.StatusInternalServerError, err.Error())
-		return
+// ingestIdempotencyScope namespaces Idempotency-Key values for report ingestion.
+const ingestIdempotencyScope = "POST /reports/ingest"
+
+// ingestFingerprint identifies an ingest request independently of multipart
+// boundaries, so a client retry of the same upload matches.
+func ingestFingerprint(up *reportUpload, mode string, async bool) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\n%s\n%s\n%t\n", up.processor, up.format, mode, async)
+	h.Write(up.data)
+	for _, sc := range up.sidecars {
+		fmt.Fprintf(h, "\n%s\n%x", sc.Filename, sha256.Sum256(sc.Data))
 	}
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
 
-	processorVols, err := h.txnRepo.GetVolumeByProcessor()
-	if err != nil {
-		writeError(w, http.StatusInternalServerError, err.Error())
+// replayIngest answers a request whose Idempotency-Key was already claimed.
+func (h *Handlers) replayIngest(w http.ResponseWriter, r *http.Request, rec *domain.IdempotencyKey, fingerprint string, async bool) {
+	if replayStored(w, rec, fingerprint) {
+		return
+	}
+	if rec.JobID == "" {
+		writeError(w, http.StatusConflict,
+			"a request with this Idempotency-Key is still being processed")
+		return
+	}
+	job, ok := h.ingestPool.Find(rec.JobID)
+	if !ok {
+		writeError(w, http.StatusConflict,
+			"the job for this Idempotency-Key is no longer available; retry with a new key")
 		return
 	}
+	w.Header().Set("Idempotent-Replayed", "true")
+	h.respondIngestJob(w, r, job, async, rec.Key)
+}
 
-	discStats, err := h.discRepo.GetStatsByProcessor()
-	if err != nil {
-		writeError(w, http.StatusInternalServerError, err.Error())
+// replayStored rejects a claimed key reused with a different request, or
+// replays its stored response. It reports false, writing nothing, when the
+// request matches but has no response yet.
+func replayStored(w http.ResponseWriter, rec *domain.IdempotencyKey, fingerprint string) bool {
+	if rec.Fingerprint != fingerprint {
+		writeError(w, http.StatusUnprocessableEntity,
+			"Idempotency-Key was already used with a different request")
+		return true
+	}
+	if rec.StatusCode == 0 {
+		return false
+	}
+	w.Header().Set("Idempotent-Replayed", "true")
+	w.WriteHeader(rec.StatusCode)
+	w.Write(rec.Response)
+	return true
+}
+
+// respondIngestJob writes the response for a submitted ingest job. With a
+// non-empty idempotency key the final response is stored for replay; if the
+// client goes away first, it is stored once the job finishes.
+func (h *Handlers) respondIngestJob(w http.ResponseWriter, r *http.Request, job *ingestion.Job, async bool, key string) {
+	// Async clients get the job back immediately and poll for completion.
+	if async {
+		snap, _ := h.ingestPool.Get(job.ID)
+		h.writeIngestResponse(w, http.StatusAccepted, snap, key)
 		return
 	}
 
-	currencyVols, err := h.txnRepo.GetVolumeByCurrency()
+	snap, err := h.ingestPool.Wait(r.Context(), job)
 	if err != nil {
-		writeError(w, http.StatusInternalServerError, err.Error())
+		if key != "" {
+			go h.completeWhenDone(job, key)
+		}
+		writeError(w, http.StatusServiceUnavailable,
+			"request ended before ingestion finished; poll /reports/jobs/"+job.ID)
 		return
 	}
+	status, body := ingestJobResponse(snap)
+	h.writeIngestResponse(w, status, body, key)
+}
 
-	// Merge processor volumes with discrepancy stats.
-	type procEntry struct {
-		Processor        string  `json:"processor"`
-		SettledUSD       float64 `json:"settled_usd"`
-		DiscrepancyCount int     `json:"discrepancy_count"`
-		ImpactUSD        float64 `json:"discrepancy_impact_usd"`
+func (h *Handlers) completeWhenDone(job *ingestion.Job, key string) {
+	snap, _ := h.ingestPool.Wait(context.Background(), job)
+	status, body := ingestJobResponse(snap)
+	h.storeIdempotentResponse(ingestIdempotencyScope, key, status, body)
+}
+
+// ingestJobResponse maps a finished job to the status and body of a
+// synchronous ingest response.
+func ingestJobResponse(snap ingestion.Job) (int, any) {
+	if snap.Status == ingestion.JobFailed {
+		return http.StatusUnprocessableEntity, map[string]string{"error": snap.Error}
+	}
+	if snap.Result != nil && snap.Result.PendingAdjustmentID != "" {
+		return http.StatusAccepted, snap.Result
 	}
+	return http.StatusOK, snap.Result
+}
 
-	discMap := make(map[string]repository.ProcessorDiscrepancyStat)
-	for _, ds := range discStats {
-		discMap[ds.Processor] = ds
+func (h *Handlers) writeIngestResponse(w http.ResponseWriter, status int, body any, key string) {
+	if key != "" {
+		h.storeIdempotentResponse(ingestIdempotencyScope, key, status, body)
 	}
+	writeJSON(w, status, body)
+}
 
-	var byProcessor []procEntry
-	for _, pv := range processorVols {
-		entry := procEntry{
-			Processor:  pv.Processor,
-			SettledUSD: roundUSD(pv.SettledUSD),
-		}
-		if ds, ok := discMap[pv.Processor]; ok {
-			entry.DiscrepancyCount = ds.DiscrepancyCount
-			entry.ImpactUSD = roundUSD(ds.ImpactUSD)
-		}
-		byProcessor = append(byProcessor, entry)
+func (h *Handlers) storeIdempotentResponse(scope, key string, status int, body any) {
+	data, err := json.Marshal(body)
+	if err == nil {
+		err = h.idemRepo.Complete(scope, key, status, append(data, '\n'))
+	}
+	if err != nil {
+		log.Printf("[api] WARNING: store idempotent response for key %q: %v", key, err)
 	}
+}
 
-	dashboard := map[string]any{
-		"period": map[string]string{
-			"from": "2024-01-08",
-			"to":   "2024-01-21",
-		},
-		"transactions": map[string]int{
-			"total":              stats.Total,
-			"captured":           stats.Captured,
-			"settled":            stats.Settled,
-			"pending_settlement": stats.PendingSettlement,
-		},
-		"volume": map[string]float64{
-			"total_usd":     roundUSD(stats.TotalUSD),
-			"settled_usd":   roundUSD(stats.SettledUSD),
-			"unsettled_usd": roundUSD(stats.UnsettledUSD),
-		},
-		"discrepancies": map[string]any{
-			"total":          discSummary.TotalCount,
-			"critical":       discSummary.BySeverity["CRITICAL"],
-			"high":           discSummary.BySeverity["HIGH"],
-			"medium":         discSummary.BySeverity["MEDIUM"],
-			"low":            discSummary.BySeverity["LOW"],
-			"total_impact_usd": roundUSD(discSummary.TotalImpact),
-		},
-		"by_processor": byProcessor,
-		"by_currency":  currencyVols,
+// --- GetIngestJob ---
+
+func (h *Handlers) GetIngestJob(w http.ResponseWriter, r *http.Request) {
+	job, ok := h.ingestPool.Get(chi.URLParam(r, "id"))
+	if !ok {
+		writeError(w, http.StatusNotFound, "job not found")
+		return
 	}
 
-	writeJSON(w, http.StatusOK, dashboard)
+	writeJSON(w, http.StatusOK, job)
 }
 
-// --- ListSettlements ---
+// --- Dead letters ---
 
-func (h *Handlers) ListSettlements(w http.ResponseWriter, r *http.Request) {
+// ListDeadLetters returns async ingestion jobs that failed their last
+// attempt: open ones by default, or ?status=retried, discarded or all.
+func (h *Handlers) ListDeadLetters(w http.ResponseWriter, r *http.Request) {
 	q := r.URL.Query()
-	filter := repository.SettlementFilter{
+	filter := repository.DeadLetterFilter{
 		Processor: q.Get("processor"),
-		From:      parseTime(q.Get("from")),
-		To:        parseTime(q.Get("to")),
+		Status:    q.Get("status"),
 		Page:      parseIntDefault(q.Get("page"), 1),
 		Limit:     parseIntDefault(q.Get("limit"), 50),
 	}
+	switch filter.Status {
+	case "":
+		filter.Status = string(domain.DeadLetterOpen)
+	case "all":
+		filter.Status = ""
+	case string(domain.DeadLetterOpen), string(domain.DeadLetterRetried), string(domain.DeadLetterDiscarded):
+	default:
+		writeError(w, http.StatusBadRequest, "invalid status: must be one of open, retried, discarded, all")
+		return
+	}
 
-	records, total, err := h.settRepo.ListRecords(filter)
+	letters := []domain.DeadLetter{}
+	total := 0
+	if repo := h.ingestPool.DeadLetters(); repo != nil {
+		var err error
+		letters, total, err = repo.List(filter)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{
+		"dead_letters": letters,
+		"total":        total,
+		"page":         filter.Page,
+		"limit":        filter.Limit,
+	})
+}
+
+func (h *Handlers) GetDeadLetter(w http.ResponseWriter, r *http.Request) {
+	dl, ok := h.deadLetter(w, chi.URLParam(r, "id"))
+	if !ok {
+		return
+	}
+	writeJSON(w, http.StatusOK, dl)
+}
+
+// GetDeadLetterRaw downloads the file a dead letter was submitted with.
+func (h *Handlers) GetDeadLetterRaw(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	if _, ok := h.deadLetter(w, id); !ok {
+		return
+	}
+	file, err := h.ingestPool.DeadLetters().GetFile(id)
+	if errors.Is(err, sql.ErrNoRows) {
+		writeError(w, http.StatusNotFound, "dead letter file was purged")
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	name := file.Filename
+	if name == "" {
+		name = id
+	}
+	contentType := mime.TypeByExtension(filepath.Ext(name))
+	if contentType == "" {
+		contentType = http.DetectContentType(file.Data)
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filepath.Base(name)))
+	w.Header().Set("Content-Length", strconv.Itoa(len(file.Data)))
+	w.Header().Set("X-Content-SHA256", file.Hash)
+	w.WriteHeader(http.StatusOK)
+	w.Write(file.Data)
+}
+
+// RetryDeadLetter queues a dead letter's file again as a new async job.
+func (h *Handlers) RetryDeadLetter(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	if _, ok := h.deadLetter(w, id); !ok {
+		return
+	}
+	job, err := h.ingestPool.RetryDeadLetter(id, r.Header.Get("X-User-ID"))
+	switch {
+	case errors.Is(err, ingestion.ErrDeadLetterClosed):
+		writeError(w, http.StatusConflict, err.Error())
+		return
+	case errors.Is(err, sql.ErrNoRows):
+		writeError(w, http.StatusNotFound, "dead letter file was purged")
+		return
+	case job == nil && err != nil:
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	case err != nil:
+		log.Printf("[api] WARNING: dead letter %s was requeued as %s but not closed: %v", id, job.ID, err)
+	}
+
+	snap, _ := h.ingestPool.Get(job.ID)
+	writeJSON(w, http.StatusAccepted, snap)
+}
+
+// DiscardDeadLetter closes a dead letter without ingesting it (admin only).
+func (h *Handlers) DiscardDeadLetter(w http.ResponseWriter, r *http.Request) {
+	if !h.requireAdmin(w, r) {
+		return
+	}
+	id := chi.URLParam(r, "id")
+	if _, ok := h.deadLetter(w, id); !ok {
+		return
+	}
+	if err := h.ingestPool.DiscardDeadLetter(id, r.Header.Get("X-User-ID")); errors.Is(err, ingestion.ErrDeadLetterClosed) {
+		writeError(w, http.StatusConflict, err.Error())
+		return
+	} else if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	dl, ok := h.deadLetter(w, id)
+	if !ok {
+		return
+	}
+	writeJSON(w, http.StatusOK, dl)
+}
+
+// deadLetter looks a dead letter up, writing a 404 or 500 when it cannot be
+// returned.
+func (h *Handlers) deadLetter(w http.ResponseWriter, id string) (*domain.DeadLetter, bool) {
+	repo := h.ingestPool.DeadLetters()
+	if repo == nil {
+		writeError(w, http.StatusNotFound, "dead letter not found")
+		return nil, false
+	}
+	dl, err := repo.Get(id)
+	if errors.Is(err, sql.ErrNoRows) {
+		writeError(w, http.StatusNotFound, "dead letter not found")
+		return nil, false
+	}
 	if err != nil {
 		writeError(w, http.StatusInternalServerError, err.Error())
+		return nil, false
+	}
+	return dl, true
+}
+
+// --- GetReport ---
+
+// GetReport returns an ingested report with the warnings its parser raised.
+func (h *Handlers) GetReport(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+
+	report, err := h.settRepo.GetReport(id)
+	if errors.Is(err, sql.ErrNoRows) {
+		writeError(w, http.StatusNotFound, "report not found")
+		return
+	}
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+
+	warnings, err := h.settRepo.GetReportWarnings(id)
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+
+	resp := map[string]any{
+		"report":   report,
+		"warnings": warnings,
+	}
+	file, err := h.settRepo.GetReportFile(id)
+	switch {
+	case err == nil:
+		resp["file"] = file
+	case !errors.Is(err, sql.ErrNoRows):
+		writeServerError(w, err)
+		return
+	}
+	provenance, err := h.settRepo.GetReportProvenance(id)
+	switch {
+	case err == nil:
+		resp["provenance"] = provenance
+	case !errors.Is(err, sql.ErrNoRows):
+		writeServerError(w, err)
+		return
+	}
+	verification, err := h.settRepo.GetReportVerification(id)
+	switch {
+	case err == nil:
+		resp["verification"] = verification
+	case !errors.Is(err, sql.ErrNoRows):
+		writeServerError(w, err)
+		return
+	}
+	controlTotals, err := h.settRepo.GetReportControlTotals(id)
+	switch {
+	case err == nil:
+		resp["control_totals"] = controlTotals
+	case !errors.Is(err, sql.ErrNoRows):
+		writeServerError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// GetReportRaw downloads the file a report was ingested from, exactly as it
+// was uploaded. A file that held several batches is the same download for
+// each of their reports.
+func (h *Handlers) GetReportRaw(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+
+	if _, err := h.settRepo.GetReport(id); errors.Is(err, sql.ErrNoRows) {
+		writeError(w, http.StatusNotFound, "report not found")
+		return
+	} else if err != nil {
+		writeServerError(w, err)
+		return
+	}
+	file, err := h.settRepo.GetReportFile(id)
+	if errors.Is(err, sql.ErrNoRows) {
+		writeError(w, http.StatusNotFound, "report has no original file: it was pulled or pushed as records, ingested before files were kept, or purged")
+		return
+	}
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+
+	name := file.Filename
+	if name == "" {
+		name = id
+	}
+	contentType := mime.TypeByExtension(filepath.Ext(name))
+	if contentType == "" {
+		contentType = http.DetectContentType(file.Data)
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filepath.Base(name)))
+	w.Header().Set("Content-Length", strconv.Itoa(len(file.Data)))
+	w.Header().Set("X-Content-SHA256", file.Hash)
+	w.WriteHeader(http.StatusOK)
+	w.Write(file.Data)
+}
+
+// --- PreviewReport ---
+
+func (h *Handlers) PreviewReport(w http.ResponseWriter, r *http.Request) {
+	up := readReportUpload(w, r)
+	if up == nil {
+		return
+	}
+
+	limit := parseIntDefault(r.FormValue("limit"), 10)
+	if limit > 100 {
+		limit = 100
+	}
+
+	result, err := h.ingestionSvc.PreviewReport(up.data, up.processor, up.format, limit)
+	if err != nil {
+		writeError(w, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+
+	writeJSON(w, http.StatusOK, result)
+}
+
+// maxValidateFileSize bounds the uploads to the public validate-file
+// endpoint, which has no login to hold anyone to account.
+const maxValidateFileSize = 10 << 20
+
+// ValidateFile checks a processor's test file against its format without
+// persisting anything, returning a result for each line with a problem.
+// It is public: processors use it before go-live, with the rate limit of
+// HTTPConfig as its only guard.
+func (h *Handlers) ValidateFile(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxValidateFileSize)
+	up := readReportUpload(w, r)
+	if up == nil {
+		return
+	}
+
+	result, err := ingestion.ValidateFile(up.data, up.processor, up.format)
+	if err != nil {
+		writeError(w, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+
+	writeJSON(w, http.StatusOK, result)
+}
+
+// --- ListTransactions ---
+
+// transactionFilter reads the transaction list filters from q, writing a
+// 400 and returning false if one is invalid.
+func transactionFilter(w http.ResponseWriter, q url.Values) (repository.TransactionFilter, bool) {
+	filter := repository.TransactionFilter{
+		Processor: q.Get("processor"),
+		Status:    q.Get("status"),
+		Currency:  q.Get("currency"),
+		Direction: q.Get("direction"),
+		From:      parseTime(q.Get("from")),
+		To:        parseTime(q.Get("to")),
+		Page:      parseIntDefault(q.Get("page"), 1),
+		Limit:     parseLimit(q.Get("limit"), 50),
+
+		ReconciliationStatus: q.Get("reconciliation_status"),
+	}
+	switch domain.Direction(filter.Direction) {
+	case "", domain.DirectionInbound, domain.DirectionOutbound:
+	default:
+		writeError(w, http.StatusBadRequest, "invalid direction: must be inbound or outbound")
+		return filter, false
+	}
+	if s := domain.ReconciliationStatus(filter.ReconciliationStatus); s != "" && !s.Valid() {
+		writeError(w, http.StatusBadRequest, "invalid reconciliation_status: must be unreconciled, settled_clean, settled_with_variance, missing_settlement or under_investigation")
+		return filter, false
+	}
+	return filter, true
+}
+
+func (h *Handlers) ListTransactions(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	filter, ok := transactionFilter(w, q)
+	if !ok {
+		return
+	}
+
+	var expand repository.TransactionExpand
+	if v := q.Get("expand"); v != "" {
+		for _, part := range strings.Split(v, ",") {
+			switch strings.TrimSpace(part) {
+			case "settlements":
+				expand.Settlements = true
+			case "discrepancies":
+				expand.Discrepancies = true
+			default:
+				writeError(w, http.StatusBadRequest, "invalid expand: must be settlements, discrepancies or both")
+				return
+			}
+		}
+	}
+
+	var txns any
+	var total int
+	var err error
+	if expand.Settlements || expand.Discrepancies {
+		txns, total, err = h.txnRepo.ListExpanded(filter, expand)
+	} else {
+		txns, total, err = h.txnRepo.List(filter)
+	}
+	if err != nil {
+		writeServerError(w, err)
 		return
 	}
 
 	writeJSON(w, http.StatusOK, map[string]any{
-		"settlements": records,
-		"total":       total,
-		"page":        filter.Page,
-		"limit":       filter.Limit,
+		"transactions": txns,
+		"total":        total,
+		"page":         filter.Page,
+		"limit":        filter.Limit,
+	})
+}
+
+// --- GetTransactionSettlementStatus ---
+
+func (h *Handlers) GetTransactionSettlementStatus(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	if id == "" {
+		writeError(w, http.StatusBadRequest, "id is required")
+		return
+	}
+
+	txn, err := h.txnRepo.GetByID(id)
+	if err != nil {
+		writeError(w, http.StatusNotFound, "transaction not found")
+		return
+	}
+
+	settlements, err := h.settRepo.GetByTransactionID(id)
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+
+	discrepancies, err := h.discRepo.GetByTransactionID(id)
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+
+	amendments, err := h.txnRepo.ListAmendments(id)
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{
+		"transaction":   txn,
+		"amendments":    amendments,
+		"settlements":   settlements,
+		"discrepancies": discrepancies,
+	})
+}
+
+// maxSettlementStatusBatch bounds one batch settlement-status lookup.
+const maxSettlementStatusBatch = 500
+
+// settlementStatusEntry is one transaction in a batch settlement-status
+// lookup. An ID with no transaction has only TransactionID and Found.
+type settlementStatusEntry struct {
+	TransactionID        string                      `json:"transaction_id"`
+	Found                bool                        `json:"found"`
+	Status               domain.TransactionStatus    `json:"status,omitempty"`
+	ReconciliationStatus domain.ReconciliationStatus `json:"reconciliation_status,omitempty"`
+	SettledAt            *time.Time                  `json:"settled_at,omitempty"`
+	Settlement           *domain.SettlementRecord    `json:"settlement,omitempty"`
+	Discrepancies        []domain.Discrepancy        `json:"discrepancies,omitempty"`
+}
+
+// BatchTransactionSettlementStatus looks up the status, matched settlement
+// record and open discrepancies of up to maxSettlementStatusBatch
+// transactions in three queries. Results follow the order of the request,
+// with repeated IDs answered once.
+func (h *Handlers) BatchTransactionSettlementStatus(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		TransactionIDs []string `json:"transaction_ids"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid JSON body: "+err.Error())
+		return
+	}
+
+	ids := make([]string, 0, len(body.TransactionIDs))
+	seen := make(map[string]bool, len(body.TransactionIDs))
+	for _, id := range body.TransactionIDs {
+		id = strings.TrimSpace(id)
+		if id == "" {
+			writeError(w, http.StatusBadRequest, "transaction_ids must not contain empty IDs")
+			return
+		}
+		if !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) == 0 {
+		writeError(w, http.StatusBadRequest, "transaction_ids is required")
+		return
+	}
+	if len(ids) > maxSettlementStatusBatch {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("at most %d transaction_ids per request, got %d", maxSettlementStatusBatch, len(ids)))
+		return
+	}
+
+	txns, err := h.txnRepo.GetByIDs(ids)
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+	settlements, err := h.settRepo.GetByTransactionIDs(ids)
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+	discrepancies, err := h.discRepo.GetByTransactionIDs(ids)
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+
+	results := make([]settlementStatusEntry, len(ids))
+	found := 0
+	for i, id := range ids {
+		results[i].TransactionID = id
+		txn, ok := txns[id]
+		if !ok {
+			continue
+		}
+		found++
+		e := &results[i]
+		e.Found = true
+		e.Status, e.ReconciliationStatus, e.SettledAt = txn.Status, txn.ReconciliationStatus, txn.SettledAt
+		// Matching links at most one record to a transaction.
+		if recs := settlements[id]; len(recs) > 0 {
+			e.Settlement = &recs[0]
+		}
+		e.Discrepancies = discrepancies[id]
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{
+		"results":   results,
+		"found":     found,
+		"not_found": len(ids) - found,
 	})
 }
+
+// --- Transaction amendments ---
+
+// amendmentRequest is the body of POST /transactions/{id}/amendments.
+type amendmentRequest struct {
+	EventID   string   `json:"event_id"`
+	Amount    *float64 `json:"amount"`
+	USDAmount *float64 `json:"usd_amount"`
+	Reason    string   `json:"reason"`
+	AmendedAt string   `json:"amended_at"`
+}
+
+// AmendTransaction accepts an upstream amendment event that changes a
+// transaction's amount after capture (a tip, an FX reprice), records it in
+// the amount history and re-runs reconciliation against the new amount.
+// Replaying an event_id already applied returns the original amendment. An
+// amendment to a transaction captured in a closed period is held as a
+// pending adjustment instead.
+func (h *Handlers) AmendTransaction(w http.ResponseWriter, r *http.Request) {
+	var body amendmentRequest
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid JSON body: "+err.Error())
+		return
+	}
+	body.Reason = strings.TrimSpace(body.Reason)
+	if body.Reason == "" {
+		writeError(w, http.StatusBadRequest, "reason is required")
+		return
+	}
+	if body.Amount == nil || *body.Amount <= 0 {
+		writeError(w, http.StatusBadRequest, "amount must be positive")
+		return
+	}
+	if body.AmendedAt != "" && parseTime(body.AmendedAt) == nil {
+		writeError(w, http.StatusBadRequest, "invalid amended_at: use RFC3339 or YYYY-MM-DD")
+		return
+	}
+	if body.AmendedAt == "" {
+		body.AmendedAt = time.Now().UTC().Format(time.RFC3339Nano)
+	}
+
+	id := chi.URLParam(r, "id")
+	txn, err := h.txnRepo.GetByID(id)
+	if errors.Is(err, sql.ErrNoRows) {
+		writeError(w, http.StatusNotFound, "transaction not found")
+		return
+	}
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+	if txn.Status != domain.StatusCaptured && txn.Status != domain.StatusSettled && txn.Status != domain.StatusPendingConfirmation {
+		writeError(w, http.StatusConflict, fmt.Sprintf(
+			"transaction is %s; only captured, settled or pending transactions can be amended", txn.Status))
+		return
+	}
+
+	if txn.CapturedAt != nil {
+		closed, err := h.periodRepo.ClosedAmong(uniquePeriods(*txn.CapturedAt))
+		if err != nil {
+			writeServerError(w, err)
+			return
+		}
+		if len(closed) > 0 {
+			h.holdAdjustment(w, domain.AdjustmentAmendment, txn.ID, closed,
+				fmt.Sprintf("amendment to transaction %s: %.2f -> %.2f %s (%s)",
+					txn.ID, txn.Amount, *body.Amount, txn.Currency, body.Reason), requestUser(r),
+				heldAmendment{TransactionID: txn.ID, Amendment: body})
+			return
+		}
+	}
+
+	amendment, created, err := h.applyAmendment(txn, body)
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+	status := http.StatusOK
+	if created {
+		status = http.StatusCreated
+	}
+
+	if txn, err = h.txnRepo.GetByID(id); err != nil {
+		writeServerError(w, err)
+		return
+	}
+	discrepancies, err := h.discRepo.GetByTransactionID(id)
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+	if discrepancies == nil {
+		discrepancies = []domain.Discrepancy{}
+	}
+
+	writeJSON(w, status, map[string]any{
+		"amendment":     amendment,
+		"transaction":   txn,
+		"discrepancies": discrepancies,
+	})
+}
+
+// applyAmendment records a validated amendment and, when it is new, re-runs
+// reconciliation. amended_at must already be set.
+func (h *Handlers) applyAmendment(txn *domain.Transaction, body amendmentRequest) (*domain.TransactionAmendment, bool, error) {
+	usdAmount := 0.0
+	if body.USDAmount != nil {
+		usdAmount = *body.USDAmount
+	} else {
+		var err error
+		if usdAmount, err = currency.ToUSD(*body.Amount, txn.Currency); err != nil {
+			return nil, false, err
+		}
+	}
+
+	amendment, created, err := h.txnRepo.ApplyAmendment(&domain.TransactionAmendment{
+		ID:            fmt.Sprintf("AMD-%d", time.Now().UnixNano()),
+		TransactionID: txn.ID,
+		EventID:       strings.TrimSpace(body.EventID),
+		Reason:        body.Reason,
+		Amount:        *body.Amount,
+		USDAmount:     roundUSD(usdAmount),
+		AmendedAt:     *parseTime(body.AmendedAt),
+	})
+	if err != nil {
+		return nil, false, err
+	}
+
+	if created {
+		log.Printf("[api] Transaction %s amendment v%d (%s): %.2f -> %.2f %s, effective %s",
+			txn.ID, amendment.Version, amendment.Reason, amendment.PreviousAmount, amendment.Amount,
+			txn.Currency, amendment.AmendedAt.Format(time.RFC3339))
+		if _, err := h.reconSvc.RunFullReconciliation(); err != nil {
+			log.Printf("[api] WARNING: reconciliation after amendment %s failed: %v", amendment.ID, err)
+		}
+	}
+	return amendment, created, nil
+}
+
+// ListTransactionAmendments returns a transaction's amount history.
+func (h *Handlers) ListTransactionAmendments(w http.ResponseWriter, r *http.Request) {
+	amendments, err := h.txnRepo.ListAmendments(chi.URLParam(r, "id"))
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{"amendments": amendments})
+}
+
+// --- Quarantined transactions ---
+
+// ListQuarantinedTransactions lists transactions moved out of the ledger
+// because their processor reference was already used by another
+// transaction, each with the transaction that kept the reference.
+func (h *Handlers) ListQuarantinedTransactions(w http.ResponseWriter, r *http.Request) {
+	quarantined, err := h.txnRepo.ListQuarantined()
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"quarantined": quarantined,
+		"total":       len(quarantined),
+	})
+}
+
+// DeleteQuarantinedTransaction discards a quarantined transaction once it
+// has been reviewed. Admin only.
+func (h *Handlers) DeleteQuarantinedTransaction(w http.ResponseWriter, r *http.Request) {
+	if !h.requireAdmin(w, r) {
+		return
+	}
+	id := chi.URLParam(r, "id")
+	err := h.txnRepo.DeleteQuarantined(id)
+	if errors.Is(err, sql.ErrNoRows) {
+		writeError(w, http.StatusNotFound, "quarantined transaction not found")
+		return
+	}
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+	log.Printf("[api] Quarantined transaction %s discarded by %s", id, requestUser(r))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// --- Transfers ---
+
+// ListTransfers lists cross-border transfers with their legs and derived
+// status, optionally filtered by status.
+func (h *Handlers) ListTransfers(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	filter := repository.TransferFilter{
+		Status: q.Get("status"),
+		Page:   parseIntDefault(q.Get("page"), 1),
+		Limit:  parseLimit(q.Get("limit"), 50),
+	}
+	if filter.Status != "" && !validTransferStatus(filter.Status) {
+		names := make([]string, len(domain.TransferStatuses))
+		for i, st := range domain.TransferStatuses {
+			names[i] = string(st)
+		}
+		writeError(w, http.StatusBadRequest, "invalid status: must be one of "+strings.Join(names, ", "))
+		return
+	}
+
+	transfers, total, err := h.txnRepo.ListTransfers(filter)
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{
+		"transfers": transfers,
+		"total":     total,
+		"page":      filter.Page,
+		"limit":     filter.Limit,
+	})
+}
+
+// GetTransfer returns one transfer with both legs, each leg's settlement
+// status and open discrepancies, and the status derived from them.
+func (h *Handlers) GetTransfer(w http.ResponseWriter, r *http.Request) {
+	t, err := h.txnRepo.GetTransfer(chi.URLParam(r, "id"))
+	if errors.Is(err, sql.ErrNoRows) {
+		writeError(w, http.StatusNotFound, "transfer not found")
+		return
+	}
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, t)
+}
+
+func validTransferStatus(s string) bool {
+	for _, st := range domain.TransferStatuses {
+		if string(st) == s {
+			return true
+		}
+	}
+	return false
+}
+
+// --- ListDiscrepancies ---
+
+// discrepancyFilter reads the discrepancy list filters from the request. A
+// saved filter supplies defaults; explicit query parameters win. It writes
+// an error and returns false if the saved filter cannot be loaded.
+func (h *Handlers) discrepancyFilter(w http.ResponseWriter, r *http.Request) (repository.DiscrepancyFilter, bool) {
+	q := r.URL.Query()
+	if id := q.Get("saved_filter"); id != "" {
+		sf, err := h.filterRepo.GetForUser(id, requestUser(r))
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				writeError(w, http.StatusNotFound, "saved filter not found")
+				return repository.DiscrepancyFilter{}, false
+			}
+			writeServerError(w, err)
+			return repository.DiscrepancyFilter{}, false
+		}
+		for k, v := range sf.Query {
+			if q.Get(k) == "" {
+				q.Set(k, v)
+			}
+		}
+	}
+
+	if st := q.Get("status"); st != "" && st != "open" && st != "resolved" {
+		writeError(w, http.StatusBadRequest, "invalid status: must be open or resolved")
+		return repository.DiscrepancyFilter{}, false
+	}
+
+	return repository.DiscrepancyFilter{
+		Type:      q.Get("type"),
+		Severity:  q.Get("severity"),
+		Processor: q.Get("processor"),
+		Merchant:  q.Get("merchant_id"),
+		BatchID:   q.Get("batch_id"),
+		Tag:       normalizeTag(q.Get("tag")),
+		Team:      q.Get("team"),
+		Assignee:  q.Get("assignee"),
+		TicketID:  q.Get("ticket_id"),
+		Status:    q.Get("status"),
+		CaseID:    q.Get("case_id"),
+		From:      parseTime(q.Get("from")),
+		To:        parseTime(q.Get("to")),
+		Page:      parseIntDefault(q.Get("page"), 1),
+		Limit:     parseLimit(q.Get("limit"), 50),
+	}, true
+}
+
+func (h *Handlers) ListDiscrepancies(w http.ResponseWriter, r *http.Request) {
+	filter, ok := h.discrepancyFilter(w, r)
+	if !ok {
+		return
+	}
+
+	discs, total, err := h.discRepo.List(filter)
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+
+	// Calculate total impact for the result set.
+	var totalImpact float64
+	for _, d := range discs {
+		totalImpact += math.Abs(d.DifferenceUSD)
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{
+		"discrepancies":    discs,
+		"total":            total,
+		"page":             filter.Page,
+		"limit":            filter.Limit,
+		"total_impact_usd": roundUSD(totalImpact),
+	})
+}
+
+// --- GetDiscrepancy ---
+
+// GetDiscrepancy returns one discrepancy with its tags and the reconciliation
+// policy (tolerances, settlement window, fee schedule version) it was
+// detected under.
+func (h *Handlers) GetDiscrepancy(w http.ResponseWriter, r *http.Request) {
+	d, err := h.discRepo.GetByID(chi.URLParam(r, "id"))
+	if errors.Is(err, sql.ErrNoRows) {
+		writeError(w, http.StatusNotFound, "discrepancy not found")
+		return
+	}
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, d)
+}
+
+// --- GetDiscrepancySummary ---
+
+// GetDiscrepancySummary returns the fixed breakdowns, plus groups by the
+// dimensions in ?group_by= (comma-separated, e.g. processor,currency) when
+// given. ?as_of=YYYY-MM-DD summarises the discrepancies open at the end of
+// that day instead of now.
+func (h *Handlers) GetDiscrepancySummary(w http.ResponseWriter, r *http.Request) {
+	day, ok := asOfParam(w, r)
+	if !ok {
+		return
+	}
+	if h.notModified(w, r) {
+		return
+	}
+	var dims []string
+	if v := r.URL.Query().Get("group_by"); v != "" {
+		dims = strings.Split(v, ",")
+		for i := range dims {
+			dims[i] = strings.TrimSpace(dims[i])
+		}
+	}
+
+	if day != "" {
+		if dims != nil {
+			if err := repository.ValidateDimensions(dims); err != nil {
+				writeError(w, http.StatusBadRequest, "invalid group_by: "+err.Error())
+				return
+			}
+		}
+		snap, summary, err := h.reconSvc.AsOf(day, dims)
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, http.StatusNotFound, "no snapshot on or before "+day)
+			return
+		}
+		if err != nil {
+			writeServerError(w, err)
+			return
+		}
+		summary.AsOf = asOfInfo(day, snap)
+		writeJSON(w, http.StatusOK, summary)
+		return
+	}
+
+	summary, err := h.discRepo.GetSummary(repository.DashboardScope{})
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+
+	if dims != nil {
+		groups, err := h.discRepo.GroupBy(dims...)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid group_by: "+err.Error())
+			return
+		}
+		summary.GroupBy = dims
+		summary.Groups = groups
+	}
+
+	writeJSON(w, http.StatusOK, summary)
+}
+
+// --- GetDashboard ---
+
+// GetDashboard shows the figures of the dashboard view in ?view=, or of the
+// caller's default view when there is no such parameter. ?view=none shows
+// everything. ?as_of=YYYY-MM-DD shows everything as it stood at the end of
+// that day. ?currency= adds the money figures converted to that currency.
+func (h *Handlers) GetDashboard(w http.ResponseWriter, r *http.Request) {
+	day, ok := asOfParam(w, r)
+	if !ok {
+		return
+	}
+	conv, ok := conversionParam(w, r, day)
+	if !ok {
+		return
+	}
+	if day != "" {
+		h.getDashboardAsOf(w, r, day, conv)
+		return
+	}
+	if id := r.URL.Query().Get("view"); id != "" && id != "none" && requestUser(r) == "" {
+		writeError(w, http.StatusBadRequest, "X-User-ID header is required with view")
+		return
+	}
+	view, err := h.dashboardView(r)
+	if errors.Is(err, sql.ErrNoRows) {
+		writeError(w, http.StatusNotFound, "dashboard view not found")
+		return
+	}
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+	var scope repository.DashboardScope
+	var key string
+	if view != nil {
+		scope = viewScope(view, time.Now())
+		key = view.ID
+		if scope.From != nil {
+			key += "|" + scope.From.Format("2006-01-02")
+		}
+	}
+	if h.notModifiedFor(w, r, key+"|"+conv.key()) {
+		return
+	}
+
+	stats, err := h.txnRepo.GetDashboardStats(scope)
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+
+	discSummary, err := h.discRepo.GetSummary(scope)
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+
+	processorVols, err := h.txnRepo.GetVolumeByProcessor(scope)
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+
+	discStats, err := h.discRepo.GetStatsByProcessor(scope)
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+
+	currencyVols, err := h.txnRepo.GetVolumeByCurrency(scope)
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+
+	dashboard := dashboardFigures(stats, discSummary, processorVols, discStats, currencyVols)
+	if view != nil {
+		dashboard["view"] = view
+		period := dashboard["period"].(map[string]string)
+		if scope.From != nil {
+			period["from"] = scope.From.Format("2006-01-02")
+		}
+		if scope.To != nil {
+			period["to"] = scope.To.AddDate(0, 0, -1).Format("2006-01-02")
+		}
+	}
+
+	if !h.addPeriodClose(w, r, dashboard) {
+		return
+	}
+	writeConverted(w, http.StatusOK, dashboard, conv)
+}
+
+// getDashboardAsOf is GetDashboard for ?as_of=: the figures of the last
+// snapshot captured on or before day, over every processor and currency.
+// Money figures are converted at day's rate.
+func (h *Handlers) getDashboardAsOf(w http.ResponseWriter, r *http.Request, day string, conv *conversion) {
+	if id := r.URL.Query().Get("view"); id != "" && id != "none" {
+		writeError(w, http.StatusBadRequest, "as_of cannot be combined with view")
+		return
+	}
+	if h.notModifiedFor(w, r, conv.key()) {
+		return
+	}
+	snap, discSummary, err := h.reconSvc.AsOf(day, nil)
+	if errors.Is(err, sql.ErrNoRows) {
+		writeError(w, http.StatusNotFound, "no snapshot on or before "+day)
+		return
+	}
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+
+	var discStats []repository.ProcessorDiscrepancyStat
+	for proc, n := range discSummary.ByProcessor {
+		discStats = append(discStats, repository.ProcessorDiscrepancyStat{
+			Processor:        proc,
+			DiscrepancyCount: n,
+			ImpactUSD:        discSummary.ImpactByProc[proc],
+		})
+	}
+	f := snap.Figures
+	dashboard := dashboardFigures(&f.Transactions, discSummary, f.ByProcessor, discStats, f.ByCurrency)
+	dashboard["as_of"] = asOfInfo(day, snap)
+
+	if !h.addPeriodClose(w, r, dashboard) {
+		return
+	}
+	writeConverted(w, http.StatusOK, dashboard, conv)
+}
+
+// addPeriodClose adds, for ?period=YYYY-MM, that period's figures as closed
+// and as they are now, for every processor whatever the view. It writes the
+// error and returns false when it cannot.
+func (h *Handlers) addPeriodClose(w http.ResponseWriter, r *http.Request, dashboard map[string]any) bool {
+	period := r.URL.Query().Get("period")
+	if period == "" {
+		return true
+	}
+	if !validPeriod(period) {
+		writeError(w, http.StatusBadRequest, "period must be YYYY-MM")
+		return false
+	}
+	view, err := h.periodView(period)
+	if err != nil {
+		writeServerError(w, err)
+		return false
+	}
+	dashboard["period_close"] = view
+	return true
+}
+
+// dashboardFigures lays out the dashboard's figures, merging the processor
+// volumes with their discrepancy stats.
+func dashboardFigures(stats *repository.DashboardStats, discSummary *repository.DiscrepancySummary,
+	processorVols []repository.ProcessorVolume, discStats []repository.ProcessorDiscrepancyStat,
+	currencyVols []repository.CurrencyVolume) map[string]any {
+	type procEntry struct {
+		Processor        string  `json:"processor"`
+		SettledUSD       float64 `json:"settled_usd"`
+		DiscrepancyCount int     `json:"discrepancy_count"`
+		ImpactUSD        float64 `json:"discrepancy_impact_usd"`
+	}
+
+	discMap := make(map[string]repository.ProcessorDiscrepancyStat)
+	for _, ds := range discStats {
+		discMap[ds.Processor] = ds
+	}
+
+	var byProcessor []procEntry
+	for _, pv := range processorVols {
+		entry := procEntry{
+			Processor:  pv.Processor,
+			SettledUSD: roundUSD(pv.SettledUSD),
+		}
+		if ds, ok := discMap[pv.Processor]; ok {
+			entry.DiscrepancyCount = ds.DiscrepancyCount
+			entry.ImpactUSD = roundUSD(ds.ImpactUSD)
+		}
+		byProcessor = append(byProcessor, entry)
+	}
+
+	return map[string]any{
+		"period": map[string]string{
+			"from": "2024-01-08",
+			"to":   "2024-01-21",
+		},
+		"transactions": map[string]int{
+			"total":              stats.Total,
+			"captured":           stats.Captured,
+			"settled":            stats.Settled,
+			"pending_settlement": stats.PendingSettlement,
+		},
+		"volume": map[string]float64{
+			"total_usd":     roundUSD(stats.TotalUSD),
+			"settled_usd":   roundUSD(stats.SettledUSD),
+			"unsettled_usd": roundUSD(stats.UnsettledUSD),
+		},
+		"discrepancies": map[string]any{
+			"total":            discSummary.TotalCount,
+			"critical":         discSummary.BySeverity["CRITICAL"],
+			"high":             discSummary.BySeverity["HIGH"],
+			"medium":           discSummary.BySeverity["MEDIUM"],
+			"low":              discSummary.BySeverity["LOW"],
+			"total_impact_usd": roundUSD(discSummary.TotalImpact),
+		},
+		"by_processor": byProcessor,
+		"by_currency":  currencyVols,
+	}
+}
+
+// asOfParam returns the day in ?as_of=, or "" when there is none. It writes
+// a 400 and returns false when the day is not a YYYY-MM-DD date.
+func asOfParam(w http.ResponseWriter, r *http.Request) (string, bool) {
+	v := r.URL.Query().Get("as_of")
+	if v == "" {
+		return "", true
+	}
+	if _, err := time.Parse("2006-01-02", v); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid as_of: use YYYY-MM-DD")
+		return "", false
+	}
+	return v, true
+}
+
+// asOfInfo says which snapshot answered a request for the end of day.
+func asOfInfo(day string, snap *repository.DailySnapshot) *repository.AsOf {
+	return &repository.AsOf{Date: day, SnapshotDate: snap.Day, CapturedAt: snap.CapturedAt}
+}
+
+// conversion is the rate the money figures of a dashboard or analytics
+// response were converted at for ?currency=.
+type conversion struct {
+	Currency    string  `json:"currency"`
+	UnitsPerUSD float64 `json:"units_per_usd"`
+	// RateDate is the day whose rate was used: today, or the as_of day.
+	RateDate string `json:"rate_date"`
+}
+
+// conversionParam reads ?currency=, to be converted at the rate in effect
+// on day, or today when day is "". It returns nil when there is no such
+// parameter, and writes a 400 and returns false for an unsupported
+// currency.
+func conversionParam(w http.ResponseWriter, r *http.Request, day string) (*conversion, bool) {
+	code := strings.ToUpper(strings.TrimSpace(r.URL.Query().Get("currency")))
+	if code == "" {
+		return nil, true
+	}
+	at := time.Now().UTC()
+	if day != "" {
+		at, _ = time.Parse("2006-01-02", day)
+	}
+	rate, err := currency.RateAt(code, at)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid currency: must be one of "+strings.Join(currency.Codes(), ", "))
+		return nil, false
+	}
+	return &conversion{Currency: code, UnitsPerUSD: rate, RateDate: at.Format("2006-01-02")}, true
+}
+
+// key tells apart the ETags of responses converted at different rates,
+// since today's rate changes when a new one takes effect.
+func (c *conversion) key() string {
+	if c == nil {
+		return ""
+	}
+	return fmt.Sprintf("%s@%g", c.Currency, c.UnitsPerUSD)
+}
+
+// writeConverted is writeJSON with, next to every USD figure of v (keys
+// "usd" and "*_usd"), the figure in c's currency under the key with that
+// suffix instead, e.g. total_ngn beside total_usd, and c under
+// "conversion". The USD figures are left as they are. With c nil it is
+// writeJSON.
+func writeConverted(w http.ResponseWriter, status int, v any, c *conversion) {
+	if c == nil {
+		writeJSON(w, status, v)
+		return
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var doc any
+	if err := dec.Decode(&doc); err != nil {
+		writeServerError(w, err)
+		return
+	}
+	addConverted(doc, strings.ToLower(c.Currency), c.UnitsPerUSD)
+	if m, ok := doc.(map[string]any); ok {
+		m["conversion"] = c
+	}
+	writeJSON(w, status, doc)
+}
+
+// unsuffixedUSD are the USD figures whose keys do not say so: the
+// dashboard's volumes by currency.
+var unsuffixedUSD = map[string]bool{"volume": true, "settled_volume": true}
+
+func addConverted(v any, suffix string, unitsPerUSD float64) {
+	switch v := v.(type) {
+	case map[string]any:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		for _, k := range keys {
+			n, ok := v[k].(json.Number)
+			if !ok {
+				addConverted(v[k], suffix, unitsPerUSD)
+				continue
+			}
+			var to string
+			switch {
+			case k == "usd" || strings.HasSuffix(k, "_usd"):
+				to = strings.TrimSuffix(k, "usd") + suffix
+			case unsuffixedUSD[k]:
+				to = k + "_" + suffix
+			default:
+				continue
+			}
+			if usd, err := n.Float64(); err == nil {
+				v[to] = roundUSD(usd * unitsPerUSD)
+			}
+		}
+	case []any:
+		for _, x := range v {
+			addConverted(x, suffix, unitsPerUSD)
+		}
+	}
+}
+
+// dashboardView returns the dashboard view a request asks for: the caller's
+// view named by ?view=, their default view when the parameter is absent, or
+// nil for ?view=none and callers without a default. It returns
+// sql.ErrNoRows for a view the caller does not own.
+func (h *Handlers) dashboardView(r *http.Request) (*domain.DashboardView, error) {
+	id := r.URL.Query().Get("view")
+	if id == "none" {
+		return nil, nil
+	}
+	user := requestUser(r)
+	if id != "" {
+		return h.viewRepo.GetForUser(id, user)
+	}
+	if user == "" {
+		return nil, nil
+	}
+	view, err := h.viewRepo.DefaultForUser(user)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	return view, err
+}
+
+func viewScope(v *domain.DashboardView, now time.Time) repository.DashboardScope {
+	from, to := v.Range(now)
+	return repository.DashboardScope{
+		Processors: v.Processors,
+		Currencies: v.Currencies,
+		MerchantID: v.MerchantID,
+		From:       from,
+		To:         to,
+	}
+}
+
+// --- Top offenders ---
+
+// maxTopOffenders caps the limit parameter of GetTopOffenders.
+const maxTopOffenders = 50
+
+// GetDashboardLive upgrades to a WebSocket on which new discrepancies,
+// matches, ingests and run totals are pushed as they happen. Browsers may
+// connect from the server's own origin or one CORS allows.
+func (h *Handlers) GetDashboardLive(w http.ResponseWriter, r *http.Request) {
+	if h.feed == nil {
+		writeError(w, http.StatusNotFound, "live feed is not available")
+		return
+	}
+	if origin := r.Header.Get("Origin"); origin != "" && w.Header().Get("Access-Control-Allow-Origin") == "" {
+		if u, err := url.Parse(origin); err != nil || !strings.EqualFold(u.Host, r.Host) {
+			writeError(w, http.StatusForbidden, "origin not allowed")
+			return
+		}
+	}
+
+	conn, err := live.Upgrade(w, r)
+	var hs *live.HandshakeError
+	if errors.As(err, &hs) {
+		writeError(w, hs.Status, hs.Message)
+		return
+	}
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+	h.feed.Serve(conn)
+}
+
+// GetTopOffenders ranks merchants and batches by the USD impact of their
+// open discrepancies, for the ops dashboard. ?currency= adds the impacts
+// converted to that currency.
+func (h *Handlers) GetTopOffenders(w http.ResponseWriter, r *http.Request) {
+	conv, ok := conversionParam(w, r, "")
+	if !ok {
+		return
+	}
+	if h.notModifiedFor(w, r, conv.key()) {
+		return
+	}
+	q := r.URL.Query()
+
+	limit := parseIntDefault(q.Get("limit"), 5)
+	if limit < 1 || limit > maxTopOffenders {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid limit: must be between 1 and %d", maxTopOffenders))
+		return
+	}
+	processor := q.Get("processor")
+	if processor != "" && !validProcessor(processor) {
+		writeError(w, http.StatusBadRequest, "invalid processor: must be one of afripay, nairagateway, capepay, mpesa")
+		return
+	}
+
+	merchants, err := h.discRepo.TopMerchants(processor, limit)
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+	batches, err := h.discRepo.TopBatches(processor, limit)
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+	for i := range merchants {
+		merchants[i].ImpactUSD = roundUSD(merchants[i].ImpactUSD)
+	}
+	for i := range batches {
+		batches[i].ImpactUSD = roundUSD(batches[i].ImpactUSD)
+	}
+
+	writeConverted(w, http.StatusOK, map[string]any{
+		"limit":     limit,
+		"merchants": merchants,
+		"batches":   batches,
+	}, conv)
+}
+
+// --- Discrepancy flow ---
+
+// flowIntervals are the bucket sizes GetDiscrepancyFlow accepts, with the
+// number of buckets returned when from is omitted.
+var flowIntervals = map[string]int{"day": 30, "week": 12, "month": 12}
+
+// maxFlowBuckets caps the length of one flow response.
+const maxFlowBuckets = 366
+
+// flowBucketStart truncates t (UTC) to the start of its bucket. Weeks start
+// on Monday.
+func flowBucketStart(t time.Time, interval string) time.Time {
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	switch interval {
+	case "week":
+		return day.AddDate(0, 0, -(int(day.Weekday())+6)%7)
+	case "month":
+		return day.AddDate(0, 0, 1-day.Day())
+	default:
+		return day
+	}
+}
+
+func flowNextBucket(t time.Time, interval string) time.Time {
+	switch interval {
+	case "week":
+		return t.AddDate(0, 0, 7)
+	case "month":
+		return t.AddDate(0, 1, 0)
+	default:
+		return t.AddDate(0, 0, 1)
+	}
+}
+
+// GetDiscrepancyFlow returns, per day, week or month, how many discrepancies
+// full reconciliation runs opened and resolved, and the open backlog at the
+// end of each period.
+func (h *Handlers) GetDiscrepancyFlow(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+
+	interval := q.Get("interval")
+	if interval == "" {
+		interval = "day"
+	}
+	defaultBuckets, ok := flowIntervals[interval]
+	if !ok {
+		writeError(w, http.StatusBadRequest, "interval must be day, week or month")
+		return
+	}
+
+	// to is inclusive in the query and exclusive internally: the range runs
+	// to the end of the bucket containing it.
+	to := time.Now().UTC()
+	if v := q.Get("to"); v != "" {
+		t := parseTime(v)
+		if t == nil {
+			writeError(w, http.StatusBadRequest, "to must be RFC3339 or YYYY-MM-DD")
+			return
+		}
+		to = t.UTC()
+	}
+	end := flowNextBucket(flowBucketStart(to, interval), interval)
+
+	start := flowBucketStart(to, interval)
+	for i := 1; i < defaultBuckets; i++ {
+		start = flowBucketStart(start.AddDate(0, 0, -1), interval)
+	}
+	if v := q.Get("from"); v != "" {
+		t := parseTime(v)
+		if t == nil {
+			writeError(w, http.StatusBadRequest, "from must be RFC3339 or YYYY-MM-DD")
+			return
+		}
+		start = flowBucketStart(t.UTC(), interval)
+	}
+	if !start.Before(end) {
+		writeError(w, http.StatusBadRequest, "from must not be after to")
+		return
+	}
+
+	var periods []time.Time
+	for t := start; t.Before(end); t = flowNextBucket(t, interval) {
+		if len(periods) == maxFlowBuckets {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("range covers more than %d %ss", maxFlowBuckets, interval))
+			return
+		}
+		periods = append(periods, t)
+	}
+
+	openAtStart, days, err := h.discRepo.GetFlow(repository.DiscrepancyFlowFilter{
+		Processor: q.Get("processor"),
+		Type:      q.Get("type"),
+		From:      start,
+		To:        end,
+	})
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+
+	type bucket struct {
+		Period      string `json:"period"`
+		Opened      int    `json:"opened"`
+		Resolved    int    `json:"resolved"`
+		NetChange   int    `json:"net_change"`
+		OpenBacklog int    `json:"open_backlog"`
+	}
+
+	buckets := make([]bucket, len(periods))
+	index := make(map[string]int, len(periods))
+	for i, p := range periods {
+		buckets[i].Period = p.Format("2006-01-02")
+		index[buckets[i].Period] = i
+	}
+	for _, d := range days {
+		day, err := time.Parse("2006-01-02", d.Day)
+		if err != nil {
+			continue
+		}
+		i, ok := index[flowBucketStart(day, interval).Format("2006-01-02")]
+		if !ok {
+			continue
+		}
+		buckets[i].Opened += d.Opened
+		buckets[i].Resolved += d.Resolved
+	}
+
+	backlog := openAtStart
+	totalOpened, totalResolved := 0, 0
+	for i := range buckets {
+		buckets[i].NetChange = buckets[i].Opened - buckets[i].Resolved
+		backlog += buckets[i].NetChange
+		buckets[i].OpenBacklog = backlog
+		totalOpened += buckets[i].Opened
+		totalResolved += buckets[i].Resolved
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{
+		"interval":      interval,
+		"from":          start.Format("2006-01-02"),
+		"to":            end.AddDate(0, 0, -1).Format("2006-01-02"),
+		"open_at_start": openAtStart,
+		"opened":        totalOpened,
+		"resolved":      totalResolved,
+		"open_at_end":   backlog,
+		"buckets":       buckets,
+	})
+}
+
+// --- Fee analytics ---
+
+// GetFeeAnalytics breaks settlement costs down per processor into processing
+// fees, penalties, chargeback fees and other adjustments, and the processing
+// fees into their components, for records settled in the optional from/to
+// range. ?currency= adds the amounts
+// converted to that currency.
+func (h *Handlers) GetFeeAnalytics(w http.ResponseWriter, r *http.Request) {
+	conv, ok := conversionParam(w, r, "")
+	if !ok {
+		return
+	}
+	q := r.URL.Query()
+	fees, err := h.settRepo.GetFeeBreakdown(repository.SettlementFilter{
+		Processor: q.Get("processor"),
+		From:      parseTime(q.Get("from")),
+		To:        parseTime(q.Get("to")),
+	})
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+
+	total := repository.ProcessorFees{Processor: "all", Costs: map[domain.CostCategory]repository.CostTotal{
+		domain.CostProcessingFee: {}, domain.CostPenalty: {},
+		domain.CostChargebackFee: {}, domain.CostAdjustment: {},
+		domain.CostRefund: {}, domain.CostWithholdingTax: {},
+		domain.CostCarriedBalance: {},
+	}, FeeComponents: map[string]repository.CostTotal{}}
+	for i := range fees {
+		pf := &fees[i]
+		total.SalesUSD += pf.SalesUSD
+		total.TotalCostUSD += pf.TotalCostUSD
+		for cat, c := range pf.Costs {
+			t := total.Costs[cat]
+			t.Count += c.Count
+			t.USD += c.USD
+			total.Costs[cat] = t
+			pf.Costs[cat] = repository.CostTotal{Count: c.Count, USD: roundUSD(c.USD)}
+		}
+		for component, c := range pf.FeeComponents {
+			t := total.FeeComponents[component]
+			t.Count += c.Count
+			t.USD += c.USD
+			total.FeeComponents[component] = t
+			pf.FeeComponents[component] = repository.CostTotal{Count: c.Count, USD: roundUSD(c.USD)}
+		}
+		pf.SalesUSD = roundUSD(pf.SalesUSD)
+		pf.TotalCostUSD = roundUSD(pf.TotalCostUSD)
+		pf.CostRate = math.Round(pf.CostRate*10000) / 10000
+	}
+	if total.SalesUSD > 0 {
+		total.CostRate = math.Round(total.TotalCostUSD/total.SalesUSD*10000) / 10000
+	}
+	for cat, c := range total.Costs {
+		total.Costs[cat] = repository.CostTotal{Count: c.Count, USD: roundUSD(c.USD)}
+	}
+	for component, c := range total.FeeComponents {
+		total.FeeComponents[component] = repository.CostTotal{Count: c.Count, USD: roundUSD(c.USD)}
+	}
+	total.SalesUSD = roundUSD(total.SalesUSD)
+	total.TotalCostUSD = roundUSD(total.TotalCostUSD)
+
+	writeConverted(w, http.StatusOK, map[string]any{
+		"processors": fees,
+		"total":      total,
+	}, conv)
+}
+
+// --- Mismatch deltas ---
+
+// maxDeltaBands caps the bands of one mismatch delta histogram.
+const maxDeltaBands = 200
+
+// deltaBand counts the matched pairs whose settled gross differs from the
+// transaction amount by FromPct (inclusive) to ToPct percent. A nil end is
+// open. Share is Count over the processor's matched pairs.
+type deltaBand struct {
+	FromPct    *float64 `json:"from_pct"`
+	ToPct      *float64 `json:"to_pct"`
+	Count      int      `json:"count"`
+	Mismatches int      `json:"mismatches"`
+	Share      float64  `json:"share"`
+}
+
+// processorDeltas is one processor's histogram of settled-versus-expected
+// differences, in percent of the transaction amount.
+type processorDeltas struct {
+	Processor  string      `json:"processor"`
+	Matched    int         `json:"matched"`
+	Mismatches int         `json:"mismatches"`
+	MeanPct    float64     `json:"mean_pct"`
+	MedianPct  float64     `json:"median_pct"`
+	Bands      []deltaBand `json:"bands"`
+}
+
+// GetMismatchDeltas buckets, per processor, how far each matched record's
+// USD gross is from its transaction's amount, in percent bands of width
+// (default 0.25) from -max to +max (default 2) with an open band at each
+// end. Every matched pair counts, not only those reported as mismatches, so
+// a systematic difference inside the tolerance shows as a shifted peak.
+// processor and an optional from/to settlement date range narrow it.
+func (h *Handlers) GetMismatchDeltas(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	width, limit := 0.25, 2.0
+	for name, dst := range map[string]*float64{"width": &width, "max": &limit} {
+		v := q.Get(name)
+		if v == "" {
+			continue
+		}
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil || f <= 0 || math.IsInf(f, 0) {
+			writeError(w, http.StatusBadRequest, name+" must be a positive percentage")
+			return
+		}
+		*dst = f
+	}
+	inner := int(math.Ceil(2*limit/width - 1e-9))
+	if inner+2 > maxDeltaBands {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("width and max give more than %d bands", maxDeltaBands))
+		return
+	}
+	processor := q.Get("processor")
+	if processor != "" && !validProcessor(processor) {
+		writeError(w, http.StatusBadRequest, "invalid processor: must be one of afripay, nairagateway, capepay, mpesa")
+		return
+	}
+
+	amounts, err := h.settRepo.GetMatchedAmounts(repository.SettlementFilter{
+		Processor: processor,
+		From:      parseTime(q.Get("from")),
+		To:        parseTime(q.Get("to")),
+	})
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+
+	edges := make([]float64, inner+1)
+	for i := range edges {
+		edges[i] = math.Round((-limit+float64(i)*width)*10000) / 10000
+	}
+	edges[inner] = limit
+
+	result := []processorDeltas{}
+	byProc := map[string][]float64{}
+	for _, a := range amounts {
+		if a.TransactionUSD == 0 {
+			continue
+		}
+		if n := len(result); n == 0 || result[n-1].Processor != a.Processor {
+			result = append(result, processorDeltas{Processor: a.Processor, Bands: newDeltaBands(edges)})
+		}
+		pd := &result[len(result)-1]
+		pct := (a.SettledUSD - a.TransactionUSD) / a.TransactionUSD * 100
+		band := &pd.Bands[deltaBandIndex(pct, edges)]
+		band.Count++
+		pd.Matched++
+		if a.Mismatch {
+			band.Mismatches++
+			pd.Mismatches++
+		}
+		byProc[a.Processor] = append(byProc[a.Processor], pct)
+	}
+	for i := range result {
+		pd := &result[i]
+		deltas := byProc[pd.Processor]
+		sort.Float64s(deltas)
+		var sum float64
+		for _, d := range deltas {
+			sum += d
+		}
+		pd.MeanPct = math.Round(sum/float64(len(deltas))*1000) / 1000
+		median := deltas[len(deltas)/2]
+		if len(deltas)%2 == 0 {
+			median = (deltas[len(deltas)/2-1] + median) / 2
+		}
+		pd.MedianPct = math.Round(median*1000) / 1000
+		for j := range pd.Bands {
+			pd.Bands[j].Share = math.Round(float64(pd.Bands[j].Count)/float64(pd.Matched)*10000) / 10000
+		}
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{
+		"band_width_pct": width,
+		"max_pct":        limit,
+		"processors":     result,
+	})
+}
+
+// newDeltaBands returns empty bands between consecutive edges, with an
+// open band below the first and above the last.
+func newDeltaBands(edges []float64) []deltaBand {
+	bands := make([]deltaBand, len(edges)+1)
+	for i := range edges {
+		bands[i].ToPct = &edges[i]
+		bands[i+1].FromPct = &edges[i]
+	}
+	return bands
+}
+
+// deltaBandIndex returns the band of newDeltaBands(edges) that pct falls in.
+func deltaBandIndex(pct float64, edges []float64) int {
+	return sort.Search(len(edges), func(i int) bool { return pct < edges[i] })
+}
+
+// --- Settlement calendar ---
+
+// calendarProcessors are the processors a settlement calendar covers.
+var calendarProcessors = []domain.Processor{
+	domain.ProcessorAfriPay, domain.ProcessorNairaGateway, domain.ProcessorCapePay, domain.ProcessorMPesa,
+}
+
+// calendarEntry is one processor's settlement on one day. Missing is set
+// on a past day the processor settles on with no records dated it, from the
+// processor's first settlement on.
+type calendarEntry struct {
+	Processor  string   `json:"processor"`
+	Expected   bool     `json:"expected"`
+	Batches    []string `json:"batches"`
+	Records    int      `json:"records"`
+	USDSettled float64  `json:"usd_settled"`
+	Missing    bool     `json:"missing"`
+}
+
+type calendarDay struct {
+	Date              string          `json:"date"`
+	BatchesExpected   int             `json:"batches_expected"`
+	BatchesReceived   int             `json:"batches_received"`
+	USDSettled        float64         `json:"usd_settled"`
+	Missing           bool            `json:"missing"`
+	MissingProcessors []string        `json:"missing_processors"`
+	Processors        []calendarEntry `json:"processors"`
+}
+
+// GetSettlementCalendar returns, for each day of ?month= (YYYY-MM, default
+// the current month), the batches expected by each processor's settlement
+// days, the batches with records dated that day, the USD net settled, and
+// which expected batches are missing. ?processor= narrows it to one
+// processor.
+func (h *Handlers) GetSettlementCalendar(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	today := time.Now().UTC().Truncate(24 * time.Hour)
+	start := today.AddDate(0, 0, 1-today.Day())
+	if v := q.Get("month"); v != "" {
+		t, err := time.Parse("2006-01", v)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "month must be YYYY-MM")
+			return
+		}
+		start = t
+	}
+	end := start.AddDate(0, 1, -1)
+
+	procs := calendarProcessors
+	if p := q.Get("processor"); p != "" {
+		if !validProcessor(p) {
+			writeError(w, http.StatusBadRequest, "invalid processor: must be one of afripay, nairagateway, capepay, mpesa")
+			return
+		}
+		procs = []domain.Processor{domain.Processor(p)}
+	}
+
+	batchDays, err := h.settRepo.GetBatchDays(q.Get("processor"), start.Format("2006-01-02"), end.Format("2006-01-02"))
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+	first, err := h.settRepo.GetFirstSettlementDays()
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+	received := make(map[string][]repository.BatchDay)
+	for _, b := range batchDays {
+		received[b.Day+"/"+b.Processor] = append(received[b.Day+"/"+b.Processor], b)
+	}
+
+	var totalExpected, totalReceived, totalMissing int
+	var totalUSD float64
+	days := []calendarDay{}
+	for day := start; !day.After(end); day = day.AddDate(0, 0, 1) {
+		date := day.Format("2006-01-02")
+		cd := calendarDay{Date: date, MissingProcessors: []string{}, Processors: []calendarEntry{}}
+		for _, proc := range procs {
+			since, active := first[string(proc)]
+			e := calendarEntry{
+				Processor: string(proc),
+				Expected:  active && date >= since && ingestion.SettlementDaysFor(proc).Expects(day),
+				Batches:   []string{},
+			}
+			for _, b := range received[date+"/"+string(proc)] {
+				e.Batches = append(e.Batches, b.BatchID)
+				e.Records += b.Records
+				e.USDSettled += b.USDNet
+			}
+			e.Missing = e.Expected && len(e.Batches) == 0 && day.Before(today)
+			if e.Expected {
+				cd.BatchesExpected++
+			}
+			if e.Missing {
+				cd.Missing = true
+				cd.MissingProcessors = append(cd.MissingProcessors, e.Processor)
+			}
+			cd.BatchesReceived += len(e.Batches)
+			cd.USDSettled += e.USDSettled
+			e.USDSettled = roundUSD(e.USDSettled)
+			cd.Processors = append(cd.Processors, e)
+		}
+		totalExpected += cd.BatchesExpected
+		totalReceived += cd.BatchesReceived
+		totalMissing += len(cd.MissingProcessors)
+		totalUSD += cd.USDSettled
+		cd.USDSettled = roundUSD(cd.USDSettled)
+		days = append(days, cd)
+	}
+
+	settlementDays := make(map[string]string, len(procs))
+	for _, proc := range procs {
+		settlementDays[string(proc)] = ingestion.SettlementDaysFor(proc).String()
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"month":           start.Format("2006-01"),
+		"settlement_days": settlementDays,
+		"totals": map[string]any{
+			"batches_expected": totalExpected,
+			"batches_received": totalReceived,
+			"missing":          totalMissing,
+			"usd_settled":      roundUSD(totalUSD),
+		},
+		"days": days,
+	})
+}
+
+// --- ListSettlements ---
+
+// maxDateWindowDays is the widest date_window_days a settlement search
+// takes.
+const maxDateWindowDays = 366
+
+// settlementFilter reads the settlement list filters from q, apart from
+// the sort order. It returns an error for an invalid amount or date search.
+func settlementFilter(q url.Values) (repository.SettlementFilter, error) {
+	f := repository.SettlementFilter{
+		Processor:   q.Get("processor"),
+		BatchID:     q.Get("batch_id"),
+		Currency:    strings.ToUpper(q.Get("currency")),
+		From:        parseTime(q.Get("from")),
+		To:          parseTime(q.Get("to")),
+		AmountField: q.Get("amount_field"),
+		Page:        parseIntDefault(q.Get("page"), 1),
+		Limit:       parseLimit(q.Get("limit"), 50),
+	}
+	if f.AmountField != "" && !repository.ValidSettlementAmountField(f.AmountField) {
+		return f, errors.New("invalid amount_field: must be one of gross, net, usd_gross, usd_net")
+	}
+
+	for _, p := range []struct {
+		name string
+		dst  **float64
+	}{{"min_amount", &f.MinAmount}, {"max_amount", &f.MaxAmount}, {"amount", &f.NearAmount}} {
+		if v := q.Get(p.name); v != "" {
+			n, err := strconv.ParseFloat(v, 64)
+			if err != nil || math.IsNaN(n) || math.IsInf(n, 0) {
+				return f, fmt.Errorf("invalid %s: must be a number", p.name)
+			}
+			*p.dst = &n
+		}
+	}
+	if f.NearAmount != nil {
+		if f.MinAmount != nil || f.MaxAmount != nil {
+			return f, errors.New("amount cannot be combined with min_amount or max_amount")
+		}
+		tol, err := parseAmountTolerance(q, *f.NearAmount)
+		if err != nil {
+			return f, err
+		}
+		// Half a cent either way, so amounts read as floats still match.
+		lo, hi := *f.NearAmount-tol-0.005, *f.NearAmount+tol+0.005
+		f.MinAmount, f.MaxAmount = &lo, &hi
+	} else if q.Get("amount_tolerance") != "" || q.Get("amount_tolerance_pct") != "" {
+		return f, errors.New("amount_tolerance and amount_tolerance_pct need amount")
+	}
+	if f.MinAmount != nil && f.MaxAmount != nil && *f.MinAmount > *f.MaxAmount {
+		return f, errors.New("min_amount must not be more than max_amount")
+	}
+
+	if d := q.Get("date"); d != "" {
+		if f.From != nil || f.To != nil {
+			return f, errors.New("date cannot be combined with from or to")
+		}
+		day, err := time.Parse("2006-01-02", d)
+		if err != nil {
+			return f, errors.New("invalid date: must be YYYY-MM-DD")
+		}
+		window := 0
+		if v := q.Get("date_window_days"); v != "" {
+			window, err = strconv.Atoi(v)
+			if err != nil || window < 0 || window > maxDateWindowDays {
+				return f, fmt.Errorf("invalid date_window_days: must be between 0 and %d", maxDateWindowDays)
+			}
+		}
+		f.DateFrom = day.AddDate(0, 0, -window).Format("2006-01-02")
+		f.DateTo = day.AddDate(0, 0, window).Format("2006-01-02")
+	} else if q.Get("date_window_days") != "" {
+		return f, errors.New("date_window_days needs date")
+	}
+	return f, nil
+}
+
+// parseAmountTolerance reads amount_tolerance, an absolute amount, or
+// amount_tolerance_pct, a percentage of amount. Neither is no tolerance.
+func parseAmountTolerance(q url.Values, amount float64) (float64, error) {
+	abs, pct := q.Get("amount_tolerance"), q.Get("amount_tolerance_pct")
+	switch {
+	case abs != "" && pct != "":
+		return 0, errors.New("give amount_tolerance or amount_tolerance_pct, not both")
+	case abs != "":
+		v, err := strconv.ParseFloat(abs, 64)
+		if err != nil || !(v >= 0) || math.IsInf(v, 0) {
+			return 0, errors.New("invalid amount_tolerance: must be a non-negative amount")
+		}
+		return v, nil
+	case pct != "":
+		v, err := strconv.ParseFloat(pct, 64)
+		if err != nil || !(v >= 0) || v > 100 {
+			return 0, errors.New("invalid amount_tolerance_pct: must be between 0 and 100")
+		}
+		return math.Abs(amount) * v / 100, nil
+	}
+	return 0, nil
+}
+
+func (h *Handlers) ListSettlements(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	sortKeys, err := repository.ParseSettlementSort(q.Get("sort"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	filter, err := settlementFilter(q)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	filter.Sort = sortKeys
+
+	records, total, err := h.settRepo.ListRecords(filter)
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{
+		"settlements": records,
+		"total":       total,
+		"page":        filter.Page,
+		"limit":       filter.Limit,
+	})
+}
+
+// --- Exports ---
+
+// Export formats. CSV has a header row; NDJSON is one JSON object per line,
+// shaped like the list endpoints' items.
+const (
+	exportCSV    = "csv"
+	exportNDJSON = "ndjson"
+)
+
+// exporter writes an export's rows to the response as they are read from
+// the database, so exports of any size use the same memory.
+type exporter struct {
+	csv *csv.Writer
+	enc *json.Encoder
+}
+
+// startExport checks the format parameter and starts an export named name.
+// It writes a 400 and returns nil if the format is unknown.
+func startExport(w http.ResponseWriter, r *http.Request, name string, columns []string) *exporter {
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = exportCSV
+	}
+
+	var e *exporter
+	switch format {
+	case exportCSV:
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		e = &exporter{csv: csv.NewWriter(w)}
+		e.csv.Write(columns)
+	case exportNDJSON:
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		e = &exporter{enc: json.NewEncoder(w)}
+	default:
+		writeError(w, http.StatusBadRequest, "invalid format: must be csv or ndjson")
+		return nil
+	}
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name+"."+format))
+	return e
+}
+
+// row writes one row: v in NDJSON, or cells in CSV.
+func (e *exporter) row(v any, cells []string) error {
+	if e.enc != nil {
+		return e.enc.Encode(v)
+	}
+	if err := e.csv.Write(cells); err != nil {
+		return err
+	}
+	return e.csv.Error()
+}
+
+// finish flushes the export. The status is sent with the first rows, so an
+// export that fails part way, including because the client went away,
+// aborts the connection: the client sees a broken transfer rather than a
+// file that looks complete.
+func (e *exporter) finish(err error) {
+	if err == nil && e.csv != nil {
+		e.csv.Flush()
+		err = e.csv.Error()
+	}
+	if err != nil {
+		log.Printf("[api] export failed: %v", err)
+		panic(http.ErrAbortHandler)
+	}
+}
+
+func exportFloat(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
+
+func exportTime(t *time.Time) string {
+	if t == nil {
+		return ""
+	}
+	return t.Format(time.RFC3339)
+}
+
+// ExportDiscrepancies streams every discrepancy matching the list filters,
+// including saved_filter, as CSV or NDJSON. Page and limit do not apply.
+func (h *Handlers) ExportDiscrepancies(w http.ResponseWriter, r *http.Request) {
+	filter, ok := h.discrepancyFilter(w, r)
+	if !ok {
+		return
+	}
+	e := startExport(w, r, "discrepancies", []string{
+		"id", "type", "severity", "processor", "merchant_id", "batch_id",
+		"transaction_id", "settlement_id", "currency", "expected_usd",
+		"actual_usd", "difference_usd", "tags", "ticket_system", "ticket_id",
+		"ticket_url", "case_id", "detected_at", "description",
+	})
+	if e == nil {
+		return
+	}
+	e.finish(h.discRepo.Each(filter, func(d *domain.Discrepancy) error {
+		var ticket domain.ExternalTicket
+		if d.Ticket != nil {
+			ticket = *d.Ticket
+		}
+		return e.row(d, []string{
+			d.ID, string(d.Type), string(d.Severity), string(d.Processor), d.MerchantID, d.BatchID,
+			d.TransactionID, d.SettlementID, d.Currency, exportFloat(d.ExpectedUSD),
+			exportFloat(d.ActualUSD), exportFloat(d.DifferenceUSD), strings.Join(d.Tags, ";"),
+			ticket.System, ticket.TicketID, ticket.URL, d.CaseID, exportTime(&d.DetectedAt), d.Description,
+		})
+	}))
+}
+
+// ExportTransactions streams every transaction matching the list filters as
+// CSV or NDJSON. Page and limit do not apply.
+func (h *Handlers) ExportTransactions(w http.ResponseWriter, r *http.Request) {
+	filter, ok := transactionFilter(w, r.URL.Query())
+	if !ok {
+		return
+	}
+	e := startExport(w, r, "transactions", []string{
+		"id", "processor", "processor_reference", "merchant_id", "direction",
+		"status", "amount", "currency", "usd_amount", "customer_country",
+		"merchant_country", "created_at", "captured_at", "settled_at",
+		"transfer_id", "leg", "reconciliation_status",
+	})
+	if e == nil {
+		return
+	}
+	e.finish(h.txnRepo.Each(filter, func(t *domain.Transaction) error {
+		direction := t.Direction
+		if direction == "" {
+			direction = domain.DirectionInbound
+		}
+		return e.row(t, []string{
+			t.ID, string(t.Processor), t.ProcessorReference, t.MerchantID, string(direction),
+			string(t.Status), exportFloat(t.Amount), t.Currency, exportFloat(t.USDAmount), t.CustomerCountry,
+			t.MerchantCountry, exportTime(&t.CreatedAt), exportTime(t.CapturedAt), exportTime(t.SettledAt),
+			t.TransferID, string(t.Leg), string(t.ReconciliationStatus),
+		})
+	}))
+}
+
+// ExportSettlements streams every settlement record matching the list
+// filters as CSV or NDJSON. Sort, page and limit do not apply.
+func (h *Handlers) ExportSettlements(w http.ResponseWriter, r *http.Request) {
+	filter, err := settlementFilter(r.URL.Query())
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	e := startExport(w, r, "settlements", []string{
+		"id", "report_id", "processor", "batch_id", "processor_transaction_id",
+		"wakala_transaction_id", "gross_amount", "fee_amount", "net_amount",
+		"currency", "usd_gross_amount", "usd_net_amount", "settlement_date",
+		"adjustment_code", "adjustment_category",
+	})
+	if e == nil {
+		return
+	}
+	e.finish(h.settRepo.EachRecord(filter, func(rec *domain.SettlementRecord) error {
+		var code, category string
+		if rec.Adjustment != nil {
+			code, category = rec.Adjustment.Code, string(rec.Adjustment.Category)
+		}
+		return e.row(rec, []string{
+			rec.ID, rec.ReportID, string(rec.Processor), rec.BatchID, rec.ProcessorTransactionID,
+			rec.WakalaTransactionID, exportFloat(rec.GrossAmount), exportFloat(rec.FeeAmount), exportFloat(rec.NetAmount),
+			rec.Currency, exportFloat(rec.USDGrossAmount), exportFloat(rec.USDNetAmount), exportTime(&rec.SettlementDate),
+			code, category,
+		})
+	}))
+}
+
+// --- Settlement corrections ---
+
+// settlementPatch is the body of PATCH /settlements/{id}. Omitted fields are
+// left unchanged.
+type settlementPatch struct {
+	GrossAmount    *float64 `json:"gross_amount"`
+	FeeAmount      *float64 `json:"fee_amount"`
+	TaxAmount      *float64 `json:"tax_amount"`
+	NetAmount      *float64 `json:"net_amount"`
+	SettlementDate *string  `json:"settlement_date"`
+	Reason         string   `json:"reason"`
+}
+
+// PatchSettlement corrects a settlement record's amounts or date, recomputes
+// its USD amounts, writes an audit entry, and re-runs reconciliation so the
+// related discrepancies reflect the fix. A correction that moves amounts in
+// or out of a closed period is held as a pending adjustment instead. Admin
+// only.
+func (h *Handlers) PatchSettlement(w http.ResponseWriter, r *http.Request) {
+	if !h.requireAdmin(w, r) {
+		return
+	}
+
+	var body settlementPatch
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid JSON body: "+err.Error())
+		return
+	}
+	body.Reason = strings.TrimSpace(body.Reason)
+	if body.Reason == "" {
+		writeError(w, http.StatusBadRequest, "reason is required")
+		return
+	}
+	if body.GrossAmount == nil && body.FeeAmount == nil && body.TaxAmount == nil && body.NetAmount == nil && body.SettlementDate == nil {
+		writeError(w, http.StatusBadRequest, "nothing to correct: provide gross_amount, fee_amount, tax_amount, net_amount or settlement_date")
+		return
+	}
+
+	id := chi.URLParam(r, "id")
+	rec, err := h.settRepo.GetRecord(id)
+	if errors.Is(err, sql.ErrNoRows) {
+		writeError(w, http.StatusNotFound, "settlement not found")
+		return
+	}
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+	before := rec.Amounts()
+
+	if err := applySettlementPatch(rec, body); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	closed, err := h.periodRepo.ClosedAmong(uniquePeriods(before.SettlementDate, rec.SettlementDate))
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+	if len(closed) > 0 {
+		h.holdAdjustment(w, domain.AdjustmentCorrection, rec.ID, closed,
+			fmt.Sprintf("correction to settlement %s: %s", rec.ID, body.Reason), requestUser(r),
+			heldCorrection{SettlementID: rec.ID, Patch: body})
+		return
+	}
+
+	correction, err := h.commitCorrection(rec, before, body.Reason, requestUser(r))
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+
+	discs, err := h.settlementDiscrepancies(rec)
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{
+		"settlement":    rec,
+		"correction":    correction,
+		"discrepancies": discs,
+	})
+}
+
+// applySettlementPatch applies body to rec and recomputes its USD amounts.
+// A corrected fee replaces the record's fee breakdown. An error means the
+// patch is invalid for this record.
+func applySettlementPatch(rec *domain.SettlementRecord, body settlementPatch) error {
+	if body.GrossAmount != nil {
+		rec.GrossAmount = *body.GrossAmount
+	}
+	if body.FeeAmount != nil {
+		rec.FeeAmount = *body.FeeAmount
+		rec.FeeBreakdown = nil
+	}
+	if body.TaxAmount != nil {
+		rec.TaxAmount = *body.TaxAmount
+	}
+	switch {
+	case body.NetAmount != nil:
+		rec.NetAmount = *body.NetAmount
+	case body.GrossAmount != nil || body.FeeAmount != nil || body.TaxAmount != nil:
+		rec.NetAmount = roundUSD(rec.GrossAmount - rec.FeeAmount - rec.TaxAmount)
+	}
+	if msg := rec.NetError(); msg != "" {
+		return errors.New(msg)
+	}
+	if body.SettlementDate != nil {
+		t := parseTime(*body.SettlementDate)
+		if t == nil {
+			return errors.New("invalid settlement_date: use RFC3339 or YYYY-MM-DD")
+		}
+		rec.SettlementDate = *t
+	}
+
+	var err error
+	if rec.USDGrossAmount, err = currency.ToUSD(rec.GrossAmount, rec.Currency); err != nil {
+		return err
+	}
+	if rec.USDNetAmount, err = currency.ToUSD(rec.NetAmount, rec.Currency); err != nil {
+		return err
+	}
+	return nil
+}
+
+// commitCorrection stores a patched record with its audit entry and re-runs
+// reconciliation.
+func (h *Handlers) commitCorrection(rec *domain.SettlementRecord, before domain.SettlementAmounts, reason, user string) (*domain.SettlementCorrection, error) {
+	correction := &domain.SettlementCorrection{
+		ID:           fmt.Sprintf("CORR-%d", time.Now().UnixNano()),
+		SettlementID: rec.ID,
+		UserID:       user,
+		Reason:       reason,
+		Before:       before,
+		After:        rec.Amounts(),
+		CreatedAt:    time.Now().UTC(),
+	}
+	if err := h.settRepo.ApplyCorrection(rec, correction); err != nil {
+		return nil, err
+	}
+	log.Printf("[api] AUDIT: settlement %s corrected by %s (%s): gross %.2f -> %.2f, net %.2f -> %.2f, date %s -> %s",
+		rec.ID, correction.UserID, correction.ID, before.GrossAmount, rec.GrossAmount,
+		before.NetAmount, rec.NetAmount, before.SettlementDate.Format("2006-01-02"),
+		rec.SettlementDate.Format("2006-01-02"))
+
+	if _, err := h.reconSvc.RunFullReconciliation(); err != nil {
+		log.Printf("[api] WARNING: reconciliation after correction %s failed: %v", correction.ID, err)
+	}
+	return correction, nil
+}
+
+// settlementDiscrepancies returns the discrepancies on a record and on the
+// transaction it is matched to.
+func (h *Handlers) settlementDiscrepancies(rec *domain.SettlementRecord) ([]domain.Discrepancy, error) {
+	discs, err := h.discRepo.GetBySettlementID(rec.ID)
+	if err != nil {
+		return nil, err
+	}
+	if rec.WakalaTransactionID != "" {
+		txnDiscs, err := h.discRepo.GetByTransactionID(rec.WakalaTransactionID)
+		if err != nil {
+			return nil, err
+		}
+		seen := make(map[string]bool, len(discs))
+		for _, d := range discs {
+			seen[d.ID] = true
+		}
+		for _, d := range txnDiscs {
+			if !seen[d.ID] {
+				discs = append(discs, d)
+			}
+		}
+	}
+	if discs == nil {
+		discs = []domain.Discrepancy{}
+	}
+	return discs, nil
+}
+
+// ListSettlementCorrections returns the correction audit trail of a record.
+func (h *Handlers) ListSettlementCorrections(w http.ResponseWriter, r *http.Request) {
+	corrections, err := h.settRepo.ListCorrections(chi.URLParam(r, "id"))
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{"corrections": corrections})
+}
+
+// GetSettlementLineage traces the USD figures of a settlement record back to
+// the report line and FX rate they came from, with the transaction it is
+// matched to.
+func (h *Handlers) GetSettlementLineage(w http.ResponseWriter, r *http.Request) {
+	l, err := h.reconSvc.RecordLineage(chi.URLParam(r, "id"))
+	if errors.Is(err, sql.ErrNoRows) {
+		writeError(w, http.StatusNotFound, "settlement not found")
+		return
+	}
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, l)
+}
+
+// --- Unmatched review queue ---
+
+// ListUnmatched returns the orphaned settlement records, longest orphaned
+// first, each with the transactions it may pay scored as match suggestions.
+// processor narrows the queue, min_age_days keeps the records orphaned for
+// at least that many days, and limit is the most suggestions per record
+// (default 3, 0 for all).
+func (h *Handlers) ListUnmatched(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	f := reconciliation.ReviewFilter{Processor: q.Get("processor"), Limit: reconciliation.DefaultSuggestionLimit}
+	if f.Processor != "" && !validProcessor(f.Processor) {
+		writeError(w, http.StatusBadRequest, "invalid processor: must be one of afripay, nairagateway, capepay, mpesa")
+		return
+	}
+	if v := q.Get("min_age_days"); v != "" {
+		days, err := strconv.Atoi(v)
+		if err != nil || days < 0 {
+			writeError(w, http.StatusBadRequest, "min_age_days must be a non-negative number of days")
+			return
+		}
+		f.MinAge = time.Duration(days) * 24 * time.Hour
+	}
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			writeError(w, http.StatusBadRequest, "limit must be a non-negative number of suggestions")
+			return
+		}
+		f.Limit = n
+	}
+
+	queue, err := h.reconSvc.ReviewQueue(f)
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{
+		"unmatched": queue,
+		"total":     len(queue),
+	})
+}
+
+// GetSuggestionFeedback returns the decisions made on match suggestions,
+// optionally for one processor, with the scoring in force and the average
+// score and features of the accepted and the rejected ones.
+func (h *Handlers) GetSuggestionFeedback(w http.ResponseWriter, r *http.Request) {
+	processor := r.URL.Query().Get("processor")
+	if processor != "" && !validProcessor(processor) {
+		writeError(w, http.StatusBadRequest, "invalid processor: must be one of afripay, nairagateway, capepay, mpesa")
+		return
+	}
+
+	report, err := h.reconSvc.SuggestionFeedback(processor)
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, report)
+}
+
+type suggestionDecision struct {
+	Note string `json:"note"`
+}
+
+// heldMatch is the payload of a match adjustment.
+type heldMatch struct {
+	SettlementID  string `json:"settlement_id"`
+	TransactionID string `json:"transaction_id"`
+	Note          string `json:"note,omitempty"`
+}
+
+// AcceptSuggestion matches an orphaned settlement record to a suggested
+// transaction and re-runs reconciliation for the record's processor. A match
+// whose record or transaction falls in a closed period is held for approval
+// instead. Admin only.
+func (h *Handlers) AcceptSuggestion(w http.ResponseWriter, r *http.Request) {
+	if !h.requireAdmin(w, r) {
+		return
+	}
+	body, ok := decodeSuggestionDecision(w, r)
+	if !ok {
+		return
+	}
+
+	rec, err := h.settRepo.GetRecord(chi.URLParam(r, "id"))
+	if errors.Is(err, sql.ErrNoRows) {
+		writeError(w, http.StatusNotFound, "settlement not found")
+		return
+	}
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+	txn, err := h.txnRepo.GetByID(chi.URLParam(r, "txnID"))
+	if errors.Is(err, sql.ErrNoRows) {
+		writeError(w, http.StatusNotFound, "transaction not found")
+		return
+	}
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+
+	captured := txn.CreatedAt
+	if txn.CapturedAt != nil {
+		captured = *txn.CapturedAt
+	}
+	closed, err := h.periodRepo.ClosedAmong(uniquePeriods(rec.SettlementDate, captured))
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+	if len(closed) > 0 {
+		h.holdAdjustment(w, domain.AdjustmentMatch, rec.ID, closed,
+			fmt.Sprintf("match of settlement %s to %s", rec.ID, txn.ID), requestUser(r),
+			heldMatch{SettlementID: rec.ID, TransactionID: txn.ID, Note: body.Note})
+		return
+	}
+
+	result, status, err := h.acceptSuggestion(rec.ID, txn.ID, requestUser(r), body.Note)
+	if err != nil {
+		writeError(w, status, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+// acceptSuggestion makes the match and re-runs reconciliation for the
+// record's processor. On error it also returns the status to answer with.
+func (h *Handlers) acceptSuggestion(recordID, txnID, user, note string) (map[string]any, int, error) {
+	fb, err := h.reconSvc.AcceptSuggestion(recordID, txnID, user, note)
+	if err != nil {
+		status, err := suggestionError(err, recordID, txnID)
+		return nil, status, err
+	}
+	log.Printf("[api] AUDIT: settlement %s matched to %s by %s (suggestion score %.2f)",
+		fb.SettlementID, fb.TransactionID, user, fb.Score)
+
+	result, err := h.reconSvc.RunScopedReconciliation(repository.RunScope{Processor: string(fb.Processor)})
+	if err != nil {
+		return nil, http.StatusInternalServerError, fmt.Errorf("matched, but reconciliation failed: %w", err)
+	}
+	return map[string]any{"feedback": fb, "reconciliation": result}, 0, nil
+}
+
+// RejectSuggestion records that a transaction is not the one an orphaned
+// settlement record pays, so it is no longer suggested for it.
+func (h *Handlers) RejectSuggestion(w http.ResponseWriter, r *http.Request) {
+	user := requestUser(r)
+	if user == "" {
+		writeError(w, http.StatusBadRequest, "X-User-ID header is required")
+		return
+	}
+	body, ok := decodeSuggestionDecision(w, r)
+	if !ok {
+		return
+	}
+
+	recordID, txnID := chi.URLParam(r, "id"), chi.URLParam(r, "txnID")
+	fb, err := h.reconSvc.RejectSuggestion(recordID, txnID, user, body.Note)
+	if err != nil {
+		status, err := suggestionError(err, recordID, txnID)
+		writeError(w, status, err.Error())
+		return
+	}
+	log.Printf("[api] AUDIT: suggestion of %s for settlement %s rejected by %s", fb.TransactionID, fb.SettlementID, user)
+
+	writeJSON(w, http.StatusOK, map[string]any{"feedback": fb})
+}
+
+// decodeSuggestionDecision reads the optional body of a decision on a
+// suggestion. On error it writes a 400 and returns false.
+func decodeSuggestionDecision(w http.ResponseWriter, r *http.Request) (suggestionDecision, bool) {
+	var body suggestionDecision
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid JSON body: "+err.Error())
+			return body, false
+		}
+	}
+	body.Note = strings.TrimSpace(body.Note)
+	return body, true
+}
+
+// suggestionError returns the status and error to answer a failed decision
+// on a suggestion with.
+func suggestionError(err error, recordID, txnID string) (int, error) {
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		return http.StatusNotFound, fmt.Errorf("settlement %s or transaction %s not found", recordID, txnID)
+	case errors.Is(err, reconciliation.ErrNotOrphaned), errors.Is(err, reconciliation.ErrNotCandidate):
+		return http.StatusConflict, err
+	}
+	return http.StatusInternalServerError, err
+}
+
+// --- Settlement batches ---
+
+func (h *Handlers) ListBatches(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	filter := repository.BatchFilter{
+		Processor: q.Get("processor"),
+		Page:      parseIntDefault(q.Get("page"), 1),
+		Limit:     parseLimit(q.Get("limit"), 50),
+	}
+
+	batches, total, err := h.settRepo.ListBatches(filter)
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+	for i := range batches {
+		roundBatch(&batches[i])
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{
+		"batches": batches,
+		"total":   total,
+		"page":    filter.Page,
+		"limit":   filter.Limit,
+	})
+}
+
+// GetBatch returns one batch with combined totals, the reports it was
+// delivered in and its carried balance.
+func (h *Handlers) GetBatch(w http.ResponseWriter, r *http.Request) {
+	processor := chi.URLParam(r, "processor")
+	batchID := chi.URLParam(r, "batchID")
+
+	batch, err := h.settRepo.GetBatch(processor, batchID)
+	if errors.Is(err, sql.ErrNoRows) {
+		writeError(w, http.StatusNotFound, "batch not found")
+		return
+	}
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+	roundBatch(batch)
+
+	balances, err := h.settRepo.GetBatchBalances(processor)
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+	for _, b := range balances {
+		if b.BatchID == batchID {
+			batch.Balances = append(batch.Balances, b)
+		}
+	}
+
+	writeJSON(w, http.StatusOK, batch)
+}
+
+func roundBatch(b *domain.SettlementBatch) {
+	b.USDGrossAmount = roundUSD(b.USDGrossAmount)
+	b.USDNetAmount = roundUSD(b.USDNetAmount)
+}
+
+// carriedBalance is where one processor's balance in one currency stands
+// after its latest batch.
+type carriedBalance struct {
+	Processor      domain.Processor `json:"processor"`
+	Currency       string           `json:"currency"`
+	CarriedBalance float64          `json:"carried_balance"`
+	LastBatchID    string           `json:"last_batch_id"`
+	// OpenedBy is the batch that took the balance negative, while it is
+	// still carried.
+	OpenedBy     string  `json:"opened_by,omitempty"`
+	Deducted     float64 `json:"deducted"`
+	OverDeducted float64 `json:"over_deducted"`
+}
+
+// GetBatchBalances returns each processor's carried negative balance per
+// currency and the batches that carried or deducted one, oldest first.
+// ?all=true lists every batch.
+func (h *Handlers) GetBatchBalances(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	processor := q.Get("processor")
+	if processor != "" && !validProcessor(processor) {
+		writeError(w, http.StatusBadRequest, "invalid processor: must be one of afripay, nairagateway, capepay, mpesa")
+		return
+	}
+	all := q.Get("all") == "true"
+
+	ledger, err := h.settRepo.GetBatchBalances(processor)
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+
+	balances := []carriedBalance{}
+	batches := []domain.BatchBalance{}
+	for _, b := range ledger {
+		n := len(balances)
+		if n == 0 || balances[n-1].Processor != b.Processor || balances[n-1].Currency != b.Currency {
+			balances = append(balances, carriedBalance{Processor: b.Processor, Currency: b.Currency})
+			n++
+		}
+		cb := &balances[n-1]
+		cb.CarriedBalance = b.CarriedOut
+		cb.LastBatchID = b.BatchID
+		cb.Deducted = roundUSD(cb.Deducted + b.Deducted)
+		cb.OverDeducted = roundUSD(cb.OverDeducted + b.OverDeducted)
+		switch {
+		case b.CarriedOut == 0:
+			cb.OpenedBy = ""
+		case b.CarriedIn == 0:
+			cb.OpenedBy = b.BatchID
+		}
+
+		if all || b.CarriedIn != 0 || b.Deducted != 0 || b.CarriedOut != 0 {
+			batches = append(batches, b)
+		}
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{
+		"balances": balances,
+		"batches":  batches,
+	})
+}
+
+// --- Batch approvals ---
+
+// ListBatchApprovals returns the batches whose transactions wait for
+// approval (?status=pending, the default), those approved
+// (?status=approved) or all of them (?status=all), with the rules by which
+// approval is required.
+func (h *Handlers) ListBatchApprovals(w http.ResponseWriter, r *http.Request) {
+	status := domain.BatchApprovalPending
+	switch v := r.URL.Query().Get("status"); v {
+	case "":
+	case "all":
+		status = ""
+	case string(domain.BatchApprovalPending), string(domain.BatchApprovalApproved):
+		status = domain.BatchApprovalStatus(v)
+	default:
+		writeError(w, http.StatusBadRequest, "status must be pending, approved or all")
+		return
+	}
+
+	approvals, rules, err := h.reconSvc.BatchApprovals(status)
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+	for i := range approvals {
+		approvals[i].USDGrossAmount = roundUSD(approvals[i].USDGrossAmount)
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{
+		"approvals": approvals,
+		"total":     len(approvals),
+		"rules":     rules,
+	})
+}
+
+// ApproveBatch settles the transactions a batch's records matched that were
+// waiting for its approval. Admin only.
+func (h *Handlers) ApproveBatch(w http.ResponseWriter, r *http.Request) {
+	if !h.requireAdmin(w, r) {
+		return
+	}
+	var body struct {
+		Note string `json:"note"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid JSON body: "+err.Error())
+			return
+		}
+	}
+
+	processor, batchID, user := chi.URLParam(r, "processor"), chi.URLParam(r, "batchID"), requestUser(r)
+	approval, settled, err := h.reconSvc.ApproveBatch(processor, batchID, user, strings.TrimSpace(body.Note))
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		writeError(w, http.StatusNotFound, fmt.Sprintf("batch %s/%s does not need approval", processor, batchID))
+		return
+	case errors.Is(err, repository.ErrBatchApproved):
+		writeError(w, http.StatusConflict, err.Error())
+		return
+	case err != nil:
+		writeServerError(w, err)
+		return
+	}
+	approval.USDGrossAmount = roundUSD(approval.USDGrossAmount)
+	log.Printf("[api] AUDIT: batch %s/%s approved by %s, %d transactions settled", processor, batchID, user, settled)
+
+	writeJSON(w, http.StatusOK, map[string]any{
+		"approval": approval,
+		"settled":  settled,
+	})
+}
+
+// --- Batch certificates ---
+
+// currentCertificateContent builds the batch's reconciled state with amounts
+// rounded to cents, so the hash does not depend on float summation noise.
+func (h *Handlers) currentCertificateContent(processor, batchID string) (*domain.CertificateContent, error) {
+	c, err := h.certRepo.BuildContent(processor, batchID)
+	if err != nil {
+		return nil, err
+	}
+	c.USDGrossAmount = roundUSD(c.USDGrossAmount)
+	c.USDNetAmount = roundUSD(c.USDNetAmount)
+	c.ExceptionImpactUSD = roundUSD(c.ExceptionImpactUSD)
+	return c, nil
+}
+
+// GenerateBatchCertificate certifies the batch's current reconciled state.
+// Generating again while nothing has changed returns the existing
+// certificate with 200.
+func (h *Handlers) GenerateBatchCertificate(w http.ResponseWriter, r *http.Request) {
+	user := requestUser(r)
+	if user == "" {
+		writeError(w, http.StatusBadRequest, "X-User-ID header is required")
+		return
+	}
+	processor := chi.URLParam(r, "processor")
+	batchID := chi.URLParam(r, "batchID")
+
+	content, err := h.currentCertificateContent(processor, batchID)
+	if errors.Is(err, sql.ErrNoRows) {
+		writeError(w, http.StatusNotFound, "batch not found")
+		return
+	}
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+	hash := content.Hash()
+
+	existing, err := h.certRepo.FindByHash(processor, batchID, hash)
+	if err == nil {
+		writeJSON(w, http.StatusOK, map[string]any{"certificate": existing, "current": true})
+		return
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		writeServerError(w, err)
+		return
+	}
+
+	cert := &domain.BatchCertificate{
+		ID:                 fmt.Sprintf("CERT-%d", time.Now().UnixNano()),
+		CertificateContent: *content,
+		ContentHash:        hash,
+		GeneratedBy:        user,
+		GeneratedAt:        time.Now().UTC().Truncate(time.Second),
+	}
+	if err := h.certRepo.Insert(cert); err != nil {
+		writeServerError(w, err)
+		return
+	}
+	log.Printf("[api] AUDIT: certificate %s for %s/%s generated by %s (hash %s, %d records, %d exceptions)",
+		cert.ID, processor, batchID, user, hash, content.Records, content.Exceptions)
+
+	writeJSON(w, http.StatusCreated, map[string]any{"certificate": cert, "current": true})
+}
+
+// ListBatchCertificates returns every certificate generated for a batch.
+func (h *Handlers) ListBatchCertificates(w http.ResponseWriter, r *http.Request) {
+	certs, err := h.certRepo.ListByBatch(chi.URLParam(r, "processor"), chi.URLParam(r, "batchID"))
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{"certificates": certs})
+}
+
+// GetCertificate returns a certificate as JSON, or as a PDF with
+// ?format=pdf. current says whether the batch still reconciles to the
+// certified figures.
+func (h *Handlers) GetCertificate(w http.ResponseWriter, r *http.Request) {
+	cert, err := h.certRepo.GetByID(chi.URLParam(r, "id"))
+	if errors.Is(err, sql.ErrNoRows) {
+		writeError(w, http.StatusNotFound, "certificate not found")
+		return
+	}
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+
+	content, err := h.currentCertificateContent(string(cert.Processor), cert.BatchID)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		writeServerError(w, err)
+		return
+	}
+	current := content != nil && content.Hash() == cert.ContentHash
+
+	switch r.URL.Query().Get("format") {
+	case "", "json":
+		writeJSON(w, http.StatusOK, map[string]any{"certificate": cert, "current": current})
+	case "pdf":
+		w.Header().Set("Content-Type", "application/pdf")
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.pdf"`, cert.ID))
+		w.WriteHeader(http.StatusOK)
+		w.Write(pdf.Render("Settlement Reconciliation Certificate", certificateLines(cert, current)))
+	default:
+		writeError(w, http.StatusBadRequest, "format must be json or pdf")
+	}
+}
+
+// certificateLines is the text of a certificate PDF.
+func certificateLines(c *domain.BatchCertificate, current bool) []string {
+	lines := []string{
+		fmt.Sprintf("Certificate    %s", c.ID),
+		fmt.Sprintf("Processor      %s", c.Processor),
+		fmt.Sprintf("Batch          %s", c.BatchID),
+		fmt.Sprintf("Generated      %s by %s", c.GeneratedAt.Format(time.RFC3339), c.GeneratedBy),
+		"",
+		fmt.Sprintf("Settlement records        %8d", c.Records),
+		fmt.Sprintf("  Matched                 %8d", c.Matched),
+		fmt.Sprintf("  Exceptions              %8d", c.Exceptions),
+	}
+	types := make([]string, 0, len(c.ExceptionsByType))
+	for t := range c.ExceptionsByType {
+		types = append(types, string(t))
+	}
+	sort.Strings(types)
+	for _, t := range types {
+		lines = append(lines, fmt.Sprintf("    %-22s%8d", t, c.ExceptionsByType[domain.DiscrepancyType(t)]))
+	}
+	lines = append(lines,
+		fmt.Sprintf("  Unreconciled            %8d", c.Unreconciled),
+		"",
+		fmt.Sprintf("Gross settled (USD)   %12.2f", c.USDGrossAmount),
+		fmt.Sprintf("Net settled (USD)     %12.2f", c.USDNetAmount),
+		fmt.Sprintf("Exception impact (USD)%12.2f", c.ExceptionImpactUSD),
+		"",
+		"Reports",
+	)
+	for _, rep := range c.Reports {
+		lines = append(lines, fmt.Sprintf("  %s  %d records", rep.ID, rep.RecordCount))
+		lines = append(lines, fmt.Sprintf("    sha256 %s", rep.FileHash))
+	}
+	lines = append(lines, "", "Content hash (SHA-256)", "  "+c.ContentHash, "")
+
+	if c.SignOff != nil {
+		lines = append(lines, fmt.Sprintf("Signed off by %s at %s", c.SignOff.UserID, c.SignOff.SignedAt.Format(time.RFC3339)))
+		if c.SignOff.Comment != "" {
+			lines = append(lines, "  "+c.SignOff.Comment)
+		}
+	} else {
+		lines = append(lines, "NOT SIGNED OFF")
+	}
+	if !current {
+		lines = append(lines, "", "The batch has changed since this certificate was generated.")
+	}
+	return lines
+}
+
+// signOffRequest is the body of POST /certificates/{id}/sign-off.
+type signOffRequest struct {
+	Comment string `json:"comment"`
+}
+
+// SignOffCertificate records the caller's approval of a certificate. The
+// batch must still reconcile to the certified figures, and a batch with
+// exceptions needs a comment.
+func (h *Handlers) SignOffCertificate(w http.ResponseWriter, r *http.Request) {
+	user := requestUser(r)
+	if user == "" {
+		writeError(w, http.StatusBadRequest, "X-User-ID header is required")
+		return
+	}
+
+	var body signOffRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid JSON body: "+err.Error())
+			return
+		}
+	}
+	body.Comment = strings.TrimSpace(body.Comment)
+
+	cert, err := h.certRepo.GetByID(chi.URLParam(r, "id"))
+	if errors.Is(err, sql.ErrNoRows) {
+		writeError(w, http.StatusNotFound, "certificate not found")
+		return
+	}
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+	if cert.SignOff != nil {
+		writeError(w, http.StatusConflict, fmt.Sprintf("certificate was already signed off by %s", cert.SignOff.UserID))
+		return
+	}
+	if cert.Exceptions > 0 && body.Comment == "" {
+		writeError(w, http.StatusBadRequest, "comment is required to sign off a batch with exceptions")
+		return
+	}
+
+	content, err := h.currentCertificateContent(string(cert.Processor), cert.BatchID)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		writeServerError(w, err)
+		return
+	}
+	if content == nil || content.Hash() != cert.ContentHash {
+		writeError(w, http.StatusConflict, "batch has changed since this certificate was generated; generate a new certificate")
+		return
+	}
+
+	signOff := &domain.CertificateSignOff{
+		UserID:   user,
+		Comment:  body.Comment,
+		SignedAt: time.Now().UTC().Truncate(time.Second),
+	}
+	if err := h.certRepo.SignOff(cert.ID, signOff); err != nil {
+		if errors.Is(err, repository.ErrCertificateSigned) {
+			writeError(w, http.StatusConflict, err.Error())
+			return
+		}
+		writeServerError(w, err)
+		return
+	}
+	cert.SignOff = signOff
+	log.Printf("[api] AUDIT: certificate %s for %s/%s signed off by %s (hash %s)",
+		cert.ID, cert.Processor, cert.BatchID, user, cert.ContentHash)
+
+	writeJSON(w, http.StatusOK, map[string]any{"certificate": cert, "current": true})
+}
+
+// --- Merchant tolerances ---
+
+func (h *Handlers) ListMerchantTolerances(w http.ResponseWriter, r *http.Request) {
+	tols, err := h.tolRepo.List()
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{
+		"tolerances": tols,
+		"total":      len(tols),
+	})
+}
+
+func (h *Handlers) PutMerchantTolerance(w http.ResponseWriter, r *http.Request) {
+	merchantID := chi.URLParam(r, "id")
+
+	var body struct {
+		AbsToleranceUSD *float64 `json:"abs_tolerance_usd"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid JSON body: "+err.Error())
+		return
+	}
+	if body.AbsToleranceUSD == nil || *body.AbsToleranceUSD < 0 {
+		writeError(w, http.StatusBadRequest, "abs_tolerance_usd is required and must be >= 0")
+		return
+	}
+
+	tol := &domain.MerchantTolerance{
+		MerchantID:      merchantID,
+		AbsToleranceUSD: *body.AbsToleranceUSD,
+		UpdatedAt:       time.Now().UTC(),
+	}
+	if err := h.tolRepo.Upsert(tol); err != nil {
+		writeServerError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, tol)
+}
+
+func (h *Handlers) DeleteMerchantTolerance(w http.ResponseWriter, r *http.Request) {
+	merchantID := chi.URLParam(r, "id")
+
+	if err := h.tolRepo.Delete(merchantID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, http.StatusNotFound, "no tolerance override for merchant")
+			return
+		}
+		writeServerError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// --- Payout holds ---
+
+// ListPayoutHolds returns the merchants whose payouts are on hold and the
+// rules they are held under.
+func (h *Handlers) ListPayoutHolds(w http.ResponseWriter, r *http.Request) {
+	holds, cfg, err := h.reconSvc.PayoutHolds()
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{
+		"holds":  holds,
+		"total":  len(holds),
+		"config": cfg,
+	})
+}
+
+// GetPayoutHold tells the payout system whether to disburse to a merchant.
+// A merchant that is not held, including one never seen, returns
+// "held": false.
+func (h *Handlers) GetPayoutHold(w http.ResponseWriter, r *http.Request) {
+	merchantID := chi.URLParam(r, "id")
+
+	hold, err := h.reconSvc.PayoutHold(merchantID)
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{
+		"merchant_id": merchantID,
+		"held":        hold != nil,
+		"hold":        hold,
+	})
+}
+
+// --- Settlement webhooks ---
+
+// maxWebhookBody caps a settlement event's size.
+const maxWebhookBody = 1 << 20
+
+// ReceiveSettlementEvent takes one settlement record pushed by a processor,
+// stores it and matches it straight away. The body must be signed with the
+// processor's secret in X-Wakala-Signature.
+func (h *Handlers) ReceiveSettlementEvent(w http.ResponseWriter, r *http.Request) {
+	processor := chi.URLParam(r, "processor")
+	secret, ok := h.webhookSecrets[processor]
+	if !ok || !validProcessor(processor) {
+		writeError(w, http.StatusNotFound, "webhooks are not enabled for processor")
+		return
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxWebhookBody+1))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "read body: "+err.Error())
+		return
+	}
+	if len(body) > maxWebhookBody {
+		writeError(w, http.StatusRequestEntityTooLarge, "event body too large")
+		return
+	}
+	sig := r.Header.Get("X-Wakala-Signature")
+	if !hmac.Equal([]byte(sig), []byte(notify.Sign(secret, body))) {
+		writeError(w, http.StatusUnauthorized, "invalid X-Wakala-Signature")
+		return
+	}
+
+	var rec domain.SettlementRecord
+	if err := json.Unmarshal(body, &rec); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid JSON body: "+err.Error())
+		return
+	}
+
+	result, err := h.ingestionSvc.IngestEvent(processor, rec)
+	if err != nil {
+		if errors.Is(err, ingestion.ErrInvalidEvent) || errors.Is(err, ingestion.ErrProcessorMismatch) ||
+			errors.Is(err, ingestion.ErrAmountRejected) {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		writeServerError(w, err)
+		return
+	}
+
+	status := http.StatusOK
+	if result.PendingAdjustmentID != "" {
+		status = http.StatusAccepted
+	}
+	writeJSON(w, status, result)
+}
+
+// --- Transform scripts ---
+
+func (h *Handlers) ListTransformScripts(w http.ResponseWriter, r *http.Request) {
+	scripts, err := h.transformRepo.List()
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{
+		"scripts": scripts,
+		"total":   len(scripts),
+	})
+}
+
+func (h *Handlers) GetTransformScript(w http.ResponseWriter, r *http.Request) {
+	proc := domain.Processor(chi.URLParam(r, "processor"))
+
+	script, err := h.transformRepo.Get(proc)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, http.StatusNotFound, "no transform script for processor")
+			return
+		}
+		writeServerError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, script)
+}
+
+// PutTransformScript replaces a processor's transform script. It applies to
+// reports parsed from then on; stored records are not rewritten. Admin only.
+func (h *Handlers) PutTransformScript(w http.ResponseWriter, r *http.Request) {
+	if !h.requireAdmin(w, r) {
+		return
+	}
+	processor := chi.URLParam(r, "processor")
+	if !validProcessor(processor) {
+		writeError(w, http.StatusBadRequest, "invalid processor: must be one of afripay, nairagateway, capepay, mpesa")
+		return
+	}
+
+	var body struct {
+		Steps []domain.TransformStep `json:"steps"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid JSON body: "+err.Error())
+		return
+	}
+
+	script := &domain.TransformScript{
+		Processor: domain.Processor(processor),
+		Steps:     body.Steps,
+		UpdatedAt: time.Now().UTC(),
+		UpdatedBy: requestUser(r),
+	}
+	if err := script.Validate(); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid transform script: "+err.Error())
+		return
+	}
+	if err := h.transformRepo.Upsert(script); err != nil {
+		writeServerError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, script)
+}
+
+// DeleteTransformScript removes a processor's transform script. Admin only.
+func (h *Handlers) DeleteTransformScript(w http.ResponseWriter, r *http.Request) {
+	if !h.requireAdmin(w, r) {
+		return
+	}
+	proc := domain.Processor(chi.URLParam(r, "processor"))
+
+	if err := h.transformRepo.Delete(proc); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, http.StatusNotFound, "no transform script for processor")
+			return
+		}
+		writeServerError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// --- Processor contacts ---
+
+// Limits on a processor contact.
+const (
+	maxEscalationSteps  = 10
+	maxContactFieldLen  = 128
+	maxSLATermsLen      = 1000
+	maxContactPortalLen = 2048
+)
+
+func (h *Handlers) ListProcessorContacts(w http.ResponseWriter, r *http.Request) {
+	contacts, err := h.contactRepo.List()
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{
+		"contacts": contacts,
+		"total":    len(contacts),
+	})
+}
+
+func (h *Handlers) GetProcessorContact(w http.ResponseWriter, r *http.Request) {
+	proc := domain.Processor(chi.URLParam(r, "processor"))
+
+	contact, err := h.contactRepo.Get(proc)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, http.StatusNotFound, "no contact for processor")
+			return
+		}
+		writeServerError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, contact)
+}
+
+// PutProcessorContact replaces a processor's escalation contacts. Alert and
+// assignment emails sent from then on, and Jira issues opened, quote them.
+// Admin only.
+func (h *Handlers) PutProcessorContact(w http.ResponseWriter, r *http.Request) {
+	if !h.requireAdmin(w, r) {
+		return
+	}
+	processor := chi.URLParam(r, "processor")
+	if !validProcessor(processor) {
+		writeError(w, http.StatusBadRequest, "invalid processor: must be one of afripay, nairagateway, capepay, mpesa")
+		return
+	}
+
+	var body struct {
+		OpsEmail         string                     `json:"ops_email"`
+		DisputePortalURL string                     `json:"dispute_portal_url"`
+		SLATerms         string                     `json:"sla_terms"`
+		Escalation       []domain.EscalationContact `json:"escalation"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid JSON body: "+err.Error())
+		return
+	}
+
+	contact := &domain.ProcessorContact{
+		Processor:        domain.Processor(processor),
+		DisputePortalURL: strings.TrimSpace(body.DisputePortalURL),
+		SLATerms:         strings.TrimSpace(body.SLATerms),
+		Escalation:       []domain.EscalationContact{},
+		UpdatedBy:        requestUser(r),
+		UpdatedAt:        time.Now().UTC(),
+	}
+	if msg := validateProcessorContact(contact, body.OpsEmail, body.Escalation); msg != "" {
+		writeError(w, http.StatusBadRequest, msg)
+		return
+	}
+	if err := h.contactRepo.Upsert(contact); err != nil {
+		writeServerError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, contact)
+}
+
+// validateProcessorContact checks and normalizes the fields of c, setting
+// its ops email and escalation path from the ones given, and returns the
+// error message for an invalid contact or "" for a valid one.
+func validateProcessorContact(c *domain.ProcessorContact, opsEmail string, escalation []domain.EscalationContact) string {
+	if opsEmail = strings.TrimSpace(opsEmail); opsEmail != "" {
+		a, err := mail.ParseAddress(opsEmail)
+		if err != nil || strings.Contains(a.Address, ",") {
+			return fmt.Sprintf("invalid ops_email %q", opsEmail)
+		}
+		c.OpsEmail = a.Address
+	}
+	if c.DisputePortalURL != "" {
+		u, err := url.Parse(c.DisputePortalURL)
+		if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" || len(c.DisputePortalURL) > maxContactPortalLen {
+			return "dispute_portal_url must be an http or https URL"
+		}
+	}
+	if len(c.SLATerms) > maxSLATermsLen {
+		return fmt.Sprintf("sla_terms must be at most %d characters", maxSLATermsLen)
+	}
+	if len(escalation) > maxEscalationSteps {
+		return fmt.Sprintf("escalation must have at most %d contacts", maxEscalationSteps)
+	}
+	for i, e := range escalation {
+		e.Name, e.Role = strings.TrimSpace(e.Name), strings.TrimSpace(e.Role)
+		e.Email, e.Phone = strings.TrimSpace(e.Email), strings.TrimSpace(e.Phone)
+		switch {
+		case e.Name == "" || len(e.Name) > maxContactFieldLen || len(e.Role) > maxContactFieldLen || len(e.Phone) > maxContactFieldLen:
+			return fmt.Sprintf("escalation %d: name is required; name, role and phone are at most %d characters", i+1, maxContactFieldLen)
+		case e.Email == "" && e.Phone == "":
+			return fmt.Sprintf("escalation %d: email or phone is required", i+1)
+		case e.AfterHours < 0:
+			return fmt.Sprintf("escalation %d: after_hours must not be negative", i+1)
+		case i > 0 && e.AfterHours < escalation[i-1].AfterHours:
+			return fmt.Sprintf("escalation %d: after_hours must not be less than the step before", i+1)
+		}
+		if e.Email != "" {
+			a, err := mail.ParseAddress(e.Email)
+			if err != nil || strings.Contains(a.Address, ",") {
+				return fmt.Sprintf("escalation %d: invalid email %q", i+1, e.Email)
+			}
+			e.Email = a.Address
+		}
+		c.Escalation = append(c.Escalation, e)
+	}
+	if c.OpsEmail == "" && c.DisputePortalURL == "" && c.SLATerms == "" && len(c.Escalation) == 0 {
+		return "at least one of ops_email, dispute_portal_url, sla_terms and escalation is required"
+	}
+	return ""
+}
+
+// DeleteProcessorContact removes a processor's escalation contacts. Admin
+// only.
+func (h *Handlers) DeleteProcessorContact(w http.ResponseWriter, r *http.Request) {
+	if !h.requireAdmin(w, r) {
+		return
+	}
+	proc := domain.Processor(chi.URLParam(r, "processor"))
+
+	if err := h.contactRepo.Delete(proc); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, http.StatusNotFound, "no contact for processor")
+			return
+		}
+		writeServerError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// --- Discrepancy tags ---
+
+func (h *Handlers) AddDiscrepancyTags(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+
+	var body struct {
+		Tags []string `json:"tags"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid JSON body: "+err.Error())
+		return
+	}
+	if len(body.Tags) == 0 {
+		writeError(w, http.StatusBadRequest, "tags is required")
+		return
+	}
+
+	tags := make([]string, 0, len(body.Tags))
+	for _, t := range body.Tags {
+		nt := normalizeTag(t)
+		if nt == "" {
+			writeError(w, http.StatusBadRequest, "tags must be non-empty and at most 64 characters")
+			return
+		}
+		tags = append(tags, nt)
+	}
+
+	exists, err := h.discRepo.Exists(id)
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+	if !exists {
+		writeError(w, http.StatusNotFound, "discrepancy not found")
+		return
+	}
+
+	if err := h.discRepo.AddTags(id, tags); err != nil {
+		writeServerError(w, err)
+		return
+	}
+	for _, t := range tags {
+		if t == domain.InvestigationTag {
+			h.refreshInvestigation(id)
+			break
+		}
+	}
+
+	current, err := h.discRepo.GetTags(id)
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{
+		"discrepancy_id": id,
+		"tags":           current,
+	})
+}
+
+func (h *Handlers) RemoveDiscrepancyTag(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	tag := normalizeTag(chi.URLParam(r, "tag"))
+
+	if err := h.discRepo.RemoveTag(id, tag); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, http.StatusNotFound, "tag not found on discrepancy")
+			return
+		}
+		writeServerError(w, err)
+		return
+	}
+	if tag == domain.InvestigationTag {
+		h.refreshInvestigation(id)
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// refreshInvestigation rederives the reconciliation status of the
+// transaction of discrepancy id after its investigation tag changed. The
+// tag change stands if this fails; the next run corrects the status.
+func (h *Handlers) refreshInvestigation(id string) {
+	disc, err := h.discRepo.GetByID(id)
+	if err != nil {
+		log.Printf("[api] WARNING: reconciliation status after tagging %s: %v", id, err)
+		return
+	}
+	if disc.TransactionID == "" {
+		return
+	}
+	if err := h.txnRepo.RefreshReconciliationStatus(disc.TransactionID); err != nil {
+		log.Printf("[api] WARNING: reconciliation status after tagging %s: %v", id, err)
+	}
+}
+
+// --- Discrepancy tickets ---
+
+// Ticket field limits. System is an identifier such as jira or zendesk.
+const (
+	maxTicketSystemLen = 32
+	maxTicketIDLen     = 128
+	maxTicketURLLen    = 2048
+)
+
+// SetDiscrepancyTicket links a discrepancy to the ticket tracking it in an
+// external system, replacing any link it had, and records the change in its
+// activity log. The caller's X-User-ID is recorded as who linked it.
+func (h *Handlers) SetDiscrepancyTicket(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	user := requestUser(r)
+	if user == "" {
+		writeError(w, http.StatusUnauthorized, "X-User-ID header is required")
+		return
+	}
+
+	var body struct {
+		System   string `json:"system"`
+		TicketID string `json:"ticket_id"`
+		URL      string `json:"url"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid JSON body: "+err.Error())
+		return
+	}
+	ticket := &domain.ExternalTicket{
+		System:   strings.ToLower(strings.TrimSpace(body.System)),
+		TicketID: strings.TrimSpace(body.TicketID),
+		URL:      strings.TrimSpace(body.URL),
+		LinkedBy: user,
+		LinkedAt: time.Now().UTC().Truncate(time.Second),
+	}
+	switch {
+	case ticket.System == "" || len(ticket.System) > maxTicketSystemLen || strings.ContainsAny(ticket.System, ": \t"):
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("system is required, at most %d characters, without spaces or colons", maxTicketSystemLen))
+		return
+	case ticket.TicketID == "" || len(ticket.TicketID) > maxTicketIDLen:
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("ticket_id is required and at most %d characters", maxTicketIDLen))
+		return
+	}
+	if ticket.URL != "" {
+		u, err := url.Parse(ticket.URL)
+		if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" || len(ticket.URL) > maxTicketURLLen {
+			writeError(w, http.StatusBadRequest, "url must be an http or https URL")
+			return
+		}
+	}
+
+	exists, err := h.discRepo.Exists(id)
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+	if !exists {
+		writeError(w, http.StatusNotFound, "discrepancy not found")
+		return
+	}
+
+	prev, err := h.discRepo.SetTicket(id, ticket)
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+	entry := &domain.DiscrepancyActivity{
+		DiscrepancyID: id, At: ticket.LinkedAt, Actor: user,
+		Action: domain.ActivityTicketLinked, To: ticket.Ref(),
+	}
+	if prev != nil {
+		entry.From = prev.Ref()
+	}
+	if err := h.discRepo.AddActivity(entry); err != nil {
+		log.Printf("[api] WARNING: activity for ticket on %s: %v", id, err)
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{
+		"discrepancy_id": id,
+		"ticket":         ticket,
+	})
+}
+
+// RemoveDiscrepancyTicket removes a discrepancy's ticket link and records
+// it in the activity log.
+func (h *Handlers) RemoveDiscrepancyTicket(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	user := requestUser(r)
+	if user == "" {
+		writeError(w, http.StatusUnauthorized, "X-User-ID header is required")
+		return
+	}
+
+	prev, err := h.discRepo.RemoveTicket(id)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, http.StatusNotFound, "no ticket linked to discrepancy")
+			return
+		}
+		writeServerError(w, err)
+		return
+	}
+	if err := h.discRepo.AddActivity(&domain.DiscrepancyActivity{
+		DiscrepancyID: id, At: time.Now().UTC().Truncate(time.Second), Actor: user,
+		Action: domain.ActivityTicketUnlinked, From: prev.Ref(),
+	}); err != nil {
+		log.Printf("[api] WARNING: activity for ticket on %s: %v", id, err)
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// --- Discrepancy cases ---
+
+// Case limits: a title, and the discrepancies added in one request.
+const (
+	maxCaseTitleLen   = 200
+	maxCaseDiscrepIDs = 1000
+)
+
+// writeCaseError maps the errors of the case operations to responses.
+func writeCaseError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		writeError(w, http.StatusNotFound, "case not found")
+	case errors.Is(err, reconciliation.ErrUnknownDiscrepancy):
+		writeError(w, http.StatusNotFound, err.Error())
+	case errors.Is(err, reconciliation.ErrCaseResolved), errors.Is(err, reconciliation.ErrCaseNotResolved):
+		writeError(w, http.StatusConflict, err.Error())
+	default:
+		writeServerError(w, err)
+	}
+}
+
+// caseDiscrepancyIDs reads {"discrepancy_ids": [...]} into ids, writing an
+// error and returning false if it is missing or too long.
+func caseDiscrepancyIDs(w http.ResponseWriter, raw []string) ([]string, bool) {
+	var ids []string
+	seen := map[string]bool{}
+	for _, id := range raw {
+		if id = strings.TrimSpace(id); id != "" && !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) == 0 || len(ids) > maxCaseDiscrepIDs {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("discrepancy_ids must list 1 to %d discrepancies", maxCaseDiscrepIDs))
+		return nil, false
+	}
+	return ids, true
+}
+
+// ListCases lists the discrepancy cases, newest first; ?status=open or
+// resolved narrows them.
+func (h *Handlers) ListCases(w http.ResponseWriter, r *http.Request) {
+	status := domain.CaseStatus(r.URL.Query().Get("status"))
+	if status != "" && status != domain.CaseOpen && status != domain.CaseResolved {
+		writeError(w, http.StatusBadRequest, "invalid status: must be open or resolved")
+		return
+	}
+	cases, err := h.caseRepo.List(status)
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"cases": cases,
+		"total": len(cases),
+	})
+}
+
+// CreateCase groups discrepancies into a new case by hand, taking them out
+// of the cases they were in. The caller's X-User-ID is recorded as who
+// opened it.
+func (h *Handlers) CreateCase(w http.ResponseWriter, r *http.Request) {
+	user := requestUser(r)
+	if user == "" {
+		writeError(w, http.StatusUnauthorized, "X-User-ID header is required")
+		return
+	}
+	var body struct {
+		Title          string   `json:"title"`
+		DiscrepancyIDs []string `json:"discrepancy_ids"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid JSON body: "+err.Error())
+		return
+	}
+	title := strings.TrimSpace(body.Title)
+	if title == "" || len(title) > maxCaseTitleLen {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("title is required and at most %d characters", maxCaseTitleLen))
+		return
+	}
+	ids, ok := caseDiscrepancyIDs(w, body.DiscrepancyIDs)
+	if !ok {
+		return
+	}
+
+	c, err := h.reconSvc.CreateCase(title, user, ids)
+	if err != nil {
+		writeCaseError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, c)
+}
+
+// GetCase returns a case with a page of its discrepancies that are still
+// raised.
+func (h *Handlers) GetCase(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	c, err := h.caseRepo.Get(id)
+	if err != nil {
+		writeCaseError(w, err)
+		return
+	}
+	q := r.URL.Query()
+	filter := repository.DiscrepancyFilter{
+		CaseID: id,
+		Page:   parseIntDefault(q.Get("page"), 1),
+		Limit:  parseLimit(q.Get("limit"), 50),
+	}
+	discs, total, err := h.discRepo.List(filter)
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"case":          c,
+		"discrepancies": discs,
+		"total":         total,
+		"page":          filter.Page,
+		"limit":         filter.Limit,
+	})
+}
+
+// AddCaseDiscrepancies moves discrepancies into an open case.
+func (h *Handlers) AddCaseDiscrepancies(w http.ResponseWriter, r *http.Request) {
+	user := requestUser(r)
+	if user == "" {
+		writeError(w, http.StatusUnauthorized, "X-User-ID header is required")
+		return
+	}
+	var body struct {
+		DiscrepancyIDs []string `json:"discrepancy_ids"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid JSON body: "+err.Error())
+		return
+	}
+	ids, ok := caseDiscrepancyIDs(w, body.DiscrepancyIDs)
+	if !ok {
+		return
+	}
+
+	c, err := h.reconSvc.AddToCase(chi.URLParam(r, "id"), user, ids)
+	if err != nil {
+		writeCaseError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, c)
+}
+
+// RemoveCaseDiscrepancy takes a discrepancy out of an open case. It is not
+// grouped automatically again.
+func (h *Handlers) RemoveCaseDiscrepancy(w http.ResponseWriter, r *http.Request) {
+	user := requestUser(r)
+	if user == "" {
+		writeError(w, http.StatusUnauthorized, "X-User-ID header is required")
+		return
+	}
+	err := h.reconSvc.RemoveFromCase(chi.URLParam(r, "id"), chi.URLParam(r, "discID"), user)
+	if errors.Is(err, sql.ErrNoRows) {
+		writeError(w, http.StatusNotFound, "discrepancy not in case")
+		return
+	}
+	if err != nil {
+		writeCaseError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ResolveCase resolves a case with an optional note, and through it every
+// member not resolved otherwise.
+func (h *Handlers) ResolveCase(w http.ResponseWriter, r *http.Request) {
+	user := requestUser(r)
+	if user == "" {
+		writeError(w, http.StatusUnauthorized, "X-User-ID header is required")
+		return
+	}
+	var body struct {
+		Note string `json:"note"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid JSON body: "+err.Error())
+			return
+		}
+	}
+
+	c, resolved, err := h.reconSvc.ResolveCase(chi.URLParam(r, "id"), user, strings.TrimSpace(body.Note))
+	if err != nil {
+		writeCaseError(w, err)
+		return
+	}
+	if resolved == nil {
+		resolved = []string{}
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"case":     c,
+		"resolved": resolved,
+	})
+}
+
+// ReopenCase reopens a resolved case and withdraws the resolutions it gave
+// its members.
+func (h *Handlers) ReopenCase(w http.ResponseWriter, r *http.Request) {
+	user := requestUser(r)
+	if user == "" {
+		writeError(w, http.StatusUnauthorized, "X-User-ID header is required")
+		return
+	}
+
+	c, reopened, err := h.reconSvc.ReopenCase(chi.URLParam(r, "id"), user)
+	if err != nil {
+		writeCaseError(w, err)
+		return
+	}
+	if reopened == nil {
+		reopened = []string{}
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"case":     c,
+		"reopened": reopened,
+	})
+}
+
+// --- Severity recalculation ---
+
+// RecalculateSeverities regrades open discrepancies under the current
+// severity rules and logs each change. Admin only.
+func (h *Handlers) RecalculateSeverities(w http.ResponseWriter, r *http.Request) {
+	if !h.requireAdmin(w, r) {
+		return
+	}
+
+	result, err := h.reconSvc.RecalculateSeverities(requestUser(r))
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, result)
+}
+
+// --- Diagnostics ---
+
+// GetDiagnostics returns what on-call checks first when paged: the database
+// size, the latest report from each processor, the last reconciliation run,
+// the oldest unmatched settlement record and unsettled capture, each with
+// its age, the retry counters and circuit state of every outbound
+// integration, and, with leader election on, which instance runs the
+// background jobs. Admin only.
+func (h *Handlers) GetDiagnostics(w http.ResponseWriter, r *http.Request) {
+	if !h.requireAdmin(w, r) {
+		return
+	}
+
+	now := time.Now().UTC()
+	size, err := h.diagnostics.DatabaseSize()
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+	ingests, err := h.diagnostics.LastIngests(now)
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+	unmatched, err := h.diagnostics.OldestUnmatchedSettlement(now)
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+	unsettled, err := h.diagnostics.OldestUnsettledCapture(now)
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+
+	resp := map[string]any{
+		"generated_at":                now,
+		"database":                    size,
+		"last_ingest":                 ingests,
+		"last_reconciliation":         h.reconSvc.LastRun(),
+		"oldest_unmatched_settlement": unmatched,
+		"oldest_unsettled_capture":    unsettled,
+		"integrations":                retry.All(),
+	}
+	if h.elector != nil {
+		election, err := h.elector.Status()
+		if err != nil {
+			writeServerError(w, err)
+			return
+		}
+		resp["leader_election"] = election
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// --- Metrics ---
+
+// metricsProcessors and metricsSeverities get a series each, zero when there
+// is nothing to report, so alerts see 0 rather than no data.
+var (
+	metricsProcessors = []domain.Processor{
+		domain.ProcessorAfriPay, domain.ProcessorCapePay, domain.ProcessorMPesa, domain.ProcessorNairaGateway,
+	}
+	metricsSeverities = []domain.Severity{
+		domain.SeverityCritical, domain.SeverityHigh, domain.SeverityMedium, domain.SeverityLow,
+	}
+)
+
+// GetMetrics exposes business KPIs for Prometheus to scrape: the count and
+// USD impact of open discrepancies, the unsettled exposure and the hours
+// since each processor's last report. A scraper that accepts OpenMetrics
+// gets it; others get the Prometheus text format.
+func (h *Handlers) GetMetrics(w http.ResponseWriter, r *http.Request) {
+	now := time.Now().UTC()
+	impacts, err := h.diagnostics.OpenImpacts()
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+	exposures, err := h.diagnostics.UnsettledExposures()
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+	ingests, err := h.diagnostics.LastIngests(now)
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+
+	type impactKey struct {
+		proc domain.Processor
+		sev  domain.Severity
+	}
+	open := map[impactKey]repository.OpenImpact{}
+	impactKeys := []impactKey{}
+	for _, p := range metricsProcessors {
+		for _, sev := range metricsSeverities {
+			impactKeys = append(impactKeys, impactKey{p, sev})
+		}
+	}
+	for _, o := range impacts {
+		k := impactKey{o.Processor, o.Severity}
+		if !slices.Contains(metricsProcessors, o.Processor) || !slices.Contains(metricsSeverities, o.Severity) {
+			impactKeys = append(impactKeys, k)
+		}
+		open[k] = o
+	}
+	unsettled := map[domain.Processor]repository.Exposure{}
+	procs := slices.Clone(metricsProcessors)
+	for _, e := range exposures {
+		if !slices.Contains(procs, e.Processor) {
+			procs = append(procs, e.Processor)
+		}
+		unsettled[e.Processor] = e
+	}
+
+	m := &metricsWriter{openMetrics: strings.Contains(r.Header.Get("Accept"), "application/openmetrics-text")}
+	m.family("wakala_open_discrepancies", "gauge", "", "Discrepancies with no resolution.")
+	for _, k := range impactKeys {
+		m.sample("wakala_open_discrepancies", float64(open[k].Count), "processor", string(k.proc), "severity", string(k.sev))
+	}
+	m.family("wakala_open_discrepancy_impact_usd", "gauge", "usd", "Sum of the absolute differences of open discrepancies, in US dollars.")
+	for _, k := range impactKeys {
+		m.sample("wakala_open_discrepancy_impact_usd", math.Round(open[k].ImpactUSD*100)/100, "processor", string(k.proc), "severity", string(k.sev))
+	}
+	m.family("wakala_unsettled_transactions", "gauge", "", "Authorized or captured transactions not yet settled.")
+	for _, p := range procs {
+		m.sample("wakala_unsettled_transactions", float64(unsettled[p].Transactions), "processor", string(p))
+	}
+	m.family("wakala_unsettled_exposure_usd", "gauge", "usd", "USD amount of the authorized or captured transactions not yet settled.")
+	for _, p := range procs {
+		m.sample("wakala_unsettled_exposure_usd", math.Round(unsettled[p].USD*100)/100, "processor", string(p))
+	}
+	m.family("wakala_last_ingest_age_hours", "gauge", "hours", "Hours since the latest report of a processor was ingested. Absent for a processor that never sent one.")
+	for _, in := range ingests {
+		m.sample("wakala_last_ingest_age_hours", math.Round(float64(in.AgeSeconds)/3.6)/1000, "processor", string(in.Processor))
+	}
+
+	if m.openMetrics {
+		m.buf.WriteString("# EOF\n")
+		w.Header().Set("Content-Type", "application/openmetrics-text; version=1.0.0; charset=utf-8")
+	} else {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(m.buf.Bytes())
+}
+
+// metricsWriter writes the text exposition format, or OpenMetrics, which
+// adds a UNIT line to each family.
+type metricsWriter struct {
+	buf         bytes.Buffer
+	openMetrics bool
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func (m *metricsWriter) family(name, typ, unit, help string) {
+	fmt.Fprintf(&m.buf, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+	if m.openMetrics && unit != "" {
+		fmt.Fprintf(&m.buf, "# UNIT %s %s\n", name, unit)
+	}
+}
+
+// sample writes one value, with labels given as name, value pairs.
+func (m *metricsWriter) sample(name string, value float64, labels ...string) {
+	m.buf.WriteString(name)
+	for i := 0; i+1 < len(labels); i += 2 {
+		sep := ","
+		if i == 0 {
+			sep = "{"
+		}
+		fmt.Fprintf(&m.buf, `%s%s="%s"`, sep, labels[i], labelEscaper.Replace(labels[i+1]))
+	}
+	if len(labels) > 0 {
+		m.buf.WriteByte('}')
+	}
+	fmt.Fprintf(&m.buf, " %s\n", strconv.FormatFloat(value, 'f', -1, 64))
+}
+
+// --- Derived state rebuild ---
+
+// RebuildDerivedState repairs settlement links and settled statuses that no
+// longer follow from the settlement records, re-runs reconciliation and
+// reports what changed. Admin only.
+func (h *Handlers) RebuildDerivedState(w http.ResponseWriter, r *http.Request) {
+	if !h.requireAdmin(w, r) {
+		return
+	}
+
+	result, err := h.reconSvc.RebuildDerivedState()
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, result)
+}
+
+// GetDiscrepancyActivity returns a discrepancy's activity log. The log is
+// kept after the discrepancy is resolved.
+func (h *Handlers) GetDiscrepancyActivity(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+
+	activity, err := h.discRepo.GetActivity(id)
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+	if len(activity) == 0 {
+		exists, err := h.discRepo.Exists(id)
+		if err != nil {
+			writeServerError(w, err)
+			return
+		}
+		if !exists {
+			writeError(w, http.StatusNotFound, "discrepancy not found")
+			return
+		}
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{
+		"discrepancy_id": id,
+		"activity":       activity,
+	})
+}
+
+// InvestigateDiscrepancy checks an amount mismatch against the known causes
+// of a difference (a fee, an FX rate, a refund) under the records as they
+// are now, and returns each check with the probable cause.
+func (h *Handlers) InvestigateDiscrepancy(w http.ResponseWriter, r *http.Request) {
+	inv, err := h.reconSvc.Investigate(chi.URLParam(r, "id"))
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		writeError(w, http.StatusNotFound, "discrepancy not found")
+		return
+	case errors.Is(err, reconciliation.ErrNotInvestigable):
+		writeError(w, http.StatusUnprocessableEntity, err.Error())
+		return
+	case err != nil:
+		writeServerError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, inv)
+}
+
+// GetDiscrepancyLineage traces the figures of a discrepancy back to the
+// report line, parsed record and FX rates they came from, and the rule and
+// policy version they were compared under.
+func (h *Handlers) GetDiscrepancyLineage(w http.ResponseWriter, r *http.Request) {
+	l, err := h.reconSvc.DiscrepancyLineage(chi.URLParam(r, "id"))
+	if errors.Is(err, sql.ErrNoRows) {
+		writeError(w, http.StatusNotFound, "discrepancy not found")
+		return
+	}
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, l)
+}
+
+// --- Saved filters ---
+
+func (h *Handlers) ListSavedFilters(w http.ResponseWriter, r *http.Request) {
+	user := requestUser(r)
+	if user == "" {
+		writeError(w, http.StatusBadRequest, "X-User-ID header is required")
+		return
+	}
+
+	filters, err := h.filterRepo.ListByUser(user)
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{
+		"saved_filters": filters,
+		"total":         len(filters),
+	})
+}
+
+func (h *Handlers) CreateSavedFilter(w http.ResponseWriter, r *http.Request) {
+	user := requestUser(r)
+	if user == "" {
+		writeError(w, http.StatusBadRequest, "X-User-ID header is required")
+		return
+	}
+
+	var body struct {
+		Name  string            `json:"name"`
+		Query map[string]string `json:"query"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid JSON body: "+err.Error())
+		return
+	}
+	body.Name = strings.TrimSpace(body.Name)
+	if body.Name == "" {
+		writeError(w, http.StatusBadRequest, "name is required")
+		return
+	}
+	for k := range body.Query {
+		if !discrepancyFilterParams[k] {
+			writeError(w, http.StatusBadRequest, "unsupported filter parameter: "+k)
+			return
+		}
+	}
+	if t, ok := body.Query["tag"]; ok {
+		body.Query["tag"] = normalizeTag(t)
+	}
+
+	sf := &domain.SavedFilter{
+		ID:        fmt.Sprintf("SF-%d", time.Now().UnixNano()),
+		UserID:    user,
+		Name:      body.Name,
+		Query:     body.Query,
+		CreatedAt: time.Now().UTC(),
+	}
+	if sf.Query == nil {
+		sf.Query = map[string]string{}
+	}
+	if err := h.filterRepo.Insert(sf); err != nil {
+		writeServerError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, sf)
+}
+
+func (h *Handlers) DeleteSavedFilter(w http.ResponseWriter, r *http.Request) {
+	user := requestUser(r)
+	if user == "" {
+		writeError(w, http.StatusBadRequest, "X-User-ID header is required")
+		return
+	}
+
+	if err := h.filterRepo.DeleteForUser(chi.URLParam(r, "id"), user); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, http.StatusNotFound, "saved filter not found")
+			return
+		}
+		writeServerError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// --- Dashboard views ---
+
+// dashboardViewBody is the body of CreateDashboardView and
+// UpdateDashboardView. An update replaces every field.
+type dashboardViewBody struct {
+	Name       string   `json:"name"`
+	Processors []string `json:"processors"`
+	Currencies []string `json:"currencies"`
+	MerchantID string   `json:"merchant_id"`
+	From       string   `json:"from"`
+	To         string   `json:"to"`
+	LastDays   int      `json:"last_days"`
+	Default    bool     `json:"default"`
+}
+
+// readDashboardView decodes and validates a view body into v, writing the
+// error response and returning false when it is invalid.
+func readDashboardView(w http.ResponseWriter, r *http.Request, v *domain.DashboardView) bool {
+	var body dashboardViewBody
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid JSON body: "+err.Error())
+		return false
+	}
+	v.Name = body.Name
+	v.Processors = body.Processors
+	v.Currencies = body.Currencies
+	v.MerchantID = body.MerchantID
+	v.From = body.From
+	v.To = body.To
+	v.LastDays = body.LastDays
+	v.Default = body.Default
+	v.Normalize()
+	if err := v.Validate(); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return false
+	}
+	return true
+}
+
+func (h *Handlers) ListDashboardViews(w http.ResponseWriter, r *http.Request) {
+	user := requestUser(r)
+	if user == "" {
+		writeError(w, http.StatusBadRequest, "X-User-ID header is required")
+		return
+	}
+
+	views, err := h.viewRepo.ListByUser(user)
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{
+		"views": views,
+		"total": len(views),
+	})
+}
+
+func (h *Handlers) GetDashboardView(w http.ResponseWriter, r *http.Request) {
+	user := requestUser(r)
+	if user == "" {
+		writeError(w, http.StatusBadRequest, "X-User-ID header is required")
+		return
+	}
+
+	v, err := h.viewRepo.GetForUser(chi.URLParam(r, "id"), user)
+	if errors.Is(err, sql.ErrNoRows) {
+		writeError(w, http.StatusNotFound, "dashboard view not found")
+		return
+	}
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, v)
+}
+
+func (h *Handlers) CreateDashboardView(w http.ResponseWriter, r *http.Request) {
+	user := requestUser(r)
+	if user == "" {
+		writeError(w, http.StatusBadRequest, "X-User-ID header is required")
+		return
+	}
+
+	now := time.Now().UTC()
+	v := &domain.DashboardView{
+		ID:        fmt.Sprintf("DV-%d", now.UnixNano()),
+		UserID:    user,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	if !readDashboardView(w, r, v) {
+		return
+	}
+	if err := h.viewRepo.Insert(v); err != nil {
+		if errors.Is(err, repository.ErrDuplicateViewName) {
+			writeError(w, http.StatusConflict, err.Error())
+			return
+		}
+		writeServerError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, v)
+}
+
+func (h *Handlers) UpdateDashboardView(w http.ResponseWriter, r *http.Request) {
+	user := requestUser(r)
+	if user == "" {
+		writeError(w, http.StatusBadRequest, "X-User-ID header is required")
+		return
+	}
+
+	v, err := h.viewRepo.GetForUser(chi.URLParam(r, "id"), user)
+	if errors.Is(err, sql.ErrNoRows) {
+		writeError(w, http.StatusNotFound, "dashboard view not found")
+		return
+	}
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+	if !readDashboardView(w, r, v) {
+		return
+	}
+	v.UpdatedAt = time.Now().UTC()
+	if err := h.viewRepo.Update(v); err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			writeError(w, http.StatusNotFound, "dashboard view not found")
+		case errors.Is(err, repository.ErrDuplicateViewName):
+			writeError(w, http.StatusConflict, err.Error())
+		default:
+			writeServerError(w, err)
+		}
+		return
+	}
+
+	writeJSON(w, http.StatusOK, v)
+}
+
+func (h *Handlers) DeleteDashboardView(w http.ResponseWriter, r *http.Request) {
+	user := requestUser(r)
+	if user == "" {
+		writeError(w, http.StatusBadRequest, "X-User-ID header is required")
+		return
+	}
+
+	if err := h.viewRepo.DeleteForUser(chi.URLParam(r, "id"), user); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, http.StatusNotFound, "dashboard view not found")
+			return
+		}
+		writeServerError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// --- ListAlerts ---
+
+func (h *Handlers) ListAlerts(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	filter := repository.AlertFilter{
+		Type:      q.Get("type"),
+		Processor: q.Get("processor"),
+		Status:    q.Get("status"),
+		Page:      parseIntDefault(q.Get("page"), 1),
+		Limit:     parseLimit(q.Get("limit"), 50),
+	}
+	switch filter.Status {
+	case "":
+		filter.Status = "open"
+	case "all":
+		filter.Status = ""
+	case "open", "resolved":
+	default:
+		writeError(w, http.StatusBadRequest, "invalid status: must be one of open, resolved, all")
+		return
+	}
+
+	alerts, total, err := h.alertRepo.List(filter)
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{
+		"alerts": alerts,
+		"total":  total,
+		"page":   filter.Page,
+		"limit":  filter.Limit,
+	})
+}
+
+// --- Processor API connectors ---
+
+func (h *Handlers) ListConnectors(w http.ResponseWriter, r *http.Request) {
+	states := []domain.ConnectorState{}
+	if h.connectors != nil {
+		var err error
+		states, err = h.connectors.States()
+		if err != nil {
+			writeServerError(w, err)
+			return
+		}
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{"connectors": states})
+}
+
+// PullConnector runs an incremental pull from one connector immediately,
+// outside the polling schedule.
+func (h *Handlers) PullConnector(w http.ResponseWriter, r *http.Request) {
+	if h.connectors == nil {
+		writeError(w, http.StatusNotFound, "connector not configured")
+		return
+	}
+
+	result, err := h.connectors.Pull(r.Context(), chi.URLParam(r, "name"))
+	if errors.Is(err, connector.ErrUnknownConnector) {
+		writeError(w, http.StatusNotFound, "connector not configured")
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusBadGateway, err.Error())
+		return
+	}
+
+	writeJSON(w, http.StatusOK, result)
+}
+
+// --- Mailbox ---
+
+// GetMailbox shows the mailbox poller's rules and state.
+func (h *Handlers) GetMailbox(w http.ResponseWriter, r *http.Request) {
+	if h.mailbox == nil {
+		writeError(w, http.StatusNotFound, "mailbox not configured")
+		return
+	}
+
+	st, err := h.mailbox.State()
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{
+		"mailbox": h.mailbox.Name(),
+		"rules":   h.mailbox.Rules(),
+		"state":   st,
+	})
+}
+
+// PollMailbox checks the mailbox immediately, outside the polling schedule.
+func (h *Handlers) PollMailbox(w http.ResponseWriter, r *http.Request) {
+	if h.mailbox == nil {
+		writeError(w, http.StatusNotFound, "mailbox not configured")
+		return
+	}
+
+	result, err := h.mailbox.Poll(r.Context())
+	if err != nil {
+		writeError(w, http.StatusBadGateway, err.Error())
+		return
+	}
+
+	writeJSON(w, http.StatusOK, result)
+}
+
+// --- Jira ---
+
+// GetJiraStatus shows the Jira integration's configuration, last sync and
+// issues by state. Admin only.
+func (h *Handlers) GetJiraStatus(w http.ResponseWriter, r *http.Request) {
+	if h.jiraSync == nil {
+		writeError(w, http.StatusNotFound, "jira not configured")
+		return
+	}
+	if !h.requireAdmin(w, r) {
+		return
+	}
+	status, err := h.jiraSync.Status()
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, status)
+}
+
+// SyncJira syncs discrepancies with Jira immediately, outside the schedule.
+// Admin only.
+func (h *Handlers) SyncJira(w http.ResponseWriter, r *http.Request) {
+	if h.jiraSync == nil {
+		writeError(w, http.StatusNotFound, "jira not configured")
+		return
+	}
+	if !h.requireAdmin(w, r) {
+		return
+	}
+	log.Printf("[api] AUDIT: Jira sync run by %s", requestUser(r))
+	result, err := h.jiraSync.Sync(r.Context())
+	if err != nil {
+		writeJSON(w, http.StatusBadGateway, result)
+		return
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+// ReceiveJiraEvent takes an issue event from Jira's webhook and applies the
+// issue's status to the discrepancies it tracks. The body must be signed
+// with JIRA_WEBHOOK_SECRET in X-Hub-Signature. Events for issues the
+// reconciler does not track are acknowledged and ignored.
+func (h *Handlers) ReceiveJiraEvent(w http.ResponseWriter, r *http.Request) {
+	if h.jiraSync == nil || h.jiraSync.WebhookSecret() == "" {
+		writeError(w, http.StatusNotFound, "jira webhook not configured")
+		return
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxWebhookBody+1))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "read body: "+err.Error())
+		return
+	}
+	if len(body) > maxWebhookBody {
+		writeError(w, http.StatusRequestEntityTooLarge, "event body too large")
+		return
+	}
+	sig := r.Header.Get("X-Hub-Signature")
+	if !hmac.Equal([]byte(sig), []byte(notify.Sign(h.jiraSync.WebhookSecret(), body))) {
+		writeError(w, http.StatusUnauthorized, "invalid X-Hub-Signature")
+		return
+	}
+
+	var event struct {
+		WebhookEvent string `json:"webhookEvent"`
+		User         struct {
+			DisplayName string `json:"displayName"`
+		} `json:"user"`
+		Issue struct {
+			Key    string `json:"key"`
+			Fields struct {
+				Status struct {
+					Name string `json:"name"`
+				} `json:"status"`
+			} `json:"fields"`
+		} `json:"issue"`
+	}
+	if err := json.Unmarshal(body, &event); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid JSON body: "+err.Error())
+		return
+	}
+	if event.Issue.Key == "" || event.Issue.Fields.Status.Name == "" {
+		writeError(w, http.StatusBadRequest, "issue.key and issue.fields.status.name are required")
+		return
+	}
+
+	issues, err := h.jiraSync.IssueUpdated(event.Issue.Key, event.Issue.Fields.Status.Name, event.User.DisplayName)
+	if errors.Is(err, jira.ErrUnknownIssue) {
+		writeJSON(w, http.StatusOK, map[string]any{"issue": event.Issue.Key, "ignored": true})
+		return
+	}
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"issue": event.Issue.Key, "issues": issues})
+}
+
+// --- RunReconciliation ---
+
+// RunReconciliation triggers a full reconciliation run. An optional as_of
+// query parameter (RFC3339 or YYYY-MM-DD) evaluates time-based detection at
+// that instant instead of now, to reproduce historical states. The
+// processor, from and to parameters (YYYY-MM-DD, both inclusive) scope the
+// run, leaving discrepancies outside the scope untouched.
+func (h *Handlers) RunReconciliation(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	var scope repository.RunScope
+	if p := q.Get("processor"); p != "" {
+		if !validProcessor(p) {
+			writeError(w, http.StatusBadRequest, "invalid processor: must be one of afripay, nairagateway, capepay, mpesa")
+			return
+		}
+		scope.Processor = p
+	}
+	for _, param := range []string{"from", "to"} {
+		v := q.Get(param)
+		if v == "" {
+			continue
+		}
+		day, err := time.Parse("2006-01-02", v)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid "+param+": use YYYY-MM-DD")
+			return
+		}
+		if param == "from" {
+			scope.From = &day
+		} else {
+			end := day.AddDate(0, 0, 1)
+			scope.To = &end
+		}
+	}
+	if scope.From != nil && scope.To != nil && !scope.From.Before(*scope.To) {
+		writeError(w, http.StatusBadRequest, "from must not be after to")
+		return
+	}
+
+	var (
+		result *reconciliation.ReconciliationResult
+		err    error
+	)
+	if raw := q.Get("as_of"); raw != "" {
+		asOf := parseTime(raw)
+		if asOf == nil {
+			writeError(w, http.StatusBadRequest, "invalid as_of: use RFC3339 or YYYY-MM-DD")
+			return
+		}
+		result, err = h.reconSvc.RunScopedReconciliationAsOf(scope, *asOf)
+	} else {
+		result, err = h.reconSvc.RunScopedReconciliation(scope)
+	}
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, result)
+}
+
+// GetPendingReconciliation shows whether a debounced run is waiting.
+func (h *Handlers) GetPendingReconciliation(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, h.reconSvc.Deferred())
+}
+
+// FlushReconciliation starts a waiting debounced run now. With nothing
+// pending it does not reconcile.
+func (h *Handlers) FlushReconciliation(w http.ResponseWriter, r *http.Request) {
+	result, err := h.reconSvc.FlushDeferred()
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+	if result == nil {
+		writeJSON(w, http.StatusOK, map[string]any{"flushed": false})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"flushed": true, "result": result})
+}
+
+// --- Period close ---
+
+// uniquePeriods returns the distinct accounting periods of times.
+func uniquePeriods(times ...time.Time) []string {
+	var periods []string
+	seen := make(map[string]bool, len(times))
+	for _, t := range times {
+		if p := domain.PeriodOf(t); !seen[p] {
+			seen[p] = true
+			periods = append(periods, p)
+		}
+	}
+	return periods
+}
+
+// validPeriod reports whether p is a YYYY-MM period key.
+func validPeriod(p string) bool {
+	t, err := time.Parse(domain.PeriodLayout, p)
+	return err == nil && t.Format(domain.PeriodLayout) == p
+}
+
+// heldCorrection is the payload of a correction adjustment.
+type heldCorrection struct {
+	SettlementID string          `json:"settlement_id"`
+	Patch        settlementPatch `json:"patch"`
+}
+
+// heldAmendment is the payload of an amendment adjustment.
+type heldAmendment struct {
+	TransactionID string           `json:"transaction_id"`
+	Amendment     amendmentRequest `json:"amendment"`
+}
+
+// holdAdjustment queues a change to a closed period and answers 202 with the
+// pending adjustment.
+func (h *Handlers) holdAdjustment(w http.ResponseWriter, kind domain.AdjustmentKind, reference string, periods []string, summary, user string, payload any) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+	adj := &domain.PendingAdjustment{
+		ID:          fmt.Sprintf("ADJ-%d", time.Now().UnixNano()),
+		Kind:        kind,
+		Reference:   reference,
+		Periods:     periods,
+		Summary:     summary,
+		Status:      domain.AdjustmentPending,
+		RequestedBy: user,
+		CreatedAt:   time.Now().UTC().Truncate(time.Second),
+		Payload:     data,
+	}
+	if err := h.periodRepo.InsertAdjustment(adj); err != nil {
+		writeServerError(w, err)
+		return
+	}
+	log.Printf("[api] Held %s for approval as %s: %s", kind, adj.ID, summary)
+
+	writeJSON(w, http.StatusAccepted, map[string]any{
+		"pending_adjustment": adj,
+		"message":            fmt.Sprintf("%s is closed; the change waits for approval", strings.Join(periods, ", ")),
+	})
+}
+
+// ListPeriods returns every period close, including reopened ones.
+func (h *Handlers) ListPeriods(w http.ResponseWriter, r *http.Request) {
+	closes, err := h.periodRepo.ListCloses("")
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{"closes": closes})
+}
+
+// GetPeriod compares a period's figures as closed with its figures now.
+func (h *Handlers) GetPeriod(w http.ResponseWriter, r *http.Request) {
+	period := chi.URLParam(r, "period")
+	if !validPeriod(period) {
+		writeError(w, http.StatusBadRequest, "period must be YYYY-MM")
+		return
+	}
+	view, err := h.periodView(period)
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+	history, err := h.periodRepo.ListCloses(period)
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+	view["history"] = history
+
+	writeJSON(w, http.StatusOK, view)
+}
+
+// periodView is the as-closed versus current summary of a period shared by
+// the period and dashboard endpoints.
+func (h *Handlers) periodView(period string) (map[string]any, error) {
+	current, err := h.periodRepo.Figures(period)
+	if err != nil {
+		return nil, err
+	}
+	roundPeriodFigures(current)
+	pending, err := h.periodRepo.ListAdjustments(string(domain.AdjustmentPending), period)
+	if err != nil {
+		return nil, err
+	}
+
+	view := map[string]any{
+		"period":              period,
+		"status":              "open",
+		"current":             current,
+		"pending_adjustments": len(pending),
+	}
+	c, err := h.periodRepo.GetClose(period)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+	case err != nil:
+		return nil, err
+	default:
+		view["status"] = "closed"
+		view["closed_by"] = c.ClosedBy
+		view["closed_at"] = c.ClosedAt
+		view["as_closed"] = c.Figures
+		view["changed_since_close"] = c.Figures != *current
+	}
+	return view, nil
+}
+
+func roundPeriodFigures(f *domain.PeriodFigures) {
+	f.TransactionUSD = roundUSD(f.TransactionUSD)
+	f.SettledUSDGross = roundUSD(f.SettledUSDGross)
+	f.SettledUSDNet = roundUSD(f.SettledUSDNet)
+	f.DiscrepancyImpactUSD = roundUSD(f.DiscrepancyImpactUSD)
+}
+
+// ClosePeriod closes a period, recording its figures. From then on ingests,
+// corrections and amendments that touch it wait for approval. Admin only.
+func (h *Handlers) ClosePeriod(w http.ResponseWriter, r *http.Request) {
+	if !h.requireAdmin(w, r) {
+		return
+	}
+	period := chi.URLParam(r, "period")
+	if !validPeriod(period) {
+		writeError(w, http.StatusBadRequest, "period must be YYYY-MM")
+		return
+	}
+
+	figures, err := h.periodRepo.Figures(period)
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+	roundPeriodFigures(figures)
+
+	c := &domain.PeriodClose{
+		Period:   period,
+		ClosedBy: requestUser(r),
+		ClosedAt: time.Now().UTC().Truncate(time.Second),
+		Figures:  *figures,
+	}
+	if err := h.periodRepo.Close(c); err != nil {
+		if errors.Is(err, repository.ErrPeriodClosed) {
+			writeError(w, http.StatusConflict, err.Error())
+			return
+		}
+		writeServerError(w, err)
+		return
+	}
+	log.Printf("[api] AUDIT: period %s closed by %s (%d settlement records, %.2f USD net settled)",
+		period, c.ClosedBy, figures.SettlementRecords, figures.SettledUSDNet)
+
+	writeJSON(w, http.StatusCreated, c)
+}
+
+// periodReopenRequest is the body of POST /periods/{period}/reopen.
+type periodReopenRequest struct {
+	Reason string `json:"reason"`
+}
+
+// ReopenPeriod reopens a closed period. Changes held while it was closed
+// stay pending until approved or rejected. Admin only.
+func (h *Handlers) ReopenPeriod(w http.ResponseWriter, r *http.Request) {
+	if !h.requireAdmin(w, r) {
+		return
+	}
+	period := chi.URLParam(r, "period")
+
+	var body periodReopenRequest
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid JSON body: "+err.Error())
+		return
+	}
+	body.Reason = strings.TrimSpace(body.Reason)
+	if body.Reason == "" {
+		writeError(w, http.StatusBadRequest, "reason is required")
+		return
+	}
+
+	user := requestUser(r)
+	if err := h.periodRepo.Reopen(period, user, body.Reason, time.Now().UTC().Truncate(time.Second)); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, http.StatusConflict, "period is not closed")
+			return
+		}
+		writeServerError(w, err)
+		return
+	}
+	log.Printf("[api] AUDIT: period %s reopened by %s: %s", period, user, body.Reason)
+
+	closes, err := h.periodRepo.ListCloses(period)
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, closes[0])
+}
+
+// ListAdjustments returns queued changes to closed periods (?status,
+// ?period).
+func (h *Handlers) ListAdjustments(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	status := q.Get("status")
+	if status == "" {
+		status = string(domain.AdjustmentPending)
+	}
+	if status == "all" {
+		status = ""
+	}
+
+	adjs, err := h.periodRepo.ListAdjustments(status, q.Get("period"))
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{"adjustments": adjs})
+}
+
+// adjustmentDecision is the body of the approve and reject endpoints.
+type adjustmentDecision struct {
+	Note string `json:"note"`
+}
+
+// ApproveAdjustment applies a held change, even though its period is still
+// closed, and records the outcome. Admin only.
+func (h *Handlers) ApproveAdjustment(w http.ResponseWriter, r *http.Request) {
+	h.decideAdjustment(w, r, domain.AdjustmentApproved)
+}
+
+// RejectAdjustment discards a held change. A note is required. Admin only.
+func (h *Handlers) RejectAdjustment(w http.ResponseWriter, r *http.Request) {
+	h.decideAdjustment(w, r, domain.AdjustmentRejected)
+}
+
+func (h *Handlers) decideAdjustment(w http.ResponseWriter, r *http.Request, decision domain.AdjustmentStatus) {
+	if !h.requireAdmin(w, r) {
+		return
+	}
+
+	var body adjustmentDecision
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid JSON body: "+err.Error())
+			return
+		}
+	}
+	body.Note = strings.TrimSpace(body.Note)
+	if decision == domain.AdjustmentRejected && body.Note == "" {
+		writeError(w, http.StatusBadRequest, "note is required to reject an adjustment")
+		return
+	}
+
+	adj, err := h.periodRepo.GetAdjustment(chi.URLParam(r, "id"))
+	if errors.Is(err, sql.ErrNoRows) {
+		writeError(w, http.StatusNotFound, "adjustment not found")
+		return
+	}
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+	if adj.Status != domain.AdjustmentPending {
+		writeError(w, http.StatusConflict, fmt.Sprintf("adjustment was already %s", adj.Status))
+		return
+	}
+
+	var result json.RawMessage
+	if decision == domain.AdjustmentApproved {
+		applied, status, err := h.applyAdjustment(adj)
+		if err != nil {
+			writeError(w, status, err.Error())
+			return
+		}
+		if result, err = json.Marshal(applied); err != nil {
+			writeServerError(w, err)
+			return
+		}
+	}
+
+	user := requestUser(r)
+	now := time.Now().UTC().Truncate(time.Second)
+	if err := h.periodRepo.DecideAdjustment(adj.ID, decision, user, body.Note, result, now); err != nil {
+		if errors.Is(err, repository.ErrAdjustmentDecided) {
+			writeError(w, http.StatusConflict, err.Error())
+			return
+		}
+		writeServerError(w, err)
+		return
+	}
+	log.Printf("[api] AUDIT: adjustment %s (%s, %s) %s by %s",
+		adj.ID, adj.Kind, strings.Join(adj.Periods, ","), decision, user)
+
+	adj.Status = decision
+	adj.DecidedBy = user
+	adj.DecidedAt = &now
+	adj.Note = body.Note
+	adj.Result = result
+	writeJSON(w, http.StatusOK, adj)
+}
+
+// applyAdjustment performs a held change against the current data. On
+// error it also returns the status to answer with; the adjustment then
+// stays pending.
+func (h *Handlers) applyAdjustment(adj *domain.PendingAdjustment) (any, int, error) {
+	switch adj.Kind {
+	case domain.AdjustmentIngest:
+		res, err := h.ingestionSvc.ApplyHeldReport(adj)
+		if err != nil {
+			return nil, http.StatusInternalServerError, err
+		}
+		return res, 0, nil
+
+	case domain.AdjustmentCorrection:
+		var held heldCorrection
+		if err := json.Unmarshal(adj.Payload, &held); err != nil {
+			return nil, http.StatusInternalServerError, err
+		}
+		rec, err := h.settRepo.GetRecord(held.SettlementID)
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, http.StatusConflict, fmt.Errorf("settlement %s no longer exists; reject the adjustment", held.SettlementID)
+		}
+		if err != nil {
+			return nil, http.StatusInternalServerError, err
+		}
+		before := rec.Amounts()
+		if err := applySettlementPatch(rec, held.Patch); err != nil {
+			return nil, http.StatusConflict, fmt.Errorf("correction no longer applies: %v; reject the adjustment", err)
+		}
+		correction, err := h.commitCorrection(rec, before, held.Patch.Reason, adj.RequestedBy)
+		if err != nil {
+			return nil, http.StatusInternalServerError, err
+		}
+		return map[string]any{"settlement": rec, "correction": correction}, 0, nil
+
+	case domain.AdjustmentMatch:
+		var held heldMatch
+		if err := json.Unmarshal(adj.Payload, &held); err != nil {
+			return nil, http.StatusInternalServerError, err
+		}
+		result, status, err := h.acceptSuggestion(held.SettlementID, held.TransactionID, adj.RequestedBy, held.Note)
+		if status == http.StatusNotFound || status == http.StatusConflict {
+			err = fmt.Errorf("%v; reject the adjustment", err)
+		}
+		return result, status, err
+
+	case domain.AdjustmentAmendment:
+		var held heldAmendment
+		if err := json.Unmarshal(adj.Payload, &held); err != nil {
+			return nil, http.StatusInternalServerError, err
+		}
+		txn, err := h.txnRepo.GetByID(held.TransactionID)
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, http.StatusConflict, fmt.Errorf("transaction %s no longer exists; reject the adjustment", held.TransactionID)
+		}
+		if err != nil {
+			return nil, http.StatusInternalServerError, err
+		}
+		amendment, _, err := h.applyAmendment(txn, held.Amendment)
+		if err != nil {
+			return nil, http.StatusInternalServerError, err
+		}
+		return map[string]any{"amendment": amendment}, 0, nil
+	}
+	return nil, http.StatusInternalServerError, fmt.Errorf("unknown adjustment kind %q", adj.Kind)
+}
+
+// --- Sandbox simulation ---
+
+// maxSimulatedTransactions bounds one processor's share of a simulated
+// dataset so a typo cannot fill the disk.
+const maxSimulatedTransactions = 5000
+
+// simulateRequest is the body of POST /simulate. Omitted fields take the
+// values of the standard test dataset.
+type simulateRequest struct {
+	Seed       *int64                               `json:"seed"`
+	Start      string                               `json:"start"`
+	End        string                               `json:"end"`
+	Merchants  *int                                 `json:"merchants"`
+	Processors map[domain.Processor]simulateProcess `json:"processors"`
+}
+
+type simulateProcess struct {
+	Transactions *int `json:"transactions"`
+	MissingPct   *int `json:"missing_pct"`
+	MismatchPct  *int `json:"mismatch_pct"`
+	Orphans      *int `json:"orphans"`
+}
+
+// scenario turns the request into a testgen scenario. Listed processors
+// replace the default set; they are always generated in the default order so
+// the same request gives the same data.
+func (req *simulateRequest) scenario() (testgen.Scenario, error) {
+	s := testgen.Default()
+	if req.Seed != nil {
+		s.Seed = *req.Seed
+	}
+	if req.Merchants != nil {
+		s.Merchants = *req.Merchants
+	}
+
+	end := s.Start.AddDate(0, 0, s.Days)
+	if req.Start != "" {
+		t := parseTime(req.Start)
+		if t == nil {
+			return s, fmt.Errorf("invalid start: use RFC3339 or YYYY-MM-DD")
+		}
+		s.Start = t.UTC()
+	}
+	if req.End != "" {
+		t := parseTime(req.End)
+		if t == nil {
+			return s, fmt.Errorf("invalid end: use RFC3339 or YYYY-MM-DD")
+		}
+		end = t.UTC()
+	}
+	s.Days = int(end.Sub(s.Start).Hours() / 24)
+	if s.Days < 1 || s.Days > 366 {
+		return s, fmt.Errorf("date range must cover between 1 and 366 days")
+	}
+
+	if len(req.Processors) > 0 {
+		var selected []testgen.ProcessorScenario
+		for _, ps := range s.Processors {
+			o, ok := req.Processors[ps.Processor]
+			if !ok {
+				continue
+			}
+			if o.Transactions != nil {
+				ps.Transactions = *o.Transactions
+			}
+			if o.MissingPct != nil {
+				ps.MissingPct = *o.MissingPct
+			}
+			if o.MismatchPct != nil {
+				ps.MismatchPct = *o.MismatchPct
+			}
+			if o.Orphans != nil {
+				ps.Orphans = *o.Orphans
+			}
+			selected = append(selected, ps)
+		}
+		if len(selected) < len(req.Processors) {
+			return s, fmt.Errorf("only %s can be simulated", defaultProcessorNames(s))
+		}
+		s.Processors = selected
+	}
+
+	for _, ps := range s.Processors {
+		if ps.Transactions < 0 || ps.Transactions > maxSimulatedTransactions {
+			return s, fmt.Errorf("%s: transactions must be between 0 and %d", ps.Processor, maxSimulatedTransactions)
+		}
+		if ps.Orphans < 0 {
+			return s, fmt.Errorf("%s: orphans must not be negative", ps.Processor)
+		}
+	}
+	return s, nil
+}
+
+func defaultProcessorNames(s testgen.Scenario) string {
+	names := make([]string, len(s.Processors))
+	for i, ps := range s.Processors {
+		names[i] = string(ps.Processor)
+	}
+	return strings.Join(names, ", ")
+}
+
+// Simulate replaces the sandbox dataset with a freshly generated one:
+// transactions are inserted directly and the settlement reports go through
+// normal ingestion and reconciliation. It is only routed on the sandbox
+// server, never against production data. Admin only.
+func (h *Handlers) Simulate(w http.ResponseWriter, r *http.Request) {
+	if !h.requireAdmin(w, r) {
+		return
+	}
+
+	var body simulateRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid JSON body: "+err.Error())
+			return
+		}
+	}
+	scenario, err := body.scenario()
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	ds, err := testgen.Generate(scenario)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if err := repository.ResetData(h.sandboxDB); err != nil {
+		writeServerError(w, err)
+		return
+	}
+	inserted, err := h.txnRepo.BulkInsert(ds.Transactions)
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+
+	results := make([]*ingestion.IngestResult, 0, len(ds.Reports))
+	for _, rep := range ds.Reports {
+		res, err := h.ingestionSvc.IngestReport(rep.Data, string(rep.Processor), rep.Format, ingestion.IngestOptions{Filename: rep.Filename})
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, fmt.Sprintf("ingest %s: %v", rep.Filename, err))
+			return
+		}
+		results = append(results, res)
+	}
+	log.Printf("[api] Sandbox reset by %s: seed %d, %d transactions, %d reports",
+		requestUser(r), scenario.Seed, inserted, len(results))
+
+	writeJSON(w, http.StatusCreated, map[string]any{
+		"seed":         scenario.Seed,
+		"start":        scenario.Start.Format("2006-01-02"),
+		"end":          scenario.Start.AddDate(0, 0, scenario.Days).Format("2006-01-02"),
+		"transactions": inserted,
+		"reports":      results,
+		"expected":     ds.Expected,
+	})
+}
+
+// --- Database snapshots ---
+
+func (h *Handlers) ListSnapshots(w http.ResponseWriter, r *http.Request) {
+	if !h.requireAdmin(w, r) {
+		return
+	}
+	snapshots, err := h.snapshots.List()
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"snapshots": snapshots})
+}
+
+// CreateSnapshot saves the whole database under a name, replacing an
+// existing snapshot of that name. Admin only.
+func (h *Handlers) CreateSnapshot(w http.ResponseWriter, r *http.Request) {
+	if !h.requireAdmin(w, r) {
+		return
+	}
+	var body struct {
+		Name string `json:"name"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid JSON body: "+err.Error())
+		return
+	}
+
+	start := time.Now()
+	snap, err := h.snapshots.Create(strings.TrimSpace(body.Name))
+	if errors.Is(err, repository.ErrInvalidSnapshotName) {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+	log.Printf("[api] Snapshot %s saved by %s (%d bytes)", snap.Name, requestUser(r), snap.SizeBytes)
+
+	writeJSON(w, http.StatusCreated, map[string]any{
+		"snapshot":    snap,
+		"duration_ms": float64(time.Since(start).Microseconds()) / 1000,
+	})
+}
+
+// RestoreSnapshot replaces the contents of the database with a snapshot.
+// Ingestion jobs still running are not stopped, so wait for them first.
+// Admin only.
+func (h *Handlers) RestoreSnapshot(w http.ResponseWriter, r *http.Request) {
+	if !h.requireAdmin(w, r) {
+		return
+	}
+	name := chi.URLParam(r, "name")
+
+	start := time.Now()
+	err := h.snapshots.Restore(name)
+	if errors.Is(err, repository.ErrInvalidSnapshotName) {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if errors.Is(err, os.ErrNotExist) {
+		writeError(w, http.StatusNotFound, "snapshot not found")
+		return
+	}
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+	log.Printf("[api] Snapshot %s restored by %s", name, requestUser(r))
+
+	writeJSON(w, http.StatusOK, map[string]any{
+		"restored":    name,
+		"duration_ms": float64(time.Since(start).Microseconds()) / 1000,
+	})
+}
+
+// --- Database maintenance ---
+
+// GetMaintenanceStatus shows the maintenance schedule, the last run and the
+// database's current size, free pages and WAL size. Admin only.
+func (h *Handlers) GetMaintenanceStatus(w http.ResponseWriter, r *http.Request) {
+	if !h.requireAdmin(w, r) {
+		return
+	}
+	status, err := h.maintenance.Status()
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, status)
+}
+
+// RunMaintenance runs maintenance now. vacuum=true also vacuums, outside
+// the quiet window if need be; the database is locked while it runs.
+// Admin only.
+func (h *Handlers) RunMaintenance(w http.ResponseWriter, r *http.Request) {
+	if !h.requireAdmin(w, r) {
+		return
+	}
+	run, err := h.maintenance.RunNow(r.URL.Query().Get("vacuum") == "true")
+	if errors.Is(err, maintenance.ErrRunning) {
+		writeError(w, http.StatusConflict, err.Error())
+		return
+	}
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+	log.Printf("[api] Maintenance run by %s: vacuumed=%t", requestUser(r), run.Vacuumed)
+	writeJSON(w, http.StatusOK, run)
+}
+
+// --- Rule flags ---
+
+// ListRules shows each reconciliation rule, its default and the flags
+// turning it on or off for all processors or one. Admin only.
+func (h *Handlers) ListRules(w http.ResponseWriter, r *http.Request) {
+	if !h.requireAdmin(w, r) {
+		return
+	}
+	flags, err := h.ruleFlagRepo.List()
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"rules": reconciliation.RuleStates(flags),
+	})
+}
+
+// PutRuleFlag turns a rule on or off for one processor, or for all of them
+// when no processor is given. It takes effect at the next reconciliation
+// run. Admin only.
+func (h *Handlers) PutRuleFlag(w http.ResponseWriter, r *http.Request) {
+	if !h.requireAdmin(w, r) {
+		return
+	}
+	rule := chi.URLParam(r, "rule")
+	if _, ok := reconciliation.LookupRule(rule); !ok {
+		writeError(w, http.StatusNotFound, "unknown rule: "+rule)
+		return
+	}
+
+	var body struct {
+		Enabled   *bool  `json:"enabled"`
+		Processor string `json:"processor"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid JSON body: "+err.Error())
+		return
+	}
+	if body.Enabled == nil {
+		writeError(w, http.StatusBadRequest, "enabled is required")
+		return
+	}
+	if body.Processor != "" && !validProcessor(body.Processor) {
+		writeError(w, http.StatusBadRequest, "invalid processor: must be one of afripay, nairagateway, capepay, mpesa")
+		return
+	}
+
+	flag := &domain.RuleFlag{
+		Rule:      rule,
+		Processor: domain.Processor(body.Processor),
+		Enabled:   *body.Enabled,
+		UpdatedBy: requestUser(r),
+		UpdatedAt: time.Now().UTC(),
+	}
+	if err := h.ruleFlagRepo.Upsert(flag); err != nil {
+		writeServerError(w, err)
+		return
+	}
+	scope := "all processors"
+	if flag.Processor != "" {
+		scope = string(flag.Processor)
+	}
+	log.Printf("[api] AUDIT: rule %s turned %s for %s by %s", rule, onOff(flag.Enabled), scope, flag.UpdatedBy)
+
+	writeJSON(w, http.StatusOK, flag)
+}
+
+// DeleteRuleFlag removes the flag for the processor given by the processor
+// query parameter, or the flag for all processors without one, so the rule
+// falls back to the next flag or its default. Admin only.
+func (h *Handlers) DeleteRuleFlag(w http.ResponseWriter, r *http.Request) {
+	if !h.requireAdmin(w, r) {
+		return
+	}
+	rule := chi.URLParam(r, "rule")
+	proc := r.URL.Query().Get("processor")
+
+	if err := h.ruleFlagRepo.Delete(rule, domain.Processor(proc)); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, http.StatusNotFound, "no flag for rule")
+			return
+		}
+		writeServerError(w, err)
+		return
+	}
+	log.Printf("[api] AUDIT: flag for rule %s (processor %q) removed by %s", rule, proc, requestUser(r))
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func onOff(on bool) string {
+	if on {
+		return "on"
+	}
+	return "off"
+}
+
+// --- Discrepancy routing rules ---
+
+// ListRoutingRules returns the routing rules in the order they are tried.
+// Admin only.
+func (h *Handlers) ListRoutingRules(w http.ResponseWriter, r *http.Request) {
+	if !h.requireAdmin(w, r) {
+		return
+	}
+	rules, err := h.routingRepo.List()
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+	if rules == nil {
+		rules = []domain.RoutingRule{}
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"rules": rules})
+}
+
+// CreateRoutingRule adds a routing rule, tried from the next
+// reconciliation run on. Admin only.
+func (h *Handlers) CreateRoutingRule(w http.ResponseWriter, r *http.Request) {
+	if !h.requireAdmin(w, r) {
+		return
+	}
+	rule, ok := readRoutingRule(w, r)
+	if !ok {
+		return
+	}
+	rule.ID = fmt.Sprintf("RR-%d", time.Now().UnixNano())
+	if err := h.routingRepo.Create(rule); err != nil {
+		writeServerError(w, err)
+		return
+	}
+	log.Printf("[api] AUDIT: routing rule %s to %s created by %s", rule.ID, reconciliation.RoutingOwner(rule), rule.UpdatedBy)
+	writeJSON(w, http.StatusCreated, rule)
+}
+
+// PutRoutingRule replaces a routing rule. Discrepancies it already assigned
+// keep their owner. Admin only.
+func (h *Handlers) PutRoutingRule(w http.ResponseWriter, r *http.Request) {
+	if !h.requireAdmin(w, r) {
+		return
+	}
+	rule, ok := readRoutingRule(w, r)
+	if !ok {
+		return
+	}
+	rule.ID = chi.URLParam(r, "id")
+	if err := h.routingRepo.Update(rule); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, http.StatusNotFound, "routing rule not found")
+			return
+		}
+		writeServerError(w, err)
+		return
+	}
+	log.Printf("[api] AUDIT: routing rule %s to %s updated by %s", rule.ID, reconciliation.RoutingOwner(rule), rule.UpdatedBy)
+	writeJSON(w, http.StatusOK, rule)
+}
+
+// DeleteRoutingRule removes a routing rule. Admin only.
+func (h *Handlers) DeleteRoutingRule(w http.ResponseWriter, r *http.Request) {
+	if !h.requireAdmin(w, r) {
+		return
+	}
+	id := chi.URLParam(r, "id")
+	if err := h.routingRepo.Delete(id); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, http.StatusNotFound, "routing rule not found")
+			return
+		}
+		writeServerError(w, err)
+		return
+	}
+	log.Printf("[api] AUDIT: routing rule %s removed by %s", id, requestUser(r))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// readRoutingRule reads and validates a routing rule body, writing a 400
+// and returning false if it is invalid.
+func readRoutingRule(w http.ResponseWriter, r *http.Request) (*domain.RoutingRule, bool) {
+	var body struct {
+		Position    int      `json:"position"`
+		Processor   string   `json:"processor"`
+		MinSeverity string   `json:"min_severity"`
+		MerchantID  string   `json:"merchant_id"`
+		Type        string   `json:"type"`
+		Team        string   `json:"team"`
+		Assignee    string   `json:"assignee"`
+		Notify      []string `json:"notify"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid JSON body: "+err.Error())
+		return nil, false
+	}
+	rule := &domain.RoutingRule{
+		Position:    body.Position,
+		Processor:   domain.Processor(body.Processor),
+		MinSeverity: domain.Severity(strings.ToUpper(body.MinSeverity)),
+		MerchantID:  strings.TrimSpace(body.MerchantID),
+		Type:        domain.DiscrepancyType(strings.ToUpper(body.Type)),
+		Team:        strings.TrimSpace(body.Team),
+		Assignee:    strings.TrimSpace(body.Assignee),
+		Notify:      []string{},
+		UpdatedBy:   requestUser(r),
+		UpdatedAt:   time.Now().UTC(),
+	}
+	switch {
+	case body.Position < 0:
+		writeError(w, http.StatusBadRequest, "position must be positive")
+		return nil, false
+	case body.Processor != "" && !validProcessor(body.Processor):
+		writeError(w, http.StatusBadRequest, "invalid processor: must be one of afripay, nairagateway, capepay, mpesa")
+		return nil, false
+	case rule.MinSeverity != "" && !reconciliation.ValidSeverity(rule.MinSeverity):
+		writeError(w, http.StatusBadRequest, "invalid min_severity: must be one of LOW, MEDIUM, HIGH, CRITICAL")
+		return nil, false
+	case rule.Type != "" && !validDiscrepancyType(rule.Type):
+		writeError(w, http.StatusBadRequest,
+			"invalid type: must be one of MISSING_SETTLEMENT, AMOUNT_MISMATCH, ORPHANED_SETTLEMENT, MISSING_PAYOUT, OVERPAID")
+		return nil, false
+	case rule.Team == "" && rule.Assignee == "":
+		writeError(w, http.StatusBadRequest, "team or assignee is required")
+		return nil, false
+	}
+	for _, addr := range body.Notify {
+		a, err := mail.ParseAddress(addr)
+		if err != nil || strings.Contains(a.Address, ",") {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid notify address %q", addr))
+			return nil, false
+		}
+		rule.Notify = append(rule.Notify, a.Address)
+	}
+	return rule, true
+}
+
+func validDiscrepancyType(t domain.DiscrepancyType) bool {
+	switch t {
+	case domain.DiscrepancyMissingSettlement, domain.DiscrepancyAmountMismatch, domain.DiscrepancyOrphaned,
+		domain.DiscrepancyMissingPayout, domain.DiscrepancyOverpaid:
+		return true
+	}
+	return false
+}
+
+// --- Configuration file ---
+
+// GetConfigStatus shows the configuration file, the settings a reload may
+// change and the outcome of the last reload. Admin only.
+func (h *Handlers) GetConfigStatus(w http.ResponseWriter, r *http.Request) {
+	if !h.requireAdmin(w, r) {
+		return
+	}
+	writeJSON(w, http.StatusOK, h.reloader.Status())
+}
+
+// ReloadConfig reads the configuration file again and applies its changed
+// settings, as SIGHUP does. A file with an invalid setting is rejected with
+// 422 and nothing changes. Admin only.
+func (h *Handlers) ReloadConfig(w http.ResponseWriter, r *http.Request) {
+	if !h.requireAdmin(w, r) {
+		return
+	}
+	result, err := h.reloader.Reload("API request by " + requestUser(r))
+	if err != nil {
+		writeError(w, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+// --- Configuration bundle ---
+
+// bundleSettings are the settings a configuration bundle carries: the
+// reconciliation policies, severity rules and schedules. Recipients,
+// addresses and secrets are left out; they belong to each environment.
+var bundleSettings = []string{
+	"MISMATCH_PCT_TOLERANCE", "MISMATCH_ABS_TOLERANCE_USD", "SETTLEMENT_WINDOW_HOURS", "FEE_SCHEDULE_VERSION",
+	"ANOMALY_VOLUME_DROP_PCT", "ANOMALY_ORPHAN_RATE_PCT", "ANOMALY_TRAILING_DAYS", "ANOMALY_MIN_RECORDS",
+	"MATCH_SUGGESTION_WEIGHTS", "MATCH_SUGGESTION_MIN_SCORE",
+	"PAYOUT_HOLD_MIN_SEVERITY", "PAYOUT_HOLD_THRESHOLD_USD",
+	"BATCH_APPROVAL_MIN_RECORDS", "BATCH_APPROVAL_MIN_USD", "CASE_AUTO_GROUP_MIN",
+	"ROUNDING_MAX_USD", "ROUNDING_AUTO_RESOLVE",
+	"SEVERITY_HIGH_USD", "SEVERITY_MEDIUM_USD", "SEVERITY_CRITICAL_DIFF_USD", "SEVERITY_HIGH_DIFF_PCT",
+	"DIGEST_SCHEDULE", "DIGEST_HOUR", "DIGEST_WEEKDAY",
+	"CONNECTOR_POLL_INTERVAL",
+	"DB_MAINTENANCE_INTERVAL", "DB_VACUUM_WINDOW", "DB_VACUUM_MIN_FREE_PCT",
+}
+
+// GetConfigBundle exports the settings in force, merchant tolerances, rule
+// flags and transform scripts as one document for PutConfigBundle on
+// another server. Admin only.
+func (h *Handlers) GetConfigBundle(w http.ResponseWriter, r *http.Request) {
+	if !h.requireAdmin(w, r) {
+		return
+	}
+	bundle, err := h.reconSvc.Config()
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+	bundle.ExportedAt = time.Now().UTC()
+	bundle.Settings = make(map[string]string)
+	for _, key := range bundleSettings {
+		if v, ok := os.LookupEnv(key); ok {
+			bundle.Settings[key] = v
+		}
+	}
+	w.Header().Set("Content-Disposition", `attachment; filename="config-bundle.json"`)
+	writeJSON(w, http.StatusOK, bundle)
+}
+
+// PutConfigBundle makes the configuration that of an exported bundle.
+// Settings are written to the configuration file and reloaded; a bundle
+// changing them is 409 without CONFIG_FILE, and 422 when a reload rejects
+// them, with nothing changed. The database entries then replace the
+// current ones. Admin only.
+func (h *Handlers) PutConfigBundle(w http.ResponseWriter, r *http.Request) {
+	if !h.requireAdmin(w, r) {
+		return
+	}
+	var bundle domain.ConfigBundle
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&bundle); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid JSON body: "+err.Error())
+		return
+	}
+	if bundle.Version != domain.ConfigBundleVersion {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("unsupported bundle version %d: this server reads version %d",
+			bundle.Version, domain.ConfigBundleVersion))
+		return
+	}
+	if err := validateBundle(&bundle); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid bundle: "+err.Error())
+		return
+	}
+
+	user := requestUser(r)
+	var reload *config.Result
+	if changed := changedSettings(bundle.Settings); len(changed) > 0 {
+		if h.reloader == nil {
+			writeError(w, http.StatusConflict, "settings differ from this server's ("+strings.Join(changed, ", ")+
+				"); set CONFIG_FILE to import them")
+			return
+		}
+		result, err := h.reloader.Rewrite(bundleSettings, bundle.Settings, "config bundle imported by "+user)
+		if errors.Is(err, config.ErrInvalid) {
+			writeError(w, http.StatusUnprocessableEntity, err.Error())
+			return
+		}
+		if err != nil {
+			writeServerError(w, err)
+			return
+		}
+		reload = result
+	}
+
+	imported, err := h.reconSvc.ReplaceConfig(&bundle, user, time.Now().UTC())
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+	log.Printf("[api] AUDIT: config bundle exported at %s imported by %s: %d settings, %d tolerances, %d rule flags, %d transform scripts",
+		bundle.ExportedAt.Format(time.RFC3339), user, len(bundle.Settings),
+		len(bundle.MerchantTolerances), len(bundle.RuleFlags), len(bundle.TransformScripts))
+
+	writeJSON(w, http.StatusOK, map[string]any{
+		"settings":            reload,
+		"merchant_tolerances": imported.MerchantTolerances,
+		"rule_flags":          imported.RuleFlags,
+		"transform_scripts":   imported.TransformScripts,
+	})
+}
+
+// validateBundle checks every entry of a bundle as the endpoints storing
+// each one do, and that it names each merchant, flag and processor once.
+func validateBundle(b *domain.ConfigBundle) error {
+	for key, v := range b.Settings {
+		if !slices.Contains(bundleSettings, key) {
+			return fmt.Errorf("settings: %s cannot be imported", key)
+		}
+		if strings.ContainsAny(v, "\r\n") {
+			return fmt.Errorf("settings: %s must be on one line", key)
+		}
+	}
+	merchants := make(map[string]bool)
+	for _, t := range b.MerchantTolerances {
+		if t.MerchantID == "" || t.AbsToleranceUSD < 0 {
+			return errors.New("merchant_tolerances: merchant_id is required and abs_tolerance_usd must be >= 0")
+		}
+		if merchants[t.MerchantID] {
+			return fmt.Errorf("merchant_tolerances: %s is given twice", t.MerchantID)
+		}
+		merchants[t.MerchantID] = true
+	}
+	flags := make(map[string]bool)
+	for _, f := range b.RuleFlags {
+		if _, ok := reconciliation.LookupRule(f.Rule); !ok {
+			return fmt.Errorf("rule_flags: unknown rule %q", f.Rule)
+		}
+		if f.Processor != "" && !validProcessor(string(f.Processor)) {
+			return fmt.Errorf("rule_flags: invalid processor %q", f.Processor)
+		}
+		key := f.Rule + "|" + string(f.Processor)
+		if flags[key] {
+			return fmt.Errorf("rule_flags: %s is given twice for processor %q", f.Rule, f.Processor)
+		}
+		flags[key] = true
+	}
+	procs := make(map[domain.Processor]bool)
+	for i := range b.TransformScripts {
+		sc := &b.TransformScripts[i]
+		if !validProcessor(string(sc.Processor)) {
+			return fmt.Errorf("transform_scripts: invalid processor %q", sc.Processor)
+		}
+		if err := sc.Validate(); err != nil {
+			return fmt.Errorf("transform_scripts: %s: %w", sc.Processor, err)
+		}
+		if procs[sc.Processor] {
+			return fmt.Errorf("transform_scripts: %s is given twice", sc.Processor)
+		}
+		procs[sc.Processor] = true
+	}
+	return nil
+}
+
+// changedSettings returns the bundle settings whose value differs from the
+// one in force, including those set here and absent from settings, sorted.
+func changedSettings(settings map[string]string) []string {
+	var changed []string
+	for _, key := range bundleSettings {
+		v, set := os.LookupEnv(key)
+		want, ok := settings[key]
+		if set != ok || v != want {
+			changed = append(changed, key)
+		}
+	}
+	sort.Strings(changed)
+	return changed
+}
+
+// --- Column encryption ---
+
+// GetEncryptionStatus shows the active column encryption key and how many
+// values of each encrypted column are sealed with each key. Admin only.
+func (h *Handlers) GetEncryptionStatus(w http.ResponseWriter, r *http.Request) {
+	if !h.requireAdmin(w, r) {
+		return
+	}
+	status, err := h.encryption.Status()
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, status)
+}
+
+// RotateEncryptionKeys re-encrypts every value not yet sealed with the
+// active key and returns the resulting status. Admin only.
+func (h *Handlers) RotateEncryptionKeys(w http.ResponseWriter, r *http.Request) {
+	if !h.requireAdmin(w, r) {
+		return
+	}
+	n, err := h.encryption.Rotate()
+	if errors.Is(err, repository.ErrRotating) {
+		writeError(w, http.StatusConflict, err.Error())
+		return
+	}
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+	log.Printf("[api] Column key rotation by %s: re-encrypted %d values", requestUser(r), n)
+
+	status, err := h.encryption.Status()
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"reencrypted": n,
+		"status":      status,
+	})
+}
+
+// --- Data retention ---
+
+// GetRetention shows the retention policy and the totals of every row a
+// purge has deleted. Admin only.
+func (h *Handlers) GetRetention(w http.ResponseWriter, r *http.Request) {
+	if !h.requireAdmin(w, r) {
+		return
+	}
+	aggs, err := h.retentionRepo.Aggregates()
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"policy":     h.retention,
+		"aggregates": aggs,
+	})
+}
+
+// ListPurgeReports returns the report of every purge, newest first. Admin
+// only.
+func (h *Handlers) ListPurgeReports(w http.ResponseWriter, r *http.Request) {
+	if !h.requireAdmin(w, r) {
+		return
+	}
+	reports, err := h.retentionRepo.ListReports()
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"reports": reports,
+		"total":   len(reports),
+	})
+}
+
+// PurgeExpired anonymizes or deletes everything past the retention policy
+// and returns the purge report. dry_run=true only reports what would be
+// purged. A purge cannot be undone. Admin only.
+func (h *Handlers) PurgeExpired(w http.ResponseWriter, r *http.Request) {
+	if !h.requireAdmin(w, r) {
+		return
+	}
+	dryRun := r.URL.Query().Get("dry_run") == "true"
+	report, err := h.retention.Purge(h.retentionRepo, time.Now(), requestUser(r), dryRun)
+	if err != nil {
+		writeServerError(w, err)
+		return
+	}
+	if !dryRun {
+		log.Printf("[api] Purge %s by %s (%s): %d transactions, %d settlement records, %d discrepancies",
+			report.ID, report.RequestedBy, report.Mode, report.Transactions, report.SettlementRecords, report.Discrepancies)
+	}
+	writeJSON(w, http.StatusOK, report)
+}
@@ -0,0 +1,152 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/go-chi/chi/v5/middleware"
+)
+
+// HTTPConfig configures the middleware wrapped around the whole server,
+// production and sandbox APIs alike.
+type HTTPConfig struct {
+	// AllowedOrigins are the browser origins allowed cross-origin access,
+	// e.g. https://dashboard.wakala.example; "*" allows any. Empty disables
+	// CORS.
+	AllowedOrigins []string
+	// CompressionLevel is the gzip/deflate level, 1-9; 0 disables
+	// compression.
+	CompressionLevel int
+	// ValidateFileRate is how many requests a minute each client may make
+	// to the public POST /validate-file; 0 disables the limit.
+	ValidateFileRate int
+}
+
+// HTTPConfigFromEnv reads the HTTP middleware configuration:
+//
+//	CORS_ALLOWED_ORIGINS  comma-separated origins, or * (unset: no CORS)
+//	HTTP_COMPRESSION      gzip/deflate level 1-9 (default 5); off disables
+//	VALIDATE_FILE_RATE    POST /validate-file requests a minute per client (default 10); off disables
+func HTTPConfigFromEnv() (HTTPConfig, error) {
+	cfg := HTTPConfig{CompressionLevel: 5, ValidateFileRate: 10}
+
+	if v := os.Getenv("CORS_ALLOWED_ORIGINS"); v != "" {
+		for _, origin := range strings.Split(v, ",") {
+			origin = strings.TrimRight(strings.TrimSpace(origin), "/")
+			if origin == "" {
+				continue
+			}
+			if origin != "*" {
+				u, err := url.Parse(origin)
+				if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.Path != "" {
+					return cfg, fmt.Errorf("CORS_ALLOWED_ORIGINS entry %q must be * or scheme://host[:port]", origin)
+				}
+			}
+			cfg.AllowedOrigins = append(cfg.AllowedOrigins, origin)
+		}
+	}
+	if v := os.Getenv("HTTP_COMPRESSION"); v != "" {
+		if v == "off" {
+			cfg.CompressionLevel = 0
+		} else {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 1 || n > 9 {
+				return cfg, fmt.Errorf("HTTP_COMPRESSION must be a level from 1 to 9 or off, got %q", v)
+			}
+			cfg.CompressionLevel = n
+		}
+	}
+	if v := os.Getenv("VALIDATE_FILE_RATE"); v != "" {
+		if v == "off" {
+			cfg.ValidateFileRate = 0
+		} else {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 1 {
+				return cfg, fmt.Errorf("VALIDATE_FILE_RATE must be a positive number of requests a minute or off, got %q", v)
+			}
+			cfg.ValidateFileRate = n
+		}
+	}
+	return cfg, nil
+}
+
+// compressedTypes are the response types worth compressing: JSON and the
+// CSV and NDJSON exports. Certificate PDFs are compressed already.
+var compressedTypes = []string{"application/json", "text/csv", "application/x-ndjson"}
+
+// Wrap applies CORS, response compression and the validate-file rate limit
+// to h.
+func (c HTTPConfig) Wrap(h http.Handler) http.Handler {
+	if c.ValidateFileRate > 0 {
+		h = newRateLimiter(c.ValidateFileRate).limit(validateFilePath)(h)
+	}
+	if c.CompressionLevel > 0 {
+		h = middleware.Compress(c.CompressionLevel, compressedTypes...)(h)
+	}
+	if len(c.AllowedOrigins) > 0 {
+		h = cors(c.AllowedOrigins)(h)
+	}
+	return h
+}
+
+const (
+	corsMethods = "GET, POST, PUT, PATCH, DELETE, OPTIONS"
+	corsHeaders = "Content-Type, X-User-ID, Idempotency-Key"
+	// corsExposed are the response headers the dashboard reads.
+	corsExposed = "Content-Disposition, Idempotent-Replayed"
+)
+
+// cors allows requests from the given origins and answers their preflight
+// requests. Requests from other origins are served without CORS headers,
+// so browsers withhold the response; their preflights get 403.
+func cors(origins []string) func(http.Handler) http.Handler {
+	allowAny := false
+	allowed := make(map[string]bool, len(origins))
+	for _, o := range origins {
+		if o == "*" {
+			allowAny = true
+		}
+		allowed[strings.ToLower(o)] = true
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			origin := r.Header.Get("Origin")
+			if origin == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+			w.Header().Add("Vary", "Origin")
+			preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+
+			if !allowAny && !allowed[strings.ToLower(origin)] {
+				if preflight {
+					w.Header().Set("Content-Type", "application/json")
+					writeError(w, http.StatusForbidden, "origin not allowed")
+					return
+				}
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			// The origin is echoed rather than sent as *, so the answer is
+			// the same whether or not every origin is allowed.
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			if preflight {
+				w.Header().Add("Vary", "Access-Control-Request-Method")
+				w.Header().Add("Vary", "Access-Control-Request-Headers")
+				w.Header().Set("Access-Control-Allow-Methods", corsMethods)
+				w.Header().Set("Access-Control-Allow-Headers", corsHeaders)
+				w.Header().Set("Access-Control-Max-Age", "600")
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+			w.Header().Set("Access-Control-Expose-Headers", corsExposed)
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,101 @@
+package api
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// validateFilePath is the public endpoint the rate limit applies to; the
+// suffix matches it under /sandbox too.
+const validateFilePath = "/api/v1/validate-file"
+
+// maxClients is how many clients a rate limiter tracks before it forgets
+// the ones whose allowance has refilled.
+const maxClients = 10000
+
+// rateLimiter allows each client, by remote address, perMinute requests a
+// minute, in bursts of up to perMinute.
+type rateLimiter struct {
+	perMinute int
+	now       func() time.Time
+
+	mu      sync.Mutex
+	clients map[string]*bucket
+}
+
+type bucket struct {
+	tokens float64
+	at     time.Time
+}
+
+func newRateLimiter(perMinute int) *rateLimiter {
+	return &rateLimiter{perMinute: perMinute, now: time.Now, clients: map[string]*bucket{}}
+}
+
+// allow takes one request from client's allowance. When there is none
+// left it returns false and how long until there is.
+func (l *rateLimiter) allow(client string) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	b, ok := l.clients[client]
+	if !ok {
+		if len(l.clients) >= maxClients {
+			l.forgetRefilled(now)
+		}
+		b = &bucket{tokens: float64(l.perMinute), at: now}
+		l.clients[client] = b
+	}
+	b.tokens = l.refill(b, now)
+	b.at = now
+	if b.tokens < 1 {
+		perToken := time.Minute / time.Duration(l.perMinute)
+		return false, time.Duration(math.Ceil((1 - b.tokens) * float64(perToken)))
+	}
+	b.tokens--
+	return true, 0
+}
+
+func (l *rateLimiter) refill(b *bucket, now time.Time) float64 {
+	return min(float64(l.perMinute), b.tokens+now.Sub(b.at).Minutes()*float64(l.perMinute))
+}
+
+// forgetRefilled drops the clients with a full allowance, who would start
+// afresh anyway.
+func (l *rateLimiter) forgetRefilled(now time.Time) {
+	for client, b := range l.clients {
+		if l.refill(b, now) >= float64(l.perMinute) {
+			delete(l.clients, client)
+		}
+	}
+}
+
+// limit answers 429 with a Retry-After to the POST requests for path that
+// are over their client's allowance.
+func (l *rateLimiter) limit(path string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodPost || !strings.HasSuffix(r.URL.Path, path) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			client, _, err := net.SplitHostPort(r.RemoteAddr)
+			if err != nil {
+				client = r.RemoteAddr
+			}
+			if ok, wait := l.allow(client); !ok {
+				w.Header().Set("Content-Type", "application/json")
+				w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+				writeError(w, http.StatusTooManyRequests,
+					"rate limit of "+strconv.Itoa(l.perMinute)+" requests a minute exceeded")
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
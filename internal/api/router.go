@@ -1,27 +1,119 @@
 package api
 
 import (
+	"database/sql"
 	"net/http"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
 
+	"github.com/wakala/reconciler/internal/config"
+	"github.com/wakala/reconciler/internal/connector"
 	"github.com/wakala/reconciler/internal/ingestion"
+	"github.com/wakala/reconciler/internal/jira"
+	"github.com/wakala/reconciler/internal/leader"
+	"github.com/wakala/reconciler/internal/live"
+	"github.com/wakala/reconciler/internal/mailbox"
+	"github.com/wakala/reconciler/internal/maintenance"
+	"github.com/wakala/reconciler/internal/reconciliation"
 	"github.com/wakala/reconciler/internal/repository"
+	"github.com/wakala/reconciler/internal/retention"
 )
 
+// Deps are the dependencies of the API. Optional subsystems are left nil
+// when they are not configured, which turns their endpoints off.
+type Deps struct {
+	TxnRepo       *repository.TransactionRepo
+	SettRepo      *repository.SettlementRepo
+	DiscRepo      *repository.DiscrepancyRepo
+	TolRepo       *repository.ToleranceRepo
+	FilterRepo    *repository.SavedFilterRepo
+	ViewRepo      *repository.DashboardViewRepo
+	AlertRepo     *repository.AlertRepo
+	IdemRepo      *repository.IdempotencyRepo
+	CertRepo      *repository.CertificateRepo
+	PeriodRepo    *repository.PeriodRepo
+	TransformRepo *repository.TransformRepo
+	RuleFlagRepo  *repository.RuleFlagRepo
+	RoutingRepo   *repository.RoutingRuleRepo
+	CaseRepo      *repository.CaseRepo
+	ContactRepo   *repository.ProcessorContactRepo
+	ReconSvc      *reconciliation.Service
+	IngestionSvc  *ingestion.Service
+	IngestPool    *ingestion.Pool
+	// Connectors is set when processor API connectors are configured.
+	Connectors *connector.Runner
+	// Mailbox is set when MAILBOX_IMAP_URL is configured.
+	Mailbox *mailbox.Poller
+	// JiraSync is set when JIRA_BASE_URL is configured.
+	JiraSync *jira.Syncer
+	// Admins are the X-User-ID values allowed to call admin-only endpoints.
+	Admins map[string]bool
+	// WebhookSecrets holds each processor's signing secret; processors
+	// without one cannot push settlement events.
+	WebhookSecrets map[string]string
+	// SandboxDB is set only on the sandbox server and enables /simulate.
+	SandboxDB *sql.DB
+	// Snapshots is set when SNAPSHOT_DIR is configured.
+	Snapshots *repository.SnapshotRepo
+	// Maintenance is set unless DB_MAINTENANCE_INTERVAL is off.
+	Maintenance *maintenance.Service
+	// Encryption is set when column encryption keys are configured.
+	Encryption *repository.EncryptionRepo
+	// RetentionRepo enables the purge history; with Retention also set,
+	// purging.
+	RetentionRepo *repository.RetentionRepo
+	// Retention is nil when no retention policy is configured.
+	Retention *retention.Policy
+	// Diagnostics enables /metrics and GET /admin/diagnostics.
+	Diagnostics *repository.DiagnosticsRepo
+	// Versions is nil when ETags are not computed.
+	Versions *repository.DataVersion
+	// Elector is set when LEADER_ELECTION is on.
+	Elector *leader.Elector
+	// Reloader is set when CONFIG_FILE is.
+	Reloader *config.Reloader
+	// Feed serves GET /dashboard/live; nil turns it off.
+	Feed *live.Hub
+}
+
 // NewRouter creates the Chi router with all API routes mounted.
-func NewRouter(
-	txnRepo *repository.TransactionRepo,
-	settRepo *repository.SettlementRepo,
-	discRepo *repository.DiscrepancyRepo,
-	ingestionSvc *ingestion.Service,
-) http.Handler {
+func NewRouter(d Deps) http.Handler {
 	h := &Handlers{
-		txnRepo:      txnRepo,
-		settRepo:     settRepo,
-		discRepo:     discRepo,
-		ingestionSvc: ingestionSvc,
+		txnRepo:        d.TxnRepo,
+		settRepo:       d.SettRepo,
+		discRepo:       d.DiscRepo,
+		tolRepo:        d.TolRepo,
+		filterRepo:     d.FilterRepo,
+		viewRepo:       d.ViewRepo,
+		alertRepo:      d.AlertRepo,
+		idemRepo:       d.IdemRepo,
+		certRepo:       d.CertRepo,
+		periodRepo:     d.PeriodRepo,
+		transformRepo:  d.TransformRepo,
+		ruleFlagRepo:   d.RuleFlagRepo,
+		routingRepo:    d.RoutingRepo,
+		caseRepo:       d.CaseRepo,
+		contactRepo:    d.ContactRepo,
+		reconSvc:       d.ReconSvc,
+		ingestionSvc:   d.IngestionSvc,
+		ingestPool:     d.IngestPool,
+		connectors:     d.Connectors,
+		mailbox:        d.Mailbox,
+		jiraSync:       d.JiraSync,
+		admins:         d.Admins,
+		webhookSecrets: d.WebhookSecrets,
+		sandboxDB:      d.SandboxDB,
+		snapshots:      d.Snapshots,
+		maintenance:    d.Maintenance,
+		encryption:     d.Encryption,
+		retentionRepo:  d.RetentionRepo,
+		retention:      d.Retention,
+		diagnostics:    d.Diagnostics,
+		versions:       d.Versions,
+		elector:        d.Elector,
+		reloader:       d.Reloader,
+		feed:           d.Feed,
 	}
 
 	r := chi.NewRouter()
@@ -31,23 +123,221 @@ func NewRouter(
 	r.Use(middleware.Recoverer)
 	r.Use(middleware.SetHeader("Content-Type", "application/json"))
 
+	// Business KPIs for Prometheus, at the path scrapers use by default.
+	if d.Diagnostics != nil {
+		r.Get("/metrics", h.GetMetrics)
+	}
+
 	r.Route("/api/v1", func(r chi.Router) {
 		// Ingestion.
 		r.Post("/reports/ingest", h.IngestReport)
+		r.Post("/reports/ingest/batch", h.IngestReportBatch)
+		r.Post("/reports/preview", h.PreviewReport)
+		r.Get("/reports/jobs/{id}", h.GetIngestJob)
+		r.Get("/reports/dead-letters", h.ListDeadLetters)
+		r.Get("/reports/dead-letters/{id}", h.GetDeadLetter)
+		r.Get("/reports/dead-letters/{id}/raw", h.GetDeadLetterRaw)
+		r.Post("/reports/dead-letters/{id}/retry", h.RetryDeadLetter)
+		r.Post("/reports/dead-letters/{id}/discard", h.DiscardDeadLetter)
+		r.Get("/reports/{id}", h.GetReport)
+		r.Get("/reports/{id}/raw", h.GetReportRaw)
+
+		// Public, rate-limited check of a processor's test file.
+		r.Post("/validate-file", h.ValidateFile)
+
+		// Processor API connectors.
+		r.Get("/connectors", h.ListConnectors)
+		r.Post("/connectors/{name}/pull", h.PullConnector)
+
+		// Report attachments fetched from an IMAP mailbox.
+		r.Get("/mailbox", h.GetMailbox)
+		r.Post("/mailbox/poll", h.PollMailbox)
+
+		// Reconciliation.
+		r.Post("/reconciliation/run", h.RunReconciliation)
+		r.Get("/reconciliation/pending", h.GetPendingReconciliation)
+		r.Post("/reconciliation/flush", h.FlushReconciliation)
 
 		// Transactions.
 		r.Get("/transactions", h.ListTransactions)
+		r.Get("/transactions/export", h.ExportTransactions)
+		r.Get("/transactions/quarantined", h.ListQuarantinedTransactions)
+		r.Delete("/transactions/quarantined/{id}", h.DeleteQuarantinedTransaction)
 		r.Get("/transactions/{id}/settlement-status", h.GetTransactionSettlementStatus)
+		r.Post("/transactions/settlement-status:batch", h.BatchTransactionSettlementStatus)
+		r.Post("/transactions/{id}/amendments", h.AmendTransaction)
+		r.Get("/transactions/{id}/amendments", h.ListTransactionAmendments)
+
+		// Cross-border transfers.
+		r.Get("/transfers", h.ListTransfers)
+		r.Get("/transfers/{id}", h.GetTransfer)
 
 		// Discrepancies.
 		r.Get("/discrepancies", h.ListDiscrepancies)
+		r.Get("/discrepancies/export", h.ExportDiscrepancies)
 		r.Get("/discrepancies/summary", h.GetDiscrepancySummary)
+		r.Get("/discrepancies/{id}", h.GetDiscrepancy)
+		r.Post("/discrepancies/{id}/tags", h.AddDiscrepancyTags)
+		r.Delete("/discrepancies/{id}/tags/{tag}", h.RemoveDiscrepancyTag)
+		r.Put("/discrepancies/{id}/ticket", h.SetDiscrepancyTicket)
+		r.Delete("/discrepancies/{id}/ticket", h.RemoveDiscrepancyTicket)
+		r.Get("/discrepancies/{id}/activity", h.GetDiscrepancyActivity)
+		r.Get("/discrepancies/{id}/investigate", h.InvestigateDiscrepancy)
+		r.Get("/discrepancies/{id}/lineage", h.GetDiscrepancyLineage)
+		r.Post("/discrepancies/recalculate-severity", h.RecalculateSeverities)
+
+		// Cases grouping discrepancies with one cause.
+		r.Get("/cases", h.ListCases)
+		r.Post("/cases", h.CreateCase)
+		r.Get("/cases/{id}", h.GetCase)
+		r.Post("/cases/{id}/discrepancies", h.AddCaseDiscrepancies)
+		r.Delete("/cases/{id}/discrepancies/{discID}", h.RemoveCaseDiscrepancy)
+		r.Post("/cases/{id}/resolve", h.ResolveCase)
+		r.Post("/cases/{id}/reopen", h.ReopenCase)
+
+		// Saved discrepancy filters (per X-User-ID).
+		r.Get("/saved-filters", h.ListSavedFilters)
+		r.Post("/saved-filters", h.CreateSavedFilter)
+		r.Delete("/saved-filters/{id}", h.DeleteSavedFilter)
+
+		// Saved dashboard views (per X-User-ID).
+		r.Get("/views", h.ListDashboardViews)
+		r.Post("/views", h.CreateDashboardView)
+		r.Get("/views/{id}", h.GetDashboardView)
+		r.Put("/views/{id}", h.UpdateDashboardView)
+		r.Delete("/views/{id}", h.DeleteDashboardView)
 
 		// Settlements.
 		r.Get("/settlements", h.ListSettlements)
+		r.Get("/settlements/export", h.ExportSettlements)
+		r.Get("/settlements/unmatched", h.ListUnmatched)
+		r.Get("/settlements/unmatched/feedback", h.GetSuggestionFeedback)
+		r.Patch("/settlements/{id}", h.PatchSettlement)
+		r.Get("/settlements/{id}/corrections", h.ListSettlementCorrections)
+		r.Get("/settlements/{id}/lineage", h.GetSettlementLineage)
+		r.Post("/settlements/{id}/suggestions/{txnID}/accept", h.AcceptSuggestion)
+		r.Post("/settlements/{id}/suggestions/{txnID}/reject", h.RejectSuggestion)
+		r.Get("/batches", h.ListBatches)
+		r.Get("/batches/approvals", h.ListBatchApprovals)
+		r.Get("/batches/balances", h.GetBatchBalances)
+		r.Post("/batches/{processor}/{batchID}/approve", h.ApproveBatch)
+		r.Get("/batches/{processor}/{batchID}", h.GetBatch)
+		r.Post("/batches/{processor}/{batchID}/certificates", h.GenerateBatchCertificate)
+		r.Get("/batches/{processor}/{batchID}/certificates", h.ListBatchCertificates)
+		r.Get("/certificates/{id}", h.GetCertificate)
+		r.Post("/certificates/{id}/sign-off", h.SignOffCertificate)
+
+		// Alerts.
+		r.Get("/alerts", h.ListAlerts)
 
 		// Dashboard.
 		r.Get("/dashboard", h.GetDashboard)
+		r.Get("/dashboard/top-offenders", h.GetTopOffenders)
+		r.Get("/dashboard/live", h.GetDashboardLive)
+
+		// Month-end close.
+		r.Get("/periods", h.ListPeriods)
+		r.Get("/periods/{period}", h.GetPeriod)
+		r.Post("/periods/{period}/close", h.ClosePeriod)
+		r.Post("/periods/{period}/reopen", h.ReopenPeriod)
+		r.Get("/adjustments", h.ListAdjustments)
+		r.Post("/adjustments/{id}/approve", h.ApproveAdjustment)
+		r.Post("/adjustments/{id}/reject", h.RejectAdjustment)
+
+		// Analytics.
+		r.Get("/analytics/discrepancy-flow", h.GetDiscrepancyFlow)
+		r.Get("/analytics/fees", h.GetFeeAnalytics)
+		r.Get("/analytics/mismatch-deltas", h.GetMismatchDeltas)
+		r.Get("/analytics/settlement-calendar", h.GetSettlementCalendar)
+
+		// Merchant tolerance overrides.
+		r.Get("/merchants/tolerances", h.ListMerchantTolerances)
+		r.Get("/merchants/payout-holds", h.ListPayoutHolds)
+		r.Get("/merchants/{id}/payout-hold", h.GetPayoutHold)
+		r.Put("/merchants/{id}/tolerance", h.PutMerchantTolerance)
+		r.Delete("/merchants/{id}/tolerance", h.DeleteMerchantTolerance)
+
+		// Settlement events pushed by processors, matched on arrival.
+		r.Post("/webhooks/{processor}/settlements", h.ReceiveSettlementEvent)
+
+		// Jira issue events, and the sync of discrepancies with Jira issues.
+		r.Post("/webhooks/jira", h.ReceiveJiraEvent)
+		r.Get("/admin/jira", h.GetJiraStatus)
+		r.Post("/admin/jira/sync", h.SyncJira)
+
+		// Per-processor transform scripts run on parsed records.
+		r.Get("/transforms", h.ListTransformScripts)
+		r.Get("/transforms/{processor}", h.GetTransformScript)
+		r.Put("/transforms/{processor}", h.PutTransformScript)
+		r.Delete("/transforms/{processor}", h.DeleteTransformScript)
+
+		// Per-processor escalation contacts, quoted in alerts and issues.
+		r.Get("/processor-contacts", h.ListProcessorContacts)
+		r.Get("/processor-contacts/{processor}", h.GetProcessorContact)
+		r.Put("/processor-contacts/{processor}", h.PutProcessorContact)
+		r.Delete("/processor-contacts/{processor}", h.DeleteProcessorContact)
+
+		// Sandbox only: regenerate the synthetic dataset.
+		if d.SandboxDB != nil {
+			r.Post("/simulate", h.Simulate)
+		}
+
+		// Database snapshots, for integration test fixtures.
+		if d.Snapshots != nil {
+			r.Get("/admin/snapshots", h.ListSnapshots)
+			r.Post("/admin/snapshots", h.CreateSnapshot)
+			r.Post("/admin/snapshots/{name}/restore", h.RestoreSnapshot)
+		}
+
+		// Scheduled SQLite maintenance, when enabled.
+		if d.Maintenance != nil {
+			r.Get("/admin/maintenance", h.GetMaintenanceStatus)
+			r.Post("/admin/maintenance/run", h.RunMaintenance)
+		}
+
+		// Flags turning reconciliation rules on and off.
+		r.Get("/admin/rules", h.ListRules)
+		r.Put("/admin/rules/{rule}", h.PutRuleFlag)
+		r.Delete("/admin/rules/{rule}", h.DeleteRuleFlag)
+
+		// Rules assigning new discrepancies to teams and users.
+		r.Get("/admin/routing-rules", h.ListRoutingRules)
+		r.Post("/admin/routing-rules", h.CreateRoutingRule)
+		r.Put("/admin/routing-rules/{id}", h.PutRoutingRule)
+		r.Delete("/admin/routing-rules/{id}", h.DeleteRoutingRule)
+
+		// Configuration moved between environments as one document.
+		r.Get("/admin/config-bundle", h.GetConfigBundle)
+		r.Put("/admin/config-bundle", h.PutConfigBundle)
+
+		// The configuration file, reloaded without a restart.
+		if d.Reloader != nil {
+			r.Get("/admin/config", h.GetConfigStatus)
+			r.Post("/admin/config/reload", h.ReloadConfig)
+		}
+
+		// Column encryption key status and rotation, when keys are configured.
+		if d.Encryption != nil {
+			r.Get("/admin/encryption", h.GetEncryptionStatus)
+			r.Post("/admin/encryption/rotate", h.RotateEncryptionKeys)
+		}
+
+		// Health and data freshness for on-call.
+		if d.Diagnostics != nil {
+			r.Get("/admin/diagnostics", h.GetDiagnostics)
+		}
+
+		// Recompute state derived from settlement records after manual edits.
+		r.Post("/admin/rebuild", h.RebuildDerivedState)
+
+		// Data retention: purge history always, purging with a policy.
+		if d.RetentionRepo != nil {
+			r.Get("/admin/retention", h.GetRetention)
+			r.Get("/admin/retention/reports", h.ListPurgeReports)
+			if d.Retention != nil {
+				r.Post("/admin/retention/purge", h.PurgeExpired)
+			}
+		}
 	})
 
 	return r
@@ -0,0 +1,52 @@
+// Package blob keeps files outside the database: the original report files
+// and database snapshots. A Store is a flat namespace of keys such as
+// "reports/<sha256>", backed by a local directory, an S3 bucket or a Google
+// Cloud Storage bucket, chosen per deployment by FromEnv.
+package blob
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"time"
+)
+
+// ErrNotFound is returned, wrapped, by Get for a key that holds nothing.
+var ErrNotFound = errors.New("blob not found")
+
+// keyPattern keeps keys safe as file paths and URL paths on every backend:
+// segments of letters, digits, '.', '-' and '_' that do not start with '.',
+// separated by '/'.
+var keyPattern = regexp.MustCompile(`^[A-Za-z0-9_-][A-Za-z0-9._-]*(/[A-Za-z0-9_-][A-Za-z0-9._-]*)*$`)
+
+// Object is a stored blob as List returns it.
+type Object struct {
+	Key     string
+	Size    int64
+	ModTime time.Time
+}
+
+// Store stores blobs by key. Keys are relative to the store's prefix, which
+// is never part of a key passed in or returned.
+type Store interface {
+	// Put stores data under key, replacing what was there.
+	Put(ctx context.Context, key string, data []byte) error
+	// Get returns what is stored under key, or an error wrapping
+	// ErrNotFound.
+	Get(ctx context.Context, key string) ([]byte, error)
+	// Delete removes key. Deleting a missing key is not an error.
+	Delete(ctx context.Context, key string) error
+	// List returns the blobs whose keys start with prefix, sorted by key.
+	List(ctx context.Context, prefix string) ([]Object, error)
+	// String names the store in logs, e.g. "s3://bucket/prod/".
+	String() string
+}
+
+// ValidKey checks that key can be stored on every backend.
+func ValidKey(key string) error {
+	if !keyPattern.MatchString(key) {
+		return fmt.Errorf("invalid blob key %q", key)
+	}
+	return nil
+}
@@ -0,0 +1,113 @@
+package blob
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// FromEnv configures the blob store from:
+//
+//	BLOB_STORE             database (the default), local, s3 or gcs
+//	BLOB_PREFIX            prefix of every key, e.g. "prod/", so deployments can share a bucket
+//	BLOB_LOCAL_DIR         directory of the local store (required for local)
+//	BLOB_BUCKET            bucket of the s3 and gcs stores (required for them)
+//	BLOB_S3_REGION         region of the bucket (default us-east-1)
+//	BLOB_S3_ENDPOINT       base URL (default https://s3.<region>.amazonaws.com), for S3-compatible servers
+//	AWS_ACCESS_KEY_ID      access key of the s3 store (required for s3)
+//	AWS_SECRET_ACCESS_KEY  its secret
+//	AWS_SESSION_TOKEN      session token of temporary credentials
+//	GCS_HMAC_ACCESS_ID     HMAC key of a service account, for gcs (required for gcs)
+//	GCS_HMAC_SECRET        its secret
+//
+// It returns nil, nil for the database store, which keeps files in the
+// database as before. Plain http endpoints are only accepted for loopback
+// hosts.
+func FromEnv() (Store, error) {
+	kind := os.Getenv("BLOB_STORE")
+	prefix := os.Getenv("BLOB_PREFIX")
+	if prefix != "" {
+		if err := ValidKey(strings.TrimSuffix(prefix, "/")); err != nil {
+			return nil, fmt.Errorf("BLOB_PREFIX: %w", err)
+		}
+		if !strings.HasSuffix(prefix, "/") {
+			prefix += "/"
+		}
+	}
+
+	switch kind {
+	case "", "database":
+		return nil, nil
+	case "local":
+		dir := os.Getenv("BLOB_LOCAL_DIR")
+		if dir == "" {
+			return nil, fmt.Errorf("BLOB_LOCAL_DIR is required when BLOB_STORE is local")
+		}
+		return NewLocal(dir, prefix), nil
+	case "s3":
+		bucket, err := bucketFromEnv(kind)
+		if err != nil {
+			return nil, err
+		}
+		region := os.Getenv("BLOB_S3_REGION")
+		if region == "" {
+			region = "us-east-1"
+		}
+		endpoint := os.Getenv("BLOB_S3_ENDPOINT")
+		if endpoint == "" {
+			endpoint = "https://s3." + region + ".amazonaws.com"
+		}
+		u, err := url.Parse(endpoint)
+		if err != nil || u.Host == "" {
+			return nil, fmt.Errorf("BLOB_S3_ENDPOINT must be a URL, got %q", endpoint)
+		}
+		if u.Scheme != "https" && !(u.Scheme == "http" && isLoopback(u.Hostname())) {
+			return nil, fmt.Errorf("BLOB_S3_ENDPOINT must use https, got %q", endpoint)
+		}
+		key, secret := os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY")
+		if key == "" || secret == "" {
+			return nil, fmt.Errorf("AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY are required when BLOB_STORE is s3")
+		}
+		return NewS3(S3Config{
+			Endpoint:     u,
+			Region:       region,
+			Bucket:       bucket,
+			Prefix:       prefix,
+			AccessKey:    key,
+			SecretKey:    secret,
+			SessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+		}), nil
+	case "gcs":
+		bucket, err := bucketFromEnv(kind)
+		if err != nil {
+			return nil, err
+		}
+		id, secret := os.Getenv("GCS_HMAC_ACCESS_ID"), os.Getenv("GCS_HMAC_SECRET")
+		if id == "" || secret == "" {
+			return nil, fmt.Errorf("GCS_HMAC_ACCESS_ID and GCS_HMAC_SECRET are required when BLOB_STORE is gcs")
+		}
+		return NewGCS(bucket, prefix, id, secret), nil
+	}
+	return nil, fmt.Errorf("BLOB_STORE must be database, local, s3 or gcs, got %q", kind)
+}
+
+func bucketFromEnv(kind string) (string, error) {
+	bucket := os.Getenv("BLOB_BUCKET")
+	if bucket == "" {
+		return "", fmt.Errorf("BLOB_BUCKET is required when BLOB_STORE is %s", kind)
+	}
+	if err := ValidKey(bucket); err != nil || strings.Contains(bucket, "/") {
+		return "", fmt.Errorf("BLOB_BUCKET: invalid bucket name %q", bucket)
+	}
+	return bucket, nil
+}
+
+func isLoopback(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
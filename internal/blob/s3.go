@@ -0,0 +1,309 @@
+package blob
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/wakala/reconciler/internal/retry"
+)
+
+// maxBlobSize bounds what Get reads back, well above any report file.
+const maxBlobSize = 1 << 30
+
+// S3 stores blobs in a bucket over the S3 REST API, signing requests with
+// AWS Signature Version 4. Buckets are addressed by path, which S3, Google
+// Cloud Storage's XML API and S3-compatible servers such as MinIO all
+// accept. Calls go through the "blob" retry policy.
+type S3 struct {
+	scheme       string // s3 or gs, for String
+	endpoint     *url.URL
+	region       string
+	bucket       string
+	prefix       string
+	accessKey    string
+	secretKey    string
+	sessionToken string
+	client       *http.Client
+	retry        *retry.Integration
+}
+
+// S3Config configures an S3 store. Endpoint is the service's base URL, e.g.
+// https://s3.eu-west-1.amazonaws.com.
+type S3Config struct {
+	Endpoint     *url.URL
+	Region       string
+	Bucket       string
+	Prefix       string
+	AccessKey    string
+	SecretKey    string
+	SessionToken string
+}
+
+// NewS3 creates a store on an S3 bucket.
+func NewS3(c S3Config) *S3 {
+	return newS3("s3", c)
+}
+
+// NewGCS creates a store on a Google Cloud Storage bucket, through its XML
+// API with an HMAC key of a service account.
+func NewGCS(bucket, prefix, accessID, secret string) *S3 {
+	return newS3("gs", S3Config{
+		Endpoint:  &url.URL{Scheme: "https", Host: "storage.googleapis.com"},
+		Region:    "auto",
+		Bucket:    bucket,
+		Prefix:    prefix,
+		AccessKey: accessID,
+		SecretKey: secret,
+	})
+}
+
+func newS3(scheme string, c S3Config) *S3 {
+	return &S3{
+		scheme:       scheme,
+		endpoint:     c.Endpoint,
+		region:       c.Region,
+		bucket:       c.Bucket,
+		prefix:       c.Prefix,
+		accessKey:    c.AccessKey,
+		secretKey:    c.SecretKey,
+		sessionToken: c.SessionToken,
+		client:       &http.Client{Timeout: 5 * time.Minute},
+		retry:        retry.For("blob", retry.DefaultPolicy),
+	}
+}
+
+func (s *S3) Put(ctx context.Context, key string, data []byte) error {
+	if err := ValidKey(key); err != nil {
+		return err
+	}
+	return s.retry.Do(ctx, func(ctx context.Context) error {
+		resp, err := s.do(ctx, http.MethodPut, s.prefix+key, nil, data)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		return nil
+	})
+}
+
+func (s *S3) Get(ctx context.Context, key string) ([]byte, error) {
+	if err := ValidKey(key); err != nil {
+		return nil, err
+	}
+	var data []byte
+	err := s.retry.Do(ctx, func(ctx context.Context) error {
+		resp, err := s.do(ctx, http.MethodGet, s.prefix+key, nil, nil)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		data, err = io.ReadAll(io.LimitReader(resp.Body, maxBlobSize))
+		return err
+	})
+	return data, err
+}
+
+func (s *S3) Delete(ctx context.Context, key string) error {
+	if err := ValidKey(key); err != nil {
+		return err
+	}
+	err := s.retry.Do(ctx, func(ctx context.Context) error {
+		resp, err := s.do(ctx, http.MethodDelete, s.prefix+key, nil, nil)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		return nil
+	})
+	if errors.Is(err, ErrNotFound) {
+		return nil
+	}
+	return err
+}
+
+type listBucketResult struct {
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+	Contents              []struct {
+		Key          string    `xml:"Key"`
+		Size         int64     `xml:"Size"`
+		LastModified time.Time `xml:"LastModified"`
+	} `xml:"Contents"`
+}
+
+// List pages through ListObjectsV2.
+func (s *S3) List(ctx context.Context, prefix string) ([]Object, error) {
+	var objects []Object
+	token := ""
+	for {
+		q := url.Values{}
+		q.Set("list-type", "2")
+		q.Set("prefix", s.prefix+prefix)
+		if token != "" {
+			q.Set("continuation-token", token)
+		}
+		var page listBucketResult
+		err := s.retry.Do(ctx, func(ctx context.Context) error {
+			resp, err := s.do(ctx, http.MethodGet, "", q, nil)
+			if err != nil {
+				return err
+			}
+			defer resp.Body.Close()
+			page = listBucketResult{}
+			return xml.NewDecoder(resp.Body).Decode(&page)
+		})
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range page.Contents {
+			objects = append(objects, Object{
+				Key:     strings.TrimPrefix(c.Key, s.prefix),
+				Size:    c.Size,
+				ModTime: c.LastModified.UTC(),
+			})
+		}
+		if !page.IsTruncated || page.NextContinuationToken == "" {
+			break
+		}
+		token = page.NextContinuationToken
+	}
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Key < objects[j].Key })
+	return objects, nil
+}
+
+func (s *S3) String() string {
+	return s.scheme + "://" + s.bucket + "/" + s.prefix
+}
+
+// do sends one signed request for object (the bucket itself when empty) and
+// returns the response when it is a success. A 404 is a permanent error
+// wrapping ErrNotFound; other client errors are permanent too.
+func (s *S3) do(ctx context.Context, method, object string, query url.Values, body []byte) (*http.Response, error) {
+	u := *s.endpoint
+	u.Path = strings.TrimRight(u.Path, "/") + "/" + s.bucket
+	if object != "" {
+		u.Path += "/" + object
+	}
+	u.RawQuery = canonicalQuery(query)
+
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = int64(len(body))
+	s.sign(req, body, time.Now().UTC())
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	err = fmt.Errorf("%s %s: status %d: %s", method, s.scheme+"://"+s.bucket+"/"+object, resp.StatusCode, strings.TrimSpace(string(msg)))
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, retry.Permanent(fmt.Errorf("%w: %w", ErrNotFound, err))
+	}
+	if !retry.RetryableStatus(resp.StatusCode) {
+		return nil, retry.Permanent(err)
+	}
+	return nil, err
+}
+
+// sign adds the Signature Version 4 headers to req. Keys are limited by
+// ValidKey to characters that need no escaping, so the request path is its
+// own canonical form.
+func (s *S3) sign(req *http.Request, body []byte, now time.Time) {
+	sum := sha256.Sum256(body)
+	payloadHash := hex.EncodeToString(sum[:])
+	amzDate := now.Format("20060102T150405Z")
+	day := now.Format("20060102")
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if s.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", s.sessionToken)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name := range req.Header {
+		if lower := strings.ToLower(name); strings.HasPrefix(lower, "x-amz-") {
+			headers[lower] = strings.TrimSpace(req.Header.Get(name))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := day + "/" + s.region + "/s3/aws4_request"
+	hashed := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(hashed[:])
+
+	key := hmacSHA256([]byte("AWS4"+s.secretKey), day)
+	key = hmacSHA256(key, s.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.accessKey, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// canonicalQuery encodes q sorted by name, with spaces as %20 as Signature
+// Version 4 requires.
+func canonicalQuery(q url.Values) string {
+	if len(q) == 0 {
+		return ""
+	}
+	names := make([]string, 0, len(q))
+	for name := range q {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var parts []string
+	for _, name := range names {
+		for _, v := range q[name] {
+			parts = append(parts, escapeQuery(name)+"="+escapeQuery(v))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+func escapeQuery(s string) string {
+	return strings.ReplaceAll(url.QueryEscape(s), "+", "%20")
+}
@@ -0,0 +1,149 @@
+// Package config reads the optional configuration file named by CONFIG_FILE
+// and reloads it while the server runs. The file holds the same settings as
+// the environment, one KEY=VALUE per line, and its values take precedence
+// over the environment's. On reload the changed settings are validated
+// together and applied to the subsystems that can take them without a
+// restart; changes to any other setting are reported as needing one.
+package config
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ReadFile reads a configuration file: KEY=VALUE lines, with blank lines and
+// lines starting with # ignored. A line may start with "export ", and a
+// value may be wrapped in single or double quotes.
+func ReadFile(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	values := make(map[string]string)
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, value, ok := strings.Cut(strings.TrimPrefix(line, "export "), "=")
+		key = strings.TrimSpace(key)
+		if !ok || !validKey(key) {
+			return nil, fmt.Errorf("%s:%d: want KEY=VALUE", path, n)
+		}
+		value = strings.TrimSpace(value)
+		if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+			value = value[1 : len(value)-1]
+		}
+		if _, dup := values[key]; dup {
+			return nil, fmt.Errorf("%s:%d: %s is set twice", path, n, key)
+		}
+		values[key] = value
+	}
+	if err := sc.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return values, nil
+}
+
+// validKey reports whether key is an environment variable name of upper
+// case letters, digits and underscores, not starting with a digit.
+func validKey(key string) bool {
+	if key == "" || key[0] >= '0' && key[0] <= '9' {
+		return false
+	}
+	for _, c := range key {
+		if !(c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+// rewriteLines returns the file data with keys set to their values in
+// values: the line of a key with a value is replaced, the line of one
+// without is dropped, and values for keys not in the file are appended.
+// Comments, blank lines and other keys are kept.
+func rewriteLines(data []byte, keys []string, values map[string]string) []byte {
+	managed := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		managed[key] = true
+	}
+	written := make(map[string]bool)
+	var out bytes.Buffer
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	for sc.Scan() {
+		line := sc.Text()
+		key, _, ok := strings.Cut(strings.TrimPrefix(strings.TrimSpace(line), "export "), "=")
+		key = strings.TrimSpace(key)
+		if ok && managed[key] {
+			if value, set := values[key]; set && !written[key] {
+				fmt.Fprintf(&out, "%s=%s\n", key, quoteValue(value))
+				written[key] = true
+			}
+			continue
+		}
+		out.WriteString(line)
+		out.WriteByte('\n')
+	}
+	for _, key := range keys {
+		if value, set := values[key]; set && !written[key] {
+			fmt.Fprintf(&out, "%s=%s\n", key, quoteValue(value))
+		}
+	}
+	return out.Bytes()
+}
+
+// quoteValue wraps a value in double quotes when ReadFile would otherwise
+// trim its spaces or strip its quotes.
+func quoteValue(v string) string {
+	if v != strings.TrimSpace(v) || strings.HasPrefix(v, `"`) || strings.HasPrefix(v, "'") {
+		return `"` + v + `"`
+	}
+	return v
+}
+
+// writeFile replaces the file at path with data, through a temporary file
+// renamed over it, so the file is never seen half written.
+func writeFile(path string, data []byte, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// setting is an environment variable's value, or its absence.
+type setting struct {
+	value string
+	set   bool
+}
+
+func lookup(key string) setting {
+	v, ok := os.LookupEnv(key)
+	return setting{value: v, set: ok}
+}
+
+func (s setting) restore(key string) {
+	if s.set {
+		os.Setenv(key, s.value)
+	} else {
+		os.Unsetenv(key)
+	}
+}
@@ -0,0 +1,290 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Subsystem is a running part of the server whose settings may change
+// without a restart.
+type Subsystem struct {
+	Name string
+	// Keys are the environment variables the subsystem reads.
+	Keys []string
+	// Prepare reads the subsystem's settings from the environment and
+	// validates them, returning a function that puts them into effect. It
+	// must not change anything itself, since a reload is abandoned if any
+	// subsystem's settings are invalid.
+	Prepare func() (apply func(), err error)
+}
+
+// Result is the outcome of one reload.
+type Result struct {
+	At      time.Time `json:"at"`
+	Trigger string    `json:"trigger"`
+	// Changed are the settings that were put into effect, and Applied the
+	// subsystems reconfigured for them.
+	Changed []string `json:"changed"`
+	Applied []string `json:"applied"`
+	// RestartRequired are the changed settings no subsystem can take while
+	// it runs. They keep their old values until the next restart.
+	RestartRequired []string `json:"restart_required"`
+	Error           string   `json:"error,omitempty"`
+}
+
+// Status is the configuration file in force and the last reload.
+type Status struct {
+	File     string    `json:"file"`
+	LoadedAt time.Time `json:"loaded_at"`
+	// Reloadable lists, by subsystem, the settings a reload may change.
+	Reloadable map[string][]string `json:"reloadable"`
+	LastReload *Result             `json:"last_reload,omitempty"`
+}
+
+// ErrInvalid is returned, wrapped, by a reload rejected because the file
+// could not be read or a changed setting is invalid. Nothing was changed.
+var ErrInvalid = errors.New("invalid configuration")
+
+// Reloader holds the settings read from the configuration file and applies
+// changes to them.
+type Reloader struct {
+	path string
+
+	// mu serialises reloads.
+	mu         sync.Mutex
+	subsystems []Subsystem
+	// values are the file's settings in force, and base the environment's
+	// values of those keys from before the file overrode them, restored
+	// when a key is removed from the file.
+	values map[string]string
+	base   map[string]setting
+
+	statusMu sync.Mutex
+	loadedAt time.Time
+	last     *Result
+}
+
+// Load reads the file named by CONFIG_FILE into the environment, so that
+// every setting read from the environment afterwards sees its values. It
+// returns nil, nil when CONFIG_FILE is not set. Load must be called before
+// any other setting is read.
+func Load() (*Reloader, error) {
+	path := os.Getenv("CONFIG_FILE")
+	if path == "" {
+		return nil, nil
+	}
+	values, err := ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := values["CONFIG_FILE"]; ok {
+		return nil, fmt.Errorf("%s: CONFIG_FILE cannot be set in the configuration file", path)
+	}
+	r := &Reloader{path: path, values: values, base: make(map[string]setting), loadedAt: time.Now().UTC()}
+	for key, value := range values {
+		r.base[key] = lookup(key)
+		os.Setenv(key, value)
+	}
+	return r, nil
+}
+
+// Path returns the configuration file's path.
+func (r *Reloader) Path() string { return r.path }
+
+// Keys returns the number of settings read from the file.
+func (r *Reloader) Keys() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.values)
+}
+
+// Register adds a subsystem that reloads may reconfigure. Subsystems are
+// reconfigured in the order they were registered.
+func (r *Reloader) Register(s Subsystem) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.subsystems = append(r.subsystems, s)
+}
+
+// Status returns the file in force and the outcome of the last reload.
+func (r *Reloader) Status() *Status {
+	r.mu.Lock()
+	reloadable := make(map[string][]string, len(r.subsystems))
+	for _, s := range r.subsystems {
+		reloadable[s.Name] = s.Keys
+	}
+	r.mu.Unlock()
+
+	r.statusMu.Lock()
+	defer r.statusMu.Unlock()
+	return &Status{File: r.path, LoadedAt: r.loadedAt, Reloadable: reloadable, LastReload: r.last}
+}
+
+// Reload reads the file again and puts its changed settings into effect.
+// The settings of every affected subsystem are validated first: if any is
+// invalid, or the file cannot be read, the reload is rejected with an error
+// wrapping ErrInvalid and nothing changes. Otherwise each affected subsystem
+// is reconfigured, as a whole, with its new settings. trigger says what
+// asked for the reload, for the log and the status.
+func (r *Reloader) Reload(trigger string) (*Result, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.reloadLocked(trigger)
+}
+
+// Rewrite sets keys in the file to their values in values, removing from it
+// those values has not, then reloads it as Reload does. Other lines of the
+// file are kept as they are. If the reload is rejected the file is put back
+// as it was, so that an invalid setting is not picked up by a later reload.
+func (r *Reloader) Rewrite(keys []string, values map[string]string, trigger string) (*Result, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	old, err := os.ReadFile(r.path)
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(r.path)
+	if err != nil {
+		return nil, err
+	}
+	if err := writeFile(r.path, rewriteLines(old, keys, values), info.Mode().Perm()); err != nil {
+		return nil, err
+	}
+	res, err := r.reloadLocked(trigger)
+	if errors.Is(err, ErrInvalid) {
+		if werr := writeFile(r.path, old, info.Mode().Perm()); werr != nil {
+			log.Printf("[config] WARNING: could not restore %s: %v", r.path, werr)
+		}
+	}
+	return res, err
+}
+
+func (r *Reloader) reloadLocked(trigger string) (*Result, error) {
+	res := &Result{At: time.Now().UTC(), Trigger: trigger, Changed: []string{}, Applied: []string{}, RestartRequired: []string{}}
+	err := r.reload(res)
+	if err != nil {
+		res.Error = err.Error()
+		log.Printf("[config] WARNING: reload (%s) of %s rejected: %v", trigger, r.path, err)
+	} else {
+		r.statusMu.Lock()
+		r.loadedAt = res.At
+		r.statusMu.Unlock()
+		switch {
+		case len(res.Changed) > 0:
+			log.Printf("[config] Reloaded %s (%s): %s changed; reconfigured %s",
+				r.path, trigger, strings.Join(res.Changed, ", "), strings.Join(res.Applied, ", "))
+		case len(res.RestartRequired) == 0:
+			log.Printf("[config] Reloaded %s (%s): no settings changed", r.path, trigger)
+		}
+		if len(res.RestartRequired) > 0 {
+			log.Printf("[config] WARNING: restart to apply the changes to %s in %s",
+				strings.Join(res.RestartRequired, ", "), r.path)
+		}
+	}
+	r.statusMu.Lock()
+	r.last = res
+	r.statusMu.Unlock()
+	return res, err
+}
+
+func (r *Reloader) reload(res *Result) error {
+	next, err := ReadFile(r.path)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalid, err)
+	}
+	if _, ok := next["CONFIG_FILE"]; ok {
+		return fmt.Errorf("%w: CONFIG_FILE cannot be set in the configuration file", ErrInvalid)
+	}
+
+	// A key's wanted value is the file's, or for a key removed from the
+	// file the environment's from before the file set it.
+	wanted := make(map[string]setting)
+	for key := range r.values {
+		wanted[key] = r.base[key]
+	}
+	for key, value := range next {
+		wanted[key] = setting{value: value, set: true}
+	}
+
+	reloadable := make(map[string]bool)
+	for _, s := range r.subsystems {
+		for _, key := range s.Keys {
+			reloadable[key] = true
+		}
+	}
+	previous := make(map[string]setting)
+	for key, want := range wanted {
+		if lookup(key) == want {
+			continue
+		}
+		if reloadable[key] {
+			previous[key] = lookup(key)
+			res.Changed = append(res.Changed, key)
+		} else {
+			res.RestartRequired = append(res.RestartRequired, key)
+		}
+	}
+	sort.Strings(res.Changed)
+	sort.Strings(res.RestartRequired)
+	if len(res.Changed) == 0 {
+		return nil
+	}
+
+	for key := range previous {
+		wanted[key].restore(key)
+	}
+	var applies []func()
+	var problems []string
+	for _, s := range r.subsystems {
+		if !s.touches(previous) {
+			continue
+		}
+		apply, err := s.Prepare()
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %v", s.Name, err))
+			continue
+		}
+		applies = append(applies, apply)
+		res.Applied = append(res.Applied, s.Name)
+	}
+	if len(problems) > 0 {
+		for key, prev := range previous {
+			prev.restore(key)
+		}
+		res.Changed, res.Applied = []string{}, []string{}
+		return fmt.Errorf("%w: %s", ErrInvalid, strings.Join(problems, "; "))
+	}
+	for _, apply := range applies {
+		apply()
+	}
+
+	for key := range previous {
+		if _, ok := r.base[key]; !ok {
+			r.base[key] = previous[key]
+		}
+		if value, ok := next[key]; ok {
+			r.values[key] = value
+		} else {
+			delete(r.values, key)
+			delete(r.base, key)
+		}
+	}
+	return nil
+}
+
+// touches reports whether any of the subsystem's keys is in changed.
+func (s Subsystem) touches(changed map[string]setting) bool {
+	for _, key := range s.Keys {
+		if _, ok := changed[key]; ok {
+			return true
+		}
+	}
+	return false
+}
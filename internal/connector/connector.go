@@ -0,0 +1,259 @@
+package connector
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/wakala/reconciler/internal/domain"
+	"github.com/wakala/reconciler/internal/ingestion"
+	"github.com/wakala/reconciler/internal/repository"
+)
+
+// ErrUnknownConnector is returned when pulling a connector that is not
+// registered with the Runner.
+var ErrUnknownConnector = errors.New("unknown connector")
+
+// Connector pulls settlement records directly from a processor API.
+type Connector interface {
+	// Name identifies the connector in the API and in saved state.
+	Name() string
+	Processor() domain.Processor
+	// Fetch returns every record changed since cursor, following pagination,
+	// along with the cursor to resume from next time. An empty cursor means
+	// a first run.
+	Fetch(ctx context.Context, cursor string) (*FetchResult, error)
+}
+
+// FetchResult is one incremental pull from a connector.
+type FetchResult struct {
+	Records []domain.SettlementRecord
+	Cursor  string
+	Pages   int
+}
+
+// PullResult summarises a Runner pull.
+type PullResult struct {
+	Connector      string                    `json:"connector"`
+	Pages          int                       `json:"pages"`
+	RecordsFetched int                       `json:"records_fetched"`
+	Cursor         string                    `json:"cursor"`
+	Reports        []*ingestion.IngestResult `json:"reports"`
+}
+
+// IntervalFromEnv reads CONNECTOR_POLL_INTERVAL (a Go duration, default 15m).
+func IntervalFromEnv() (time.Duration, error) {
+	v := os.Getenv("CONNECTOR_POLL_INTERVAL")
+	if v == "" {
+		return 15 * time.Minute, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("CONNECTOR_POLL_INTERVAL must be a positive duration, got %q", v)
+	}
+	return d, nil
+}
+
+// Runner pulls from registered connectors on a schedule and feeds the
+// records into ingestion, one report per batch per pull.
+type Runner struct {
+	ingestionSvc *ingestion.Service
+	repo         *repository.ConnectorRepo
+	connectors   map[string]Connector
+	names        []string
+
+	// mu keeps a scheduled pull and a manual one from racing on the cursor.
+	mu sync.Mutex
+
+	intervalMu sync.Mutex
+	interval   time.Duration
+	// reconfigured wakes Run to reschedule after SetInterval.
+	reconfigured chan struct{}
+}
+
+// NewRunner creates a runner for the given connectors.
+func NewRunner(
+	ingestionSvc *ingestion.Service,
+	repo *repository.ConnectorRepo,
+	interval time.Duration,
+	connectors ...Connector,
+) *Runner {
+	r := &Runner{
+		ingestionSvc: ingestionSvc,
+		repo:         repo,
+		interval:     interval,
+		connectors:   make(map[string]Connector),
+		reconfigured: make(chan struct{}, 1),
+	}
+	for _, c := range connectors {
+		r.connectors[c.Name()] = c
+		r.names = append(r.names, c.Name())
+	}
+	sort.Strings(r.names)
+	return r
+}
+
+// SetInterval changes the time between scheduled pulls. The next pull is
+// due one new interval after the last.
+func (r *Runner) SetInterval(d time.Duration) {
+	r.intervalMu.Lock()
+	r.interval = d
+	r.intervalMu.Unlock()
+	select {
+	case r.reconfigured <- struct{}{}:
+	default:
+	}
+}
+
+// Interval returns the time between scheduled pulls.
+func (r *Runner) Interval() time.Duration {
+	r.intervalMu.Lock()
+	defer r.intervalMu.Unlock()
+	return r.interval
+}
+
+// Names returns the registered connector names.
+func (r *Runner) Names() []string {
+	return r.names
+}
+
+// States returns the saved state of every registered connector. Connectors
+// that have never run are returned with an empty cursor.
+func (r *Runner) States() ([]domain.ConnectorState, error) {
+	states := make([]domain.ConnectorState, 0, len(r.names))
+	for _, name := range r.names {
+		st, err := r.state(r.connectors[name])
+		if err != nil {
+			return nil, err
+		}
+		states = append(states, *st)
+	}
+	return states, nil
+}
+
+func (r *Runner) state(c Connector) (*domain.ConnectorState, error) {
+	st, err := r.repo.Get(c.Name())
+	if errors.Is(err, sql.ErrNoRows) {
+		return &domain.ConnectorState{Name: c.Name(), Processor: c.Processor()}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("get state: %w", err)
+	}
+	return st, nil
+}
+
+// Pull fetches everything new from one connector and ingests it. The cursor
+// only advances once every batch has been stored, so a failed pull is
+// retried from the same point.
+func (r *Runner) Pull(ctx context.Context, name string) (*PullResult, error) {
+	c, ok := r.connectors[name]
+	if !ok {
+		return nil, ErrUnknownConnector
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	st, err := r.state(c)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().UTC()
+	st.LastRunAt = &now
+
+	result, err := r.pull(ctx, c, st.Cursor)
+	if err != nil {
+		st.LastError = err.Error()
+		if saveErr := r.repo.Save(st); saveErr != nil {
+			log.Printf("[connector] WARNING: save state for %s: %v", name, saveErr)
+		}
+		return nil, err
+	}
+
+	st.Cursor = result.Cursor
+	st.LastSuccessAt = &now
+	st.LastError = ""
+	st.RecordsPulled += result.RecordsFetched
+	if err := r.repo.Save(st); err != nil {
+		return nil, fmt.Errorf("save state: %w", err)
+	}
+	return result, nil
+}
+
+func (r *Runner) pull(ctx context.Context, c Connector, cursor string) (*PullResult, error) {
+	fetched, err := c.Fetch(ctx, cursor)
+	if err != nil {
+		return nil, fmt.Errorf("fetch: %w", err)
+	}
+
+	result := &PullResult{
+		Connector:      c.Name(),
+		Pages:          fetched.Pages,
+		RecordsFetched: len(fetched.Records),
+		Cursor:         fetched.Cursor,
+		Reports:        []*ingestion.IngestResult{},
+	}
+	if result.Cursor == "" {
+		result.Cursor = cursor
+	}
+
+	byBatch := make(map[string][]domain.SettlementRecord)
+	var batches []string
+	for _, rec := range fetched.Records {
+		if _, ok := byBatch[rec.BatchID]; !ok {
+			batches = append(batches, rec.BatchID)
+		}
+		byBatch[rec.BatchID] = append(byBatch[rec.BatchID], rec)
+	}
+	sort.Strings(batches)
+
+	for _, batchID := range batches {
+		res, err := r.ingestionSvc.IngestRecords(string(c.Processor()), batchID, byBatch[batchID])
+		if err != nil {
+			return nil, fmt.Errorf("ingest batch %s: %w", batchID, err)
+		}
+		result.Reports = append(result.Reports, res)
+	}
+
+	log.Printf("[connector] Pulled %d records in %d pages from %s (%d batches)",
+		result.RecordsFetched, result.Pages, c.Name(), len(batches))
+	return result, nil
+}
+
+// Run pulls from every connector immediately and then every interval until
+// ctx is cancelled. A new interval from SetInterval counts from the start
+// of the last pull.
+func (r *Runner) Run(ctx context.Context) {
+	interval := r.Interval()
+	log.Printf("[connector] Polling %v every %s", r.names, interval)
+
+	for {
+		started := time.Now()
+		for _, name := range r.names {
+			if _, err := r.Pull(ctx, name); err != nil {
+				log.Printf("[connector] WARNING: pull from %s failed: %v", name, err)
+			}
+		}
+
+		for due := false; !due; {
+			timer := time.NewTimer(time.Until(started.Add(interval)))
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return
+			case <-r.reconfigured:
+				timer.Stop()
+				interval = r.Interval()
+				log.Printf("[connector] Polling %v every %s", r.names, interval)
+			case <-timer.C:
+				due = true
+			}
+		}
+	}
+}
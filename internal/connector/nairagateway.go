@@ -0,0 +1,240 @@
+package connector
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/wakala/reconciler/internal/currency"
+	"github.com/wakala/reconciler/internal/domain"
+	"github.com/wakala/reconciler/internal/retry"
+)
+
+// maxPagesPerPull stops a misbehaving API from paginating forever.
+const maxPagesPerPull = 1000
+
+// NairaGatewayAPI pulls settlements from the NairaGateway REST API:
+//
+//	GET {base}/settlements?updated_since=<RFC3339>&page=<n>&per_page=<size>
+//	Authorization: Bearer <token>
+//
+// The cursor is the latest updated_at seen. updated_since is inclusive, so a
+// pull may return records already stored; ingestion dedupes them per batch.
+type NairaGatewayAPI struct {
+	baseURL  string
+	token    string
+	pageSize int
+	client   *http.Client
+	retry    *retry.Integration
+}
+
+type nairaGatewayPage struct {
+	Data []nairaGatewaySettlement `json:"data"`
+	Meta struct {
+		Page       int `json:"page"`
+		TotalPages int `json:"total_pages"`
+	} `json:"meta"`
+}
+
+type nairaGatewaySettlement struct {
+	Ref           string  `json:"ref"`
+	MerchantID    string  `json:"merchant_id"`
+	AmountNGN     float64 `json:"amount_ngn"`
+	ProcessingFee float64 `json:"processing_fee_ngn"`
+	PayoutNGN     float64 `json:"payout_ngn"`
+	SettledAt     string  `json:"settled_at"`
+	BatchID       string  `json:"batch_id"`
+	UpdatedAt     string  `json:"updated_at"`
+}
+
+// NewNairaGatewayFromEnv configures the connector from:
+//
+//	NAIRAGATEWAY_API_URL        base URL, e.g. https://api.nairagateway.com/v1
+//	NAIRAGATEWAY_API_TOKEN      bearer token (required)
+//	NAIRAGATEWAY_API_PAGE_SIZE  records per page (default 100)
+//
+// It returns nil, nil when NAIRAGATEWAY_API_URL is not set. Plain http is only
+// accepted for loopback hosts.
+func NewNairaGatewayFromEnv() (*NairaGatewayAPI, error) {
+	base := os.Getenv("NAIRAGATEWAY_API_URL")
+	if base == "" {
+		return nil, nil
+	}
+	u, err := url.Parse(base)
+	if err != nil {
+		return nil, fmt.Errorf("NAIRAGATEWAY_API_URL: %w", err)
+	}
+	if u.Scheme != "https" && !(u.Scheme == "http" && isLoopback(u.Hostname())) {
+		return nil, fmt.Errorf("NAIRAGATEWAY_API_URL must use https, got %q", base)
+	}
+
+	token := os.Getenv("NAIRAGATEWAY_API_TOKEN")
+	if token == "" {
+		return nil, fmt.Errorf("NAIRAGATEWAY_API_TOKEN is required when NAIRAGATEWAY_API_URL is set")
+	}
+
+	pageSize := 100
+	if v := os.Getenv("NAIRAGATEWAY_API_PAGE_SIZE"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("NAIRAGATEWAY_API_PAGE_SIZE must be a positive integer, got %q", v)
+		}
+		pageSize = n
+	}
+
+	return &NairaGatewayAPI{
+		baseURL:  strings.TrimRight(base, "/"),
+		token:    token,
+		pageSize: pageSize,
+		client:   &http.Client{Timeout: 30 * time.Second},
+		retry:    retry.For("nairagateway", retry.DefaultPolicy),
+	}, nil
+}
+
+func isLoopback(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+func (c *NairaGatewayAPI) Name() string { return "nairagateway" }
+
+func (c *NairaGatewayAPI) Processor() domain.Processor { return domain.ProcessorNairaGateway }
+
+func (c *NairaGatewayAPI) Fetch(ctx context.Context, cursor string) (*FetchResult, error) {
+	result := &FetchResult{Cursor: cursor}
+	var latest time.Time
+	if cursor != "" {
+		t, err := time.Parse(time.RFC3339, cursor)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cursor %q: %w", cursor, err)
+		}
+		latest = t
+	}
+
+	for page := 1; page <= maxPagesPerPull; page++ {
+		resp, err := c.fetchPage(ctx, cursor, page)
+		if err != nil {
+			return nil, fmt.Errorf("page %d: %w", page, err)
+		}
+		result.Pages++
+
+		for i, s := range resp.Data {
+			rec, err := normalizeNairaGateway(s)
+			if err != nil {
+				return nil, fmt.Errorf("page %d record %d: %w", page, i, err)
+			}
+			result.Records = append(result.Records, *rec)
+
+			if s.UpdatedAt != "" {
+				updated, err := time.Parse(time.RFC3339, s.UpdatedAt)
+				if err != nil {
+					return nil, fmt.Errorf("page %d record %d updated_at: %w", page, i, err)
+				}
+				if updated.After(latest) {
+					latest = updated
+				}
+			}
+		}
+
+		if len(resp.Data) == 0 || page >= resp.Meta.TotalPages {
+			break
+		}
+	}
+
+	if !latest.IsZero() {
+		result.Cursor = latest.UTC().Format(time.RFC3339)
+	}
+	return result, nil
+}
+
+// fetchPage requests one page, retrying failures under the "nairagateway"
+// retry policy.
+func (c *NairaGatewayAPI) fetchPage(ctx context.Context, since string, page int) (*nairaGatewayPage, error) {
+	var p *nairaGatewayPage
+	err := c.retry.Do(ctx, func(ctx context.Context) error {
+		var err error
+		p, err = c.getPage(ctx, since, page)
+		return err
+	})
+	return p, err
+}
+
+func (c *NairaGatewayAPI) getPage(ctx context.Context, since string, page int) (*nairaGatewayPage, error) {
+	q := url.Values{}
+	if since != "" {
+		q.Set("updated_since", since)
+	}
+	q.Set("page", strconv.Itoa(page))
+	q.Set("per_page", strconv.Itoa(c.pageSize))
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.baseURL+"/settlements?"+q.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		err := fmt.Errorf("status %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+		if !retry.RetryableStatus(resp.StatusCode) {
+			return nil, retry.Permanent(err)
+		}
+		return nil, err
+	}
+
+	var p nairaGatewayPage
+	if err := json.NewDecoder(resp.Body).Decode(&p); err != nil {
+		return nil, fmt.Errorf("decode: %w", err)
+	}
+	return &p, nil
+}
+
+// normalizeNairaGateway maps an API settlement onto a SettlementRecord the same
+// way the json_b file parser does.
+func normalizeNairaGateway(s nairaGatewaySettlement) (*domain.SettlementRecord, error) {
+	settledAt, err := time.Parse(time.RFC3339, s.SettledAt)
+	if err != nil {
+		return nil, fmt.Errorf("settled_at: %w", err)
+	}
+
+	usdGross, err := currency.ToUSD(s.AmountNGN, "NGN")
+	if err != nil {
+		return nil, fmt.Errorf("currency gross: %w", err)
+	}
+	usdNet, err := currency.ToUSD(s.PayoutNGN, "NGN")
+	if err != nil {
+		return nil, fmt.Errorf("currency net: %w", err)
+	}
+
+	return &domain.SettlementRecord{
+		ID:                     fmt.Sprintf("SR-NG-%s-%s-api", s.BatchID, s.Ref),
+		Processor:              domain.ProcessorNairaGateway,
+		ProcessorTransactionID: s.Ref,
+		GrossAmount:            s.AmountNGN,
+		FeeAmount:              s.ProcessingFee,
+		NetAmount:              s.PayoutNGN,
+		Currency:               "NGN",
+		USDGrossAmount:         usdGross,
+		USDNetAmount:           usdNet,
+		SettlementDate:         settledAt,
+		BatchID:                s.BatchID,
+	}, nil
+}
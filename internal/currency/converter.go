@@ -1,6 +1,14 @@
 package currency
 
-import "fmt"
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
 
 // ratesPerUSD maps currency codes to the number of local currency units per 1 USD.
 // These are approximate 2024 rates for African corridors.
@@ -37,3 +45,107 @@ func Rate(currency string) (float64, error) {
 	}
 	return rate, nil
 }
+
+// Codes returns the supported currency codes, sorted.
+func Codes() []string {
+	codes := make([]string, 0, len(ratesPerUSD))
+	for code := range ratesPerUSD {
+		codes = append(codes, code)
+	}
+	sort.Strings(codes)
+	return codes
+}
+
+// ratePoint is a historical rate effective from a given day.
+type ratePoint struct {
+	effective time.Time
+	rate      float64
+}
+
+// rateHistory holds optional historical rates per currency, sorted by
+// effective date. It is loaded once at startup.
+var rateHistory = map[string][]ratePoint{}
+
+// LoadRateHistory reads historical rates in CSV form:
+//
+//	date,currency,units_per_usd
+//	2023-07-01,KES,141.2
+//
+// Each rate applies from its date until the next entry for that currency.
+// Dates before the first entry fall back to the static rate.
+func LoadRateHistory(r io.Reader) (int, error) {
+	reader := csv.NewReader(r)
+	reader.TrimLeadingSpace = true
+
+	rows, err := reader.ReadAll()
+	if err != nil {
+		return 0, fmt.Errorf("read rate history: %w", err)
+	}
+
+	history := map[string][]ratePoint{}
+	count := 0
+	for i, row := range rows {
+		if i == 0 && len(row) > 0 && strings.EqualFold(strings.TrimSpace(row[0]), "date") {
+			continue
+		}
+		if len(row) < 3 {
+			return 0, fmt.Errorf("line %d: expected 3 columns, got %d", i+1, len(row))
+		}
+		day, err := time.Parse("2006-01-02", strings.TrimSpace(row[0]))
+		if err != nil {
+			return 0, fmt.Errorf("line %d date: %w", i+1, err)
+		}
+		cur := strings.ToUpper(strings.TrimSpace(row[1]))
+		if _, ok := ratesPerUSD[cur]; !ok {
+			return 0, fmt.Errorf("line %d: unsupported currency: %s", i+1, cur)
+		}
+		rate, err := strconv.ParseFloat(strings.TrimSpace(row[2]), 64)
+		if err != nil || rate <= 0 {
+			return 0, fmt.Errorf("line %d: invalid rate %q", i+1, row[2])
+		}
+		history[cur] = append(history[cur], ratePoint{effective: day, rate: rate})
+		count++
+	}
+
+	for cur := range history {
+		sort.Slice(history[cur], func(i, j int) bool {
+			return history[cur][i].effective.Before(history[cur][j].effective)
+		})
+	}
+	rateHistory = history
+	return count, nil
+}
+
+// RateAt returns the exchange rate (units per 1 USD) in effect at the given
+// time, falling back to the static rate when no history covers it.
+func RateAt(currency string, at time.Time) (float64, error) {
+	rate, _, err := RateEffectiveAt(currency, at)
+	return rate, err
+}
+
+// RateEffectiveAt is RateAt, with the day the rate took effect: the date of
+// its rate history entry, or the zero time for the static rate.
+func RateEffectiveAt(currency string, at time.Time) (float64, time.Time, error) {
+	rate, err := Rate(currency)
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	var from time.Time
+	for _, p := range rateHistory[currency] {
+		if p.effective.After(at) {
+			break
+		}
+		rate, from = p.rate, p.effective
+	}
+	return rate, from, nil
+}
+
+// ToUSDAt converts a local currency amount to USD at the rate in effect at
+// the given time.
+func ToUSDAt(amount float64, currency string, at time.Time) (float64, error) {
+	rate, err := RateAt(currency, at)
+	if err != nil {
+		return 0, err
+	}
+	return amount / rate, nil
+}
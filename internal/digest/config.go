@@ -0,0 +1,116 @@
+package digest
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config controls who receives the digest, how often, and in what form.
+type Config struct {
+	Recipients []string
+	// Schedule is "daily" or "weekly".
+	Schedule string
+	// Hour is the UTC hour of day at which the digest is sent.
+	Hour int
+	// Weekday is the day weekly digests are sent on.
+	Weekday time.Weekday
+	// HTML adds an HTML alternative to the plain-text body.
+	HTML bool
+	// AttachCSV attaches the top offenders as a CSV file.
+	AttachCSV bool
+}
+
+// ConfigFromEnv reads the digest configuration:
+//
+//	DIGEST_RECIPIENTS  comma-separated addresses (required; unset disables digests)
+//	DIGEST_SCHEDULE    daily | weekly (default daily)
+//	DIGEST_HOUR        0-23 UTC (default 7)
+//	DIGEST_WEEKDAY     e.g. monday (default monday; weekly only)
+//	DIGEST_HTML        true | false (default true)
+//	DIGEST_ATTACH_CSV  true | false (default false)
+//
+// It returns nil, nil when DIGEST_RECIPIENTS is not set.
+func ConfigFromEnv() (*Config, error) {
+	raw := os.Getenv("DIGEST_RECIPIENTS")
+	if raw == "" {
+		return nil, nil
+	}
+
+	cfg := &Config{
+		Schedule: "daily",
+		Hour:     7,
+		Weekday:  time.Monday,
+		HTML:     true,
+	}
+	for _, r := range strings.Split(raw, ",") {
+		if r = strings.TrimSpace(r); r != "" {
+			cfg.Recipients = append(cfg.Recipients, r)
+		}
+	}
+
+	if v := os.Getenv("DIGEST_SCHEDULE"); v != "" {
+		if v != "daily" && v != "weekly" {
+			return nil, fmt.Errorf("DIGEST_SCHEDULE must be daily or weekly, got %q", v)
+		}
+		cfg.Schedule = v
+	}
+	if v := os.Getenv("DIGEST_HOUR"); v != "" {
+		h, err := strconv.Atoi(v)
+		if err != nil || h < 0 || h > 23 {
+			return nil, fmt.Errorf("DIGEST_HOUR must be 0-23, got %q", v)
+		}
+		cfg.Hour = h
+	}
+	if v := os.Getenv("DIGEST_WEEKDAY"); v != "" {
+		wd, ok := parseWeekday(v)
+		if !ok {
+			return nil, fmt.Errorf("invalid DIGEST_WEEKDAY %q", v)
+		}
+		cfg.Weekday = wd
+	}
+	if v := os.Getenv("DIGEST_HTML"); v != "" {
+		cfg.HTML = v == "true"
+	}
+	if v := os.Getenv("DIGEST_ATTACH_CSV"); v != "" {
+		cfg.AttachCSV = v == "true"
+	}
+
+	return cfg, nil
+}
+
+func parseWeekday(s string) (time.Weekday, bool) {
+	for d := time.Sunday; d <= time.Saturday; d++ {
+		if strings.EqualFold(d.String(), s) {
+			return d, true
+		}
+	}
+	return 0, false
+}
+
+// period returns the length of time one digest covers.
+func (c *Config) period() time.Duration {
+	if c.Schedule == "weekly" {
+		return 7 * 24 * time.Hour
+	}
+	return 24 * time.Hour
+}
+
+// nextRun returns the first scheduled send time strictly after now.
+func (c *Config) nextRun(now time.Time) time.Time {
+	now = now.UTC()
+	next := time.Date(now.Year(), now.Month(), now.Day(), c.Hour, 0, 0, 0, time.UTC)
+	if c.Schedule == "weekly" {
+		next = next.AddDate(0, 0, (int(c.Weekday)-int(next.Weekday())+7)%7)
+	}
+	for !next.After(now) {
+		if c.Schedule == "weekly" {
+			next = next.AddDate(0, 0, 7)
+		} else {
+			next = next.AddDate(0, 0, 1)
+		}
+	}
+	return next
+}
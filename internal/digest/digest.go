@@ -0,0 +1,308 @@
+package digest
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"fmt"
+	htmltemplate "html/template"
+	"log"
+	"math"
+	"sort"
+	"strconv"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/wakala/reconciler/internal/domain"
+	"github.com/wakala/reconciler/internal/notify"
+	"github.com/wakala/reconciler/internal/repository"
+)
+
+// topOffenderCount is how many discrepancies the digest lists by impact.
+const topOffenderCount = 10
+
+// Digest is the summary sent to finance, built from the dashboard queries.
+type Digest struct {
+	Schedule        string
+	PeriodStart     time.Time
+	PeriodEnd       time.Time
+	ReportsInPeriod int
+	MatchedRecords  int
+	TotalRecords    int
+	MatchRatePct    float64
+	PendingCount    int
+	UnsettledUSD    float64
+	OpenTotal       int
+	OpenImpactUSD   float64
+	BySeverity      []SeverityCount
+	ByProcessor     []repository.ProcessorDiscrepancyStat
+	TopOffenders    []domain.Discrepancy
+}
+
+// SeverityCount is one row of the open-discrepancies-by-severity table.
+type SeverityCount struct {
+	Severity string
+	Count    int
+}
+
+// Service builds and emails digests on a schedule.
+type Service struct {
+	txnRepo  *repository.TransactionRepo
+	settRepo *repository.SettlementRepo
+	discRepo *repository.DiscrepancyRepo
+
+	mu     sync.Mutex
+	mailer *notify.Mailer
+	cfg    *Config
+	// reconfigured wakes Run to reschedule after Reconfigure.
+	reconfigured chan struct{}
+}
+
+// NewService creates a new digest service.
+func NewService(
+	txnRepo *repository.TransactionRepo,
+	settRepo *repository.SettlementRepo,
+	discRepo *repository.DiscrepancyRepo,
+	mailer *notify.Mailer,
+	cfg *Config,
+) *Service {
+	return &Service{
+		txnRepo:      txnRepo,
+		settRepo:     settRepo,
+		discRepo:     discRepo,
+		mailer:       mailer,
+		cfg:          cfg,
+		reconfigured: make(chan struct{}, 1),
+	}
+}
+
+// Reconfigure replaces the mailer and the configuration. A digest being
+// sent finishes under the old ones; the next is scheduled under the new.
+func (s *Service) Reconfigure(mailer *notify.Mailer, cfg *Config) {
+	s.mu.Lock()
+	s.mailer, s.cfg = mailer, cfg
+	s.mu.Unlock()
+	select {
+	case s.reconfigured <- struct{}{}:
+	default:
+	}
+}
+
+func (s *Service) settings() (*notify.Mailer, *Config) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.mailer, s.cfg
+}
+
+// Build assembles a digest for the period ending at end.
+func (s *Service) Build(end time.Time) (*Digest, error) {
+	_, cfg := s.settings()
+	return s.build(cfg, end)
+}
+
+func (s *Service) build(cfg *Config, end time.Time) (*Digest, error) {
+	start := end.Add(-cfg.period())
+	d := &Digest{
+		Schedule:    cfg.Schedule,
+		PeriodStart: start,
+		PeriodEnd:   end,
+	}
+
+	var err error
+	if d.ReportsInPeriod, err = s.settRepo.CountReportsSince(start); err != nil {
+		return nil, fmt.Errorf("count reports: %w", err)
+	}
+	if d.MatchedRecords, d.TotalRecords, err = s.settRepo.CountMatchedBetween(start, end); err != nil {
+		return nil, fmt.Errorf("count matched: %w", err)
+	}
+	if d.TotalRecords > 0 {
+		d.MatchRatePct = math.Round(float64(d.MatchedRecords)/float64(d.TotalRecords)*1000) / 10
+	}
+
+	stats, err := s.txnRepo.GetDashboardStats(repository.DashboardScope{})
+	if err != nil {
+		return nil, fmt.Errorf("dashboard stats: %w", err)
+	}
+	d.PendingCount = stats.PendingSettlement
+	d.UnsettledUSD = roundUSD(stats.UnsettledUSD)
+
+	summary, err := s.discRepo.GetSummary(repository.DashboardScope{})
+	if err != nil {
+		return nil, fmt.Errorf("discrepancy summary: %w", err)
+	}
+	d.OpenTotal = summary.TotalCount
+	d.OpenImpactUSD = roundUSD(summary.TotalImpact)
+	for _, sev := range []domain.Severity{
+		domain.SeverityCritical, domain.SeverityHigh, domain.SeverityMedium, domain.SeverityLow,
+	} {
+		d.BySeverity = append(d.BySeverity, SeverityCount{
+			Severity: string(sev),
+			Count:    summary.BySeverity[string(sev)],
+		})
+	}
+
+	if d.ByProcessor, err = s.discRepo.GetStatsByProcessor(repository.DashboardScope{}); err != nil {
+		return nil, fmt.Errorf("processor stats: %w", err)
+	}
+	sort.Slice(d.ByProcessor, func(i, j int) bool {
+		return d.ByProcessor[i].ImpactUSD > d.ByProcessor[j].ImpactUSD
+	})
+	for i := range d.ByProcessor {
+		d.ByProcessor[i].ImpactUSD = roundUSD(d.ByProcessor[i].ImpactUSD)
+	}
+
+	if d.TopOffenders, err = s.discRepo.TopByImpact(topOffenderCount); err != nil {
+		return nil, fmt.Errorf("top offenders: %w", err)
+	}
+
+	return d, nil
+}
+
+// Send builds the digest for the period ending at end and emails it.
+func (s *Service) Send(end time.Time) error {
+	mailer, cfg := s.settings()
+	d, err := s.build(cfg, end)
+	if err != nil {
+		return err
+	}
+
+	text, err := renderText(d)
+	if err != nil {
+		return fmt.Errorf("render text: %w", err)
+	}
+	var html string
+	if cfg.HTML {
+		if html, err = renderHTML(d); err != nil {
+			return fmt.Errorf("render html: %w", err)
+		}
+	}
+	var attachments []notify.Attachment
+	if cfg.AttachCSV {
+		data, err := renderCSV(d)
+		if err != nil {
+			return fmt.Errorf("render csv: %w", err)
+		}
+		attachments = append(attachments, notify.Attachment{
+			Filename:    fmt.Sprintf("wakala-top-offenders-%s.csv", end.Format("2006-01-02")),
+			ContentType: "text/csv; charset=utf-8",
+			Data:        data,
+		})
+	}
+
+	subject := fmt.Sprintf("Wakala reconciliation %s digest — %s", d.Schedule, end.Format("2006-01-02"))
+	if err := mailer.Send(cfg.Recipients, subject, text, html, attachments); err != nil {
+		return err
+	}
+
+	log.Printf("[digest] Sent %s digest to %d recipients", d.Schedule, len(cfg.Recipients))
+	return nil
+}
+
+// Run sends digests on the configured schedule until ctx is cancelled.
+func (s *Service) Run(ctx context.Context) {
+	for {
+		_, cfg := s.settings()
+		next := cfg.nextRun(time.Now())
+		log.Printf("[digest] Next %s digest at %s", cfg.Schedule, next.Format(time.RFC3339))
+
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-s.reconfigured:
+			timer.Stop()
+			continue
+		case <-timer.C:
+		}
+
+		if err := s.Send(next); err != nil {
+			log.Printf("[digest] WARNING: failed to send digest: %v", err)
+		}
+	}
+}
+
+// --- rendering ---
+
+var textTmpl = template.Must(template.New("text").Parse(`Wakala reconciliation {{.Schedule}} digest
+Period: {{.PeriodStart.Format "2006-01-02 15:04"}} to {{.PeriodEnd.Format "2006-01-02 15:04"}} UTC
+
+Reports ingested in period: {{.ReportsInPeriod}}
+Match rate: {{.MatchRatePct}}% ({{.MatchedRecords}} of {{.TotalRecords}} settlement records ingested in the period)
+Pending settlement: {{.PendingCount}} transactions ({{printf "%.2f" .UnsettledUSD}} USD)
+
+Open discrepancies: {{.OpenTotal}} ({{printf "%.2f" .OpenImpactUSD}} USD impact)
+{{range .BySeverity}}  {{printf "%-9s" .Severity}} {{.Count}}
+{{end}}
+By processor:
+{{range .ByProcessor}}  {{printf "%-13s" .Processor}} {{.DiscrepancyCount}} discrepancies, {{printf "%.2f" .ImpactUSD}} USD
+{{end}}
+Top offenders by impact:
+{{range .TopOffenders}}  {{printf "%-20s" .Type}} {{printf "%10.2f" .DifferenceUSD}} USD  {{.Severity}}  {{.Description}}
+{{end}}`))
+
+var htmlTmpl = htmltemplate.Must(htmltemplate.New("html").Parse(`<html><body style="font-family: sans-serif">
+<h2>Wakala reconciliation {{.Schedule}} digest</h2>
+<p>Period: {{.PeriodStart.Format "2006-01-02 15:04"}} to {{.PeriodEnd.Format "2006-01-02 15:04"}} UTC</p>
+<p>Reports ingested in period: <b>{{.ReportsInPeriod}}</b><br>
+Match rate: <b>{{.MatchRatePct}}%</b> ({{.MatchedRecords}} of {{.TotalRecords}} settlement records ingested in the period)<br>
+Pending settlement: <b>{{.PendingCount}}</b> transactions ({{printf "%.2f" .UnsettledUSD}} USD)</p>
+<h3>Open discrepancies: {{.OpenTotal}} ({{printf "%.2f" .OpenImpactUSD}} USD)</h3>
+<table border="1" cellpadding="4" cellspacing="0">
+<tr><th>Severity</th><th>Count</th></tr>
+{{range .BySeverity}}<tr><td>{{.Severity}}</td><td>{{.Count}}</td></tr>
+{{end}}</table>
+<h3>By processor</h3>
+<table border="1" cellpadding="4" cellspacing="0">
+<tr><th>Processor</th><th>Discrepancies</th><th>Impact USD</th></tr>
+{{range .ByProcessor}}<tr><td>{{.Processor}}</td><td>{{.DiscrepancyCount}}</td><td>{{printf "%.2f" .ImpactUSD}}</td></tr>
+{{end}}</table>
+<h3>Top offenders by impact</h3>
+<table border="1" cellpadding="4" cellspacing="0">
+<tr><th>Type</th><th>Processor</th><th>Difference USD</th><th>Severity</th><th>Description</th></tr>
+{{range .TopOffenders}}<tr><td>{{.Type}}</td><td>{{.Processor}}</td><td>{{printf "%.2f" .DifferenceUSD}}</td><td>{{.Severity}}</td><td>{{.Description}}</td></tr>
+{{end}}</table>
+</body></html>`))
+
+func renderText(d *Digest) (string, error) {
+	var buf bytes.Buffer
+	err := textTmpl.Execute(&buf, d)
+	return buf.String(), err
+}
+
+func renderHTML(d *Digest) (string, error) {
+	var buf bytes.Buffer
+	err := htmlTmpl.Execute(&buf, d)
+	return buf.String(), err
+}
+
+func renderCSV(d *Digest) ([]byte, error) {
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	if err := w.Write([]string{
+		"id", "type", "processor", "transaction_id", "settlement_id",
+		"difference_usd", "severity", "description", "ticket_system", "ticket_id", "ticket_url",
+	}); err != nil {
+		return nil, err
+	}
+	for _, disc := range d.TopOffenders {
+		var ticket domain.ExternalTicket
+		if disc.Ticket != nil {
+			ticket = *disc.Ticket
+		}
+		if err := w.Write([]string{
+			disc.ID, string(disc.Type), string(disc.Processor), disc.TransactionID,
+			disc.SettlementID, strconv.FormatFloat(roundUSD(disc.DifferenceUSD), 'f', 2, 64),
+			string(disc.Severity), disc.Description, ticket.System, ticket.TicketID, ticket.URL,
+		}); err != nil {
+			return nil, err
+		}
+	}
+	w.Flush()
+	return buf.Bytes(), w.Error()
+}
+
+func roundUSD(v float64) float64 {
+	return math.Round(v*100) / 100
+}
@@ -0,0 +1,40 @@
+package domain
+
+import "time"
+
+type AlertType string
+
+const (
+	AlertBatchGap AlertType = "BATCH_GAP"
+	// AlertVolumeDrop: a processor's daily settled volume fell well below
+	// its trailing average.
+	AlertVolumeDrop AlertType = "SETTLED_VOLUME_DROP"
+	// AlertOrphanRate: too many of a processor's recent settlement records
+	// match no transaction.
+	AlertOrphanRate AlertType = "ORPHAN_RATE"
+	// AlertReportVerification: a report file was rejected because it did not
+	// match its checksum or signature file, or came without one.
+	AlertReportVerification AlertType = "REPORT_VERIFICATION_FAILED"
+	// AlertControlTotalMismatch: the records parsed from a report do not add
+	// up to the totals its footer declares.
+	AlertControlTotalMismatch AlertType = "CONTROL_TOTAL_MISMATCH"
+	// AlertNegativeBalance: a batch's refunds exceeded its sales and the
+	// processor carries a negative balance that later payouts must clear.
+	AlertNegativeBalance AlertType = "NEGATIVE_BALANCE"
+	// AlertBalanceOverDeducted: a batch deducted more for a carried balance
+	// than the processor was owed.
+	AlertBalanceOverDeducted AlertType = "BALANCE_OVER_DEDUCTED"
+)
+
+// Alert is an operational problem that is not tied to a single transaction
+// or settlement record, such as a missing processor file.
+type Alert struct {
+	ID         string     `json:"id"`
+	Type       AlertType  `json:"type"`
+	Processor  Processor  `json:"processor"`
+	Severity   Severity   `json:"severity"`
+	Reference  string     `json:"reference"`
+	Message    string     `json:"message"`
+	CreatedAt  time.Time  `json:"created_at"`
+	ResolvedAt *time.Time `json:"resolved_at,omitempty"`
+}
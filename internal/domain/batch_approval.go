@@ -0,0 +1,34 @@
+package domain
+
+import "time"
+
+// BatchApprovalStatus is where a batch is in its settlement approval.
+type BatchApprovalStatus string
+
+const (
+	// BatchApprovalPending holds the batch's matched transactions in
+	// StatusPendingConfirmation.
+	BatchApprovalPending BatchApprovalStatus = "pending"
+	// BatchApprovalApproved settles them, and any matched later.
+	BatchApprovalApproved BatchApprovalStatus = "approved"
+)
+
+// BatchApproval is the approval a settlement batch needs before the
+// transactions its records match are marked settled. It is requested when a
+// match finds the batch at or over its processor's approval threshold.
+type BatchApproval struct {
+	Processor Processor           `json:"processor"`
+	BatchID   string              `json:"batch_id"`
+	Status    BatchApprovalStatus `json:"status"`
+	// RecordCount and USDGrossAmount are the batch's totals when a match
+	// last found it pending.
+	RecordCount    int       `json:"record_count"`
+	USDGrossAmount float64   `json:"usd_gross_amount"`
+	RequestedAt    time.Time `json:"requested_at"`
+	// PendingTransactions is how many of its transactions wait for the
+	// approval.
+	PendingTransactions int        `json:"pending_transactions"`
+	ApprovedBy          string     `json:"approved_by,omitempty"`
+	ApprovedAt          *time.Time `json:"approved_at,omitempty"`
+	Note                string     `json:"note,omitempty"`
+}
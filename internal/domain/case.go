@@ -0,0 +1,37 @@
+package domain
+
+import "time"
+
+// CaseStatus is whether a case is still being worked.
+type CaseStatus string
+
+const (
+	CaseOpen     CaseStatus = "open"
+	CaseResolved CaseStatus = "resolved"
+)
+
+// DiscrepancyCase groups discrepancies with one underlying cause, such as a
+// bad batch, so they are investigated and resolved together. Members are
+// keyed by their deterministic IDs, like tags, so a case outlives
+// reconciliation re-runs.
+type DiscrepancyCase struct {
+	ID    string `json:"id"`
+	Title string `json:"title"`
+	// GroupKey is what the members of a case the reconciler opened share,
+	// such as "batch:afripay:KE-BATCH-001". It is empty on cases opened by
+	// hand.
+	GroupKey  string     `json:"group_key,omitempty"`
+	Status    CaseStatus `json:"status"`
+	CreatedBy string     `json:"created_by"`
+	CreatedAt time.Time  `json:"created_at"`
+
+	ResolvedBy string     `json:"resolved_by,omitempty"`
+	ResolvedAt *time.Time `json:"resolved_at,omitempty"`
+	Note       string     `json:"note,omitempty"`
+
+	// Members counts every discrepancy in the case, Current those still
+	// raised, and ImpactUSD is the absolute difference of the current ones.
+	Members   int     `json:"members"`
+	Current   int     `json:"current"`
+	ImpactUSD float64 `json:"impact_usd"`
+}
@@ -0,0 +1,63 @@
+package domain
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"time"
+)
+
+// BatchCertificate is a statement of how one settlement batch reconciled,
+// produced for month-end close. ContentHash covers the figures only, so a
+// sign-off approves exactly those figures.
+type BatchCertificate struct {
+	ID string `json:"id"`
+	CertificateContent
+	ContentHash string              `json:"content_hash"`
+	GeneratedBy string              `json:"generated_by"`
+	GeneratedAt time.Time           `json:"generated_at"`
+	SignOff     *CertificateSignOff `json:"sign_off,omitempty"`
+}
+
+// CertificateContent is the reconciled state of a batch at one point in
+// time. Every settlement record is exactly one of matched, an exception, or
+// unreconciled.
+type CertificateContent struct {
+	Processor Processor           `json:"processor"`
+	BatchID   string              `json:"batch_id"`
+	Reports   []CertificateReport `json:"reports"`
+	// Records is the number of settlement records in the batch.
+	Records int `json:"records"`
+	// Matched records belong to a transaction and have no discrepancy.
+	Matched int `json:"matched"`
+	// Exceptions are records with an open discrepancy.
+	Exceptions       int                     `json:"exceptions"`
+	ExceptionsByType map[DiscrepancyType]int `json:"exceptions_by_type"`
+	// Unreconciled records have not been through a reconciliation run yet.
+	Unreconciled       int     `json:"unreconciled"`
+	USDGrossAmount     float64 `json:"usd_gross_amount"`
+	USDNetAmount       float64 `json:"usd_net_amount"`
+	ExceptionImpactUSD float64 `json:"exception_impact_usd"`
+}
+
+// CertificateReport identifies one file the batch was delivered in.
+type CertificateReport struct {
+	ID          string `json:"id"`
+	FileHash    string `json:"file_hash"`
+	RecordCount int    `json:"record_count"`
+}
+
+// CertificateSignOff records who approved a certificate.
+type CertificateSignOff struct {
+	UserID   string    `json:"user_id"`
+	Comment  string    `json:"comment,omitempty"`
+	SignedAt time.Time `json:"signed_at"`
+}
+
+// Hash returns the hex SHA-256 of the content's JSON encoding. Map keys are
+// encoded sorted, so equal content always hashes the same.
+func (c CertificateContent) Hash() string {
+	data, _ := json.Marshal(c)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,21 @@
+package domain
+
+import "time"
+
+// ConfigBundleVersion is the version of the ConfigBundle format. Bundles of
+// another version are not imported.
+const ConfigBundleVersion = 1
+
+// ConfigBundle is the configuration that moves between environments, such
+// as from staging to production, as one document. Settings are the
+// configuration file settings by key; the rest is the configuration stored
+// in the database. Recipients, addresses and secrets differ between
+// environments and are never part of a bundle.
+type ConfigBundle struct {
+	Version            int                 `json:"version"`
+	ExportedAt         time.Time           `json:"exported_at"`
+	Settings           map[string]string   `json:"settings"`
+	MerchantTolerances []MerchantTolerance `json:"merchant_tolerances"`
+	RuleFlags          []RuleFlag          `json:"rule_flags"`
+	TransformScripts   []TransformScript   `json:"transform_scripts"`
+}
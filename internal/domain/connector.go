@@ -0,0 +1,15 @@
+package domain
+
+import "time"
+
+// ConnectorState is the persisted progress of a processor API connector.
+// Cursor is opaque to everything but the connector that issued it.
+type ConnectorState struct {
+	Name          string     `json:"name"`
+	Processor     Processor  `json:"processor"`
+	Cursor        string     `json:"cursor"`
+	LastRunAt     *time.Time `json:"last_run_at,omitempty"`
+	LastSuccessAt *time.Time `json:"last_success_at,omitempty"`
+	LastError     string     `json:"last_error,omitempty"`
+	RecordsPulled int        `json:"records_pulled"`
+}
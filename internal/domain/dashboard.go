@@ -0,0 +1,112 @@
+package domain
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// MaxViewDays is the longest trailing window a dashboard view may cover.
+const MaxViewDays = 366
+
+// DashboardView is a named dashboard configuration stored for a single user:
+// the processors, currencies and merchant whose figures it shows and the
+// dates of the transactions it counts. Empty fields do not narrow the
+// dashboard. A user's default view applies whenever they open the dashboard
+// without picking one, so treasury and merchant operations each land on
+// their own slice.
+type DashboardView struct {
+	ID         string   `json:"id"`
+	UserID     string   `json:"user_id"`
+	Name       string   `json:"name"`
+	Processors []string `json:"processors"`
+	Currencies []string `json:"currencies"`
+	MerchantID string   `json:"merchant_id,omitempty"`
+	// From and To are inclusive YYYY-MM-DD dates. LastDays is instead a
+	// window ending today, e.g. 7 for the last week; a view has one or the
+	// other.
+	From      string    `json:"from,omitempty"`
+	To        string    `json:"to,omitempty"`
+	LastDays  int       `json:"last_days,omitempty"`
+	Default   bool      `json:"default"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// Normalize trims the view's fields, lowercases processors and uppercases
+// currencies, dropping empty and repeated entries.
+func (v *DashboardView) Normalize() {
+	v.Name = strings.TrimSpace(v.Name)
+	v.MerchantID = strings.TrimSpace(v.MerchantID)
+	v.From = strings.TrimSpace(v.From)
+	v.To = strings.TrimSpace(v.To)
+	v.Processors = normalizeList(v.Processors, strings.ToLower)
+	v.Currencies = normalizeList(v.Currencies, strings.ToUpper)
+}
+
+func normalizeList(values []string, fold func(string) string) []string {
+	out := []string{}
+	seen := make(map[string]bool, len(values))
+	for _, s := range values {
+		s = fold(strings.TrimSpace(s))
+		if s == "" || seen[s] {
+			continue
+		}
+		seen[s] = true
+		out = append(out, s)
+	}
+	return out
+}
+
+// Validate checks a normalized view.
+func (v *DashboardView) Validate() error {
+	if v.Name == "" {
+		return errors.New("name is required")
+	}
+	for _, c := range v.Currencies {
+		if len(c) != 3 {
+			return fmt.Errorf("currency %q must be a 3-letter code", c)
+		}
+	}
+	if v.LastDays != 0 && (v.From != "" || v.To != "") {
+		return errors.New("set either last_days or from/to, not both")
+	}
+	if v.LastDays < 0 || v.LastDays > MaxViewDays {
+		return fmt.Errorf("last_days must be between 1 and %d", MaxViewDays)
+	}
+	var from, to time.Time
+	var err error
+	if v.From != "" {
+		if from, err = time.Parse("2006-01-02", v.From); err != nil {
+			return errors.New("from must be YYYY-MM-DD")
+		}
+	}
+	if v.To != "" {
+		if to, err = time.Parse("2006-01-02", v.To); err != nil {
+			return errors.New("to must be YYYY-MM-DD")
+		}
+	}
+	if v.From != "" && v.To != "" && to.Before(from) {
+		return errors.New("to must not be before from")
+	}
+	return nil
+}
+
+// Range returns the view's dates as of now: the first day it covers and the
+// day after the last, either of which is nil when unbounded.
+func (v *DashboardView) Range(now time.Time) (from, to *time.Time) {
+	if v.LastDays > 0 {
+		end := now.UTC().Truncate(24*time.Hour).AddDate(0, 0, 1)
+		start := end.AddDate(0, 0, -v.LastDays)
+		return &start, &end
+	}
+	if t, err := time.Parse("2006-01-02", v.From); err == nil {
+		from = &t
+	}
+	if t, err := time.Parse("2006-01-02", v.To); err == nil {
+		end := t.AddDate(0, 0, 1)
+		to = &end
+	}
+	return from, to
+}
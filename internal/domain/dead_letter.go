@@ -0,0 +1,33 @@
+package domain
+
+import "time"
+
+type DeadLetterStatus string
+
+const (
+	DeadLetterOpen      DeadLetterStatus = "open"
+	DeadLetterRetried   DeadLetterStatus = "retried"
+	DeadLetterDiscarded DeadLetterStatus = "discarded"
+)
+
+// DeadLetter is a queued ingestion job that failed its last attempt. The
+// file it was submitted with is kept, under its SHA-256, until the dead
+// letter is retried or discarded. ID is the failed job's ID.
+type DeadLetter struct {
+	ID          string            `json:"id"`
+	Processor   Processor         `json:"processor"`
+	Format      string            `json:"format"`
+	Backfill    bool              `json:"backfill,omitempty"`
+	File        ReportFile        `json:"file"`
+	Sidecars    []ReportFile      `json:"sidecars,omitempty"`
+	Provenance  *ReportProvenance `json:"provenance,omitempty"`
+	Error       string            `json:"error"`
+	Attempts    int               `json:"attempts"`
+	SubmittedAt time.Time         `json:"submitted_at"`
+	FailedAt    time.Time         `json:"failed_at"`
+	Status      DeadLetterStatus  `json:"status"`
+	ResolvedAt  *time.Time        `json:"resolved_at,omitempty"`
+	ResolvedBy  string            `json:"resolved_by,omitempty"`
+	// RetryJobID is the job a retried dead letter was queued as.
+	RetryJobID string `json:"retry_job_id,omitempty"`
+}
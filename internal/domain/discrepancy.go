@@ -8,6 +8,10 @@ const (
 	DiscrepancyMissingSettlement DiscrepancyType = "MISSING_SETTLEMENT"
 	DiscrepancyAmountMismatch    DiscrepancyType = "AMOUNT_MISMATCH"
 	DiscrepancyOrphaned          DiscrepancyType = "ORPHANED_SETTLEMENT"
+	// DiscrepancyMissingPayout is a payout instruction with no disbursement.
+	DiscrepancyMissingPayout DiscrepancyType = "MISSING_PAYOUT"
+	// DiscrepancyOverpaid is a disbursement larger than its instruction.
+	DiscrepancyOverpaid DiscrepancyType = "OVERPAID"
 )
 
 type Severity string
@@ -32,4 +36,145 @@ type Discrepancy struct {
 	Severity      Severity        `json:"severity"`
 	Description   string          `json:"description"`
 	DetectedAt    time.Time       `json:"detected_at"`
+	// MerchantID and BatchID are copied from the transaction and settlement
+	// record at detection time, where there is one.
+	MerchantID string   `json:"merchant_id,omitempty"`
+	BatchID    string   `json:"batch_id,omitempty"`
+	Tags       []string `json:"tags,omitempty"`
+	// Policy is the rule set the discrepancy was detected under. It is only
+	// loaded by the detail endpoint.
+	Policy *ReconciliationPolicy `json:"policy,omitempty"`
+	// ProbableCause is set on an amount mismatch whose difference the
+	// records around it explain.
+	ProbableCause *ProbableCause `json:"probable_cause,omitempty"`
+	// Assignment is set once a routing rule has assigned the discrepancy.
+	Assignment *DiscrepancyAssignment `json:"assignment,omitempty"`
+	// Ticket is set once the discrepancy is linked to a ticket in an
+	// external tracker.
+	Ticket *ExternalTicket `json:"ticket,omitempty"`
+	// Resolution is set while the discrepancy is marked resolved in an
+	// external workflow, such as its Jira issue.
+	Resolution *DiscrepancyResolution `json:"resolution,omitempty"`
+	// CaseID is the case the discrepancy is grouped in, if any.
+	CaseID string `json:"case_id,omitempty"`
+}
+
+// DiscrepancyResolution records a discrepancy resolved outside the
+// reconciler, for instance a dispute closed in Jira. The records still
+// disagree, so the discrepancy is still raised; the resolution, keyed by its
+// deterministic ID like tags, says nobody needs to work on it.
+type DiscrepancyResolution struct {
+	// Source is the system it was resolved in, and Reference what there,
+	// such as the issue key.
+	Source     string    `json:"source"`
+	Reference  string    `json:"reference,omitempty"`
+	Status     string    `json:"status,omitempty"`
+	ResolvedBy string    `json:"resolved_by"`
+	ResolvedAt time.Time `json:"resolved_at"`
+}
+
+// ExternalTicket links a discrepancy to the ticket tracking it in another
+// system, such as a Jira issue or a Zendesk ticket opened for a processor
+// dispute. It is keyed by the discrepancy's deterministic ID, like tags, so
+// the link survives reconciliation re-runs.
+type ExternalTicket struct {
+	System   string    `json:"system"`
+	TicketID string    `json:"ticket_id"`
+	URL      string    `json:"url,omitempty"`
+	LinkedBy string    `json:"linked_by"`
+	LinkedAt time.Time `json:"linked_at"`
+}
+
+// Ref is the ticket as system:ticket_id, as the activity log records it.
+func (t *ExternalTicket) Ref() string {
+	return t.System + ":" + t.TicketID
+}
+
+// CauseKind is a known reason for an amount mismatch.
+type CauseKind string
+
+const (
+	// CauseFeeDeducted is a gross amount reported net of the record's own
+	// processing fee.
+	CauseFeeDeducted CauseKind = "FEE_DEDUCTED"
+	// CauseFeeRate is a difference equal to the processor's usual fee rate.
+	CauseFeeRate CauseKind = "FEE_RATE"
+	// CauseFXRate is the same local amount converted to USD at a different
+	// rate.
+	CauseFXRate CauseKind = "FX_RATE"
+	// CauseRefundOffset is a difference equal to a refund the processor
+	// reported against the payment or in its batch.
+	CauseRefundOffset CauseKind = "REFUND_OFFSET"
+)
+
+// ProbableCause is the likeliest explanation found for a mismatch.
+type ProbableCause struct {
+	Cause  CauseKind `json:"cause"`
+	Detail string    `json:"detail"`
+}
+
+// CauseCheck is one explanation considered for a mismatch and whether the
+// amounts fit it.
+type CauseCheck struct {
+	ProbableCause
+	Fits bool `json:"fits"`
+}
+
+// ReconciliationPolicy records the rules in force when a discrepancy was
+// detected, so it can still be explained after tolerances change. Version
+// identifies the exact combination of values.
+type ReconciliationPolicy struct {
+	Version                 string  `json:"version"`
+	MismatchPctTolerance    float64 `json:"mismatch_pct_tolerance"`
+	MismatchAbsToleranceUSD float64 `json:"mismatch_abs_tolerance_usd"`
+	MerchantOverride        bool    `json:"merchant_override"`
+	SettlementWindowHours   int     `json:"settlement_window_hours"`
+	FeeScheduleVersion      string  `json:"fee_schedule_version,omitempty"`
+}
+
+// ActivityAction is what a discrepancy activity entry records.
+type ActivityAction string
+
+const (
+	// ActivitySeverityChanged is a severity regraded under new rules.
+	ActivitySeverityChanged ActivityAction = "severity_changed"
+	// ActivityAssigned is a new discrepancy routed to a team or user.
+	ActivityAssigned ActivityAction = "assigned"
+	// ActivityTicketLinked is an external ticket linked, or relinked.
+	ActivityTicketLinked ActivityAction = "ticket_linked"
+	// ActivityTicketUnlinked is an external ticket link removed.
+	ActivityTicketUnlinked ActivityAction = "ticket_unlinked"
+	// ActivityResolved is a discrepancy marked resolved in an external
+	// workflow.
+	ActivityResolved ActivityAction = "resolved"
+	// ActivityReopened is that resolution withdrawn.
+	ActivityReopened ActivityAction = "reopened"
+	// ActivityCaseAdded is a discrepancy grouped into a case, or moved to
+	// another.
+	ActivityCaseAdded ActivityAction = "case_added"
+	// ActivityCaseRemoved is a discrepancy taken out of its case.
+	ActivityCaseRemoved ActivityAction = "case_removed"
+)
+
+// DiscrepancyActivity is one entry in a discrepancy's activity log. Entries
+// are keyed by the discrepancy's deterministic ID, like tags, so the log
+// outlives reconciliation re-runs.
+type DiscrepancyActivity struct {
+	ID            int64          `json:"id"`
+	DiscrepancyID string         `json:"discrepancy_id"`
+	At            time.Time      `json:"at"`
+	Actor         string         `json:"actor"`
+	Action        ActivityAction `json:"action"`
+	From          string         `json:"from,omitempty"`
+	To            string         `json:"to,omitempty"`
+}
+
+// SavedFilter is a named set of discrepancy list query parameters stored for
+// a single user, so long-running investigations can be reopened quickly.
+type SavedFilter struct {
+	ID        string            `json:"id"`
+	UserID    string            `json:"user_id"`
+	Name      string            `json:"name"`
+	Query     map[string]string `json:"query"`
+	CreatedAt time.Time         `json:"created_at"`
 }
@@ -0,0 +1,16 @@
+package domain
+
+import "time"
+
+// IdempotencyKey records a client-supplied Idempotency-Key for a write
+// endpoint, the request it was first used with, and the response to replay.
+// StatusCode is zero while the original request is still being processed.
+type IdempotencyKey struct {
+	Scope       string
+	Key         string
+	Fingerprint string
+	JobID       string
+	StatusCode  int
+	Response    []byte
+	CreatedAt   time.Time
+}
@@ -0,0 +1,31 @@
+package domain
+
+import "time"
+
+// JiraIssueState is where the reconciler last left a discrepancy's Jira
+// issue.
+type JiraIssueState string
+
+const (
+	// JiraIssueOpen is an issue for a discrepancy still being raised.
+	JiraIssueOpen JiraIssueState = "open"
+	// JiraIssueResolvedHere is an issue the reconciler resolved because it
+	// no longer raises the discrepancy.
+	JiraIssueResolvedHere JiraIssueState = "resolved_here"
+	// JiraIssueResolvedInJira is an issue resolved in Jira, whose
+	// discrepancy is marked resolved.
+	JiraIssueResolvedInJira JiraIssueState = "resolved_in_jira"
+)
+
+// JiraIssue is the Jira issue tracking a discrepancy. Status is the issue's
+// status as Jira last reported it, and LastError why the last transition
+// the reconciler tried failed.
+type JiraIssue struct {
+	DiscrepancyID string         `json:"discrepancy_id"`
+	Key           string         `json:"key"`
+	State         JiraIssueState `json:"state"`
+	Status        string         `json:"status,omitempty"`
+	LastError     string         `json:"last_error,omitempty"`
+	CreatedAt     time.Time      `json:"created_at"`
+	UpdatedAt     time.Time      `json:"updated_at"`
+}
@@ -0,0 +1,12 @@
+package domain
+
+import "time"
+
+// Lease is a named lock in the database, held by one server instance until
+// it expires unless the holder renews it first.
+type Lease struct {
+	Name       string    `json:"name"`
+	Holder     string    `json:"holder"`
+	AcquiredAt time.Time `json:"acquired_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+}
@@ -0,0 +1,25 @@
+package domain
+
+import "time"
+
+// MerchantTolerance overrides the global amount-mismatch tolerance for a
+// single merchant. High-volume merchants with micro-transactions typically
+// need a tighter absolute tolerance than the default.
+type MerchantTolerance struct {
+	MerchantID      string    `json:"merchant_id"`
+	AbsToleranceUSD float64   `json:"abs_tolerance_usd"`
+	UpdatedAt       time.Time `json:"updated_at"`
+}
+
+// PayoutHold signals that a merchant's payouts should not be disbursed:
+// the merchant's open discrepancies of the hold severity add up to more
+// than the hold threshold. It is raised and cleared by reconciliation runs.
+type PayoutHold struct {
+	MerchantID string `json:"merchant_id"`
+	// Discrepancies and OpenUSD are the count and summed absolute USD
+	// difference of the open discrepancies behind the hold, as of UpdatedAt.
+	Discrepancies int       `json:"discrepancies"`
+	OpenUSD       float64   `json:"open_usd"`
+	HeldSince     time.Time `json:"held_since"`
+	UpdatedAt     time.Time `json:"updated_at"`
+}
@@ -0,0 +1,87 @@
+package domain
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// PeriodLayout is the format of accounting period keys: calendar months,
+// e.g. "2024-01".
+const PeriodLayout = "2006-01"
+
+// PeriodOf returns the accounting period t falls in. The month is taken in
+// t's own offset, matching the date the processor reported, as stored.
+func PeriodOf(t time.Time) string {
+	return t.Format(PeriodLayout)
+}
+
+// PeriodClose is one close of an accounting period. Figures are the period's
+// numbers at the moment it was closed. A reopened period keeps its close
+// history.
+type PeriodClose struct {
+	Period       string        `json:"period"`
+	ClosedBy     string        `json:"closed_by"`
+	ClosedAt     time.Time     `json:"closed_at"`
+	Figures      PeriodFigures `json:"figures"`
+	ReopenedBy   string        `json:"reopened_by,omitempty"`
+	ReopenedAt   *time.Time    `json:"reopened_at,omitempty"`
+	ReopenReason string        `json:"reopen_reason,omitempty"`
+}
+
+// PeriodFigures are the numbers finance reports for a period. Transactions
+// count by capture date, settlements by settlement date, and discrepancies
+// by the date of the settlement or, for missing settlements, the capture.
+type PeriodFigures struct {
+	Transactions         int     `json:"transactions"`
+	TransactionUSD       float64 `json:"transaction_usd"`
+	SettlementRecords    int     `json:"settlement_records"`
+	SettledUSDGross      float64 `json:"settled_usd_gross"`
+	SettledUSDNet        float64 `json:"settled_usd_net"`
+	Discrepancies        int     `json:"discrepancies"`
+	DiscrepancyImpactUSD float64 `json:"discrepancy_impact_usd"`
+}
+
+// AdjustmentKind is the change a pending adjustment would make.
+type AdjustmentKind string
+
+const (
+	// AdjustmentIngest is a settlement report with records in a closed period.
+	AdjustmentIngest AdjustmentKind = "ingest"
+	// AdjustmentCorrection is a settlement correction that moves amounts in
+	// or out of a closed period.
+	AdjustmentCorrection AdjustmentKind = "correction"
+	// AdjustmentAmendment is an amount amendment to a transaction captured in
+	// a closed period.
+	AdjustmentAmendment AdjustmentKind = "amendment"
+	// AdjustmentMatch is an accepted match suggestion for a settlement
+	// record or transaction in a closed period.
+	AdjustmentMatch AdjustmentKind = "match"
+)
+
+// AdjustmentStatus is where a pending adjustment is in its approval.
+type AdjustmentStatus string
+
+const (
+	AdjustmentPending  AdjustmentStatus = "pending"
+	AdjustmentApproved AdjustmentStatus = "approved"
+	AdjustmentRejected AdjustmentStatus = "rejected"
+)
+
+// PendingAdjustment is a change held back because it touches a closed
+// period. Payload is what is needed to apply it; Result is the outcome of
+// applying it after approval.
+type PendingAdjustment struct {
+	ID          string           `json:"id"`
+	Kind        AdjustmentKind   `json:"kind"`
+	Reference   string           `json:"reference"`
+	Periods     []string         `json:"periods"`
+	Summary     string           `json:"summary"`
+	Status      AdjustmentStatus `json:"status"`
+	RequestedBy string           `json:"requested_by,omitempty"`
+	CreatedAt   time.Time        `json:"created_at"`
+	DecidedBy   string           `json:"decided_by,omitempty"`
+	DecidedAt   *time.Time       `json:"decided_at,omitempty"`
+	Note        string           `json:"note,omitempty"`
+	Payload     json.RawMessage  `json:"-"`
+	Result      json.RawMessage  `json:"result,omitempty"`
+}
@@ -0,0 +1,61 @@
+package domain
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// ProcessorContact is who to reach at a processor about its settlements:
+// the operations mailbox, the portal disputes are filed in, the terms the
+// processor committed to, and whom to escalate to, in order, when those
+// terms are not met.
+type ProcessorContact struct {
+	Processor        Processor `json:"processor"`
+	OpsEmail         string    `json:"ops_email,omitempty"`
+	DisputePortalURL string    `json:"dispute_portal_url,omitempty"`
+	// SLATerms are the response and resolution times agreed with the
+	// processor, as written in the contract.
+	SLATerms   string              `json:"sla_terms,omitempty"`
+	Escalation []EscalationContact `json:"escalation"`
+	UpdatedBy  string              `json:"updated_by"`
+	UpdatedAt  time.Time           `json:"updated_at"`
+}
+
+// EscalationContact is one step of a processor's escalation path. AfterHours
+// is how long after a dispute is raised it goes to this contact.
+type EscalationContact struct {
+	Name       string `json:"name"`
+	Role       string `json:"role,omitempty"`
+	Email      string `json:"email,omitempty"`
+	Phone      string `json:"phone,omitempty"`
+	AfterHours int    `json:"after_hours"`
+}
+
+// Lines describes the contact as plain text lines for emails and issues.
+func (c *ProcessorContact) Lines() []string {
+	var lines []string
+	if c.OpsEmail != "" {
+		lines = append(lines, "Operations: "+c.OpsEmail)
+	}
+	if c.DisputePortalURL != "" {
+		lines = append(lines, "Dispute portal: "+c.DisputePortalURL)
+	}
+	if c.SLATerms != "" {
+		lines = append(lines, "SLA: "+c.SLATerms)
+	}
+	for i, e := range c.Escalation {
+		who := e.Name
+		if e.Role != "" {
+			who += " (" + e.Role + ")"
+		}
+		var reach []string
+		for _, v := range []string{e.Email, e.Phone} {
+			if v != "" {
+				reach = append(reach, v)
+			}
+		}
+		lines = append(lines, fmt.Sprintf("Escalation %d, after %dh: %s, %s", i+1, e.AfterHours, who, strings.Join(reach, ", ")))
+	}
+	return lines
+}
@@ -0,0 +1,51 @@
+package domain
+
+import "time"
+
+// RetentionMode is what a purge does to rows past their retention.
+type RetentionMode string
+
+const (
+	// RetentionAnonymize keeps the rows, and so every amount, date and
+	// status, but replaces processor references, merchant IDs and free-text
+	// reasons.
+	RetentionAnonymize RetentionMode = "anonymize"
+	// RetentionDelete removes the rows. Their totals are kept as retention
+	// aggregates.
+	RetentionDelete RetentionMode = "delete"
+)
+
+// PurgeReport is the compliance record of one purge: what was purged, under
+// which cutoffs, by whom, and what the purged rows added up to. Cutoffs
+// holds the processors with a retention period; "*" is the default for
+// processors not listed.
+type PurgeReport struct {
+	ID                      string               `json:"id"`
+	Mode                    RetentionMode        `json:"mode"`
+	DryRun                  bool                 `json:"dry_run"`
+	RequestedBy             string               `json:"requested_by"`
+	PurgedAt                time.Time            `json:"purged_at"`
+	Cutoffs                 map[string]time.Time `json:"cutoffs"`
+	Transactions            int                  `json:"transactions"`
+	SettlementRecords       int                  `json:"settlement_records"`
+	Discrepancies           int                  `json:"discrepancies"`
+	QuarantinedTransactions int                  `json:"quarantined_transactions"`
+	ReportWarnings          int                  `json:"report_warnings"`
+	ReportFiles             int                  `json:"report_files"`
+	Aggregates              []RetentionAggregate `json:"aggregates"`
+	Skipped                 map[string]int       `json:"skipped,omitempty"`
+}
+
+// RetentionAggregate totals purged rows of one kind ("transaction" or
+// "settlement") per month, processor and currency. Transactions count by
+// creation month and sum their amount; settlement records count by
+// settlement month and sum their gross amount.
+type RetentionAggregate struct {
+	Kind      string    `json:"kind"`
+	Period    string    `json:"period"`
+	Processor Processor `json:"processor"`
+	Currency  string    `json:"currency"`
+	Count     int       `json:"count"`
+	Amount    float64   `json:"amount"`
+	USDAmount float64   `json:"usd_amount"`
+}
@@ -0,0 +1,33 @@
+package domain
+
+import "time"
+
+// RoutingRule assigns new discrepancies to a team or a user. A rule matches
+// a discrepancy when every criterion it sets does; unset criteria match
+// anything. Rules are tried by Position, and the first match wins.
+type RoutingRule struct {
+	ID       string `json:"id"`
+	Position int    `json:"position"`
+	// Criteria.
+	Processor   Processor       `json:"processor,omitempty"`
+	MinSeverity Severity        `json:"min_severity,omitempty"`
+	MerchantID  string          `json:"merchant_id,omitempty"`
+	Type        DiscrepancyType `json:"type,omitempty"`
+	// Team and Assignee are who the discrepancy goes to; at least one is
+	// set. Notify are the email addresses told of the assignment.
+	Team      string    `json:"team,omitempty"`
+	Assignee  string    `json:"assignee,omitempty"`
+	Notify    []string  `json:"notify"`
+	UpdatedBy string    `json:"updated_by"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// DiscrepancyAssignment is who a discrepancy was routed to, and by which
+// rule. It is keyed by the discrepancy's deterministic ID, like tags, so a
+// discrepancy keeps its owner across reconciliation re-runs.
+type DiscrepancyAssignment struct {
+	Team       string    `json:"team,omitempty"`
+	Assignee   string    `json:"assignee,omitempty"`
+	RuleID     string    `json:"rule_id"`
+	AssignedAt time.Time `json:"assigned_at"`
+}
@@ -0,0 +1,14 @@
+package domain
+
+import "time"
+
+// RuleFlag turns a reconciliation rule on or off, for every processor or,
+// overriding that, for one.
+type RuleFlag struct {
+	Rule string `json:"rule"`
+	// Processor is the processor the flag applies to; empty for all.
+	Processor Processor `json:"processor,omitempty"`
+	Enabled   bool      `json:"enabled"`
+	UpdatedBy string    `json:"updated_by"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
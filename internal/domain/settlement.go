@@ -1,6 +1,10 @@
 package domain
 
-import "time"
+import (
+	"fmt"
+	"math"
+	"time"
+)
 
 type SettlementReport struct {
 	ID          string    `json:"id"`
@@ -12,6 +16,74 @@ type SettlementReport struct {
 	IngestedAt  time.Time `json:"ingested_at"`
 }
 
+// ReportFile is the file a report was ingested from, byte for byte. A file
+// that held several batches is stored once for the reports of all of them,
+// so Hash is the whole file's and may differ from each report's FileHash.
+type ReportFile struct {
+	Hash     string    `json:"sha256"`
+	Filename string    `json:"filename,omitempty"`
+	Size     int       `json:"size"`
+	StoredAt time.Time `json:"stored_at"`
+	Data     []byte    `json:"-"`
+}
+
+// ControlTotals are the totals a processor declares in a report's footer
+// row, beside the sums of the records parsed from the report. Matched is
+// false when any of them differ by a cent or more.
+type ControlTotals struct {
+	Line        int     `json:"line"`
+	Gross       float64 `json:"gross"`
+	Fee         float64 `json:"fee"`
+	Net         float64 `json:"net"`
+	ParsedGross float64 `json:"parsed_gross"`
+	ParsedFee   float64 `json:"parsed_fee"`
+	ParsedNet   float64 `json:"parsed_net"`
+	Matched     bool    `json:"matched"`
+}
+
+// ReportProvenance is where a report's file came from when it did not come
+// through the API. Source is "mailbox" for an email attachment, with the
+// message's sender, subject and ID and the fetch rule that picked it.
+type ReportProvenance struct {
+	Source     string    `json:"source"`
+	Mailbox    string    `json:"mailbox,omitempty"`
+	MessageID  string    `json:"message_id,omitempty"`
+	From       string    `json:"from,omitempty"`
+	Subject    string    `json:"subject,omitempty"`
+	ReceivedAt time.Time `json:"received_at"`
+	Rule       string    `json:"rule,omitempty"`
+}
+
+// Verification statuses of a report file.
+const (
+	// VerificationVerified: every checksum or signature file sent with the
+	// report matched it.
+	VerificationVerified = "verified"
+	// VerificationUnverified: the report came without one.
+	VerificationUnverified = "unverified"
+)
+
+// ReportVerification is how a report's file was checked against the
+// checksum or signature files (sidecars) sent with it. Method lists the
+// checks in sidecar order, e.g. "sha256,pgp"; Signer is the key ID of a PGP
+// signature.
+type ReportVerification struct {
+	Status    string    `json:"status"`
+	Method    string    `json:"method,omitempty"`
+	Sidecar   string    `json:"sidecar,omitempty"`
+	Signer    string    `json:"signer,omitempty"`
+	CheckedAt time.Time `json:"checked_at"`
+}
+
+// ReportWarning is something a parser noticed while reading a report: a line
+// it skipped, a field it had to coerce, or a date it parsed with a fallback
+// layout.
+type ReportWarning struct {
+	Line    int    `json:"line"`
+	Kind    string `json:"kind"`
+	Message string `json:"message"`
+}
+
 type SettlementRecord struct {
 	ID                     string    `json:"id"`
 	ReportID               string    `json:"report_id"`
@@ -26,4 +98,148 @@ type SettlementRecord struct {
 	USDNetAmount           float64   `json:"usd_net_amount"`
 	SettlementDate         time.Time `json:"settlement_date"`
 	BatchID                string    `json:"batch_id"`
+	// FeeBreakdown is the fee by component, in the record's currency, for
+	// reports that list the components in separate columns. FeeAmount is
+	// their sum.
+	FeeBreakdown map[string]float64 `json:"fee_breakdown,omitempty"`
+	// TaxAmount is the tax withheld on the fee, such as Nigerian withholding
+	// tax, in the record's currency. It is deducted from the payout besides
+	// the fee, so NetAmount is GrossAmount - FeeAmount - TaxAmount.
+	TaxAmount float64 `json:"tax_amount,omitempty"`
+	// Adjustment is set on rows that are not payments, such as penalties,
+	// classified by their processor's adjustment code.
+	Adjustment *RecordAdjustment `json:"adjustment,omitempty"`
+}
+
+// CostCategory is what a settlement cost was for. Processing fees are the
+// fees deducted from payments; the other categories are adjustment rows.
+type CostCategory string
+
+const (
+	CostProcessingFee CostCategory = "processing_fee"
+	CostPenalty       CostCategory = "penalty"
+	CostChargebackFee CostCategory = "chargeback_fee"
+	CostAdjustment    CostCategory = "adjustment"
+	// CostRefund is a payment row with a negative amount and no adjustment
+	// code, classified as a refund by the processor's amount policy.
+	CostRefund CostCategory = "refund"
+	// CostWithholdingTax is the tax withheld on payment rows' fees.
+	CostWithholdingTax CostCategory = "withholding_tax"
+	// CostCarriedBalance is a deduction of the negative balance an earlier
+	// batch carried forward when its refunds exceeded its sales.
+	CostCarriedBalance CostCategory = "carried_balance"
+)
+
+// Fee components of a FeeBreakdown.
+const (
+	FeeProcessing = "processing"
+	FeeFX         = "fx"
+	FeeVAT        = "vat"
+)
+
+// RecordAdjustment classifies a penalty or adjustment row of a settlement
+// report. Code is the processor's own code for it, e.g. "PEN".
+type RecordAdjustment struct {
+	Code     string       `json:"code"`
+	Category CostCategory `json:"category"`
+}
+
+// SettlementBatch aggregates every report a processor sent under one batch
+// ID. Some processors split a batch across several intraday files.
+type SettlementBatch struct {
+	Processor       Processor          `json:"processor"`
+	BatchID         string             `json:"batch_id"`
+	ReportCount     int                `json:"report_count"`
+	RecordCount     int                `json:"record_count"`
+	USDGrossAmount  float64            `json:"usd_gross_amount"`
+	USDNetAmount    float64            `json:"usd_net_amount"`
+	FirstIngestedAt time.Time          `json:"first_ingested_at"`
+	LastIngestedAt  time.Time          `json:"last_ingested_at"`
+	Reports         []SettlementReport `json:"reports,omitempty"`
+	// Balances is the batch's place in the processor's carried balance, one
+	// per currency it settled in. Only GetBatch fills it.
+	Balances []BatchBalance `json:"balances,omitempty"`
+}
+
+// BatchBalance is one batch's place in a processor's running balance. A batch
+// whose refunds and charges exceed its sales pays nothing out; the processor
+// carries the shortfall forward as a negative balance and takes it off later
+// payouts with carried_balance rows. Amounts are in Currency.
+type BatchBalance struct {
+	Processor Processor `json:"processor"`
+	BatchID   string    `json:"batch_id"`
+	Currency  string    `json:"currency"`
+	// SettlementDate is the batch's latest settlement date, YYYY-MM-DD.
+	// Batches are taken in that order.
+	SettlementDate string `json:"settlement_date"`
+	// CarriedIn is the negative balance still owed when the batch settled,
+	// zero or less.
+	CarriedIn float64 `json:"carried_in"`
+	// Net is the net of the batch's rows other than carried_balance ones.
+	Net float64 `json:"net"`
+	// Deducted is what the batch's carried_balance rows took off its payout.
+	Deducted float64 `json:"deducted"`
+	// OverDeducted is how much Deducted exceeds the balance carried in.
+	OverDeducted float64 `json:"over_deducted"`
+	// Payout is Net less Deducted, or zero when that is negative.
+	Payout float64 `json:"payout"`
+	// CarriedOut is the negative balance carried to the next batch.
+	CarriedOut float64 `json:"carried_out"`
+}
+
+// SettlementCorrection is the audit entry for a manual fix to a settlement
+// record, e.g. an amount the processor confirmed was typo'd.
+type SettlementCorrection struct {
+	ID           string            `json:"id"`
+	SettlementID string            `json:"settlement_id"`
+	UserID       string            `json:"user_id"`
+	Reason       string            `json:"reason"`
+	Before       SettlementAmounts `json:"before"`
+	After        SettlementAmounts `json:"after"`
+	CreatedAt    time.Time         `json:"created_at"`
+}
+
+// SettlementAmounts are the correctable fields of a settlement record.
+type SettlementAmounts struct {
+	GrossAmount    float64   `json:"gross_amount"`
+	FeeAmount      float64   `json:"fee_amount"`
+	TaxAmount      float64   `json:"tax_amount,omitempty"`
+	NetAmount      float64   `json:"net_amount"`
+	USDGrossAmount float64   `json:"usd_gross_amount"`
+	USDNetAmount   float64   `json:"usd_net_amount"`
+	SettlementDate time.Time `json:"settlement_date"`
+}
+
+// Amounts returns the correctable fields of the record.
+func (r *SettlementRecord) Amounts() SettlementAmounts {
+	return SettlementAmounts{
+		GrossAmount:    r.GrossAmount,
+		FeeAmount:      r.FeeAmount,
+		TaxAmount:      r.TaxAmount,
+		NetAmount:      r.NetAmount,
+		USDGrossAmount: r.USDGrossAmount,
+		USDNetAmount:   r.USDNetAmount,
+		SettlementDate: r.SettlementDate,
+	}
+}
+
+// NetError describes how the record's net differs from its gross less the
+// fee and any tax withheld, or is "" when they agree to the cent.
+func (r *SettlementRecord) NetError() string {
+	if math.Abs(r.GrossAmount-r.FeeAmount-r.TaxAmount-r.NetAmount) <= 0.01 {
+		return ""
+	}
+	if r.TaxAmount != 0 {
+		return fmt.Sprintf("gross %.2f - fee %.2f - tax %.2f does not equal net %.2f",
+			r.GrossAmount, r.FeeAmount, r.TaxAmount, r.NetAmount)
+	}
+	return fmt.Sprintf("gross %.2f - fee %.2f does not equal net %.2f", r.GrossAmount, r.FeeAmount, r.NetAmount)
+}
+
+// USDTax is the tax withheld in USD, at the record's gross rate.
+func (r *SettlementRecord) USDTax() float64 {
+	if r.TaxAmount == 0 || r.GrossAmount == 0 {
+		return 0
+	}
+	return r.TaxAmount * r.USDGrossAmount / r.GrossAmount
 }
@@ -0,0 +1,11 @@
+package domain
+
+import "time"
+
+// Snapshot is a saved copy of the whole database that can be restored later,
+// e.g. an integration test fixture.
+type Snapshot struct {
+	Name      string    `json:"name"`
+	SizeBytes int64     `json:"size_bytes"`
+	CreatedAt time.Time `json:"created_at"`
+}
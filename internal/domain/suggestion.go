@@ -0,0 +1,54 @@
+package domain
+
+import "time"
+
+// SuggestionFeatures are how closely a transaction resembles an orphaned
+// settlement record, each from 0 (not at all) to 1 (exactly).
+type SuggestionFeatures struct {
+	// Amount compares the record's gross amount with the transaction's.
+	Amount float64 `json:"amount"`
+	// Time compares the record's settlement date with the transaction's
+	// capture, against the settlement window.
+	Time float64 `json:"time"`
+	// Merchant is 1 when the record's batch settled other payments of the
+	// transaction's merchant. Settlement records do not carry the merchant
+	// themselves.
+	Merchant float64 `json:"merchant"`
+	// Reference compares the two references once the prefix the processor's
+	// matched references share is taken off.
+	Reference float64 `json:"reference"`
+}
+
+// MatchSuggestion is a transaction an orphaned settlement record may pay,
+// scored from 0 to 1 by the weighted features.
+type MatchSuggestion struct {
+	Transaction *Transaction       `json:"transaction"`
+	Score       float64            `json:"score"`
+	Features    SuggestionFeatures `json:"features"`
+}
+
+// SuggestionDecision is a reviewer's verdict on a match suggestion.
+type SuggestionDecision string
+
+const (
+	// SuggestionAccepted links the record to the transaction.
+	SuggestionAccepted SuggestionDecision = "accepted"
+	// SuggestionRejected stops the transaction being suggested for the
+	// record again.
+	SuggestionRejected SuggestionDecision = "rejected"
+)
+
+// SuggestionFeedback is a decision on one suggestion, stored with its score
+// and features as they were when it was made, to tune the weights by. A
+// later decision on the same pair replaces it.
+type SuggestionFeedback struct {
+	SettlementID  string             `json:"settlement_id"`
+	TransactionID string             `json:"transaction_id"`
+	Processor     Processor          `json:"processor"`
+	Decision      SuggestionDecision `json:"decision"`
+	Score         float64            `json:"score"`
+	Features      SuggestionFeatures `json:"features"`
+	UserID        string             `json:"user_id"`
+	Note          string             `json:"note,omitempty"`
+	DecidedAt     time.Time          `json:"decided_at"`
+}
@@ -9,6 +9,9 @@ const (
 	StatusCaptured   TransactionStatus = "captured"
 	StatusSettled    TransactionStatus = "settled"
 	StatusFailed     TransactionStatus = "failed"
+	// StatusPendingConfirmation is a transaction matched to a record of a
+	// batch that waits for approval before its transactions are settled.
+	StatusPendingConfirmation TransactionStatus = "pending_settlement_confirmation"
 )
 
 type Processor string
@@ -17,6 +20,17 @@ const (
 	ProcessorAfriPay      Processor = "afripay"
 	ProcessorNairaGateway Processor = "nairagateway"
 	ProcessorCapePay      Processor = "capepay"
+	ProcessorMPesa        Processor = "mpesa"
+)
+
+// Direction is which way a transaction moves money. Inbound collections
+// from customers are the default; outbound transactions are payout
+// instructions to merchants, reconciled against disbursement reports.
+type Direction string
+
+const (
+	DirectionInbound  Direction = "inbound"
+	DirectionOutbound Direction = "outbound"
 )
 
 type Transaction struct {
@@ -33,4 +47,83 @@ type Transaction struct {
 	CreatedAt          time.Time         `json:"created_at"`
 	CapturedAt         *time.Time        `json:"captured_at,omitempty"`
 	SettledAt          *time.Time        `json:"settled_at,omitempty"`
+	// Direction is empty for inbound transactions.
+	Direction Direction `json:"direction,omitempty"`
+	// TransferID and Leg link the transaction to the other legs of a
+	// cross-border transfer; both are empty for a single-leg payment.
+	TransferID string  `json:"transfer_id,omitempty"`
+	Leg        LegRole `json:"leg,omitempty"`
+	// ReconciliationStatus is kept up to date by the reconciliation service
+	// and is loaded wherever Direction and the transfer links are.
+	ReconciliationStatus ReconciliationStatus `json:"reconciliation_status,omitempty"`
+}
+
+// ReconciliationStatus summarises where a transaction stands after the last
+// reconciliation run, so clients need not combine its status with
+// discrepancy queries.
+type ReconciliationStatus string
+
+const (
+	// ReconUnreconciled is a transaction not yet settled and not yet
+	// overdue, or one no run has looked at since it was created.
+	ReconUnreconciled ReconciliationStatus = "unreconciled"
+	// ReconSettledClean is a settled transaction with no open discrepancy.
+	ReconSettledClean ReconciliationStatus = "settled_clean"
+	// ReconSettledWithVariance is a settled transaction whose settlement
+	// differs from it beyond tolerance: an amount mismatch or an overpaid
+	// payout.
+	ReconSettledWithVariance ReconciliationStatus = "settled_with_variance"
+	// ReconMissingSettlement is a transaction past the settlement window
+	// with no settlement, or a payout with no disbursement.
+	ReconMissingSettlement ReconciliationStatus = "missing_settlement"
+	// ReconUnderInvestigation is a transaction with an open discrepancy
+	// tagged InvestigationTag. It takes precedence over the others.
+	ReconUnderInvestigation ReconciliationStatus = "under_investigation"
+)
+
+// InvestigationTag is the discrepancy tag that puts a transaction under
+// investigation.
+const InvestigationTag = "investigating"
+
+// Valid reports whether s is one of the reconciliation statuses.
+func (s ReconciliationStatus) Valid() bool {
+	switch s {
+	case ReconUnreconciled, ReconSettledClean, ReconSettledWithVariance, ReconMissingSettlement, ReconUnderInvestigation:
+		return true
+	}
+	return false
+}
+
+// Outbound reports whether the transaction is a payout instruction.
+func (t *Transaction) Outbound() bool {
+	return t.Direction == DirectionOutbound
+}
+
+// TransactionAmendment is one version of a transaction's amount after
+// capture, e.g. a tip added or an FX reprice. The transaction row always
+// carries the latest amended amount; amendments keep the history.
+type TransactionAmendment struct {
+	ID                string    `json:"id"`
+	TransactionID     string    `json:"transaction_id"`
+	Version           int       `json:"version"`
+	EventID           string    `json:"event_id,omitempty"`
+	Reason            string    `json:"reason"`
+	PreviousAmount    float64   `json:"previous_amount"`
+	PreviousUSDAmount float64   `json:"previous_usd_amount"`
+	Amount            float64   `json:"amount"`
+	USDAmount         float64   `json:"usd_amount"`
+	AmendedAt         time.Time `json:"amended_at"`
+	RecordedAt        time.Time `json:"recorded_at"`
+}
+
+// QuarantinedTransaction is a transaction removed from the ledger because
+// another transaction of the same processor already had its processor
+// reference, which made matching by reference ambiguous. It is kept with
+// its amount history until reviewed. KeptID is the transaction that still
+// holds the reference.
+type QuarantinedTransaction struct {
+	Transaction   Transaction            `json:"transaction"`
+	Amendments    []TransactionAmendment `json:"amendments"`
+	KeptID        string                 `json:"kept_transaction_id"`
+	QuarantinedAt time.Time              `json:"quarantined_at"`
 }
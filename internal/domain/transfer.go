@@ -0,0 +1,103 @@
+package domain
+
+// LegRole is the part a transaction plays in a cross-border transfer.
+type LegRole string
+
+const (
+	// LegCollection takes the funds from the customer through the customer's
+	// processor.
+	LegCollection LegRole = "collection"
+	// LegPayout pays the merchant through the merchant's processor.
+	LegPayout LegRole = "payout"
+)
+
+// Valid reports whether r is a known leg role.
+func (r LegRole) Valid() bool {
+	return r == LegCollection || r == LegPayout
+}
+
+// TransferStatus is the state of a transfer as a whole, derived from its
+// legs.
+type TransferStatus string
+
+const (
+	// TransferPending has both legs, neither settled yet.
+	TransferPending TransferStatus = "pending"
+	// TransferCollected has its collection settled and its payout not yet.
+	TransferCollected TransferStatus = "collected"
+	// TransferCompleted has both legs settled with no open discrepancies.
+	TransferCompleted TransferStatus = "completed"
+	// TransferIncomplete is missing a leg from the transaction feed.
+	TransferIncomplete TransferStatus = "incomplete"
+	// TransferFailed has a failed leg.
+	TransferFailed TransferStatus = "failed"
+	// TransferException needs investigation: a leg has open discrepancies,
+	// or the merchant was paid out before the collection settled.
+	TransferException TransferStatus = "exception"
+)
+
+// TransferStatuses lists every transfer status, for validating filters.
+var TransferStatuses = []TransferStatus{
+	TransferPending, TransferCollected, TransferCompleted,
+	TransferIncomplete, TransferFailed, TransferException,
+}
+
+// Transfer is one logical cross-border payment made of linked transactions,
+// a collection leg and a payout leg. Each leg is reconciled against its own
+// processor like any other transaction.
+type Transfer struct {
+	ID     string         `json:"id"`
+	Status TransferStatus `json:"status"`
+	// Reason explains a failed, incomplete or exception status.
+	Reason string        `json:"reason,omitempty"`
+	Legs   []TransferLeg `json:"legs"`
+}
+
+// TransferLeg is one transaction of a transfer with its open discrepancy
+// count.
+type TransferLeg struct {
+	Role              LegRole     `json:"role"`
+	Transaction       Transaction `json:"transaction"`
+	OpenDiscrepancies int         `json:"open_discrepancies"`
+}
+
+// Leg returns the transfer's leg with the given role, or nil.
+func (t *Transfer) Leg(role LegRole) *TransferLeg {
+	for i := range t.Legs {
+		if t.Legs[i].Role == role {
+			return &t.Legs[i]
+		}
+	}
+	return nil
+}
+
+// DeriveStatus sets Status and Reason from the legs. The first rule that
+// applies wins: a missing leg, then a failed leg, then open discrepancies,
+// then how far settlement has got.
+func (t *Transfer) DeriveStatus() {
+	collection, payout := t.Leg(LegCollection), t.Leg(LegPayout)
+	t.Reason = ""
+
+	switch {
+	case collection == nil:
+		t.Status, t.Reason = TransferIncomplete, "no collection leg"
+	case payout == nil:
+		t.Status, t.Reason = TransferIncomplete, "no payout leg"
+	case collection.Transaction.Status == StatusFailed:
+		t.Status, t.Reason = TransferFailed, "collection leg failed"
+	case payout.Transaction.Status == StatusFailed:
+		t.Status, t.Reason = TransferFailed, "payout leg failed"
+	case collection.OpenDiscrepancies > 0:
+		t.Status, t.Reason = TransferException, "collection leg has open discrepancies"
+	case payout.OpenDiscrepancies > 0:
+		t.Status, t.Reason = TransferException, "payout leg has open discrepancies"
+	case collection.Transaction.Status == StatusSettled && payout.Transaction.Status == StatusSettled:
+		t.Status = TransferCompleted
+	case collection.Transaction.Status == StatusSettled:
+		t.Status = TransferCollected
+	case payout.Transaction.Status == StatusSettled:
+		t.Status, t.Reason = TransferException, "payout settled before collection"
+	default:
+		t.Status = TransferPending
+	}
+}
@@ -0,0 +1,234 @@
+package domain
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"time"
+)
+
+// TransformOp is one kind of change a transform step makes to a field.
+type TransformOp string
+
+const (
+	// TransformTrimPrefix removes Value from the start of a text field.
+	TransformTrimPrefix TransformOp = "trim_prefix"
+	// TransformTrimSuffix removes Value from the end of a text field.
+	TransformTrimSuffix TransformOp = "trim_suffix"
+	// TransformAddPrefix puts Value in front of a text field that does not
+	// already start with it.
+	TransformAddPrefix TransformOp = "add_prefix"
+	// TransformReplace replaces every Value in a text field with With.
+	TransformReplace TransformOp = "replace"
+	// TransformUpper and TransformLower change the case of a text field.
+	TransformUpper TransformOp = "upper"
+	TransformLower TransformOp = "lower"
+	// TransformSet sets a text field to Value.
+	TransformSet TransformOp = "set"
+	// TransformScale multiplies an amount field by Factor, e.g. 0.01 for
+	// amounts reported in cents. The field "amounts" scales every amount
+	// of the record, so its net still equals gross less fee and tax.
+	TransformScale TransformOp = "scale"
+)
+
+// Fields a transform step can read and change. Only what parsers get wrong
+// in practice is exposed; batch IDs and dates are left to the parser.
+var (
+	transformTextFields   = []string{"processor_transaction_id", "currency"}
+	transformAmountFields = []string{"amounts", "gross_amount", "fee_amount", "net_amount"}
+)
+
+// Limits that keep a transform script small and cheap to run on every row.
+const (
+	MaxTransformSteps   = 50
+	maxTransformTextLen = 64
+)
+
+// TransformScript is a processor's list of fixes applied to each parsed
+// record during ingestion, so quirks such as reference prefixes or amounts
+// in cents can be fixed as configuration instead of a parser release. Steps
+// run in order and only touch the record's own fields, so a script has no
+// way to reach the filesystem, the network or other records. It is a fixed
+// set of operations rather than uploaded code, such as Starlark or WASM,
+// run in a sandbox: there is no interpreter to escape from or to bound.
+type TransformScript struct {
+	Processor Processor       `json:"processor"`
+	Version   int             `json:"version"`
+	Steps     []TransformStep `json:"steps"`
+	UpdatedAt time.Time       `json:"updated_at"`
+	UpdatedBy string          `json:"updated_by,omitempty"`
+}
+
+// TransformStep is one change to one field.
+type TransformStep struct {
+	Op    TransformOp `json:"op"`
+	Field string      `json:"field"`
+	// Value is the prefix, suffix, text to replace or text to set.
+	Value  string  `json:"value,omitempty"`
+	With   string  `json:"with,omitempty"`
+	Factor float64 `json:"factor,omitempty"`
+	// When limits the step to matching records.
+	When *TransformMatch `json:"when,omitempty"`
+}
+
+// TransformMatch selects records by a text field. Both conditions must hold
+// when both are given.
+type TransformMatch struct {
+	Field  string `json:"field"`
+	Prefix string `json:"prefix,omitempty"`
+	Equals string `json:"equals,omitempty"`
+}
+
+func isTransformField(name string, fields []string) bool {
+	for _, f := range fields {
+		if f == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Validate checks the script before it is stored. Step numbers in errors
+// start at 1.
+func (s *TransformScript) Validate() error {
+	if len(s.Steps) == 0 {
+		return fmt.Errorf("steps must not be empty")
+	}
+	if len(s.Steps) > MaxTransformSteps {
+		return fmt.Errorf("at most %d steps are allowed", MaxTransformSteps)
+	}
+	for i, st := range s.Steps {
+		if err := st.validate(); err != nil {
+			return fmt.Errorf("step %d: %w", i+1, err)
+		}
+	}
+	return nil
+}
+
+func (st TransformStep) validate() error {
+	for _, v := range []string{st.Value, st.With} {
+		if len(v) > maxTransformTextLen {
+			return fmt.Errorf("values must be at most %d characters", maxTransformTextLen)
+		}
+	}
+
+	switch st.Op {
+	case TransformTrimPrefix, TransformTrimSuffix, TransformAddPrefix, TransformReplace, TransformSet:
+		if !isTransformField(st.Field, transformTextFields) {
+			return fmt.Errorf("%s needs a text field: one of %s", st.Op, strings.Join(transformTextFields, ", "))
+		}
+		if st.Value == "" {
+			return fmt.Errorf("%s needs a value", st.Op)
+		}
+	case TransformUpper, TransformLower:
+		if !isTransformField(st.Field, transformTextFields) {
+			return fmt.Errorf("%s needs a text field: one of %s", st.Op, strings.Join(transformTextFields, ", "))
+		}
+	case TransformScale:
+		if !isTransformField(st.Field, transformAmountFields) {
+			return fmt.Errorf("scale needs an amount field: one of %s", strings.Join(transformAmountFields, ", "))
+		}
+		if st.Factor == 0 || math.IsNaN(st.Factor) || math.IsInf(st.Factor, 0) {
+			return fmt.Errorf("scale needs a non-zero factor")
+		}
+	default:
+		return fmt.Errorf("unknown op %q", st.Op)
+	}
+
+	if st.When != nil {
+		if !isTransformField(st.When.Field, transformTextFields) {
+			return fmt.Errorf("when needs a text field: one of %s", strings.Join(transformTextFields, ", "))
+		}
+		if st.When.Prefix == "" && st.When.Equals == "" {
+			return fmt.Errorf("when needs a prefix or equals")
+		}
+		if len(st.When.Prefix) > maxTransformTextLen || len(st.When.Equals) > maxTransformTextLen {
+			return fmt.Errorf("values must be at most %d characters", maxTransformTextLen)
+		}
+	}
+	return nil
+}
+
+// Apply runs the script on rec and reports whether anything changed. The
+// script must be valid.
+func (s *TransformScript) Apply(rec *SettlementRecord) bool {
+	changed := false
+	for _, st := range s.Steps {
+		if st.When != nil && !st.When.matches(rec) {
+			continue
+		}
+		if st.Op == TransformScale {
+			changed = scaleAmounts(rec, st.Field, st.Factor) || changed
+			continue
+		}
+
+		text := textField(rec, st.Field)
+		before := *text
+		switch st.Op {
+		case TransformTrimPrefix:
+			*text = strings.TrimPrefix(*text, st.Value)
+		case TransformTrimSuffix:
+			*text = strings.TrimSuffix(*text, st.Value)
+		case TransformAddPrefix:
+			if !strings.HasPrefix(*text, st.Value) {
+				*text = st.Value + *text
+			}
+		case TransformReplace:
+			*text = strings.ReplaceAll(*text, st.Value, st.With)
+		case TransformUpper:
+			*text = strings.ToUpper(*text)
+		case TransformLower:
+			*text = strings.ToLower(*text)
+		case TransformSet:
+			*text = st.Value
+		}
+		changed = changed || *text != before
+	}
+	return changed
+}
+
+func (m *TransformMatch) matches(rec *SettlementRecord) bool {
+	v := *textField(rec, m.Field)
+	if m.Prefix != "" && !strings.HasPrefix(v, m.Prefix) {
+		return false
+	}
+	if m.Equals != "" && v != m.Equals {
+		return false
+	}
+	return true
+}
+
+func textField(rec *SettlementRecord, name string) *string {
+	if name == "currency" {
+		return &rec.Currency
+	}
+	return &rec.ProcessorTransactionID
+}
+
+// scaleAmounts multiplies the named amount field of rec by factor, or all of
+// its amounts including the fee breakdown for "amounts", and reports
+// whether any was non-zero.
+func scaleAmounts(rec *SettlementRecord, name string, factor float64) bool {
+	var amounts []*float64
+	switch name {
+	case "amounts":
+		amounts = []*float64{&rec.GrossAmount, &rec.FeeAmount, &rec.TaxAmount, &rec.NetAmount}
+		for k, v := range rec.FeeBreakdown {
+			rec.FeeBreakdown[k] = v * factor
+		}
+	case "fee_amount":
+		amounts = []*float64{&rec.FeeAmount}
+	case "net_amount":
+		amounts = []*float64{&rec.NetAmount}
+	default:
+		amounts = []*float64{&rec.GrossAmount}
+	}
+	changed := false
+	for _, amount := range amounts {
+		if *amount != 0 {
+			*amount *= factor
+			changed = true
+		}
+	}
+	return changed
+}
@@ -0,0 +1,57 @@
+package ingestion
+
+import (
+	"strings"
+
+	"github.com/wakala/reconciler/internal/domain"
+)
+
+// adjustmentCodes is each processor's taxonomy of adjustment codes. Rows
+// that are not payments carry one of these codes in place of a transaction
+// reference, e.g. "PEN-240115-01" for an AfriPay penalty. M-Pesa statements
+// have no such rows: their charges are folded into the payment's fee.
+var adjustmentCodes = map[domain.Processor]map[string]domain.CostCategory{
+	domain.ProcessorAfriPay: {
+		"ADJ": domain.CostAdjustment,
+		"PEN": domain.CostPenalty,
+		"CBF": domain.CostChargebackFee,
+		"BAL": domain.CostCarriedBalance,
+	},
+	domain.ProcessorNairaGateway: {
+		"ADJ": domain.CostAdjustment,
+		"PNL": domain.CostPenalty,
+		"PEN": domain.CostPenalty,
+		"CHB": domain.CostChargebackFee,
+		"BAL": domain.CostCarriedBalance,
+	},
+	domain.ProcessorCapePay: {
+		"ADJ": domain.CostAdjustment,
+		"PEN": domain.CostPenalty,
+		"CBK": domain.CostChargebackFee,
+		"RDR": domain.CostChargebackFee,
+		"BAL": domain.CostCarriedBalance,
+	},
+}
+
+// classifyAdjustment returns the adjustment a reference denotes for the
+// processor, or nil for a payment. The code is the reference up to the first
+// '-' or '_', compared case-insensitively.
+func classifyAdjustment(proc domain.Processor, ref string) *domain.RecordAdjustment {
+	code := strings.ToUpper(strings.TrimSpace(ref))
+	if i := strings.IndexAny(code, "-_"); i >= 0 {
+		code = code[:i]
+	}
+	cat, ok := adjustmentCodes[proc][code]
+	if !ok {
+		return nil
+	}
+	return &domain.RecordAdjustment{Code: code, Category: cat}
+}
+
+// classifyAdjustments marks the adjustment rows among records.
+func classifyAdjustments(records []domain.SettlementRecord) {
+	for i := range records {
+		rec := &records[i]
+		rec.Adjustment = classifyAdjustment(rec.Processor, rec.ProcessorTransactionID)
+	}
+}
@@ -0,0 +1,180 @@
+package ingestion
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/wakala/reconciler/internal/domain"
+)
+
+// ErrAmountRejected is returned when a report, or a record pulled or pushed
+// for a processor, has a payment row with a gross amount the processor's
+// AmountPolicy rejects.
+var ErrAmountRejected = errors.New("amount rejected by policy")
+
+// NegativePolicy is what becomes of a payment row with a negative gross
+// amount. Rows with an adjustment code are already adjustments and are left
+// alone.
+type NegativePolicy string
+
+const (
+	// NegativeRefund classifies the row as a refund, so it is neither
+	// matched as a sale nor counted in sales. It is the default.
+	NegativeRefund NegativePolicy = "refund"
+	// NegativeAdjustment classifies the row as an adjustment.
+	NegativeAdjustment NegativePolicy = "adjustment"
+	// NegativeReject fails the report.
+	NegativeReject NegativePolicy = "reject"
+)
+
+// ZeroPolicy is what becomes of a payment row with a zero gross amount.
+type ZeroPolicy string
+
+const (
+	// ZeroSkip drops the row with a line_skipped warning, which is kept with
+	// the report. It is the default.
+	ZeroSkip ZeroPolicy = "skip"
+	// ZeroReject fails the report.
+	ZeroReject ZeroPolicy = "reject"
+	// ZeroKeep stores the row as a payment.
+	ZeroKeep ZeroPolicy = "keep"
+)
+
+// negativeCode is the adjustment code of payment rows classified by the
+// sign of their amount rather than by a processor code.
+const negativeCode = "NEG"
+
+// AmountPolicy is how a processor's negative and zero amount payment rows
+// are handled.
+type AmountPolicy struct {
+	Negative NegativePolicy
+	Zero     ZeroPolicy
+}
+
+var defaultAmountPolicy = AmountPolicy{Negative: NegativeRefund, Zero: ZeroSkip}
+
+// amountPolicies is the registry of amount policies by processor. It is
+// filled once at startup by RegisterAmountPolicies; processors not in it use
+// the defaults.
+var amountPolicies = map[domain.Processor]AmountPolicy{}
+
+// RegisterAmountPolicies sets the amount policy of each processor in
+// policies. It must be called before any report is parsed.
+func RegisterAmountPolicies(policies map[domain.Processor]AmountPolicy) {
+	for proc, p := range policies {
+		amountPolicies[proc] = p
+	}
+}
+
+func amountPolicyFor(proc domain.Processor) AmountPolicy {
+	if p, ok := amountPolicies[proc]; ok {
+		return p
+	}
+	return defaultAmountPolicy
+}
+
+// AmountPoliciesFromEnv reads NEGATIVE_AMOUNTS and ZERO_AMOUNTS,
+// comma-separated lists such as "capepay=reject" and "afripay=keep". Each
+// processor named in only one of them keeps the default for the other.
+func AmountPoliciesFromEnv() (map[domain.Processor]AmountPolicy, error) {
+	policies := make(map[domain.Processor]AmountPolicy)
+	err := parsePolicyList("NEGATIVE_AMOUNTS", "refund, adjustment or reject", func(proc domain.Processor, mode string) bool {
+		n := NegativePolicy(mode)
+		if n != NegativeRefund && n != NegativeAdjustment && n != NegativeReject {
+			return false
+		}
+		p := policyOr(policies, proc)
+		p.Negative = n
+		policies[proc] = p
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = parsePolicyList("ZERO_AMOUNTS", "skip, reject or keep", func(proc domain.Processor, mode string) bool {
+		z := ZeroPolicy(mode)
+		if z != ZeroSkip && z != ZeroReject && z != ZeroKeep {
+			return false
+		}
+		p := policyOr(policies, proc)
+		p.Zero = z
+		policies[proc] = p
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return policies, nil
+}
+
+func policyOr(policies map[domain.Processor]AmountPolicy, proc domain.Processor) AmountPolicy {
+	if p, ok := policies[proc]; ok {
+		return p
+	}
+	return defaultAmountPolicy
+}
+
+// parsePolicyList calls set with each processor=mode entry of the
+// variable; set reports whether the mode is valid.
+func parsePolicyList(name, modes string, set func(domain.Processor, string) bool) error {
+	v := os.Getenv(name)
+	if v == "" {
+		return nil
+	}
+	for _, entry := range strings.Split(v, ",") {
+		proc, mode, ok := strings.Cut(strings.TrimSpace(entry), "=")
+		proc = strings.TrimSpace(proc)
+		if !ok || proc == "" || !set(domain.Processor(proc), strings.TrimSpace(mode)) {
+			return fmt.Errorf("invalid %s entry %q: want processor=mode, where mode is %s", name, entry, modes)
+		}
+	}
+	return nil
+}
+
+// applyAmountPolicy classifies the negative payment rows of parsed and drops
+// its zero ones as proc's policy says. Rows the policy rejects are left for
+// checkAmounts, so a preview can still show them.
+func applyAmountPolicy(proc domain.Processor, parsed *ParseResult) {
+	policy := amountPolicyFor(proc)
+	kept := parsed.Records[:0]
+	for _, rec := range parsed.Records {
+		if rec.Adjustment == nil {
+			switch {
+			case rec.GrossAmount < 0 && policy.Negative == NegativeRefund:
+				rec.Adjustment = &domain.RecordAdjustment{Code: negativeCode, Category: domain.CostRefund}
+			case rec.GrossAmount < 0 && policy.Negative == NegativeAdjustment:
+				rec.Adjustment = &domain.RecordAdjustment{Code: negativeCode, Category: domain.CostAdjustment}
+			case rec.GrossAmount == 0 && policy.Zero == ZeroSkip:
+				// Records do not know their line, so the reason names the
+				// reference instead.
+				parsed.skip(0, fmt.Sprintf("record %s has a zero gross amount", rec.ProcessorTransactionID))
+				continue
+			}
+		}
+		kept = append(kept, rec)
+	}
+	parsed.Records = kept
+}
+
+// checkAmounts returns an ErrAmountRejected error naming the first payment
+// row whose negative or zero gross amount proc's policy rejects.
+func checkAmounts(proc domain.Processor, records []domain.SettlementRecord) error {
+	policy := amountPolicyFor(proc)
+	for i := range records {
+		rec := &records[i]
+		if rec.Adjustment != nil {
+			continue
+		}
+		if rec.GrossAmount < 0 && policy.Negative == NegativeReject {
+			return fmt.Errorf("%w: record %s has negative gross amount %.2f %s and %s rejects negative amounts",
+				ErrAmountRejected, rec.ProcessorTransactionID, rec.GrossAmount, rec.Currency, proc)
+		}
+		if rec.GrossAmount == 0 && policy.Zero == ZeroReject {
+			return fmt.Errorf("%w: record %s has a zero gross amount and %s rejects zero amounts",
+				ErrAmountRejected, rec.ProcessorTransactionID, proc)
+		}
+	}
+	return nil
+}
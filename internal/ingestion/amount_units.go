@@ -0,0 +1,75 @@
+package ingestion
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/wakala/reconciler/internal/domain"
+)
+
+// AmountUnit is the unit a processor's reports state amounts in.
+type AmountUnit string
+
+const (
+	// UnitMajor states amounts in the currency's main unit, e.g. 1500.50
+	// naira. It is the default.
+	UnitMajor AmountUnit = "major"
+	// UnitMinor states them in hundredths, e.g. 150050 kobo.
+	UnitMinor AmountUnit = "minor"
+)
+
+// minorPerMajor is the number of minor units in a major one. Every
+// currency settled here has two decimal places.
+const minorPerMajor = 100
+
+// amountUnits is the registry of amount units by processor. It is filled
+// once at startup by RegisterAmountUnits; processors not in it use
+// UnitMajor.
+var amountUnits = map[domain.Processor]AmountUnit{}
+
+// RegisterAmountUnits sets the amount unit of each processor in units. It
+// must be called before any report is parsed.
+func RegisterAmountUnits(units map[domain.Processor]AmountUnit) {
+	for proc, u := range units {
+		amountUnits[proc] = u
+	}
+}
+
+func amountUnitFor(proc domain.Processor) AmountUnit {
+	if u, ok := amountUnits[proc]; ok {
+		return u
+	}
+	return UnitMajor
+}
+
+// AmountUnitsFromEnv reads AMOUNT_UNITS, a comma-separated list such as
+// "nairagateway=minor".
+func AmountUnitsFromEnv() (map[domain.Processor]AmountUnit, error) {
+	units := make(map[domain.Processor]AmountUnit)
+	err := parsePolicyList("AMOUNT_UNITS", "major or minor", func(proc domain.Processor, mode string) bool {
+		u := AmountUnit(mode)
+		if u != UnitMajor && u != UnitMinor {
+			return false
+		}
+		units[proc] = u
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return units, nil
+}
+
+// toMajor converts an amount read from the report into major units. A
+// minor-unit amount that is not a whole number is rounded to the nearest
+// minor unit, half away from zero, with a field_coerced warning.
+func (p *ParseResult) toMajor(line int, field string, v float64) float64 {
+	if p.units != UnitMinor {
+		return v
+	}
+	if whole := math.Round(v); whole != v {
+		p.warn(line, WarnFieldCoerced, fmt.Sprintf("%s %v is not a whole number of minor units; rounded to %.0f", field, v, whole))
+		v = whole
+	}
+	return v / minorPerMajor
+}
@@ -0,0 +1,152 @@
+package ingestion
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/wakala/reconciler/internal/domain"
+)
+
+// NumberFormat is how a processor's CSV files write amounts.
+type NumberFormat string
+
+const (
+	// NumberDot has a decimal point and groups thousands with commas,
+	// spaces or apostrophes: 1,234.56, 1 234.56, 1'234.56. It is the
+	// default.
+	NumberDot NumberFormat = "dot"
+	// NumberComma has a decimal comma and groups thousands with points,
+	// spaces or apostrophes: 1.234,56, 1 234,56.
+	NumberComma NumberFormat = "comma"
+)
+
+// The separators of each format. Non-breaking spaces count as spaces.
+func (f NumberFormat) separators() (decimal byte, groups string) {
+	if f == NumberComma {
+		return ',', ". '"
+	}
+	return '.', ", '"
+}
+
+// numberFormats is the registry of number formats by processor. It is
+// filled once at startup by RegisterNumberFormats; processors not in it use
+// NumberDot.
+var numberFormats = map[domain.Processor]NumberFormat{}
+
+// RegisterNumberFormats sets the number format of each processor in
+// formats. It must be called before any report is parsed.
+func RegisterNumberFormats(formats map[domain.Processor]NumberFormat) {
+	for proc, f := range formats {
+		numberFormats[proc] = f
+	}
+}
+
+func numberFormatFor(proc domain.Processor) NumberFormat {
+	if f, ok := numberFormats[proc]; ok {
+		return f
+	}
+	return NumberDot
+}
+
+// NumberFormatsFromEnv reads AMOUNT_FORMATS, a comma-separated list such as
+// "capepay=comma,afripay=dot".
+func NumberFormatsFromEnv() (map[domain.Processor]NumberFormat, error) {
+	formats := make(map[domain.Processor]NumberFormat)
+	v := os.Getenv("AMOUNT_FORMATS")
+	if v == "" {
+		return formats, nil
+	}
+	for _, entry := range strings.Split(v, ",") {
+		proc, name, ok := strings.Cut(strings.TrimSpace(entry), "=")
+		f := NumberFormat(strings.TrimSpace(name))
+		if !ok || strings.TrimSpace(proc) == "" || (f != NumberDot && f != NumberComma) {
+			return nil, fmt.Errorf("invalid AMOUNT_FORMATS entry %q: want processor=dot or processor=comma", entry)
+		}
+		formats[domain.Processor(strings.TrimSpace(proc))] = f
+	}
+	return formats, nil
+}
+
+// parse reads an amount written in f. Negatives may be written with a
+// leading or trailing minus or in parentheses. Thousands separators must
+// group every three digits, so a file in the other format, where 1234,56
+// would otherwise read as 123456, is refused rather than misread. read is
+// the amount as it was read, e.g. -1234.56, or "" when s needed none of this
+// because it is digits with at most a leading minus and the decimal
+// separator.
+func (f NumberFormat) parse(s string) (v float64, read string, err error) {
+	decimal, groups := f.separators()
+	invalid := func(why string) error {
+		return fmt.Errorf("invalid amount %q: %s (%s number format)", s, why, f)
+	}
+
+	t := strings.NewReplacer("\u00a0", " ", "\u202f", " ").Replace(strings.TrimSpace(s))
+	plain := true
+	neg := false
+	if strings.HasPrefix(t, "(") && strings.HasSuffix(t, ")") {
+		neg, plain = true, false
+		t = strings.TrimSpace(t[1 : len(t)-1])
+	}
+	switch {
+	case strings.HasPrefix(t, "-"):
+		neg = !neg
+		t = t[1:]
+	case strings.HasPrefix(t, "+"):
+		plain = false
+		t = t[1:]
+	case strings.HasSuffix(t, "-"):
+		neg, plain = !neg, false
+		t = t[:len(t)-1]
+	}
+
+	intPart, frac, hasDecimal := strings.Cut(t, string(decimal))
+	if strings.IndexByte(frac, decimal) >= 0 {
+		return 0, "", invalid("more than one decimal separator")
+	}
+	if !allDigits(frac) {
+		return 0, "", invalid("not a number")
+	}
+
+	if sep := strings.IndexAny(intPart, groups); sep >= 0 {
+		plain = false
+		parts := strings.Split(intPart, intPart[sep:sep+1])
+		for i, p := range parts {
+			if !allDigits(p) || p == "" || len(p) > 3 || (i > 0 && len(p) != 3) {
+				return 0, "", invalid("misplaced thousands separator")
+			}
+		}
+		intPart = strings.Join(parts, "")
+	} else if !allDigits(intPart) {
+		return 0, "", invalid("not a number")
+	}
+	if intPart == "" && frac == "" {
+		return 0, "", invalid("no digits")
+	}
+
+	read = intPart
+	if hasDecimal {
+		read += "." + frac
+	}
+	if neg {
+		read = "-" + read
+	}
+	v, err = strconv.ParseFloat(read, 64)
+	if err != nil {
+		return 0, "", invalid(err.Error())
+	}
+	if plain {
+		read = ""
+	}
+	return v, read, nil
+}
+
+func allDigits(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return false
+		}
+	}
+	return true
+}
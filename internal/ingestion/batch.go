@@ -0,0 +1,200 @@
+package ingestion
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/wakala/reconciler/internal/reconciliation"
+)
+
+// BatchFile is one report of a batch ingest.
+type BatchFile struct {
+	Filename  string
+	Processor string
+	Format    string
+	Data      []byte
+	Sidecars  []Sidecar
+}
+
+// BatchFileResult is the outcome of one file of a batch ingest. Exactly one
+// of Result and Error is set.
+type BatchFileResult struct {
+	Filename  string        `json:"filename,omitempty"`
+	Processor string        `json:"processor"`
+	Format    string        `json:"format"`
+	Result    *IngestResult `json:"result,omitempty"`
+	Error     string        `json:"error,omitempty"`
+}
+
+// BatchIngestResult is the outcome of a batch ingest. Reconciled is false
+// when no file stored anything new, so there was nothing to reconcile.
+type BatchIngestResult struct {
+	Files                 []BatchFileResult `json:"files"`
+	ReportsIngested       int               `json:"reports_ingested"`
+	RecordsIngested       int               `json:"records_ingested"`
+	Failed                int               `json:"failed"`
+	Reconciled            bool              `json:"reconciled"`
+	DiscrepanciesDetected int               `json:"discrepancies_detected"`
+}
+
+// IngestBatch ingests files one after another and reconciles once at the
+// end, rather than after every file. A file that fails is reported and does
+// not stop the others. Backfill batches are reconciled as of the latest
+// settlement date across the files stored, within the files' scope.
+func (s *Service) IngestBatch(files []BatchFile, opts IngestOptions) (*BatchIngestResult, error) {
+	opts.skipReconcile = true
+
+	out := &BatchIngestResult{Files: make([]BatchFileResult, 0, len(files))}
+	var asOf *time.Time
+	var reportIDs []string
+	for _, f := range files {
+		fr := BatchFileResult{Filename: f.Filename, Processor: f.Processor, Format: f.Format}
+		fileOpts := opts
+		fileOpts.Filename = f.Filename
+		fileOpts.Sidecars = f.Sidecars
+		res, err := s.IngestReport(f.Data, f.Processor, f.Format, fileOpts)
+		if err != nil {
+			fr.Error = err.Error()
+			out.Failed++
+			out.Files = append(out.Files, fr)
+			continue
+		}
+		fr.Result = res
+		out.Files = append(out.Files, fr)
+
+		for _, stored := range res.stored() {
+			out.ReportsIngested++
+			out.RecordsIngested += stored.RecordsIngested
+			reportIDs = append(reportIDs, stored.ReportID)
+			if m := stored.Metrics; m != nil && m.MaxSettlementDate != nil && (asOf == nil || m.MaxSettlementDate.After(*asOf)) {
+				asOf = m.MaxSettlementDate
+			}
+		}
+	}
+
+	if out.ReportsIngested == 0 {
+		return out, nil
+	}
+
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+
+	var reconResult *reconciliation.ReconciliationResult
+	var err error
+	if opts.Backfill {
+		reconResult, err = s.reconcileBackfill(reportIDs, asOf)
+	} else {
+		reconResult, err = s.reconSvc.RunFullReconciliation()
+	}
+	if err != nil {
+		return out, fmt.Errorf("reconcile: %w", err)
+	}
+	if reconResult == nil {
+		return out, nil
+	}
+	out.Reconciled = true
+	out.DiscrepanciesDetected = reconResult.TotalDiscrepancies
+
+	log.Printf("[ingestion] Batch ingest: %d of %d files stored (%d records), %d failed, %d discrepancies",
+		out.ReportsIngested, len(files), out.RecordsIngested, out.Failed, out.DiscrepanciesDetected)
+	return out, nil
+}
+
+// multiBatchReportID is the ReportID of the result of an upload that held
+// several batches, each stored as its own report.
+const multiBatchReportID = "multi-batch"
+
+// stored returns the results of the reports r stored: r itself, or for a
+// multi-batch upload the batches that were stored. Reports already ingested
+// or held for approval stored nothing.
+func (r *IngestResult) stored() []*IngestResult {
+	results := []*IngestResult{r}
+	if r.ReportID == multiBatchReportID {
+		results = r.Reports
+	}
+	var stored []*IngestResult
+	for _, res := range results {
+		if res.ReportID != "already-ingested" && res.PendingAdjustmentID == "" {
+			stored = append(stored, res)
+		}
+	}
+	return stored
+}
+
+// ingestBatches stores each batch of a multi-batch upload as its own report,
+// in file order, and then reconciles once, as a single report would. A batch
+// that fails stops the upload; the batches before it stay stored, and since
+// each is deduped by its own hash, uploading the file again stores the rest.
+func (s *Service) ingestBatches(parts [][]byte, processor, format string, opts IngestOptions) (*IngestResult, error) {
+	partOpts := opts
+	partOpts.skipReconcile = true
+
+	out := &IngestResult{ReportID: multiBatchReportID, Backfill: opts.Backfill}
+	for i, part := range parts {
+		res, err := s.IngestReport(part, processor, format, partOpts)
+		if err != nil {
+			return nil, fmt.Errorf("batch %d of %d: %w (%d batches before it were stored)", i+1, len(parts), err, i)
+		}
+		out.Reports = append(out.Reports, res)
+		out.RecordsIngested += res.RecordsIngested
+		out.DuplicatesSkipped += res.DuplicatesSkipped
+		out.AlertsRaised += res.AlertsRaised
+	}
+
+	stored := out.stored()
+	if len(stored) == 0 || opts.skipReconcile {
+		return out, nil
+	}
+	var asOf *time.Time
+	reportIDs := make([]string, len(stored))
+	for i, res := range stored {
+		reportIDs[i] = res.ReportID
+		if m := res.Metrics; m != nil && m.MaxSettlementDate != nil && (asOf == nil || m.MaxSettlementDate.After(*asOf)) {
+			asOf = m.MaxSettlementDate
+		}
+	}
+
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+
+	var reconResult *reconciliation.ReconciliationResult
+	var err error
+	switch {
+	case !opts.Backfill && opts.approvedAdjustment == "" && s.reconSvc.RequestRun():
+		out.ReconciliationDeferred = true
+	case opts.Backfill:
+		reconResult, err = s.reconcileBackfill(reportIDs, asOf)
+	default:
+		reconResult, err = s.reconSvc.RunFullReconciliation()
+	}
+	if err != nil {
+		log.Printf("[ingestion] WARNING: reconciliation failed: %v", err)
+	}
+	if reconResult != nil {
+		out.DiscrepanciesDetected = reconResult.TotalDiscrepancies
+	}
+	log.Printf("[ingestion] Multi-batch upload from %s: %d of %d batches stored (%d records)",
+		processor, len(stored), len(parts), out.RecordsIngested)
+	return out, nil
+}
+
+// reconcileBackfill reconciles the reports a backfill stored as of asOf,
+// within their scope (see SettlementRepo.GetReportScope) and without
+// notifications, so the open discrepancies of other processors and dates
+// are left as they are. It returns nil, reconciling nothing, when the
+// reports stored no records (asOf is then nil too). A backfill never falls
+// back to a live run.
+func (s *Service) reconcileBackfill(reportIDs []string, asOf *time.Time) (*reconciliation.ReconciliationResult, error) {
+	if asOf == nil {
+		return nil, nil
+	}
+	scope, ok, err := s.settlementRepo.GetReportScope(reportIDs)
+	if err != nil {
+		return nil, fmt.Errorf("backfill scope: %w", err)
+	}
+	if !ok {
+		return nil, nil
+	}
+	return s.reconSvc.RunBackfillReconciliation(scope, *asOf)
+}
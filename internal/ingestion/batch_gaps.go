@@ -0,0 +1,108 @@
+package ingestion
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/wakala/reconciler/internal/domain"
+)
+
+// batchSeqPattern splits a sequential batch ID such as KE-BATCH-007 into its
+// prefix and number. Generated IDs (BATCH-<unix nanos>) have far more digits
+// and are deliberately not matched.
+var batchSeqPattern = regexp.MustCompile(`^(.*\D)(\d{1,6})$`)
+
+// maxGapAlertsPerRun bounds how many missing batches are alerted in one pass,
+// so a typo'd batch number cannot flood the alert list.
+const maxGapAlertsPerRun = 50
+
+type batchSeq struct {
+	width int
+	nums  map[int]bool
+}
+
+// checkBatchGaps looks at every batch ID seen for a processor and raises a
+// BATCH_GAP alert for each sequence number skipped between the lowest and
+// highest seen. Alerts for batches that have since arrived are resolved.
+// It returns the number of new alerts raised.
+func (s *Service) checkBatchGaps(processor domain.Processor) (int, error) {
+	ids, err := s.settlementRepo.GetBatchIDs(string(processor))
+	if err != nil {
+		return 0, fmt.Errorf("get batch ids: %w", err)
+	}
+
+	seqs := make(map[string]*batchSeq)
+	for _, id := range ids {
+		m := batchSeqPattern.FindStringSubmatch(id)
+		if m == nil {
+			continue
+		}
+		n, _ := strconv.Atoi(m[2])
+		seq, ok := seqs[m[1]]
+		if !ok {
+			seq = &batchSeq{width: len(m[2]), nums: make(map[int]bool)}
+			seqs[m[1]] = seq
+		}
+		seq.nums[n] = true
+	}
+
+	now := time.Now().UTC()
+	raised := 0
+	for prefix, seq := range seqs {
+		nums := make([]int, 0, len(seq.nums))
+		for n := range seq.nums {
+			nums = append(nums, n)
+		}
+		sort.Ints(nums)
+
+		// A batch that arrived late resolves its earlier gap alert.
+		for _, n := range nums {
+			batchID := fmt.Sprintf("%s%0*d", prefix, seq.width, n)
+			if err := s.alertRepo.Resolve(batchGapAlertID(processor, batchID), now); err != nil {
+				return raised, fmt.Errorf("resolve alert: %w", err)
+			}
+		}
+
+		for n := nums[0] + 1; n < nums[len(nums)-1]; n++ {
+			if seq.nums[n] {
+				continue
+			}
+			if raised >= maxGapAlertsPerRun {
+				log.Printf("[ingestion] WARNING: more than %d batch gaps for %s, not alerting the rest",
+					maxGapAlertsPerRun, processor)
+				return raised, nil
+			}
+
+			batchID := fmt.Sprintf("%s%0*d", prefix, seq.width, n)
+			alert := &domain.Alert{
+				ID:        batchGapAlertID(processor, batchID),
+				Type:      domain.AlertBatchGap,
+				Processor: processor,
+				Severity:  domain.SeverityHigh,
+				Reference: batchID,
+				Message: fmt.Sprintf(
+					"Batch %s from %s was never received (sequence gap between %s%0*d and %s%0*d)",
+					batchID, processor, prefix, seq.width, nums[0], prefix, seq.width, nums[len(nums)-1]),
+				CreatedAt: now,
+			}
+			created, err := s.alertRepo.Insert(alert)
+			if err != nil {
+				return raised, fmt.Errorf("insert alert: %w", err)
+			}
+			if created {
+				log.Printf("[ingestion] ALERT: %s", alert.Message)
+				raised++
+			}
+		}
+	}
+
+	return raised, nil
+}
+
+func batchGapAlertID(processor domain.Processor, batchID string) string {
+	return fmt.Sprintf("ALERT-BG-%s-%s", processor, batchID)
+}
@@ -0,0 +1,102 @@
+package ingestion
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/wakala/reconciler/internal/domain"
+)
+
+// checkCarriedBalances walks a processor's batch balances and raises a
+// NEGATIVE_BALANCE alert for the batch that opened a balance still carried,
+// and a BALANCE_OVER_DEDUCTED alert for each batch that deducted more than
+// was owed. Alerts whose condition has cleared are resolved. It returns the
+// number of new alerts raised.
+func (s *Service) checkCarriedBalances(processor domain.Processor) (int, error) {
+	balances, err := s.settlementRepo.GetBatchBalances(string(processor))
+	if err != nil {
+		return 0, fmt.Errorf("get batch balances: %w", err)
+	}
+
+	now := time.Now().UTC()
+	raised := 0
+	insert := func(a *domain.Alert) error {
+		created, err := s.alertRepo.Insert(a)
+		if err != nil {
+			return fmt.Errorf("insert alert: %w", err)
+		}
+		if created {
+			log.Printf("[ingestion] ALERT: %s", a.Message)
+			raised++
+		}
+		return nil
+	}
+
+	// opened is the batch that took each currency's balance negative, while
+	// the balance is still carried.
+	opened := make(map[string]domain.BatchBalance)
+	for _, b := range balances {
+		if b.OverDeducted > 0 {
+			err = insert(&domain.Alert{
+				ID:        overDeductedAlertID(processor, b.BatchID),
+				Type:      domain.AlertBalanceOverDeducted,
+				Processor: processor,
+				Severity:  domain.SeverityHigh,
+				Reference: b.BatchID,
+				Message: fmt.Sprintf(
+					"Batch %s from %s deducted %s %.2f for a carried balance of %s %.2f, %.2f more than was owed",
+					b.BatchID, processor, b.Currency, b.Deducted, b.Currency, -b.CarriedIn, b.OverDeducted),
+				CreatedAt: now,
+			})
+		} else if err = s.alertRepo.Resolve(overDeductedAlertID(processor, b.BatchID), now); err != nil {
+			err = fmt.Errorf("resolve alert: %w", err)
+		}
+		if err != nil {
+			return raised, err
+		}
+
+		switch {
+		case b.CarriedOut == 0:
+			delete(opened, b.Currency)
+		case b.CarriedIn == 0:
+			opened[b.Currency] = b
+		}
+	}
+
+	// A balance paid off resolves the alert of the batch that opened it.
+	for _, b := range balances {
+		if o, ok := opened[b.Currency]; ok && o.BatchID == b.BatchID {
+			continue
+		}
+		if err := s.alertRepo.Resolve(negativeBalanceAlertID(processor, b.BatchID), now); err != nil {
+			return raised, fmt.Errorf("resolve alert: %w", err)
+		}
+	}
+	for currency, o := range opened {
+		err := insert(&domain.Alert{
+			ID:        negativeBalanceAlertID(processor, o.BatchID),
+			Type:      domain.AlertNegativeBalance,
+			Processor: processor,
+			Severity:  domain.SeverityMedium,
+			Reference: o.BatchID,
+			Message: fmt.Sprintf(
+				"Batch %s from %s netted %s %.2f below zero; the processor carries it forward and deducts it from later payouts",
+				o.BatchID, processor, currency, -o.CarriedOut),
+			CreatedAt: now,
+		})
+		if err != nil {
+			return raised, err
+		}
+	}
+
+	return raised, nil
+}
+
+func overDeductedAlertID(processor domain.Processor, batchID string) string {
+	return fmt.Sprintf("ALERT-OD-%s-%s", processor, batchID)
+}
+
+func negativeBalanceAlertID(processor domain.Processor, batchID string) string {
+	return fmt.Sprintf("ALERT-NB-%s-%s", processor, batchID)
+}
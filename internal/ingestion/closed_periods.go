@@ -0,0 +1,148 @@
+package ingestion
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/wakala/reconciler/internal/domain"
+)
+
+// heldReport is the payload of an ingest adjustment: the parsed report,
+// exactly as it would have been stored.
+type heldReport struct {
+	ReportID  string                    `json:"report_id"`
+	Processor domain.Processor          `json:"processor"`
+	BatchID   string                    `json:"batch_id"`
+	Records   []domain.SettlementRecord `json:"records"`
+	Warnings  []domain.ReportWarning    `json:"warnings"`
+	Backfill  bool                      `json:"backfill"`
+	// Source is the uploaded file, stored with the report on approval.
+	Source        []byte                     `json:"source,omitempty"`
+	SourceName    string                     `json:"source_name,omitempty"`
+	Provenance    *domain.ReportProvenance   `json:"provenance,omitempty"`
+	Verification  *domain.ReportVerification `json:"verification,omitempty"`
+	ControlTotals *domain.ControlTotals      `json:"control_totals,omitempty"`
+}
+
+// holdForClosedPeriods queues the report as a pending adjustment if any of
+// its records settle in a closed period, and returns the result to report
+// instead of storing it. It returns nil when every period is open. A file
+// already waiting returns its existing adjustment.
+func (s *Service) holdForClosedPeriods(
+	hash, reportID string,
+	proc domain.Processor,
+	parsed *ParseResult,
+	metrics *IngestMetrics,
+	opts IngestOptions,
+) (*IngestResult, error) {
+	inPeriod := make(map[string]int)
+	for _, rec := range parsed.Records {
+		inPeriod[domain.PeriodOf(rec.SettlementDate)]++
+	}
+	periods := make([]string, 0, len(inPeriod))
+	for p := range inPeriod {
+		periods = append(periods, p)
+	}
+	closed, err := s.periodRepo.ClosedAmong(periods)
+	if err != nil || len(closed) == 0 {
+		return nil, err
+	}
+
+	held := &IngestResult{
+		ReportID:      "pending-approval",
+		BatchID:       parsed.BatchID,
+		ClosedPeriods: closed,
+		Backfill:      opts.Backfill,
+		Metrics:       metrics,
+	}
+
+	existing, err := s.periodRepo.FindPendingAdjustment(domain.AdjustmentIngest, hash)
+	if err == nil {
+		held.PendingAdjustmentID = existing.ID
+		return held, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
+
+	rep := heldReport{
+		ReportID:      reportID,
+		Processor:     proc,
+		BatchID:       parsed.BatchID,
+		Records:       parsed.Records,
+		Warnings:      parsed.Warnings,
+		Backfill:      opts.Backfill,
+		Provenance:    opts.Provenance,
+		Verification:  opts.verification,
+		ControlTotals: parsed.ControlTotals,
+	}
+	if opts.source != nil {
+		rep.Source, rep.SourceName = opts.source.Data, opts.source.Filename
+	}
+	payload, err := json.Marshal(rep)
+	if err != nil {
+		return nil, err
+	}
+
+	inClosed := 0
+	for _, p := range closed {
+		inClosed += inPeriod[p]
+	}
+	summary := fmt.Sprintf("%s report with %d records, %d of them in closed %s",
+		proc, len(parsed.Records), inClosed, strings.Join(closed, ", "))
+	if parsed.BatchID != "" {
+		summary += ", batch " + parsed.BatchID
+	}
+
+	adj := &domain.PendingAdjustment{
+		ID:        fmt.Sprintf("ADJ-%d", time.Now().UnixNano()),
+		Kind:      domain.AdjustmentIngest,
+		Reference: hash,
+		Periods:   closed,
+		Summary:   summary,
+		Status:    domain.AdjustmentPending,
+		CreatedAt: time.Now().UTC().Truncate(time.Second),
+		Payload:   payload,
+	}
+	if err := s.periodRepo.InsertAdjustment(adj); err != nil {
+		return nil, err
+	}
+	log.Printf("[ingestion] Held %s for approval as %s: %s", reportID, adj.ID, summary)
+
+	held.PendingAdjustmentID = adj.ID
+	return held, nil
+}
+
+// ApplyHeldReport stores a report that was held back by a closed period,
+// once its adjustment has been approved.
+func (s *Service) ApplyHeldReport(adj *domain.PendingAdjustment) (*IngestResult, error) {
+	var rep heldReport
+	if err := json.Unmarshal(adj.Payload, &rep); err != nil {
+		return nil, fmt.Errorf("adjustment %s payload: %w", adj.ID, err)
+	}
+
+	parsed := &ParseResult{
+		Records: rep.Records, BatchID: rep.BatchID, Warnings: rep.Warnings, ControlTotals: rep.ControlTotals,
+	}
+	opts := IngestOptions{
+		Backfill:           rep.Backfill,
+		Provenance:         rep.Provenance,
+		verification:       rep.Verification,
+		approvedAdjustment: adj.ID,
+	}
+	if len(rep.Source) > 0 {
+		opts.source = &domain.ReportFile{
+			Hash:     fmt.Sprintf("%x", sha256.Sum256(rep.Source)),
+			Filename: rep.SourceName,
+			Size:     len(rep.Source),
+			Data:     rep.Source,
+		}
+	}
+	return s.store(adj.Reference, rep.ReportID, rep.Processor, parsed, computeMetrics(parsed, 0), opts)
+}
@@ -0,0 +1,99 @@
+package ingestion
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/wakala/reconciler/internal/domain"
+)
+
+// totalsMarker is the ID column value of a report's footer totals row.
+const totalsMarker = "TOTAL"
+
+// isTotalsRow reports whether row is a footer totals row: its idColumn,
+// which it may be too short to hold every other column, reads TOTAL.
+func isTotalsRow(cols *csvColumns, row []string, idColumn string) bool {
+	i := cols.index[idColumn]
+	return i < len(row) && strings.EqualFold(strings.TrimSpace(row[i]), totalsMarker)
+}
+
+// readControlTotals reads the declared gross, fee and net of a footer
+// totals row; the fee is the sum of its fee columns. A row too short to hold them, or a second totals row, is
+// skipped; an amount that cannot be read fails the file, as it does in a
+// record.
+func (p *ParseResult) readControlTotals(line int, cols *csvColumns, row []string, gross string, fees []feeColumn, net string) error {
+	if p.ControlTotals != nil {
+		p.skip(line, fmt.Sprintf("second totals row; the totals on line %d are used", p.ControlTotals.Line))
+		return nil
+	}
+	if !cols.fits(row) {
+		p.skip(line, "totals row: "+cols.shortRow(row))
+		return nil
+	}
+	ct := &domain.ControlTotals{Line: line}
+	var err error
+	if ct.Gross, err = p.parseAmount(line, "total gross", cols.field(row, gross)); err != nil {
+		return fmt.Errorf("line %d total gross: %w", line, err)
+	}
+	if ct.Fee, _, err = p.readFees(line, "total fee", cols, row, fees); err != nil {
+		return fmt.Errorf("line %d %w", line, err)
+	}
+	if ct.Net, err = p.parseAmount(line, "total net", cols.field(row, net)); err != nil {
+		return fmt.Errorf("line %d total net: %w", line, err)
+	}
+	p.ControlTotals = ct
+	return nil
+}
+
+// checkControlTotals sums the parsed records into the control totals and
+// warns, on the totals row, when they differ from the declared ones. Rows
+// that were skipped are not in the sums, so a footer also catches records
+// lost to malformed lines.
+func (p *ParseResult) checkControlTotals() {
+	ct := p.ControlTotals
+	if ct == nil {
+		return
+	}
+	ct.ParsedGross, ct.ParsedFee, ct.ParsedNet = 0, 0, 0
+	for i := range p.Records {
+		ct.ParsedGross += p.Records[i].GrossAmount
+		ct.ParsedFee += p.Records[i].FeeAmount
+		ct.ParsedNet += p.Records[i].NetAmount
+	}
+	ct.ParsedGross, ct.ParsedFee, ct.ParsedNet = round2(ct.ParsedGross), round2(ct.ParsedFee), round2(ct.ParsedNet)
+	ct.Matched = round2(ct.Gross) == ct.ParsedGross &&
+		round2(ct.Fee) == ct.ParsedFee &&
+		round2(ct.Net) == ct.ParsedNet
+	if !ct.Matched {
+		p.warn(ct.Line, WarnControlTotalMismatch, fmt.Sprintf(
+			"declared totals gross %.2f, fee %.2f, net %.2f; the %d records parsed sum to gross %.2f, fee %.2f, net %.2f",
+			ct.Gross, ct.Fee, ct.Net, len(p.Records), ct.ParsedGross, ct.ParsedFee, ct.ParsedNet))
+	}
+}
+
+// alertControlTotals raises a CONTROL_TOTAL_MISMATCH alert for a stored
+// report whose records do not add up to its footer's totals, and reports
+// whether it raised one.
+func (s *Service) alertControlTotals(proc domain.Processor, reportID, batchID string, ct *domain.ControlTotals) (bool, error) {
+	alert := &domain.Alert{
+		ID:        "ALERT-CT-" + reportID,
+		Type:      domain.AlertControlTotalMismatch,
+		Processor: proc,
+		Severity:  domain.SeverityHigh,
+		Reference: reportID,
+		Message: fmt.Sprintf(
+			"Report %s (batch %s) from %s declares net %.2f but its records sum to %.2f (gross %.2f vs %.2f, fee %.2f vs %.2f)",
+			reportID, batchID, proc, ct.Net, ct.ParsedNet, ct.Gross, ct.ParsedGross, ct.Fee, ct.ParsedFee),
+		CreatedAt: time.Now().UTC(),
+	}
+	created, err := s.alertRepo.Insert(alert)
+	if err != nil {
+		return false, fmt.Errorf("insert alert: %w", err)
+	}
+	if created {
+		log.Printf("[ingestion] ALERT: %s", alert.Message)
+	}
+	return created, nil
+}
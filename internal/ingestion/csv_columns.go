@@ -0,0 +1,68 @@
+package ingestion
+
+import (
+	"fmt"
+	"strings"
+)
+
+// csvColumns locates a CSV report's columns by header name, so processors
+// may reorder columns or add their own without values landing in the wrong
+// field. Names are compared case-insensitively.
+type csvColumns struct {
+	index map[string]int
+	// width is the number of fields a row needs to hold every required
+	// column.
+	width int
+}
+
+// readColumns indexes header and checks that it has each of the required
+// columns exactly once. Other columns are ignored.
+func readColumns(header []string, required ...string) (*csvColumns, error) {
+	cols := &csvColumns{index: make(map[string]int, len(header))}
+	seen := make(map[string]int, len(header))
+	for i, name := range header {
+		name = strings.ToLower(strings.TrimSpace(name))
+		seen[name]++
+		cols.index[name] = i
+	}
+	var missing []string
+	for _, name := range required {
+		switch seen[name] {
+		case 0:
+			missing = append(missing, fmt.Sprintf("%q", name))
+		case 1:
+			cols.width = max(cols.width, cols.index[name]+1)
+		default:
+			return nil, fmt.Errorf("column %q appears %d times in the header", name, seen[name])
+		}
+	}
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("missing column %s", strings.Join(missing, ", "))
+	}
+	return cols, nil
+}
+
+// fits reports whether row has every required column.
+func (c *csvColumns) fits(row []string) bool {
+	return len(row) >= c.width
+}
+
+// shortRow is the skip reason for a row that does not fit.
+func (c *csvColumns) shortRow(row []string) string {
+	return fmt.Sprintf("expected %d columns, got %d", c.width, len(row))
+}
+
+// field returns the trimmed value of a required column in a row that fits.
+func (c *csvColumns) field(row []string, name string) string {
+	return strings.TrimSpace(row[c.index[name]])
+}
+
+// optional returns the trimmed value of a column the header may not have,
+// and whether the header and row have it.
+func (c *csvColumns) optional(row []string, name string) (string, bool) {
+	i, ok := c.index[name]
+	if !ok || i >= len(row) {
+		return "", false
+	}
+	return strings.TrimSpace(row[i]), true
+}
@@ -0,0 +1,130 @@
+package ingestion
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/wakala/reconciler/internal/domain"
+	"github.com/wakala/reconciler/internal/pgp"
+)
+
+// decryptionKeys is the registry of PGP secret keys by processor. It is
+// filled once at startup by RegisterDecryptionKeys.
+var decryptionKeys = map[domain.Processor]*pgp.KeyRing{}
+
+// RegisterDecryptionKeys makes PGP-encrypted reports of each processor in
+// keys decryptable. It must be called before any report is ingested.
+func RegisterDecryptionKeys(keys map[domain.Processor]*pgp.KeyRing) {
+	for proc, kr := range keys {
+		decryptionKeys[proc] = kr
+	}
+}
+
+// DecryptionKeyProcessors returns the processors with a decryption key,
+// sorted.
+func DecryptionKeyProcessors() []domain.Processor {
+	procs := make([]domain.Processor, 0, len(decryptionKeys))
+	for proc := range decryptionKeys {
+		procs = append(procs, proc)
+	}
+	sort.Slice(procs, func(i, j int) bool { return procs[i] < procs[j] })
+	return procs
+}
+
+// DecryptionKeyIDs returns the IDs of proc's decryption keys.
+func DecryptionKeyIDs(proc domain.Processor) []string {
+	if kr, ok := decryptionKeys[proc]; ok {
+		return kr.KeyIDs()
+	}
+	return nil
+}
+
+// DecryptionKeysFromEnv reads PGP_KEY_FILES, a comma-separated list such as
+// "capepay=/run/secrets/capepay.asc" of secret key exports, and
+// PGP_PASSPHRASE_FILES, a list of the same form naming the files holding
+// the passphrases of protected keys.
+func DecryptionKeysFromEnv() (map[domain.Processor]*pgp.KeyRing, error) {
+	keyFiles, err := processorFiles("PGP_KEY_FILES")
+	if err != nil {
+		return nil, err
+	}
+	passFiles, err := processorFiles("PGP_PASSPHRASE_FILES")
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make(map[domain.Processor]*pgp.KeyRing, len(keyFiles))
+	for proc, path := range keyFiles {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("PGP key for %s: %w", proc, err)
+		}
+		var passphrase []byte
+		if passPath, ok := passFiles[proc]; ok {
+			p, err := os.ReadFile(passPath)
+			if err != nil {
+				return nil, fmt.Errorf("PGP passphrase for %s: %w", proc, err)
+			}
+			passphrase = []byte(strings.TrimRight(string(p), "\r\n"))
+		}
+		kr, err := pgp.ReadKeyRing(data, passphrase)
+		if err != nil {
+			return nil, fmt.Errorf("PGP key for %s: %s: %w", proc, path, err)
+		}
+		keys[proc] = kr
+	}
+	for proc := range passFiles {
+		if _, ok := keyFiles[proc]; !ok {
+			return nil, fmt.Errorf("PGP_PASSPHRASE_FILES names %s, which has no entry in PGP_KEY_FILES", proc)
+		}
+	}
+	return keys, nil
+}
+
+// processorFiles reads a processor=path list from the named variable.
+func processorFiles(name string) (map[domain.Processor]string, error) {
+	files := make(map[domain.Processor]string)
+	v := os.Getenv(name)
+	if v == "" {
+		return files, nil
+	}
+	for _, entry := range strings.Split(v, ",") {
+		proc, path, ok := strings.Cut(strings.TrimSpace(entry), "=")
+		proc, path = strings.TrimSpace(proc), strings.TrimSpace(path)
+		if !ok || proc == "" || path == "" {
+			return nil, fmt.Errorf("invalid %s entry %q: want processor=path", name, entry)
+		}
+		files[domain.Processor(proc)] = path
+	}
+	return files, nil
+}
+
+// decryptReport returns data decrypted with proc's key when it is a PGP
+// message, and data itself otherwise, reporting whether it was encrypted.
+func decryptReport(proc domain.Processor, data []byte) ([]byte, bool, error) {
+	if !pgp.IsEncrypted(data) {
+		return data, false, nil
+	}
+	kr, ok := decryptionKeys[proc]
+	if !ok {
+		return nil, true, fmt.Errorf("report is PGP-encrypted, but no decryption key is configured for %s", proc)
+	}
+	plain, err := kr.Decrypt(data)
+	if err != nil {
+		return nil, true, fmt.Errorf("decrypt report: %w", err)
+	}
+	return plain, true, nil
+}
+
+// decryptedFilename drops the extension an encrypting tool adds, so
+// "settlement.csv.pgp" is stored as "settlement.csv".
+func decryptedFilename(name string) string {
+	for _, ext := range []string{".pgp", ".gpg", ".asc"} {
+		if len(name) > len(ext) && strings.EqualFold(name[len(name)-len(ext):], ext) {
+			return name[:len(name)-len(ext)]
+		}
+	}
+	return name
+}
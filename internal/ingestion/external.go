@@ -0,0 +1,325 @@
+package ingestion
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/wakala/reconciler/internal/currency"
+	"github.com/wakala/reconciler/internal/domain"
+)
+
+// FormatExternal is the format of reports parsed by the processor's
+// registered external parser.
+const FormatExternal = "external"
+
+// ExternalParser is a partner-supplied parser binary. It is run once per
+// report with the file on stdin and must write one normalized
+// SettlementRecord per line to stdout as JSON (NDJSON), then exit 0. The
+// report ID and processor are passed in WAKALA_REPORT_ID and
+// WAKALA_PROCESSOR. Its environment holds only those, PATH, TMPDIR and the
+// server's own WAKALA_* variables, so none of the server's secrets reach
+// it. It runs in a fresh temporary directory, which is also its TMPDIR and
+// is removed afterwards, and on Unix under a CPU time limit besides the
+// wall-clock Timeout. Anything written to stderr is included in the error
+// if the parser fails.
+type ExternalParser struct {
+	Command  string
+	Args     []string
+	Timeout  time.Duration
+	CPULimit time.Duration
+}
+
+func (p ExternalParser) String() string {
+	return strings.Join(append([]string{p.Command}, p.Args...), " ")
+}
+
+// externalParsers is the registry of external parsers by processor. It is
+// filled once at startup by RegisterExternalParsers.
+var externalParsers = map[domain.Processor]ExternalParser{}
+
+// RegisterExternalParsers makes format "external" available for each
+// processor in parsers. It must be called before any report is parsed.
+func RegisterExternalParsers(parsers map[domain.Processor]ExternalParser) {
+	for proc, p := range parsers {
+		externalParsers[proc] = p
+	}
+}
+
+// HasExternalParser reports whether proc has a registered external parser.
+func HasExternalParser(proc domain.Processor) bool {
+	_, ok := externalParsers[proc]
+	return ok
+}
+
+// ExternalParserProcessors returns the processors with an external parser,
+// sorted.
+func ExternalParserProcessors() []domain.Processor {
+	procs := make([]domain.Processor, 0, len(externalParsers))
+	for proc := range externalParsers {
+		procs = append(procs, proc)
+	}
+	sort.Slice(procs, func(i, j int) bool { return procs[i] < procs[j] })
+	return procs
+}
+
+// ExternalParsersFromEnv reads EXTERNAL_PARSERS, a comma-separated list such
+// as "capepay=/opt/parsers/capepay --strict", EXTERNAL_PARSER_TIMEOUT (a Go
+// duration, default 1m) and EXTERNAL_PARSER_CPU_LIMIT (a Go duration,
+// default 30s).
+func ExternalParsersFromEnv() (map[domain.Processor]ExternalParser, error) {
+	timeout := time.Minute
+	if v := os.Getenv("EXTERNAL_PARSER_TIMEOUT"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("EXTERNAL_PARSER_TIMEOUT must be a positive duration, got %q", v)
+		}
+		timeout = d
+	}
+	cpuLimit := 30 * time.Second
+	if v := os.Getenv("EXTERNAL_PARSER_CPU_LIMIT"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("EXTERNAL_PARSER_CPU_LIMIT must be a positive duration, got %q", v)
+		}
+		cpuLimit = d
+	}
+
+	parsers := make(map[domain.Processor]ExternalParser)
+	v := os.Getenv("EXTERNAL_PARSERS")
+	if v == "" {
+		return parsers, nil
+	}
+	for _, entry := range strings.Split(v, ",") {
+		proc, cmd, ok := strings.Cut(strings.TrimSpace(entry), "=")
+		fields := strings.Fields(cmd)
+		if !ok || strings.TrimSpace(proc) == "" || len(fields) == 0 {
+			return nil, fmt.Errorf("invalid EXTERNAL_PARSERS entry %q", entry)
+		}
+		parsers[domain.Processor(strings.TrimSpace(proc))] = ExternalParser{
+			Command:  fields[0],
+			Args:     fields[1:],
+			Timeout:  timeout,
+			CPULimit: cpuLimit,
+		}
+	}
+	return parsers, nil
+}
+
+// parseReport is Parse for a processor's report, which may also be in the
+// processor's external format.
+func parseReport(proc domain.Processor, format string, data []byte, reportID string) (*ParseResult, error) {
+	if format != FormatExternal {
+		return Parse(format, data, reportID)
+	}
+	p, ok := externalParsers[proc]
+	if !ok {
+		return nil, fmt.Errorf("no external parser registered for %s", proc)
+	}
+	parsed, err := p.parse(proc, data, reportID)
+	if err != nil {
+		return nil, fmt.Errorf("parse %s: %w", format, err)
+	}
+	classifyAdjustments(parsed.Records)
+	return parsed, nil
+}
+
+// stderrTail is how much of a failed parser's stderr is kept in the error.
+const stderrTail = 1024
+
+// maxParserOutput bounds what a parser may write to stdout; a parser
+// writing more is killed and the report fails.
+const maxParserOutput = 256 << 20
+
+// maxParserStderr bounds the stderr kept while a parser runs.
+const maxParserStderr = 64 << 10
+
+// parserEnv is the environment a parser runs with. The server's own
+// environment holds credentials, such as column encryption keys and the
+// blob store, SMTP and Jira secrets, so only PATH and the WAKALA_*
+// variables are passed on. TMPDIR is the parser's working directory dir.
+func parserEnv(proc domain.Processor, reportID, dir string) []string {
+	var env []string
+	for _, kv := range os.Environ() {
+		name, _, _ := strings.Cut(kv, "=")
+		switch {
+		case name == "WAKALA_REPORT_ID", name == "WAKALA_PROCESSOR":
+		case name == "PATH", strings.HasPrefix(name, "WAKALA_"):
+			env = append(env, kv)
+		}
+	}
+	return append(env, "TMPDIR="+dir, "WAKALA_REPORT_ID="+reportID, "WAKALA_PROCESSOR="+string(proc))
+}
+
+// cappedBuffer takes at most max bytes. Past that it calls onFull once and
+// fails every write. The buffer is a named field rather than embedded so
+// that io.Copy cannot bypass Write through bytes.Buffer's ReadFrom.
+type cappedBuffer struct {
+	buf    bytes.Buffer
+	max    int
+	full   bool
+	onFull func()
+}
+
+var errOutputTooLarge = errors.New("output too large")
+
+func (b *cappedBuffer) Write(p []byte) (int, error) {
+	if b.full || b.buf.Len()+len(p) > b.max {
+		if !b.full {
+			b.full = true
+			if b.onFull != nil {
+				b.onFull()
+			}
+		}
+		return 0, errOutputTooLarge
+	}
+	return b.buf.Write(p)
+}
+
+// tailBuffer keeps the last max bytes written to it.
+type tailBuffer struct {
+	b   []byte
+	max int
+}
+
+func (t *tailBuffer) Write(p []byte) (int, error) {
+	t.b = append(t.b, p...)
+	if len(t.b) > t.max {
+		t.b = append(t.b[:0], t.b[len(t.b)-t.max:]...)
+	}
+	return len(p), nil
+}
+
+func (t *tailBuffer) String() string { return string(t.b) }
+
+// parse runs the parser on data and normalizes its output. Lines that are
+// not a usable record are skipped with a warning, like short rows in the
+// built-in parsers; the parser failing or timing out fails the report.
+func (p ExternalParser) parse(proc domain.Processor, data []byte, reportID string) (*ParseResult, error) {
+	// The command is resolved before the working directory changes, so a
+	// relative path keeps meaning what it did at startup.
+	path, err := exec.LookPath(p.Command)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", p.Command, err)
+	}
+	if path, err = filepath.Abs(path); err != nil {
+		return nil, fmt.Errorf("%s: %w", p.Command, err)
+	}
+	dir, err := os.MkdirTemp("", "wakala-parser-")
+	if err != nil {
+		return nil, fmt.Errorf("parser directory: %w", err)
+	}
+	defer os.RemoveAll(dir)
+
+	ctx, cancel := context.WithTimeout(context.Background(), p.Timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, path, p.Args...)
+	cmd.Dir = dir
+	cmd.Env = parserEnv(proc, reportID, dir)
+	limitParser(cmd, p.CPULimit)
+	// Output a parser's children still hold open must not hold up the
+	// report once the parser is gone.
+	cmd.WaitDelay = time.Second
+	cmd.Stdin = bytes.NewReader(data)
+	stdout := &cappedBuffer{max: maxParserOutput, onFull: cancel}
+	stderr := &tailBuffer{max: maxParserStderr}
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+
+	if err := cmd.Run(); err != nil {
+		if stdout.full {
+			return nil, fmt.Errorf("%s: output exceeds %d MB", p.Command, maxParserOutput>>20)
+		}
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return nil, fmt.Errorf("%s: timed out after %s", p.Command, p.Timeout)
+		}
+		if cpuLimitExceeded(err, p.CPULimit) {
+			return nil, fmt.Errorf("%s: used up its CPU limit of %s", p.Command, p.CPULimit)
+		}
+		msg := strings.TrimSpace(stderr.String())
+		if len(msg) > stderrTail {
+			msg = msg[len(msg)-stderrTail:]
+		}
+		if msg != "" {
+			return nil, fmt.Errorf("%s: %w: %s", p.Command, err, msg)
+		}
+		return nil, fmt.Errorf("%s: %w", p.Command, err)
+	}
+
+	result := &ParseResult{}
+	scanner := bufio.NewScanner(&stdout.buf)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+		var rec domain.SettlementRecord
+		if err := json.Unmarshal([]byte(text), &rec); err != nil {
+			result.skip(line, fmt.Sprintf("invalid record: %v", err))
+			continue
+		}
+		if reason := result.normalizeRecord(&rec, proc, reportID, line); reason != "" {
+			result.skip(line, reason)
+			continue
+		}
+		result.Records = append(result.Records, rec)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("read output: %w", err)
+	}
+	return result, nil
+}
+
+// normalizeRecord checks a record that did not come from a built-in parser,
+// such as one from an external parser or a webhook, and fills in what the
+// reconciler owns: the report, the processor, the ID if missing and
+// the USD amounts, which are always recomputed. It returns why the record
+// is unusable, or "".
+func (p *ParseResult) normalizeRecord(rec *domain.SettlementRecord, proc domain.Processor, reportID string, line int) string {
+	switch {
+	case rec.Processor != "" && rec.Processor != proc:
+		return fmt.Sprintf("processor %s does not match %s", rec.Processor, proc)
+	case rec.ProcessorTransactionID == "":
+		return "missing processor_transaction_id"
+	case rec.Currency == "":
+		return "missing currency"
+	case rec.SettlementDate.IsZero():
+		return "missing settlement_date"
+	}
+
+	if p.BatchID == "" {
+		p.BatchID = rec.BatchID
+	} else if rec.BatchID != p.BatchID {
+		return fmt.Sprintf("batch %s differs from the report's batch %s", rec.BatchID, p.BatchID)
+	}
+
+	usdGross, err := currency.ToUSD(rec.GrossAmount, rec.Currency)
+	if err != nil {
+		return fmt.Sprintf("gross amount: %v", err)
+	}
+	usdNet, err := currency.ToUSD(rec.NetAmount, rec.Currency)
+	if err != nil {
+		return fmt.Sprintf("net amount: %v", err)
+	}
+
+	if rec.ID == "" {
+		rec.ID = fmt.Sprintf("SR-EXT-%s-%s-%s-%d", proc, rec.BatchID, rec.ProcessorTransactionID, line)
+	}
+	rec.ReportID = reportID
+	rec.Processor = proc
+	rec.USDGrossAmount = usdGross
+	rec.USDNetAmount = usdNet
+	rec.WakalaTransactionID = ""
+	return ""
+}
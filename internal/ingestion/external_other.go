@@ -0,0 +1,14 @@
+//go:build !unix
+
+package ingestion
+
+import (
+	"os/exec"
+	"time"
+)
+
+// limitParser does nothing off Unix: parsers are bounded by their timeout
+// only.
+func limitParser(*exec.Cmd, time.Duration) {}
+
+func cpuLimitExceeded(error, time.Duration) bool { return false }
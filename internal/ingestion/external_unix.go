@@ -0,0 +1,45 @@
+//go:build unix
+
+package ingestion
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"syscall"
+	"time"
+)
+
+// limitParser makes cmd run under a CPU time limit of limit, rounded up to
+// whole seconds, through the shell's ulimit, and in its own process group so
+// that cancelling it also kills whatever the parser started. The parser gets
+// SIGXCPU at the limit and SIGKILL a second later, and cannot raise either.
+func limitParser(cmd *exec.Cmd, limit time.Duration) {
+	secs := cpuSeconds(limit)
+	script := fmt.Sprintf(`ulimit -S -t %d && ulimit -H -t %d && exec "$@"`, secs, secs+1)
+	cmd.Args = append([]string{"/bin/sh", "-c", script, "wakala-parser"}, cmd.Args...)
+	cmd.Path = "/bin/sh"
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+}
+
+func cpuSeconds(limit time.Duration) int64 {
+	return int64((limit + time.Second - 1) / time.Second)
+}
+
+// cpuLimitExceeded reports whether err is a parser killed for using up its
+// CPU limit.
+func cpuLimitExceeded(err error, limit time.Duration) bool {
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) {
+		return false
+	}
+	status, ok := exitErr.Sys().(syscall.WaitStatus)
+	if !ok || !status.Signaled() {
+		return false
+	}
+	used := exitErr.UserTime() + exitErr.SystemTime()
+	return status.Signal() == syscall.SIGXCPU || used >= time.Duration(cpuSeconds(limit))*time.Second
+}
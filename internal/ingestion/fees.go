@@ -0,0 +1,73 @@
+package ingestion
+
+import (
+	"fmt"
+
+	"github.com/wakala/reconciler/internal/domain"
+)
+
+// feeColumn is a CSV column holding one component of a record's fee.
+type feeColumn struct {
+	component string
+	column    string
+}
+
+// afriPayFees and capePayFees are the fee columns of the CSV formats. The
+// first is required; the others are read when the header has them.
+var (
+	afriPayFees = []feeColumn{
+		{domain.FeeProcessing, "fee_kes"}, {domain.FeeFX, "fx_fee_kes"}, {domain.FeeVAT, "vat_kes"},
+	}
+	capePayFees = []feeColumn{
+		{domain.FeeProcessing, "deductions_zar"}, {domain.FeeFX, "fx_fee_zar"}, {domain.FeeVAT, "vat_zar"},
+	}
+)
+
+// readTax reads the optional withheld tax column of a row, 0 when the
+// header or the row does not have it.
+func (p *ParseResult) readTax(line int, cols *csvColumns, row []string, column string) (float64, error) {
+	v, ok := cols.optional(row, column)
+	if !ok || v == "" {
+		return 0, nil
+	}
+	tax, err := p.parseAmount(line, column, v)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", column, err)
+	}
+	return tax, nil
+}
+
+// readFees reads the fee columns of a row and returns their sum and, when
+// the header has more than the first, the amount of each component. field
+// names the first column in warnings and errors. An optional column left
+// empty in the row is not in its breakdown.
+func (p *ParseResult) readFees(line int, field string, cols *csvColumns, row []string, fees []feeColumn) (float64, map[string]float64, error) {
+	amounts := make(map[string]float64, len(fees))
+	split := false
+	var total float64
+	for i, fc := range fees {
+		v, ok := cols.optional(row, fc.column)
+		if i > 0 {
+			if _, inHeader := cols.index[fc.column]; inHeader {
+				split = true
+			}
+			if !ok || v == "" {
+				continue
+			}
+		}
+		label := field
+		if i > 0 {
+			label = fc.column
+		}
+		amount, err := p.parseAmount(line, label, v)
+		if err != nil {
+			return 0, nil, fmt.Errorf("%s: %w", label, err)
+		}
+		amounts[fc.component] = amount
+		total += amount
+	}
+	if !split {
+		return total, nil, nil
+	}
+	return round2(total), amounts, nil
+}
@@ -0,0 +1,119 @@
+package ingestion
+
+import (
+	"math"
+	"time"
+
+	"github.com/wakala/reconciler/internal/domain"
+)
+
+// ParseResult is what every format parser returns: the normalized records,
+// the batch ID found in the file, any rows that were skipped, and warnings
+// about anything the parser had to guess at.
+type ParseResult struct {
+	Records  []domain.SettlementRecord
+	BatchID  string
+	Skipped  []SkippedRow
+	Warnings []domain.ReportWarning
+	// ControlTotals is the report's footer totals row, if it has one.
+	ControlTotals *domain.ControlTotals
+
+	// numbers is the number format parseAmount reads; "" is NumberDot.
+	numbers NumberFormat
+	// units is the unit amounts are stated in; "" is UnitMajor.
+	units AmountUnit
+}
+
+// SkippedRow records a source row the parser could not use, and why.
+type SkippedRow struct {
+	Line   int    `json:"line"`
+	Reason string `json:"reason"`
+}
+
+func (p *ParseResult) skip(line int, reason string) {
+	p.Skipped = append(p.Skipped, SkippedRow{Line: line, Reason: reason})
+	p.warn(line, WarnLineSkipped, reason)
+}
+
+// AmountTotals holds summed gross and net amounts.
+type AmountTotals struct {
+	Gross float64 `json:"gross"`
+	Net   float64 `json:"net"`
+}
+
+// IngestMetrics lets the operator sanity-check a file immediately after
+// upload.
+type IngestMetrics struct {
+	ParseDurationMS   float64                 `json:"parse_duration_ms"`
+	RowsParsed        int                     `json:"rows_parsed"`
+	RowsSkipped       int                     `json:"rows_skipped"`
+	SkippedRows       []SkippedRow            `json:"skipped_rows,omitempty"`
+	WarningCount      int                     `json:"warning_count"`
+	RecordTypes       map[string]int          `json:"record_types"`
+	LocalTotals       map[string]AmountTotals `json:"local_totals"`
+	USDTotals         AmountTotals            `json:"usd_totals"`
+	MinSettlementDate *time.Time              `json:"min_settlement_date,omitempty"`
+	MaxSettlementDate *time.Time              `json:"max_settlement_date,omitempty"`
+	// Transform is set when the processor's transform script ran.
+	Transform *TransformMetrics `json:"transform,omitempty"`
+}
+
+// recordType classifies a parsed record by its adjustment category, or for
+// payments by the sign of its gross amount.
+func recordType(rec *domain.SettlementRecord) string {
+	switch {
+	case rec.Adjustment != nil:
+		return string(rec.Adjustment.Category)
+	case rec.GrossAmount > 0:
+		return "sale"
+	case rec.GrossAmount < 0:
+		return "refund"
+	default:
+		return "zero_amount"
+	}
+}
+
+// computeMetrics summarises a parse result.
+func computeMetrics(res *ParseResult, parseDuration time.Duration) *IngestMetrics {
+	m := &IngestMetrics{
+		ParseDurationMS: float64(parseDuration.Microseconds()) / 1000,
+		RowsParsed:      len(res.Records),
+		RowsSkipped:     len(res.Skipped),
+		SkippedRows:     res.Skipped,
+		WarningCount:    len(res.Warnings),
+		RecordTypes:     make(map[string]int),
+		LocalTotals:     make(map[string]AmountTotals),
+	}
+
+	for i := range res.Records {
+		rec := &res.Records[i]
+		m.RecordTypes[recordType(rec)]++
+
+		lt := m.LocalTotals[rec.Currency]
+		lt.Gross += rec.GrossAmount
+		lt.Net += rec.NetAmount
+		m.LocalTotals[rec.Currency] = lt
+
+		m.USDTotals.Gross += rec.USDGrossAmount
+		m.USDTotals.Net += rec.USDNetAmount
+
+		d := rec.SettlementDate
+		if m.MinSettlementDate == nil || d.Before(*m.MinSettlementDate) {
+			m.MinSettlementDate = &d
+		}
+		if m.MaxSettlementDate == nil || d.After(*m.MaxSettlementDate) {
+			m.MaxSettlementDate = &d
+		}
+	}
+
+	for cur, lt := range m.LocalTotals {
+		m.LocalTotals[cur] = AmountTotals{Gross: round2(lt.Gross), Net: round2(lt.Net)}
+	}
+	m.USDTotals = AmountTotals{Gross: round2(m.USDTotals.Gross), Net: round2(m.USDTotals.Net)}
+
+	return m
+}
+
+func round2(v float64) float64 {
+	return math.Round(v*100) / 100
+}
@@ -4,7 +4,6 @@ import (
 	"encoding/csv"
 	"fmt"
 	"io"
-	"strconv"
 	"strings"
 	"time"
 
@@ -12,25 +11,41 @@ import (
 	"github.com/wakala/reconciler/internal/domain"
 )
 
+// afriPayColumns are the AfriPay columns the parser needs, by header name.
+var afriPayColumns = []string{
+	"transaction_id", "settlement_date", "gross_amount_kes", "fee_kes", "net_kes", "batch_id",
+}
+
 // ParseAfriPayCSV parses the AfriPay Kenya CSV settlement format.
 //
 // Expected header:
 //
 //	transaction_id,merchant_ref,settlement_date,gross_amount_kes,fee_kes,net_kes,batch_id
-func ParseAfriPayCSV(data []byte, reportID string) ([]domain.SettlementRecord, string, error) {
-	reader := csv.NewReader(strings.NewReader(string(data)))
+//
+// Columns are found by name, so they may come in any order; merchant_ref and
+// any extra columns are ignored. Optional fx_fee_kes and vat_kes columns are
+// fee components beside fee_kes, summed into the record's fee; an optional
+// wht_kes column is the tax withheld on the fee. A row whose
+// transaction_id is TOTAL is the footer: its amount columns are the file's
+// control totals.
+func ParseAfriPayCSV(data []byte, reportID string) (*ParseResult, error) {
+	result := &ParseResult{
+		numbers: numberFormatFor(domain.ProcessorAfriPay),
+		units:   amountUnitFor(domain.ProcessorAfriPay),
+	}
+	reader := csv.NewReader(strings.NewReader(result.decodeText(data)))
 	reader.TrimLeadingSpace = true
+	reader.FieldsPerRecord = -1
 
 	header, err := reader.Read()
 	if err != nil {
-		return nil, "", fmt.Errorf("read header: %w", err)
+		return nil, fmt.Errorf("read header: %w", err)
 	}
-	if len(header) < 7 {
-		return nil, "", fmt.Errorf("expected 7 columns, got %d", len(header))
+	cols, err := readColumns(header, afriPayColumns...)
+	if err != nil {
+		return nil, err
 	}
 
-	var records []domain.SettlementRecord
-	var batchID string
 	lineNum := 1
 
 	for {
@@ -40,51 +55,59 @@ func ParseAfriPayCSV(data []byte, reportID string) ([]domain.SettlementRecord, s
 			break
 		}
 		if err != nil {
-			return nil, "", fmt.Errorf("line %d: %w", lineNum, err)
+			return nil, fmt.Errorf("line %d: %w", lineNum, err)
 		}
-		if len(row) < 7 {
+		if isTotalsRow(cols, row, "transaction_id") {
+			if err := result.readControlTotals(lineNum, cols, row, "gross_amount_kes", afriPayFees, "net_kes"); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if !cols.fits(row) {
+			result.skip(lineNum, cols.shortRow(row))
 			continue
 		}
 
-		txnID := strings.TrimSpace(row[0])
-		settleDateStr := strings.TrimSpace(row[2])
-		grossStr := strings.TrimSpace(row[3])
-		feeStr := strings.TrimSpace(row[4])
-		netStr := strings.TrimSpace(row[5])
-		batchID = strings.TrimSpace(row[6])
+		txnID := cols.field(row, "transaction_id")
+		settleDateStr := cols.field(row, "settlement_date")
+		grossStr := cols.field(row, "gross_amount_kes")
+		netStr := cols.field(row, "net_kes")
+		result.BatchID = cols.field(row, "batch_id")
 
-		gross, err := strconv.ParseFloat(grossStr, 64)
+		gross, err := result.parseAmount(lineNum, "gross", grossStr)
 		if err != nil {
-			return nil, "", fmt.Errorf("line %d gross: %w", lineNum, err)
+			return nil, fmt.Errorf("line %d gross: %w", lineNum, err)
 		}
-		fee, err := strconv.ParseFloat(feeStr, 64)
+		fee, feeBreakdown, err := result.readFees(lineNum, "fee", cols, row, afriPayFees)
 		if err != nil {
-			return nil, "", fmt.Errorf("line %d fee: %w", lineNum, err)
+			return nil, fmt.Errorf("line %d %w", lineNum, err)
 		}
-		net, err := strconv.ParseFloat(netStr, 64)
+		tax, err := result.readTax(lineNum, cols, row, "wht_kes")
 		if err != nil {
-			return nil, "", fmt.Errorf("line %d net: %w", lineNum, err)
+			return nil, fmt.Errorf("line %d %w", lineNum, err)
+		}
+		net, err := result.parseAmount(lineNum, "net", netStr)
+		if err != nil {
+			return nil, fmt.Errorf("line %d net: %w", lineNum, err)
 		}
 
-		settleDate, err := time.Parse("2006-01-02", settleDateStr)
+		settleDate, err := result.parseDate(lineNum, "settlement date", settleDateStr, time.UTC,
+			"2006-01-02", time.RFC3339)
 		if err != nil {
-			settleDate, err = time.Parse(time.RFC3339, settleDateStr)
-			if err != nil {
-				return nil, "", fmt.Errorf("line %d date: %w", lineNum, err)
-			}
+			return nil, fmt.Errorf("line %d date: %w", lineNum, err)
 		}
 
 		usdGross, err := currency.ToUSD(gross, "KES")
 		if err != nil {
-			return nil, "", fmt.Errorf("line %d currency gross: %w", lineNum, err)
+			return nil, fmt.Errorf("line %d currency gross: %w", lineNum, err)
 		}
 		usdNet, err := currency.ToUSD(net, "KES")
 		if err != nil {
-			return nil, "", fmt.Errorf("line %d currency net: %w", lineNum, err)
+			return nil, fmt.Errorf("line %d currency net: %w", lineNum, err)
 		}
 
 		rec := domain.SettlementRecord{
-			ID:                     fmt.Sprintf("SR-AP-%s-%d", txnID, lineNum),
+			ID:                     fmt.Sprintf("SR-AP-%s-%s-%d", result.BatchID, txnID, lineNum),
 			ReportID:               reportID,
 			Processor:              domain.ProcessorAfriPay,
 			ProcessorTransactionID: txnID,
@@ -95,10 +118,13 @@ func ParseAfriPayCSV(data []byte, reportID string) ([]domain.SettlementRecord, s
 			USDGrossAmount:         usdGross,
 			USDNetAmount:           usdNet,
 			SettlementDate:         settleDate,
-			BatchID:                batchID,
+			BatchID:                result.BatchID,
+			FeeBreakdown:           feeBreakdown,
+			TaxAmount:              tax,
 		}
-		records = append(records, rec)
+		result.Records = append(result.Records, rec)
 	}
 
-	return records, batchID, nil
+	result.checkControlTotals()
+	return result, nil
 }
@@ -4,7 +4,6 @@ import (
 	"encoding/csv"
 	"fmt"
 	"io"
-	"strconv"
 	"strings"
 	"time"
 
@@ -12,26 +11,40 @@ import (
 	"github.com/wakala/reconciler/internal/domain"
 )
 
+// capePayColumns are the CapePay columns the parser needs, by header name.
+var capePayColumns = []string{
+	"txref", "settle_date", "amount_zar", "deductions_zar", "net_zar", "batch",
+}
+
 // ParseCapePayCSV parses the CapePay South Africa pipe-delimited CSV format.
 //
 // Expected header:
 //
 //	TXREF|MERCHANT|SETTLE_DATE|AMOUNT_ZAR|DEDUCTIONS_ZAR|NET_ZAR|BATCH
-func ParseCapePayCSV(data []byte, reportID string) ([]domain.SettlementRecord, string, error) {
-	reader := csv.NewReader(strings.NewReader(string(data)))
+//
+// Columns are found by name, so they may come in any order; MERCHANT and any
+// extra columns are ignored. Optional FX_FEE_ZAR and VAT_ZAR columns are fee
+// components beside DEDUCTIONS_ZAR, summed into the record's fee; an
+// optional WHT_ZAR column is the tax withheld on the fee.
+func ParseCapePayCSV(data []byte, reportID string) (*ParseResult, error) {
+	result := &ParseResult{
+		numbers: numberFormatFor(domain.ProcessorCapePay),
+		units:   amountUnitFor(domain.ProcessorCapePay),
+	}
+	reader := csv.NewReader(strings.NewReader(result.decodeText(data)))
 	reader.Comma = '|'
 	reader.TrimLeadingSpace = true
+	reader.FieldsPerRecord = -1
 
 	header, err := reader.Read()
 	if err != nil {
-		return nil, "", fmt.Errorf("read header: %w", err)
+		return nil, fmt.Errorf("read header: %w", err)
 	}
-	if len(header) < 7 {
-		return nil, "", fmt.Errorf("expected 7 columns, got %d", len(header))
+	cols, err := readColumns(header, capePayColumns...)
+	if err != nil {
+		return nil, err
 	}
 
-	var records []domain.SettlementRecord
-	var batchID string
 	lineNum := 1
 
 	for {
@@ -41,51 +54,53 @@ func ParseCapePayCSV(data []byte, reportID string) ([]domain.SettlementRecord, s
 			break
 		}
 		if err != nil {
-			return nil, "", fmt.Errorf("line %d: %w", lineNum, err)
+			return nil, fmt.Errorf("line %d: %w", lineNum, err)
 		}
-		if len(row) < 7 {
+		if !cols.fits(row) {
+			result.skip(lineNum, cols.shortRow(row))
 			continue
 		}
 
-		txRef := strings.TrimSpace(row[0])
-		settleDateStr := strings.TrimSpace(row[2])
-		amountStr := strings.TrimSpace(row[3])
-		deductionsStr := strings.TrimSpace(row[4])
-		netStr := strings.TrimSpace(row[5])
-		batchID = strings.TrimSpace(row[6])
+		txRef := cols.field(row, "txref")
+		settleDateStr := cols.field(row, "settle_date")
+		amountStr := cols.field(row, "amount_zar")
+		netStr := cols.field(row, "net_zar")
+		result.BatchID = cols.field(row, "batch")
 
-		amount, err := strconv.ParseFloat(amountStr, 64)
+		amount, err := result.parseAmount(lineNum, "amount", amountStr)
+		if err != nil {
+			return nil, fmt.Errorf("line %d amount: %w", lineNum, err)
+		}
+		deductions, feeBreakdown, err := result.readFees(lineNum, "deductions", cols, row, capePayFees)
 		if err != nil {
-			return nil, "", fmt.Errorf("line %d amount: %w", lineNum, err)
+			return nil, fmt.Errorf("line %d %w", lineNum, err)
 		}
-		deductions, err := strconv.ParseFloat(deductionsStr, 64)
+		tax, err := result.readTax(lineNum, cols, row, "wht_zar")
 		if err != nil {
-			return nil, "", fmt.Errorf("line %d deductions: %w", lineNum, err)
+			return nil, fmt.Errorf("line %d %w", lineNum, err)
 		}
-		net, err := strconv.ParseFloat(netStr, 64)
+		net, err := result.parseAmount(lineNum, "net", netStr)
 		if err != nil {
-			return nil, "", fmt.Errorf("line %d net: %w", lineNum, err)
+			return nil, fmt.Errorf("line %d net: %w", lineNum, err)
 		}
 
-		settleDate, err := time.Parse("2006-01-02", settleDateStr)
+		settleDate, err := result.parseDate(lineNum, "settlement date", settleDateStr, time.UTC,
+			"2006-01-02", time.RFC3339)
 		if err != nil {
-			settleDate, err = time.Parse(time.RFC3339, settleDateStr)
-			if err != nil {
-				return nil, "", fmt.Errorf("line %d date: %w", lineNum, err)
-			}
+			return nil, fmt.Errorf("line %d date: %w", lineNum, err)
 		}
 
 		usdGross, err := currency.ToUSD(amount, "ZAR")
 		if err != nil {
-			return nil, "", fmt.Errorf("line %d currency gross: %w", lineNum, err)
+			return nil, fmt.Errorf("line %d currency gross: %w", lineNum, err)
 		}
 		usdNet, err := currency.ToUSD(net, "ZAR")
 		if err != nil {
-			return nil, "", fmt.Errorf("line %d currency net: %w", lineNum, err)
+			return nil, fmt.Errorf("line %d currency net: %w", lineNum, err)
 		}
 
 		rec := domain.SettlementRecord{
-			ID:                     fmt.Sprintf("SR-CP-%s-%d", txRef, lineNum),
+			ID:                     fmt.Sprintf("SR-CP-%s-%s-%d", result.BatchID, txRef, lineNum),
 			ReportID:               reportID,
 			Processor:              domain.ProcessorCapePay,
 			ProcessorTransactionID: txRef,
@@ -96,10 +111,12 @@ func ParseCapePayCSV(data []byte, reportID string) ([]domain.SettlementRecord, s
 			USDGrossAmount:         usdGross,
 			USDNetAmount:           usdNet,
 			SettlementDate:         settleDate,
-			BatchID:                batchID,
+			BatchID:                result.BatchID,
+			FeeBreakdown:           feeBreakdown,
+			TaxAmount:              tax,
 		}
-		records = append(records, rec)
+		result.Records = append(result.Records, rec)
 	}
 
-	return records, batchID, nil
+	return result, nil
 }
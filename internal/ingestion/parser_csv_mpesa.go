@@ -0,0 +1,247 @@
+package ingestion
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/wakala/reconciler/internal/currency"
+	"github.com/wakala/reconciler/internal/domain"
+)
+
+// mpesaTZ is East Africa Time; statement timestamps carry no offset.
+var mpesaTZ = time.FixedZone("EAT", 3*60*60)
+
+// mpesaReceiptPattern matches an M-Pesa receipt number such as QBR7XK2L9P.
+var mpesaReceiptPattern = regexp.MustCompile(`^[A-Z0-9]{10}$`)
+
+// mpesaColumns are the statement columns the parser needs, by header name.
+var mpesaColumns = []string{
+	"receipt no.", "completion time", "details", "transaction status",
+	"paid in", "withdrawn", "reason type", "linked transaction id",
+}
+
+// isMPesaHeader reports whether row is the column header that ends the
+// preamble: the row with a Receipt No. column, wherever it is.
+func isMPesaHeader(row []string) bool {
+	for _, name := range row {
+		if strings.EqualFold(strings.TrimSpace(name), "receipt no.") {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseMPesaStatementCSV parses a Safaricom M-Pesa organisation statement
+// exported as CSV.
+//
+// The export starts with a few "Label:,value" lines (Short Code, Time Period,
+// ...) followed by the column header:
+//
+//	Receipt No.,Completion Time,Initiation Time,Details,Transaction Status,Paid In,Withdrawn,Balance,Balance Confirmed,Reason Type,Other Party Info,Linked Transaction ID,A/C No.
+//
+// Each completed Pay Bill payment becomes a record keyed by its receipt
+// number. Pay Bill Charge rows are folded into the fee of the payment named
+// in their Linked Transaction ID. All other rows (withdrawals, transfers,
+// unlinked charges, failed payments) are skipped with a reason.
+//
+// Statements have no batch ID, and receipt numbers are unique across
+// statements, so every statement for a paybill shares the batch
+// MPESA-<short code>-PAYBILL; overlapping statement downloads then dedupe.
+func ParseMPesaStatementCSV(data []byte, reportID string) (*ParseResult, error) {
+	result := &ParseResult{
+		numbers: numberFormatFor(domain.ProcessorMPesa),
+		units:   amountUnitFor(domain.ProcessorMPesa),
+	}
+	reader := csv.NewReader(strings.NewReader(result.decodeText(data)))
+	reader.TrimLeadingSpace = true
+	reader.FieldsPerRecord = -1
+
+	shortCode := ""
+	var cols *csvColumns
+	lineNum := 0
+
+	// Read the preamble up to and including the column header.
+	for {
+		lineNum++
+		row, err := reader.Read()
+		if err == io.EOF {
+			return nil, fmt.Errorf("column header not found")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineNum, err)
+		}
+		if len(row) >= 2 && strings.EqualFold(strings.TrimSpace(row[0]), "short code:") {
+			shortCode = strings.TrimSpace(row[1])
+			continue
+		}
+		if isMPesaHeader(row) {
+			if cols, err = readColumns(row, mpesaColumns...); err != nil {
+				return nil, err
+			}
+			break
+		}
+	}
+
+	if shortCode != "" {
+		result.BatchID = fmt.Sprintf("MPESA-%s-PAYBILL", shortCode)
+	} else {
+		result.BatchID = "MPESA-PAYBILL"
+	}
+
+	byReceipt := make(map[string]int)
+	type charge struct {
+		line    int
+		linked  string
+		amount  float64
+		receipt string
+	}
+	var charges []charge
+
+	for {
+		lineNum++
+		row, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineNum, err)
+		}
+		if !cols.fits(row) {
+			result.skip(lineNum, cols.shortRow(row))
+			continue
+		}
+		field := func(name string) string { return cols.field(row, name) }
+
+		receipt := normalizeMPesaReceipt(field("receipt no."))
+		if receipt != field("receipt no.") {
+			result.warn(lineNum, WarnFieldCoerced, fmt.Sprintf("receipt no. %q read as %s", field("receipt no."), receipt))
+		}
+		reason := strings.ToLower(field("reason type"))
+		details := strings.ToLower(field("details"))
+
+		if !strings.EqualFold(field("transaction status"), "completed") {
+			result.skip(lineNum, fmt.Sprintf("transaction %s is %s", receipt, field("transaction status")))
+			continue
+		}
+
+		if strings.Contains(reason, "charge") || strings.Contains(details, "charge") {
+			amount, err := parseMPesaAmount(result.numbers, field("withdrawn"))
+			if err != nil {
+				return nil, fmt.Errorf("line %d withdrawn: %w", lineNum, err)
+			}
+			amount = result.toMajor(lineNum, "withdrawn", amount)
+			linked := normalizeMPesaReceipt(field("linked transaction id"))
+			if linked != field("linked transaction id") {
+				result.warn(lineNum, WarnFieldCoerced, fmt.Sprintf("linked transaction id %q read as %s",
+					field("linked transaction id"), linked))
+			}
+			charges = append(charges, charge{
+				line:    lineNum,
+				linked:  linked,
+				amount:  amount,
+				receipt: receipt,
+			})
+			continue
+		}
+
+		if !strings.HasPrefix(reason, "pay bill") && !strings.HasPrefix(details, "pay bill") {
+			result.skip(lineNum, fmt.Sprintf("%s is not a pay bill payment (%s)", receipt, field("reason type")))
+			continue
+		}
+		if !mpesaReceiptPattern.MatchString(receipt) {
+			result.skip(lineNum, fmt.Sprintf("invalid receipt number %q", field("receipt no.")))
+			continue
+		}
+
+		gross, err := parseMPesaAmount(result.numbers, field("paid in"))
+		if err != nil {
+			return nil, fmt.Errorf("line %d paid in: %w", lineNum, err)
+		}
+		gross = result.toMajor(lineNum, "paid in", gross)
+		if gross <= 0 {
+			result.skip(lineNum, fmt.Sprintf("pay bill %s has no paid in amount", receipt))
+			continue
+		}
+
+		completed, err := result.parseDate(lineNum, "completion time", field("completion time"), mpesaTZ,
+			"2006-01-02 15:04:05", "02/01/2006 15:04:05", "02-01-2006 15:04:05")
+		if err != nil {
+			return nil, fmt.Errorf("line %d completion time: %w", lineNum, err)
+		}
+
+		if _, dup := byReceipt[receipt]; dup {
+			result.skip(lineNum, fmt.Sprintf("duplicate receipt %s", receipt))
+			continue
+		}
+		byReceipt[receipt] = len(result.Records)
+		result.Records = append(result.Records, domain.SettlementRecord{
+			ID:                     fmt.Sprintf("SR-MP-%s-%s-%d", result.BatchID, receipt, lineNum),
+			ReportID:               reportID,
+			Processor:              domain.ProcessorMPesa,
+			ProcessorTransactionID: receipt,
+			GrossAmount:            gross,
+			Currency:               "KES",
+			SettlementDate:         completed,
+			BatchID:                result.BatchID,
+		})
+	}
+
+	for _, c := range charges {
+		i, ok := byReceipt[c.linked]
+		if !ok {
+			result.skip(c.line, fmt.Sprintf("charge %s is not linked to a pay bill payment in this statement", c.receipt))
+			continue
+		}
+		result.Records[i].FeeAmount += c.amount
+	}
+	sort.Slice(result.Skipped, func(i, j int) bool { return result.Skipped[i].Line < result.Skipped[j].Line })
+	sort.SliceStable(result.Warnings, func(i, j int) bool { return result.Warnings[i].Line < result.Warnings[j].Line })
+
+	for i := range result.Records {
+		rec := &result.Records[i]
+		rec.FeeAmount = round2(rec.FeeAmount)
+		rec.NetAmount = round2(rec.GrossAmount - rec.FeeAmount)
+
+		usdGross, err := currency.ToUSD(rec.GrossAmount, "KES")
+		if err != nil {
+			return nil, fmt.Errorf("record %s currency gross: %w", rec.ProcessorTransactionID, err)
+		}
+		usdNet, err := currency.ToUSD(rec.NetAmount, "KES")
+		if err != nil {
+			return nil, fmt.Errorf("record %s currency net: %w", rec.ProcessorTransactionID, err)
+		}
+		rec.USDGrossAmount = usdGross
+		rec.USDNetAmount = usdNet
+	}
+
+	return result, nil
+}
+
+// normalizeMPesaReceipt upper-cases a receipt number and strips the spaces
+// and quotes some exports add.
+func normalizeMPesaReceipt(s string) string {
+	s = strings.Trim(strings.TrimSpace(s), `'"`)
+	return strings.ToUpper(strings.ReplaceAll(s, " ", ""))
+}
+
+// parseMPesaAmount parses amounts such as "1,500.00" or "-15.00" in the
+// statement's number format. Empty cells are zero. The sign is dropped: the
+// column already says which way it went.
+func parseMPesaAmount(f NumberFormat, s string) (float64, error) {
+	if strings.TrimSpace(s) == "" {
+		return 0, nil
+	}
+	v, _, err := f.parse(s)
+	if err != nil {
+		return 0, err
+	}
+	if v < 0 {
+		v = -v
+	}
+	return v, nil
+}
@@ -1,6 +1,7 @@
 package ingestion
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"time"
@@ -17,58 +18,133 @@ type nairaGatewayFile struct {
 }
 
 type nairaGatewayEntry struct {
-	Ref            string  `json:"ref"`
-	MerchantID     string  `json:"merchant_id"`
-	AmountNGN      float64 `json:"amount_ngn"`
-	ProcessingFee  float64 `json:"processing_fee_ngn"`
-	PayoutNGN      float64 `json:"payout_ngn"`
-	SettledAt      string  `json:"settled_at"`
+	Ref           string  `json:"ref"`
+	MerchantID    string  `json:"merchant_id"`
+	AmountNGN     float64 `json:"amount_ngn"`
+	ProcessingFee float64 `json:"processing_fee_ngn"`
+	PayoutNGN     float64 `json:"payout_ngn"`
+	SettledAt     string  `json:"settled_at"`
+	// FXFeeNGN and VATNGN are the fee components some merchants' records
+	// list beside the processing fee.
+	FXFeeNGN *float64 `json:"fx_fee_ngn"`
+	VATNGN   *float64 `json:"vat_ngn"`
+	// WHTNGN is the withholding tax on the fees, deducted from the payout.
+	WHTNGN float64 `json:"wht_ngn"`
 }
 
 // ParseNairaGatewayJSON parses the NairaGateway Nigeria JSON settlement format.
-func ParseNairaGatewayJSON(data []byte, reportID string) ([]domain.SettlementRecord, string, error) {
+// The v2 API returns an array of such objects, one per batch, which is read
+// too; the result's BatchID is then the first batch's, and each record
+// carries its own. IngestReport stores each batch of an array as its own
+// report.
+func ParseNairaGatewayJSON(data []byte, reportID string) (*ParseResult, error) {
+	files, err := readNairaGatewayFiles(data)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &ParseResult{units: amountUnitFor(domain.ProcessorNairaGateway)}
+	if len(files) > 0 {
+		result.BatchID = files[0].BatchID
+	}
+	for _, file := range files {
+		if err := result.addNairaGatewayBatch(file, reportID); err != nil {
+			if len(files) > 1 {
+				return nil, fmt.Errorf("batch %s: %w", file.BatchID, err)
+			}
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+// readNairaGatewayFiles reads a v1 object or a v2 array of them.
+func readNairaGatewayFiles(data []byte) ([]nairaGatewayFile, error) {
+	var files []nairaGatewayFile
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte("[")) {
+		if err := json.Unmarshal(data, &files); err != nil {
+			return nil, fmt.Errorf("unmarshal: %w", err)
+		}
+		return files, nil
+	}
 	var file nairaGatewayFile
 	if err := json.Unmarshal(data, &file); err != nil {
-		return nil, "", fmt.Errorf("unmarshal: %w", err)
+		return nil, fmt.Errorf("unmarshal: %w", err)
 	}
+	return append(files, file), nil
+}
 
-	var records []domain.SettlementRecord
+// splitNairaGatewayBatches returns each batch object of a v2 array as its
+// own document, or nil when data is a v1 object.
+func splitNairaGatewayBatches(data []byte) ([][]byte, error) {
+	if !bytes.HasPrefix(bytes.TrimSpace(data), []byte("[")) {
+		return nil, nil
+	}
+	var raw []json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("unmarshal: %w", err)
+	}
+	parts := make([][]byte, len(raw))
+	for i, r := range raw {
+		parts[i] = r
+	}
+	return parts, nil
+}
 
+// addNairaGatewayBatch appends the records of one batch object.
+func (p *ParseResult) addNairaGatewayBatch(file nairaGatewayFile, reportID string) error {
 	for i, entry := range file.Records {
-		settledAt, err := time.Parse(time.RFC3339, entry.SettledAt)
+		// Records are numbered from 1 in warnings, like lines in the CSV formats.
+		settledAt, err := p.parseDate(i+1, "settled_at", entry.SettledAt, time.UTC,
+			time.RFC3339, "2006-01-02T15:04:05-07:00")
 		if err != nil {
-			// Try alternative format with timezone offset.
-			settledAt, err = time.Parse("2006-01-02T15:04:05-07:00", entry.SettledAt)
-			if err != nil {
-				return nil, "", fmt.Errorf("record %d date: %w", i, err)
+			return fmt.Errorf("record %d date: %w", i, err)
+		}
+
+		gross := p.toMajor(i+1, "amount_ngn", entry.AmountNGN)
+		fee := p.toMajor(i+1, "processing_fee_ngn", entry.ProcessingFee)
+		net := p.toMajor(i+1, "payout_ngn", entry.PayoutNGN)
+		tax := p.toMajor(i+1, "wht_ngn", entry.WHTNGN)
+		var feeBreakdown map[string]float64
+		if entry.FXFeeNGN != nil || entry.VATNGN != nil {
+			feeBreakdown = map[string]float64{domain.FeeProcessing: fee}
+			if entry.FXFeeNGN != nil {
+				feeBreakdown[domain.FeeFX] = p.toMajor(i+1, "fx_fee_ngn", *entry.FXFeeNGN)
+				fee += feeBreakdown[domain.FeeFX]
 			}
+			if entry.VATNGN != nil {
+				feeBreakdown[domain.FeeVAT] = p.toMajor(i+1, "vat_ngn", *entry.VATNGN)
+				fee += feeBreakdown[domain.FeeVAT]
+			}
+			fee = round2(fee)
 		}
 
-		usdGross, err := currency.ToUSD(entry.AmountNGN, "NGN")
+		usdGross, err := currency.ToUSD(gross, "NGN")
 		if err != nil {
-			return nil, "", fmt.Errorf("record %d currency gross: %w", i, err)
+			return fmt.Errorf("record %d currency gross: %w", i, err)
 		}
-		usdNet, err := currency.ToUSD(entry.PayoutNGN, "NGN")
+		usdNet, err := currency.ToUSD(net, "NGN")
 		if err != nil {
-			return nil, "", fmt.Errorf("record %d currency net: %w", i, err)
+			return fmt.Errorf("record %d currency net: %w", i, err)
 		}
 
 		rec := domain.SettlementRecord{
-			ID:                     fmt.Sprintf("SR-NG-%s-%d", entry.Ref, i),
+			ID:                     fmt.Sprintf("SR-NG-%s-%s-%d", file.BatchID, entry.Ref, i),
 			ReportID:               reportID,
 			Processor:              domain.ProcessorNairaGateway,
 			ProcessorTransactionID: entry.Ref,
-			GrossAmount:            entry.AmountNGN,
-			FeeAmount:              entry.ProcessingFee,
-			NetAmount:              entry.PayoutNGN,
+			GrossAmount:            gross,
+			FeeAmount:              fee,
+			NetAmount:              net,
 			Currency:               "NGN",
 			USDGrossAmount:         usdGross,
 			USDNetAmount:           usdNet,
 			SettlementDate:         settledAt,
 			BatchID:                file.BatchID,
+			FeeBreakdown:           feeBreakdown,
+			TaxAmount:              tax,
 		}
-		records = append(records, rec)
+		p.Records = append(p.Records, rec)
 	}
-
-	return records, file.BatchID, nil
+	return nil
 }
@@ -0,0 +1,445 @@
+package ingestion
+
+import (
+	"container/heap"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/wakala/reconciler/internal/domain"
+	"github.com/wakala/reconciler/internal/repository"
+)
+
+type JobStatus string
+
+const (
+	JobQueued    JobStatus = "queued"
+	JobRunning   JobStatus = "running"
+	JobSucceeded JobStatus = "succeeded"
+	JobFailed    JobStatus = "failed"
+)
+
+// ErrDeadLetterClosed is returned for a dead letter already retried or
+// discarded.
+var ErrDeadLetterClosed = errors.New("dead letter was already retried or discarded")
+
+// finishedJobTTL is how long finished jobs stay queryable.
+const finishedJobTTL = time.Hour
+
+// Job is a single report ingestion queued on the Pool.
+type Job struct {
+	ID          string        `json:"id"`
+	Processor   string        `json:"processor"`
+	Format      string        `json:"format"`
+	Priority    int           `json:"priority"`
+	Backfill    bool          `json:"backfill,omitempty"`
+	Status      JobStatus     `json:"status"`
+	Result      *IngestResult `json:"result,omitempty"`
+	Error       string        `json:"error,omitempty"`
+	Attempts    int           `json:"attempts"`
+	MaxAttempts int           `json:"max_attempts"`
+	SubmittedAt time.Time     `json:"submitted_at"`
+	StartedAt   *time.Time    `json:"started_at,omitempty"`
+	// NextAttemptAt is when a failed attempt is retried.
+	NextAttemptAt *time.Time `json:"next_attempt_at,omitempty"`
+	FinishedAt    *time.Time `json:"finished_at,omitempty"`
+	// DeadLettered is set when the job failed its last attempt and was kept
+	// as a dead letter under its ID.
+	DeadLettered bool `json:"dead_lettered,omitempty"`
+
+	data       []byte
+	filename   string
+	provenance *domain.ReportProvenance
+	sidecars   []Sidecar
+	deadLetter bool
+	seq        uint64
+	done       chan struct{}
+}
+
+// PoolConfig controls ingestion concurrency.
+type PoolConfig struct {
+	// Workers is the maximum number of reports parsed concurrently.
+	Workers int
+	// Priorities maps processor to priority; higher runs first. Processors
+	// not listed have priority 0.
+	Priorities map[string]int
+	// MaxAttempts is how many times a job submitted with SubmitAsync is
+	// tried before it becomes a dead letter.
+	MaxAttempts int
+	// RetryDelay is the wait before the second attempt; it doubles for
+	// each attempt after that.
+	RetryDelay time.Duration
+}
+
+// PoolConfigFromEnv reads INGEST_WORKERS (default 2), INGEST_PRIORITIES,
+// a comma-separated list such as "afripay=10,nairagateway=5,capepay=1",
+// INGEST_MAX_ATTEMPTS (default 3) and INGEST_RETRY_DELAY (default 30s).
+func PoolConfigFromEnv() (PoolConfig, error) {
+	cfg := PoolConfig{Workers: 2, Priorities: make(map[string]int), MaxAttempts: 3, RetryDelay: 30 * time.Second}
+
+	if v := os.Getenv("INGEST_WORKERS"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return cfg, fmt.Errorf("INGEST_WORKERS must be a positive integer, got %q", v)
+		}
+		cfg.Workers = n
+	}
+
+	if v := os.Getenv("INGEST_PRIORITIES"); v != "" {
+		for _, pair := range strings.Split(v, ",") {
+			proc, prio, ok := strings.Cut(strings.TrimSpace(pair), "=")
+			if !ok {
+				return cfg, fmt.Errorf("invalid INGEST_PRIORITIES entry %q", pair)
+			}
+			n, err := strconv.Atoi(prio)
+			if err != nil {
+				return cfg, fmt.Errorf("invalid priority for %s: %w", proc, err)
+			}
+			cfg.Priorities[strings.TrimSpace(proc)] = n
+		}
+	}
+
+	if v := os.Getenv("INGEST_MAX_ATTEMPTS"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return cfg, fmt.Errorf("INGEST_MAX_ATTEMPTS must be a positive integer, got %q", v)
+		}
+		cfg.MaxAttempts = n
+	}
+
+	if v := os.Getenv("INGEST_RETRY_DELAY"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			return cfg, fmt.Errorf("INGEST_RETRY_DELAY must be a duration such as 30s, got %q", v)
+		}
+		cfg.RetryDelay = d
+	}
+
+	return cfg, nil
+}
+
+// Pool runs ingestion jobs on a bounded set of workers. Waiting jobs are
+// dequeued by processor priority, then in submission order, so a large
+// low-priority file does not delay daily files from other processors.
+type Pool struct {
+	svc *Service
+	cfg PoolConfig
+
+	mu    sync.Mutex
+	cond  *sync.Cond
+	queue jobQueue
+	jobs  map[string]*Job
+	seq   uint64
+
+	deadLetters *repository.DeadLetterRepo
+}
+
+// NewPool creates a pool. Call Start to launch the workers.
+func NewPool(svc *Service, cfg PoolConfig) *Pool {
+	p := &Pool{
+		svc:  svc,
+		cfg:  cfg,
+		jobs: make(map[string]*Job),
+	}
+	p.cond = sync.NewCond(&p.mu)
+	return p
+}
+
+// SetDeadLetters keeps async jobs that fail their last attempt in repo.
+// Without it they are only logged.
+func (p *Pool) SetDeadLetters(repo *repository.DeadLetterRepo) {
+	p.deadLetters = repo
+}
+
+// DeadLetters returns the repository dead letters are kept in, or nil.
+func (p *Pool) DeadLetters() *repository.DeadLetterRepo {
+	return p.deadLetters
+}
+
+// Start launches the workers. They exit when ctx is cancelled.
+func (p *Pool) Start(ctx context.Context) {
+	for i := 0; i < p.cfg.Workers; i++ {
+		go p.worker(ctx)
+	}
+	go func() {
+		<-ctx.Done()
+		p.mu.Lock()
+		p.cond.Broadcast()
+		p.mu.Unlock()
+	}()
+	log.Printf("[ingestion] Started %d ingestion workers", p.cfg.Workers)
+}
+
+// Submit queues a report for ingestion and returns its job. The job is
+// tried once; the caller is expected to wait for it and act on a failure.
+func (p *Pool) Submit(data []byte, processor, format string, opts IngestOptions) *Job {
+	return p.submit(data, processor, format, opts, 1, false)
+}
+
+// SubmitAsync queues a report that no client waits on. A failed attempt is
+// retried with backoff up to MaxAttempts times, and a job that fails them
+// all is kept as a dead letter to be retried or discarded.
+func (p *Pool) SubmitAsync(data []byte, processor, format string, opts IngestOptions) *Job {
+	return p.submit(data, processor, format, opts, max(p.cfg.MaxAttempts, 1), true)
+}
+
+func (p *Pool) submit(data []byte, processor, format string, opts IngestOptions, attempts int, deadLetter bool) *Job {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.pruneLocked()
+	p.seq++
+	job := &Job{
+		ID:          fmt.Sprintf("JOB-%s-%d", processor, time.Now().UnixNano()),
+		Processor:   processor,
+		Format:      format,
+		Priority:    p.cfg.Priorities[processor],
+		Backfill:    opts.Backfill,
+		Status:      JobQueued,
+		MaxAttempts: attempts,
+		SubmittedAt: time.Now().UTC(),
+		data:        data,
+		filename:    opts.Filename,
+		provenance:  opts.Provenance,
+		sidecars:    opts.Sidecars,
+		deadLetter:  deadLetter,
+		seq:         p.seq,
+		done:        make(chan struct{}),
+	}
+	p.jobs[job.ID] = job
+	heap.Push(&p.queue, job)
+	p.cond.Signal()
+	return job
+}
+
+// Wait blocks until the job finishes or ctx is done, then returns a snapshot.
+func (p *Pool) Wait(ctx context.Context, job *Job) (Job, error) {
+	select {
+	case <-job.done:
+	case <-ctx.Done():
+		return p.snapshot(job), ctx.Err()
+	}
+	return p.snapshot(job), nil
+}
+
+// Find returns a live job by ID, for use with Wait.
+func (p *Pool) Find(id string) (*Job, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	job, ok := p.jobs[id]
+	return job, ok
+}
+
+// Get returns a snapshot of a job by ID.
+func (p *Pool) Get(id string) (Job, bool) {
+	p.mu.Lock()
+	job, ok := p.jobs[id]
+	p.mu.Unlock()
+	if !ok {
+		return Job{}, false
+	}
+	return p.snapshot(job), true
+}
+
+func (p *Pool) snapshot(job *Job) Job {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	cp := *job
+	cp.data = nil
+	return cp
+}
+
+func (p *Pool) worker(ctx context.Context) {
+	for {
+		p.mu.Lock()
+		for p.queue.Len() == 0 && ctx.Err() == nil {
+			p.cond.Wait()
+		}
+		if ctx.Err() != nil {
+			p.mu.Unlock()
+			return
+		}
+		job := heap.Pop(&p.queue).(*Job)
+		now := time.Now().UTC()
+		job.Status = JobRunning
+		job.Attempts++
+		if job.StartedAt == nil {
+			job.StartedAt = &now
+		}
+		job.NextAttemptAt = nil
+		data := job.data
+		p.mu.Unlock()
+
+		result, err := p.svc.IngestReport(data, job.Processor, job.Format,
+			IngestOptions{Backfill: job.Backfill, Filename: job.filename, Provenance: job.provenance, Sidecars: job.sidecars})
+		if err != nil && p.retryLater(ctx, job, err) {
+			continue
+		}
+		deadLettered := false
+		if err != nil && job.deadLetter {
+			deadLettered = p.keepDeadLetter(job, data, err)
+		}
+
+		p.mu.Lock()
+		finished := time.Now().UTC()
+		job.FinishedAt = &finished
+		job.data = nil
+		job.sidecars = nil
+		if err != nil {
+			job.Status = JobFailed
+			job.Error = err.Error()
+			job.DeadLettered = deadLettered
+		} else {
+			job.Status = JobSucceeded
+			job.Result = result
+		}
+		close(job.done)
+		p.mu.Unlock()
+	}
+}
+
+// retryLater puts a failed job back on the queue after a backoff if it has
+// attempts left, and reports whether it did.
+func (p *Pool) retryLater(ctx context.Context, job *Job, err error) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if job.Attempts >= job.MaxAttempts || ctx.Err() != nil {
+		return false
+	}
+	delay := p.cfg.RetryDelay << (job.Attempts - 1)
+	next := time.Now().UTC().Add(delay)
+	job.Status = JobQueued
+	job.Error = err.Error()
+	job.NextAttemptAt = &next
+	log.Printf("[ingestion] Job %s failed attempt %d of %d, retrying in %s: %v",
+		job.ID, job.Attempts, job.MaxAttempts, delay, err)
+
+	time.AfterFunc(delay, func() {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		heap.Push(&p.queue, job)
+		p.cond.Signal()
+	})
+	return true
+}
+
+// keepDeadLetter stores a job that failed its last attempt, with the file
+// it was submitted with, and reports whether it was stored.
+func (p *Pool) keepDeadLetter(job *Job, data []byte, err error) bool {
+	if p.deadLetters == nil {
+		log.Printf("[ingestion] WARNING: job %s failed %d attempts and is dropped: %v", job.ID, job.Attempts, err)
+		return false
+	}
+	dl := &domain.DeadLetter{
+		ID:          job.ID,
+		Processor:   domain.Processor(job.Processor),
+		Format:      job.Format,
+		Backfill:    job.Backfill,
+		File:        domain.ReportFile{Hash: fmt.Sprintf("%x", sha256.Sum256(data)), Filename: job.filename, Size: len(data), Data: data},
+		Provenance:  job.provenance,
+		Error:       err.Error(),
+		Attempts:    job.Attempts,
+		SubmittedAt: job.SubmittedAt,
+		FailedAt:    time.Now().UTC(),
+	}
+	for _, sc := range job.sidecars {
+		dl.Sidecars = append(dl.Sidecars, domain.ReportFile{Filename: sc.Filename, Size: len(sc.Data), Data: sc.Data})
+	}
+	if err := p.deadLetters.Insert(dl); err != nil {
+		log.Printf("[ingestion] WARNING: job %s failed %d attempts and could not be kept as a dead letter: %v",
+			job.ID, job.Attempts, err)
+		return false
+	}
+	log.Printf("[ingestion] Job %s failed %d attempts and was kept as a dead letter: %v", job.ID, job.Attempts, err)
+	return true
+}
+
+// RetryDeadLetter queues an open dead letter's file again as a new async
+// job and closes the dead letter as retried by user.
+func (p *Pool) RetryDeadLetter(id, user string) (*Job, error) {
+	if p.deadLetters == nil {
+		return nil, sql.ErrNoRows
+	}
+	dl, err := p.deadLetters.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	if dl.Status != domain.DeadLetterOpen {
+		return nil, ErrDeadLetterClosed
+	}
+	file, err := p.deadLetters.GetFile(id)
+	if err != nil {
+		return nil, fmt.Errorf("dead letter file: %w", err)
+	}
+
+	opts := IngestOptions{Backfill: dl.Backfill, Filename: file.Filename, Provenance: dl.Provenance}
+	for _, sc := range dl.Sidecars {
+		opts.Sidecars = append(opts.Sidecars, Sidecar{Filename: sc.Filename, Data: sc.Data})
+	}
+	job := p.SubmitAsync(file.Data, string(dl.Processor), dl.Format, opts)
+	if _, err := p.deadLetters.Resolve(id, domain.DeadLetterRetried, user, job.ID, time.Now().UTC()); err != nil {
+		return job, fmt.Errorf("resolve dead letter: %w", err)
+	}
+	return job, nil
+}
+
+// DiscardDeadLetter closes an open dead letter without ingesting it. Its
+// file is then purged with the next retention run.
+func (p *Pool) DiscardDeadLetter(id, user string) error {
+	if p.deadLetters == nil {
+		return sql.ErrNoRows
+	}
+	dl, err := p.deadLetters.Get(id)
+	if err != nil {
+		return err
+	}
+	if dl.Status != domain.DeadLetterOpen {
+		return ErrDeadLetterClosed
+	}
+	ok, err := p.deadLetters.Resolve(id, domain.DeadLetterDiscarded, user, "", time.Now().UTC())
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrDeadLetterClosed
+	}
+	return nil
+}
+
+// pruneLocked drops finished jobs older than finishedJobTTL.
+func (p *Pool) pruneLocked() {
+	cutoff := time.Now().Add(-finishedJobTTL)
+	for id, job := range p.jobs {
+		if job.FinishedAt != nil && job.FinishedAt.Before(cutoff) {
+			delete(p.jobs, id)
+		}
+	}
+}
+
+// jobQueue is a max-heap on priority, FIFO within equal priority.
+type jobQueue []*Job
+
+func (q jobQueue) Len() int { return len(q) }
+func (q jobQueue) Less(i, j int) bool {
+	if q[i].Priority != q[j].Priority {
+		return q[i].Priority > q[j].Priority
+	}
+	return q[i].seq < q[j].seq
+}
+func (q jobQueue) Swap(i, j int) { q[i], q[j] = q[j], q[i] }
+func (q *jobQueue) Push(x any)   { *q = append(*q, x.(*Job)) }
+func (q *jobQueue) Pop() any {
+	old := *q
+	n := len(old)
+	job := old[n-1]
+	*q = old[:n-1]
+	return job
+}
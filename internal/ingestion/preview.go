@@ -0,0 +1,131 @@
+package ingestion
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/wakala/reconciler/internal/domain"
+)
+
+// previewReportID is used for records parsed during a preview; nothing with
+// this ID is ever persisted.
+const previewReportID = "preview"
+
+// PreviewResult describes what ingesting a file would produce, without
+// persisting anything.
+type PreviewResult struct {
+	BatchID         string                    `json:"batch_id"`
+	AlreadyIngested bool                      `json:"already_ingested"`
+	TotalRecords    int                       `json:"total_records"`
+	Records         []domain.SettlementRecord `json:"records"`
+	Metrics         *IngestMetrics            `json:"metrics"`
+	Warnings        []string                  `json:"warnings"`
+}
+
+// PreviewReport parses a settlement report and returns the first limit
+// normalized records along with totals and validation warnings. It is useful
+// before committing an unfamiliar file.
+func (s *Service) PreviewReport(data []byte, processor string, format string, limit int) (*PreviewResult, error) {
+	data, _, err := decryptReport(domain.Processor(processor), data)
+	if err != nil {
+		return nil, err
+	}
+	hash := fmt.Sprintf("%x", sha256.Sum256(data))
+	exists, err := s.settlementRepo.ReportExistsByHash(hash)
+	if err != nil {
+		return nil, fmt.Errorf("check hash: %w", err)
+	}
+
+	parseStart := time.Now()
+	parsed, transform, err := s.parse(domain.Processor(processor), format, data, previewReportID)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &PreviewResult{
+		BatchID:         parsed.BatchID,
+		AlreadyIngested: exists,
+		TotalRecords:    len(parsed.Records),
+		Metrics:         computeMetrics(parsed, time.Since(parseStart)),
+		Warnings:        validateParsed(parsed, domain.Processor(processor)),
+	}
+	result.Metrics.Transform = transform
+	if exists {
+		result.Warnings = append(result.Warnings,
+			"file has already been ingested; ingesting it again will be a no-op")
+	}
+
+	records := parsed.Records
+	if len(records) > limit {
+		records = records[:limit]
+	}
+	result.Records = records
+
+	return result, nil
+}
+
+// validateParsed returns human-readable warnings about a parsed file.
+func validateParsed(parsed *ParseResult, processor domain.Processor) []string {
+	warnings := []string{}
+
+	if parsed.BatchID == "" {
+		warnings = append(warnings, "no batch ID found in file; one will be generated on ingest")
+	}
+	var batches []string
+	for i := range parsed.Records {
+		if id := parsed.Records[i].BatchID; !slices.Contains(batches, id) {
+			batches = append(batches, id)
+		}
+	}
+	if len(batches) > 1 {
+		warnings = append(warnings, fmt.Sprintf(
+			"file holds %d batches (%s); each will be ingested as its own report", len(batches), strings.Join(batches, ", ")))
+	}
+	if len(parsed.Records) == 0 {
+		warnings = append(warnings, "file contains no settlement records")
+	}
+	for _, pw := range parsed.Warnings {
+		if pw.Line == 0 {
+			warnings = append(warnings, pw.Message)
+		} else if pw.Kind == WarnLineSkipped {
+			warnings = append(warnings, fmt.Sprintf("line %d skipped: %s", pw.Line, pw.Message))
+		} else {
+			warnings = append(warnings, fmt.Sprintf("line %d: %s", pw.Line, pw.Message))
+		}
+	}
+
+	if len(parsed.Records) > 0 && parsed.Records[0].Processor != processor {
+		warnings = append(warnings, fmt.Sprintf(
+			"file format produces %s records but processor %s was selected",
+			parsed.Records[0].Processor, processor))
+	} else if err := checkRecords(processor, parsed.Records); err != nil {
+		warnings = append(warnings, err.Error()+"; ingesting the file will fail")
+	}
+	if err := checkAmounts(processor, parsed.Records); err != nil {
+		warnings = append(warnings, err.Error()+"; ingesting the file will fail")
+	}
+
+	seen := make(map[string]bool, len(parsed.Records))
+	for i := range parsed.Records {
+		rec := &parsed.Records[i]
+
+		if seen[rec.ProcessorTransactionID] {
+			warnings = append(warnings, fmt.Sprintf(
+				"duplicate processor transaction ID %s in file", rec.ProcessorTransactionID))
+		}
+		seen[rec.ProcessorTransactionID] = true
+
+		if rec.Adjustment == nil && rec.GrossAmount <= 0 {
+			warnings = append(warnings, fmt.Sprintf(
+				"record %s has non-positive gross amount %.2f", rec.ProcessorTransactionID, rec.GrossAmount))
+		}
+		if msg := rec.NetError(); msg != "" {
+			warnings = append(warnings, fmt.Sprintf("record %s: %s", rec.ProcessorTransactionID, msg))
+		}
+	}
+
+	return warnings
+}
@@ -0,0 +1,73 @@
+package ingestion
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/wakala/reconciler/internal/domain"
+)
+
+// ErrProcessorMismatch is returned when a report, or a record pulled or
+// pushed for a processor, belongs to another processor: the format is
+// another processor's, or a record is in a currency the processor does not
+// settle in.
+var ErrProcessorMismatch = errors.New("report does not match processor")
+
+// formatProcessors is the processor each built-in format is the report of.
+var formatProcessors = map[string]domain.Processor{
+	"csv_a":     domain.ProcessorAfriPay,
+	"json_b":    domain.ProcessorNairaGateway,
+	"csv_c":     domain.ProcessorCapePay,
+	"csv_mpesa": domain.ProcessorMPesa,
+}
+
+// processorCurrencies are the currencies each processor settles in.
+// Processors not listed are not checked.
+var processorCurrencies = map[domain.Processor][]string{
+	domain.ProcessorAfriPay:      {"KES"},
+	domain.ProcessorNairaGateway: {"NGN"},
+	domain.ProcessorCapePay:      {"ZAR"},
+	domain.ProcessorMPesa:        {"KES"},
+}
+
+// processorCountries is the country each processor settles in, whose tax is
+// withheld on its fees.
+var processorCountries = map[domain.Processor]string{
+	domain.ProcessorAfriPay:      "KE",
+	domain.ProcessorNairaGateway: "NG",
+	domain.ProcessorCapePay:      "ZA",
+	domain.ProcessorMPesa:        "KE",
+}
+
+// CheckFormat returns an ErrProcessorMismatch error when format is a
+// built-in format of a processor other than proc. The external format
+// belongs to whichever processor registered it.
+func CheckFormat(proc domain.Processor, format string) error {
+	if owner, ok := formatProcessors[format]; ok && owner != proc {
+		return fmt.Errorf("%w: %s is the %s report format; upload it with processor=%s or pick %s's format",
+			ErrProcessorMismatch, format, owner, owner, proc)
+	}
+	return nil
+}
+
+// checkRecords returns an ErrProcessorMismatch error naming the first
+// record that was parsed for another processor or is in a currency proc
+// does not settle in. Transform scripts run before it, so a script that
+// rewrites the currency is checked too.
+func checkRecords(proc domain.Processor, records []domain.SettlementRecord) error {
+	currencies := processorCurrencies[proc]
+	for i := range records {
+		rec := &records[i]
+		if rec.Processor != proc {
+			return fmt.Errorf("%w: record %s is a %s record, not %s",
+				ErrProcessorMismatch, rec.ProcessorTransactionID, rec.Processor, proc)
+		}
+		if currencies != nil && !slices.Contains(currencies, rec.Currency) {
+			return fmt.Errorf("%w: record %s is in %s, but %s settles in %s",
+				ErrProcessorMismatch, rec.ProcessorTransactionID, rec.Currency, proc, strings.Join(currencies, ", "))
+		}
+	}
+	return nil
+}
@@ -2,21 +2,83 @@ package ingestion
 
 import (
 	"crypto/sha256"
+	"encoding/json"
 	"fmt"
 	"log"
+	"sync"
 	"time"
 
+	"github.com/wakala/reconciler/internal/currency"
 	"github.com/wakala/reconciler/internal/domain"
+	"github.com/wakala/reconciler/internal/live"
+	"github.com/wakala/reconciler/internal/notify"
 	"github.com/wakala/reconciler/internal/reconciliation"
 	"github.com/wakala/reconciler/internal/repository"
 )
 
 // IngestResult is returned from a successful ingestion.
 type IngestResult struct {
-	ReportID             string `json:"report_id"`
-	RecordsIngested      int    `json:"records_ingested"`
-	DuplicatesSkipped    int    `json:"duplicates_skipped"`
-	DiscrepanciesDetected int   `json:"discrepancies_detected"`
+	ReportID              string `json:"report_id"`
+	BatchID               string `json:"batch_id,omitempty"`
+	BatchReportCount      int    `json:"batch_report_count,omitempty"`
+	RecordsIngested       int    `json:"records_ingested"`
+	DuplicatesSkipped     int    `json:"duplicates_skipped"`
+	DiscrepanciesDetected int    `json:"discrepancies_detected"`
+	AlertsRaised          int    `json:"alerts_raised,omitempty"`
+	Backfill              bool   `json:"backfill,omitempty"`
+	// ReconciliationDeferred is set when reconciliation was left to the
+	// debounced run; DiscrepanciesDetected is then zero.
+	ReconciliationDeferred bool `json:"reconciliation_deferred,omitempty"`
+	// PendingAdjustmentID is set when the report was held back because it
+	// has records in ClosedPeriods. Nothing was stored.
+	PendingAdjustmentID string         `json:"pending_adjustment_id,omitempty"`
+	ClosedPeriods       []string       `json:"closed_periods,omitempty"`
+	Metrics             *IngestMetrics `json:"metrics,omitempty"`
+	// Verification is how the file was checked against its sidecars.
+	Verification *domain.ReportVerification `json:"verification,omitempty"`
+	// ControlTotals are the totals the report's footer declares, checked
+	// against its records.
+	ControlTotals *domain.ControlTotals `json:"control_totals,omitempty"`
+	// Reports is set, with ReportID multiBatchReportID, when the upload held
+	// several batches: it has the result of each batch's report, and the
+	// counts above are their totals.
+	Reports []*IngestResult `json:"reports,omitempty"`
+}
+
+// IngestOptions adjusts how a single report is ingested.
+type IngestOptions struct {
+	// Backfill loads a historical file: USD amounts use the FX rate in
+	// effect on each record's settlement date, reconciliation is evaluated
+	// as of the file's latest settlement date and only within the file's
+	// scope, and alerts and notifications are suppressed.
+	Backfill bool
+
+	// approvedAdjustment is the ID of the pending adjustment being applied;
+	// it lets the report through into closed periods.
+	approvedAdjustment string
+
+	// skipReconcile leaves reconciliation to the caller, which runs it once
+	// for a whole batch of reports.
+	skipReconcile bool
+
+	// Filename is the name the file was uploaded under, kept with the file.
+	Filename string
+
+	// Provenance records where the file came from when it did not come
+	// through the API, and is kept with every report stored from it.
+	Provenance *domain.ReportProvenance
+
+	// Sidecars are checksum or signature files the report is verified
+	// against before it is parsed.
+	Sidecars []Sidecar
+
+	// verification is the result of checking Sidecars, kept with every
+	// report stored from the file.
+	verification *domain.ReportVerification
+
+	// source is the file being ingested, kept with every report stored from
+	// it. Reports built from records rather than a file have none.
+	source *domain.ReportFile
 }
 
 // Service handles ingestion of settlement reports from various processors.
@@ -24,7 +86,51 @@ type Service struct {
 	settlementRepo *repository.SettlementRepo
 	txnRepo        *repository.TransactionRepo
 	discRepo       *repository.DiscrepancyRepo
+	alertRepo      *repository.AlertRepo
+	periodRepo     *repository.PeriodRepo
+	transformRepo  *repository.TransformRepo
 	reconSvc       *reconciliation.Service
+	uow            *repository.UnitOfWork
+
+	notifierMu    sync.Mutex
+	alertNotifier *notify.AlertNotifier
+
+	// feed receives ingest.completed for the dashboard's live feed, when
+	// set. It is guarded by writeMu.
+	feed *live.Hub
+
+	// writeMu serializes the persist-and-reconcile phase. Parsing may run
+	// concurrently on the ingestion pool, but SQLite has a single writer and
+	// reconciliation rebuilds discrepancies from scratch.
+	writeMu sync.Mutex
+}
+
+// revalueAtSettlementDate recomputes USD amounts using the FX rate in effect
+// on each record's settlement date.
+func revalueAtSettlementDate(records []domain.SettlementRecord) error {
+	for i := range records {
+		rec := &records[i]
+		gross, err := currency.ToUSDAt(rec.GrossAmount, rec.Currency, rec.SettlementDate)
+		if err != nil {
+			return fmt.Errorf("record %s: %w", rec.ID, err)
+		}
+		net, err := currency.ToUSDAt(rec.NetAmount, rec.Currency, rec.SettlementDate)
+		if err != nil {
+			return fmt.Errorf("record %s: %w", rec.ID, err)
+		}
+		rec.USDGrossAmount = gross
+		rec.USDNetAmount = net
+	}
+	return nil
+}
+
+// alreadyIngested is the result for a file whose hash was seen before.
+func alreadyIngested() *IngestResult {
+	return &IngestResult{
+		ReportID:          "already-ingested",
+		RecordsIngested:   0,
+		DuplicatesSkipped: 0,
+	}
 }
 
 // NewService creates a new ingestion service.
@@ -32,21 +138,98 @@ func NewService(
 	settlementRepo *repository.SettlementRepo,
 	txnRepo *repository.TransactionRepo,
 	discRepo *repository.DiscrepancyRepo,
+	alertRepo *repository.AlertRepo,
+	periodRepo *repository.PeriodRepo,
+	transformRepo *repository.TransformRepo,
 	reconSvc *reconciliation.Service,
+	uow *repository.UnitOfWork,
 ) *Service {
 	return &Service{
 		settlementRepo: settlementRepo,
 		txnRepo:        txnRepo,
 		discRepo:       discRepo,
+		alertRepo:      alertRepo,
+		periodRepo:     periodRepo,
+		transformRepo:  transformRepo,
 		reconSvc:       reconSvc,
+		uow:            uow,
+	}
+}
+
+// SetAlertNotifier emails the alerts raised for rejected reports through n.
+// Other ingestion alerts are only stored and logged. It may be called again
+// while reports are ingested; nil stops the emails.
+func (s *Service) SetAlertNotifier(n *notify.AlertNotifier) {
+	s.notifierMu.Lock()
+	defer s.notifierMu.Unlock()
+	s.alertNotifier = n
+}
+
+// SetLiveFeed publishes ingest.completed to hub for every stored report.
+func (s *Service) SetLiveFeed(hub *live.Hub) {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	s.feed = hub
+}
+
+// Parse dispatches to the parser for the given format.
+//
+// format must be one of: csv_a, json_b, csv_c, csv_mpesa
+func Parse(format string, data []byte, reportID string) (*ParseResult, error) {
+	var parsed *ParseResult
+	var err error
+
+	switch format {
+	case "csv_a":
+		parsed, err = ParseAfriPayCSV(data, reportID)
+	case "json_b":
+		parsed, err = ParseNairaGatewayJSON(data, reportID)
+	case "csv_c":
+		parsed, err = ParseCapePayCSV(data, reportID)
+	case "csv_mpesa":
+		parsed, err = ParseMPesaStatementCSV(data, reportID)
+	default:
+		return nil, fmt.Errorf("unsupported format: %s", format)
 	}
+	if err != nil {
+		return nil, fmt.Errorf("parse %s: %w", format, err)
+	}
+	classifyAdjustments(parsed.Records)
+	return parsed, nil
 }
 
 // IngestReport parses a settlement report file and stores the records.
-// It also triggers reconciliation after ingestion.
+// It also triggers reconciliation after ingestion. A NairaGateway v2 file
+// with several batches is stored as one report per batch. A report that is
+// PGP-encrypted is decrypted first with the processor's registered key.
 //
-// format must be one of: csv_a, json_b, csv_c
-func (s *Service) IngestReport(data []byte, processor string, format string) (*IngestResult, error) {
+// format must be one of: csv_a, json_b, csv_c, csv_mpesa, or external when
+// the processor has a registered external parser.
+func (s *Service) IngestReport(data []byte, processor string, format string, opts IngestOptions) (*IngestResult, error) {
+	proc := domain.Processor(processor)
+	sent, sentName := data, opts.Filename
+	// An encrypted report is hashed and stored decrypted, so it is recognised
+	// however many times the processor re-encrypts it.
+	data, encrypted, err := decryptReport(proc, data)
+	if err != nil {
+		return nil, err
+	}
+	if encrypted {
+		opts.Filename = decryptedFilename(opts.Filename)
+	}
+
+	if opts.verification == nil {
+		v, err := verifyReport(proc, sent, data, sentName, opts.Sidecars)
+		if err != nil {
+			s.rejectUnverified(proc, fmt.Sprintf("%x", sha256.Sum256(sent)), sentName, err)
+			return nil, fmt.Errorf("verify report: %w", err)
+		}
+		if v.Status == domain.VerificationVerified {
+			s.resolveVerified(proc, sentName)
+		}
+		opts.verification = v
+	}
+
 	// Idempotency check via file hash.
 	hash := fmt.Sprintf("%x", sha256.Sum256(data))
 	exists, err := s.settlementRepo.ReportExistsByHash(hash)
@@ -54,38 +237,155 @@ func (s *Service) IngestReport(data []byte, processor string, format string) (*I
 		return nil, fmt.Errorf("check hash: %w", err)
 	}
 	if exists {
-		return &IngestResult{
-			ReportID:          "already-ingested",
-			RecordsIngested:   0,
-			DuplicatesSkipped: 0,
-		}, nil
+		return alreadyIngested(), nil
+	}
+	if opts.source == nil {
+		opts.source = &domain.ReportFile{Hash: hash, Filename: opts.Filename, Size: len(data), Data: data}
 	}
 
 	reportID := fmt.Sprintf("RPT-%s-%d", processor, time.Now().UnixNano())
-	proc := domain.Processor(processor)
+	if err := CheckFormat(proc, format); err != nil {
+		return nil, err
+	}
+	if format == "json_b" {
+		parts, err := splitNairaGatewayBatches(data)
+		if err != nil {
+			return nil, fmt.Errorf("parse %s: %w", format, err)
+		}
+		if len(parts) > 1 {
+			return s.ingestBatches(parts, processor, format, opts)
+		}
+	}
 
-	var records []domain.SettlementRecord
-	var batchID string
+	parseStart := time.Now()
+	parsed, transform, err := s.parse(proc, format, data, reportID)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Backfill {
+		if err := revalueAtSettlementDate(parsed.Records); err != nil {
+			return nil, fmt.Errorf("historical fx: %w", err)
+		}
+	}
+	metrics := computeMetrics(parsed, time.Since(parseStart))
+	metrics.Transform = transform
 
-	switch format {
-	case "csv_a":
-		records, batchID, err = ParseAfriPayCSV(data, reportID)
-	case "json_b":
-		records, batchID, err = ParseNairaGatewayJSON(data, reportID)
-	case "csv_c":
-		records, batchID, err = ParseCapePayCSV(data, reportID)
-	default:
-		return nil, fmt.Errorf("unsupported format: %s", format)
+	return s.store(hash, reportID, proc, parsed, metrics, opts)
+}
+
+// IngestRecords stores settlement records that did not arrive as a file, such
+// as those pulled from a processor API, as one report of the given batch.
+// Records must already be normalized; their ReportID is overwritten. Records
+// the batch already has are dropped first, and if none remain no report is
+// created, so overlapping incremental pulls are no-ops.
+func (s *Service) IngestRecords(processor string, batchID string, records []domain.SettlementRecord) (*IngestResult, error) {
+	return s.ingestRecords(processor, batchID, records, IngestOptions{})
+}
+
+func (s *Service) ingestRecords(processor string, batchID string, records []domain.SettlementRecord, opts IngestOptions) (*IngestResult, error) {
+	if batchID != "" {
+		known, err := s.settlementRepo.GetBatchTransactionIDs(processor, batchID)
+		if err != nil {
+			return nil, fmt.Errorf("get batch records: %w", err)
+		}
+		fresh := records[:0:0]
+		for _, rec := range records {
+			if !known[rec.ProcessorTransactionID] {
+				fresh = append(fresh, rec)
+			}
+		}
+		if len(fresh) == 0 {
+			return &IngestResult{
+				ReportID:          "already-ingested",
+				BatchID:           batchID,
+				DuplicatesSkipped: len(records),
+			}, nil
+		}
+		records = fresh
 	}
+
+	payload, err := json.Marshal(records)
 	if err != nil {
-		return nil, fmt.Errorf("parse %s: %w", format, err)
+		return nil, fmt.Errorf("hash records: %w", err)
+	}
+	hash := fmt.Sprintf("%x", sha256.Sum256(payload))
+	exists, err := s.settlementRepo.ReportExistsByHash(hash)
+	if err != nil {
+		return nil, fmt.Errorf("check hash: %w", err)
+	}
+	if exists {
+		return alreadyIngested(), nil
 	}
 
+	reportID := fmt.Sprintf("RPT-%s-%d", processor, time.Now().UnixNano())
+	for i := range records {
+		records[i].ReportID = reportID
+	}
+	classifyAdjustments(records)
+	parsed := &ParseResult{Records: records, BatchID: batchID}
+	applyAmountPolicy(domain.Processor(processor), parsed)
+	applyWithholding(domain.Processor(processor), parsed)
+	metrics := computeMetrics(parsed, 0)
+
+	return s.store(hash, reportID, domain.Processor(processor), parsed, metrics, opts)
+}
+
+// store persists a parsed report and its records, then checks batch gaps and
+// reconciles. It holds writeMu for the whole phase.
+func (s *Service) store(
+	hash, reportID string,
+	proc domain.Processor,
+	parsed *ParseResult,
+	metrics *IngestMetrics,
+	opts IngestOptions,
+) (*IngestResult, error) {
+	processor := string(proc)
+	if err := checkRecords(proc, parsed.Records); err != nil {
+		return nil, err
+	}
+	if err := checkAmounts(proc, parsed.Records); err != nil {
+		return nil, err
+	}
+
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+
+	// Another worker may have stored the same file while we were parsing.
+	if exists, err := s.settlementRepo.ReportExistsByHash(hash); err != nil {
+		return nil, fmt.Errorf("check hash: %w", err)
+	} else if exists {
+		return alreadyIngested(), nil
+	}
+
+	// Records in a closed period wait for approval instead.
+	if opts.approvedAdjustment == "" {
+		held, err := s.holdForClosedPeriods(hash, reportID, proc, parsed, metrics, opts)
+		if err != nil {
+			return nil, fmt.Errorf("check closed periods: %w", err)
+		}
+		if held != nil {
+			return held, nil
+		}
+	}
+
+	records := parsed.Records
+	batchID := parsed.BatchID
 	if batchID == "" {
 		batchID = fmt.Sprintf("BATCH-%d", time.Now().UnixNano())
+		for i := range records {
+			records[i].BatchID = batchID
+		}
 	}
 
-	// Store the report.
+	// Store the report, its file first when that goes to a blob store. The
+	// report and its records are written in one transaction: a report row
+	// without its records would make a retry of the same file look already
+	// ingested.
+	if opts.source != nil {
+		if err := s.settlementRepo.PutReportFile(opts.source); err != nil {
+			return nil, fmt.Errorf("store report file: %w", err)
+		}
+	}
 	report := &domain.SettlementReport{
 		ID:          reportID,
 		Processor:   proc,
@@ -95,23 +395,106 @@ func (s *Service) IngestReport(data []byte, processor string, format string) (*I
 		RecordCount: len(records),
 		IngestedAt:  time.Now(),
 	}
-	if err := s.settlementRepo.InsertReport(report); err != nil {
-		return nil, fmt.Errorf("insert report: %w", err)
-	}
+	var inserted, batchReports int
+	err := s.uow.Run(func(tx *repository.Tx) error {
+		if err := tx.Settlements.InsertReport(report); err != nil {
+			return fmt.Errorf("insert report: %w", err)
+		}
+		if err := tx.Settlements.InsertReportWarnings(reportID, parsed.Warnings); err != nil {
+			return fmt.Errorf("insert report warnings: %w", err)
+		}
+		if opts.source != nil {
+			if err := tx.Settlements.InsertReportFile(reportID, opts.source); err != nil {
+				return fmt.Errorf("insert report file: %w", err)
+			}
+		}
+		if opts.Provenance != nil {
+			if err := tx.Settlements.InsertReportProvenance(reportID, opts.Provenance); err != nil {
+				return fmt.Errorf("insert report provenance: %w", err)
+			}
+		}
+		if opts.verification != nil {
+			if err := tx.Settlements.InsertReportVerification(reportID, opts.verification); err != nil {
+				return fmt.Errorf("insert report verification: %w", err)
+			}
+		}
+		if parsed.ControlTotals != nil {
+			if err := tx.Settlements.InsertReportControlTotals(reportID, parsed.ControlTotals); err != nil {
+				return fmt.Errorf("insert report control totals: %w", err)
+			}
+		}
 
-	// Store the records.
-	inserted, err := s.settlementRepo.InsertRecords(records)
+		// Store the records.
+		var err error
+		inserted, err = tx.Settlements.InsertRecords(records)
+		if err != nil {
+			return fmt.Errorf("insert records: %w", err)
+		}
+		batchReports, err = tx.Settlements.CountBatchReports(processor, batchID)
+		if err != nil {
+			return fmt.Errorf("count batch reports: %w", err)
+		}
+		return nil
+	})
 	if err != nil {
-		return nil, fmt.Errorf("insert records: %w", err)
+		return nil, err
 	}
 
-	log.Printf("[ingestion] Ingested report %s: %d records (%d new) from %s",
-		reportID, len(records), inserted, processor)
+	log.Printf("[ingestion] Ingested report %s: %d records (%d new) from %s, batch %s (report %d)",
+		reportID, len(records), inserted, processor, batchID, batchReports)
 
-	// Run reconciliation.
-	reconResult, err := s.reconSvc.RunFullReconciliation()
-	if err != nil {
-		log.Printf("[ingestion] WARNING: reconciliation failed: %v", err)
+	// Check for skipped batch numbers now that this batch is recorded.
+	// Historical loads would raise a flood of stale alerts, so skip it.
+	alertsRaised := 0
+	if !opts.Backfill {
+		alertsRaised, err = s.checkBatchGaps(proc)
+		if err != nil {
+			log.Printf("[ingestion] WARNING: batch gap check failed: %v", err)
+		}
+		raised, err := s.checkCarriedBalances(proc)
+		if err != nil {
+			log.Printf("[ingestion] WARNING: carried balance check failed: %v", err)
+		}
+		alertsRaised += raised
+		if ct := parsed.ControlTotals; ct != nil && !ct.Matched {
+			raised, err := s.alertControlTotals(proc, reportID, batchID, ct)
+			if err != nil {
+				log.Printf("[ingestion] WARNING: control total alert failed: %v", err)
+			} else if raised {
+				alertsRaised++
+			}
+		}
+	}
+
+	s.feed.Publish(live.EventIngestCompleted, live.IngestCompleted{
+		ReportID:          reportID,
+		Processor:         processor,
+		BatchID:           batchID,
+		RecordsIngested:   inserted,
+		DuplicatesSkipped: len(records) - inserted,
+		AlertsRaised:      alertsRaised,
+	})
+
+	// Run reconciliation. Backfills are evaluated as of the file's latest
+	// settlement date so the missing-settlement cutoff matches that day, and
+	// only within the file's scope.
+	// Live ingests share a debounced run when one is configured; approved
+	// adjustments reconcile at once so the approver sees the outcome.
+	var reconResult *reconciliation.ReconciliationResult
+	var reconErr error
+	deferred := false
+	switch {
+	case opts.skipReconcile:
+		// The caller reconciles the whole batch once.
+	case !opts.Backfill && opts.approvedAdjustment == "" && s.reconSvc.RequestRun():
+		deferred = true
+	case opts.Backfill:
+		reconResult, reconErr = s.reconcileBackfill([]string{reportID}, metrics.MaxSettlementDate)
+	default:
+		reconResult, reconErr = s.reconSvc.RunFullReconciliation()
+	}
+	if reconErr != nil {
+		log.Printf("[ingestion] WARNING: reconciliation failed: %v", reconErr)
 		// Do not fail ingestion if reconciliation has issues.
 	}
 
@@ -121,9 +504,17 @@ func (s *Service) IngestReport(data []byte, processor string, format string) (*I
 	}
 
 	return &IngestResult{
-		ReportID:              reportID,
-		RecordsIngested:       inserted,
-		DuplicatesSkipped:     len(records) - inserted,
-		DiscrepanciesDetected: discrepanciesDetected,
+		ReportID:               reportID,
+		BatchID:                batchID,
+		BatchReportCount:       batchReports,
+		RecordsIngested:        inserted,
+		DuplicatesSkipped:      len(records) - inserted,
+		DiscrepanciesDetected:  discrepanciesDetected,
+		AlertsRaised:           alertsRaised,
+		Backfill:               opts.Backfill,
+		ReconciliationDeferred: deferred,
+		Metrics:                metrics,
+		Verification:           opts.verification,
+		ControlTotals:          parsed.ControlTotals,
 	}, nil
 }
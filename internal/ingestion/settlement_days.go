@@ -0,0 +1,152 @@
+package ingestion
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/wakala/reconciler/internal/domain"
+)
+
+// SettlementDays are the weekdays a processor settles on, indexed by
+// time.Weekday. A processor is expected to send settlement records dated
+// each of them.
+type SettlementDays [7]bool
+
+var (
+	weekdays  = SettlementDays{false, true, true, true, true, true, false}
+	everyDay  = SettlementDays{true, true, true, true, true, true, true}
+	dayTokens = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+)
+
+// defaultSettlementDays are the processors' settlement days when
+// SETTLEMENT_DAYS does not name them: banking days for the card processors,
+// every day for M-Pesa.
+var defaultSettlementDays = map[domain.Processor]SettlementDays{
+	domain.ProcessorAfriPay:      weekdays,
+	domain.ProcessorNairaGateway: weekdays,
+	domain.ProcessorCapePay:      weekdays,
+	domain.ProcessorMPesa:        everyDay,
+}
+
+// settlementDays is the registry of settlement days by processor. It is
+// filled once at startup by RegisterSettlementDays.
+var settlementDays = map[domain.Processor]SettlementDays{}
+
+// RegisterSettlementDays sets the settlement days of each processor in
+// days. It must be called before the calendar is read.
+func RegisterSettlementDays(days map[domain.Processor]SettlementDays) {
+	for proc, d := range days {
+		settlementDays[proc] = d
+	}
+}
+
+// SettlementDaysFor returns the days proc settles on.
+func SettlementDaysFor(proc domain.Processor) SettlementDays {
+	if d, ok := settlementDays[proc]; ok {
+		return d
+	}
+	return defaultSettlementDays[proc]
+}
+
+// Expects reports whether records dated day are expected.
+func (d SettlementDays) Expects(day time.Time) bool {
+	return d[day.Weekday()]
+}
+
+// String writes the days as SETTLEMENT_DAYS reads them, e.g. "mon-fri".
+func (d SettlementDays) String() string {
+	if d == everyDay {
+		return "daily"
+	}
+	var parts []string
+	// Runs are read Monday first, so a weekend is written "sat-sun".
+	order := []time.Weekday{time.Monday, time.Tuesday, time.Wednesday, time.Thursday, time.Friday, time.Saturday, time.Sunday}
+	for i := 0; i < len(order); i++ {
+		if !d[order[i]] {
+			continue
+		}
+		j := i
+		for j+1 < len(order) && d[order[j+1]] {
+			j++
+		}
+		switch {
+		case j == i:
+			parts = append(parts, dayTokens[order[i]])
+		default:
+			parts = append(parts, dayTokens[order[i]]+"-"+dayTokens[order[j]])
+		}
+		i = j
+	}
+	if len(parts) == 0 {
+		return "none"
+	}
+	return strings.Join(parts, "/")
+}
+
+// SettlementDaysFromEnv reads SETTLEMENT_DAYS, a comma-separated list such
+// as "capepay=mon-sat,nairagateway=mon/wed/fri,afripay=none". Days are
+// three-letter names or ranges of them, joined by "/"; "daily"
+// is every day and "none" turns the calendar's expectations off for the
+// processor.
+func SettlementDaysFromEnv() (map[domain.Processor]SettlementDays, error) {
+	days := make(map[domain.Processor]SettlementDays)
+	v := os.Getenv("SETTLEMENT_DAYS")
+	if v == "" {
+		return days, nil
+	}
+	for _, entry := range strings.Split(v, ",") {
+		proc, spec, ok := strings.Cut(strings.TrimSpace(entry), "=")
+		proc = strings.TrimSpace(proc)
+		if !ok || proc == "" {
+			return nil, fmt.Errorf("invalid SETTLEMENT_DAYS entry %q: want processor=days, e.g. capepay=mon-fri", entry)
+		}
+		d, err := parseSettlementDays(strings.TrimSpace(spec))
+		if err != nil {
+			return nil, fmt.Errorf("invalid SETTLEMENT_DAYS entry %q: %v", entry, err)
+		}
+		days[domain.Processor(proc)] = d
+	}
+	return days, nil
+}
+
+func parseSettlementDays(spec string) (SettlementDays, error) {
+	switch strings.ToLower(spec) {
+	case "daily":
+		return everyDay, nil
+	case "none":
+		return SettlementDays{}, nil
+	}
+	var d SettlementDays
+	for _, part := range strings.Split(strings.ToLower(spec), "/") {
+		from, to, isRange := strings.Cut(part, "-")
+		start, ok := dayIndex(from)
+		if !ok {
+			return d, fmt.Errorf("%q is not a day; use mon, tue, wed, thu, fri, sat or sun", from)
+		}
+		end := start
+		if isRange {
+			if end, ok = dayIndex(to); !ok {
+				return d, fmt.Errorf("%q is not a day; use mon, tue, wed, thu, fri, sat or sun", to)
+			}
+		}
+		// A range may wrap past Sunday, as fri-mon does.
+		for wd := start; ; wd = (wd + 1) % 7 {
+			d[wd] = true
+			if wd == end {
+				break
+			}
+		}
+	}
+	return d, nil
+}
+
+func dayIndex(token string) (time.Weekday, bool) {
+	for i, t := range dayTokens {
+		if strings.TrimSpace(token) == t {
+			return time.Weekday(i), true
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,76 @@
+package ingestion
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/wakala/reconciler/internal/currency"
+	"github.com/wakala/reconciler/internal/domain"
+)
+
+// TransformMetrics reports the processor's transform script run on a report.
+type TransformMetrics struct {
+	Version        int `json:"version"`
+	RecordsChanged int `json:"records_changed"`
+}
+
+// parse parses a report, runs the processor's transform script, if it has
+// one, on the records and applies the processor's amount policy and
+// withholding rate.
+func (s *Service) parse(proc domain.Processor, format string, data []byte, reportID string) (*ParseResult, *TransformMetrics, error) {
+	parsed, err := parseReport(proc, format, data, reportID)
+	if err != nil {
+		return nil, nil, err
+	}
+	tm, err := s.applyTransform(proc, parsed)
+	if err != nil {
+		return nil, nil, err
+	}
+	applyAmountPolicy(proc, parsed)
+	applyWithholding(proc, parsed)
+	return parsed, tm, nil
+}
+
+// applyTransform runs proc's transform script on the parsed records. Changed
+// records get their USD amounts and adjustment classification redone, since
+// the script may have fixed the amounts, the currency or the reference. A
+// script that leaves a record's net no longer equal to its gross less fee
+// and tax, such as one scaling only the gross, fails the report.
+func (s *Service) applyTransform(proc domain.Processor, parsed *ParseResult) (*TransformMetrics, error) {
+	script, err := s.transformRepo.Get(proc)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("load transform: %w", err)
+	}
+
+	tm := &TransformMetrics{Version: script.Version}
+	for i := range parsed.Records {
+		rec := &parsed.Records[i]
+		balanced := rec.NetError() == ""
+		if !script.Apply(rec) {
+			continue
+		}
+		tm.RecordsChanged++
+		if rec.ProcessorTransactionID == "" {
+			return nil, fmt.Errorf("transform v%d left record %s without a reference", script.Version, rec.ID)
+		}
+		if msg := rec.NetError(); balanced && msg != "" {
+			return nil, fmt.Errorf("transform v%d left record %s unbalanced: %s", script.Version, rec.ProcessorTransactionID, msg)
+		}
+		gross, err := currency.ToUSD(rec.GrossAmount, rec.Currency)
+		if err != nil {
+			return nil, fmt.Errorf("transform v%d record %s: %w", script.Version, rec.ID, err)
+		}
+		net, err := currency.ToUSD(rec.NetAmount, rec.Currency)
+		if err != nil {
+			return nil, fmt.Errorf("transform v%d record %s: %w", script.Version, rec.ID, err)
+		}
+		rec.USDGrossAmount = gross
+		rec.USDNetAmount = net
+		rec.Adjustment = classifyAdjustment(rec.Processor, rec.ProcessorTransactionID)
+	}
+	return tm, nil
+}
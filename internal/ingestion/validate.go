@@ -0,0 +1,201 @@
+package ingestion
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+
+	"github.com/wakala/reconciler/internal/domain"
+	"github.com/wakala/reconciler/internal/pgp"
+)
+
+// Validation issue severities. A file with any error issue would not ingest
+// cleanly: the line would be skipped, or the whole file rejected.
+const (
+	SeverityError   = "error"
+	SeverityWarning = "warning"
+)
+
+// Validation issue kinds, besides the parse warning kinds.
+const (
+	IssueParseError     = "parse_error"
+	IssueNoRecords      = "no_records"
+	IssueNoBatchID      = "no_batch_id"
+	IssueRecordRejected = "record_rejected"
+	IssueDuplicateRef   = "duplicate_reference"
+	IssueNonPositive    = "non_positive_gross"
+	IssueAmountMismatch = "amount_mismatch"
+)
+
+// maxValidationItems bounds the lines, and the issues, a validation lists; a
+// file in the wrong format would otherwise list every one of its lines.
+const maxValidationItems = 1000
+
+// ValidationIssue is one problem found in a file. Line is set for problems
+// with a source line, Record for problems with a parsed record.
+type ValidationIssue struct {
+	Line     int    `json:"line,omitempty"`
+	Record   string `json:"record,omitempty"`
+	Severity string `json:"severity"`
+	Kind     string `json:"kind"`
+	Message  string `json:"message"`
+}
+
+// LineValidation is the result for one source line that had a problem.
+type LineValidation struct {
+	Line   int               `json:"line"`
+	Valid  bool              `json:"valid"`
+	Issues []ValidationIssue `json:"issues"`
+}
+
+// ValidationResult is a file checked against a processor's format. Lines
+// lists only the lines with issues, in order; every other line was read
+// cleanly. Issues holds the problems of the file as a whole and of parsed
+// records.
+type ValidationResult struct {
+	Processor     string            `json:"processor"`
+	Format        string            `json:"format"`
+	Valid         bool              `json:"valid"`
+	Records       int               `json:"records"`
+	LinesRejected int               `json:"lines_rejected"`
+	Lines         []LineValidation  `json:"lines"`
+	Issues        []ValidationIssue `json:"issues"`
+	// StoppedAtLine is the line a parse error stopped at, the way it fails
+	// an ingest; the lines after it were not checked.
+	StoppedAtLine int `json:"stopped_at_line,omitempty"`
+	// Truncated is set when there were more lines or issues than listed.
+	Truncated bool `json:"truncated,omitempty"`
+}
+
+// ErrValidateEncrypted is returned for a PGP file, encrypted or armored.
+// Validation is public, so it never decrypts with the processors' keys, and
+// every PGP file gets this one error whatever is inside it.
+var ErrValidateEncrypted = errors.New("PGP files cannot be validated; send the test file unencrypted")
+
+// errorLine finds the line number the parsers put in their errors.
+var errorLine = regexp.MustCompile(`\bline (\d+)\b`)
+
+// ValidateFile parses data as format for processor and reports, line by
+// line, what ingesting it would make of it. Unlike PreviewReport it reads
+// nothing from the database: the processor's transform script is not run,
+// so the file is checked against the format as documented. A file the
+// parser rejects is an invalid result rather than an error; only a PGP file
+// is one, ErrValidateEncrypted.
+func ValidateFile(data []byte, processor, format string) (*ValidationResult, error) {
+	if pgp.IsArmored(data) || pgp.IsEncrypted(data) {
+		return nil, ErrValidateEncrypted
+	}
+	proc := domain.Processor(processor)
+	result := &ValidationResult{
+		Processor: processor,
+		Format:    format,
+		Lines:     []LineValidation{},
+		Issues:    []ValidationIssue{},
+	}
+	parsed, err := parseReport(proc, format, data, previewReportID)
+	if err != nil {
+		issue := ValidationIssue{Severity: SeverityError, Kind: IssueParseError, Message: err.Error()}
+		if m := errorLine.FindStringSubmatch(err.Error()); m != nil {
+			issue.Line, _ = strconv.Atoi(m[1])
+			result.StoppedAtLine = issue.Line
+			result.Lines = append(result.Lines, LineValidation{Line: issue.Line, Issues: []ValidationIssue{issue}})
+		} else {
+			result.Issues = append(result.Issues, issue)
+		}
+		return result, nil
+	}
+	applyAmountPolicy(proc, parsed)
+	applyWithholding(proc, parsed)
+	result.Records = len(parsed.Records)
+	result.LinesRejected = len(parsed.Skipped)
+
+	var issues []ValidationIssue
+	byLine := map[int]int{}
+	for _, pw := range parsed.Warnings {
+		issue := ValidationIssue{Line: pw.Line, Severity: SeverityWarning, Kind: pw.Kind, Message: pw.Message}
+		if pw.Kind == WarnLineSkipped {
+			issue.Severity = SeverityError
+		}
+		if pw.Line == 0 {
+			issues = append(issues, issue)
+			continue
+		}
+		i, ok := byLine[pw.Line]
+		if !ok {
+			if len(result.Lines) == maxValidationItems {
+				result.Truncated = true
+				continue
+			}
+			i = len(result.Lines)
+			byLine[pw.Line] = i
+			result.Lines = append(result.Lines, LineValidation{Line: pw.Line, Valid: true})
+		}
+		lv := &result.Lines[i]
+		lv.Issues = append(lv.Issues, issue)
+		if issue.Severity == SeverityError {
+			lv.Valid = false
+		}
+	}
+
+	result.Valid = len(parsed.Skipped) == 0
+	for _, issue := range append(issues, recordIssues(parsed, proc)...) {
+		if issue.Severity == SeverityError {
+			result.Valid = false
+		}
+		if len(result.Issues) == maxValidationItems {
+			result.Truncated = true
+			continue
+		}
+		result.Issues = append(result.Issues, issue)
+	}
+	return result, nil
+}
+
+// recordIssues checks the parsed records the way validateParsed does, as
+// issues: errors for what would fail the ingest, warnings for what would
+// be ingested but is likely wrong.
+func recordIssues(parsed *ParseResult, proc domain.Processor) []ValidationIssue {
+	var issues []ValidationIssue
+	fileIssue := func(severity, kind, msg string) {
+		issues = append(issues, ValidationIssue{Severity: severity, Kind: kind, Message: msg})
+	}
+	recordIssue := func(rec *domain.SettlementRecord, severity, kind, msg string) {
+		issues = append(issues, ValidationIssue{
+			Record: rec.ProcessorTransactionID, Severity: severity, Kind: kind, Message: msg,
+		})
+	}
+
+	if len(parsed.Records) == 0 {
+		fileIssue(SeverityError, IssueNoRecords, "file contains no settlement records")
+		return issues
+	}
+	if parsed.BatchID == "" {
+		fileIssue(SeverityWarning, IssueNoBatchID, "no batch ID found in file; one will be generated on ingest")
+	}
+	if err := checkRecords(proc, parsed.Records); err != nil {
+		fileIssue(SeverityError, IssueRecordRejected, err.Error())
+	}
+	if err := checkAmounts(proc, parsed.Records); err != nil {
+		fileIssue(SeverityError, IssueRecordRejected, err.Error())
+	}
+
+	seen := make(map[string]bool, len(parsed.Records))
+	for i := range parsed.Records {
+		rec := &parsed.Records[i]
+		if seen[rec.ProcessorTransactionID] {
+			recordIssue(rec, SeverityWarning, IssueDuplicateRef,
+				"processor transaction ID appears more than once in the file")
+		}
+		seen[rec.ProcessorTransactionID] = true
+
+		if rec.Adjustment == nil && rec.GrossAmount <= 0 {
+			recordIssue(rec, SeverityWarning, IssueNonPositive,
+				fmt.Sprintf("non-positive gross amount %.2f", rec.GrossAmount))
+		}
+		if msg := rec.NetError(); msg != "" {
+			recordIssue(rec, SeverityWarning, IssueAmountMismatch, msg)
+		}
+	}
+	return issues
+}
@@ -0,0 +1,322 @@
+package ingestion
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/wakala/reconciler/internal/domain"
+	"github.com/wakala/reconciler/internal/pgp"
+)
+
+// Sidecar is a checksum or detached signature file sent with a report.
+type Sidecar struct {
+	Filename string
+	Data     []byte
+}
+
+// checksumExts are the extensions of checksum sidecars, by hash.
+var checksumExts = map[string]func() hash.Hash{
+	"md5":    md5.New,
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+	"sha512": sha512.New,
+}
+
+// signatureExts are the extensions of detached PGP signature sidecars.
+var signatureExts = map[string]bool{"sig": true, "asc": true}
+
+// sidecarExt returns the lowercased extension of a sidecar's name, or ""
+// when it has none a sidecar may have.
+func sidecarExt(name string) string {
+	i := strings.LastIndexByte(name, '.')
+	if i <= 0 {
+		return ""
+	}
+	ext := strings.ToLower(name[i+1:])
+	if _, ok := checksumExts[ext]; !ok && !signatureExts[ext] {
+		return ""
+	}
+	return ext
+}
+
+// SidecarOf returns the name of the report a sidecar file belongs to, such
+// as "settlement.csv" for "settlement.csv.md5", and false for a name without
+// a sidecar extension.
+func SidecarOf(name string) (string, bool) {
+	ext := sidecarExt(name)
+	if ext == "" {
+		return "", false
+	}
+	return name[:len(name)-len(ext)-1], true
+}
+
+// SidecarTargets pairs files sent together, as in one email, with their
+// sidecars. A file is a sidecar when another file is named like it without
+// the sidecar extension, so "report.csv.asc" alone is an armored report but
+// next to "report.csv" is its signature. It returns, for each name, the
+// index of the report it is a sidecar of, or -1.
+func SidecarTargets(names []string) []int {
+	index := make(map[string]int, len(names))
+	for i, name := range names {
+		index[name] = i
+	}
+	targets := make([]int, len(names))
+	for i, name := range names {
+		targets[i] = -1
+		if base, ok := SidecarOf(name); ok {
+			if j, ok := index[base]; ok && j != i {
+				targets[i] = j
+			}
+		}
+	}
+	return targets
+}
+
+// VerificationConfig is how reports are checked against their sidecars.
+type VerificationConfig struct {
+	// SigningKeys are the keys each processor's signatures are checked with.
+	SigningKeys map[domain.Processor]*pgp.SigningKeys
+	// Required processors have every report without a sidecar rejected.
+	Required map[domain.Processor]bool
+}
+
+// verification is the registered VerificationConfig. It is filled once at
+// startup by RegisterVerification.
+var verification = VerificationConfig{
+	SigningKeys: map[domain.Processor]*pgp.SigningKeys{},
+	Required:    map[domain.Processor]bool{},
+}
+
+// RegisterVerification sets the signing keys and the processors that must
+// send sidecars. It must be called before any report is ingested.
+func RegisterVerification(cfg VerificationConfig) {
+	for proc, keys := range cfg.SigningKeys {
+		verification.SigningKeys[proc] = keys
+	}
+	for proc, required := range cfg.Required {
+		verification.Required[proc] = required
+	}
+}
+
+// SigningKeyProcessors returns the processors with signing keys, sorted.
+func SigningKeyProcessors() []domain.Processor {
+	procs := make([]domain.Processor, 0, len(verification.SigningKeys))
+	for proc := range verification.SigningKeys {
+		procs = append(procs, proc)
+	}
+	sort.Slice(procs, func(i, j int) bool { return procs[i] < procs[j] })
+	return procs
+}
+
+// SigningKeyIDs returns the IDs of proc's signing keys.
+func SigningKeyIDs(proc domain.Processor) []string {
+	if keys, ok := verification.SigningKeys[proc]; ok {
+		return keys.KeyIDs()
+	}
+	return nil
+}
+
+// VerificationFromEnv reads PGP_SIGNING_KEY_FILES, a comma-separated list
+// such as "capepay=/etc/wakala/capepay-signing.asc" of public key exports,
+// and REPORT_VERIFICATION_REQUIRED, a comma-separated list of processors
+// whose reports must come with a sidecar.
+func VerificationFromEnv() (VerificationConfig, error) {
+	cfg := VerificationConfig{
+		SigningKeys: make(map[domain.Processor]*pgp.SigningKeys),
+		Required:    make(map[domain.Processor]bool),
+	}
+	files, err := processorFiles("PGP_SIGNING_KEY_FILES")
+	if err != nil {
+		return cfg, err
+	}
+	for proc, path := range files {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return cfg, fmt.Errorf("PGP signing key for %s: %w", proc, err)
+		}
+		keys, err := pgp.ReadSigningKeys(data)
+		if err != nil {
+			return cfg, fmt.Errorf("PGP signing key for %s: %s: %w", proc, path, err)
+		}
+		cfg.SigningKeys[proc] = keys
+	}
+	for _, proc := range strings.Split(os.Getenv("REPORT_VERIFICATION_REQUIRED"), ",") {
+		if proc = strings.TrimSpace(proc); proc != "" {
+			cfg.Required[domain.Processor(proc)] = true
+		}
+	}
+	return cfg, nil
+}
+
+// verifyReport checks a report against every one of its sidecars. A
+// checksum or signature may cover the file as sent or, for an encrypted
+// report, its decrypted content. Without sidecars the report is unverified,
+// which is an error for a processor that requires them.
+func verifyReport(proc domain.Processor, sent, plain []byte, filename string, sidecars []Sidecar) (*domain.ReportVerification, error) {
+	v := &domain.ReportVerification{Status: domain.VerificationUnverified, CheckedAt: time.Now().UTC().Truncate(time.Second)}
+	if len(sidecars) == 0 {
+		if verification.Required[proc] {
+			return nil, fmt.Errorf("reports from %s must come with a checksum or signature file", proc)
+		}
+		return v, nil
+	}
+
+	var methods, names []string
+	for _, sc := range sidecars {
+		method, signer, err := checkSidecar(proc, sent, plain, filename, sc)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", sc.Filename, err)
+		}
+		methods = append(methods, method)
+		names = append(names, sc.Filename)
+		if signer != "" {
+			v.Signer = signer
+		}
+	}
+	v.Status = domain.VerificationVerified
+	v.Method = strings.Join(methods, ",")
+	v.Sidecar = strings.Join(names, ",")
+	return v, nil
+}
+
+// checkSidecar checks one sidecar by its extension. It returns the method
+// and, for a signature, the signing key's ID.
+func checkSidecar(proc domain.Processor, sent, plain []byte, filename string, sc Sidecar) (string, string, error) {
+	ext := sidecarExt(sc.Filename)
+	if ext == "" {
+		return "", "", errors.New("unknown sidecar type: want .md5, .sha1, .sha256, .sha512, .sig or .asc")
+	}
+	if newHash, ok := checksumExts[ext]; ok {
+		want, err := parseChecksum(sc.Data, newHash().Size(), filename)
+		if err != nil {
+			return "", "", err
+		}
+		var got []byte
+		for _, data := range [][]byte{plain, sent} {
+			h := newHash()
+			h.Write(data)
+			if got = h.Sum(nil); bytes.Equal(got, want) {
+				return ext, "", nil
+			}
+		}
+		return "", "", fmt.Errorf("%s checksum mismatch: the file has %x, the sidecar expects %x", ext, got, want)
+	}
+
+	keys, ok := verification.SigningKeys[proc]
+	if !ok {
+		return "", "", fmt.Errorf("no signing key is configured for %s to check the signature with", proc)
+	}
+	signer, err := keys.VerifyDetached(sent, sc.Data)
+	if err != nil && !bytes.Equal(sent, plain) {
+		if s, plainErr := keys.VerifyDetached(plain, sc.Data); plainErr == nil {
+			signer, err = s, nil
+		}
+	}
+	if err != nil {
+		return "", "", fmt.Errorf("signature: %w", err)
+	}
+	return "pgp", signer, nil
+}
+
+// parseChecksum reads the digest of a checksum file in the formats of
+// md5sum ("<hex>  <name>"), BSD ("MD5 (<name>) = <hex>") or a bare hex
+// digest. In a file listing several files the line naming filename is used.
+func parseChecksum(data []byte, size int, filename string) ([]byte, error) {
+	var found [][]byte
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		digest, name := "", ""
+		if open := strings.Index(line, " ("); open >= 0 && strings.Contains(line, ") = ") {
+			rest := line[open+2:]
+			close := strings.LastIndex(rest, ") = ")
+			name, digest = rest[:close], strings.TrimSpace(rest[close+4:])
+		} else {
+			fields := strings.Fields(line)
+			digest = fields[0]
+			if len(fields) > 1 {
+				name = strings.TrimPrefix(strings.Join(fields[1:], " "), "*")
+			}
+		}
+		b, err := hex.DecodeString(digest)
+		if err != nil || len(b) != size {
+			continue
+		}
+		if name != "" && filename != "" && (name == filename || baseName(name) == baseName(filename)) {
+			return b, nil
+		}
+		found = append(found, b)
+	}
+	switch len(found) {
+	case 0:
+		return nil, fmt.Errorf("no %d-byte hex digest in the checksum file", size)
+	case 1:
+		return found[0], nil
+	}
+	return nil, errors.New("checksum file lists several files, none of them named like the report")
+}
+
+func baseName(name string) string {
+	return name[strings.LastIndexAny(name, `/\`)+1:]
+}
+
+// rejectUnverified raises a REPORT_VERIFICATION_FAILED alert for a report
+// rejected by verifyReport. Retries of the same file share one alert.
+func (s *Service) rejectUnverified(proc domain.Processor, hash, filename string, cause error) {
+	ref := filename
+	if ref == "" {
+		ref = hash
+	}
+	alert := &domain.Alert{
+		ID:        fmt.Sprintf("ALERT-RV-%s-%s", proc, hash[:16]),
+		Type:      domain.AlertReportVerification,
+		Processor: proc,
+		Severity:  domain.SeverityHigh,
+		Reference: ref,
+		Message:   fmt.Sprintf("Report %s from %s was rejected: %v", ref, proc, cause),
+		CreatedAt: time.Now().UTC(),
+	}
+	created, err := s.alertRepo.Insert(alert)
+	if err != nil {
+		log.Printf("[ingestion] WARNING: insert verification alert: %v", err)
+		return
+	}
+	if !created {
+		return
+	}
+	log.Printf("[ingestion] ALERT: %s", alert.Message)
+	s.notifierMu.Lock()
+	notifier := s.alertNotifier
+	s.notifierMu.Unlock()
+	if notifier != nil {
+		if err := notifier.Notify([]domain.Alert{*alert}); err != nil {
+			log.Printf("[ingestion] WARNING: email verification alert: %v", err)
+		}
+	}
+}
+
+// resolveVerified resolves the verification alerts of earlier files with
+// the name of a report that has now been verified, such as a corrupted
+// transfer that was sent again.
+func (s *Service) resolveVerified(proc domain.Processor, filename string) {
+	if filename == "" {
+		return
+	}
+	if err := s.alertRepo.ResolveByReference(domain.AlertReportVerification, proc, filename, time.Now().UTC()); err != nil {
+		log.Printf("[ingestion] WARNING: resolve verification alerts: %v", err)
+	}
+}
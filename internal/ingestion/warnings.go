@@ -0,0 +1,61 @@
+package ingestion
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/wakala/reconciler/internal/domain"
+)
+
+// Parse warning kinds, persisted with the report.
+const (
+	WarnLineSkipped  = "line_skipped"
+	WarnFieldCoerced = "field_coerced"
+	WarnDateFallback = "date_fallback"
+	// WarnEncodingFallback is for a file that was not UTF-8 and was read as
+	// Windows-1252.
+	WarnEncodingFallback = "encoding_fallback"
+	// WarnControlTotalMismatch is for a footer whose totals the parsed
+	// records do not add up to.
+	WarnControlTotalMismatch = "control_total_mismatch"
+	// WarnWithholdingMismatch is for a record whose withheld tax is not
+	// its country's withholding rate of the fee.
+	WarnWithholdingMismatch = "withholding_tax_mismatch"
+)
+
+func (p *ParseResult) warn(line int, kind, msg string) {
+	p.Warnings = append(p.Warnings, domain.ReportWarning{Line: line, Kind: kind, Message: msg})
+}
+
+// parseAmount parses a numeric field in the report's number format and
+// amount unit. Values with thousands separators or a negative in
+// parentheses are accepted with a field_coerced warning.
+func (p *ParseResult) parseAmount(line int, field, s string) (float64, error) {
+	v, read, err := p.numbers.parse(s)
+	if err != nil {
+		return 0, err
+	}
+	if read != "" {
+		p.warn(line, WarnFieldCoerced, fmt.Sprintf("%s %q read as %s", field, s, read))
+	}
+	return p.toMajor(line, field, v), nil
+}
+
+// parseDate tries each layout in turn. Matching any layout but the first
+// records a date_fallback warning.
+func (p *ParseResult) parseDate(line int, field, s string, loc *time.Location, layouts ...string) (time.Time, error) {
+	var firstErr error
+	for i, layout := range layouts {
+		t, err := time.ParseInLocation(layout, s, loc)
+		if err == nil {
+			if i > 0 {
+				p.warn(line, WarnDateFallback, fmt.Sprintf("%s %q parsed with fallback layout %s", field, s, layout))
+			}
+			return t, nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	return time.Time{}, firstErr
+}
@@ -0,0 +1,76 @@
+package ingestion
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/wakala/reconciler/internal/domain"
+)
+
+// ErrInvalidEvent is returned by IngestEvent for an event that is not a
+// usable settlement record.
+var ErrInvalidEvent = errors.New("invalid settlement event")
+
+// EventResult is the outcome of one settlement event.
+type EventResult struct {
+	SettlementID string `json:"settlement_id,omitempty"`
+	BatchID      string `json:"batch_id"`
+	// Duplicate is set when the batch already has the record; nothing was
+	// stored.
+	Duplicate bool `json:"duplicate,omitempty"`
+	// PendingAdjustmentID is set when the record falls in a closed period
+	// and is held for approval.
+	PendingAdjustmentID string `json:"pending_adjustment_id,omitempty"`
+	Matched             bool   `json:"matched"`
+	TransactionID       string `json:"transaction_id,omitempty"`
+}
+
+// IngestEvent stores one settlement record pushed by a processor webhook and
+// matches it at once, rather than reconciling everything. The record has the
+// same fields and checks as external parser output. Events without a
+// batch_id go into one batch per processor and settlement day, so a retried
+// event is dropped by the batch dedupe.
+func (s *Service) IngestEvent(processor string, rec domain.SettlementRecord) (*EventResult, error) {
+	proc := domain.Processor(processor)
+	if rec.BatchID == "" && !rec.SettlementDate.IsZero() {
+		rec.BatchID = fmt.Sprintf("WH-%s-%s", processor, rec.SettlementDate.UTC().Format("20060102"))
+	}
+	if rec.ID == "" {
+		rec.ID = fmt.Sprintf("SR-WH-%s-%s", rec.BatchID, rec.ProcessorTransactionID)
+	}
+	var parsed ParseResult
+	if reason := parsed.normalizeRecord(&rec, proc, "", 0); reason != "" {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidEvent, reason)
+	}
+	rec.Adjustment = classifyAdjustment(proc, rec.ProcessorTransactionID)
+	// A file would skip this row; an event has nothing else in it.
+	if rec.Adjustment == nil && rec.GrossAmount == 0 && amountPolicyFor(proc).Zero == ZeroSkip {
+		return nil, fmt.Errorf("%w: zero gross amount", ErrInvalidEvent)
+	}
+
+	res, err := s.ingestRecords(processor, rec.BatchID, []domain.SettlementRecord{rec}, IngestOptions{skipReconcile: true})
+	if err != nil {
+		return nil, err
+	}
+
+	result := &EventResult{BatchID: rec.BatchID}
+	switch {
+	case res.PendingAdjustmentID != "":
+		result.PendingAdjustmentID = res.PendingAdjustmentID
+		return result, nil
+	case res.RecordsIngested == 0:
+		result.Duplicate = true
+		return result, nil
+	}
+
+	result.SettlementID = rec.ID
+	txn, err := s.reconSvc.MatchRecord(rec.ID)
+	if err != nil {
+		return nil, err
+	}
+	if txn != nil {
+		result.Matched = true
+		result.TransactionID = txn.ID
+	}
+	return result, nil
+}
@@ -0,0 +1,79 @@
+package ingestion
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/wakala/reconciler/internal/domain"
+)
+
+// withholdingRates is the registry of the tax rates withheld on fees, as
+// fractions, by country. It is filled once at startup by
+// RegisterWithholdingRates; countries not in it have no rate to check
+// against.
+var withholdingRates = map[string]float64{}
+
+// RegisterWithholdingRates sets the withholding rate of each country in
+// rates. It must be called before any report is parsed.
+func RegisterWithholdingRates(rates map[string]float64) {
+	for country, rate := range rates {
+		withholdingRates[country] = rate
+	}
+}
+
+// WithholdingRatesFromEnv reads WITHHOLDING_TAX_RATES, a comma-separated
+// list of country=percentage entries such as "NG=10".
+func WithholdingRatesFromEnv() (map[string]float64, error) {
+	rates := make(map[string]float64)
+	v := os.Getenv("WITHHOLDING_TAX_RATES")
+	if v == "" {
+		return rates, nil
+	}
+	for _, entry := range strings.Split(v, ",") {
+		country, pct, ok := strings.Cut(strings.TrimSpace(entry), "=")
+		country = strings.ToUpper(strings.TrimSpace(country))
+		rate, err := strconv.ParseFloat(strings.TrimSpace(pct), 64)
+		if !ok || len(country) != 2 || err != nil || rate < 0 || rate >= 100 {
+			return nil, fmt.Errorf("invalid WITHHOLDING_TAX_RATES entry %q: want country=percentage, e.g. NG=10", entry)
+		}
+		rates[country] = rate / 100
+	}
+	return rates, nil
+}
+
+// applyWithholding checks the tax withheld on the fees of parsed's payment
+// rows against the rate of proc's country. A row that reports no tax but
+// whose net is short of gross less fee by that rate of the fee gets the
+// shortfall as its tax, so correct withholding is not taken for a wrong
+// net. A row that reports tax other than the rate gets a
+// withholding_tax_mismatch warning. Without a rate, reported tax is kept as
+// it is.
+func applyWithholding(proc domain.Processor, parsed *ParseResult) {
+	country := processorCountries[proc]
+	rate, ok := withholdingRates[country]
+	if !ok {
+		return
+	}
+	for i := range parsed.Records {
+		rec := &parsed.Records[i]
+		if rec.Adjustment != nil || rec.FeeAmount <= 0 {
+			continue
+		}
+		expected := round2(rec.FeeAmount * rate)
+		if rec.TaxAmount == 0 {
+			shortfall := round2(rec.GrossAmount - rec.FeeAmount - rec.NetAmount)
+			if expected > 0 && shortfall > 0.01 && math.Abs(shortfall-expected) <= 0.01 {
+				rec.TaxAmount = shortfall
+			}
+			continue
+		}
+		if math.Abs(rec.TaxAmount-expected) > 0.01 {
+			parsed.warn(0, WarnWithholdingMismatch, fmt.Sprintf(
+				"record %s withheld tax %.2f %s, but %s's rate of %.4g%% of the fee %.2f is %.2f",
+				rec.ProcessorTransactionID, rec.TaxAmount, rec.Currency, country, rate*100, rec.FeeAmount, expected))
+		}
+	}
+}
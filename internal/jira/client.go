@@ -0,0 +1,165 @@
+package jira
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/wakala/reconciler/internal/retry"
+)
+
+// Client calls the Jira REST API (version 2, which Jira Cloud and Data
+// Center both serve) under the "jira" retry policy.
+type Client struct {
+	baseURL string
+	email   string
+	token   string
+	client  *http.Client
+	retry   *retry.Integration
+}
+
+// NewClient returns a client of the site cfg names.
+func NewClient(cfg *Config) *Client {
+	return &Client{
+		baseURL: cfg.BaseURL,
+		email:   cfg.Email,
+		token:   cfg.Token,
+		client:  &http.Client{Timeout: 30 * time.Second},
+		retry:   retry.For("jira", retry.DefaultPolicy),
+	}
+}
+
+// IssueFields are the fields of a new issue.
+type IssueFields struct {
+	Project     string
+	IssueType   string
+	Summary     string
+	Description string
+	Labels      []string
+	Priority    string
+}
+
+// CreateIssue opens an issue and returns its key.
+func (c *Client) CreateIssue(ctx context.Context, f IssueFields) (string, error) {
+	fields := map[string]any{
+		"project":     map[string]string{"key": f.Project},
+		"issuetype":   map[string]string{"name": f.IssueType},
+		"summary":     f.Summary,
+		"description": f.Description,
+		"labels":      f.Labels,
+	}
+	if f.Priority != "" {
+		fields["priority"] = map[string]string{"name": f.Priority}
+	}
+	var created struct {
+		Key string `json:"key"`
+	}
+	if err := c.call(ctx, http.MethodPost, "/rest/api/2/issue", map[string]any{"fields": fields}, &created); err != nil {
+		return "", fmt.Errorf("create issue: %w", err)
+	}
+	if created.Key == "" {
+		return "", fmt.Errorf("create issue: response has no issue key")
+	}
+	return created.Key, nil
+}
+
+// Transition applies the transition called name, without regard to case,
+// to an issue. It reports false when the issue's workflow offers no such
+// transition from its current status.
+func (c *Client) Transition(ctx context.Context, key, name string) (bool, error) {
+	path := "/rest/api/2/issue/" + url.PathEscape(key) + "/transitions"
+	var list struct {
+		Transitions []struct {
+			ID   string `json:"id"`
+			Name string `json:"name"`
+		} `json:"transitions"`
+	}
+	if err := c.call(ctx, http.MethodGet, path, nil, &list); err != nil {
+		return false, fmt.Errorf("list transitions of %s: %w", key, err)
+	}
+	for _, t := range list.Transitions {
+		if !strings.EqualFold(t.Name, name) {
+			continue
+		}
+		body := map[string]any{"transition": map[string]string{"id": t.ID}}
+		if err := c.call(ctx, http.MethodPost, path, body, nil); err != nil {
+			return false, fmt.Errorf("transition %s to %q: %w", key, name, err)
+		}
+		return true, nil
+	}
+	return false, nil
+}
+
+// Status returns the name of an issue's status.
+func (c *Client) Status(ctx context.Context, key string) (string, error) {
+	var issue struct {
+		Fields struct {
+			Status struct {
+				Name string `json:"name"`
+			} `json:"status"`
+		} `json:"fields"`
+	}
+	if err := c.call(ctx, http.MethodGet, "/rest/api/2/issue/"+url.PathEscape(key)+"?fields=status", nil, &issue); err != nil {
+		return "", fmt.Errorf("get %s: %w", key, err)
+	}
+	return issue.Fields.Status.Name, nil
+}
+
+// call sends one request, retrying failures. Other 4xx responses than 408
+// and 429 are not retried.
+func (c *Client) call(ctx context.Context, method, path string, in, out any) error {
+	var body []byte
+	if in != nil {
+		var err error
+		if body, err = json.Marshal(in); err != nil {
+			return err
+		}
+	}
+	return c.retry.Do(ctx, func(ctx context.Context) error {
+		return c.do(ctx, method, path, body, out)
+	})
+}
+
+func (c *Client) do(ctx context.Context, method, path string, body []byte, out any) error {
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	if c.email != "" {
+		req.SetBasicAuth(c.email, c.token)
+	} else {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		err := fmt.Errorf("status %d: %s", resp.StatusCode, strings.TrimSpace(string(msg)))
+		if !retry.RetryableStatus(resp.StatusCode) {
+			return retry.Permanent(err)
+		}
+		return err
+	}
+	if out == nil {
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("decode: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,213 @@
+// Package jira keeps discrepancies and Jira issues in step: it opens an
+// issue for each serious discrepancy, resolves the issue when the
+// reconciler stops raising the discrepancy, and marks the discrepancy
+// resolved when its issue is resolved in Jira.
+package jira
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/wakala/reconciler/internal/domain"
+)
+
+// severities are the discrepancy severities, most severe first.
+var severities = []domain.Severity{
+	domain.SeverityCritical, domain.SeverityHigh, domain.SeverityMedium, domain.SeverityLow,
+}
+
+// Config is the Jira site, how issues are filed there, and how their
+// statuses map onto the reconciler's.
+type Config struct {
+	BaseURL string `json:"base_url"`
+	// Email is the account of an Atlassian Cloud API token, sent with basic
+	// auth. Without it the token is sent as a bearer personal access token,
+	// as Jira Data Center expects.
+	Email string `json:"email,omitempty"`
+	Token string `json:"-"`
+
+	Project   string   `json:"project"`
+	IssueType string   `json:"issue_type"`
+	Labels    []string `json:"labels"`
+	// MinSeverity is the lowest severity an issue is opened for.
+	MinSeverity domain.Severity `json:"min_severity"`
+	// Priorities maps discrepancy severities to Jira priority names.
+	// Severities without one get the project's default priority.
+	Priorities map[domain.Severity]string `json:"priorities,omitempty"`
+
+	// ResolvedStatuses are the Jira statuses, matched without regard to
+	// case, that resolve the discrepancy here.
+	ResolvedStatuses []string `json:"resolved_statuses"`
+	// ResolveTransition is the transition applied to an issue whose
+	// discrepancy is no longer raised, and ReopenTransition the one applied
+	// when it is raised again. An empty ReopenTransition leaves the issue
+	// resolved.
+	ResolveTransition string `json:"resolve_transition"`
+	ReopenTransition  string `json:"reopen_transition,omitempty"`
+
+	// WebhookSecret verifies the X-Hub-Signature of Jira's webhooks. Without
+	// it the webhook endpoint is off.
+	WebhookSecret string `json:"-"`
+
+	SyncInterval     time.Duration `json:"-"`
+	MaxIssuesPerSync int           `json:"max_issues_per_sync"`
+}
+
+// ConfigFromEnv reads:
+//
+//	JIRA_BASE_URL             site URL, e.g. https://wakala.atlassian.net (unset disables the integration)
+//	JIRA_EMAIL                account of an Atlassian Cloud API token; unset sends the token as a bearer PAT
+//	JIRA_API_TOKEN            API token or personal access token (required)
+//	JIRA_PROJECT              project key issues are opened in (required)
+//	JIRA_ISSUE_TYPE           issue type (default Task)
+//	JIRA_LABELS               comma-separated labels of every issue (default wakala-reconciler)
+//	JIRA_MIN_SEVERITY         lowest severity an issue is opened for (default HIGH)
+//	JIRA_PRIORITIES           severity=priority pairs, e.g. CRITICAL=Highest,HIGH=High
+//	JIRA_RESOLVED_STATUSES    comma-separated statuses that resolve the discrepancy (default Done)
+//	JIRA_RESOLVE_TRANSITION   transition applied when the discrepancy is no longer raised (default Done)
+//	JIRA_REOPEN_TRANSITION    transition applied when it is raised again (default none)
+//	JIRA_WEBHOOK_SECRET       secret of the Jira webhook; unset turns the webhook endpoint off
+//	JIRA_SYNC_INTERVAL        time between syncs besides those after runs (default 15m)
+//	JIRA_MAX_ISSUES_PER_SYNC  most issues opened in one sync (default 50)
+//
+// It returns nil, nil when JIRA_BASE_URL is not set. Plain http is only
+// accepted for loopback hosts.
+func ConfigFromEnv() (*Config, error) {
+	base := os.Getenv("JIRA_BASE_URL")
+	if base == "" {
+		return nil, nil
+	}
+	u, err := url.Parse(base)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("JIRA_BASE_URL must be a URL, got %q", base)
+	}
+	if u.Scheme != "https" && !(u.Scheme == "http" && isLoopback(u.Hostname())) {
+		return nil, fmt.Errorf("JIRA_BASE_URL must use https, got %q", base)
+	}
+
+	cfg := &Config{
+		BaseURL:           strings.TrimRight(base, "/"),
+		Email:             os.Getenv("JIRA_EMAIL"),
+		Token:             os.Getenv("JIRA_API_TOKEN"),
+		Project:           os.Getenv("JIRA_PROJECT"),
+		IssueType:         envOr("JIRA_ISSUE_TYPE", "Task"),
+		Labels:            splitList(envOr("JIRA_LABELS", "wakala-reconciler")),
+		MinSeverity:       domain.Severity(strings.ToUpper(envOr("JIRA_MIN_SEVERITY", string(domain.SeverityHigh)))),
+		ResolvedStatuses:  splitList(envOr("JIRA_RESOLVED_STATUSES", "Done")),
+		ResolveTransition: envOr("JIRA_RESOLVE_TRANSITION", "Done"),
+		ReopenTransition:  os.Getenv("JIRA_REOPEN_TRANSITION"),
+		WebhookSecret:     os.Getenv("JIRA_WEBHOOK_SECRET"),
+		SyncInterval:      15 * time.Minute,
+		MaxIssuesPerSync:  50,
+	}
+	if cfg.Token == "" {
+		return nil, fmt.Errorf("JIRA_API_TOKEN is required when JIRA_BASE_URL is set")
+	}
+	if cfg.Project == "" {
+		return nil, fmt.Errorf("JIRA_PROJECT is required when JIRA_BASE_URL is set")
+	}
+	if cfg.Severities() == nil {
+		return nil, fmt.Errorf("JIRA_MIN_SEVERITY must be LOW, MEDIUM, HIGH or CRITICAL, got %q", cfg.MinSeverity)
+	}
+	for _, label := range cfg.Labels {
+		if strings.ContainsAny(label, " \t") {
+			return nil, fmt.Errorf("JIRA_LABELS: label %q contains a space", label)
+		}
+	}
+	if len(cfg.ResolvedStatuses) == 0 {
+		return nil, fmt.Errorf("JIRA_RESOLVED_STATUSES must name at least one status")
+	}
+	if v := os.Getenv("JIRA_PRIORITIES"); v != "" {
+		cfg.Priorities = map[domain.Severity]string{}
+		for _, pair := range splitList(v) {
+			sev, priority, ok := strings.Cut(pair, "=")
+			sev = strings.ToUpper(strings.TrimSpace(sev))
+			priority = strings.TrimSpace(priority)
+			if !ok || priority == "" || !validSeverity(domain.Severity(sev)) {
+				return nil, fmt.Errorf("JIRA_PRIORITIES must be SEVERITY=priority pairs such as CRITICAL=Highest, got %q", pair)
+			}
+			cfg.Priorities[domain.Severity(sev)] = priority
+		}
+	}
+	if v := os.Getenv("JIRA_SYNC_INTERVAL"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("JIRA_SYNC_INTERVAL must be a positive duration, got %q", v)
+		}
+		cfg.SyncInterval = d
+	}
+	if v := os.Getenv("JIRA_MAX_ISSUES_PER_SYNC"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("JIRA_MAX_ISSUES_PER_SYNC must be a positive integer, got %q", v)
+		}
+		cfg.MaxIssuesPerSync = n
+	}
+	return cfg, nil
+}
+
+// Severities returns the severities issues are opened for, or nil when
+// MinSeverity is not a severity.
+func (c *Config) Severities() []domain.Severity {
+	for i, sev := range severities {
+		if sev == c.MinSeverity {
+			return severities[:i+1]
+		}
+	}
+	return nil
+}
+
+// Resolved reports whether status is one of the statuses that resolve a
+// discrepancy.
+func (c *Config) Resolved(status string) bool {
+	for _, s := range c.ResolvedStatuses {
+		if strings.EqualFold(s, status) {
+			return true
+		}
+	}
+	return false
+}
+
+// BrowseURL is the page of the issue with the given key.
+func (c *Config) BrowseURL(key string) string {
+	return c.BaseURL + "/browse/" + url.PathEscape(key)
+}
+
+func validSeverity(sev domain.Severity) bool {
+	for _, s := range severities {
+		if s == sev {
+			return true
+		}
+	}
+	return false
+}
+
+func envOr(name, def string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return def
+}
+
+func splitList(v string) []string {
+	var out []string
+	for _, s := range strings.Split(v, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+func isLoopback(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
@@ -0,0 +1,432 @@
+package jira
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/wakala/reconciler/internal/domain"
+	"github.com/wakala/reconciler/internal/repository"
+)
+
+// syncActor is who the activity log records the syncer's changes as.
+const syncActor = "jira-sync"
+
+// maxFailingListed bounds the failing issues Status lists.
+const maxFailingListed = 20
+
+// SyncResult is what one sync did. Failed counts the transitions that
+// failed; they are tried again by the next sync.
+type SyncResult struct {
+	At       time.Time `json:"at"`
+	Opened   int       `json:"opened"`
+	Adopted  int       `json:"adopted"`
+	Resolved int       `json:"resolved"`
+	Reopened int       `json:"reopened"`
+	Failed   int       `json:"failed"`
+	Error    string    `json:"error,omitempty"`
+}
+
+// Status is the integration's configuration, its last sync, and its issues
+// by state.
+type Status struct {
+	Config   Config             `json:"config"`
+	LastSync *SyncResult        `json:"last_sync"`
+	Issues   map[string]int     `json:"issues"`
+	Failing  []domain.JiraIssue `json:"failing"`
+}
+
+// Syncer syncs discrepancies with Jira issues after every reconciliation
+// run and on a schedule, and applies the status changes Jira's webhook
+// reports.
+type Syncer struct {
+	uow      *repository.UnitOfWork
+	issues   *repository.JiraIssueRepo
+	contacts *repository.ProcessorContactRepo
+
+	cfgMu  sync.Mutex
+	cfg    *Config
+	client *Client
+
+	// syncMu keeps a scheduled sync and a manual one from opening two
+	// issues for one discrepancy.
+	syncMu sync.Mutex
+	// kick wakes Run for a sync; it is buffered so that requests made while
+	// a sync runs collapse into one more.
+	kick chan struct{}
+
+	lastMu sync.Mutex
+	last   *SyncResult
+}
+
+// NewSyncer returns a syncer of the site cfg names. New issues carry the
+// escalation contacts of their processor.
+func NewSyncer(cfg *Config, uow *repository.UnitOfWork, issues *repository.JiraIssueRepo,
+	contacts *repository.ProcessorContactRepo) *Syncer {
+	return &Syncer{
+		uow:      uow,
+		issues:   issues,
+		contacts: contacts,
+		cfg:      cfg,
+		client:   NewClient(cfg),
+		kick:     make(chan struct{}, 1),
+	}
+}
+
+// SetConfig replaces the configuration, from the next sync on.
+func (s *Syncer) SetConfig(cfg *Config) {
+	s.cfgMu.Lock()
+	s.cfg = cfg
+	s.client = NewClient(cfg)
+	s.cfgMu.Unlock()
+	s.Kick()
+}
+
+func (s *Syncer) config() (*Config, *Client) {
+	s.cfgMu.Lock()
+	defer s.cfgMu.Unlock()
+	return s.cfg, s.client
+}
+
+// WebhookSecret returns the secret Jira's webhooks are signed with, or ""
+// when the webhook is off.
+func (s *Syncer) WebhookSecret() string {
+	cfg, _ := s.config()
+	return cfg.WebhookSecret
+}
+
+// Kick asks Run for a sync without waiting for it. Reconciliation runs call
+// it once their discrepancies are committed.
+func (s *Syncer) Kick() {
+	select {
+	case s.kick <- struct{}{}:
+	default:
+	}
+}
+
+// Run syncs immediately, then after every Kick and every sync interval,
+// until ctx is cancelled.
+func (s *Syncer) Run(ctx context.Context) {
+	cfg, _ := s.config()
+	log.Printf("[jira] Syncing discrepancies of %s and above with project %s at %s every %s and after each run",
+		cfg.MinSeverity, cfg.Project, cfg.BaseURL, cfg.SyncInterval)
+	for {
+		if _, err := s.Sync(ctx); err != nil {
+			log.Printf("[jira] WARNING: sync failed: %v", err)
+		}
+		cfg, _ := s.config()
+		timer := time.NewTimer(cfg.SyncInterval)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-s.kick:
+			timer.Stop()
+		case <-timer.C:
+		}
+	}
+}
+
+// Sync opens an issue for each discrepancy that qualifies and has none,
+// resolves the issues of discrepancies no longer raised, and, with a reopen
+// transition configured, reopens those of discrepancies raised again. A
+// discrepancy already linked to a Jira ticket by hand is adopted rather than
+// given a second issue. A failed transition is recorded on its issue and
+// tried again next time; failing to open an issue stops the sync.
+func (s *Syncer) Sync(ctx context.Context) (*SyncResult, error) {
+	s.syncMu.Lock()
+	defer s.syncMu.Unlock()
+
+	cfg, client := s.config()
+	result := &SyncResult{At: time.Now().UTC().Truncate(time.Second)}
+	err := s.sync(ctx, cfg, client, result)
+	if err != nil {
+		result.Error = err.Error()
+	}
+	s.lastMu.Lock()
+	s.last = result
+	s.lastMu.Unlock()
+
+	if result.Opened+result.Adopted+result.Resolved+result.Reopened+result.Failed > 0 {
+		log.Printf("[jira] Sync: opened=%d, adopted=%d, resolved=%d, reopened=%d, failed=%d",
+			result.Opened, result.Adopted, result.Resolved, result.Reopened, result.Failed)
+	}
+	return result, err
+}
+
+func (s *Syncer) sync(ctx context.Context, cfg *Config, client *Client, result *SyncResult) error {
+	untracked, err := s.issues.Untracked(cfg.Severities(), cfg.MaxIssuesPerSync)
+	if err != nil {
+		return fmt.Errorf("get untracked discrepancies: %w", err)
+	}
+	var contacts []domain.ProcessorContact
+	if len(untracked) > 0 {
+		if contacts, err = s.contacts.List(); err != nil {
+			return fmt.Errorf("get processor contacts: %w", err)
+		}
+	}
+	for i := range untracked {
+		d := &untracked[i]
+		if d.Ticket != nil {
+			if err := s.issues.Insert(&domain.JiraIssue{
+				DiscrepancyID: d.ID, Key: d.Ticket.TicketID, State: domain.JiraIssueOpen,
+				CreatedAt: result.At, UpdatedAt: result.At,
+			}); err != nil {
+				return fmt.Errorf("adopt %s for %s: %w", d.Ticket.TicketID, d.ID, err)
+			}
+			result.Adopted++
+			continue
+		}
+		var contact *domain.ProcessorContact
+		if j := slices.IndexFunc(contacts, func(c domain.ProcessorContact) bool { return c.Processor == d.Processor }); j >= 0 {
+			contact = &contacts[j]
+		}
+		key, err := client.CreateIssue(ctx, issueFields(cfg, d, contact))
+		if err != nil {
+			return fmt.Errorf("open issue for %s: %w", d.ID, err)
+		}
+		if err := s.link(cfg, d.ID, key, result.At); err != nil {
+			return fmt.Errorf("link issue %s to %s: %w", key, d.ID, err)
+		}
+		log.Printf("[jira] Opened %s for %s", key, d.ID)
+		result.Opened++
+	}
+
+	gone, err := s.issues.Gone()
+	if err != nil {
+		return fmt.Errorf("get issues of resolved discrepancies: %w", err)
+	}
+	for i := range gone {
+		if s.move(ctx, cfg, client, &gone[i], cfg.ResolveTransition, domain.JiraIssueResolvedHere, result.At) {
+			result.Resolved++
+		} else {
+			result.Failed++
+		}
+	}
+
+	if cfg.ReopenTransition == "" {
+		return nil
+	}
+	returned, err := s.issues.Returned()
+	if err != nil {
+		return fmt.Errorf("get issues of discrepancies raised again: %w", err)
+	}
+	for i := range returned {
+		if s.move(ctx, cfg, client, &returned[i], cfg.ReopenTransition, domain.JiraIssueOpen, result.At) {
+			result.Reopened++
+		} else {
+			result.Failed++
+		}
+	}
+	return nil
+}
+
+// link stores a new issue as the discrepancy's ticket, in its activity log
+// and as tracked.
+func (s *Syncer) link(cfg *Config, discID, key string, at time.Time) error {
+	return s.uow.Run(func(tx *repository.Tx) error {
+		ticket := &domain.ExternalTicket{
+			System: "jira", TicketID: key, URL: cfg.BrowseURL(key), LinkedBy: syncActor, LinkedAt: at,
+		}
+		prev, err := tx.Discrepancies.SetTicket(discID, ticket)
+		if err != nil {
+			return err
+		}
+		entry := &domain.DiscrepancyActivity{
+			DiscrepancyID: discID, At: at, Actor: syncActor, Action: domain.ActivityTicketLinked, To: ticket.Ref(),
+		}
+		if prev != nil {
+			entry.From = prev.Ref()
+		}
+		if err := tx.Discrepancies.AddActivity(entry); err != nil {
+			return err
+		}
+		return tx.JiraIssues.Insert(&domain.JiraIssue{
+			DiscrepancyID: discID, Key: key, State: domain.JiraIssueOpen, CreatedAt: at, UpdatedAt: at,
+		})
+	})
+}
+
+// move applies transition to issue and reports whether the issue got to
+// state. The state is stored before the transition is made, so that the
+// webhook Jira sends for it is not taken for a change made in Jira. An
+// issue without the transition that is already where it should be, moved
+// in Jira meanwhile, counts as moved.
+func (s *Syncer) move(ctx context.Context, cfg *Config, client *Client, issue *domain.JiraIssue,
+	transition string, state domain.JiraIssueState, at time.Time) bool {
+	prev := issue.State
+	issue.State, issue.UpdatedAt = state, at
+	if err := s.issues.Update(issue); err != nil {
+		log.Printf("[jira] WARNING: update %s: %v", issue.Key, err)
+		return false
+	}
+
+	ok, err := client.Transition(ctx, issue.Key, transition)
+	if err == nil && !ok {
+		var status string
+		if status, err = client.Status(ctx, issue.Key); err == nil {
+			if cfg.Resolved(status) == (state == domain.JiraIssueResolvedHere) {
+				ok, issue.Status = true, status
+			} else {
+				err = fmt.Errorf("issue in status %q has no %q transition", status, transition)
+			}
+		}
+	}
+	if ok {
+		issue.LastError = ""
+	} else {
+		issue.State, issue.LastError = prev, err.Error()
+		log.Printf("[jira] WARNING: %s of %s: %v", transition, issue.Key, err)
+	}
+	if err := s.issues.Update(issue); err != nil {
+		log.Printf("[jira] WARNING: update %s: %v", issue.Key, err)
+	}
+	return ok
+}
+
+// ErrUnknownIssue is returned by IssueUpdated for an issue the reconciler
+// does not track.
+var ErrUnknownIssue = errors.New("issue not tracked")
+
+// IssueUpdated applies the status of a tracked issue, as Jira's webhook
+// reports it, to each discrepancy the issue covers. Moving an open issue to
+// a resolved status marks its discrepancy resolved, by who Jira names;
+// moving an issue resolved in Jira back out of one withdraws that. Both are
+// recorded in the discrepancy's activity log. Statuses the reconciler's own
+// transitions lead to only update the issue's status.
+func (s *Syncer) IssueUpdated(key, status, user string) ([]domain.JiraIssue, error) {
+	cfg, _ := s.config()
+	actor := "jira"
+	if user != "" {
+		actor += ":" + user
+	}
+
+	var issues []domain.JiraIssue
+	err := s.uow.Run(func(tx *repository.Tx) error {
+		var err error
+		if issues, err = tx.JiraIssues.ListByKey(key); err != nil {
+			return err
+		}
+		now := time.Now().UTC().Truncate(time.Second)
+		resolved := cfg.Resolved(status)
+		for i := range issues {
+			issue := &issues[i]
+			switch {
+			case issue.State == domain.JiraIssueOpen && resolved:
+				if err := tx.Discrepancies.Resolve(issue.DiscrepancyID, &domain.DiscrepancyResolution{
+					Source: "jira", Reference: key, Status: status, ResolvedBy: actor, ResolvedAt: now,
+				}); err != nil {
+					return err
+				}
+				if err := tx.Discrepancies.AddActivity(&domain.DiscrepancyActivity{
+					DiscrepancyID: issue.DiscrepancyID, At: now, Actor: actor,
+					Action: domain.ActivityResolved, From: issue.Status, To: status,
+				}); err != nil {
+					return err
+				}
+				issue.State = domain.JiraIssueResolvedInJira
+			case issue.State == domain.JiraIssueResolvedInJira && !resolved:
+				if err := tx.Discrepancies.Unresolve(issue.DiscrepancyID); err != nil && !errors.Is(err, sql.ErrNoRows) {
+					return err
+				}
+				if err := tx.Discrepancies.AddActivity(&domain.DiscrepancyActivity{
+					DiscrepancyID: issue.DiscrepancyID, At: now, Actor: actor,
+					Action: domain.ActivityReopened, From: issue.Status, To: status,
+				}); err != nil {
+					return err
+				}
+				issue.State = domain.JiraIssueOpen
+			}
+			issue.Status, issue.UpdatedAt = status, now
+			if err := tx.JiraIssues.Update(issue); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(issues) == 0 {
+		return nil, ErrUnknownIssue
+	}
+	return issues, nil
+}
+
+// Status returns the configuration, the last sync and the issues by state.
+func (s *Syncer) Status() (*Status, error) {
+	cfg, _ := s.config()
+	counts, err := s.issues.CountByState()
+	if err != nil {
+		return nil, err
+	}
+	failing, err := s.issues.Failing(maxFailingListed)
+	if err != nil {
+		return nil, err
+	}
+	if failing == nil {
+		failing = []domain.JiraIssue{}
+	}
+	s.lastMu.Lock()
+	last := s.last
+	s.lastMu.Unlock()
+	return &Status{Config: *cfg, LastSync: last, Issues: counts, Failing: failing}, nil
+}
+
+// issueFields describes d as a new issue, with the escalation contacts of
+// its processor when it has any.
+func issueFields(cfg *Config, d *domain.Discrepancy, contact *domain.ProcessorContact) IssueFields {
+	summary := fmt.Sprintf("[%s] %s on %s: %.2f USD", d.Severity, d.Type, d.Processor, math.Abs(d.DifferenceUSD))
+	if d.MerchantID != "" {
+		summary += " (" + d.MerchantID + ")"
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "Discrepancy %s raised by the reconciler.\n\n", d.ID)
+	b.WriteString("||Field||Value||\n")
+	for _, row := range [][2]string{
+		{"Type", string(d.Type)},
+		{"Severity", string(d.Severity)},
+		{"Processor", string(d.Processor)},
+		{"Merchant", d.MerchantID},
+		{"Batch", d.BatchID},
+		{"Transaction", d.TransactionID},
+		{"Settlement record", d.SettlementID},
+		{"Expected USD", fmt.Sprintf("%.2f", d.ExpectedUSD)},
+		{"Actual USD", fmt.Sprintf("%.2f", d.ActualUSD)},
+		{"Difference USD", fmt.Sprintf("%.2f", d.DifferenceUSD)},
+		{"Detected", d.DetectedAt.UTC().Format(time.RFC3339)},
+	} {
+		if row[1] != "" {
+			fmt.Fprintf(&b, "|%s|%s|\n", row[0], row[1])
+		}
+	}
+	fmt.Fprintf(&b, "\n%s\n\n", d.Description)
+	if contact != nil {
+		if lines := contact.Lines(); len(lines) > 0 {
+			fmt.Fprintf(&b, "h3. Escalating with %s\n", d.Processor)
+			for _, line := range lines {
+				fmt.Fprintf(&b, "* %s\n", line)
+			}
+			b.WriteString("\n")
+		}
+	}
+	b.WriteString("Resolving this issue marks the discrepancy resolved in the reconciler. " +
+		"The reconciler resolves the issue itself once the records agree.")
+
+	return IssueFields{
+		Project:     cfg.Project,
+		IssueType:   cfg.IssueType,
+		Summary:     summary,
+		Description: b.String(),
+		Labels:      append(append([]string{}, cfg.Labels...), d.ID),
+		Priority:    cfg.Priorities[d.Severity],
+	}
+}
@@ -0,0 +1,245 @@
+// Package leader runs the background jobs (scheduled connector pulls,
+// mailbox polls, digests and database maintenance) on a single instance when
+// several replicas share one database. The instance holding a lease row in
+// the database is the leader; it renews the lease while it runs, and once it
+// stops, another instance takes the lease when it expires. The API serves on
+// every instance either way.
+package leader
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/wakala/reconciler/internal/domain"
+	"github.com/wakala/reconciler/internal/repository"
+)
+
+// LeaseName is the lease the background jobs run under.
+const LeaseName = "scheduler"
+
+// Config identifies this instance and sets how long its lease lasts.
+type Config struct {
+	// InstanceID names this instance as the lease holder. Every replica
+	// needs its own.
+	InstanceID string
+	// TTL is how long the lease lasts unrenewed, and so how soon another
+	// instance takes over from a leader that died. It is renewed every TTL/3.
+	TTL time.Duration
+}
+
+// ConfigFromEnv reads:
+//
+//	LEADER_ELECTION   true | false (default false)
+//	LEADER_LEASE_TTL  Go duration, at least 3s (default 30s)
+//	INSTANCE_ID       this instance's name (default hostname-pid)
+//
+// It returns nil, nil when LEADER_ELECTION is not true, meaning every
+// instance runs the background jobs.
+func ConfigFromEnv() (*Config, error) {
+	if v := os.Getenv("LEADER_ELECTION"); v != "true" {
+		if v != "" && v != "false" {
+			return nil, fmt.Errorf("LEADER_ELECTION must be true or false, got %q", v)
+		}
+		return nil, nil
+	}
+
+	cfg := &Config{TTL: 30 * time.Second}
+	if v := os.Getenv("LEADER_LEASE_TTL"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 3*time.Second {
+			return nil, fmt.Errorf("LEADER_LEASE_TTL must be a duration of at least 3s, got %q", v)
+		}
+		cfg.TTL = d
+	}
+	cfg.InstanceID = strings.TrimSpace(os.Getenv("INSTANCE_ID"))
+	if cfg.InstanceID == "" {
+		host, err := os.Hostname()
+		if err != nil {
+			host = "instance"
+		}
+		cfg.InstanceID = host + "-" + strconv.Itoa(os.Getpid())
+	}
+	return cfg, nil
+}
+
+// Status is this instance's part in the election.
+type Status struct {
+	Instance    string     `json:"instance"`
+	Leader      bool       `json:"leader"`
+	LeaderSince *time.Time `json:"leader_since,omitempty"`
+	// Lease is the current lease, whoever holds it; nil when none does.
+	Lease     *domain.Lease `json:"lease"`
+	LeaseTTL  string        `json:"lease_ttl"`
+	Jobs      []string      `json:"jobs"`
+	LastError string        `json:"last_error,omitempty"`
+}
+
+type job struct {
+	name string
+	run  func(ctx context.Context)
+}
+
+// Elector campaigns for the lease and runs the registered jobs while this
+// instance holds it.
+type Elector struct {
+	repo *repository.LeaseRepo
+	cfg  Config
+	jobs []job
+
+	mu          sync.Mutex
+	leaderSince *time.Time
+	lastErr     string
+}
+
+// NewElector creates an elector for this instance. Register jobs with Go,
+// then start it with Run.
+func NewElector(repo *repository.LeaseRepo, cfg Config) *Elector {
+	return &Elector{repo: repo, cfg: cfg}
+}
+
+// InstanceID returns this instance's name.
+func (e *Elector) InstanceID() string { return e.cfg.InstanceID }
+
+// Go registers a background job. run is started with a context that is
+// cancelled if the lease is lost, and started again if it is regained, so
+// it should return once ctx is done. Go must be called before Run.
+func (e *Elector) Go(name string, run func(ctx context.Context)) {
+	e.jobs = append(e.jobs, job{name: name, run: run})
+}
+
+// Leading reports whether this instance holds the lease.
+func (e *Elector) Leading() bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.leaderSince != nil
+}
+
+// Status returns this instance's election state and the current lease.
+func (e *Elector) Status() (*Status, error) {
+	lease, err := e.repo.Get(LeaseName)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	st := &Status{
+		Instance:    e.cfg.InstanceID,
+		Leader:      e.leaderSince != nil,
+		LeaderSince: e.leaderSince,
+		Lease:       lease,
+		LeaseTTL:    e.cfg.TTL.String(),
+		Jobs:        make([]string, len(e.jobs)),
+		LastError:   e.lastErr,
+	}
+	for i, j := range e.jobs {
+		st.Jobs[i] = j.name
+	}
+	return st, nil
+}
+
+// Run campaigns for the lease every TTL/3 until ctx is cancelled. On winning
+// it starts the jobs; on losing the lease, or failing to renew it before it
+// expires, it stops them and waits for them to return before campaigning
+// again. When ctx is cancelled it stops the jobs and releases the lease.
+func (e *Elector) Run(ctx context.Context) {
+	interval := e.cfg.TTL / 3
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var (
+		stop     context.CancelFunc
+		wg       sync.WaitGroup
+		expires  time.Time
+		standing string
+	)
+	stepDown := func(reason string) {
+		stop()
+		wg.Wait()
+		e.mu.Lock()
+		e.leaderSince = nil
+		e.mu.Unlock()
+		log.Printf("[leader] WARNING: %s stopped background jobs: %s", e.cfg.InstanceID, reason)
+	}
+
+	for {
+		now := time.Now().UTC()
+		won, err := e.repo.Acquire(LeaseName, e.cfg.InstanceID, now, e.cfg.TTL)
+		e.mu.Lock()
+		leading := e.leaderSince != nil
+		if err != nil {
+			e.lastErr = err.Error()
+		} else {
+			e.lastErr = ""
+		}
+		e.mu.Unlock()
+
+		switch {
+		case err != nil:
+			log.Printf("[leader] WARNING: %s could not reach the %s lease: %v", e.cfg.InstanceID, LeaseName, err)
+			if leading && !now.Before(expires.Add(-interval)) {
+				stepDown("the lease could not be renewed before it expires")
+			}
+		case won && !leading:
+			expires = now.Add(e.cfg.TTL)
+			jobCtx, cancel := context.WithCancel(ctx)
+			stop = cancel
+			for _, j := range e.jobs {
+				wg.Add(1)
+				go func(j job) {
+					defer wg.Done()
+					j.run(jobCtx)
+				}(j)
+			}
+			e.mu.Lock()
+			e.leaderSince = &now
+			e.mu.Unlock()
+			standing = ""
+			log.Printf("[leader] %s is the leader; running %s", e.cfg.InstanceID, e.jobNames())
+		case won:
+			expires = now.Add(e.cfg.TTL)
+		case leading:
+			stepDown("another instance took the lease")
+		default:
+			if lease, err := e.repo.Get(LeaseName); err == nil && lease.Holder != standing {
+				standing = lease.Holder
+				log.Printf("[leader] %s is standing by; %s holds the lease until %s",
+					e.cfg.InstanceID, lease.Holder, lease.ExpiresAt.Format(time.RFC3339))
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			if e.Leading() {
+				stop()
+				wg.Wait()
+				e.mu.Lock()
+				e.leaderSince = nil
+				e.mu.Unlock()
+				if err := e.repo.Release(LeaseName, e.cfg.InstanceID); err != nil {
+					log.Printf("[leader] WARNING: release lease: %v", err)
+				}
+			}
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (e *Elector) jobNames() string {
+	names := make([]string, len(e.jobs))
+	for i, j := range e.jobs {
+		names[i] = j.name
+	}
+	if len(names) == 0 {
+		return "no background jobs"
+	}
+	return strings.Join(names, ", ")
+}
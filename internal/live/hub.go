@@ -0,0 +1,172 @@
+// Package live pushes dashboard deltas to connected clients over
+// WebSocket, so a wall screen can follow new discrepancies, matches and
+// ingests without polling.
+package live
+
+import (
+	"encoding/json"
+	"log"
+	"sync"
+	"time"
+)
+
+// Event types.
+const (
+	// EventHello is the first event on every connection. A client loads
+	// GET /dashboard after it and applies the deltas that follow.
+	EventHello = "hello"
+	// EventDiscrepancyNew is sent after a run that opened discrepancies.
+	EventDiscrepancyNew = "discrepancy.new"
+	// EventSettlementMatched is sent when settlement records are matched to
+	// their transactions, by a run or as they arrive.
+	EventSettlementMatched = "settlement.matched"
+	// EventIngestCompleted is sent when a report has been stored, before it
+	// is reconciled.
+	EventIngestCompleted = "ingest.completed"
+	// EventReconciliationCompleted is sent after every run, with its
+	// totals, so counts that went down are refreshed too.
+	EventReconciliationCompleted = "reconciliation.completed"
+)
+
+// MaxItems is the most discrepancies or matches listed in one event; Count
+// is the full number.
+const MaxItems = 100
+
+// subscriberBuffer is how many events a client may fall behind by before it
+// is dropped.
+const subscriberBuffer = 64
+
+// Event is the envelope of every message sent to clients.
+type Event struct {
+	Type string    `json:"type"`
+	At   time.Time `json:"at"`
+	Data any       `json:"data,omitempty"`
+}
+
+// DiscrepanciesNew is the data of discrepancy.new.
+type DiscrepanciesNew struct {
+	Count         int                `json:"count"`
+	ImpactUSD     float64            `json:"impact_usd"`
+	Discrepancies []DiscrepancyDelta `json:"discrepancies"`
+}
+
+// DiscrepancyDelta is one new discrepancy.
+type DiscrepancyDelta struct {
+	ID            string  `json:"id"`
+	Type          string  `json:"type"`
+	Severity      string  `json:"severity"`
+	Processor     string  `json:"processor"`
+	MerchantID    string  `json:"merchant_id,omitempty"`
+	DifferenceUSD float64 `json:"difference_usd"`
+}
+
+// SettlementsMatched is the data of settlement.matched.
+type SettlementsMatched struct {
+	Count   int          `json:"count"`
+	Matches []MatchDelta `json:"matches"`
+}
+
+// MatchDelta is one matched settlement record. Pending is set when its
+// batch waits for approval before the transaction is settled.
+type MatchDelta struct {
+	TransactionID string  `json:"transaction_id"`
+	SettlementID  string  `json:"settlement_id"`
+	Processor     string  `json:"processor"`
+	BatchID       string  `json:"batch_id"`
+	USDAmount     float64 `json:"usd_amount"`
+	Pending       bool    `json:"pending,omitempty"`
+}
+
+// IngestCompleted is the data of ingest.completed.
+type IngestCompleted struct {
+	ReportID          string `json:"report_id"`
+	Processor         string `json:"processor"`
+	BatchID           string `json:"batch_id"`
+	RecordsIngested   int    `json:"records_ingested"`
+	DuplicatesSkipped int    `json:"duplicates_skipped"`
+	AlertsRaised      int    `json:"alerts_raised,omitempty"`
+}
+
+// ReconciliationCompleted is the data of reconciliation.completed.
+type ReconciliationCompleted struct {
+	Matched            int  `json:"matched"`
+	TotalDiscrepancies int  `json:"total_discrepancies"`
+	Opened             int  `json:"opened"`
+	Resolved           int  `json:"resolved"`
+	Scoped             bool `json:"scoped,omitempty"`
+}
+
+// Hub fans events out to the connected clients. A nil Hub drops them, so
+// services publish whether or not a feed is configured.
+type Hub struct {
+	mu   sync.Mutex
+	subs map[chan []byte]struct{}
+}
+
+func NewHub() *Hub {
+	return &Hub{subs: make(map[chan []byte]struct{})}
+}
+
+// Listening reports whether any client is connected, so publishers can skip
+// work nobody would see.
+func (h *Hub) Listening() bool {
+	if h == nil {
+		return false
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.subs) > 0
+}
+
+// Clients returns how many clients are connected.
+func (h *Hub) Clients() int {
+	if h == nil {
+		return 0
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.subs)
+}
+
+// Publish sends an event to every client. It never blocks: a client whose
+// buffer is full is dropped, and reloads the dashboard when it reconnects.
+func (h *Hub) Publish(typ string, data any) {
+	if !h.Listening() {
+		return
+	}
+	msg, err := json.Marshal(Event{Type: typ, At: time.Now().UTC(), Data: data})
+	if err != nil {
+		log.Printf("[live] WARNING: marshal %s: %v", typ, err)
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for ch := range h.subs {
+		select {
+		case ch <- msg:
+		default:
+			delete(h.subs, ch)
+			close(ch)
+			log.Printf("[live] Dropped a client %d events behind", subscriberBuffer)
+		}
+	}
+}
+
+// subscribe returns a channel of encoded events and the function that
+// stops them. The channel is closed when the client is dropped or stops.
+func (h *Hub) subscribe() (<-chan []byte, func()) {
+	ch := make(chan []byte, subscriberBuffer)
+	h.mu.Lock()
+	h.subs[ch] = struct{}{}
+	h.mu.Unlock()
+
+	return ch, func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		if _, ok := h.subs[ch]; ok {
+			delete(h.subs, ch)
+			close(ch)
+		}
+	}
+}
@@ -0,0 +1,277 @@
+package live
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The server side of RFC 6455, as much of it as a feed that only sends
+// needs: the handshake, unfragmented text frames out, and control frames
+// in. What clients send besides is read and ignored.
+
+// acceptGUID is appended to a client's key to prove the handshake was read.
+const acceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+const (
+	opText  = 0x1
+	opClose = 0x8
+	opPing  = 0x9
+	opPong  = 0xA
+)
+
+const (
+	// pingInterval is how often the server pings a client, and twice it how
+	// long a client may stay silent, pongs included, before it is dropped.
+	pingInterval = 30 * time.Second
+	// writeTimeout bounds each write, so a stalled client does not hold its
+	// connection open.
+	writeTimeout = 10 * time.Second
+	// maxClientFrame is the largest frame a client may send.
+	maxClientFrame = 64 << 10
+)
+
+// Close codes.
+const (
+	closeNormal   = 1000
+	closeProtocol = 1002
+	closeTooBig   = 1009
+	closeTryAgain = 1013
+)
+
+// HandshakeError is a request that is not a WebSocket handshake this server
+// accepts. Status is the HTTP status to answer it with.
+type HandshakeError struct {
+	Status  int
+	Message string
+}
+
+func (e *HandshakeError) Error() string { return e.Message }
+
+// Conn is an upgraded connection. Writes are serialized; reads happen on
+// the goroutine Serve starts.
+type Conn struct {
+	conn net.Conn
+	r    *bufio.Reader
+
+	mu sync.Mutex
+	w  *bufio.Writer
+}
+
+// Upgrade completes the WebSocket handshake of r and takes over its
+// connection. On a *HandshakeError nothing has been written to w, except a
+// Sec-WebSocket-Version header when the client asked for another version.
+func Upgrade(w http.ResponseWriter, r *http.Request) (*Conn, error) {
+	if r.Method != http.MethodGet {
+		return nil, &HandshakeError{http.StatusMethodNotAllowed, "a WebSocket handshake must be a GET"}
+	}
+	if !headerHasToken(r.Header, "Connection", "upgrade") || !headerHasToken(r.Header, "Upgrade", "websocket") {
+		return nil, &HandshakeError{http.StatusBadRequest, "expected a WebSocket handshake (Connection: Upgrade, Upgrade: websocket)"}
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		return nil, &HandshakeError{http.StatusUpgradeRequired, "unsupported WebSocket version: only 13 is supported"}
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if raw, err := base64.StdEncoding.DecodeString(key); err != nil || len(raw) != 16 {
+		return nil, &HandshakeError{http.StatusBadRequest, "invalid Sec-WebSocket-Key"}
+	}
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		return nil, errors.New("the response writer cannot hand over its connection")
+	}
+
+	conn, brw, err := hj.Hijack()
+	if err != nil {
+		return nil, fmt.Errorf("hijack: %w", err)
+	}
+	sum := sha1.Sum([]byte(key + acceptGUID))
+	c := &Conn{conn: conn, r: brw.Reader, w: brw.Writer}
+	conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	fmt.Fprintf(c.w, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: %s\r\n\r\n",
+		base64.StdEncoding.EncodeToString(sum[:]))
+	if err := c.w.Flush(); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("write handshake: %w", err)
+	}
+	return c, nil
+}
+
+// Serve sends the hub's events to c until the client goes away, stops
+// answering or falls too far behind, then closes c.
+func (h *Hub) Serve(c *Conn) {
+	events, stop := h.subscribe()
+	defer stop()
+	defer c.conn.Close()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		c.readLoop()
+	}()
+
+	hello, _ := json.Marshal(Event{Type: EventHello, At: time.Now().UTC(), Data: map[string]int{"clients": h.Clients()}})
+	if c.writeFrame(opText, hello) != nil {
+		return
+	}
+	ping := time.NewTicker(pingInterval)
+	defer ping.Stop()
+	for {
+		select {
+		case msg, ok := <-events:
+			if !ok {
+				c.writeClose(closeTryAgain, "too far behind; reconnect")
+				return
+			}
+			if c.writeFrame(opText, msg) != nil {
+				return
+			}
+		case <-ping.C:
+			if c.writeFrame(opPing, nil) != nil {
+				return
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+// readLoop answers pings and closes until the connection fails, the client
+// closes it or stays silent past the deadline.
+func (c *Conn) readLoop() {
+	for {
+		c.conn.SetReadDeadline(time.Now().Add(2 * pingInterval))
+		op, payload, err := c.readFrame()
+		var tooBig *frameTooBig
+		switch {
+		case errors.As(err, &tooBig):
+			c.writeClose(closeTooBig, err.Error())
+			return
+		case errors.Is(err, errProtocol):
+			c.writeClose(closeProtocol, err.Error())
+			return
+		case err != nil:
+			return
+		}
+		switch op {
+		case opClose:
+			code := closeNormal
+			if len(payload) >= 2 {
+				code = int(binary.BigEndian.Uint16(payload))
+			}
+			c.writeClose(code, "")
+			return
+		case opPing:
+			if c.writeFrame(opPong, payload) != nil {
+				return
+			}
+		}
+	}
+}
+
+var errProtocol = errors.New("protocol error")
+
+type frameTooBig struct{ size uint64 }
+
+func (e *frameTooBig) Error() string {
+	return fmt.Sprintf("frame of %d bytes is over the %d byte limit", e.size, maxClientFrame)
+}
+
+// readFrame reads one frame from the client and unmasks its payload.
+func (c *Conn) readFrame() (byte, []byte, error) {
+	var head [2]byte
+	if _, err := io.ReadFull(c.r, head[:]); err != nil {
+		return 0, nil, err
+	}
+	op := head[0] & 0x0F
+	if head[1]&0x80 == 0 {
+		return 0, nil, fmt.Errorf("%w: client frames must be masked", errProtocol)
+	}
+	size := uint64(head[1] & 0x7F)
+	switch size {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(c.r, ext[:]); err != nil {
+			return 0, nil, err
+		}
+		size = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(c.r, ext[:]); err != nil {
+			return 0, nil, err
+		}
+		size = binary.BigEndian.Uint64(ext[:])
+	}
+	if op >= opClose && (size > 125 || head[0]&0x80 == 0) {
+		return 0, nil, fmt.Errorf("%w: control frames must be whole and at most 125 bytes", errProtocol)
+	}
+	if size > maxClientFrame {
+		return 0, nil, &frameTooBig{size}
+	}
+	var mask [4]byte
+	if _, err := io.ReadFull(c.r, mask[:]); err != nil {
+		return 0, nil, err
+	}
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(c.r, payload); err != nil {
+		return 0, nil, err
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return op, payload, nil
+}
+
+// writeFrame sends one unmasked, unfragmented frame.
+func (c *Conn) writeFrame(op byte, payload []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	head := []byte{0x80 | op}
+	switch n := len(payload); {
+	case n < 126:
+		head = append(head, byte(n))
+	case n <= 0xFFFF:
+		head = append(head, 126)
+		head = binary.BigEndian.AppendUint16(head, uint16(n))
+	default:
+		head = append(head, 127)
+		head = binary.BigEndian.AppendUint64(head, uint64(n))
+	}
+	c.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	c.w.Write(head)
+	c.w.Write(payload)
+	return c.w.Flush()
+}
+
+// writeClose sends a close frame with a code and reason.
+func (c *Conn) writeClose(code int, reason string) {
+	if len(reason) > 123 {
+		reason = reason[:123]
+	}
+	payload := binary.BigEndian.AppendUint16(nil, uint16(code))
+	c.writeFrame(opClose, append(payload, reason...))
+}
+
+// headerHasToken reports whether a comma-separated header has token, in
+// any case.
+func headerHasToken(h http.Header, name, token string) bool {
+	for _, v := range h.Values(name) {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,209 @@
+package mailbox
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// imapTimeout bounds each command, so a stalled server fails the poll
+// instead of hanging it.
+const imapTimeout = 2 * time.Minute
+
+// imapClient speaks the few IMAP4rev1 commands the poller needs, one at a
+// time: LOGIN, EXAMINE, UID SEARCH, UID FETCH and LOGOUT.
+type imapClient struct {
+	conn net.Conn
+	r    *bufio.Reader
+	tag  int
+}
+
+// imapResponse is one untagged response line with its literals, e.g. the
+// message of a FETCH.
+type imapResponse struct {
+	text     string
+	literals [][]byte
+}
+
+func dialIMAP(ctx context.Context, addr string, useTLS bool) (*imapClient, error) {
+	d := &net.Dialer{Timeout: 30 * time.Second}
+	var conn net.Conn
+	var err error
+	if useTLS {
+		host, _, _ := net.SplitHostPort(addr)
+		conn, err = (&tls.Dialer{NetDialer: d, Config: &tls.Config{ServerName: host}}).DialContext(ctx, "tcp", addr)
+	} else {
+		conn, err = d.DialContext(ctx, "tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	c := &imapClient{conn: conn, r: bufio.NewReader(conn)}
+	conn.SetDeadline(time.Now().Add(imapTimeout))
+	greeting, err := c.readResponse()
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("greeting: %w", err)
+	}
+	if !strings.HasPrefix(greeting.text, "* OK") && !strings.HasPrefix(greeting.text, "* PREAUTH") {
+		conn.Close()
+		return nil, fmt.Errorf("greeting: %s", greeting.text)
+	}
+	return c, nil
+}
+
+// command sends one command and returns its untagged responses. A NO or BAD
+// completion is an error.
+func (c *imapClient) command(format string, args ...any) ([]imapResponse, error) {
+	c.tag++
+	tag := fmt.Sprintf("W%04d", c.tag)
+	c.conn.SetDeadline(time.Now().Add(imapTimeout))
+	if _, err := fmt.Fprintf(c.conn, "%s %s\r\n", tag, fmt.Sprintf(format, args...)); err != nil {
+		return nil, err
+	}
+	var untagged []imapResponse
+	for {
+		resp, err := c.readResponse()
+		if err != nil {
+			return nil, err
+		}
+		if strings.HasPrefix(resp.text, tag+" ") {
+			status := strings.TrimPrefix(resp.text, tag+" ")
+			if !strings.HasPrefix(status, "OK") {
+				return nil, &imapStatusError{status}
+			}
+			return untagged, nil
+		}
+		if strings.HasPrefix(resp.text, "+") {
+			return nil, fmt.Errorf("unexpected continuation: %s", resp.text)
+		}
+		untagged = append(untagged, resp)
+	}
+}
+
+// imapStatusError is a NO or BAD completion: the server answered, and
+// refused the command.
+type imapStatusError struct{ status string }
+
+func (e *imapStatusError) Error() string { return e.status }
+
+// readResponse reads one response line, reading each literal it announces
+// with {n} into literals.
+func (c *imapClient) readResponse() (imapResponse, error) {
+	var resp imapResponse
+	var b strings.Builder
+	for {
+		line, err := c.r.ReadString('\n')
+		if err != nil {
+			return resp, err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		n, ok := literalSize(line)
+		if !ok {
+			b.WriteString(line)
+			resp.text = b.String()
+			return resp, nil
+		}
+		if n > maxMessageSize {
+			return resp, fmt.Errorf("literal of %d bytes exceeds %d", n, maxMessageSize)
+		}
+		lit := make([]byte, n)
+		if _, err := io.ReadFull(c.r, lit); err != nil {
+			return resp, err
+		}
+		resp.literals = append(resp.literals, lit)
+		b.WriteString(line[:strings.LastIndexByte(line, '{')])
+	}
+}
+
+// literalSize reports the size of the literal a line ends by announcing.
+func literalSize(line string) (int, bool) {
+	if !strings.HasSuffix(line, "}") {
+		return 0, false
+	}
+	open := strings.LastIndexByte(line, '{')
+	if open < 0 {
+		return 0, false
+	}
+	n, err := strconv.Atoi(strings.TrimSuffix(line[open+1:len(line)-1], "+"))
+	return n, err == nil && n >= 0
+}
+
+func (c *imapClient) login(user, password string) error {
+	_, err := c.command("LOGIN %s %s", quote(user), quote(password))
+	return err
+}
+
+// selectFolder opens a folder read-only and returns its UIDVALIDITY.
+func (c *imapClient) selectFolder(folder string) (uint64, error) {
+	resps, err := c.command("EXAMINE %s", quote(folder))
+	if err != nil {
+		return 0, err
+	}
+	for _, r := range resps {
+		if i := strings.Index(r.text, "[UIDVALIDITY "); i >= 0 {
+			v := r.text[i+len("[UIDVALIDITY "):]
+			if j := strings.IndexByte(v, ']'); j >= 0 {
+				return strconv.ParseUint(v[:j], 10, 32)
+			}
+		}
+	}
+	return 0, errors.New("server sent no UIDVALIDITY")
+}
+
+// searchSince returns the UIDs above after, in ascending order.
+func (c *imapClient) searchSince(after uint64) ([]uint64, error) {
+	resps, err := c.command("UID SEARCH UID %d:*", after+1)
+	if err != nil {
+		return nil, err
+	}
+	var uids []uint64
+	for _, r := range resps {
+		if !strings.HasPrefix(r.text, "* SEARCH") {
+			continue
+		}
+		for _, f := range strings.Fields(strings.TrimPrefix(r.text, "* SEARCH")) {
+			uid, err := strconv.ParseUint(f, 10, 32)
+			// n:* always matches the newest message, even when it is
+			// below n.
+			if err == nil && uid > after {
+				uids = append(uids, uid)
+			}
+		}
+	}
+	slices.Sort(uids)
+	return uids, nil
+}
+
+// fetch returns a message's full source without marking it read. It
+// returns nil for a message deleted since the search.
+func (c *imapClient) fetch(uid uint64) ([]byte, error) {
+	resps, err := c.command("UID FETCH %d (UID BODY.PEEK[])", uid)
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range resps {
+		if strings.Contains(r.text, " FETCH ") && len(r.literals) > 0 {
+			return r.literals[0], nil
+		}
+	}
+	return nil, nil
+}
+
+func (c *imapClient) logout() {
+	c.command("LOGOUT")
+	c.conn.Close()
+}
+
+func quote(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	return `"` + strings.ReplaceAll(s, `"`, `\"`) + `"`
+}
@@ -0,0 +1,130 @@
+package mailbox
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"time"
+)
+
+// maxMessageSize is the largest message the poller fetches, attachments
+// included. It matches the upload limit of POST /reports/ingest.
+const maxMessageSize = 32 << 20
+
+// maxPartDepth stops a message nesting multiparts without end.
+const maxPartDepth = 8
+
+// message is the part of an email the rules look at.
+type message struct {
+	ID          string
+	From        string // address only, lowercased
+	Subject     string
+	Date        time.Time
+	Attachments []attachment
+}
+
+type attachment struct {
+	Filename string
+	Data     []byte
+}
+
+var headerDecoder = &mime.WordDecoder{}
+
+// parseMessage reads a message's headers and every part with a filename.
+func parseMessage(raw []byte) (*message, error) {
+	m, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		return nil, err
+	}
+	msg := &message{ID: strings.Trim(strings.TrimSpace(m.Header.Get("Message-Id")), "<>")}
+	if subject, err := headerDecoder.DecodeHeader(m.Header.Get("Subject")); err == nil {
+		msg.Subject = subject
+	} else {
+		msg.Subject = m.Header.Get("Subject")
+	}
+	if addr, err := mail.ParseAddress(m.Header.Get("From")); err == nil {
+		msg.From = strings.ToLower(addr.Address)
+	}
+	if date, err := m.Header.Date(); err == nil {
+		msg.Date = date.UTC()
+	}
+
+	if err := msg.walk(textproto.MIMEHeader(m.Header), m.Body, 0); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// walk collects the attachments of one part, descending into multiparts.
+func (msg *message) walk(header textproto.MIMEHeader, body io.Reader, depth int) error {
+	mediaType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		mediaType, params = "text/plain", nil
+	}
+	if strings.HasPrefix(mediaType, "multipart/") {
+		if depth >= maxPartDepth {
+			return fmt.Errorf("multipart nested deeper than %d", maxPartDepth)
+		}
+		mr := multipart.NewReader(body, params["boundary"])
+		for {
+			part, err := mr.NextRawPart()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return fmt.Errorf("read part: %w", err)
+			}
+			if err := msg.walk(part.Header, part, depth+1); err != nil {
+				return err
+			}
+		}
+	}
+
+	name := partFilename(header, params)
+	if name == "" {
+		return nil
+	}
+	data, err := io.ReadAll(decodeTransfer(header.Get("Content-Transfer-Encoding"), body))
+	if err != nil {
+		return fmt.Errorf("attachment %s: %w", name, err)
+	}
+	msg.Attachments = append(msg.Attachments, attachment{Filename: name, Data: data})
+	return nil
+}
+
+// partFilename is the filename of Content-Disposition, or else the name of
+// Content-Type, decoded. Parts without either are message text.
+func partFilename(header textproto.MIMEHeader, typeParams map[string]string) string {
+	name := ""
+	if _, params, err := mime.ParseMediaType(header.Get("Content-Disposition")); err == nil {
+		name = params["filename"]
+	}
+	if name == "" {
+		name = typeParams["name"]
+	}
+	if decoded, err := headerDecoder.DecodeHeader(name); err == nil {
+		name = decoded
+	}
+	// Keep only the base name; some clients send a full path.
+	if i := strings.LastIndexAny(name, `/\`); i >= 0 {
+		name = name[i+1:]
+	}
+	return strings.TrimSpace(name)
+}
+
+func decodeTransfer(encoding string, body io.Reader) io.Reader {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "base64":
+		return base64.NewDecoder(base64.StdEncoding, body)
+	case "quoted-printable":
+		return quotedprintable.NewReader(body)
+	}
+	return body
+}
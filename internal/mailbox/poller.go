@@ -0,0 +1,398 @@
+// Package mailbox ingests settlement reports that processors only send as
+// email attachments, by polling an IMAP mailbox.
+package mailbox
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/wakala/reconciler/internal/domain"
+	"github.com/wakala/reconciler/internal/ingestion"
+	"github.com/wakala/reconciler/internal/repository"
+	"github.com/wakala/reconciler/internal/retry"
+)
+
+// stateName is the poller's entry in connector_state.
+const stateName = "mailbox"
+
+// maxMessagesPerPoll leaves the rest of a large backlog to the next poll.
+const maxMessagesPerPoll = 100
+
+// Poller fetches new messages from one IMAP folder and queues every
+// attachment a rule matches on the ingestion pool. Messages are only read:
+// they are not flagged, moved or deleted. The cursor is the folder's
+// UIDVALIDITY and the highest UID handled, and advances after each message.
+type Poller struct {
+	addr     string
+	useTLS   bool
+	folder   string
+	user     string
+	password string
+	interval time.Duration
+	rules    []Rule
+
+	pool  *ingestion.Pool
+	repo  *repository.ConnectorRepo
+	retry *retry.Integration
+
+	// mu keeps a scheduled poll and a manual one from racing on the cursor.
+	mu sync.Mutex
+}
+
+// PollResult summarises one poll.
+type PollResult struct {
+	Mailbox            string             `json:"mailbox"`
+	Messages           int                `json:"messages"`
+	Attachments        []AttachmentResult `json:"attachments"`
+	AttachmentsSkipped int                `json:"attachments_skipped"`
+	Cursor             string             `json:"cursor"`
+}
+
+// AttachmentResult is what became of one attachment a rule matched.
+type AttachmentResult struct {
+	UID       uint64                  `json:"uid"`
+	MessageID string                  `json:"message_id,omitempty"`
+	From      string                  `json:"from"`
+	Subject   string                  `json:"subject"`
+	Filename  string                  `json:"filename"`
+	Sidecars  []string                `json:"sidecars,omitempty"`
+	Rule      string                  `json:"rule"`
+	JobID     string                  `json:"job_id"`
+	Result    *ingestion.IngestResult `json:"result,omitempty"`
+	Error     string                  `json:"error,omitempty"`
+}
+
+// NewPollerFromEnv configures the poller from:
+//
+//	MAILBOX_IMAP_URL       imaps://host[:993]/folder (folder defaults to INBOX)
+//	MAILBOX_IMAP_USER      login (required)
+//	MAILBOX_IMAP_PASSWORD  password (required)
+//	MAILBOX_RULES_FILE     JSON array of rules (required)
+//	MAILBOX_POLL_INTERVAL  Go duration (default 5m)
+//
+// It returns nil, nil when MAILBOX_IMAP_URL is not set. Plain imap:// is only
+// accepted for loopback hosts.
+func NewPollerFromEnv(pool *ingestion.Pool, repo *repository.ConnectorRepo) (*Poller, error) {
+	raw := os.Getenv("MAILBOX_IMAP_URL")
+	if raw == "" {
+		return nil, nil
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, fmt.Errorf("MAILBOX_IMAP_URL: %w", err)
+	}
+	p := &Poller{pool: pool, repo: repo, interval: 5 * time.Minute, retry: retry.For("imap", retry.DefaultPolicy)}
+	switch {
+	case u.Scheme == "imaps":
+		p.useTLS = true
+		p.addr = hostPort(u, "993")
+	case u.Scheme == "imap" && isLoopback(u.Hostname()):
+		p.addr = hostPort(u, "143")
+	default:
+		return nil, fmt.Errorf("MAILBOX_IMAP_URL must use imaps, got %q", raw)
+	}
+	p.folder = strings.Trim(u.Path, "/")
+	if p.folder == "" {
+		p.folder = "INBOX"
+	}
+
+	p.user = os.Getenv("MAILBOX_IMAP_USER")
+	p.password = os.Getenv("MAILBOX_IMAP_PASSWORD")
+	if p.user == "" || p.password == "" {
+		return nil, errors.New("MAILBOX_IMAP_USER and MAILBOX_IMAP_PASSWORD are required when MAILBOX_IMAP_URL is set")
+	}
+
+	rulesPath := os.Getenv("MAILBOX_RULES_FILE")
+	if rulesPath == "" {
+		return nil, errors.New("MAILBOX_RULES_FILE is required when MAILBOX_IMAP_URL is set")
+	}
+	if p.rules, err = LoadRules(rulesPath); err != nil {
+		return nil, fmt.Errorf("MAILBOX_RULES_FILE: %w", err)
+	}
+
+	if v := os.Getenv("MAILBOX_POLL_INTERVAL"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("MAILBOX_POLL_INTERVAL must be a positive duration, got %q", v)
+		}
+		p.interval = d
+	}
+	return p, nil
+}
+
+func hostPort(u *url.URL, defaultPort string) string {
+	if u.Port() != "" {
+		return u.Host
+	}
+	return net.JoinHostPort(u.Hostname(), defaultPort)
+}
+
+func isLoopback(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// Name identifies the mailbox as user@host/folder.
+func (p *Poller) Name() string {
+	host, _, _ := net.SplitHostPort(p.addr)
+	return p.user + "@" + host + "/" + p.folder
+}
+
+// Rules returns the configured rules.
+func (p *Poller) Rules() []Rule {
+	return p.rules
+}
+
+// State returns the poller's saved state, with an empty cursor before the
+// first poll.
+func (p *Poller) State() (*domain.ConnectorState, error) {
+	st, err := p.repo.Get(stateName)
+	if errors.Is(err, sql.ErrNoRows) {
+		return &domain.ConnectorState{Name: stateName}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("get state: %w", err)
+	}
+	return st, nil
+}
+
+// Poll fetches and ingests everything new in the folder. A poll that fails
+// keeps the cursor of the last message it finished, and its error is kept in
+// the state. An attachment that fails to ingest does not fail the poll; its
+// error is in the result and the log.
+func (p *Poller) Poll(ctx context.Context) (*PollResult, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	st, err := p.State()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().UTC()
+	st.LastRunAt = &now
+
+	result, err := p.poll(ctx, st)
+	if err != nil {
+		st.LastError = err.Error()
+		if saveErr := p.repo.Save(st); saveErr != nil {
+			log.Printf("[mailbox] WARNING: save state: %v", saveErr)
+		}
+		return nil, err
+	}
+
+	st.LastSuccessAt = &now
+	st.LastError = ""
+	if err := p.repo.Save(st); err != nil {
+		return nil, fmt.Errorf("save state: %w", err)
+	}
+	log.Printf("[mailbox] Checked %d messages in %s: %d attachments queued, %d skipped",
+		result.Messages, p.Name(), len(result.Attachments), result.AttachmentsSkipped)
+	return result, nil
+}
+
+func (p *Poller) poll(ctx context.Context, st *domain.ConnectorState) (*PollResult, error) {
+	uidValidity, lastUID := parseCursor(st.Cursor)
+
+	c, err := p.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer c.logout()
+	validity, err := c.selectFolder(p.folder)
+	if err != nil {
+		return nil, fmt.Errorf("select %s: %w", p.folder, err)
+	}
+	if validity != uidValidity && st.Cursor != "" {
+		// The folder was recreated and its UIDs reassigned. Starting over
+		// re-reads old messages; files already ingested are skipped by hash.
+		log.Printf("[mailbox] WARNING: UIDVALIDITY of %s changed from %d to %d; reading the folder from the start",
+			p.Name(), uidValidity, validity)
+		lastUID = 0
+	}
+	st.Cursor = formatCursor(validity, lastUID)
+
+	uids, err := c.searchSince(lastUID)
+	if err != nil {
+		return nil, fmt.Errorf("search: %w", err)
+	}
+	if len(uids) > maxMessagesPerPoll {
+		uids = uids[:maxMessagesPerPoll]
+	}
+
+	result := &PollResult{Mailbox: p.Name(), Attachments: []AttachmentResult{}}
+	for _, uid := range uids {
+		raw, err := c.fetch(uid)
+		if err != nil {
+			return nil, fmt.Errorf("fetch %d: %w", uid, err)
+		}
+		if raw != nil {
+			if err := p.ingestMessage(ctx, uid, raw, st, result); err != nil {
+				return nil, err
+			}
+			result.Messages++
+		}
+		st.Cursor = formatCursor(validity, uid)
+		if err := p.repo.Save(st); err != nil {
+			return nil, fmt.Errorf("save state: %w", err)
+		}
+	}
+	result.Cursor = st.Cursor
+	return result, nil
+}
+
+// connect dials the server and logs in, retrying under the "imap" retry
+// policy. A rejected login is not retried.
+func (p *Poller) connect(ctx context.Context) (*imapClient, error) {
+	var c *imapClient
+	err := p.retry.Do(ctx, func(ctx context.Context) error {
+		var err error
+		if c, err = dialIMAP(ctx, p.addr, p.useTLS); err != nil {
+			return fmt.Errorf("connect: %w", err)
+		}
+		if err := c.login(p.user, p.password); err != nil {
+			c.logout()
+			c = nil
+			var rejected *imapStatusError
+			if errors.As(err, &rejected) {
+				return retry.Permanent(fmt.Errorf("login: %w", err))
+			}
+			return fmt.Errorf("login: %w", err)
+		}
+		return nil
+	})
+	return c, err
+}
+
+// ingestMessage queues each attachment of a message that a rule matches and
+// waits for it, so the cursor only passes a message once its files are
+// stored or have failed. Checksum and signature files named after another
+// attachment are sent with it rather than matched. It only returns an error
+// when ctx is done.
+func (p *Poller) ingestMessage(ctx context.Context, uid uint64, raw []byte, st *domain.ConnectorState, result *PollResult) error {
+	msg, err := parseMessage(raw)
+	if err != nil {
+		log.Printf("[mailbox] WARNING: message %d in %s is not readable, skipped: %v", uid, p.Name(), err)
+		return nil
+	}
+	received := msg.Date
+	if received.IsZero() {
+		received = time.Now().UTC()
+	}
+
+	names := make([]string, len(msg.Attachments))
+	for i, att := range msg.Attachments {
+		names[i] = att.Filename
+	}
+	targets := ingestion.SidecarTargets(names)
+
+	for i, att := range msg.Attachments {
+		if targets[i] >= 0 {
+			continue
+		}
+		rule := p.match(msg, att.Filename)
+		if rule == nil {
+			result.AttachmentsSkipped++
+			continue
+		}
+		ar := AttachmentResult{
+			UID:       uid,
+			MessageID: msg.ID,
+			From:      msg.From,
+			Subject:   msg.Subject,
+			Filename:  att.Filename,
+			Rule:      rule.Name,
+		}
+		var sidecars []ingestion.Sidecar
+		for j, target := range targets {
+			if target == i {
+				sidecars = append(sidecars, ingestion.Sidecar{Filename: names[j], Data: msg.Attachments[j].Data})
+				ar.Sidecars = append(ar.Sidecars, names[j])
+			}
+		}
+		// Queued as async so a failing attachment, which the cursor moves
+		// past, is retried and then kept as a dead letter.
+		job := p.pool.SubmitAsync(att.Data, rule.Processor, rule.Format, ingestion.IngestOptions{
+			Filename: att.Filename,
+			Sidecars: sidecars,
+			Provenance: &domain.ReportProvenance{
+				Source:     "mailbox",
+				Mailbox:    p.Name(),
+				MessageID:  msg.ID,
+				From:       msg.From,
+				Subject:    msg.Subject,
+				ReceivedAt: received,
+				Rule:       rule.Name,
+			},
+		})
+		ar.JobID = job.ID
+		done, err := p.pool.Wait(ctx, job)
+		if err != nil {
+			return err
+		}
+		if done.Status == ingestion.JobFailed {
+			ar.Error = done.Error
+			log.Printf("[mailbox] WARNING: %s from message %d (%s) failed to ingest: %s",
+				att.Filename, uid, msg.From, done.Error)
+		} else {
+			ar.Result = done.Result
+			st.RecordsPulled += done.Result.RecordsIngested
+		}
+		result.Attachments = append(result.Attachments, ar)
+	}
+	return nil
+}
+
+func (p *Poller) match(msg *message, filename string) *Rule {
+	for i := range p.rules {
+		if p.rules[i].matches(msg, filename) {
+			return &p.rules[i]
+		}
+	}
+	return nil
+}
+
+func parseCursor(cursor string) (uidValidity, lastUID uint64) {
+	v, u, ok := strings.Cut(cursor, ":")
+	if !ok {
+		return 0, 0
+	}
+	uidValidity, _ = strconv.ParseUint(v, 10, 32)
+	lastUID, _ = strconv.ParseUint(u, 10, 32)
+	return uidValidity, lastUID
+}
+
+func formatCursor(uidValidity, lastUID uint64) string {
+	return fmt.Sprintf("%d:%d", uidValidity, lastUID)
+}
+
+// Run polls immediately and then every interval until ctx is cancelled.
+func (p *Poller) Run(ctx context.Context) {
+	log.Printf("[mailbox] Polling %s every %s", p.Name(), p.interval)
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+
+	for {
+		if _, err := p.Poll(ctx); err != nil {
+			log.Printf("[mailbox] WARNING: poll of %s failed: %v", p.Name(), err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
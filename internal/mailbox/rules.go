@@ -0,0 +1,118 @@
+package mailbox
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/wakala/reconciler/internal/domain"
+	"github.com/wakala/reconciler/internal/ingestion"
+)
+
+// Rule picks the attachments of one processor's report emails. An
+// attachment is ingested under the first rule it matches, with the rule's
+// processor and format.
+type Rule struct {
+	Name      string `json:"name"`
+	Processor string `json:"processor"`
+	Format    string `json:"format"`
+	// From is the sender's address, or "@domain" for any sender at that
+	// domain. It is required, so mail from anyone else is never ingested.
+	From string `json:"from"`
+	// Subject is a regular expression the subject must match; empty matches
+	// any subject.
+	Subject string `json:"subject,omitempty"`
+	// Filename is a glob such as "settlement_*.csv" the attachment's name
+	// must match, ignoring case; empty matches any name.
+	Filename string `json:"filename,omitempty"`
+
+	subject *regexp.Regexp
+}
+
+// ruleFormats are the formats a rule may name.
+var ruleFormats = map[string]bool{
+	"csv_a": true, "json_b": true, "csv_c": true, "csv_mpesa": true, ingestion.FormatExternal: true,
+}
+
+// LoadRules reads a JSON array of rules from path and checks them.
+func LoadRules(path string) ([]Rule, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var rules []Rule
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if len(rules) == 0 {
+		return nil, fmt.Errorf("%s: no rules", path)
+	}
+	names := make(map[string]bool, len(rules))
+	for i := range rules {
+		r := &rules[i]
+		if err := r.compile(); err != nil {
+			return nil, fmt.Errorf("%s: rule %d: %w", path, i+1, err)
+		}
+		if names[r.Name] {
+			return nil, fmt.Errorf("%s: rule name %q used twice", path, r.Name)
+		}
+		names[r.Name] = true
+	}
+	return rules, nil
+}
+
+func (r *Rule) compile() error {
+	r.Name = strings.TrimSpace(r.Name)
+	r.From = strings.ToLower(strings.TrimSpace(r.From))
+	r.Filename = strings.ToLower(r.Filename)
+	if r.Name == "" {
+		return errors.New("name is required")
+	}
+	if r.Processor == "" || r.Format == "" {
+		return errors.New("processor and format are required")
+	}
+	if !ruleFormats[r.Format] {
+		return fmt.Errorf("unknown format %q", r.Format)
+	}
+	if err := ingestion.CheckFormat(domain.Processor(r.Processor), r.Format); err != nil {
+		return err
+	}
+	if r.From == "" || r.From == "@" {
+		return errors.New("from is required")
+	}
+	if r.Subject != "" {
+		re, err := regexp.Compile(r.Subject)
+		if err != nil {
+			return fmt.Errorf("subject: %w", err)
+		}
+		r.subject = re
+	}
+	if _, err := path.Match(r.Filename, ""); err != nil {
+		return fmt.Errorf("filename: %w", err)
+	}
+	return nil
+}
+
+// matches reports whether an attachment of msg falls under the rule.
+func (r *Rule) matches(msg *message, filename string) bool {
+	if strings.HasPrefix(r.From, "@") {
+		if !strings.HasSuffix(msg.From, r.From) {
+			return false
+		}
+	} else if msg.From != r.From {
+		return false
+	}
+	if r.subject != nil && !r.subject.MatchString(msg.Subject) {
+		return false
+	}
+	if r.Filename != "" {
+		if ok, _ := path.Match(r.Filename, strings.ToLower(filename)); !ok {
+			return false
+		}
+	}
+	return true
+}
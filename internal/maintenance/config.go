@@ -0,0 +1,119 @@
+package maintenance
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config controls how often maintenance runs and when it may VACUUM.
+type Config struct {
+	// Interval is the time between runs.
+	Interval time.Duration
+	// VacuumWindow is the daily UTC window in which a run may also VACUUM;
+	// nil means maintenance never vacuums on its own.
+	VacuumWindow *Window
+	// VacuumMinFreePct is the share of free pages, in percent, below which
+	// VACUUM is skipped as not worth locking the database for.
+	VacuumMinFreePct float64
+}
+
+// Window is a daily span of UTC time. End before Start wraps past
+// midnight, e.g. 23:00-01:00.
+type Window struct {
+	// Start and End are minutes after midnight UTC.
+	Start, End int
+}
+
+// Contains reports whether t falls inside the window.
+func (w Window) Contains(t time.Time) bool {
+	t = t.UTC()
+	m := t.Hour()*60 + t.Minute()
+	if w.Start <= w.End {
+		return m >= w.Start && m < w.End
+	}
+	return m >= w.Start || m < w.End
+}
+
+// Length is how long the window lasts each day.
+func (w Window) Length() time.Duration {
+	minutes := w.End - w.Start
+	if minutes <= 0 {
+		minutes += 24 * 60
+	}
+	return time.Duration(minutes) * time.Minute
+}
+
+func (w Window) String() string {
+	return fmt.Sprintf("%02d:%02d-%02d:%02d", w.Start/60, w.Start%60, w.End/60, w.End%60)
+}
+
+// ConfigFromEnv reads the maintenance configuration:
+//
+//	DB_MAINTENANCE_INTERVAL  Go duration (default 1h); off disables maintenance
+//	DB_VACUUM_WINDOW         HH:MM-HH:MM UTC, e.g. 02:00-04:00 (unset: never VACUUM)
+//	DB_VACUUM_MIN_FREE_PCT   0-100 (default 10)
+//
+// It returns nil, nil when DB_MAINTENANCE_INTERVAL is off. The window must
+// be at least one interval long so that a run falls inside it.
+func ConfigFromEnv() (*Config, error) {
+	cfg := &Config{Interval: time.Hour, VacuumMinFreePct: 10}
+
+	if v := os.Getenv("DB_MAINTENANCE_INTERVAL"); v != "" {
+		if v == "off" {
+			return nil, nil
+		}
+		d, err := time.ParseDuration(v)
+		if err != nil || d < time.Minute {
+			return nil, fmt.Errorf("DB_MAINTENANCE_INTERVAL must be a duration of at least 1m or off, got %q", v)
+		}
+		cfg.Interval = d
+	}
+	if v := os.Getenv("DB_VACUUM_WINDOW"); v != "" {
+		w, err := parseWindow(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid DB_VACUUM_WINDOW %q: %w", v, err)
+		}
+		if w.Length() < cfg.Interval {
+			return nil, fmt.Errorf("DB_VACUUM_WINDOW %s is shorter than DB_MAINTENANCE_INTERVAL %s, so no run may fall inside it", w, cfg.Interval)
+		}
+		cfg.VacuumWindow = &w
+	}
+	if v := os.Getenv("DB_VACUUM_MIN_FREE_PCT"); v != "" {
+		pct, err := strconv.ParseFloat(v, 64)
+		if err != nil || pct < 0 || pct > 100 {
+			return nil, fmt.Errorf("DB_VACUUM_MIN_FREE_PCT must be 0-100, got %q", v)
+		}
+		cfg.VacuumMinFreePct = pct
+	}
+	return cfg, nil
+}
+
+func parseWindow(s string) (Window, error) {
+	from, to, ok := strings.Cut(s, "-")
+	if !ok {
+		return Window{}, fmt.Errorf("want HH:MM-HH:MM")
+	}
+	start, err := parseClock(from)
+	if err != nil {
+		return Window{}, err
+	}
+	end, err := parseClock(to)
+	if err != nil {
+		return Window{}, err
+	}
+	if start == end {
+		return Window{}, fmt.Errorf("start and end are the same")
+	}
+	return Window{Start: start, End: end}, nil
+}
+
+func parseClock(s string) (int, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(s))
+	if err != nil {
+		return 0, fmt.Errorf("%q is not HH:MM", s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
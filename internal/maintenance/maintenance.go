@@ -0,0 +1,297 @@
+// Package maintenance keeps a long-running SQLite database compact: it
+// checkpoints the write-ahead log so it does not grow without bound,
+// refreshes the query planner's statistics, and vacuums free pages away in
+// a configured quiet window.
+package maintenance
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// ErrRunning is returned by RunNow while another run is in progress.
+var ErrRunning = errors.New("maintenance is already running")
+
+// Checkpoint is the result of PRAGMA wal_checkpoint. Busy means a reader or
+// writer kept SQLite from checkpointing the whole log; the rest is done on
+// a later run.
+type Checkpoint struct {
+	Busy              bool `json:"busy"`
+	WALPages          int  `json:"wal_pages"`
+	CheckpointedPages int  `json:"checkpointed_pages"`
+}
+
+// Run is the outcome of one maintenance run.
+type Run struct {
+	StartedAt  time.Time   `json:"started_at"`
+	DurationMS int64       `json:"duration_ms"`
+	Checkpoint *Checkpoint `json:"checkpoint,omitempty"`
+	Vacuumed   bool        `json:"vacuumed"`
+	// VacuumSkipped says why the run did not vacuum, when it could have.
+	VacuumSkipped string `json:"vacuum_skipped,omitempty"`
+	FreedPages    int    `json:"freed_pages,omitempty"`
+	Error         string `json:"error,omitempty"`
+}
+
+// DatabaseStats describes the database file as it is now.
+type DatabaseStats struct {
+	PageSize      int     `json:"page_size"`
+	PageCount     int     `json:"page_count"`
+	FreelistCount int     `json:"freelist_count"`
+	FreePct       float64 `json:"free_pct"`
+	SizeBytes     int64   `json:"size_bytes"`
+	// WALBytes is the size of the write-ahead log file, when the database
+	// is a file.
+	WALBytes *int64 `json:"wal_bytes,omitempty"`
+}
+
+// Status is the schedule, the last run and the current database size.
+type Status struct {
+	Interval         string        `json:"interval"`
+	VacuumWindow     string        `json:"vacuum_window,omitempty"`
+	VacuumMinFreePct float64       `json:"vacuum_min_free_pct"`
+	Running          bool          `json:"running"`
+	NextRunAt        *time.Time    `json:"next_run_at,omitempty"`
+	LastRun          *Run          `json:"last_run,omitempty"`
+	LastVacuumAt     *time.Time    `json:"last_vacuum_at,omitempty"`
+	Database         DatabaseStats `json:"database"`
+}
+
+// Service runs maintenance on a schedule and on demand. Runs never
+// overlap.
+type Service struct {
+	db *sql.DB
+	// path is the database file, or "" for an in-memory database.
+	path string
+
+	runMu sync.Mutex
+
+	mu           sync.Mutex
+	cfg          *Config
+	running      bool
+	nextRunAt    *time.Time
+	lastRun      *Run
+	lastVacuumAt *time.Time
+
+	// reconfigured wakes Run to reschedule after SetConfig.
+	reconfigured chan struct{}
+}
+
+// NewService creates a maintenance service for the database at path, which
+// is "" for an in-memory database.
+func NewService(db *sql.DB, path string, cfg *Config) *Service {
+	return &Service{db: db, path: path, cfg: cfg, reconfigured: make(chan struct{}, 1)}
+}
+
+// SetConfig replaces the schedule and vacuum settings. A run in progress
+// finishes under the old ones; the next is scheduled one new interval from
+// now.
+func (s *Service) SetConfig(cfg *Config) {
+	s.mu.Lock()
+	s.cfg = cfg
+	s.mu.Unlock()
+	select {
+	case s.reconfigured <- struct{}{}:
+	default:
+	}
+}
+
+func (s *Service) config() *Config {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.cfg
+}
+
+// Run runs maintenance every interval until ctx is cancelled.
+func (s *Service) Run(ctx context.Context) {
+	for {
+		next := time.Now().Add(s.config().Interval)
+		s.mu.Lock()
+		s.nextRunAt = &next
+		s.mu.Unlock()
+
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-s.reconfigured:
+			timer.Stop()
+			continue
+		case <-timer.C:
+		}
+
+		s.runMu.Lock()
+		run := s.run(time.Now(), false)
+		s.runMu.Unlock()
+		if run.Error != "" {
+			log.Printf("[maintenance] WARNING: %s", run.Error)
+		}
+	}
+}
+
+// RunNow runs maintenance immediately. With vacuum it vacuums whatever the
+// window and free space; otherwise it vacuums only as a scheduled run
+// would.
+func (s *Service) RunNow(vacuum bool) (*Run, error) {
+	if !s.runMu.TryLock() {
+		return nil, ErrRunning
+	}
+	defer s.runMu.Unlock()
+	return s.run(time.Now(), vacuum), nil
+}
+
+// run checkpoints, optimizes and, when due, vacuums. Failures are recorded
+// in the returned Run rather than stopping the schedule.
+func (s *Service) run(now time.Time, forceVacuum bool) *Run {
+	s.mu.Lock()
+	s.running = true
+	s.mu.Unlock()
+	run := &Run{StartedAt: now.UTC()}
+	defer func() {
+		run.DurationMS = time.Since(now).Milliseconds()
+		s.mu.Lock()
+		s.running = false
+		s.lastRun = run
+		s.mu.Unlock()
+	}()
+
+	cp, err := s.checkpoint()
+	if err != nil {
+		run.Error = fmt.Sprintf("checkpoint: %v", err)
+		return run
+	}
+	run.Checkpoint = cp
+
+	if _, err := s.db.Exec("PRAGMA optimize"); err != nil {
+		run.Error = fmt.Sprintf("optimize: %v", err)
+		return run
+	}
+
+	if !forceVacuum {
+		var reason string
+		reason, err = s.vacuumSkipReason(now)
+		if err != nil {
+			run.Error = fmt.Sprintf("vacuum check: %v", err)
+			return run
+		}
+		if reason != "" {
+			run.VacuumSkipped = reason
+			return run
+		}
+	}
+
+	before, err := s.stats()
+	if err != nil {
+		run.Error = fmt.Sprintf("stats: %v", err)
+		return run
+	}
+	if _, err := s.db.Exec("VACUUM"); err != nil {
+		run.Error = fmt.Sprintf("vacuum: %v", err)
+		return run
+	}
+	run.Vacuumed = true
+	run.FreedPages = before.FreelistCount
+	at := now.UTC()
+	s.mu.Lock()
+	s.lastVacuumAt = &at
+	s.mu.Unlock()
+	log.Printf("[maintenance] Vacuumed database, freeing %d pages in %s", before.FreelistCount, time.Since(now).Round(time.Millisecond))
+
+	// VACUUM rewrites the whole database through the log.
+	if cp, err := s.checkpoint(); err == nil {
+		run.Checkpoint = cp
+	}
+	return run
+}
+
+// vacuumSkipReason returns why a scheduled run at now should not vacuum,
+// or "" when it should. Each day's window is used at most once.
+func (s *Service) vacuumSkipReason(now time.Time) (string, error) {
+	cfg := s.config()
+	w := cfg.VacuumWindow
+	if w == nil {
+		return "no vacuum window configured", nil
+	}
+	if !w.Contains(now) {
+		return "outside the vacuum window " + w.String(), nil
+	}
+	s.mu.Lock()
+	last := s.lastVacuumAt
+	s.mu.Unlock()
+	if last != nil && now.Sub(*last) < w.Length() {
+		return "already vacuumed in this window", nil
+	}
+	st, err := s.stats()
+	if err != nil {
+		return "", err
+	}
+	if st.FreePct < cfg.VacuumMinFreePct {
+		return fmt.Sprintf("only %.1f%% of pages are free (minimum %.1f%%)", st.FreePct, cfg.VacuumMinFreePct), nil
+	}
+	return "", nil
+}
+
+// checkpoint copies the log into the database and truncates it.
+func (s *Service) checkpoint() (*Checkpoint, error) {
+	var busy, walPages, checkpointed int
+	if err := s.db.QueryRow("PRAGMA wal_checkpoint(TRUNCATE)").Scan(&busy, &walPages, &checkpointed); err != nil {
+		return nil, err
+	}
+	return &Checkpoint{Busy: busy != 0, WALPages: walPages, CheckpointedPages: checkpointed}, nil
+}
+
+func (s *Service) stats() (*DatabaseStats, error) {
+	var st DatabaseStats
+	for pragma, dest := range map[string]*int{
+		"page_size":      &st.PageSize,
+		"page_count":     &st.PageCount,
+		"freelist_count": &st.FreelistCount,
+	} {
+		if err := s.db.QueryRow("PRAGMA " + pragma).Scan(dest); err != nil {
+			return nil, fmt.Errorf("%s: %w", pragma, err)
+		}
+	}
+	st.SizeBytes = int64(st.PageSize) * int64(st.PageCount)
+	if st.PageCount > 0 {
+		st.FreePct = float64(st.FreelistCount) / float64(st.PageCount) * 100
+	}
+	if s.path != "" {
+		if fi, err := os.Stat(s.path + "-wal"); err == nil {
+			size := fi.Size()
+			st.WALBytes = &size
+		}
+	}
+	return &st, nil
+}
+
+// Status returns the schedule, the last run and the database's current
+// size and free space.
+func (s *Service) Status() (*Status, error) {
+	st, err := s.stats()
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	status := &Status{
+		Interval:         s.cfg.Interval.String(),
+		VacuumMinFreePct: s.cfg.VacuumMinFreePct,
+		Running:          s.running,
+		NextRunAt:        s.nextRunAt,
+		LastRun:          s.lastRun,
+		LastVacuumAt:     s.lastVacuumAt,
+		Database:         *st,
+	}
+	if s.cfg.VacuumWindow != nil {
+		status.VacuumWindow = s.cfg.VacuumWindow.String()
+	}
+	return status, nil
+}
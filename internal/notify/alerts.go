@@ -0,0 +1,57 @@
+package notify
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/wakala/reconciler/internal/domain"
+)
+
+// AlertNotifier emails newly raised alerts to the operations team.
+type AlertNotifier struct {
+	mailer     *Mailer
+	recipients []string
+	contacts   ContactBook
+}
+
+// NewAlertNotifierFromEnv sends alerts to the comma-separated addresses in
+// ALERT_RECIPIENTS through mailer, with the escalation contacts in
+// contacts, which may be nil. It returns nil when either of the first two is
+// missing, meaning alerts are only stored and logged.
+func NewAlertNotifierFromEnv(mailer *Mailer, contacts ContactBook) *AlertNotifier {
+	var recipients []string
+	for _, r := range strings.Split(os.Getenv("ALERT_RECIPIENTS"), ",") {
+		if r = strings.TrimSpace(r); r != "" {
+			recipients = append(recipients, r)
+		}
+	}
+	if mailer == nil || len(recipients) == 0 {
+		return nil
+	}
+	return &AlertNotifier{mailer: mailer, recipients: recipients, contacts: contacts}
+}
+
+// Notify sends one email listing the alerts and the escalation contacts of
+// their processors.
+func (n *AlertNotifier) Notify(alerts []domain.Alert) error {
+	if len(alerts) == 0 {
+		return nil
+	}
+
+	subject := fmt.Sprintf("[Wakala] %s alert: %s", alerts[0].Severity, alerts[0].Message)
+	if len(alerts) > 1 {
+		subject = fmt.Sprintf("[Wakala] %d new reconciliation alerts", len(alerts))
+	}
+
+	var b strings.Builder
+	var procs []domain.Processor
+	for _, a := range alerts {
+		fmt.Fprintf(&b, "[%s] %s (%s)\n  %s\n\n", a.Severity, a.Type, a.Processor, a.Message)
+		procs = append(procs, a.Processor)
+	}
+	writeContacts(&b, n.contacts, procs)
+	b.WriteString("See GET /api/v1/alerts?status=open for all open alerts.\n")
+
+	return n.mailer.Send(n.recipients, subject, b.String(), "", nil)
+}
@@ -0,0 +1,48 @@
+package notify
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/wakala/reconciler/internal/domain"
+)
+
+// AssignmentNotifier emails the owners of newly assigned discrepancies.
+type AssignmentNotifier struct {
+	mailer   *Mailer
+	contacts ContactBook
+}
+
+// NewAssignmentNotifier sends assignment emails through mailer, with the
+// escalation contacts in contacts, which may be nil. It returns nil when
+// mailer is nil, meaning assignments are only stored and logged.
+func NewAssignmentNotifier(mailer *Mailer, contacts ContactBook) *AssignmentNotifier {
+	if mailer == nil {
+		return nil
+	}
+	return &AssignmentNotifier{mailer: mailer, contacts: contacts}
+}
+
+// Notify sends recipients one email listing the discrepancies newly
+// assigned to owner and the escalation contacts of their processors.
+func (n *AssignmentNotifier) Notify(recipients []string, owner string, discs []domain.Discrepancy) error {
+	if len(discs) == 0 || len(recipients) == 0 {
+		return nil
+	}
+
+	subject := fmt.Sprintf("[Wakala] %s discrepancy assigned to %s: %s", discs[0].Severity, owner, discs[0].ID)
+	if len(discs) > 1 {
+		subject = fmt.Sprintf("[Wakala] %d new discrepancies assigned to %s", len(discs), owner)
+	}
+
+	var b strings.Builder
+	var procs []domain.Processor
+	for _, d := range discs {
+		fmt.Fprintf(&b, "[%s] %s %s (%s)\n  %s\n\n", d.Severity, d.Type, d.ID, d.Processor, d.Description)
+		procs = append(procs, d.Processor)
+	}
+	writeContacts(&b, n.contacts, procs)
+	b.WriteString("See GET /api/v1/discrepancies/{id} for each, or filter the list by team or assignee.\n")
+
+	return n.mailer.Send(recipients, subject, b.String(), "", nil)
+}
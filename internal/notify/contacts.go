@@ -0,0 +1,45 @@
+package notify
+
+import (
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+
+	"github.com/wakala/reconciler/internal/domain"
+)
+
+// ContactBook holds the processors' escalation contacts.
+type ContactBook interface {
+	List() ([]domain.ProcessorContact, error)
+}
+
+// writeContacts appends the escalation contacts of procs to b, in the order
+// given, so whoever reads the email knows whom to chase. A contact book
+// that cannot be read is logged and left out; the email is still sent.
+func writeContacts(b *strings.Builder, book ContactBook, procs []domain.Processor) {
+	if book == nil {
+		return
+	}
+	contacts, err := book.List()
+	if err != nil {
+		log.Printf("[notify] WARNING: failed to read processor contacts: %v", err)
+		return
+	}
+	var seen []domain.Processor
+	for _, p := range procs {
+		if slices.Contains(seen, p) {
+			continue
+		}
+		seen = append(seen, p)
+		i := slices.IndexFunc(contacts, func(c domain.ProcessorContact) bool { return c.Processor == p })
+		if i < 0 {
+			continue
+		}
+		fmt.Fprintf(b, "Escalation contacts for %s:\n", p)
+		for _, line := range contacts[i].Lines() {
+			fmt.Fprintf(b, "  %s\n", line)
+		}
+		b.WriteString("\n")
+	}
+}
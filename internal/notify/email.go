@@ -0,0 +1,174 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"mime"
+	"mime/multipart"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/wakala/reconciler/internal/retry"
+)
+
+// Attachment is a file attached to an outgoing email.
+type Attachment struct {
+	Filename    string
+	ContentType string
+	Data        []byte
+}
+
+// Mailer sends email through an SMTP relay.
+type Mailer struct {
+	addr     string
+	username string
+	password string
+	from     string
+	retry    *retry.Integration
+}
+
+// NewMailerFromEnv configures a Mailer from SMTP_ADDR (host:port),
+// SMTP_USERNAME, SMTP_PASSWORD and SMTP_FROM. It returns nil when SMTP_ADDR
+// is not set, meaning email is disabled.
+func NewMailerFromEnv() *Mailer {
+	addr := os.Getenv("SMTP_ADDR")
+	if addr == "" {
+		return nil
+	}
+	from := os.Getenv("SMTP_FROM")
+	if from == "" {
+		from = "reconciler@wakala.local"
+	}
+	return &Mailer{
+		addr:     addr,
+		username: os.Getenv("SMTP_USERNAME"),
+		password: os.Getenv("SMTP_PASSWORD"),
+		from:     from,
+		retry:    retry.For("smtp", retry.DefaultPolicy),
+	}
+}
+
+// Send delivers a message to the recipients. htmlBody is optional; when set,
+// the message carries both a plain-text and an HTML alternative. Failures
+// are retried under the "smtp" retry policy, except a permanent (5xx) reply
+// from the relay.
+func (m *Mailer) Send(to []string, subject, textBody, htmlBody string, attachments []Attachment) error {
+	if len(to) == 0 {
+		return fmt.Errorf("no recipients")
+	}
+
+	msg, err := buildMessage(m.from, to, subject, textBody, htmlBody, attachments)
+	if err != nil {
+		return fmt.Errorf("build message: %w", err)
+	}
+
+	var auth smtp.Auth
+	if m.username != "" {
+		host := m.addr
+		if i := strings.LastIndex(host, ":"); i >= 0 {
+			host = host[:i]
+		}
+		auth = smtp.PlainAuth("", m.username, m.password, host)
+	}
+
+	err = m.retry.Do(context.Background(), func(context.Context) error {
+		err := smtp.SendMail(m.addr, auth, m.from, to, msg)
+		var reply *textproto.Error
+		if errors.As(err, &reply) && reply.Code >= 500 {
+			return retry.Permanent(err)
+		}
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("send mail: %w", err)
+	}
+	return nil
+}
+
+func buildMessage(from string, to []string, subject, textBody, htmlBody string, attachments []Attachment) ([]byte, error) {
+	var buf bytes.Buffer
+	mixed := multipart.NewWriter(&buf)
+
+	fmt.Fprintf(&buf, "From: %s\r\n", from)
+	fmt.Fprintf(&buf, "To: %s\r\n", strings.Join(to, ", "))
+	fmt.Fprintf(&buf, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&buf, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&buf, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&buf, "Content-Type: multipart/mixed; boundary=%s\r\n\r\n", mixed.Boundary())
+
+	// Body: text, optionally with an HTML alternative.
+	var bodyBuf bytes.Buffer
+	alt := multipart.NewWriter(&bodyBuf)
+	if err := writePart(alt, "text/plain; charset=utf-8", []byte(textBody)); err != nil {
+		return nil, err
+	}
+	if htmlBody != "" {
+		if err := writePart(alt, "text/html; charset=utf-8", []byte(htmlBody)); err != nil {
+			return nil, err
+		}
+	}
+	if err := alt.Close(); err != nil {
+		return nil, err
+	}
+
+	bodyPart, err := mixed.CreatePart(textproto.MIMEHeader{
+		"Content-Type": {"multipart/alternative; boundary=" + alt.Boundary()},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if _, err := bodyPart.Write(bodyBuf.Bytes()); err != nil {
+		return nil, err
+	}
+
+	for _, a := range attachments {
+		part, err := mixed.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {a.ContentType},
+			"Content-Transfer-Encoding": {"base64"},
+			"Content-Disposition":       {fmt.Sprintf("attachment; filename=%q", a.Filename)},
+		})
+		if err != nil {
+			return nil, err
+		}
+		if _, err := part.Write(wrapBase64(a.Data)); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := mixed.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func writePart(w *multipart.Writer, contentType string, data []byte) error {
+	part, err := w.CreatePart(textproto.MIMEHeader{
+		"Content-Type":              {contentType},
+		"Content-Transfer-Encoding": {"base64"},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = part.Write(wrapBase64(data))
+	return err
+}
+
+// wrapBase64 encodes data as base64 with 76-character lines (RFC 2045).
+func wrapBase64(data []byte) []byte {
+	enc := base64.StdEncoding.EncodeToString(data)
+	var out bytes.Buffer
+	for len(enc) > 76 {
+		out.WriteString(enc[:76])
+		out.WriteString("\r\n")
+		enc = enc[76:]
+	}
+	out.WriteString(enc)
+	out.WriteString("\r\n")
+	return out.Bytes()
+}
@@ -0,0 +1,154 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/wakala/reconciler/internal/retry"
+)
+
+const (
+	// EventTransactionSettled is sent when a transaction is matched to its
+	// settlement record.
+	EventTransactionSettled = "transaction.settled"
+	// EventPayoutHeld is sent when a merchant's payouts are put on hold.
+	EventPayoutHeld = "merchant.payout_held"
+	// EventPayoutReleased is sent when a merchant's payout hold is cleared.
+	EventPayoutReleased = "merchant.payout_released"
+	// EventDiscrepancyAssigned is sent when a routing rule assigns a new
+	// discrepancy.
+	EventDiscrepancyAssigned = "discrepancy.assigned"
+)
+
+// Event is the envelope of every outgoing webhook.
+type Event struct {
+	ID        string    `json:"id"`
+	Type      string    `json:"type"`
+	CreatedAt time.Time `json:"created_at"`
+	Data      any       `json:"data"`
+}
+
+// TransactionSettled is the data of a transaction.settled event.
+type TransactionSettled struct {
+	TransactionID      string    `json:"transaction_id"`
+	MerchantID         string    `json:"merchant_id"`
+	Processor          string    `json:"processor"`
+	ProcessorReference string    `json:"processor_reference"`
+	SettlementID       string    `json:"settlement_id"`
+	BatchID            string    `json:"batch_id"`
+	Amount             float64   `json:"amount"`
+	Currency           string    `json:"currency"`
+	USDAmount          float64   `json:"usd_amount"`
+	SettledUSDGross    float64   `json:"settled_usd_gross"`
+	SettledAt          time.Time `json:"settled_at"`
+}
+
+// PayoutHoldChanged is the data of merchant.payout_held and
+// merchant.payout_released events. ReleasedAt is only set on the latter,
+// whose counts are those the hold was last refreshed with.
+type PayoutHoldChanged struct {
+	MerchantID    string     `json:"merchant_id"`
+	Held          bool       `json:"held"`
+	Discrepancies int        `json:"discrepancies"`
+	OpenUSD       float64    `json:"open_usd"`
+	HeldSince     time.Time  `json:"held_since"`
+	ReleasedAt    *time.Time `json:"released_at,omitempty"`
+}
+
+// DiscrepancyAssigned is the data of a discrepancy.assigned event.
+type DiscrepancyAssigned struct {
+	DiscrepancyID string  `json:"discrepancy_id"`
+	Type          string  `json:"type"`
+	Severity      string  `json:"severity"`
+	Processor     string  `json:"processor"`
+	MerchantID    string  `json:"merchant_id,omitempty"`
+	DifferenceUSD float64 `json:"difference_usd"`
+	Team          string  `json:"team,omitempty"`
+	Assignee      string  `json:"assignee,omitempty"`
+	RuleID        string  `json:"rule_id"`
+}
+
+// WebhookSender posts events to a downstream HTTP endpoint.
+type WebhookSender struct {
+	url    string
+	secret string
+	client *http.Client
+	retry  *retry.Integration
+}
+
+// NewWebhookSenderFromEnv posts to SETTLEMENT_WEBHOOK_URL, signing bodies
+// with SETTLEMENT_WEBHOOK_SECRET when set. It returns nil when the URL is
+// not set, meaning no webhooks are sent.
+func NewWebhookSenderFromEnv() *WebhookSender {
+	url := os.Getenv("SETTLEMENT_WEBHOOK_URL")
+	if url == "" {
+		return nil
+	}
+	return &WebhookSender{
+		url:    url,
+		secret: os.Getenv("SETTLEMENT_WEBHOOK_SECRET"),
+		client: &http.Client{Timeout: 10 * time.Second},
+		retry:  retry.For("webhook", retry.DefaultPolicy),
+	}
+}
+
+// Sign returns the X-Wakala-Signature value for body: "sha256=" and the hex
+// HMAC-SHA256 of body keyed with secret.
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Send posts one event, retrying failed deliveries under the "webhook"
+// retry policy. Any 2xx response is a delivery; other 4xx responses than 408
+// and 429 are not retried. The event ID is stable across retries so the
+// receiver can drop duplicates.
+func (w *WebhookSender) Send(ev Event) error {
+	body, err := json.Marshal(ev)
+	if err != nil {
+		return fmt.Errorf("marshal event: %w", err)
+	}
+
+	err = w.retry.Do(context.Background(), func(ctx context.Context) error {
+		return w.post(ctx, ev.Type, body)
+	})
+	if err != nil {
+		return fmt.Errorf("deliver %s %s: %w", ev.Type, ev.ID, err)
+	}
+	return nil
+}
+
+func (w *WebhookSender) post(ctx context.Context, eventType string, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Wakala-Event", eventType)
+	if w.secret != "" {
+		req.Header.Set("X-Wakala-Signature", Sign(w.secret, body))
+	}
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		err := fmt.Errorf("status %d", resp.StatusCode)
+		if !retry.RetryableStatus(resp.StatusCode) {
+			return retry.Permanent(err)
+		}
+		return err
+	}
+	return nil
+}
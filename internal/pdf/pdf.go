@@ -0,0 +1,109 @@
+// Package pdf writes plain text documents as minimal PDF files, so reports
+// can be downloaded as PDF without a third-party dependency.
+package pdf
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// A4 page geometry in points.
+const (
+	pageWidth    = 595
+	pageHeight   = 842
+	margin       = 56
+	titleSize    = 15
+	bodySize     = 9.5
+	lineHeight   = 13
+	maxLineChars = 86
+)
+
+// Render lays out title in bold and lines in a monospace font on as many A4
+// pages as needed. Characters outside printable ASCII are replaced with '?'
+// and long lines are cut at the right margin.
+func Render(title string, lines []string) []byte {
+	linesPerPage := (pageHeight - 2*margin - 2*lineHeight) / lineHeight
+
+	var pages [][]string
+	for len(lines) > linesPerPage {
+		pages = append(pages, lines[:linesPerPage])
+		lines = lines[linesPerPage:]
+	}
+	pages = append(pages, lines)
+
+	// Objects 1-4 are fixed; each page then takes a page and a content
+	// object.
+	var objects []string
+	kids := make([]string, len(pages))
+	for i := range pages {
+		kids[i] = fmt.Sprintf("%d 0 R", 5+2*i)
+	}
+	objects = append(objects,
+		"<< /Type /Catalog /Pages 2 0 R >>",
+		fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), len(pages)),
+		"<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica-Bold /Encoding /WinAnsiEncoding >>",
+		"<< /Type /Font /Subtype /Type1 /BaseFont /Courier /Encoding /WinAnsiEncoding >>",
+	)
+
+	for i, pageLines := range pages {
+		var content bytes.Buffer
+		y := pageHeight - margin
+		if i == 0 {
+			fmt.Fprintf(&content, "BT /F1 %d Tf %d %d Td (%s) Tj ET\n", titleSize, margin, y, escape(title))
+		} else {
+			fmt.Fprintf(&content, "BT /F1 %g Tf %d %d Td (%s, page %d) Tj ET\n", bodySize, margin, y, escape(title), i+1)
+		}
+		y -= 2 * lineHeight
+
+		fmt.Fprintf(&content, "BT /F2 %g Tf %d TL %d %d Td\n", bodySize, lineHeight, margin, y)
+		for _, line := range pageLines {
+			fmt.Fprintf(&content, "(%s) Tj T*\n", escape(line))
+		}
+		content.WriteString("ET\n")
+
+		objects = append(objects,
+			fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %d %d] /Resources << /Font << /F1 3 0 R /F2 4 0 R >> >> /Contents %d 0 R >>",
+				pageWidth, pageHeight, 6+2*i),
+			fmt.Sprintf("<< /Length %d >>\nstream\n%sendstream", content.Len(), content.String()),
+		)
+	}
+
+	var out bytes.Buffer
+	out.WriteString("%PDF-1.4\n")
+	offsets := make([]int, len(objects))
+	for i, obj := range objects {
+		offsets[i] = out.Len()
+		fmt.Fprintf(&out, "%d 0 obj\n%s\nendobj\n", i+1, obj)
+	}
+
+	xref := out.Len()
+	fmt.Fprintf(&out, "xref\n0 %d\n0000000000 65535 f \n", len(objects)+1)
+	for _, off := range offsets {
+		fmt.Fprintf(&out, "%010d 00000 n \n", off)
+	}
+	fmt.Fprintf(&out, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(objects)+1, xref)
+	return out.Bytes()
+}
+
+// escape makes s safe inside a PDF string literal.
+func escape(s string) string {
+	var b strings.Builder
+	n := 0
+	for _, r := range s {
+		if n == maxLineChars {
+			break
+		}
+		n++
+		switch {
+		case r == '(' || r == ')' || r == '\\':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case r < 32 || r > 126:
+			b.WriteByte('?')
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,45 @@
+package pgp
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+)
+
+const armorStart = "-----BEGIN PGP "
+
+// isArmored reports whether data starts with an armor header line of the
+// given type, such as "MESSAGE".
+func isArmored(data []byte, kind string) bool {
+	return bytes.HasPrefix(bytes.TrimLeft(data, " \t\r\n"), []byte(armorStart+kind+"-----"))
+}
+
+// IsArmored reports whether data starts with an armor header line of any
+// type: a message, a signature or a key block.
+func IsArmored(data []byte) bool {
+	return bytes.HasPrefix(bytes.TrimLeft(data, " \t\r\n"), []byte(armorStart))
+}
+
+// unarmor returns the binary content of data: its first armored block of the
+// given type, such as "MESSAGE", or else its first armored block, checking
+// the CRC when there is one. Data that is not armored is returned as is.
+func unarmor(data []byte, kind string) ([]byte, error) {
+	start := bytes.Index(data, []byte(armorStart+kind+"-----"))
+	if start < 0 {
+		start = bytes.Index(data, []byte(armorStart))
+	}
+	if start < 0 {
+		return data, nil
+	}
+	block, err := armor.Decode(bytes.NewReader(data[start:]))
+	if err != nil {
+		return nil, fmt.Errorf("armor: %w", err)
+	}
+	out, err := io.ReadAll(block.Body)
+	if err != nil {
+		return nil, fmt.Errorf("armor: %w", err)
+	}
+	return out, nil
+}
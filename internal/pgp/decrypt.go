@@ -0,0 +1,196 @@
+// Package pgp decrypts OpenPGP messages with a secret key and verifies
+// detached signatures with a public key. Packets, ciphers, compression and
+// signatures are handled by ProtonMail's go-crypto OpenPGP library; this
+// package reads the keys as processors export them, unwraps RSA session keys
+// itself so that no failure can be told from another, and turns the
+// library's errors into ones an operator can act on.
+package pgp
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
+)
+
+// MaxPlaintext bounds a decrypted, decompressed message, so a small
+// compressed message cannot expand without end.
+const MaxPlaintext = 256 << 20
+
+// ErrDecrypt is returned for every message encrypted to a configured key
+// that still cannot be decrypted: a session key that does not unwrap, data
+// that fails its integrity check or a packet that cannot be read. They all
+// return this one error, so the answer to a crafted message says nothing
+// about the key it was sent to.
+var ErrDecrypt = errors.New("message cannot be decrypted with the configured key")
+
+// IsEncrypted reports whether data is an OpenPGP message encrypted to a key:
+// armored, or binary and starting with a session key or marker packet.
+func IsEncrypted(data []byte) bool {
+	if isArmored(data, "MESSAGE") {
+		return true
+	}
+	if len(data) == 0 || data[0]&0x80 == 0 {
+		return false
+	}
+	p, err := packet.Read(bytes.NewReader(data))
+	if err != nil {
+		return false
+	}
+	switch p.(type) {
+	case *packet.EncryptedKey, *packet.SymmetricKeyEncrypted, *packet.Marker:
+		return true
+	}
+	return false
+}
+
+// Decrypt decrypts an armored or binary message encrypted to one of the
+// keys and returns the content of its literal data. A message for other
+// keys fails with an error naming them; any other failure is ErrDecrypt.
+func (kr *KeyRing) Decrypt(data []byte) ([]byte, error) {
+	bin, err := unarmor(data, "MESSAGE")
+	if err != nil {
+		return nil, err
+	}
+	recipients, err := messageRecipients(bin)
+	if err != nil {
+		return nil, err
+	}
+	if len(recipients) == 0 {
+		return nil, errors.New("message is not encrypted to a public key")
+	}
+	matched := false
+	for _, id := range recipients {
+		// Key ID 0 is a hidden recipient, which any key may be.
+		if _, ok := kr.ids[id]; ok || id == 0 {
+			matched = true
+		}
+	}
+	if !matched {
+		names := make([]string, len(recipients))
+		for i, id := range recipients {
+			names[i] = fmt.Sprintf("%016X", id)
+		}
+		return nil, fmt.Errorf("message is encrypted to %s, which no configured key matches", strings.Join(names, ", "))
+	}
+
+	limit := int64(MaxPlaintext)
+	md, err := openpgp.ReadMessage(bytes.NewReader(bin), kr.entities, nil, &packet.Config{MaxDecompressedMessageSize: &limit})
+	if err != nil {
+		return nil, ErrDecrypt
+	}
+	// Signatures inside the message are not checked; reading to the end
+	// checks the integrity of the data.
+	plain, err := io.ReadAll(io.LimitReader(md.UnverifiedBody, MaxPlaintext+1))
+	if err != nil {
+		return nil, ErrDecrypt
+	}
+	if len(plain) > MaxPlaintext {
+		return nil, fmt.Errorf("decrypted message is larger than %d MB", MaxPlaintext>>20)
+	}
+	return plain, nil
+}
+
+// messageRecipients returns the key IDs of the public-key encrypted session
+// key packets a message starts with. Reading them needs no secret key.
+func messageRecipients(bin []byte) ([]uint64, error) {
+	packets := packet.NewReader(bytes.NewReader(bin))
+	var ids []uint64
+	for {
+		p, err := packets.Next()
+		if err == io.EOF {
+			return nil, errors.New("message has no encrypted data")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("read message: %w", err)
+		}
+		switch p := p.(type) {
+		case *packet.EncryptedKey:
+			ids = append(ids, p.KeyId)
+		case *packet.SymmetricKeyEncrypted, *packet.Marker:
+		default:
+			return ids, nil
+		}
+	}
+}
+
+// sessionCiphers are the ciphers an RSA-encrypted session key may name,
+// with their key sizes.
+var sessionCiphers = []struct {
+	id   packet.CipherFunction
+	size int
+}{
+	{packet.Cipher3DES, 24},
+	{packet.CipherAES128, 16},
+	{packet.CipherAES192, 24},
+	{packet.CipherAES256, 32},
+}
+
+// sessionKeyDecrypter is how an RSA secret key is handed to the library,
+// which decrypts session keys through a crypto.Decrypter. The library would
+// tell bad PKCS #1 padding, an unknown cipher and a bad checksum apart,
+// which is a padding oracle; this decrypter never fails on a ciphertext.
+// Each session key size is unwrapped with rsa.DecryptPKCS1v15SessionKey,
+// the cipher and checksum are checked in constant time, and a session key
+// that does not check out is replaced by a random one, so the message
+// then fails as if encrypted to another key.
+type sessionKeyDecrypter struct {
+	*rsa.PrivateKey
+}
+
+func (d sessionKeyDecrypter) Decrypt(random io.Reader, ciphertext []byte, _ crypto.DecrypterOpts) ([]byte, error) {
+	if random == nil {
+		random = rand.Reader
+	}
+	// The fallback: a random AES-256 key, with its cipher and checksum.
+	out := make([]byte, 1+32+2)
+	if _, err := io.ReadFull(random, out[1:33]); err != nil {
+		return nil, err
+	}
+	out[0] = byte(packet.CipherAES256)
+	sum := keyChecksum(out[1:33])
+	out[33], out[34] = byte(sum>>8), byte(sum)
+	n := len(out)
+
+	for _, size := range []int{16, 24, 32} {
+		msg := make([]byte, 1+size+2)
+		if _, err := io.ReadFull(random, msg); err != nil {
+			return nil, err
+		}
+		// An error here is about the sizes of the key and ciphertext, not
+		// about what the ciphertext decrypts to.
+		if err := rsa.DecryptPKCS1v15SessionKey(random, d.PrivateKey, ciphertext, msg); err != nil {
+			return nil, err
+		}
+		cipherOK := 0
+		for _, c := range sessionCiphers {
+			if c.size == size {
+				cipherOK |= subtle.ConstantTimeByteEq(msg[0], byte(c.id))
+			}
+		}
+		sum := keyChecksum(msg[1 : 1+size])
+		want := uint16(msg[1+size])<<8 | uint16(msg[2+size])
+		ok := cipherOK & subtle.ConstantTimeEq(int32(sum), int32(want))
+		subtle.ConstantTimeCopy(ok, out[:len(msg)], msg)
+		n = subtle.ConstantTimeSelect(ok, len(msg), n)
+	}
+	return out[:n], nil
+}
+
+// keyChecksum is the checksum of a session key (RFC 4880 section 5.1): the
+// sum of its octets, modulo 65536.
+func keyChecksum(key []byte) uint16 {
+	var sum uint16
+	for _, b := range key {
+		sum += uint16(b)
+	}
+	return sum
+}
@@ -0,0 +1,101 @@
+package pgp
+
+import (
+	"bytes"
+	"crypto/rsa"
+	"errors"
+	"fmt"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
+)
+
+// KeyRing holds the decryption keys read from one secret key file.
+type KeyRing struct {
+	entities openpgp.EntityList
+	// ids are the IDs of the keys that can decrypt; order lists them as
+	// they appear in the file.
+	ids   map[uint64]struct{}
+	order []uint64
+}
+
+// ReadKeyRing reads the RSA and ECDH secret keys and subkeys of an armored
+// or binary key export, such as that of gpg --export-secret-keys. Keys
+// protected by a passphrase are unlocked with passphrase. Other keys, such
+// as signing-only ones, are not used to decrypt; at least one key must be
+// usable.
+func ReadKeyRing(data, passphrase []byte) (*KeyRing, error) {
+	bin, err := unarmor(data, "PRIVATE KEY BLOCK")
+	if err != nil {
+		return nil, err
+	}
+	entities, err := openpgp.ReadKeyRing(bytes.NewReader(bin))
+	if err != nil {
+		return nil, fmt.Errorf("read keys: %w", err)
+	}
+
+	kr := &KeyRing{entities: entities, ids: map[uint64]struct{}{}}
+	secret := false
+	for _, e := range entities {
+		keys := []**packet.PrivateKey{&e.PrivateKey}
+		for i := range e.Subkeys {
+			keys = append(keys, &e.Subkeys[i].PrivateKey)
+		}
+		for _, kp := range keys {
+			k := *kp
+			// A stub's secret is kept elsewhere, e.g. on a smartcard.
+			if k == nil || k.Dummy() {
+				continue
+			}
+			secret = true
+			if !decrypts(k.PubKeyAlgo) {
+				// Only the keys listed by KeyIDs may be tried on a message.
+				*kp = nil
+				continue
+			}
+			if k.Encrypted {
+				if passphrase == nil {
+					return nil, fmt.Errorf("key %016X: key is protected by a passphrase, but none is configured", k.KeyId)
+				}
+				if err := k.Decrypt(passphrase); err != nil {
+					return nil, fmt.Errorf("key %016X: wrong passphrase", k.KeyId)
+				}
+			}
+			if rsaKey, ok := k.PrivateKey.(*rsa.PrivateKey); ok {
+				k.PrivateKey = sessionKeyDecrypter{rsaKey}
+			}
+			if _, ok := kr.ids[k.KeyId]; !ok {
+				kr.ids[k.KeyId] = struct{}{}
+				kr.order = append(kr.order, k.KeyId)
+			}
+		}
+	}
+	if len(kr.order) == 0 {
+		if !secret {
+			return nil, errors.New("no secret keys: this is a public key export")
+		}
+		return nil, errors.New("no usable decryption key (RSA, ECDH, X25519 or X448 keys are supported)")
+	}
+	return kr, nil
+}
+
+// decrypts reports whether keys of algo are used to decrypt. ElGamal keys
+// are not: their session keys cannot be unwrapped without telling failures
+// apart.
+func decrypts(algo packet.PublicKeyAlgorithm) bool {
+	switch algo {
+	case packet.PubKeyAlgoRSA, packet.PubKeyAlgoRSAEncryptOnly, packet.PubKeyAlgoECDH,
+		packet.PubKeyAlgoX25519, packet.PubKeyAlgoX448:
+		return true
+	}
+	return false
+}
+
+// KeyIDs returns the IDs of the keys, in hex as gpg shows them.
+func (kr *KeyRing) KeyIDs() []string {
+	ids := make([]string, len(kr.order))
+	for i, id := range kr.order {
+		ids[i] = fmt.Sprintf("%016X", id)
+	}
+	return ids
+}
@@ -0,0 +1,125 @@
+package pgp
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	pgperrors "github.com/ProtonMail/go-crypto/openpgp/errors"
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
+)
+
+// SigningKeys holds the public keys whose signatures are accepted.
+type SigningKeys struct {
+	entities openpgp.EntityList
+	ids      []uint64
+}
+
+// ReadSigningKeys reads the RSA, ECDSA and EdDSA keys and subkeys of an
+// armored or binary public key export, such as that of gpg --export. Other
+// keys are ignored; at least one must be usable. A key must be certified
+// for signing, and signatures by a revoked or expired key are refused.
+func ReadSigningKeys(data []byte) (*SigningKeys, error) {
+	bin, err := unarmor(data, "PUBLIC KEY BLOCK")
+	if err != nil {
+		return nil, err
+	}
+	entities, err := openpgp.ReadKeyRing(bytes.NewReader(bin))
+	if err != nil {
+		return nil, fmt.Errorf("read keys: %w", err)
+	}
+
+	sk := &SigningKeys{entities: entities}
+	for _, e := range entities {
+		keys := []*packet.PublicKey{e.PrimaryKey}
+		for _, sub := range e.Subkeys {
+			keys = append(keys, sub.PublicKey)
+		}
+		for _, k := range keys {
+			if k != nil && signs(k.PubKeyAlgo) {
+				sk.ids = append(sk.ids, k.KeyId)
+			}
+		}
+	}
+	if len(sk.ids) == 0 {
+		return nil, errors.New("no usable signing key (RSA, ECDSA or EdDSA keys are supported)")
+	}
+	return sk, nil
+}
+
+func signs(algo packet.PublicKeyAlgorithm) bool {
+	switch algo {
+	case packet.PubKeyAlgoRSA, packet.PubKeyAlgoRSASignOnly, packet.PubKeyAlgoECDSA,
+		packet.PubKeyAlgoEdDSA, packet.PubKeyAlgoEd25519, packet.PubKeyAlgoEd448:
+		return true
+	}
+	return false
+}
+
+// KeyIDs returns the IDs of the keys, in hex as gpg shows them.
+func (sk *SigningKeys) KeyIDs() []string {
+	ids := make([]string, len(sk.ids))
+	for i, id := range sk.ids {
+		ids[i] = fmt.Sprintf("%016X", id)
+	}
+	return ids
+}
+
+// VerifyDetached checks a detached signature, armored or binary, over data.
+// It returns the ID of the key that made it; in a file of several
+// signatures, the first by a configured key is checked.
+func (sk *SigningKeys) VerifyDetached(data, signature []byte) (string, error) {
+	bin, err := unarmor(signature, "SIGNATURE")
+	if err != nil {
+		return "", err
+	}
+	issuers, err := signatureIssuers(bin)
+	if err != nil {
+		return "", err
+	}
+
+	sig, _, err := openpgp.VerifyDetachedSignature(sk.entities, bytes.NewReader(data), bytes.NewReader(bin), nil)
+	switch {
+	case err == nil:
+		return fmt.Sprintf("%016X", *sig.IssuerKeyId), nil
+	case errors.Is(err, pgperrors.ErrUnknownIssuer):
+		return "", fmt.Errorf("signed by key %s, which is not a configured signing key", issuers)
+	case errors.Is(err, pgperrors.ErrSignatureExpired), errors.Is(err, pgperrors.ErrKeyExpired), errors.Is(err, pgperrors.ErrKeyRevoked):
+		return "", fmt.Errorf("signature by key %s: %w", issuers, err)
+	default:
+		return "", fmt.Errorf("signature by key %s does not match the file", issuers)
+	}
+}
+
+// signatureIssuers returns the key IDs a signature file names, joined for
+// an error message.
+func signatureIssuers(bin []byte) (string, error) {
+	packets := packet.NewReader(bytes.NewReader(bin))
+	var ids string
+	for {
+		p, err := packets.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", fmt.Errorf("signature: %w", err)
+		}
+		sig, ok := p.(*packet.Signature)
+		if !ok {
+			continue
+		}
+		if sig.IssuerKeyId == nil {
+			return "", errors.New("signature names no issuer key")
+		}
+		if ids != "" {
+			ids += ", "
+		}
+		ids += fmt.Sprintf("%016X", *sig.IssuerKeyId)
+	}
+	if ids == "" {
+		return "", errors.New("no signature in the signature file")
+	}
+	return ids, nil
+}
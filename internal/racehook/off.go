@@ -0,0 +1,14 @@
+//go:build !racehooks
+
+package racehook
+
+import "time"
+
+// Enabled reports whether the hooks are compiled in.
+const Enabled = false
+
+// SetMaxDelay does nothing without -tags racehooks.
+func SetMaxDelay(time.Duration) {}
+
+// Pause does nothing without -tags racehooks.
+func Pause(string) {}
@@ -0,0 +1,11 @@
+package racehook
+
+// The gaps Pause is called in.
+const (
+	// MatchLookup is between looking up a settlement record's transaction
+	// and linking the two.
+	MatchLookup = "match_lookup"
+	// MatchSettle is between linking a record to its transaction and
+	// marking the transaction settled.
+	MatchSettle = "match_settle"
+)
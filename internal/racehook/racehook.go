@@ -0,0 +1,33 @@
+//go:build racehooks
+
+// Package racehook widens the window between a read and the write that
+// depends on it, so that races needing unlucky timing happen on most runs
+// instead of once a month in production. It is compiled in only with
+// -tags racehooks; see testdata/concurrency.
+package racehook
+
+import (
+	"math/rand"
+	"sync/atomic"
+	"time"
+)
+
+// Enabled reports whether the hooks are compiled in.
+const Enabled = true
+
+// maxDelay is the longest pause, in nanoseconds.
+var maxDelay atomic.Int64
+
+func init() { maxDelay.Store(int64(2 * time.Millisecond)) }
+
+// SetMaxDelay sets the longest pause Pause takes; 0 disables pausing.
+func SetMaxDelay(d time.Duration) { maxDelay.Store(int64(d)) }
+
+// Pause sleeps for a random time up to the maximum delay, so concurrent
+// callers interleave differently on every run. point names the gap, e.g.
+// MatchLookup, so call sites are easy to find; every point pauses alike.
+func Pause(point string) {
+	if d := maxDelay.Load(); d > 0 {
+		time.Sleep(time.Duration(rand.Int63n(d)))
+	}
+}
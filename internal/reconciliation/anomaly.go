@@ -0,0 +1,251 @@
+package reconciliation
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/wakala/reconciler/internal/domain"
+	"github.com/wakala/reconciler/internal/notify"
+	"github.com/wakala/reconciler/internal/repository"
+)
+
+// AnomalyConfig sets the thresholds for aggregate anomaly alerts.
+type AnomalyConfig struct {
+	// VolumeDropPct alerts when a processor's latest daily settled volume is
+	// this fraction below its trailing daily average.
+	VolumeDropPct float64
+	// OrphanRatePct alerts when this fraction of a processor's settlement
+	// records over the trailing window match no transaction.
+	OrphanRatePct float64
+	// TrailingDays is the window, in days before the latest settlement day,
+	// that the volume average and orphan rate are computed over.
+	TrailingDays int
+	// MinRecords is the fewest records in the window for an orphan rate to
+	// be judged, so one stray record on a quiet day does not alert.
+	MinRecords int
+}
+
+// AnomalyConfigFromEnv reads ANOMALY_VOLUME_DROP_PCT (default 40),
+// ANOMALY_ORPHAN_RATE_PCT (default 3), ANOMALY_TRAILING_DAYS (default 7) and
+// ANOMALY_MIN_RECORDS (default 20).
+func AnomalyConfigFromEnv() (AnomalyConfig, error) {
+	cfg := AnomalyConfig{VolumeDropPct: 0.40, OrphanRatePct: 0.03, TrailingDays: 7, MinRecords: 20}
+
+	pct := func(name string, dst *float64) error {
+		v := os.Getenv(name)
+		if v == "" {
+			return nil
+		}
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil || f <= 0 || f >= 100 {
+			return fmt.Errorf("%s must be a percentage between 0 and 100, got %q", name, v)
+		}
+		*dst = f / 100
+		return nil
+	}
+	count := func(name string, dst *int) error {
+		v := os.Getenv(name)
+		if v == "" {
+			return nil
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return fmt.Errorf("%s must be a positive integer, got %q", name, v)
+		}
+		*dst = n
+		return nil
+	}
+
+	if err := pct("ANOMALY_VOLUME_DROP_PCT", &cfg.VolumeDropPct); err != nil {
+		return cfg, err
+	}
+	if err := pct("ANOMALY_ORPHAN_RATE_PCT", &cfg.OrphanRatePct); err != nil {
+		return cfg, err
+	}
+	if err := count("ANOMALY_TRAILING_DAYS", &cfg.TrailingDays); err != nil {
+		return cfg, err
+	}
+	if err := count("ANOMALY_MIN_RECORDS", &cfg.MinRecords); err != nil {
+		return cfg, err
+	}
+	return cfg, nil
+}
+
+// SetAnomalyDetection enables the aggregate anomaly step at the end of every
+// full reconciliation run. New alerts are stored in alertRepo and, when
+// notifier is not nil, emailed.
+func (s *Service) SetAnomalyDetection(alertRepo *repository.AlertRepo, cfg AnomalyConfig, notifier *notify.AlertNotifier) {
+	s.alertRepo = alertRepo
+	s.anomalyCfg = cfg
+	s.notifier = notifier
+}
+
+// processorWindow is a processor's latest settlement day and the days before
+// it.
+type processorWindow struct {
+	latest   repository.ProcessorDayStat
+	trailing []repository.ProcessorDayStat
+}
+
+// DetectAnomalies checks each processor's latest complete settlement day,
+// the last before asOf's, against the trailing window: a drop in settled USD volume
+// beyond the threshold, or an orphan rate above it. Alerts whose condition
+// has cleared, or whose rule is turned off for the processor, are resolved.
+// It returns the number of new alerts.
+func (s *Service) DetectAnomalies(asOf time.Time) (int, error) {
+	if s.alertRepo == nil {
+		return 0, nil
+	}
+	cfg := s.anomalyCfg
+
+	var rules *ruleSet
+	err := s.uow.Run(func(tx *repository.Tx) error {
+		var err error
+		rules, err = loadRules(tx)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	// asOf's own day is still settling, and its part-day volume would read
+	// as a drop.
+	stats, err := s.settRepo.GetDailyStats(asOf.UTC().AddDate(0, 0, -1).Format("2006-01-02"))
+	if err != nil {
+		return 0, fmt.Errorf("get daily stats: %w", err)
+	}
+
+	// Stats are oldest first, so the last day seen per processor is its
+	// latest.
+	byProc := make(map[string][]repository.ProcessorDayStat)
+	var order []string
+	for _, st := range stats {
+		if _, ok := byProc[st.Processor]; !ok {
+			order = append(order, st.Processor)
+		}
+		byProc[st.Processor] = append(byProc[st.Processor], st)
+	}
+
+	now := s.clock.Now().UTC()
+	var raised []domain.Alert
+	for _, proc := range order {
+		days := byProc[proc]
+		w := processorWindow{latest: days[len(days)-1]}
+		latestDay, _ := time.Parse("2006-01-02", w.latest.Day)
+		windowStart := latestDay.AddDate(0, 0, -cfg.TrailingDays).Format("2006-01-02")
+		for _, st := range days[:len(days)-1] {
+			if st.Day >= windowStart {
+				w.trailing = append(w.trailing, st)
+			}
+		}
+
+		for _, check := range []func(domain.Processor, processorWindow, AnomalyConfig, time.Time) (*domain.Alert, domain.AlertType){
+			volumeDropAlert, orphanRateAlert,
+		} {
+			alert, alertType := check(domain.Processor(proc), w, cfg, now)
+			if !rules.enabled(string(alertType), domain.Processor(proc)) {
+				alert = nil
+			}
+			if alert == nil {
+				if err := s.resolveOpenAlerts(alertType, proc, now); err != nil {
+					return len(raised), err
+				}
+				continue
+			}
+			created, err := s.alertRepo.Insert(alert)
+			if err != nil {
+				return len(raised), fmt.Errorf("insert alert: %w", err)
+			}
+			if created {
+				log.Printf("[reconciliation] ALERT: %s", alert.Message)
+				raised = append(raised, *alert)
+			}
+		}
+	}
+
+	if len(raised) > 0 && s.notifier != nil {
+		if err := s.notifier.Notify(raised); err != nil {
+			log.Printf("[reconciliation] WARNING: failed to send %d alert notifications: %v", len(raised), err)
+		}
+	}
+	return len(raised), nil
+}
+
+// volumeDropAlert compares the latest day's settled USD volume with the
+// average over the trailing window, counting days without settlements as
+// zero. No alert is possible without any trailing volume.
+func volumeDropAlert(proc domain.Processor, w processorWindow, cfg AnomalyConfig, now time.Time) (*domain.Alert, domain.AlertType) {
+	var total float64
+	for _, st := range w.trailing {
+		total += st.USDGross
+	}
+	avg := total / float64(cfg.TrailingDays)
+	if avg <= 0 || w.latest.USDGross >= avg*(1-cfg.VolumeDropPct) {
+		return nil, domain.AlertVolumeDrop
+	}
+
+	drop := 1 - w.latest.USDGross/avg
+	return &domain.Alert{
+		ID:        fmt.Sprintf("ALERT-VD-%s-%s", proc, w.latest.Day),
+		Type:      domain.AlertVolumeDrop,
+		Processor: proc,
+		Severity:  domain.SeverityHigh,
+		Reference: w.latest.Day,
+		Message: fmt.Sprintf(
+			"Settled volume from %s on %s was %.2f USD, %.0f%% below the %d-day average of %.2f USD",
+			proc, w.latest.Day, w.latest.USDGross, drop*100, cfg.TrailingDays, avg),
+		CreatedAt: now,
+	}, domain.AlertVolumeDrop
+}
+
+// orphanRateAlert computes the share of unmatched records over the latest
+// day and the trailing window.
+func orphanRateAlert(proc domain.Processor, w processorWindow, cfg AnomalyConfig, now time.Time) (*domain.Alert, domain.AlertType) {
+	records, unmatched := w.latest.Records, w.latest.Unmatched
+	for _, st := range w.trailing {
+		records += st.Records
+		unmatched += st.Unmatched
+	}
+	if records < cfg.MinRecords {
+		return nil, domain.AlertOrphanRate
+	}
+	rate := float64(unmatched) / float64(records)
+	if rate <= cfg.OrphanRatePct {
+		return nil, domain.AlertOrphanRate
+	}
+
+	sev := domain.SeverityMedium
+	if rate > 2*cfg.OrphanRatePct {
+		sev = domain.SeverityHigh
+	}
+	return &domain.Alert{
+		ID:        fmt.Sprintf("ALERT-OR-%s-%s", proc, w.latest.Day),
+		Type:      domain.AlertOrphanRate,
+		Processor: proc,
+		Severity:  sev,
+		Reference: w.latest.Day,
+		Message: fmt.Sprintf(
+			"%.1f%% of %s settlement records in the %d days to %s match no transaction (%d of %d; threshold %.1f%%)",
+			rate*100, proc, cfg.TrailingDays+1, w.latest.Day, unmatched, records, cfg.OrphanRatePct*100),
+		CreatedAt: now,
+	}, domain.AlertOrphanRate
+}
+
+// resolveOpenAlerts resolves every open alert of one type for a processor.
+func (s *Service) resolveOpenAlerts(alertType domain.AlertType, proc string, at time.Time) error {
+	open, _, err := s.alertRepo.List(repository.AlertFilter{
+		Type: string(alertType), Processor: proc, Status: "open", Limit: 1000,
+	})
+	if err != nil {
+		return fmt.Errorf("list open alerts: %w", err)
+	}
+	for _, a := range open {
+		if err := s.alertRepo.Resolve(a.ID, at); err != nil {
+			return fmt.Errorf("resolve alert: %w", err)
+		}
+	}
+	return nil
+}
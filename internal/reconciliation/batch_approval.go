@@ -0,0 +1,201 @@
+package reconciliation
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/wakala/reconciler/internal/domain"
+	"github.com/wakala/reconciler/internal/repository"
+)
+
+// BatchApprovalRule is when a processor's batch needs approval before the
+// transactions it matches are settled: once it has MinRecords records or
+// MinUSD in gross USD. A zero limit is not checked.
+type BatchApprovalRule struct {
+	MinRecords int     `json:"min_records,omitempty"`
+	MinUSD     float64 `json:"min_usd,omitempty"`
+}
+
+// BatchApprovalRules are the rules by processor. Batches of processors
+// without one never need approval.
+type BatchApprovalRules map[domain.Processor]BatchApprovalRule
+
+// needsApproval reports whether a batch of count records and usd gross
+// reaches the rule.
+func (r BatchApprovalRule) needsApproval(count int, usd float64) bool {
+	return (r.MinRecords > 0 && count >= r.MinRecords) || (r.MinUSD > 0 && usd >= r.MinUSD)
+}
+
+// BatchApprovalRulesFromEnv reads BATCH_APPROVAL_MIN_RECORDS and
+// BATCH_APPROVAL_MIN_USD, each per processor, e.g. afripay=1000,capepay=500.
+// Neither is set by default, so no batch needs approval.
+func BatchApprovalRulesFromEnv() (BatchApprovalRules, error) {
+	rules := BatchApprovalRules{}
+	parse := func(name string, set func(r *BatchApprovalRule, v string) error) error {
+		v := os.Getenv(name)
+		if v == "" {
+			return nil
+		}
+		for _, entry := range strings.Split(v, ",") {
+			proc, limit, ok := strings.Cut(strings.TrimSpace(entry), "=")
+			proc = strings.TrimSpace(proc)
+			if !ok || proc == "" {
+				return fmt.Errorf("invalid %s entry %q", name, entry)
+			}
+			rule := rules[domain.Processor(proc)]
+			if err := set(&rule, strings.TrimSpace(limit)); err != nil {
+				return fmt.Errorf("%s %s: %w", name, proc, err)
+			}
+			rules[domain.Processor(proc)] = rule
+		}
+		return nil
+	}
+
+	err := parse("BATCH_APPROVAL_MIN_RECORDS", func(r *BatchApprovalRule, v string) error {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return fmt.Errorf("must be a positive number of records, got %q", v)
+		}
+		r.MinRecords = n
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = parse("BATCH_APPROVAL_MIN_USD", func(r *BatchApprovalRule, v string) error {
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil || f <= 0 {
+			return fmt.Errorf("must be a positive amount, got %q", v)
+		}
+		r.MinUSD = f
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
+// SetBatchApprovalRules replaces the batch approval rules.
+func (s *Service) SetBatchApprovalRules(rules BatchApprovalRules) {
+	s.approvals = rules
+}
+
+// holdForApproval reports whether the transaction rec matched must wait
+// for rec's batch to be approved: the batch's approval is pending, or the
+// batch has reached the processor's rule and has not been approved. It
+// requests the approval, or refreshes its totals, when it holds. The caller
+// holds runMu.
+func (s *Service) holdForApproval(tx *repository.Tx, rec domain.SettlementRecord) (bool, error) {
+	a, err := tx.BatchApprovals.Get(string(rec.Processor), rec.BatchID)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return false, fmt.Errorf("get approval of %s/%s: %w", rec.Processor, rec.BatchID, err)
+	}
+	if a != nil && a.Status == domain.BatchApprovalApproved {
+		return false, nil
+	}
+	rule, ok := s.approvals[rec.Processor]
+	if a == nil && !ok {
+		return false, nil
+	}
+
+	count, usd, err := tx.Settlements.GetBatchTotals(string(rec.Processor), rec.BatchID)
+	if err != nil {
+		return false, fmt.Errorf("batch totals of %s/%s: %w", rec.Processor, rec.BatchID, err)
+	}
+	if a == nil && !rule.needsApproval(count, usd) {
+		return false, nil
+	}
+	if a == nil {
+		log.Printf("[reconciliation] Batch %s/%s (%d records, %.2f USD) needs approval before settling",
+			rec.Processor, rec.BatchID, count, usd)
+	}
+	err = tx.BatchApprovals.Request(&domain.BatchApproval{
+		Processor:      rec.Processor,
+		BatchID:        rec.BatchID,
+		RecordCount:    count,
+		USDGrossAmount: usd,
+		RequestedAt:    s.clock.Now(),
+	})
+	if err != nil {
+		return false, fmt.Errorf("request approval of %s/%s: %w", rec.Processor, rec.BatchID, err)
+	}
+	return true, nil
+}
+
+// BatchApprovals returns the batch approvals with status, or all when it is
+// empty, and the rules by which they are requested.
+func (s *Service) BatchApprovals(status domain.BatchApprovalStatus) ([]domain.BatchApproval, BatchApprovalRules, error) {
+	s.runMu.Lock()
+	rules := s.approvals
+	s.runMu.Unlock()
+
+	var approvals []domain.BatchApproval
+	err := s.uow.Run(func(tx *repository.Tx) error {
+		var err error
+		approvals, err = tx.BatchApprovals.List(status)
+		return err
+	})
+	return approvals, rules, err
+}
+
+// ApproveBatch approves a batch and settles every transaction its records
+// matched that was waiting for it, on the record's settlement date, sending
+// transaction.settled for each. Records matched later settle straight away.
+// It returns sql.ErrNoRows when the batch needs no approval and
+// repository.ErrBatchApproved when it is already approved.
+func (s *Service) ApproveBatch(processor, batchID, user, note string) (*domain.BatchApproval, int, error) {
+	s.runMu.Lock()
+	defer s.runMu.Unlock()
+
+	var approval *domain.BatchApproval
+	var settled []Match
+	err := s.uow.Run(func(tx *repository.Tx) error {
+		if err := tx.BatchApprovals.Approve(processor, batchID, user, note, s.clock.Now()); err != nil {
+			return err
+		}
+		records, err := tx.Settlements.GetBatchMatchedRecords(processor, batchID)
+		if err != nil {
+			return fmt.Errorf("get batch records: %w", err)
+		}
+		var ids []string
+		for _, rec := range records {
+			txn, err := tx.Transactions.GetByID(rec.WakalaTransactionID)
+			if err != nil {
+				return fmt.Errorf("get transaction %s: %w", rec.WakalaTransactionID, err)
+			}
+			if txn.Status != domain.StatusPendingConfirmation {
+				continue
+			}
+			if err := tx.Transactions.UpdateStatusToSettled(txn.ID, rec.SettlementDate); err != nil {
+				return fmt.Errorf("settle %s: %w", txn.ID, err)
+			}
+			settledAt := rec.SettlementDate
+			txn.Status = domain.StatusSettled
+			txn.SettledAt = &settledAt
+			settled = append(settled, Match{Transaction: txn, Record: rec})
+			ids = append(ids, txn.ID)
+		}
+		if len(ids) > 0 {
+			if err := tx.Transactions.RefreshReconciliationStatus(ids...); err != nil {
+				return fmt.Errorf("refresh reconciliation status: %w", err)
+			}
+		}
+		if approval, err = tx.BatchApprovals.Get(processor, batchID); err != nil {
+			return err
+		}
+		return s.captureHistory(tx)
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+
+	log.Printf("[reconciliation] Batch %s/%s approved by %s: %d transactions settled", processor, batchID, user, len(settled))
+	s.notifySettled(settled)
+	return approval, len(settled), nil
+}
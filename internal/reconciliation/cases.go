@@ -0,0 +1,355 @@
+package reconciliation
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/wakala/reconciler/internal/domain"
+	"github.com/wakala/reconciler/internal/repository"
+)
+
+// groupingActor is who the activity log records automatic grouping as.
+const groupingActor = "grouping"
+
+var (
+	// ErrCaseResolved is returned for a change to a resolved case, or to a
+	// discrepancy in one; the case must be reopened first.
+	ErrCaseResolved = errors.New("case is resolved")
+	// ErrCaseNotResolved is returned for reopening a case that is open.
+	ErrCaseNotResolved = errors.New("case is not resolved")
+	// ErrUnknownDiscrepancy is returned for grouping a discrepancy that is
+	// not currently raised.
+	ErrUnknownDiscrepancy = errors.New("discrepancy not found")
+)
+
+// CaseGroupingConfig sets when discrepancies are grouped into cases
+// automatically.
+type CaseGroupingConfig struct {
+	// MinSize is the fewest ungrouped discrepancies sharing a batch, or a
+	// merchant and type, that open a case. 0 turns grouping off.
+	MinSize int `json:"min_size"`
+}
+
+// DefaultCaseGrouping opens a case for 5 or more discrepancies sharing a
+// cause.
+func DefaultCaseGrouping() CaseGroupingConfig {
+	return CaseGroupingConfig{MinSize: 5}
+}
+
+// CaseGroupingFromEnv reads CASE_AUTO_GROUP_MIN (default 5, 0 for off).
+func CaseGroupingFromEnv() (CaseGroupingConfig, error) {
+	cfg := DefaultCaseGrouping()
+	if v := os.Getenv("CASE_AUTO_GROUP_MIN"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 || n == 1 {
+			return cfg, fmt.Errorf("CASE_AUTO_GROUP_MIN must be 0 (off) or at least 2, got %q", v)
+		}
+		cfg.MinSize = n
+	}
+	return cfg, nil
+}
+
+// SetCaseGrouping replaces the grouping rules, from the next run on.
+func (s *Service) SetCaseGrouping(cfg CaseGroupingConfig) {
+	s.runMu.Lock()
+	defer s.runMu.Unlock()
+	s.cases = cfg
+}
+
+// CaseGroup is what a discrepancy shares with the others of its automatic
+// case: its batch, or, without one, its merchant and type. It returns ""
+// for a discrepancy with neither.
+func CaseGroup(d *domain.Discrepancy) (key, title string) {
+	switch {
+	case d.BatchID != "":
+		return "batch:" + string(d.Processor) + ":" + d.BatchID,
+			fmt.Sprintf("%s batch %s", d.Processor, d.BatchID)
+	case d.MerchantID != "":
+		return "merchant:" + string(d.Processor) + ":" + d.MerchantID + ":" + string(d.Type),
+			fmt.Sprintf("%s for merchant %s on %s", d.Type, d.MerchantID, d.Processor)
+	}
+	return "", ""
+}
+
+// groupNew puts each discrepancy in no case into the open automatic case of
+// its group, and opens a case for each group of at least MinSize
+// discrepancies without one. A discrepancy taken out of a case by hand is
+// left alone. The caller holds runMu.
+func (s *Service) groupNew(tx *repository.Tx) (int, error) {
+	if s.cases.MinSize == 0 {
+		return 0, nil
+	}
+	discs, err := tx.Cases.ListUngrouped()
+	if err != nil {
+		return 0, fmt.Errorf("get ungrouped discrepancies: %w", err)
+	}
+	if len(discs) == 0 {
+		return 0, nil
+	}
+	open, err := tx.Cases.OpenGroups()
+	if err != nil {
+		return 0, fmt.Errorf("get open cases: %w", err)
+	}
+
+	groups := map[string][]domain.Discrepancy{}
+	titles := map[string]string{}
+	for _, d := range discs {
+		if key, title := CaseGroup(&d); key != "" {
+			groups[key] = append(groups[key], d)
+			titles[key] = title
+		}
+	}
+	keys := make([]string, 0, len(groups))
+	for key := range groups {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	now := s.clock.Now().UTC().Truncate(time.Second)
+	grouped := 0
+	for _, key := range keys {
+		members := groups[key]
+		caseID, ok := open[key]
+		if !ok {
+			if len(members) < s.cases.MinSize {
+				continue
+			}
+			c := &domain.DiscrepancyCase{
+				ID: newCaseID(), Title: titles[key], GroupKey: key, CreatedBy: groupingActor, CreatedAt: now,
+			}
+			if err := tx.Cases.Create(c); err != nil {
+				return 0, fmt.Errorf("open case for %s: %w", key, err)
+			}
+			caseID = c.ID
+			log.Printf("[reconciliation] Opened case %s for %d discrepancies: %s", c.ID, len(members), c.Title)
+		}
+		for _, d := range members {
+			if err := s.addMember(tx, caseID, d.ID, groupingActor, now); err != nil {
+				return 0, err
+			}
+		}
+		grouped += len(members)
+	}
+	return grouped, nil
+}
+
+// CreateCase opens a case by hand with the given discrepancies, taking them
+// out of any case they were in. It returns ErrUnknownDiscrepancy for a
+// discrepancy not currently raised and ErrCaseResolved for one in a
+// resolved case.
+func (s *Service) CreateCase(title, user string, discIDs []string) (*domain.DiscrepancyCase, error) {
+	now := s.clock.Now().UTC().Truncate(time.Second)
+	c := &domain.DiscrepancyCase{ID: newCaseID(), Title: title, CreatedBy: user, CreatedAt: now}
+	err := s.uow.Run(func(tx *repository.Tx) error {
+		if err := tx.Cases.Create(c); err != nil {
+			return err
+		}
+		if err := s.addMembers(tx, c.ID, discIDs, user, now); err != nil {
+			return err
+		}
+		var err error
+		c, err = tx.Cases.Get(c.ID)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("[reconciliation] Case %s opened by %s with %d discrepancies", c.ID, user, len(discIDs))
+	return c, nil
+}
+
+// AddToCase moves discrepancies into an open case. It returns sql.ErrNoRows
+// when there is no such case, ErrCaseResolved when it or a discrepancy's
+// current case is resolved, and ErrUnknownDiscrepancy for a discrepancy not
+// currently raised.
+func (s *Service) AddToCase(caseID, user string, discIDs []string) (*domain.DiscrepancyCase, error) {
+	now := s.clock.Now().UTC().Truncate(time.Second)
+	var c *domain.DiscrepancyCase
+	err := s.uow.Run(func(tx *repository.Tx) error {
+		var err error
+		if c, err = tx.Cases.Get(caseID); err != nil {
+			return err
+		}
+		if c.Status == domain.CaseResolved {
+			return ErrCaseResolved
+		}
+		if err := s.addMembers(tx, caseID, discIDs, user, now); err != nil {
+			return err
+		}
+		c, err = tx.Cases.Get(caseID)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// RemoveFromCase takes a discrepancy out of an open case; it is then not
+// grouped automatically again. It returns sql.ErrNoRows when the
+// discrepancy is not in the case and ErrCaseResolved when the case is
+// resolved.
+func (s *Service) RemoveFromCase(caseID, discID, user string) error {
+	now := s.clock.Now().UTC().Truncate(time.Second)
+	return s.uow.Run(func(tx *repository.Tx) error {
+		c, err := tx.Cases.Get(caseID)
+		if err != nil {
+			return err
+		}
+		if c.Status == domain.CaseResolved {
+			return ErrCaseResolved
+		}
+		if err := tx.Cases.RemoveMember(caseID, discID, user, now); err != nil {
+			return err
+		}
+		return tx.Discrepancies.AddActivity(&domain.DiscrepancyActivity{
+			DiscrepancyID: discID, At: now, Actor: user, Action: domain.ActivityCaseRemoved, From: caseID,
+		})
+	})
+}
+
+// ResolveCase resolves a case and, through it, each of its discrepancies
+// not already resolved otherwise, recording each in its activity log. It
+// returns the discrepancies it resolved, sql.ErrNoRows when there is no
+// such case, and ErrCaseResolved when it is resolved already.
+func (s *Service) ResolveCase(caseID, user, note string) (*domain.DiscrepancyCase, []string, error) {
+	now := s.clock.Now().UTC().Truncate(time.Second)
+	var c *domain.DiscrepancyCase
+	var resolved []string
+	err := s.uow.Run(func(tx *repository.Tx) error {
+		var err error
+		if c, err = tx.Cases.Get(caseID); err != nil {
+			return err
+		}
+		if c.Status == domain.CaseResolved {
+			return ErrCaseResolved
+		}
+		if err := tx.Cases.SetResolved(caseID, user, &now, note); err != nil {
+			return err
+		}
+		resolved, err = tx.Cases.ResolveMembers(caseID, &domain.DiscrepancyResolution{
+			Source: "case", Reference: caseID, Status: string(domain.CaseResolved), ResolvedBy: user, ResolvedAt: now,
+		})
+		if err != nil {
+			return err
+		}
+		for _, id := range resolved {
+			if err := tx.Discrepancies.AddActivity(&domain.DiscrepancyActivity{
+				DiscrepancyID: id, At: now, Actor: user, Action: domain.ActivityResolved, To: "case:" + caseID,
+			}); err != nil {
+				return err
+			}
+		}
+		c, err = tx.Cases.Get(caseID)
+		return err
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	log.Printf("[reconciliation] Case %s resolved by %s: %d discrepancies resolved", caseID, user, len(resolved))
+	return c, resolved, nil
+}
+
+// ReopenCase reopens a resolved case and withdraws the resolutions it gave
+// its discrepancies. It returns those discrepancies, sql.ErrNoRows when
+// there is no such case, and ErrCaseNotResolved when it is open.
+func (s *Service) ReopenCase(caseID, user string) (*domain.DiscrepancyCase, []string, error) {
+	now := s.clock.Now().UTC().Truncate(time.Second)
+	var c *domain.DiscrepancyCase
+	var reopened []string
+	err := s.uow.Run(func(tx *repository.Tx) error {
+		var err error
+		if c, err = tx.Cases.Get(caseID); err != nil {
+			return err
+		}
+		if c.Status != domain.CaseResolved {
+			return ErrCaseNotResolved
+		}
+		if err := tx.Cases.SetResolved(caseID, "", nil, ""); err != nil {
+			return err
+		}
+		if reopened, err = tx.Cases.UnresolveMembers(caseID); err != nil {
+			return err
+		}
+		for _, id := range reopened {
+			if err := tx.Discrepancies.AddActivity(&domain.DiscrepancyActivity{
+				DiscrepancyID: id, At: now, Actor: user, Action: domain.ActivityReopened, From: "case:" + caseID,
+			}); err != nil {
+				return err
+			}
+		}
+		c, err = tx.Cases.Get(caseID)
+		return err
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	log.Printf("[reconciliation] Case %s reopened by %s: %d discrepancies reopened", caseID, user, len(reopened))
+	return c, reopened, nil
+}
+
+// addMembers checks that each discrepancy is raised and not in a resolved
+// case, then adds them all.
+func (s *Service) addMembers(tx *repository.Tx, caseID string, discIDs []string, user string, at time.Time) error {
+	for _, id := range discIDs {
+		exists, err := tx.Discrepancies.Exists(id)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return fmt.Errorf("%w: %s", ErrUnknownDiscrepancy, id)
+		}
+		if err := s.addMember(tx, caseID, id, user, at); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addMember adds one discrepancy to a case and logs it in its activity. A
+// discrepancy in a resolved case fails the unit of work with
+// ErrCaseResolved.
+func (s *Service) addMember(tx *repository.Tx, caseID, discID, actor string, at time.Time) error {
+	prev, err := tx.Cases.AddMember(caseID, discID, actor, at)
+	if err != nil {
+		return fmt.Errorf("add %s to %s: %w", discID, caseID, err)
+	}
+	if prev == caseID {
+		return nil
+	}
+	if prev != "" {
+		pc, err := tx.Cases.Get(prev)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return err
+		}
+		if pc != nil && pc.Status == domain.CaseResolved {
+			return fmt.Errorf("%w: %s is in case %s", ErrCaseResolved, discID, prev)
+		}
+	}
+	return tx.Discrepancies.AddActivity(&domain.DiscrepancyActivity{
+		DiscrepancyID: discID, At: at, Actor: actor, Action: domain.ActivityCaseAdded, From: prev, To: caseID,
+	})
+}
+
+// lastCaseID keeps case IDs unique when several are opened in the same
+// nanosecond.
+var lastCaseID atomic.Int64
+
+func newCaseID() string {
+	for {
+		last, n := lastCaseID.Load(), time.Now().UnixNano()
+		if n <= last {
+			n = last + 1
+		}
+		if lastCaseID.CompareAndSwap(last, n) {
+			return fmt.Sprintf("CASE-%d", n)
+		}
+	}
+}
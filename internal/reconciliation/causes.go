@@ -0,0 +1,275 @@
+package reconciliation
+
+import (
+	"errors"
+	"fmt"
+	"math"
+
+	"github.com/wakala/reconciler/internal/domain"
+	"github.com/wakala/reconciler/internal/repository"
+)
+
+const (
+	// causeToleranceUSD and causeTolerancePct bound how far apart two
+	// amounts may be and still be taken as equal, the larger applying: a
+	// cent of rounding on each side, or 0.1% of the expected amount.
+	causeToleranceUSD = 0.02
+	causeTolerancePct = 0.001
+	// feeRateTolerance is how far, in fractions of the amount, a difference
+	// may be from the processor's fee rate.
+	feeRateTolerance = 0.001
+	// minFeeRateRecords is the fewest matched records a processor's fee rate
+	// is judged from.
+	minFeeRateRecords = 5
+	// maxFXSpread is the largest relative gap between two conversion rates
+	// of one amount that is taken as a rate difference rather than an error.
+	maxFXSpread = 0.10
+)
+
+// ErrNotInvestigable is returned by Investigate for a discrepancy that is
+// not an amount mismatch.
+var ErrNotInvestigable = errors.New("only AMOUNT_MISMATCH discrepancies can be investigated")
+
+// Investigation is the analysis of one amount mismatch against the records
+// as they are now.
+type Investigation struct {
+	DiscrepancyID string                   `json:"discrepancy_id"`
+	Transaction   *domain.Transaction      `json:"transaction"`
+	Settlement    *domain.SettlementRecord `json:"settlement"`
+	DifferenceUSD float64                  `json:"difference_usd"`
+	// ProbableCause is the first check that fits, nil when none does. It
+	// differs from the discrepancy's own when records changed since the run
+	// that detected it.
+	ProbableCause *domain.ProbableCause `json:"probable_cause"`
+	Checks        []domain.CauseCheck   `json:"checks"`
+}
+
+// Investigate checks each known cause against an amount mismatch and its
+// records. It returns sql.ErrNoRows when the discrepancy, its transaction or
+// its settlement record does not exist, and ErrNotInvestigable for any other
+// discrepancy type.
+func (s *Service) Investigate(id string) (*Investigation, error) {
+	var inv *Investigation
+	err := s.uow.Run(func(tx *repository.Tx) error {
+		d, err := tx.Discrepancies.GetByID(id)
+		if err != nil {
+			return err
+		}
+		if d.Type != domain.DiscrepancyAmountMismatch {
+			return ErrNotInvestigable
+		}
+		txn, err := tx.Transactions.GetByID(d.TransactionID)
+		if err != nil {
+			return err
+		}
+		rec, err := tx.Settlements.GetRecord(d.SettlementID)
+		if err != nil {
+			return err
+		}
+		matched, err := tx.Settlements.GetMatchedRecords()
+		if err != nil {
+			return fmt.Errorf("get matched: %w", err)
+		}
+		causes, err := newCauseAnalyzer(tx, matched)
+		if err != nil {
+			return err
+		}
+		checks := causes.checks(txn, rec)
+		inv = &Investigation{
+			DiscrepancyID: d.ID,
+			Transaction:   txn,
+			Settlement:    rec,
+			DifferenceUSD: rec.USDGrossAmount - txn.USDAmount,
+			ProbableCause: probableCause(checks),
+			Checks:        checks,
+		}
+		return nil
+	})
+	return inv, err
+}
+
+// causeAnalyzer explains amount mismatches from the records around them.
+type causeAnalyzer struct {
+	// feeRates are each processor's fees over gross across its matched
+	// records, for processors with enough of them. Tax withheld on the fees
+	// is not a fee.
+	feeRates map[domain.Processor]feeRate
+	refunds  map[domain.Processor][]domain.SettlementRecord
+}
+
+type feeRate struct {
+	rate    float64
+	records int
+}
+
+// newCauseAnalyzer reads the refunds and derives the processors' fee rates
+// from matched, their matched settlement records.
+func newCauseAnalyzer(tx *repository.Tx, matched []domain.SettlementRecord) (*causeAnalyzer, error) {
+	refunds, err := tx.Settlements.GetRefundRecords()
+	if err != nil {
+		return nil, fmt.Errorf("get refunds: %w", err)
+	}
+	taxes, err := tx.Settlements.GetTaxAmounts()
+	if err != nil {
+		return nil, fmt.Errorf("get taxes: %w", err)
+	}
+	a := &causeAnalyzer{
+		feeRates: make(map[domain.Processor]feeRate),
+		refunds:  make(map[domain.Processor][]domain.SettlementRecord),
+	}
+	for _, rec := range refunds {
+		a.refunds[rec.Processor] = append(a.refunds[rec.Processor], rec)
+	}
+
+	type totals struct {
+		gross, fees float64
+		n           int
+	}
+	byProc := make(map[domain.Processor]*totals)
+	for _, rec := range matched {
+		t := byProc[rec.Processor]
+		if t == nil {
+			t = &totals{}
+			byProc[rec.Processor] = t
+		}
+		rec.TaxAmount = taxes[rec.ID]
+		t.gross += rec.USDGrossAmount
+		t.fees += rec.USDGrossAmount - rec.USDNetAmount - rec.USDTax()
+		t.n++
+	}
+	for proc, t := range byProc {
+		if t.n >= minFeeRateRecords && t.gross > 0 {
+			a.feeRates[proc] = feeRate{rate: t.fees / t.gross, records: t.n}
+		}
+	}
+	return a, nil
+}
+
+// checks tries each cause, in order of likelihood, against the mismatch
+// between txn and its settlement record rec.
+func (a *causeAnalyzer) checks(txn *domain.Transaction, rec *domain.SettlementRecord) []domain.CauseCheck {
+	diff := rec.USDGrossAmount - txn.USDAmount
+	return []domain.CauseCheck{
+		feeDeductedCheck(txn, rec, diff),
+		a.feeRateCheck(txn, rec, diff),
+		fxRateCheck(txn, rec),
+		a.refundCheck(txn, rec, diff),
+	}
+}
+
+// probableCause returns the first check that fits, or nil.
+func probableCause(checks []domain.CauseCheck) *domain.ProbableCause {
+	for _, c := range checks {
+		if c.Fits {
+			cause := c.ProbableCause
+			return &cause
+		}
+	}
+	return nil
+}
+
+// sameAmount reports whether two USD amounts are equal but for rounding,
+// relative to the expected amount.
+func sameAmount(a, b, expected float64) bool {
+	return math.Abs(a-b) <= math.Max(causeToleranceUSD, causeTolerancePct*math.Abs(expected))
+}
+
+// feeDeductedCheck fits a gross amount short by the record's own fee: the
+// processor reported the net amount as gross.
+func feeDeductedCheck(txn *domain.Transaction, rec *domain.SettlementRecord, diff float64) domain.CauseCheck {
+	fee := rec.USDGrossAmount - rec.USDNetAmount
+	c := domain.CauseCheck{ProbableCause: domain.ProbableCause{Cause: domain.CauseFeeDeducted}}
+	switch {
+	case fee <= 0:
+		c.Detail = "the settlement record has no fee"
+	case diff < 0 && sameAmount(-diff, fee, txn.USDAmount):
+		c.Fits = true
+		c.Detail = fmt.Sprintf("the reported gross is %.2f USD short, the record's own fee of %.2f USD: it was reported net of the fee", -diff, fee)
+	default:
+		c.Detail = fmt.Sprintf("the difference of %.2f USD is not the record's fee of %.2f USD", diff, fee)
+	}
+	return c
+}
+
+// feeRateCheck fits a difference that is the processor's usual fee rate of
+// the amount, charged or refunded once too often.
+func (a *causeAnalyzer) feeRateCheck(txn *domain.Transaction, rec *domain.SettlementRecord, diff float64) domain.CauseCheck {
+	c := domain.CauseCheck{ProbableCause: domain.ProbableCause{Cause: domain.CauseFeeRate}}
+	fr, ok := a.feeRates[rec.Processor]
+	if !ok || txn.USDAmount == 0 {
+		c.Detail = fmt.Sprintf("too few matched %s records to know its fee rate", rec.Processor)
+		return c
+	}
+	pct := math.Abs(diff) / txn.USDAmount
+	c.Fits = math.Abs(pct-fr.rate) <= feeRateTolerance
+	verb := "is not"
+	if c.Fits {
+		verb = "matches"
+	}
+	c.Detail = fmt.Sprintf("the difference of %.2f%% of the amount %s %s's fee rate of %.2f%% across %d matched records",
+		pct*100, verb, rec.Processor, fr.rate*100, fr.records)
+	return c
+}
+
+// fxRateCheck fits a record that reports the transaction's local amount but
+// converted it to USD at a different, plausible rate.
+func fxRateCheck(txn *domain.Transaction, rec *domain.SettlementRecord) domain.CauseCheck {
+	c := domain.CauseCheck{ProbableCause: domain.ProbableCause{Cause: domain.CauseFXRate}}
+	switch {
+	case txn.Currency != rec.Currency:
+		c.Detail = fmt.Sprintf("the transaction is in %s and the record in %s", txn.Currency, rec.Currency)
+		return c
+	case txn.USDAmount == 0 || rec.USDGrossAmount == 0:
+		c.Detail = "an amount is zero, so it has no conversion rate"
+		return c
+	case math.Abs(rec.GrossAmount-txn.Amount) > math.Max(0.01, causeTolerancePct*math.Abs(txn.Amount)):
+		c.Detail = fmt.Sprintf("the local amounts differ too: %.2f and %.2f %s", txn.Amount, rec.GrossAmount, txn.Currency)
+		return c
+	}
+
+	txnRate := txn.Amount / txn.USDAmount
+	recRate := rec.GrossAmount / rec.USDGrossAmount
+	spread := math.Abs(recRate-txnRate) / txnRate
+	c.Fits = spread <= maxFXSpread
+	c.Detail = fmt.Sprintf("both report %.2f %s, converted at %.4f and %.4f %s per USD (%.1f%% apart)",
+		txn.Amount, txn.Currency, txnRate, recRate, txn.Currency, spread*100)
+	if !c.Fits {
+		c.Detail += fmt.Sprintf(", more than the %.0f%% a rate difference explains", maxFXSpread*100)
+	}
+	return c
+}
+
+// refundCheck fits a gross amount short by a refund the processor reported
+// against the same reference or, failing that, in the same batch.
+func (a *causeAnalyzer) refundCheck(txn *domain.Transaction, rec *domain.SettlementRecord, diff float64) domain.CauseCheck {
+	c := domain.CauseCheck{ProbableCause: domain.ProbableCause{Cause: domain.CauseRefundOffset}}
+	if diff >= 0 {
+		c.Detail = "the reported gross is not short, so no refund was netted from it"
+		return c
+	}
+
+	var inBatch *domain.SettlementRecord
+	for i := range a.refunds[rec.Processor] {
+		ref := &a.refunds[rec.Processor][i]
+		if !sameAmount(-diff, math.Abs(ref.USDGrossAmount), txn.USDAmount) {
+			continue
+		}
+		if ref.ProcessorTransactionID == rec.ProcessorTransactionID {
+			c.Fits = true
+			c.Detail = fmt.Sprintf("refund %s of %.2f USD was reported against the same reference %s",
+				ref.ID, math.Abs(ref.USDGrossAmount), rec.ProcessorTransactionID)
+			return c
+		}
+		if inBatch == nil && ref.BatchID == rec.BatchID {
+			inBatch = ref
+		}
+	}
+	if inBatch != nil {
+		c.Fits = true
+		c.Detail = fmt.Sprintf("refund %s of %.2f USD in batch %s equals the shortfall",
+			inBatch.ID, math.Abs(inBatch.USDGrossAmount), rec.BatchID)
+		return c
+	}
+	c.Detail = fmt.Sprintf("no %s refund of %.2f USD against the reference or in batch %s", rec.Processor, -diff, rec.BatchID)
+	return c
+}
@@ -0,0 +1,155 @@
+package reconciliation
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/wakala/reconciler/internal/domain"
+	"github.com/wakala/reconciler/internal/repository"
+)
+
+// ConfigChanges counts the entries of one kind an import stored and
+// removed.
+type ConfigChanges struct {
+	Stored  int `json:"stored"`
+	Removed int `json:"removed"`
+}
+
+// ConfigImport is what ReplaceConfig changed.
+type ConfigImport struct {
+	MerchantTolerances ConfigChanges `json:"merchant_tolerances"`
+	RuleFlags          ConfigChanges `json:"rule_flags"`
+	TransformScripts   ConfigChanges `json:"transform_scripts"`
+}
+
+// Config returns the merchant tolerances, rule flags and transform scripts
+// as a bundle without settings.
+func (s *Service) Config() (*domain.ConfigBundle, error) {
+	b := &domain.ConfigBundle{Version: domain.ConfigBundleVersion}
+	err := s.uow.Run(func(tx *repository.Tx) error {
+		var err error
+		if b.MerchantTolerances, err = tx.Tolerances.List(); err != nil {
+			return fmt.Errorf("list merchant tolerances: %w", err)
+		}
+		if b.RuleFlags, err = tx.RuleFlags.List(); err != nil {
+			return fmt.Errorf("list rule flags: %w", err)
+		}
+		if b.TransformScripts, err = tx.Transforms.List(); err != nil {
+			return fmt.Errorf("list transform scripts: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if b.MerchantTolerances == nil {
+		b.MerchantTolerances = []domain.MerchantTolerance{}
+	}
+	if b.RuleFlags == nil {
+		b.RuleFlags = []domain.RuleFlag{}
+	}
+	if b.TransformScripts == nil {
+		b.TransformScripts = []domain.TransformScript{}
+	}
+	return b, nil
+}
+
+// ReplaceConfig makes the merchant tolerances, rule flags and transform
+// scripts those of b, in one transaction: entries b has are stored as by
+// user at at, and the others removed. A transform script whose steps are
+// unchanged keeps its version. b must have been validated. It waits for
+// the run in progress, if any, so that no run sees part of the new
+// configuration.
+func (s *Service) ReplaceConfig(b *domain.ConfigBundle, user string, at time.Time) (*ConfigImport, error) {
+	s.runMu.Lock()
+	defer s.runMu.Unlock()
+
+	res := &ConfigImport{}
+	err := s.uow.Run(func(tx *repository.Tx) error {
+		tols, err := tx.Tolerances.List()
+		if err != nil {
+			return fmt.Errorf("list merchant tolerances: %w", err)
+		}
+		keep := make(map[string]bool, len(b.MerchantTolerances))
+		for _, t := range b.MerchantTolerances {
+			t.UpdatedAt = at
+			if err := tx.Tolerances.Upsert(&t); err != nil {
+				return fmt.Errorf("store tolerance of %s: %w", t.MerchantID, err)
+			}
+			keep[t.MerchantID] = true
+			res.MerchantTolerances.Stored++
+		}
+		for _, t := range tols {
+			if keep[t.MerchantID] {
+				continue
+			}
+			if err := tx.Tolerances.Delete(t.MerchantID); err != nil {
+				return fmt.Errorf("remove tolerance of %s: %w", t.MerchantID, err)
+			}
+			res.MerchantTolerances.Removed++
+		}
+
+		flags, err := tx.RuleFlags.List()
+		if err != nil {
+			return fmt.Errorf("list rule flags: %w", err)
+		}
+		keepFlags := make(map[string]bool, len(b.RuleFlags))
+		for _, f := range b.RuleFlags {
+			f.UpdatedBy, f.UpdatedAt = user, at
+			if err := tx.RuleFlags.Upsert(&f); err != nil {
+				return fmt.Errorf("store flag of %s: %w", f.Rule, err)
+			}
+			keepFlags[f.Rule+"|"+string(f.Processor)] = true
+			res.RuleFlags.Stored++
+		}
+		for _, f := range flags {
+			if keepFlags[f.Rule+"|"+string(f.Processor)] {
+				continue
+			}
+			if err := tx.RuleFlags.Delete(f.Rule, f.Processor); err != nil {
+				return fmt.Errorf("remove flag of %s: %w", f.Rule, err)
+			}
+			res.RuleFlags.Removed++
+		}
+
+		scripts, err := tx.Transforms.List()
+		if err != nil {
+			return fmt.Errorf("list transform scripts: %w", err)
+		}
+		current := make(map[domain.Processor]domain.TransformScript, len(scripts))
+		for _, sc := range scripts {
+			current[sc.Processor] = sc
+		}
+		for _, sc := range b.TransformScripts {
+			prev, ok := current[sc.Processor]
+			delete(current, sc.Processor)
+			if ok && sameSteps(prev.Steps, sc.Steps) {
+				continue
+			}
+			sc.UpdatedBy, sc.UpdatedAt = user, at
+			if err := tx.Transforms.Upsert(&sc); err != nil {
+				return fmt.Errorf("store transform script of %s: %w", sc.Processor, err)
+			}
+			res.TransformScripts.Stored++
+		}
+		for proc := range current {
+			if err := tx.Transforms.Delete(proc); err != nil {
+				return fmt.Errorf("remove transform script of %s: %w", proc, err)
+			}
+			res.TransformScripts.Removed++
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// sameSteps reports whether two transform scripts do the same.
+func sameSteps(a, b []domain.TransformStep) bool {
+	x, errA := json.Marshal(a)
+	y, errB := json.Marshal(b)
+	return errA == nil && errB == nil && string(x) == string(y)
+}
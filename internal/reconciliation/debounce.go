@@ -0,0 +1,125 @@
+package reconciliation
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"time"
+)
+
+// DebounceFromEnv reads RECONCILE_DEBOUNCE, a Go duration such as "30s".
+// Unset or "0" disables debouncing: every ingest reconciles immediately.
+func DebounceFromEnv() (time.Duration, error) {
+	v := os.Getenv("RECONCILE_DEBOUNCE")
+	if v == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("RECONCILE_DEBOUNCE must be a non-negative duration, got %q", v)
+	}
+	return d, nil
+}
+
+// DeferredRun describes the reconciliation run waiting for ingestion to go
+// quiet. RequestedAt is the first request since the last run and DueAt is
+// when the run starts unless another request pushes it back.
+type DeferredRun struct {
+	Debounce    string     `json:"debounce"`
+	Pending     bool       `json:"pending"`
+	Requests    int        `json:"requests,omitempty"`
+	RequestedAt *time.Time `json:"requested_at,omitempty"`
+	DueAt       *time.Time `json:"due_at,omitempty"`
+}
+
+// SetDebounce makes RequestRun wait for d without further requests before
+// reconciling. Zero, the default, turns debouncing off.
+func (s *Service) SetDebounce(d time.Duration) {
+	s.debounceMu.Lock()
+	defer s.debounceMu.Unlock()
+	s.debounce = d
+}
+
+// RequestRun schedules a full reconciliation once d has passed without
+// another request, so consecutive ingests share one run. It returns false,
+// scheduling nothing, when debouncing is off; the caller then reconciles
+// itself.
+func (s *Service) RequestRun() bool {
+	s.debounceMu.Lock()
+	defer s.debounceMu.Unlock()
+	if s.debounce <= 0 {
+		return false
+	}
+
+	now := time.Now().UTC()
+	if s.pendingSince == nil {
+		s.pendingSince = &now
+	}
+	s.pendingRequests++
+	s.pendingDue = now.Add(s.debounce)
+	if s.debounceTimer == nil {
+		s.debounceTimer = time.AfterFunc(s.debounce, s.runDeferred)
+	} else {
+		s.debounceTimer.Reset(s.debounce)
+	}
+	return true
+}
+
+// Deferred returns the state of the debounced run.
+func (s *Service) Deferred() DeferredRun {
+	s.debounceMu.Lock()
+	defer s.debounceMu.Unlock()
+	d := DeferredRun{Debounce: s.debounce.String(), Pending: s.pendingSince != nil}
+	if d.Pending {
+		since, due := *s.pendingSince, s.pendingDue
+		d.Requests = s.pendingRequests
+		d.RequestedAt = &since
+		d.DueAt = &due
+	}
+	return d
+}
+
+// FlushDeferred runs the pending reconciliation now instead of waiting for
+// the quiet period. It returns nil when nothing is pending.
+func (s *Service) FlushDeferred() (*ReconciliationResult, error) {
+	s.debounceMu.Lock()
+	pending := s.pendingSince != nil
+	s.debounceMu.Unlock()
+	if !pending {
+		return nil, nil
+	}
+	return s.RunFullReconciliation()
+}
+
+func (s *Service) runDeferred() {
+	s.debounceMu.Lock()
+	requests := s.pendingRequests
+	pending := s.pendingSince != nil
+	s.debounceMu.Unlock()
+	if !pending {
+		return
+	}
+
+	result, err := s.RunFullReconciliation()
+	if err != nil {
+		log.Printf("[reconciliation] WARNING: deferred run failed: %v", err)
+		return
+	}
+	log.Printf("[reconciliation] Deferred run for %d requests: %d discrepancies",
+		requests, result.TotalDiscrepancies)
+}
+
+// clearDeferred drops the pending request. A live full run covers every
+// change stored before it starts, so it is called at the start of each one.
+// A run as of an earlier time does not reconcile them as of now and leaves
+// the request pending.
+func (s *Service) clearDeferred() {
+	s.debounceMu.Lock()
+	defer s.debounceMu.Unlock()
+	if s.debounceTimer != nil {
+		s.debounceTimer.Stop()
+	}
+	s.pendingSince = nil
+	s.pendingRequests = 0
+	s.pendingDue = time.Time{}
+}
@@ -0,0 +1,73 @@
+package reconciliation
+
+import (
+	"math"
+
+	"github.com/wakala/reconciler/internal/domain"
+	"github.com/wakala/reconciler/internal/live"
+)
+
+// SetLiveFeed publishes matches, the discrepancies each run opens and run
+// totals to hub, for the dashboard's live feed.
+func (s *Service) SetLiveFeed(hub *live.Hub) {
+	s.runMu.Lock()
+	defer s.runMu.Unlock()
+	s.feed = hub
+}
+
+// publishMatched sends settlement.matched for matches, pending batch
+// approval or not.
+func (s *Service) publishMatched(matches []Match) {
+	if len(matches) == 0 || !s.feed.Listening() {
+		return
+	}
+	ev := live.SettlementsMatched{Count: len(matches), Matches: []live.MatchDelta{}}
+	for _, m := range matches {
+		if len(ev.Matches) == live.MaxItems {
+			break
+		}
+		ev.Matches = append(ev.Matches, live.MatchDelta{
+			TransactionID: m.Transaction.ID,
+			SettlementID:  m.Record.ID,
+			Processor:     string(m.Record.Processor),
+			BatchID:       m.Record.BatchID,
+			USDAmount:     m.Transaction.USDAmount,
+			Pending:       m.Pending,
+		})
+	}
+	s.feed.Publish(live.EventSettlementMatched, ev)
+}
+
+// publishNew sends discrepancy.new for the discrepancies a run opened.
+func (s *Service) publishNew(discs []domain.Discrepancy) {
+	if len(discs) == 0 {
+		return
+	}
+	ev := live.DiscrepanciesNew{Count: len(discs), Discrepancies: []live.DiscrepancyDelta{}}
+	for _, d := range discs {
+		ev.ImpactUSD += math.Abs(d.DifferenceUSD)
+		if len(ev.Discrepancies) == live.MaxItems {
+			continue
+		}
+		ev.Discrepancies = append(ev.Discrepancies, live.DiscrepancyDelta{
+			ID:            d.ID,
+			Type:          string(d.Type),
+			Severity:      string(d.Severity),
+			Processor:     string(d.Processor),
+			MerchantID:    d.MerchantID,
+			DifferenceUSD: d.DifferenceUSD,
+		})
+	}
+	s.feed.Publish(live.EventDiscrepancyNew, ev)
+}
+
+// publishRun sends reconciliation.completed with a run's totals.
+func (s *Service) publishRun(result *ReconciliationResult) {
+	s.feed.Publish(live.EventReconciliationCompleted, live.ReconciliationCompleted{
+		Matched:            result.MatchedCount,
+		TotalDiscrepancies: result.TotalDiscrepancies,
+		Opened:             result.Opened,
+		Resolved:           result.Resolved,
+		Scoped:             result.Scope != nil,
+	})
+}
@@ -0,0 +1,44 @@
+package reconciliation
+
+import (
+	"fmt"
+
+	"github.com/wakala/reconciler/internal/repository"
+)
+
+// captureHistory records the figures and open discrepancies as tx leaves
+// them as today's snapshot. Every change a run or regrade makes replaces
+// the day's earlier capture, so the last of the day is what is kept. The
+// caller holds runMu.
+func (s *Service) captureHistory(tx *repository.Tx) error {
+	now := s.clock.Now().UTC()
+	if err := tx.History.Capture(now.Format("2006-01-02"), now); err != nil {
+		return fmt.Errorf("capture daily snapshot: %w", err)
+	}
+	return nil
+}
+
+// AsOf returns the snapshot of the end of day, a UTC date, and the summary
+// of the discrepancies open then, grouped by dims when there are any. It
+// returns sql.ErrNoRows when nothing was captured on or before day.
+func (s *Service) AsOf(day string, dims []string) (*repository.DailySnapshot, *repository.DiscrepancySummary, error) {
+	var snap *repository.DailySnapshot
+	var summary *repository.DiscrepancySummary
+	err := s.uow.Run(func(tx *repository.Tx) error {
+		var err error
+		if snap, err = tx.History.Latest(day); err != nil {
+			return err
+		}
+		if summary, err = tx.History.Summary(snap.Day); err != nil {
+			return fmt.Errorf("summary of %s: %w", snap.Day, err)
+		}
+		if len(dims) > 0 {
+			if summary.Groups, err = tx.History.GroupBy(snap.Day, dims...); err != nil {
+				return err
+			}
+			summary.GroupBy = dims
+		}
+		return nil
+	})
+	return snap, summary, err
+}
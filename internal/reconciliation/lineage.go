@@ -0,0 +1,363 @@
+package reconciliation
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/wakala/reconciler/internal/currency"
+	"github.com/wakala/reconciler/internal/domain"
+)
+
+// rateMatchToleranceUSD is how far a USD figure may be from its amount
+// converted at the converter's rate and still be taken as converted at it:
+// half a cent, for figures stored rounded to the cent.
+const rateMatchToleranceUSD = 0.005
+
+// lineageAmounts name the amount each USD figure converts.
+var lineageAmounts = map[string]string{
+	"usd_gross_amount": "settlement record's gross",
+	"usd_net_amount":   "settlement record's net",
+	"usd_amount":       "transaction's amount",
+}
+
+// Lineage traces a discrepancy's USD figures, or a settlement record's,
+// back to where they came from: the report and line the record was read
+// from, the record as parsed and corrected since, the FX rates its amounts
+// were converted at, the transaction it was compared with and the rule it
+// was compared under. Explanation tells the same chain in sentences.
+type Lineage struct {
+	DiscrepancyID string                        `json:"discrepancy_id,omitempty"`
+	Source        *LineageSource                `json:"source,omitempty"`
+	Record        *domain.SettlementRecord      `json:"record,omitempty"`
+	Corrections   []domain.SettlementCorrection `json:"corrections,omitempty"`
+	FX            []LineageRate                 `json:"fx"`
+	Transaction   *domain.Transaction           `json:"transaction,omitempty"`
+	Comparison    *LineageComparison            `json:"comparison,omitempty"`
+	Explanation   []string                      `json:"explanation"`
+}
+
+// LineageSource is the report a settlement record was read from and where
+// in it. Line is the line of a CSV report, Entry the index of the entry of
+// a JSON report; Text is the line itself when the report's file is kept and
+// the line still names the record's transaction.
+type LineageSource struct {
+	Report       *domain.SettlementReport   `json:"report"`
+	File         *domain.ReportFile         `json:"file,omitempty"`
+	Provenance   *domain.ReportProvenance   `json:"provenance,omitempty"`
+	Verification *domain.ReportVerification `json:"verification,omitempty"`
+	Line         int                        `json:"line,omitempty"`
+	Entry        *int                       `json:"entry,omitempty"`
+	Text         string                     `json:"text,omitempty"`
+}
+
+// LineageRate is the rate one USD figure was converted at, worked out from
+// the stored amounts, beside the rate the converter has in effect on its
+// date now. Source is "history" for a rate history entry, effective from
+// EffectiveFrom, or "static". Matches is false when the two differ, such as
+// when rate history was loaded after the figure was converted.
+type LineageRate struct {
+	Of            string  `json:"of"`
+	Field         string  `json:"field"`
+	Currency      string  `json:"currency"`
+	Amount        float64 `json:"amount"`
+	USD           float64 `json:"usd"`
+	UnitsPerUSD   float64 `json:"units_per_usd"`
+	RateDate      string  `json:"rate_date"`
+	RateInEffect  float64 `json:"rate_in_effect"`
+	Source        string  `json:"source"`
+	EffectiveFrom string  `json:"effective_from,omitempty"`
+	Matches       bool    `json:"matches"`
+}
+
+// LineageComparison is the check that raised a discrepancy: Rule says what
+// was compared with what, and Policy is the rule set, with its version, in
+// force when it was detected.
+type LineageComparison struct {
+	Type          domain.DiscrepancyType       `json:"type"`
+	Rule          string                       `json:"rule"`
+	ExpectedUSD   float64                      `json:"expected_usd"`
+	ActualUSD     float64                      `json:"actual_usd"`
+	DifferenceUSD float64                      `json:"difference_usd"`
+	Policy        *domain.ReconciliationPolicy `json:"policy,omitempty"`
+	Description   string                       `json:"description"`
+}
+
+// comparisonRules say what each discrepancy type compares.
+var comparisonRules = map[domain.DiscrepancyType]string{
+	domain.DiscrepancyMissingSettlement: "the transaction's USD amount, with no settlement record reported within the settlement window",
+	domain.DiscrepancyAmountMismatch:    "the settlement record's gross USD against the transaction's USD amount, beyond both the percentage and the absolute tolerance",
+	domain.DiscrepancyOrphaned:          "the settlement record's net USD, with no transaction it matches",
+	domain.DiscrepancyMissingPayout:     "the payout instruction's USD amount, with no disbursement reported",
+	domain.DiscrepancyOverpaid:          "the disbursement's gross USD above the payout instruction's USD amount",
+}
+
+// DiscrepancyLineage returns the lineage of a discrepancy's figures. It
+// returns sql.ErrNoRows when there is no such discrepancy; a transaction or
+// settlement record since deleted is left out.
+func (s *Service) DiscrepancyLineage(id string) (*Lineage, error) {
+	d, err := s.discRepo.GetByID(id)
+	if err != nil {
+		return nil, err
+	}
+	l := &Lineage{DiscrepancyID: d.ID, FX: []LineageRate{}}
+
+	field := "usd_gross_amount"
+	if d.Type == domain.DiscrepancyOrphaned {
+		field = "usd_net_amount"
+	}
+	if d.SettlementID != "" {
+		if err := s.traceRecord(l, d.SettlementID, field); err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return nil, err
+		}
+	}
+	if d.TransactionID != "" {
+		if err := s.traceTransaction(l, d.TransactionID); err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return nil, err
+		}
+	}
+
+	l.Comparison = &LineageComparison{
+		Type:          d.Type,
+		Rule:          comparisonRules[d.Type],
+		ExpectedUSD:   d.ExpectedUSD,
+		ActualUSD:     d.ActualUSD,
+		DifferenceUSD: d.DifferenceUSD,
+		Policy:        d.Policy,
+		Description:   d.Description,
+	}
+	l.Explanation = append(l.Explanation, explainComparison(l.Comparison))
+	return l, nil
+}
+
+// RecordLineage returns the lineage of a settlement record's USD figures,
+// with the transaction it is matched to. It returns sql.ErrNoRows when there
+// is no such record.
+func (s *Service) RecordLineage(id string) (*Lineage, error) {
+	l := &Lineage{FX: []LineageRate{}}
+	if err := s.traceRecord(l, id, "usd_gross_amount"); err != nil {
+		return nil, err
+	}
+	if l.Record.WakalaTransactionID != "" {
+		if err := s.traceTransaction(l, l.Record.WakalaTransactionID); err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return nil, err
+		}
+	}
+	return l, nil
+}
+
+// traceRecord adds a settlement record, its source and corrections, and the
+// rate of its USD figure field to l.
+func (s *Service) traceRecord(l *Lineage, id, field string) error {
+	rec, err := s.settRepo.GetRecord(id)
+	if err != nil {
+		return err
+	}
+	l.Record = rec
+
+	src, err := s.recordSource(rec)
+	if err != nil {
+		return err
+	}
+	l.Source = src
+	if src != nil {
+		l.Explanation = append(l.Explanation, explainSource(src))
+	}
+	l.Explanation = append(l.Explanation, fmt.Sprintf(
+		"Settlement record %s reads gross %.2f, fee %.2f, net %.2f %s, settled %s.",
+		rec.ID, rec.GrossAmount, rec.FeeAmount, rec.NetAmount, rec.Currency, rec.SettlementDate.Format("2006-01-02"),
+	))
+
+	corrections, err := s.settRepo.ListCorrections(rec.ID)
+	if err != nil {
+		return fmt.Errorf("list corrections: %w", err)
+	}
+	if len(corrections) > 0 {
+		l.Corrections = corrections
+		last := corrections[len(corrections)-1]
+		l.Explanation = append(l.Explanation, fmt.Sprintf(
+			"The record was corrected %d time(s) since it was parsed, last by %s on %s: %s.",
+			len(corrections), last.UserID, last.CreatedAt.Format("2006-01-02"), last.Reason,
+		))
+	}
+
+	amount, usd := rec.GrossAmount, rec.USDGrossAmount
+	if field == "usd_net_amount" {
+		amount, usd = rec.NetAmount, rec.USDNetAmount
+	}
+	if rate, ok := lineageRate("settlement", field, rec.Currency, amount, usd, rec.SettlementDate); ok {
+		l.FX = append(l.FX, rate)
+		l.Explanation = append(l.Explanation, explainRate(rate))
+	}
+	return nil
+}
+
+// traceTransaction adds a transaction and the rate of its USD amount to l.
+func (s *Service) traceTransaction(l *Lineage, id string) error {
+	txn, err := s.txnRepo.GetByID(id)
+	if err != nil {
+		return err
+	}
+	l.Transaction = txn
+	l.Explanation = append(l.Explanation, fmt.Sprintf(
+		"Transaction %s of merchant %s is %.2f %s, %.2f USD, created %s.",
+		txn.ID, txn.MerchantID, txn.Amount, txn.Currency, txn.USDAmount, txn.CreatedAt.Format("2006-01-02"),
+	))
+	if rate, ok := lineageRate("transaction", "usd_amount", txn.Currency, txn.Amount, txn.USDAmount, txn.CreatedAt); ok {
+		l.FX = append(l.FX, rate)
+		l.Explanation = append(l.Explanation, explainRate(rate))
+	}
+	return nil
+}
+
+// recordSource returns the report a record was read from, with its file,
+// provenance and verification where they are kept, and the record's place
+// in it. It returns nil for a record whose report is gone.
+func (s *Service) recordSource(rec *domain.SettlementRecord) (*LineageSource, error) {
+	report, err := s.settRepo.GetReport(rec.ReportID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("get report: %w", err)
+	}
+	src := &LineageSource{Report: report}
+
+	if src.Provenance, err = s.settRepo.GetReportProvenance(report.ID); err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("get provenance: %w", err)
+	}
+	if src.Verification, err = s.settRepo.GetReportVerification(report.ID); err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("get verification: %w", err)
+	}
+	if src.File, err = s.settRepo.GetReportFile(report.ID); err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("get file: %w", err)
+	}
+
+	kind, n := recordLocation(rec.ID)
+	switch kind {
+	case "line":
+		src.Line = n
+		if src.File != nil {
+			src.Text = sourceLine(src.File.Data, n, rec.ProcessorTransactionID)
+		}
+	case "entry":
+		src.Entry = &n
+	}
+	return src, nil
+}
+
+// recordLocation reads where a record was in its report from its ID, which
+// the file parsers end with the CSV line or the JSON entry index. It
+// returns "" for records from elsewhere, such as webhooks and connectors.
+func recordLocation(id string) (string, int) {
+	var kind string
+	switch {
+	case strings.HasPrefix(id, "SR-AP-"), strings.HasPrefix(id, "SR-CP-"), strings.HasPrefix(id, "SR-MP-"):
+		kind = "line"
+	case strings.HasPrefix(id, "SR-NG-"):
+		kind = "entry"
+	default:
+		return "", 0
+	}
+	n, err := strconv.Atoi(id[strings.LastIndex(id, "-")+1:])
+	if err != nil || n < 0 {
+		return "", 0
+	}
+	return kind, n
+}
+
+// sourceLine returns line n of a report file, or "" when the file has no
+// such line or it does not name ref, as when a quoted field spans lines.
+func sourceLine(data []byte, n int, ref string) string {
+	lines := strings.Split(strings.TrimPrefix(string(data), "\ufeff"), "\n")
+	if n < 1 || n > len(lines) {
+		return ""
+	}
+	text := strings.TrimRight(lines[n-1], "\r")
+	if ref == "" || !strings.Contains(text, ref) {
+		return ""
+	}
+	return text
+}
+
+// lineageRate works out the rate usd was converted from amount at, and the
+// converter's rate on at. It returns false for a figure with no rate to
+// show: a USD amount or a zero one.
+func lineageRate(of, field, code string, amount, usd float64, at time.Time) (LineageRate, bool) {
+	if code == "USD" || code == "" || usd == 0 {
+		return LineageRate{}, false
+	}
+	r := LineageRate{
+		Of:          of,
+		Field:       field,
+		Currency:    code,
+		Amount:      amount,
+		USD:         usd,
+		UnitsPerUSD: amount / usd,
+		RateDate:    at.Format("2006-01-02"),
+		Source:      "static",
+	}
+	rate, from, err := currency.RateEffectiveAt(code, at)
+	if err != nil {
+		r.Source = "unsupported"
+		return r, true
+	}
+	r.RateInEffect = rate
+	if !from.IsZero() {
+		r.Source = "history"
+		r.EffectiveFrom = from.Format("2006-01-02")
+	}
+	r.Matches = math.Abs(amount/rate-usd) <= rateMatchToleranceUSD+1e-9
+	return r, true
+}
+
+func explainSource(src *LineageSource) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Report %s (%s batch %s", src.Report.ID, src.Report.Processor, src.Report.BatchID)
+	if src.File != nil && src.File.Filename != "" {
+		fmt.Fprintf(&b, ", file %s", src.File.Filename)
+	}
+	fmt.Fprintf(&b, ", sha256 %s) was ingested on %s", src.Report.FileHash, src.Report.IngestedAt.Format("2006-01-02"))
+	if src.Provenance != nil {
+		fmt.Fprintf(&b, " from %s", src.Provenance.Source)
+	}
+	if src.Verification != nil {
+		fmt.Fprintf(&b, ", %s", src.Verification.Status)
+	}
+	switch {
+	case src.Line > 0:
+		fmt.Fprintf(&b, "; the record is on line %d", src.Line)
+	case src.Entry != nil:
+		fmt.Fprintf(&b, "; the record is entry %d", *src.Entry)
+	}
+	b.WriteString(".")
+	return b.String()
+}
+
+func explainRate(r LineageRate) string {
+	s := fmt.Sprintf("The %s %.2f %s was converted to %.2f USD (%s) at %.6g %s per USD",
+		lineageAmounts[r.Field], r.Amount, r.Currency, r.USD, r.Field, r.UnitsPerUSD, r.Currency)
+	switch {
+	case r.Source == "unsupported":
+		return s + "; the converter no longer has a rate for " + r.Currency + "."
+	case r.Matches && r.Source == "history":
+		return s + fmt.Sprintf(", the rate history rate in effect on %s (from %s).", r.RateDate, r.EffectiveFrom)
+	case r.Matches:
+		return s + fmt.Sprintf(", the static rate on %s.", r.RateDate)
+	}
+	return s + fmt.Sprintf("; the converter's rate on %s is now %.6g (%s).", r.RateDate, r.RateInEffect, r.Source)
+}
+
+func explainComparison(c *LineageComparison) string {
+	s := fmt.Sprintf("%s compares %s: expected %.2f USD, actual %.2f USD, difference %.2f USD",
+		c.Type, c.Rule, c.ExpectedUSD, c.ActualUSD, c.DifferenceUSD)
+	if c.Policy == nil {
+		return s + "."
+	}
+	return s + fmt.Sprintf(", under policy %s (tolerance %.4g%% or %.2f USD, settlement window %dh).",
+		c.Policy.Version, c.Policy.MismatchPctTolerance*100, c.Policy.MismatchAbsToleranceUSD, c.Policy.SettlementWindowHours)
+}
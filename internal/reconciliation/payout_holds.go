@@ -0,0 +1,181 @@
+package reconciliation
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/wakala/reconciler/internal/domain"
+	"github.com/wakala/reconciler/internal/notify"
+	"github.com/wakala/reconciler/internal/repository"
+)
+
+// holdSeverities are the severities a hold can be set from, most severe
+// first.
+var holdSeverities = []domain.Severity{domain.SeverityCritical, domain.SeverityHigh, domain.SeverityMedium, domain.SeverityLow}
+
+// PayoutHoldConfig sets when a merchant's payouts are put on hold.
+type PayoutHoldConfig struct {
+	// MinSeverity is the lowest severity of discrepancy that counts towards
+	// a hold.
+	MinSeverity domain.Severity `json:"min_severity"`
+	// ThresholdUSD holds a merchant once the summed absolute difference of
+	// its open discrepancies of MinSeverity or above is more than this.
+	ThresholdUSD float64 `json:"threshold_usd"`
+}
+
+// DefaultPayoutHoldConfig holds a merchant with more than 1000 USD in open
+// HIGH or CRITICAL discrepancies.
+func DefaultPayoutHoldConfig() PayoutHoldConfig {
+	return PayoutHoldConfig{MinSeverity: domain.SeverityHigh, ThresholdUSD: 1000}
+}
+
+// PayoutHoldConfigFromEnv reads PAYOUT_HOLD_MIN_SEVERITY (default HIGH) and
+// PAYOUT_HOLD_THRESHOLD_USD (default 1000).
+func PayoutHoldConfigFromEnv() (PayoutHoldConfig, error) {
+	cfg := DefaultPayoutHoldConfig()
+	if v := os.Getenv("PAYOUT_HOLD_MIN_SEVERITY"); v != "" {
+		sev := domain.Severity(strings.ToUpper(v))
+		if severitiesFrom(sev) == nil {
+			return cfg, fmt.Errorf("PAYOUT_HOLD_MIN_SEVERITY must be one of LOW, MEDIUM, HIGH, CRITICAL, got %q", v)
+		}
+		cfg.MinSeverity = sev
+	}
+	if v := os.Getenv("PAYOUT_HOLD_THRESHOLD_USD"); v != "" {
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil || f < 0 {
+			return cfg, fmt.Errorf("PAYOUT_HOLD_THRESHOLD_USD must be a non-negative amount, got %q", v)
+		}
+		cfg.ThresholdUSD = f
+	}
+	return cfg, nil
+}
+
+// SetPayoutHoldConfig replaces the hold rules. Holds are re-evaluated by the
+// next run.
+func (s *Service) SetPayoutHoldConfig(cfg PayoutHoldConfig) {
+	s.holds = cfg
+}
+
+// severitiesFrom returns min and the severities above it, or nil when min
+// is not a severity.
+func severitiesFrom(min domain.Severity) []domain.Severity {
+	for i, sev := range holdSeverities {
+		if sev == min {
+			return holdSeverities[:i+1]
+		}
+	}
+	return nil
+}
+
+// PayoutHolds returns the merchants whose payouts are on hold and the rules
+// they were held under.
+func (s *Service) PayoutHolds() ([]domain.PayoutHold, PayoutHoldConfig, error) {
+	s.runMu.Lock()
+	cfg := s.holds
+	s.runMu.Unlock()
+
+	var holds []domain.PayoutHold
+	err := s.uow.Run(func(tx *repository.Tx) error {
+		var err error
+		holds, err = tx.PayoutHolds.List()
+		return err
+	})
+	return holds, cfg, err
+}
+
+// PayoutHold returns the hold on merchantID's payouts, or nil when they are
+// not held.
+func (s *Service) PayoutHold(merchantID string) (*domain.PayoutHold, error) {
+	var hold *domain.PayoutHold
+	err := s.uow.Run(func(tx *repository.Tx) error {
+		var err error
+		hold, err = tx.PayoutHolds.Get(merchantID)
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil
+		}
+		return err
+	})
+	return hold, err
+}
+
+// syncPayoutHolds holds the payouts of every merchant now over the
+// threshold, refreshes the counts of those already held and releases the
+// rest. It returns the events to send once tx commits, for merchants newly
+// held or released. The caller holds runMu.
+func (s *Service) syncPayoutHolds(tx *repository.Tx) ([]notify.Event, error) {
+	exposure, err := tx.PayoutHolds.Exposure(severitiesFrom(s.holds.MinSeverity))
+	if err != nil {
+		return nil, fmt.Errorf("payout hold exposure: %w", err)
+	}
+	current, err := tx.PayoutHolds.List()
+	if err != nil {
+		return nil, fmt.Errorf("list payout holds: %w", err)
+	}
+	held := make(map[string]domain.PayoutHold, len(current))
+	for _, h := range current {
+		held[h.MerchantID] = h
+	}
+
+	now := s.clock.Now().UTC().Truncate(time.Second)
+	var events []notify.Event
+	for _, h := range exposure {
+		if h.OpenUSD <= s.holds.ThresholdUSD {
+			continue
+		}
+		h.UpdatedAt = now
+		prev, ok := held[h.MerchantID]
+		delete(held, h.MerchantID)
+		if ok {
+			h.HeldSince = prev.HeldSince
+		} else {
+			h.HeldSince = now
+			events = append(events, payoutHoldEvent(h, nil))
+			log.Printf("[reconciliation] Holding payouts to merchant %s: %d open discrepancies, %.2f USD",
+				h.MerchantID, h.Discrepancies, h.OpenUSD)
+		}
+		if err := tx.PayoutHolds.Upsert(&h); err != nil {
+			return nil, fmt.Errorf("hold payouts to %s: %w", h.MerchantID, err)
+		}
+	}
+	for _, h := range current {
+		if _, ok := held[h.MerchantID]; !ok {
+			continue
+		}
+		if err := tx.PayoutHolds.Delete(h.MerchantID); err != nil {
+			return nil, fmt.Errorf("release payouts to %s: %w", h.MerchantID, err)
+		}
+		events = append(events, payoutHoldEvent(h, &now))
+		log.Printf("[reconciliation] Released payout hold on merchant %s", h.MerchantID)
+	}
+	return events, nil
+}
+
+// payoutHoldEvent is the merchant.payout_held event for h, or the
+// merchant.payout_released one when releasedAt is set.
+func payoutHoldEvent(h domain.PayoutHold, releasedAt *time.Time) notify.Event {
+	ev := notify.Event{
+		ID:        fmt.Sprintf("EVT-HOLD-%s-%d", h.MerchantID, h.HeldSince.Unix()),
+		Type:      notify.EventPayoutHeld,
+		CreatedAt: h.UpdatedAt,
+		Data: notify.PayoutHoldChanged{
+			MerchantID:    h.MerchantID,
+			Held:          releasedAt == nil,
+			Discrepancies: h.Discrepancies,
+			OpenUSD:       h.OpenUSD,
+			HeldSince:     h.HeldSince,
+			ReleasedAt:    releasedAt,
+		},
+	}
+	if releasedAt != nil {
+		ev.ID = fmt.Sprintf("EVT-RELEASE-%s-%d", h.MerchantID, h.HeldSince.Unix())
+		ev.Type = notify.EventPayoutReleased
+		ev.CreatedAt = *releasedAt
+	}
+	return ev
+}
@@ -0,0 +1,142 @@
+package reconciliation
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/wakala/reconciler/internal/domain"
+	"github.com/wakala/reconciler/internal/repository"
+)
+
+// Payouts are outbound transactions: instructions to disburse to a merchant
+// through a processor. The processor's disbursement report is ingested like
+// a settlement report and its records are matched to payouts by processor
+// reference in MatchSettlements, so this file only holds the checks that
+// differ from collections.
+
+// DetectMissingPayouts finds payouts instructed more than the settlement
+// window before asOf that no disbursement record has matched.
+func (s *Service) DetectMissingPayouts(tx *repository.Tx, asOf time.Time, scope repository.RunScope) (int, error) {
+	rules, err := loadRules(tx)
+	if err != nil || !rules.anywhere(string(domain.DiscrepancyMissingPayout)) {
+		return 0, err
+	}
+	cutoff := asOf.Add(-s.tol.SettlementWindow)
+
+	payouts, err := tx.Transactions.GetPayoutsWithoutDisbursement(cutoff)
+	if err != nil {
+		return 0, fmt.Errorf("query: %w", err)
+	}
+
+	pol := s.tol.policy(s.tol.MismatchAbsUSD, false)
+	var discs []domain.Discrepancy
+	for _, p := range payouts {
+		if !rules.enabled(string(domain.DiscrepancyMissingPayout), p.Processor) || !scope.Covers(p.Processor, p.CreatedAt) {
+			continue
+		}
+		discs = append(discs, domain.Discrepancy{
+			ID:            fmt.Sprintf("DISC-MP-%s", p.ID),
+			Type:          domain.DiscrepancyMissingPayout,
+			TransactionID: p.ID,
+			Processor:     p.Processor,
+			MerchantID:    p.MerchantID,
+			ExpectedUSD:   p.USDAmount,
+			ActualUSD:     0,
+			DifferenceUSD: p.USDAmount,
+			Currency:      p.Currency,
+			Severity:      s.severity.byAmount(p.USDAmount),
+			Description: fmt.Sprintf(
+				"Payout %s (%.2f USD) to merchant %s instructed but no disbursement found from %s",
+				p.ID, p.USDAmount, p.MerchantID, p.Processor,
+			),
+			DetectedAt: asOf,
+			Policy:     pol,
+		})
+	}
+
+	if len(discs) == 0 {
+		return 0, nil
+	}
+	n, err := tx.Discrepancies.BulkInsert(discs)
+	if err != nil {
+		return 0, fmt.Errorf("insert discrepancies: %w", err)
+	}
+	log.Printf("[reconciliation] Detected %d MISSING_PAYOUT discrepancies", n)
+	return n, nil
+}
+
+// DetectOverpaidPayouts finds disbursement records whose gross amount
+// exceeds the payout instruction by more than the mismatch tolerance.
+// Overpayment is money sent to a merchant that has to be clawed back, so it
+// is raised at least HIGH (see SeverityRules.overpaid).
+func (s *Service) DetectOverpaidPayouts(tx *repository.Tx, asOf time.Time, scope repository.RunScope) (int, error) {
+	rules, err := loadRules(tx)
+	if err != nil || !rules.anywhere(string(domain.DiscrepancyOverpaid)) {
+		return 0, err
+	}
+	matched, err := tx.Settlements.GetMatchedRecords()
+	if err != nil {
+		return 0, fmt.Errorf("get matched: %w", err)
+	}
+
+	overrides, err := tx.Tolerances.GetAll()
+	if err != nil {
+		return 0, fmt.Errorf("get tolerance overrides: %w", err)
+	}
+
+	pols := newMismatchPolicies(s.tol, overrides)
+	var discs []domain.Discrepancy
+	for _, rec := range matched {
+		if !rules.enabled(string(domain.DiscrepancyOverpaid), rec.Processor) {
+			continue
+		}
+		p, err := tx.Transactions.GetByID(rec.WakalaTransactionID)
+		if err != nil || p == nil || !p.Outbound() || !scope.Covers(p.Processor, p.CreatedAt) {
+			continue
+		}
+
+		diff := rec.USDGrossAmount - p.USDAmount
+		if diff <= 0 {
+			continue
+		}
+		ok, pol := pols.within(p.MerchantID, p.USDAmount, diff)
+		if ok {
+			continue
+		}
+
+		pctDiff := diff / p.USDAmount
+		sev := s.severity.overpaid(pctDiff, diff)
+
+		discs = append(discs, domain.Discrepancy{
+			ID:            fmt.Sprintf("DISC-OP-%s", rec.ID),
+			Type:          domain.DiscrepancyOverpaid,
+			TransactionID: p.ID,
+			SettlementID:  rec.ID,
+			Processor:     rec.Processor,
+			MerchantID:    p.MerchantID,
+			BatchID:       rec.BatchID,
+			ExpectedUSD:   p.USDAmount,
+			ActualUSD:     rec.USDGrossAmount,
+			DifferenceUSD: diff,
+			Currency:      rec.Currency,
+			Severity:      sev,
+			Description: fmt.Sprintf(
+				"Payout %s overpaid to merchant %s: instructed %.2f USD, disbursed %.2f USD (%.1f%% over)",
+				p.ID, p.MerchantID, p.USDAmount, rec.USDGrossAmount, pctDiff*100,
+			),
+			DetectedAt: asOf,
+			Policy:     pol,
+		})
+	}
+
+	if len(discs) == 0 {
+		return 0, nil
+	}
+	n, err := tx.Discrepancies.BulkInsert(discs)
+	if err != nil {
+		return 0, fmt.Errorf("insert discrepancies: %w", err)
+	}
+	log.Printf("[reconciliation] Detected %d OVERPAID discrepancies", n)
+	return n, nil
+}
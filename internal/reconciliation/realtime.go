@@ -0,0 +1,110 @@
+package reconciliation
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/wakala/reconciler/internal/domain"
+	"github.com/wakala/reconciler/internal/notify"
+	"github.com/wakala/reconciler/internal/repository"
+)
+
+// SetSettlementWebhook sends a transaction.settled event to sender for every
+// match, whether made by a full run or by MatchRecord.
+func (s *Service) SetSettlementWebhook(sender *notify.WebhookSender) {
+	s.runMu.Lock()
+	defer s.runMu.Unlock()
+	s.webhook = sender
+}
+
+// MatchRecord matches one stored settlement record straight away instead of
+// waiting for the next full run: a single lookup by processor reference and,
+// on a hit, the same updates MatchSettlements makes. It returns the matched
+// transaction, settled or pending batch approval, or nil when the record is already matched, is an adjustment
+// row or has no transaction yet; the next full run picks up the latter.
+// Discrepancies are not rebuilt here, but the transaction's reconciliation
+// status is refreshed.
+func (s *Service) MatchRecord(recordID string) (*domain.Transaction, error) {
+	s.runMu.Lock()
+	defer s.runMu.Unlock()
+
+	var m *Match
+	err := s.uow.Run(func(tx *repository.Tx) error {
+		rec, err := tx.Settlements.GetRecord(recordID)
+		if err != nil {
+			return fmt.Errorf("get record %s: %w", recordID, err)
+		}
+		if rec.WakalaTransactionID != "" || rec.Adjustment != nil {
+			return nil
+		}
+		if m, err = s.matchRecord(tx, *rec, repository.RunScope{}); err != nil || m == nil {
+			return err
+		}
+		return tx.Transactions.RefreshReconciliationStatus(m.Transaction.ID)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("match record: %w", err)
+	}
+	if m == nil {
+		return nil, nil
+	}
+
+	s.notifySettled([]Match{*m})
+	s.publishMatched([]Match{*m})
+	return m.Transaction, nil
+}
+
+// notifySettled sends transaction.settled for each match in the background,
+// in order, leaving out those pending batch approval. Delivery failures are
+// logged; the match stands regardless.
+func (s *Service) notifySettled(matches []Match) {
+	webhook := s.webhook
+	if webhook == nil || len(matches) == 0 {
+		return
+	}
+
+	events := make([]notify.Event, 0, len(matches))
+	now := time.Now().UTC()
+	for _, m := range matches {
+		if m.Pending {
+			continue
+		}
+		events = append(events, notify.Event{
+			ID:        fmt.Sprintf("EVT-SETTLED-%s-%s", m.Transaction.ID, m.Record.ID),
+			Type:      notify.EventTransactionSettled,
+			CreatedAt: now,
+			Data: notify.TransactionSettled{
+				TransactionID:      m.Transaction.ID,
+				MerchantID:         m.Transaction.MerchantID,
+				Processor:          string(m.Transaction.Processor),
+				ProcessorReference: m.Transaction.ProcessorReference,
+				SettlementID:       m.Record.ID,
+				BatchID:            m.Record.BatchID,
+				Amount:             m.Transaction.Amount,
+				Currency:           m.Transaction.Currency,
+				USDAmount:          m.Transaction.USDAmount,
+				SettledUSDGross:    m.Record.USDGrossAmount,
+				SettledAt:          m.Record.SettlementDate,
+			},
+		})
+	}
+
+	s.sendEvents(events)
+}
+
+// sendEvents sends events to the webhook in the background, in order.
+// Delivery failures are logged.
+func (s *Service) sendEvents(events []notify.Event) {
+	webhook := s.webhook
+	if webhook == nil || len(events) == 0 {
+		return
+	}
+	go func() {
+		for _, ev := range events {
+			if err := webhook.Send(ev); err != nil {
+				log.Printf("[reconciliation] WARNING: webhook: %v", err)
+			}
+		}
+	}()
+}
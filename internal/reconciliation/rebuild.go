@@ -0,0 +1,83 @@
+package reconciliation
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/wakala/reconciler/internal/repository"
+)
+
+// RebuildResult is what a rebuild of derived state changed.
+type RebuildResult struct {
+	// UnlinkedRecords were matched to a transaction that is gone or no
+	// longer has their reference.
+	UnlinkedRecords []repository.LinkRepair `json:"unlinked_records"`
+	// RemovedOrphans counts rows, by table, left behind by a deleted
+	// transaction or settlement record.
+	RemovedOrphans map[string]int `json:"removed_orphans"`
+	// Rematched is how many unmatched records, including the unlinked ones,
+	// found their transaction.
+	Rematched int `json:"rematched"`
+	// StatusChanges are transactions whose settled status or date did not
+	// follow from their matched records.
+	StatusChanges []repository.StatusRepair `json:"status_changes"`
+	// Reconciliation is the detection run on the repaired state.
+	Reconciliation *ReconciliationResult `json:"reconciliation"`
+}
+
+// RebuildDerivedState repairs the state matching derives from settlement
+// records, for use after the database was edited by hand. It clears links
+// to missing or no longer matching transactions and rows orphaned by
+// deleted ones, rematches, recomputes settled statuses from the matched
+// records, and then runs a full reconciliation. The repairs commit as one
+// unit of work before detection runs.
+func (s *Service) RebuildDerivedState() (*RebuildResult, error) {
+	s.runMu.Lock()
+	defer s.runMu.Unlock()
+
+	result := &RebuildResult{RemovedOrphans: map[string]int{}}
+	var matches []Match
+	err := s.uow.Run(func(tx *repository.Tx) error {
+		var err error
+		if result.UnlinkedRecords, err = tx.Settlements.ClearStaleLinks(); err != nil {
+			return fmt.Errorf("clear stale links: %w", err)
+		}
+		removed, err := tx.Transactions.DeleteOrphanedLinks()
+		if err != nil {
+			return fmt.Errorf("delete orphaned transaction links: %w", err)
+		}
+		for table, n := range removed {
+			result.RemovedOrphans[table] = n
+		}
+		if result.RemovedOrphans["settlement_adjustments"], err = tx.Settlements.DeleteOrphanedAdjustments(); err != nil {
+			return fmt.Errorf("delete orphaned adjustments: %w", err)
+		}
+		removed, err = tx.Settlements.DeleteOrphanedFees()
+		if err != nil {
+			return fmt.Errorf("delete orphaned fees: %w", err)
+		}
+		for table, n := range removed {
+			result.RemovedOrphans[table] = n
+		}
+		if matches, err = s.MatchSettlements(tx, repository.RunScope{}); err != nil {
+			return fmt.Errorf("match settlements: %w", err)
+		}
+		if result.StatusChanges, err = tx.Transactions.RepairSettledStatuses(); err != nil {
+			return fmt.Errorf("repair statuses: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	result.Rematched = len(matches)
+	s.notifySettled(matches)
+	s.publishMatched(matches)
+
+	if result.Reconciliation, err = s.run(s.clock.Now(), repository.RunScope{}, runLive); err != nil {
+		return nil, err
+	}
+	log.Printf("[reconciliation] Rebuilt derived state: unlinked=%d, rematched=%d, status_changes=%d, orphans=%v",
+		len(result.UnlinkedRecords), result.Rematched, len(result.StatusChanges), result.RemovedOrphans)
+	return result, nil
+}
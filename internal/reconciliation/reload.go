@@ -0,0 +1,47 @@
+package reconciliation
+
+import "github.com/wakala/reconciler/internal/notify"
+
+// Settings are the detection settings that may change while the service
+// runs.
+type Settings struct {
+	Tolerances  Tolerances
+	Severity    SeverityRules
+	Anomaly     AnomalyConfig
+	Suggestions SuggestionConfig
+	PayoutHolds PayoutHoldConfig
+	Approvals   BatchApprovalRules
+	Cases       CaseGroupingConfig
+	Rounding    RoundingConfig
+}
+
+// Reconfigure replaces the detection settings, the scoring of match
+// suggestions, the payout hold rules, the batch approval rules, the case
+// grouping rules and the rounding rules. It waits for the run in progress,
+// if any, so that no run, match or severity recalculation is judged by a
+// mix of the old and new settings. Discrepancies already stored keep their
+// severities until RecalculateSeverities, and payout holds stand until the
+// next run.
+func (s *Service) Reconfigure(st Settings) {
+	s.runMu.Lock()
+	defer s.runMu.Unlock()
+	s.tol = st.Tolerances
+	s.severity = st.Severity
+	s.anomalyCfg = st.Anomaly
+	s.suggest = st.Suggestions
+	s.holds = st.PayoutHolds
+	s.approvals = st.Approvals
+	s.cases = st.Cases
+	s.rounding = st.Rounding
+}
+
+// SetNotifications replaces the notifier anomaly alerts are emailed through
+// and the webhook transaction.settled and payout hold events are sent to,
+// between runs.
+// Either may be nil to stop sending.
+func (s *Service) SetNotifications(notifier *notify.AlertNotifier, webhook *notify.WebhookSender) {
+	s.runMu.Lock()
+	defer s.runMu.Unlock()
+	s.notifier = notifier
+	s.webhook = webhook
+}
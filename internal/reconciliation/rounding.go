@@ -0,0 +1,139 @@
+package reconciliation
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/wakala/reconciler/internal/domain"
+	"github.com/wakala/reconciler/internal/repository"
+)
+
+const (
+	// roundingTag marks the amount mismatches that are conversion rounding
+	// rather than a difference in the amount charged.
+	roundingTag = "rounding"
+	// roundingActor is who the activity log records automatic rounding
+	// resolutions as, and the source of the resolutions.
+	roundingActor = "rounding"
+)
+
+// RoundingConfig sets which amount mismatches are taken as rounding.
+type RoundingConfig struct {
+	// MaxUSD is the USD difference below which a mismatch is rounding. 0
+	// turns classification off.
+	MaxUSD float64 `json:"max_usd"`
+	// AutoResolve resolves the mismatches tagged rounding.
+	AutoResolve bool `json:"auto_resolve"`
+}
+
+// DefaultRounding takes sub-cent mismatches as rounding and resolves them.
+func DefaultRounding() RoundingConfig {
+	return RoundingConfig{MaxUSD: 0.01, AutoResolve: true}
+}
+
+// RoundingFromEnv reads ROUNDING_MAX_USD (default 0.01, 0 for off) and
+// ROUNDING_AUTO_RESOLVE (default true).
+func RoundingFromEnv() (RoundingConfig, error) {
+	cfg := DefaultRounding()
+	if v := os.Getenv("ROUNDING_MAX_USD"); v != "" {
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil || f < 0 || f > 1 {
+			return cfg, fmt.Errorf("ROUNDING_MAX_USD must be an amount from 0 (off) to 1, got %q", v)
+		}
+		cfg.MaxUSD = f
+	}
+	if v := os.Getenv("ROUNDING_AUTO_RESOLVE"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return cfg, fmt.Errorf("ROUNDING_AUTO_RESOLVE must be true or false, got %q", v)
+		}
+		cfg.AutoResolve = b
+	}
+	return cfg, nil
+}
+
+// SetRounding replaces the rounding rules, from the next run on.
+func (s *Service) SetRounding(cfg RoundingConfig) {
+	s.runMu.Lock()
+	defer s.runMu.Unlock()
+	s.rounding = cfg
+}
+
+// classifyRounding tags the amount mismatches of less than MaxUSD as
+// rounding and, with AutoResolve, resolves those without a resolution. A
+// tagged mismatch that has since grown loses the tag and the resolution
+// classification gave it. It returns how many mismatches it newly tagged.
+// The caller holds runMu.
+func (s *Service) classifyRounding(tx *repository.Tx) (int, error) {
+	cfg := s.rounding
+	if cfg.MaxUSD == 0 {
+		return 0, nil
+	}
+	discs, err := tx.Discrepancies.ListMismatches()
+	if err != nil {
+		return 0, fmt.Errorf("get amount mismatches: %w", err)
+	}
+
+	now := s.clock.Now().UTC().Truncate(time.Second)
+	tagged, resolved := 0, 0
+	for i := range discs {
+		d := &discs[i]
+		rounding := math.Abs(d.DifferenceUSD) < cfg.MaxUSD
+		hasTag := slices.Contains(d.Tags, roundingTag)
+		switch {
+		case rounding && !hasTag:
+			if err := tx.Discrepancies.AddTags(d.ID, []string{roundingTag}); err != nil {
+				return 0, fmt.Errorf("tag %s: %w", d.ID, err)
+			}
+			tagged++
+		case !rounding && hasTag:
+			if err := s.unclassifyRounding(tx, d, now); err != nil {
+				return 0, err
+			}
+			continue
+		case !rounding:
+			continue
+		}
+		if !cfg.AutoResolve || d.Resolution != nil {
+			continue
+		}
+		if err := tx.Discrepancies.Resolve(d.ID, &domain.DiscrepancyResolution{
+			Source: roundingActor, Status: "resolved", ResolvedBy: roundingActor, ResolvedAt: now,
+		}); err != nil {
+			return 0, fmt.Errorf("resolve %s: %w", d.ID, err)
+		}
+		if err := tx.Discrepancies.AddActivity(&domain.DiscrepancyActivity{
+			DiscrepancyID: d.ID, At: now, Actor: roundingActor, Action: domain.ActivityResolved, To: roundingTag,
+		}); err != nil {
+			return 0, fmt.Errorf("log activity: %w", err)
+		}
+		resolved++
+	}
+	if tagged > 0 || resolved > 0 {
+		log.Printf("[reconciliation] Tagged %d amount mismatches as rounding, resolved %d", tagged, resolved)
+	}
+	return tagged, nil
+}
+
+// unclassifyRounding takes the rounding tag off a mismatch that outgrew it,
+// and reopens it if classification resolved it.
+func (s *Service) unclassifyRounding(tx *repository.Tx, d *domain.Discrepancy, now time.Time) error {
+	if err := tx.Discrepancies.RemoveTag(d.ID, roundingTag); err != nil {
+		return fmt.Errorf("untag %s: %w", d.ID, err)
+	}
+	if d.Resolution == nil || d.Resolution.Source != roundingActor {
+		return nil
+	}
+	if err := tx.Discrepancies.Unresolve(d.ID); err != nil {
+		return fmt.Errorf("reopen %s: %w", d.ID, err)
+	}
+	log.Printf("[reconciliation] Reopened %s: its difference of %.4f USD is no longer rounding", d.ID, d.DifferenceUSD)
+	return tx.Discrepancies.AddActivity(&domain.DiscrepancyActivity{
+		DiscrepancyID: d.ID, At: now, Actor: roundingActor, Action: domain.ActivityReopened, From: roundingTag,
+	})
+}
@@ -0,0 +1,159 @@
+package reconciliation
+
+import (
+	"fmt"
+	"log"
+	"slices"
+	"time"
+
+	"github.com/wakala/reconciler/internal/domain"
+	"github.com/wakala/reconciler/internal/notify"
+	"github.com/wakala/reconciler/internal/repository"
+)
+
+// MatchesRoutingRule reports whether d meets every criterion rule sets.
+func MatchesRoutingRule(rule *domain.RoutingRule, d *domain.Discrepancy) bool {
+	switch {
+	case rule.Processor != "" && rule.Processor != d.Processor:
+		return false
+	case rule.Type != "" && rule.Type != d.Type:
+		return false
+	case rule.MerchantID != "" && rule.MerchantID != d.MerchantID:
+		return false
+	case rule.MinSeverity != "" && !slices.Contains(severitiesFrom(rule.MinSeverity), d.Severity):
+		return false
+	}
+	return true
+}
+
+// ValidSeverity reports whether sev is one of the four severities.
+func ValidSeverity(sev domain.Severity) bool {
+	return severitiesFrom(sev) != nil
+}
+
+// RoutingOwner names who rule assigns to, for logs and emails.
+func RoutingOwner(rule *domain.RoutingRule) string {
+	switch {
+	case rule.Team != "" && rule.Assignee != "":
+		return rule.Assignee + " (" + rule.Team + ")"
+	case rule.Assignee != "":
+		return rule.Assignee
+	}
+	return rule.Team
+}
+
+// routedBatch is the discrepancies one rule assigned in a run.
+type routedBatch struct {
+	rule  domain.RoutingRule
+	discs []domain.Discrepancy
+}
+
+// routeNew assigns each discrepancy no rule has assigned yet to the owner
+// of the first routing rule it matches, and logs it in its activity. A
+// discrepancy keeps its owner through re-runs, so only the ones new since
+// the last run, or unmatched until now, are routed. The caller holds runMu.
+func (s *Service) routeNew(tx *repository.Tx) ([]routedBatch, error) {
+	rules, err := tx.RoutingRules.List()
+	if err != nil {
+		return nil, fmt.Errorf("get routing rules: %w", err)
+	}
+	if len(rules) == 0 {
+		return nil, nil
+	}
+	discs, err := tx.Discrepancies.ListUnassigned()
+	if err != nil {
+		return nil, fmt.Errorf("get unassigned discrepancies: %w", err)
+	}
+
+	now := s.clock.Now().UTC().Truncate(time.Second)
+	batches := make([]routedBatch, len(rules))
+	for i := range rules {
+		batches[i].rule = rules[i]
+	}
+	for _, d := range discs {
+		i := slices.IndexFunc(rules, func(rule domain.RoutingRule) bool { return MatchesRoutingRule(&rule, &d) })
+		if i < 0 {
+			continue
+		}
+		rule := &rules[i]
+		if err := tx.Discrepancies.Assign(d.ID, &domain.DiscrepancyAssignment{
+			Team:       rule.Team,
+			Assignee:   rule.Assignee,
+			RuleID:     rule.ID,
+			AssignedAt: now,
+		}); err != nil {
+			return nil, fmt.Errorf("assign %s: %w", d.ID, err)
+		}
+		if err := tx.Discrepancies.AddActivity(&domain.DiscrepancyActivity{
+			DiscrepancyID: d.ID,
+			At:            now,
+			Actor:         "routing:" + rule.ID,
+			Action:        domain.ActivityAssigned,
+			To:            RoutingOwner(rule),
+		}); err != nil {
+			return nil, fmt.Errorf("log %s: %w", d.ID, err)
+		}
+		batches[i].discs = append(batches[i].discs, d)
+	}
+
+	routed := batches[:0]
+	for _, b := range batches {
+		if len(b.discs) > 0 {
+			log.Printf("[reconciliation] Routing rule %s assigned %d discrepancies to %s",
+				b.rule.ID, len(b.discs), RoutingOwner(&b.rule))
+			routed = append(routed, b)
+		}
+	}
+	return routed, nil
+}
+
+// notifyAssigned emails each rule's addresses the discrepancies it assigned
+// and sends discrepancy.assigned for each, in the background. Delivery
+// failures are logged; the assignments stand regardless.
+func (s *Service) notifyAssigned(routed []routedBatch) {
+	if len(routed) == 0 {
+		return
+	}
+	if notifier := s.assignNotifier; notifier != nil {
+		go func() {
+			for _, b := range routed {
+				if err := notifier.Notify(b.rule.Notify, RoutingOwner(&b.rule), b.discs); err != nil {
+					log.Printf("[reconciliation] WARNING: failed to email %d assignments of rule %s: %v",
+						len(b.discs), b.rule.ID, err)
+				}
+			}
+		}()
+	}
+
+	now := time.Now().UTC()
+	var events []notify.Event
+	for _, b := range routed {
+		for _, d := range b.discs {
+			events = append(events, notify.Event{
+				ID:        "EVT-ASSIGNED-" + d.ID,
+				Type:      notify.EventDiscrepancyAssigned,
+				CreatedAt: now,
+				Data: notify.DiscrepancyAssigned{
+					DiscrepancyID: d.ID,
+					Type:          string(d.Type),
+					Severity:      string(d.Severity),
+					Processor:     string(d.Processor),
+					MerchantID:    d.MerchantID,
+					DifferenceUSD: d.DifferenceUSD,
+					Team:          b.rule.Team,
+					Assignee:      b.rule.Assignee,
+					RuleID:        b.rule.ID,
+				},
+			})
+		}
+	}
+	s.sendEvents(events)
+}
+
+// SetAssignmentNotifier replaces the notifier routed discrepancies are
+// emailed through, between runs. nil stops the emails.
+func (s *Service) SetAssignmentNotifier(n *notify.AssignmentNotifier) {
+	s.runMu.Lock()
+	defer s.runMu.Unlock()
+	s.assignNotifier = n
+}
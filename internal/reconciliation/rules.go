@@ -0,0 +1,131 @@
+package reconciliation
+
+import (
+	"fmt"
+
+	"github.com/wakala/reconciler/internal/domain"
+	"github.com/wakala/reconciler/internal/repository"
+)
+
+// Rule is a detection rule that rule flags can turn off, or on, for every
+// processor or for one. A rule is named after the discrepancy or alert type
+// it raises.
+type Rule struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	// DefaultEnabled is whether the rule runs where no flag says otherwise.
+	// A new rule starts off, to be rolled out processor by processor.
+	DefaultEnabled bool `json:"default_enabled"`
+}
+
+// Rules are the reconciliation rules, in the order a run applies them.
+// Matching is not a rule: it always runs.
+var Rules = []Rule{
+	{Name: string(domain.DiscrepancyMissingSettlement), Description: "Captured transactions with no settlement record after the settlement window", DefaultEnabled: true},
+	{Name: string(domain.DiscrepancyAmountMismatch), Description: "Matched settlements whose gross amount differs from the transaction beyond the tolerance", DefaultEnabled: true},
+	{Name: string(domain.DiscrepancyOrphaned), Description: "Settlement records that match no transaction", DefaultEnabled: true},
+	{Name: string(domain.DiscrepancyMissingPayout), Description: "Payout instructions with no disbursement record after the settlement window", DefaultEnabled: true},
+	{Name: string(domain.DiscrepancyOverpaid), Description: "Disbursements above their payout instruction beyond the tolerance", DefaultEnabled: true},
+	{Name: string(domain.AlertVolumeDrop), Description: "A processor's latest daily settled volume far below its trailing average", DefaultEnabled: true},
+	{Name: string(domain.AlertOrphanRate), Description: "A processor's share of unmatched settlement records above the threshold", DefaultEnabled: true},
+}
+
+// LookupRule returns the rule called name.
+func LookupRule(name string) (Rule, bool) {
+	for _, r := range Rules {
+		if r.Name == name {
+			return r, true
+		}
+	}
+	return Rule{}, false
+}
+
+// RuleState is a rule and where it runs under the current flags.
+type RuleState struct {
+	Rule
+	// Enabled is whether the rule runs for processors without a flag of
+	// their own.
+	Enabled bool `json:"enabled"`
+	// Processors are the processors with a flag of their own, and whether
+	// the rule runs for them.
+	Processors map[domain.Processor]bool `json:"processors"`
+	Flags      []domain.RuleFlag         `json:"flags"`
+}
+
+// RuleStates resolves flags, as returned by RuleFlagRepo.List, into the
+// state of every rule.
+func RuleStates(flags []domain.RuleFlag) []RuleState {
+	rs := newRuleSet(flags)
+	states := make([]RuleState, len(Rules))
+	for i, r := range Rules {
+		st := RuleState{Rule: r, Enabled: rs.enabled(r.Name, ""), Processors: map[domain.Processor]bool{}, Flags: []domain.RuleFlag{}}
+		for _, f := range flags {
+			if f.Rule != r.Name {
+				continue
+			}
+			st.Flags = append(st.Flags, f)
+			if f.Processor != "" {
+				st.Processors[f.Processor] = f.Enabled
+			}
+		}
+		states[i] = st
+	}
+	return states
+}
+
+// ruleSet decides which rules run for which processor: a processor's own
+// flag wins over the flag for all processors, which wins over the rule's
+// default. Flags naming no known rule are ignored.
+type ruleSet struct {
+	defaults map[string]bool
+	// flags holds, by rule, the flags by processor, "" being all.
+	flags map[string]map[domain.Processor]bool
+}
+
+func newRuleSet(flags []domain.RuleFlag) *ruleSet {
+	rs := &ruleSet{defaults: make(map[string]bool, len(Rules)), flags: make(map[string]map[domain.Processor]bool)}
+	for _, r := range Rules {
+		rs.defaults[r.Name] = r.DefaultEnabled
+	}
+	for _, f := range flags {
+		if rs.flags[f.Rule] == nil {
+			rs.flags[f.Rule] = make(map[domain.Processor]bool)
+		}
+		rs.flags[f.Rule][f.Processor] = f.Enabled
+	}
+	return rs
+}
+
+// loadRules reads the rule flags in force for a run.
+func loadRules(tx *repository.Tx) (*ruleSet, error) {
+	flags, err := tx.RuleFlags.List()
+	if err != nil {
+		return nil, fmt.Errorf("get rule flags: %w", err)
+	}
+	return newRuleSet(flags), nil
+}
+
+// enabled reports whether rule runs for proc.
+func (rs *ruleSet) enabled(rule string, proc domain.Processor) bool {
+	if on, ok := rs.flags[rule][proc]; ok {
+		return on
+	}
+	if on, ok := rs.flags[rule][""]; ok {
+		return on
+	}
+	return rs.defaults[rule]
+}
+
+// anywhere reports whether rule runs for any processor, so that a rule off
+// everywhere need not even query its candidates.
+func (rs *ruleSet) anywhere(rule string) bool {
+	if rs.enabled(rule, "") {
+		return true
+	}
+	for _, on := range rs.flags[rule] {
+		if on {
+			return true
+		}
+	}
+	return false
+}
@@ -1,25 +1,69 @@
 package reconciliation
 
 import (
+	"crypto/sha256"
 	"database/sql"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"math"
-	"os"
-	"strconv"
+	"sync"
 	"time"
 
 	"github.com/wakala/reconciler/internal/domain"
+	"github.com/wakala/reconciler/internal/jira"
+	"github.com/wakala/reconciler/internal/live"
+	"github.com/wakala/reconciler/internal/notify"
+	"github.com/wakala/reconciler/internal/racehook"
 	"github.com/wakala/reconciler/internal/repository"
 )
 
-// ReconciliationResult summarises a full reconciliation run.
+// Clock abstracts the current time so time-based detection can be tested
+// and replayed deterministically.
+type Clock interface {
+	Now() time.Time
+}
+
+// SystemClock is the wall clock.
+type SystemClock struct{}
+
+func (SystemClock) Now() time.Time { return time.Now() }
+
+// ReconciliationResult summarises a reconciliation run.
 type ReconciliationResult struct {
-	MatchedCount        int `json:"matched_count"`
-	MissingSettlements  int `json:"missing_settlements"`
-	AmountMismatches    int `json:"amount_mismatches"`
-	OrphanedSettlements int `json:"orphaned_settlements"`
-	TotalDiscrepancies  int `json:"total_discrepancies"`
+	AsOf                time.Time `json:"as_of"`
+	MatchedCount        int       `json:"matched_count"`
+	MissingSettlements  int       `json:"missing_settlements"`
+	AmountMismatches    int       `json:"amount_mismatches"`
+	OrphanedSettlements int       `json:"orphaned_settlements"`
+	MissingPayouts      int       `json:"missing_payouts"`
+	OverpaidPayouts     int       `json:"overpaid_payouts"`
+	TotalDiscrepancies  int       `json:"total_discrepancies"`
+	Opened              int       `json:"opened"`
+	Resolved            int       `json:"resolved"`
+	Rounding            int       `json:"rounding"`
+	Assigned            int       `json:"assigned"`
+	Grouped             int       `json:"grouped"`
+	AnomalyAlerts       int       `json:"anomaly_alerts"`
+
+	// Backfill is set for a run reconciling a historical load, which sent
+	// no notifications.
+	Backfill bool `json:"backfill,omitempty"`
+
+	// Scope is set for a scoped run; the counts are then of the
+	// discrepancies in scope.
+	Scope *repository.RunScope `json:"scope,omitempty"`
+}
+
+// Run is the outcome of one reconciliation run, full or scoped. IDs count up from 1
+// at startup. Result is nil when the run failed.
+type Run struct {
+	ID         int64                 `json:"id"`
+	StartedAt  time.Time             `json:"started_at"`
+	DurationMS int64                 `json:"duration_ms"`
+	Result     *ReconciliationResult `json:"result,omitempty"`
+	Error      string                `json:"error,omitempty"`
 }
 
 // Service performs settlement reconciliation against known transactions.
@@ -27,6 +71,57 @@ type Service struct {
 	txnRepo  *repository.TransactionRepo
 	settRepo *repository.SettlementRepo
 	discRepo *repository.DiscrepancyRepo
+	tolRepo  *repository.ToleranceRepo
+	uow      *repository.UnitOfWork
+	clock    Clock
+	tol      Tolerances
+	severity SeverityRules
+	suggest  SuggestionConfig
+	holds    PayoutHoldConfig
+
+	// approvals gates the settling of large batches; see batch_approval.go.
+	approvals BatchApprovalRules
+
+	// Anomaly detection is off unless SetAnomalyDetection is called.
+	alertRepo  *repository.AlertRepo
+	anomalyCfg AnomalyConfig
+	notifier   *notify.AlertNotifier
+
+	// webhook receives transaction.settled events, see realtime.go, and
+	// payout hold changes, see payout_holds.go, when set.
+	webhook *notify.WebhookSender
+
+	// assignNotifier emails the discrepancies routing rules assign; see
+	// routing.go.
+	assignNotifier *notify.AssignmentNotifier
+
+	// cases sets when discrepancies are grouped into cases; see cases.go.
+	cases CaseGroupingConfig
+	// rounding sets which amount mismatches are tagged as rounding.
+	rounding RoundingConfig
+
+	// jira syncs discrepancies with Jira issues after each run, when set.
+	jira *jira.Syncer
+
+	// feed receives matches, new discrepancies and run totals for the
+	// dashboard's live feed, when set; see feed.go.
+	feed *live.Hub
+
+	// runMu ensures only one reconciliation run rebuilds discrepancies at a
+	// time.
+	runMu sync.Mutex
+
+	// lastRun is the latest run since startup, failed or not.
+	lastMu  sync.Mutex
+	lastRun *Run
+
+	// Debounced runs requested by ingestion; see debounce.go.
+	debounceMu      sync.Mutex
+	debounce        time.Duration
+	debounceTimer   *time.Timer
+	pendingSince    *time.Time
+	pendingRequests int
+	pendingDue      time.Time
 }
 
 // NewService creates a new reconciliation service.
@@ -34,101 +129,387 @@ func NewService(
 	txnRepo *repository.TransactionRepo,
 	settRepo *repository.SettlementRepo,
 	discRepo *repository.DiscrepancyRepo,
+	tolRepo *repository.ToleranceRepo,
+	uow *repository.UnitOfWork,
 ) *Service {
 	return &Service{
 		txnRepo:  txnRepo,
 		settRepo: settRepo,
 		discRepo: discRepo,
+		tolRepo:  tolRepo,
+		uow:      uow,
+		clock:    SystemClock{},
+		tol:      DefaultTolerances(),
+		severity: DefaultSeverityRules(),
+		suggest:  DefaultSuggestionConfig(),
+		holds:    DefaultPayoutHoldConfig(),
+		cases:    DefaultCaseGrouping(),
+		rounding: DefaultRounding(),
 	}
 }
 
+// SetJiraSync sets the syncer told of every run, between runs.
+func (s *Service) SetJiraSync(j *jira.Syncer) {
+	s.runMu.Lock()
+	defer s.runMu.Unlock()
+	s.jira = j
+}
+
+// SetClock replaces the service's clock.
+func (s *Service) SetClock(c Clock) {
+	s.clock = c
+}
+
 // RunFullReconciliation clears previous discrepancies and runs all detection
-// steps from scratch. This ensures a consistent view.
+// steps from scratch as of the clock's current time. This ensures a
+// consistent view.
 func (s *Service) RunFullReconciliation() (*ReconciliationResult, error) {
-	if err := s.discRepo.ClearAll(); err != nil {
-		return nil, fmt.Errorf("clear discrepancies: %w", err)
+	s.runMu.Lock()
+	defer s.runMu.Unlock()
+	return s.run(s.clock.Now(), repository.RunScope{}, runLive)
+}
+
+// RunFullReconciliationAsOf is RunFullReconciliation evaluated at asOf: the
+// missing-settlement cutoff and detection timestamps are derived from asOf
+// rather than the current time, so historical states can be reproduced. The
+// aggregate anomaly checks only run on live runs.
+func (s *Service) RunFullReconciliationAsOf(asOf time.Time) (*ReconciliationResult, error) {
+	s.runMu.Lock()
+	defer s.runMu.Unlock()
+	return s.run(asOf, repository.RunScope{}, runAsOf)
+}
+
+// RunScopedReconciliation is RunScopedReconciliationAsOf as of the clock's
+// current time.
+func (s *Service) RunScopedReconciliation(scope repository.RunScope) (*ReconciliationResult, error) {
+	s.runMu.Lock()
+	defer s.runMu.Unlock()
+	return s.run(s.clock.Now(), scope, runLive)
+}
+
+// RunScopedReconciliationAsOf is RunFullReconciliationAsOf limited to scope:
+// only the discrepancies in scope are cleared and re-detected, and only the
+// settlement records whose match would change them are matched, so the open
+// discrepancies of other processors and dates are left as they are. The
+// aggregate anomaly checks judge a processor's whole trailing window and do
+// not run. A zero scope is a full run.
+func (s *Service) RunScopedReconciliationAsOf(scope repository.RunScope, asOf time.Time) (*ReconciliationResult, error) {
+	s.runMu.Lock()
+	defer s.runMu.Unlock()
+	return s.run(asOf, scope, runAsOf)
+}
+
+// RunBackfillReconciliation is RunScopedReconciliationAsOf for a historical
+// load. Nothing leaves the service: matches send no transaction.settled
+// webhooks, payout hold changes send no events, assignments are not
+// emailed, Jira is not synced and the anomaly checks do not run.
+func (s *Service) RunBackfillReconciliation(scope repository.RunScope, asOf time.Time) (*ReconciliationResult, error) {
+	s.runMu.Lock()
+	defer s.runMu.Unlock()
+	return s.run(asOf, scope, runBackfill)
+}
+
+// LastRun returns the latest reconciliation run since startup, or nil
+// when none has run yet.
+func (s *Service) LastRun() *Run {
+	s.lastMu.Lock()
+	defer s.lastMu.Unlock()
+	if s.lastRun == nil {
+		return nil
 	}
+	run := *s.lastRun
+	return &run
+}
 
-	matched, err := s.MatchSettlements()
+// runKind is what a run is for.
+type runKind int
+
+const (
+	// runLive is a run as of the clock's current time.
+	runLive runKind = iota
+	// runAsOf reproduces the state at an earlier or later time.
+	runAsOf
+	// runBackfill reconciles a historical load; nothing leaves the service.
+	runBackfill
+)
+
+// run is a reconciliation run of kind for a caller holding runMu.
+func (s *Service) run(asOf time.Time, scope repository.RunScope, kind runKind) (*ReconciliationResult, error) {
+	started := time.Now()
+	result, err := s.reconcile(asOf, scope, kind)
+
+	run := &Run{StartedAt: started.UTC(), DurationMS: time.Since(started).Milliseconds(), Result: result}
 	if err != nil {
-		return nil, fmt.Errorf("match settlements: %w", err)
+		run.Error = err.Error()
+	}
+	s.lastMu.Lock()
+	if s.lastRun != nil {
+		run.ID = s.lastRun.ID + 1
+	} else {
+		run.ID = 1
 	}
+	s.lastRun = run
+	s.lastMu.Unlock()
+	return result, err
+}
 
-	missing, err := s.DetectMissingSettlements()
-	if err != nil {
-		return nil, fmt.Errorf("detect missing: %w", err)
+func (s *Service) reconcile(asOf time.Time, scope repository.RunScope, kind runKind) (*ReconciliationResult, error) {
+	full := scope.IsZero()
+	backfill := kind == runBackfill
+	if full && kind == runLive {
+		s.clearDeferred()
 	}
 
-	mismatches, err := s.DetectAmountMismatches()
+	// Matching and detection each commit as one unit of work, so a run that
+	// fails part-way leaves no half-matched records and no partly rebuilt
+	// discrepancies.
+	var matches []Match
+	err := s.uow.Run(func(tx *repository.Tx) error {
+		var err error
+		matches, err = s.MatchSettlements(tx, scope)
+		return err
+	})
 	if err != nil {
-		return nil, fmt.Errorf("detect mismatches: %w", err)
+		return nil, fmt.Errorf("match settlements: %w", err)
 	}
-
-	orphaned, err := s.DetectOrphanedSettlements()
+	matched := len(matches)
+	if !backfill {
+		s.notifySettled(matches)
+	}
+	s.publishMatched(matches)
+
+	var missing, mismatches, orphaned, missingPayouts, overpaid, opened, resolved int
+	var holdEvents []notify.Event
+	var routed []routedBatch
+	var rounding, grouped int
+	var fresh []domain.Discrepancy
+	err = s.uow.Run(func(tx *repository.Tx) error {
+		var err error
+		if full {
+			err = tx.Discrepancies.ClearAll()
+		} else {
+			err = tx.Discrepancies.ClearScope(scope)
+		}
+		if err != nil {
+			return fmt.Errorf("clear discrepancies: %w", err)
+		}
+		if missing, err = s.DetectMissingSettlements(tx, asOf, scope); err != nil {
+			return fmt.Errorf("detect missing: %w", err)
+		}
+		if mismatches, err = s.DetectAmountMismatches(tx, asOf, scope); err != nil {
+			return fmt.Errorf("detect mismatches: %w", err)
+		}
+		if orphaned, err = s.DetectOrphanedSettlements(tx, asOf, scope); err != nil {
+			return fmt.Errorf("detect orphaned: %w", err)
+		}
+		if missingPayouts, err = s.DetectMissingPayouts(tx, asOf, scope); err != nil {
+			return fmt.Errorf("detect missing payouts: %w", err)
+		}
+		if overpaid, err = s.DetectOverpaidPayouts(tx, asOf, scope); err != nil {
+			return fmt.Errorf("detect overpaid payouts: %w", err)
+		}
+		// A run as of an earlier time than the lifecycle already records
+		// would resolve current spells that the next live run reopens, so
+		// it neither records nor announces spells.
+		advance := kind == runLive
+		if !advance {
+			latest, err := tx.Discrepancies.LatestLifecycleAt()
+			if err != nil {
+				return fmt.Errorf("latest discrepancy lifecycle: %w", err)
+			}
+			advance = !asOf.Before(latest)
+		}
+		if advance {
+			if s.feed.Listening() {
+				if fresh, err = tx.Discrepancies.ListUnopened(); err != nil {
+					return fmt.Errorf("list new discrepancies: %w", err)
+				}
+			}
+			if opened, resolved, err = tx.Discrepancies.SyncLifecycle(asOf); err != nil {
+				return fmt.Errorf("sync discrepancy lifecycle: %w", err)
+			}
+		}
+		if rounding, err = s.classifyRounding(tx); err != nil {
+			return err
+		}
+		if routed, err = s.routeNew(tx); err != nil {
+			return err
+		}
+		if grouped, err = s.groupNew(tx); err != nil {
+			return err
+		}
+		if err := tx.Transactions.RefreshReconciliationStatus(); err != nil {
+			return fmt.Errorf("refresh reconciliation status: %w", err)
+		}
+		if holdEvents, err = s.syncPayoutHolds(tx); err != nil {
+			return err
+		}
+		return s.captureHistory(tx)
+	})
 	if err != nil {
-		return nil, fmt.Errorf("detect orphaned: %w", err)
+		return nil, err
+	}
+	// A backfill's matches, holds and assignments are history; nobody
+	// outside is told of them.
+	if !backfill {
+		s.sendEvents(holdEvents)
+		s.notifyAssigned(routed)
+		if s.jira != nil {
+			s.jira.Kick()
+		}
+	}
+	s.publishNew(fresh)
+	assigned := 0
+	for _, b := range routed {
+		assigned += len(b.discs)
+	}
+
+	// Aggregate checks are advisory; a failure here does not fail the run.
+	// They judge the days up to now, so as-of runs and backfills, which
+	// look at other times, skip them.
+	var anomalies int
+	if full && kind == runLive {
+		if anomalies, err = s.DetectAnomalies(asOf); err != nil {
+			log.Printf("[reconciliation] WARNING: anomaly detection failed: %v", err)
+		}
 	}
 
 	result := &ReconciliationResult{
+		AsOf:                asOf,
 		MatchedCount:        matched,
 		MissingSettlements:  missing,
 		AmountMismatches:    mismatches,
 		OrphanedSettlements: orphaned,
-		TotalDiscrepancies:  missing + mismatches + orphaned,
+		MissingPayouts:      missingPayouts,
+		OverpaidPayouts:     overpaid,
+		TotalDiscrepancies:  missing + mismatches + orphaned + missingPayouts + overpaid,
+		Opened:              opened,
+		Resolved:            resolved,
+		Rounding:            rounding,
+		Assigned:            assigned,
+		Grouped:             grouped,
+		AnomalyAlerts:       anomalies,
+		Backfill:            backfill,
+	}
+	if !full {
+		result.Scope = &scope
+		log.Printf("[reconciliation] Scoped run: %s", scope)
+	}
+	if backfill {
+		log.Printf("[reconciliation] Backfill run as of %s; notifications suppressed", asOf.UTC().Format("2006-01-02"))
 	}
 
-	log.Printf("[reconciliation] Results: matched=%d, missing=%d, mismatches=%d, orphaned=%d",
-		matched, missing, mismatches, orphaned)
+	log.Printf("[reconciliation] Results: matched=%d, missing=%d, mismatches=%d, orphaned=%d, missing_payouts=%d, overpaid=%d, opened=%d, resolved=%d, rounding=%d, assigned=%d, grouped=%d",
+		matched, missing, mismatches, orphaned, missingPayouts, overpaid, opened, resolved, rounding, assigned, grouped)
+	s.publishRun(result)
 
 	return result, nil
 }
 
+// Match is a settlement record matched to its transaction. Pending is set
+// when the transaction waits for the record's batch to be approved instead
+// of being settled.
+type Match struct {
+	Transaction *domain.Transaction
+	Record      domain.SettlementRecord
+	Pending     bool
+}
+
 // MatchSettlements tries to match unmatched settlement records to transactions
 // by processor_reference. On match, the settlement record is updated with the
-// wakala transaction ID and the transaction status is set to "settled".
-func (s *Service) MatchSettlements() (int, error) {
-	unmatched, err := s.settRepo.GetUnmatchedRecords()
+// wakala transaction ID and the transaction status is set to "settled", or
+// to "pending_settlement_confirmation" in a batch awaiting approval. A
+// database error fails the whole phase, so tx is rolled back rather than
+// committing some matches without their status update. Only records whose
+// transaction is in scope are matched.
+func (s *Service) MatchSettlements(tx *repository.Tx, scope repository.RunScope) ([]Match, error) {
+	unmatched, err := tx.Settlements.GetUnmatchedRecords()
 	if err != nil {
-		return 0, fmt.Errorf("get unmatched: %w", err)
+		return nil, fmt.Errorf("get unmatched: %w", err)
 	}
 
-	matched := 0
+	var matches []Match
 	for _, rec := range unmatched {
-		txn, err := s.txnRepo.GetByProcessorRef(string(rec.Processor), rec.ProcessorTransactionID)
-		if err != nil {
-			if err != sql.ErrNoRows {
-				log.Printf("[reconciliation] WARNING: db error matching %s/%s: %v",
-					rec.Processor, rec.ProcessorTransactionID, err)
-			}
+		if !scope.CoversProcessor(rec.Processor) {
 			continue
 		}
-		if txn == nil {
-			continue
+		m, err := s.matchRecord(tx, rec, scope)
+		if err != nil {
+			return nil, err
 		}
-
-		// Update the settlement record with the Wakala transaction ID.
-		if err := s.settRepo.UpdateWakalaTransactionID(rec.ID, txn.ID); err != nil {
-			log.Printf("[reconciliation] WARNING: failed to update match for %s: %v",
-				rec.ID, err)
-			continue
+		if m != nil {
+			matches = append(matches, *m)
 		}
+	}
 
-		// Mark the transaction as settled.
-		if err := s.txnRepo.UpdateStatusToSettled(txn.ID, rec.SettlementDate); err != nil {
-			log.Printf("[reconciliation] WARNING: failed to update txn status for %s: %v",
-				txn.ID, err)
-		}
+	return matches, nil
+}
+
+// matchRecord looks up rec's transaction by processor reference and, when
+// found, records the match. It returns nil when no transaction has the
+// reference, the transaction is outside scope or it is already matched to
+// another record.
+func (s *Service) matchRecord(tx *repository.Tx, rec domain.SettlementRecord, scope repository.RunScope) (*Match, error) {
+	txn, err := tx.Transactions.GetByProcessorRef(string(rec.Processor), rec.ProcessorTransactionID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("look up %s/%s: %w", rec.Processor, rec.ProcessorTransactionID, err)
+	}
+	if !scope.Covers(txn.Processor, txn.CreatedAt) {
+		return nil, nil
+	}
+
+	racehook.Pause(racehook.MatchLookup)
 
-		// Log the confidence score.
-		confidence := calculateConfidence(txn, &rec)
-		log.Printf("[reconciliation] Matched %s -> %s (confidence=%.2f, gross_usd_diff=%.4f)",
-			rec.ProcessorTransactionID, txn.ID, confidence,
-			math.Abs(txn.USDAmount-rec.USDGrossAmount))
+	// Link the settlement record to the Wakala transaction. A transaction
+	// already settled by another record keeps that one; this record stays
+	// unmatched and is reported as orphaned, since the payment was settled
+	// twice.
+	linked, err := tx.Settlements.LinkTransaction(rec.ID, txn.ID)
+	if err != nil {
+		return nil, fmt.Errorf("update match for %s: %w", rec.ID, err)
+	}
+	if !linked {
+		log.Printf("[reconciliation] Not matching %s: %s is already settled by another record",
+			rec.ID, txn.ID)
+		return nil, nil
+	}
+	racehook.Pause(racehook.MatchSettle)
+	rec.WakalaTransactionID = txn.ID
 
-		matched++
+	// A batch that needs approval leaves the transaction pending.
+	pending, err := s.holdForApproval(tx, rec)
+	if err != nil {
+		return nil, err
+	}
+	if pending {
+		if err := tx.Transactions.UpdateStatusToPendingConfirmation(txn.ID); err != nil {
+			return nil, fmt.Errorf("update txn status for %s: %w", txn.ID, err)
+		}
+		txn.Status = domain.StatusPendingConfirmation
+		txn.SettledAt = nil
+		log.Printf("[reconciliation] Matched %s -> %s, pending approval of batch %s",
+			rec.ProcessorTransactionID, txn.ID, rec.BatchID)
+		return &Match{Transaction: txn, Record: rec, Pending: true}, nil
 	}
 
-	return matched, nil
+	// Mark the transaction as settled.
+	if err := tx.Transactions.UpdateStatusToSettled(txn.ID, rec.SettlementDate); err != nil {
+		return nil, fmt.Errorf("update txn status for %s: %w", txn.ID, err)
+	}
+	settledAt := rec.SettlementDate
+	txn.Status = domain.StatusSettled
+	txn.SettledAt = &settledAt
+
+	// Log the confidence score.
+	confidence := calculateConfidence(txn, &rec)
+	log.Printf("[reconciliation] Matched %s -> %s (confidence=%.2f, gross_usd_diff=%.4f)",
+		rec.ProcessorTransactionID, txn.ID, confidence,
+		math.Abs(txn.USDAmount-rec.USDGrossAmount))
+
+	return &Match{Transaction: txn, Record: rec}, nil
 }
 
 // calculateConfidence returns a score (0-1) indicating how well the settlement
@@ -154,37 +535,35 @@ func calculateConfidence(txn *domain.Transaction, rec *domain.SettlementRecord)
 	}
 }
 
-// settlementWindowHours returns the configured settlement window from the
-// SETTLEMENT_WINDOW_HOURS environment variable, defaulting to 48.
-func settlementWindowHours() time.Duration {
-	if v := os.Getenv("SETTLEMENT_WINDOW_HOURS"); v != "" {
-		if h, err := strconv.Atoi(v); err == nil && h > 0 {
-			return time.Duration(h) * time.Hour
-		}
-	}
-	return 48 * time.Hour
-}
-
-// DetectMissingSettlements finds captured transactions older than the
+// DetectMissingSettlements finds inbound transactions captured more than the
 // settlement window (default 48h, configurable via SETTLEMENT_WINDOW_HOURS)
-// that have no matching settlement record.
-func (s *Service) DetectMissingSettlements() (int, error) {
-	cutoff := time.Now().Add(-settlementWindowHours())
+// before asOf that have no matching settlement record.
+func (s *Service) DetectMissingSettlements(tx *repository.Tx, asOf time.Time, scope repository.RunScope) (int, error) {
+	rules, err := loadRules(tx)
+	if err != nil || !rules.anywhere(string(domain.DiscrepancyMissingSettlement)) {
+		return 0, err
+	}
+	cutoff := asOf.Add(-s.tol.SettlementWindow)
 
-	txns, err := s.txnRepo.GetCapturedWithoutSettlement(cutoff)
+	txns, err := tx.Transactions.GetCapturedWithoutSettlement(cutoff)
 	if err != nil {
 		return 0, fmt.Errorf("query: %w", err)
 	}
 
+	pol := s.tol.policy(s.tol.MismatchAbsUSD, false)
 	var discs []domain.Discrepancy
 	for _, txn := range txns {
-		sev := severityByAmount(txn.USDAmount)
+		if !rules.enabled(string(domain.DiscrepancyMissingSettlement), txn.Processor) || !scope.Covers(txn.Processor, txn.CreatedAt) {
+			continue
+		}
+		sev := s.severity.byAmount(txn.USDAmount)
 
 		d := domain.Discrepancy{
 			ID:            fmt.Sprintf("DISC-MS-%s", txn.ID),
 			Type:          domain.DiscrepancyMissingSettlement,
 			TransactionID: txn.ID,
 			Processor:     txn.Processor,
+			MerchantID:    txn.MerchantID,
 			ExpectedUSD:   txn.USDAmount,
 			ActualUSD:     0,
 			DifferenceUSD: txn.USDAmount,
@@ -194,13 +573,14 @@ func (s *Service) DetectMissingSettlements() (int, error) {
 				"Transaction %s (%.2f USD) captured but no settlement found from %s",
 				txn.ID, txn.USDAmount, txn.Processor,
 			),
-			DetectedAt: time.Now(),
+			DetectedAt: asOf,
+			Policy:     pol,
 		}
 		discs = append(discs, d)
 	}
 
 	if len(discs) > 0 {
-		n, err := s.discRepo.BulkInsert(discs)
+		n, err := tx.Discrepancies.BulkInsert(discs)
 		if err != nil {
 			return 0, fmt.Errorf("insert discrepancies: %w", err)
 		}
@@ -211,38 +591,62 @@ func (s *Service) DetectMissingSettlements() (int, error) {
 }
 
 // DetectAmountMismatches checks matched settlement records for USD amount
-// differences beyond the tolerance threshold.
-func (s *Service) DetectAmountMismatches() (int, error) {
-	matched, err := s.settRepo.GetMatchedRecords()
+// differences beyond the tolerance threshold. A merchant's override, when
+// one is configured, is the whole tolerance; otherwise the global
+// percentage and absolute tolerances apply. Each mismatch
+// carries the probable cause of its difference when a known one fits.
+func (s *Service) DetectAmountMismatches(tx *repository.Tx, asOf time.Time, scope repository.RunScope) (int, error) {
+	rules, err := loadRules(tx)
+	if err != nil || !rules.anywhere(string(domain.DiscrepancyAmountMismatch)) {
+		return 0, err
+	}
+	matched, err := tx.Settlements.GetMatchedRecords()
 	if err != nil {
 		return 0, fmt.Errorf("get matched: %w", err)
 	}
 
+	overrides, err := tx.Tolerances.GetAll()
+	if err != nil {
+		return 0, fmt.Errorf("get tolerance overrides: %w", err)
+	}
+
+	causes, err := newCauseAnalyzer(tx, matched)
+	if err != nil {
+		return 0, err
+	}
+
+	pols := newMismatchPolicies(s.tol, overrides)
 	var discs []domain.Discrepancy
 
 	for _, rec := range matched {
-		txn, err := s.txnRepo.GetByID(rec.WakalaTransactionID)
-		if err != nil || txn == nil {
+		if !rules.enabled(string(domain.DiscrepancyAmountMismatch), rec.Processor) {
+			continue
+		}
+		txn, err := tx.Transactions.GetByID(rec.WakalaTransactionID)
+		if err != nil || txn == nil || !scope.Covers(txn.Processor, txn.CreatedAt) {
 			continue
 		}
 
-		// Compare gross USD amount (before fees) against the original transaction
-		// amount. Normal fee deductions are expected and do not constitute a
+		// Compare gross USD amount (before fees) against the transaction amount,
+		// which is the latest amended amount if upstream amended it after
+		// capture. Normal fee deductions are expected and do not constitute a
 		// mismatch; only a difference in the gross charged amount does.
 		diff := rec.USDGrossAmount - txn.USDAmount
 		absDiff := math.Abs(diff)
 
-		// Skip clean matches (< 0.5% difference — FX rounding tolerance).
-		if txn.USDAmount > 0 && absDiff/txn.USDAmount <= 0.005 {
+		// Paying a merchant more than instructed is OVERPAID, detected with
+		// the payouts; an underpaid payout is an ordinary mismatch.
+		if txn.Outbound() && diff > 0 {
 			continue
 		}
-		// Also skip tiny absolute differences (< 0.10 USD).
-		if absDiff < 0.10 {
+
+		ok, pol := pols.within(txn.MerchantID, txn.USDAmount, diff)
+		if ok {
 			continue
 		}
 
 		pctDiff := absDiff / txn.USDAmount
-		sev := mismatchSeverity(pctDiff, absDiff)
+		sev := s.severity.byDifference(pctDiff, absDiff)
 
 		d := domain.Discrepancy{
 			ID:            fmt.Sprintf("DISC-AM-%s", rec.ID),
@@ -250,6 +654,8 @@ func (s *Service) DetectAmountMismatches() (int, error) {
 			TransactionID: txn.ID,
 			SettlementID:  rec.ID,
 			Processor:     rec.Processor,
+			MerchantID:    txn.MerchantID,
+			BatchID:       rec.BatchID,
 			ExpectedUSD:   txn.USDAmount,
 			ActualUSD:     rec.USDGrossAmount,
 			DifferenceUSD: diff,
@@ -259,13 +665,15 @@ func (s *Service) DetectAmountMismatches() (int, error) {
 				"Gross amount mismatch for %s: expected %.2f USD, reported gross %.2f USD (%.1f%% diff)",
 				txn.ID, txn.USDAmount, rec.USDGrossAmount, pctDiff*100,
 			),
-			DetectedAt: time.Now(),
+			DetectedAt:    asOf,
+			Policy:        pol,
+			ProbableCause: probableCause(causes.checks(txn, &rec)),
 		}
 		discs = append(discs, d)
 	}
 
 	if len(discs) > 0 {
-		n, err := s.discRepo.BulkInsert(discs)
+		n, err := tx.Discrepancies.BulkInsert(discs)
 		if err != nil {
 			return 0, fmt.Errorf("insert discrepancies: %w", err)
 		}
@@ -277,36 +685,46 @@ func (s *Service) DetectAmountMismatches() (int, error) {
 
 // DetectOrphanedSettlements finds settlement records that could not be matched
 // to any known Wakala transaction.
-func (s *Service) DetectOrphanedSettlements() (int, error) {
-	unmatched, err := s.settRepo.GetUnmatchedRecords()
+func (s *Service) DetectOrphanedSettlements(tx *repository.Tx, asOf time.Time, scope repository.RunScope) (int, error) {
+	rules, err := loadRules(tx)
+	if err != nil || !rules.anywhere(string(domain.DiscrepancyOrphaned)) {
+		return 0, err
+	}
+	unmatched, err := tx.Settlements.GetUnmatchedRecords()
 	if err != nil {
 		return 0, fmt.Errorf("get unmatched: %w", err)
 	}
 
+	pol := s.tol.policy(s.tol.MismatchAbsUSD, false)
 	var discs []domain.Discrepancy
 
 	for _, rec := range unmatched {
+		if !rules.enabled(string(domain.DiscrepancyOrphaned), rec.Processor) || !scope.Covers(rec.Processor, rec.SettlementDate) {
+			continue
+		}
 		d := domain.Discrepancy{
-			ID:           fmt.Sprintf("DISC-OS-%s", rec.ID),
-			Type:         domain.DiscrepancyOrphaned,
-			SettlementID: rec.ID,
-			Processor:    rec.Processor,
-			ExpectedUSD:  0,
-			ActualUSD:    rec.USDNetAmount,
+			ID:            orphanDiscrepancyID(rec.ID),
+			Type:          domain.DiscrepancyOrphaned,
+			SettlementID:  rec.ID,
+			Processor:     rec.Processor,
+			BatchID:       rec.BatchID,
+			ExpectedUSD:   0,
+			ActualUSD:     rec.USDNetAmount,
 			DifferenceUSD: rec.USDNetAmount,
-			Currency:     rec.Currency,
-			Severity:     domain.SeverityHigh,
+			Currency:      rec.Currency,
+			Severity:      domain.SeverityHigh,
 			Description: fmt.Sprintf(
 				"Orphaned settlement %s from %s: %.2f USD with no matching transaction (proc_ref=%s)",
 				rec.ID, rec.Processor, rec.USDNetAmount, rec.ProcessorTransactionID,
 			),
-			DetectedAt: time.Now(),
+			DetectedAt: asOf,
+			Policy:     pol,
 		}
 		discs = append(discs, d)
 	}
 
 	if len(discs) > 0 {
-		n, err := s.discRepo.BulkInsert(discs)
+		n, err := tx.Discrepancies.BulkInsert(discs)
 		if err != nil {
 			return 0, fmt.Errorf("insert discrepancies: %w", err)
 		}
@@ -318,23 +736,65 @@ func (s *Service) DetectOrphanedSettlements() (int, error) {
 
 // --- helpers ---
 
-func severityByAmount(usdAmount float64) domain.Severity {
-	switch {
-	case usdAmount > 500:
-		return domain.SeverityHigh
-	case usdAmount > 100:
-		return domain.SeverityMedium
-	default:
-		return domain.SeverityLow
+// orphanDiscrepancyID is the ID of the ORPHANED_SETTLEMENT discrepancy of a
+// settlement record.
+func orphanDiscrepancyID(recordID string) string {
+	return "DISC-OS-" + recordID
+}
+
+// policy snapshots the detection rules in force, for the given absolute
+// mismatch tolerance. A merchant override replaces the percentage tolerance
+// too, so none is recorded with it.
+func (t Tolerances) policy(absToleranceUSD float64, merchantOverride bool) *domain.ReconciliationPolicy {
+	pct := t.MismatchPct
+	if merchantOverride {
+		pct = 0
+	}
+	p := &domain.ReconciliationPolicy{
+		MismatchPctTolerance:    pct,
+		MismatchAbsToleranceUSD: absToleranceUSD,
+		MerchantOverride:        merchantOverride,
+		SettlementWindowHours:   int(t.SettlementWindow.Hours()),
+		FeeScheduleVersion:      t.FeeScheduleVersion,
+	}
+	b, _ := json.Marshal(p)
+	p.Version = fmt.Sprintf("%x", sha256.Sum256(b))[:12]
+	return p
+}
+
+// mismatchPolicies resolves each merchant's absolute mismatch tolerance and
+// the policy recorded with its discrepancies, building each policy once.
+type mismatchPolicies struct {
+	tol        Tolerances
+	overrides  map[string]float64
+	def        *domain.ReconciliationPolicy
+	byMerchant map[string]*domain.ReconciliationPolicy
+}
+
+func newMismatchPolicies(tol Tolerances, overrides map[string]float64) *mismatchPolicies {
+	return &mismatchPolicies{
+		tol:        tol,
+		overrides:  overrides,
+		def:        tol.policy(tol.MismatchAbsUSD, false),
+		byMerchant: make(map[string]*domain.ReconciliationPolicy),
 	}
 }
 
-func mismatchSeverity(pctDiff, absDiff float64) domain.Severity {
-	if absDiff > 500 {
-		return domain.SeverityCritical
+// within reports whether a gross difference of diff against the expected
+// amount is within merchantID's tolerance, with the policy that decided it.
+// The merchant's override is consulted first and, when set, is the only
+// tolerance: the global percentage would otherwise let a large payment's
+// difference through however tight the override. Without one, the global
+// percentage and absolute tolerances apply.
+func (p *mismatchPolicies) within(merchantID string, expected, diff float64) (bool, *domain.ReconciliationPolicy) {
+	v, ok := p.overrides[merchantID]
+	if !ok {
+		return p.tol.within(expected, diff, p.tol.MismatchAbsUSD), p.def
 	}
-	if pctDiff > 0.02 {
-		return domain.SeverityHigh
+	pol := p.byMerchant[merchantID]
+	if pol == nil {
+		pol = p.tol.policy(v, true)
+		p.byMerchant[merchantID] = pol
 	}
-	return domain.SeverityMedium
+	return math.Abs(diff) < v, pol
 }
@@ -0,0 +1,198 @@
+package reconciliation
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"strconv"
+
+	"github.com/wakala/reconciler/internal/domain"
+	"github.com/wakala/reconciler/internal/notify"
+	"github.com/wakala/reconciler/internal/repository"
+)
+
+// SeverityRules sets the thresholds discrepancy severities are graded by.
+// Orphaned settlements are always HIGH and overpaid payouts at least HIGH,
+// whatever the thresholds.
+type SeverityRules struct {
+	// HighUSD and MediumUSD grade missing settlements and payouts by amount:
+	// above HighUSD is HIGH, above MediumUSD is MEDIUM, the rest LOW.
+	HighUSD   float64 `json:"high_usd"`
+	MediumUSD float64 `json:"medium_usd"`
+	// CriticalDiffUSD and HighDiffPct grade amount differences: above
+	// CriticalDiffUSD is CRITICAL, above HighDiffPct of the expected amount
+	// is HIGH, the rest MEDIUM.
+	CriticalDiffUSD float64 `json:"critical_diff_usd"`
+	HighDiffPct     float64 `json:"high_diff_pct"`
+}
+
+// DefaultSeverityRules are the rules used when none are configured.
+func DefaultSeverityRules() SeverityRules {
+	return SeverityRules{HighUSD: 500, MediumUSD: 100, CriticalDiffUSD: 500, HighDiffPct: 0.02}
+}
+
+// SeverityRulesFromEnv reads SEVERITY_HIGH_USD (default 500),
+// SEVERITY_MEDIUM_USD (default 100), SEVERITY_CRITICAL_DIFF_USD (default
+// 500) and SEVERITY_HIGH_DIFF_PCT (default 2).
+func SeverityRulesFromEnv() (SeverityRules, error) {
+	rules := DefaultSeverityRules()
+
+	usd := func(name string, dst *float64) error {
+		v := os.Getenv(name)
+		if v == "" {
+			return nil
+		}
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil || f < 0 {
+			return fmt.Errorf("%s must be a non-negative amount, got %q", name, v)
+		}
+		*dst = f
+		return nil
+	}
+
+	if err := usd("SEVERITY_HIGH_USD", &rules.HighUSD); err != nil {
+		return rules, err
+	}
+	if err := usd("SEVERITY_MEDIUM_USD", &rules.MediumUSD); err != nil {
+		return rules, err
+	}
+	if err := usd("SEVERITY_CRITICAL_DIFF_USD", &rules.CriticalDiffUSD); err != nil {
+		return rules, err
+	}
+	if v := os.Getenv("SEVERITY_HIGH_DIFF_PCT"); v != "" {
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil || f <= 0 || f >= 100 {
+			return rules, fmt.Errorf("SEVERITY_HIGH_DIFF_PCT must be a percentage between 0 and 100, got %q", v)
+		}
+		rules.HighDiffPct = f / 100
+	}
+	if rules.MediumUSD > rules.HighUSD {
+		return rules, fmt.Errorf("SEVERITY_MEDIUM_USD (%g) must not exceed SEVERITY_HIGH_USD (%g)", rules.MediumUSD, rules.HighUSD)
+	}
+	return rules, nil
+}
+
+// SetSeverityRules replaces the rules used by detection and by
+// RecalculateSeverities.
+func (s *Service) SetSeverityRules(rules SeverityRules) {
+	s.severity = rules
+}
+
+func (r SeverityRules) byAmount(usdAmount float64) domain.Severity {
+	switch {
+	case usdAmount > r.HighUSD:
+		return domain.SeverityHigh
+	case usdAmount > r.MediumUSD:
+		return domain.SeverityMedium
+	default:
+		return domain.SeverityLow
+	}
+}
+
+func (r SeverityRules) byDifference(pctDiff, absDiff float64) domain.Severity {
+	if absDiff > r.CriticalDiffUSD {
+		return domain.SeverityCritical
+	}
+	if pctDiff > r.HighDiffPct {
+		return domain.SeverityHigh
+	}
+	return domain.SeverityMedium
+}
+
+// overpaid grades an overpaid payout: overpayment has to be clawed back from
+// the merchant, so it is never below HIGH.
+func (r SeverityRules) overpaid(pctDiff, diff float64) domain.Severity {
+	if sev := r.byDifference(pctDiff, diff); sev != domain.SeverityMedium {
+		return sev
+	}
+	return domain.SeverityHigh
+}
+
+// Severity returns the severity d is graded under the rules, from its type
+// and amounts, the same way detection grades it.
+func (r SeverityRules) Severity(d *domain.Discrepancy) domain.Severity {
+	switch d.Type {
+	case domain.DiscrepancyMissingSettlement, domain.DiscrepancyMissingPayout:
+		return r.byAmount(d.ExpectedUSD)
+	case domain.DiscrepancyAmountMismatch:
+		absDiff := math.Abs(d.DifferenceUSD)
+		return r.byDifference(absDiff/d.ExpectedUSD, absDiff)
+	case domain.DiscrepancyOverpaid:
+		return r.overpaid(d.DifferenceUSD/d.ExpectedUSD, d.DifferenceUSD)
+	default:
+		return domain.SeverityHigh
+	}
+}
+
+// SeverityChange is one discrepancy regraded by RecalculateSeverities.
+type SeverityChange struct {
+	DiscrepancyID string          `json:"discrepancy_id"`
+	From          domain.Severity `json:"from"`
+	To            domain.Severity `json:"to"`
+}
+
+// SeverityRecalculation summarises a RecalculateSeverities call.
+type SeverityRecalculation struct {
+	Rules   SeverityRules    `json:"rules"`
+	Checked int              `json:"checked"`
+	Changed int              `json:"changed"`
+	Changes []SeverityChange `json:"changes"`
+}
+
+// RecalculateSeverities regrades every open discrepancy under the current
+// rules, without re-detecting anything. Each change is written to the
+// discrepancy's activity log as made by actor, in the same transaction, and
+// payout holds are re-evaluated against the new severities.
+func (s *Service) RecalculateSeverities(actor string) (*SeverityRecalculation, error) {
+	s.runMu.Lock()
+	defer s.runMu.Unlock()
+
+	result := &SeverityRecalculation{Rules: s.severity, Changes: []SeverityChange{}}
+	now := s.clock.Now().UTC()
+	var holdEvents []notify.Event
+	err := s.uow.Run(func(tx *repository.Tx) error {
+		discs, err := tx.Discrepancies.ListAll()
+		if err != nil {
+			return fmt.Errorf("list discrepancies: %w", err)
+		}
+		result.Checked = len(discs)
+
+		for _, d := range discs {
+			to := s.severity.Severity(&d)
+			if to == d.Severity {
+				continue
+			}
+			if err := tx.Discrepancies.UpdateSeverity(d.ID, to); err != nil {
+				return fmt.Errorf("update %s: %w", d.ID, err)
+			}
+			if err := tx.Discrepancies.AddActivity(&domain.DiscrepancyActivity{
+				DiscrepancyID: d.ID,
+				At:            now,
+				Actor:         actor,
+				Action:        domain.ActivitySeverityChanged,
+				From:          string(d.Severity),
+				To:            string(to),
+			}); err != nil {
+				return fmt.Errorf("log %s: %w", d.ID, err)
+			}
+			result.Changes = append(result.Changes, SeverityChange{DiscrepancyID: d.ID, From: d.Severity, To: to})
+		}
+		if holdEvents, err = s.syncPayoutHolds(tx); err != nil {
+			return err
+		}
+		return s.captureHistory(tx)
+	})
+	if err != nil {
+		return nil, err
+	}
+	s.sendEvents(holdEvents)
+	if s.jira != nil {
+		s.jira.Kick()
+	}
+
+	result.Changed = len(result.Changes)
+	log.Printf("[reconciliation] Recalculated severities: %d checked, %d changed (by %s)",
+		result.Checked, result.Changed, actor)
+	return result, nil
+}
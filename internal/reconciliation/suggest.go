@@ -0,0 +1,597 @@
+package reconciliation
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/wakala/reconciler/internal/domain"
+	"github.com/wakala/reconciler/internal/repository"
+)
+
+const (
+	// suggestionAmountSpan is the relative difference in amount at which the
+	// amount feature falls to 0.
+	suggestionAmountSpan = 0.05
+	// minRefPatternRecords is the fewest matched records a processor's
+	// reference prefix is learned from.
+	minRefPatternRecords = 5
+	// refSeparators split a reference into its parts.
+	refSeparators = "-_/.: "
+	// DefaultSuggestionLimit is how many suggestions the review queue shows
+	// for each record unless asked for another number.
+	DefaultSuggestionLimit = 3
+)
+
+var (
+	// ErrNotOrphaned is returned for a settlement record that is already
+	// matched or is an adjustment row.
+	ErrNotOrphaned = errors.New("settlement record is not orphaned")
+	// ErrNotCandidate is returned for a transaction an orphaned record
+	// cannot pay: one of another processor, a payout, or one not awaiting
+	// settlement.
+	ErrNotCandidate = errors.New("transaction cannot be matched to the settlement record")
+)
+
+// SuggestionWeights are the relative weights of the features a match
+// suggestion is scored by.
+type SuggestionWeights struct {
+	Amount    float64 `json:"amount"`
+	Time      float64 `json:"time"`
+	Merchant  float64 `json:"merchant"`
+	Reference float64 `json:"reference"`
+}
+
+// SuggestionConfig is how match suggestions are scored.
+type SuggestionConfig struct {
+	Weights SuggestionWeights `json:"weights"`
+	// MinScore is the lowest score the review queue suggests.
+	MinScore float64 `json:"min_score"`
+}
+
+// DefaultSuggestionConfig is the scoring used when none is configured.
+func DefaultSuggestionConfig() SuggestionConfig {
+	return SuggestionConfig{Weights: SuggestionWeights{Amount: 4, Time: 2, Merchant: 1, Reference: 3}, MinScore: 0.6}
+}
+
+// SuggestionConfigFromEnv reads MATCH_SUGGESTION_WEIGHTS, comma-separated
+// feature=weight pairs for amount, time, merchant and reference (default
+// amount=4,time=2,merchant=1,reference=3; a feature left out keeps its
+// default), and MATCH_SUGGESTION_MIN_SCORE (default 0.6).
+func SuggestionConfigFromEnv() (SuggestionConfig, error) {
+	cfg := DefaultSuggestionConfig()
+
+	if v := os.Getenv("MATCH_SUGGESTION_WEIGHTS"); v != "" {
+		for _, pair := range strings.Split(v, ",") {
+			name, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+			w, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+			if !ok || err != nil || w < 0 {
+				return cfg, fmt.Errorf("MATCH_SUGGESTION_WEIGHTS: %q must be feature=weight with a non-negative weight", pair)
+			}
+			switch strings.TrimSpace(name) {
+			case "amount":
+				cfg.Weights.Amount = w
+			case "time":
+				cfg.Weights.Time = w
+			case "merchant":
+				cfg.Weights.Merchant = w
+			case "reference":
+				cfg.Weights.Reference = w
+			default:
+				return cfg, fmt.Errorf("MATCH_SUGGESTION_WEIGHTS: unknown feature %q: must be amount, time, merchant or reference", name)
+			}
+		}
+		if cfg.Weights.total() == 0 {
+			return cfg, fmt.Errorf("MATCH_SUGGESTION_WEIGHTS must give some feature a positive weight, got %q", v)
+		}
+	}
+	if v := os.Getenv("MATCH_SUGGESTION_MIN_SCORE"); v != "" {
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil || f < 0 || f > 1 {
+			return cfg, fmt.Errorf("MATCH_SUGGESTION_MIN_SCORE must be a score from 0 to 1, got %q", v)
+		}
+		cfg.MinScore = f
+	}
+	return cfg, nil
+}
+
+// SetSuggestionConfig replaces the scoring of match suggestions.
+func (s *Service) SetSuggestionConfig(cfg SuggestionConfig) {
+	s.runMu.Lock()
+	defer s.runMu.Unlock()
+	s.suggest = cfg
+}
+
+func (w SuggestionWeights) total() float64 {
+	return w.Amount + w.Time + w.Merchant + w.Reference
+}
+
+// score is the weighted mean of f.
+func (w SuggestionWeights) score(f domain.SuggestionFeatures) float64 {
+	sum := w.Amount*f.Amount + w.Time*f.Time + w.Merchant*f.Merchant + w.Reference*f.Reference
+	return roundScore(sum / w.total())
+}
+
+func roundScore(x float64) float64 {
+	return math.Round(x*1000) / 1000
+}
+
+// ReviewFilter narrows the review queue.
+type ReviewFilter struct {
+	Processor string
+	// MinAge keeps the records that have been orphaned at least this long.
+	MinAge time.Duration
+	// Limit is the most suggestions shown for each record; 0 shows all.
+	Limit int
+}
+
+// OrphanReview is an orphaned settlement record in the review queue with the
+// transactions it may pay, best first.
+type OrphanReview struct {
+	Settlement    domain.SettlementRecord  `json:"settlement"`
+	DiscrepancyID string                   `json:"discrepancy_id"`
+	OrphanedSince time.Time                `json:"orphaned_since"`
+	Suggestions   []domain.MatchSuggestion `json:"suggestions"`
+}
+
+// ReviewQueue returns the settlement records the last run reported orphaned,
+// longest orphaned first, with their match suggestions: the captured inbound
+// transactions of the record's processor that no record settled, scoring at
+// least the minimum, less those rejected for the record.
+func (s *Service) ReviewQueue(f ReviewFilter) ([]OrphanReview, error) {
+	cfg, window := s.suggestionSettings()
+	now := s.clock.Now()
+
+	queue := []OrphanReview{}
+	err := s.uow.Run(func(tx *repository.Tx) error {
+		since, err := tx.Discrepancies.OpenSince(domain.DiscrepancyOrphaned)
+		if err != nil {
+			return fmt.Errorf("get orphans: %w", err)
+		}
+		unmatched, err := tx.Settlements.GetUnmatchedRecords()
+		if err != nil {
+			return fmt.Errorf("get unmatched: %w", err)
+		}
+		sg, err := newSuggester(tx, cfg, window, now)
+		if err != nil {
+			return err
+		}
+		for _, rec := range unmatched {
+			if f.Processor != "" && string(rec.Processor) != f.Processor {
+				continue
+			}
+			id := orphanDiscrepancyID(rec.ID)
+			opened, ok := since[id]
+			if !ok || now.Sub(opened) < f.MinAge {
+				continue
+			}
+			queue = append(queue, OrphanReview{
+				Settlement:    rec,
+				DiscrepancyID: id,
+				OrphanedSince: opened,
+				Suggestions:   sg.suggest(&rec, f.Limit),
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(queue, func(i, j int) bool {
+		if !queue[i].OrphanedSince.Equal(queue[j].OrphanedSince) {
+			return queue[i].OrphanedSince.Before(queue[j].OrphanedSince)
+		}
+		return queue[i].Settlement.ID < queue[j].Settlement.ID
+	})
+	return queue, nil
+}
+
+// AcceptSuggestion matches an orphaned settlement record to a transaction as
+// a reviewer decided, recording the decision with the suggestion's score.
+// The link stands although the references differ: rebuilding derived state
+// keeps it. Discrepancies are not rebuilt here. It returns sql.ErrNoRows
+// when the record or the transaction does not exist, ErrNotOrphaned when
+// the record is matched or an adjustment, and ErrNotCandidate when the
+// transaction cannot be the record's.
+func (s *Service) AcceptSuggestion(recordID, txnID, user, note string) (*domain.SuggestionFeedback, error) {
+	s.runMu.Lock()
+	defer s.runMu.Unlock()
+
+	var m *Match
+	var fb *domain.SuggestionFeedback
+	err := s.uow.Run(func(tx *repository.Tx) error {
+		rec, sug, err := s.reviewPair(tx, recordID, txnID, s.suggest, s.tol.SettlementWindow)
+		if err != nil {
+			return err
+		}
+		txn := sug.Transaction
+
+		linked, err := tx.Settlements.LinkTransaction(rec.ID, txn.ID)
+		if err != nil {
+			return fmt.Errorf("update match for %s: %w", rec.ID, err)
+		}
+		if !linked {
+			return fmt.Errorf("%w: %s is already settled by another record", ErrNotCandidate, txn.ID)
+		}
+		if err := tx.Transactions.UpdateStatusToSettled(txn.ID, rec.SettlementDate); err != nil {
+			return fmt.Errorf("update txn status for %s: %w", txn.ID, err)
+		}
+		if err := tx.Transactions.RefreshReconciliationStatus(txn.ID); err != nil {
+			return err
+		}
+		fb = newFeedback(rec, sug, domain.SuggestionAccepted, user, note, s.clock.Now())
+		if err := tx.Suggestions.Upsert(fb); err != nil {
+			return fmt.Errorf("store feedback: %w", err)
+		}
+
+		settledAt := rec.SettlementDate
+		txn.Status = domain.StatusSettled
+		txn.SettledAt = &settledAt
+		rec.WakalaTransactionID = txn.ID
+		m = &Match{Transaction: txn, Record: *rec}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("[reconciliation] Matched %s -> %s by accepted suggestion (score=%.2f, user=%s)",
+		m.Record.ProcessorTransactionID, m.Transaction.ID, fb.Score, user)
+	s.notifySettled([]Match{*m})
+	s.publishMatched([]Match{*m})
+	return fb, nil
+}
+
+// RejectSuggestion records that a transaction is not the one an orphaned
+// settlement record pays, so it is no longer suggested for it. It returns
+// the same errors as AcceptSuggestion.
+func (s *Service) RejectSuggestion(recordID, txnID, user, note string) (*domain.SuggestionFeedback, error) {
+	cfg, window := s.suggestionSettings()
+
+	var fb *domain.SuggestionFeedback
+	err := s.uow.Run(func(tx *repository.Tx) error {
+		rec, sug, err := s.reviewPair(tx, recordID, txnID, cfg, window)
+		if err != nil {
+			return err
+		}
+		fb = newFeedback(rec, sug, domain.SuggestionRejected, user, note, s.clock.Now())
+		if err := tx.Suggestions.Upsert(fb); err != nil {
+			return fmt.Errorf("store feedback: %w", err)
+		}
+		return nil
+	})
+	return fb, err
+}
+
+// FeedbackStats sums up the decisions of one kind.
+type FeedbackStats struct {
+	Count int `json:"count"`
+	// MeanScore and MeanFeatures average the decisions' scores and features
+	// as they were when each was made.
+	MeanScore    float64                   `json:"mean_score"`
+	MeanFeatures domain.SuggestionFeatures `json:"mean_features"`
+}
+
+// SuggestionReport is the feedback on match suggestions, to tune the weights
+// by: a feature that scores as high on rejected suggestions as on accepted
+// ones does not tell them apart and deserves less weight.
+type SuggestionReport struct {
+	Config   SuggestionConfig            `json:"config"`
+	Accepted FeedbackStats               `json:"accepted"`
+	Rejected FeedbackStats               `json:"rejected"`
+	Feedback []domain.SuggestionFeedback `json:"feedback"`
+}
+
+// SuggestionFeedback returns the decisions on suggestions for processor's
+// records, or every processor's when it is empty, and their averages.
+func (s *Service) SuggestionFeedback(processor string) (*SuggestionReport, error) {
+	cfg, _ := s.suggestionSettings()
+
+	var feedback []domain.SuggestionFeedback
+	err := s.uow.Run(func(tx *repository.Tx) error {
+		var err error
+		feedback, err = tx.Suggestions.List(processor)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	report := &SuggestionReport{Config: cfg, Feedback: feedback}
+	for _, f := range feedback {
+		st := &report.Rejected
+		if f.Decision == domain.SuggestionAccepted {
+			st = &report.Accepted
+		}
+		st.Count++
+		st.MeanScore += f.Score
+		st.MeanFeatures.Amount += f.Features.Amount
+		st.MeanFeatures.Time += f.Features.Time
+		st.MeanFeatures.Merchant += f.Features.Merchant
+		st.MeanFeatures.Reference += f.Features.Reference
+	}
+	for _, st := range []*FeedbackStats{&report.Accepted, &report.Rejected} {
+		if st.Count == 0 {
+			continue
+		}
+		n := float64(st.Count)
+		st.MeanScore = roundScore(st.MeanScore / n)
+		st.MeanFeatures = domain.SuggestionFeatures{
+			Amount:    roundScore(st.MeanFeatures.Amount / n),
+			Time:      roundScore(st.MeanFeatures.Time / n),
+			Merchant:  roundScore(st.MeanFeatures.Merchant / n),
+			Reference: roundScore(st.MeanFeatures.Reference / n),
+		}
+	}
+	return report, nil
+}
+
+// suggestionSettings returns the suggestion scoring and settlement window in
+// force, between runs.
+func (s *Service) suggestionSettings() (SuggestionConfig, time.Duration) {
+	s.runMu.Lock()
+	defer s.runMu.Unlock()
+	return s.suggest, s.tol.SettlementWindow
+}
+
+// reviewPair loads an orphaned settlement record and a transaction it may
+// pay, and scores the pair.
+func (s *Service) reviewPair(tx *repository.Tx, recordID, txnID string, cfg SuggestionConfig, window time.Duration) (*domain.SettlementRecord, *domain.MatchSuggestion, error) {
+	rec, err := tx.Settlements.GetRecord(recordID)
+	if err != nil {
+		return nil, nil, err
+	}
+	switch {
+	case rec.WakalaTransactionID != "":
+		return nil, nil, fmt.Errorf("%w: %s is matched to %s", ErrNotOrphaned, rec.ID, rec.WakalaTransactionID)
+	case rec.Adjustment != nil:
+		return nil, nil, fmt.Errorf("%w: %s is an adjustment row", ErrNotOrphaned, rec.ID)
+	}
+
+	txn, err := tx.Transactions.GetByID(txnID)
+	if err != nil {
+		return nil, nil, err
+	}
+	switch {
+	case txn.Processor != rec.Processor:
+		return nil, nil, fmt.Errorf("%w: %s is from %s and %s from %s", ErrNotCandidate, txn.ID, txn.Processor, rec.ID, rec.Processor)
+	case txn.Direction == domain.DirectionOutbound:
+		return nil, nil, fmt.Errorf("%w: %s is a payout", ErrNotCandidate, txn.ID)
+	case txn.Status != domain.StatusCaptured:
+		return nil, nil, fmt.Errorf("%w: %s is %s, not captured", ErrNotCandidate, txn.ID, txn.Status)
+	}
+
+	sg, err := newSuggester(tx, cfg, window, s.clock.Now())
+	if err != nil {
+		return nil, nil, err
+	}
+	sug := sg.score(rec, txn)
+	return rec, &sug, nil
+}
+
+func newFeedback(rec *domain.SettlementRecord, sug *domain.MatchSuggestion, decision domain.SuggestionDecision, user, note string, at time.Time) *domain.SuggestionFeedback {
+	return &domain.SuggestionFeedback{
+		SettlementID:  rec.ID,
+		TransactionID: sug.Transaction.ID,
+		Processor:     rec.Processor,
+		Decision:      decision,
+		Score:         sug.Score,
+		Features:      sug.Features,
+		UserID:        user,
+		Note:          note,
+		DecidedAt:     at.UTC().Truncate(time.Second),
+	}
+}
+
+// suggester scores transactions as the payment of orphaned settlement
+// records, from the records matched so far.
+type suggester struct {
+	cfg    SuggestionConfig
+	window time.Duration
+	// candidates are each processor's captured inbound transactions that no
+	// record settled.
+	candidates map[domain.Processor][]domain.Transaction
+	// prefixes are the reference prefixes each processor's matched records
+	// share, for processors with enough of them.
+	prefixes map[domain.Processor]string
+	// merchants are the merchants of the payments each batch settled, by
+	// batchKey.
+	merchants map[string]map[string]bool
+	// rejected are the transactions rejected for each record.
+	rejected map[string]map[string]bool
+}
+
+// newSuggester reads the candidates captured before asOf and learns the
+// processors' reference prefixes and batches' merchants from the matched
+// records.
+func newSuggester(tx *repository.Tx, cfg SuggestionConfig, window time.Duration, asOf time.Time) (*suggester, error) {
+	captured, err := tx.Transactions.GetCapturedWithoutSettlement(asOf)
+	if err != nil {
+		return nil, fmt.Errorf("get candidates: %w", err)
+	}
+	matched, err := tx.Settlements.GetMatchedRecords()
+	if err != nil {
+		return nil, fmt.Errorf("get matched: %w", err)
+	}
+	ids := make([]string, len(matched))
+	for i, rec := range matched {
+		ids[i] = rec.WakalaTransactionID
+	}
+	settled, err := tx.Transactions.GetByIDs(ids)
+	if err != nil {
+		return nil, fmt.Errorf("get matched transactions: %w", err)
+	}
+	rejected, err := tx.Suggestions.Rejected()
+	if err != nil {
+		return nil, fmt.Errorf("get rejected suggestions: %w", err)
+	}
+
+	sg := &suggester{
+		cfg:        cfg,
+		window:     window,
+		candidates: make(map[domain.Processor][]domain.Transaction),
+		prefixes:   make(map[domain.Processor]string),
+		merchants:  make(map[string]map[string]bool),
+		rejected:   rejected,
+	}
+	for _, txn := range captured {
+		sg.candidates[txn.Processor] = append(sg.candidates[txn.Processor], txn)
+	}
+	refs := make(map[domain.Processor][]string)
+	for _, rec := range matched {
+		refs[rec.Processor] = append(refs[rec.Processor], rec.ProcessorTransactionID)
+		txn := settled[rec.WakalaTransactionID]
+		if txn == nil || txn.MerchantID == "" {
+			continue
+		}
+		key := batchKey(rec.Processor, rec.BatchID)
+		if sg.merchants[key] == nil {
+			sg.merchants[key] = make(map[string]bool)
+		}
+		sg.merchants[key][txn.MerchantID] = true
+	}
+	for proc, rs := range refs {
+		if len(rs) >= minRefPatternRecords {
+			sg.prefixes[proc] = refPrefix(rs)
+		}
+	}
+	return sg, nil
+}
+
+func batchKey(proc domain.Processor, batchID string) string {
+	return string(proc) + "/" + batchID
+}
+
+// suggest returns the candidates for rec scoring at least the minimum, best
+// first, at most limit of them unless limit is 0.
+func (sg *suggester) suggest(rec *domain.SettlementRecord, limit int) []domain.MatchSuggestion {
+	suggestions := []domain.MatchSuggestion{}
+	candidates := sg.candidates[rec.Processor]
+	for i := range candidates {
+		if sg.rejected[rec.ID][candidates[i].ID] {
+			continue
+		}
+		if m := sg.score(rec, &candidates[i]); m.Score >= sg.cfg.MinScore {
+			suggestions = append(suggestions, m)
+		}
+	}
+	sort.SliceStable(suggestions, func(i, j int) bool {
+		if suggestions[i].Score != suggestions[j].Score {
+			return suggestions[i].Score > suggestions[j].Score
+		}
+		return suggestions[i].Transaction.ID < suggestions[j].Transaction.ID
+	})
+	if limit > 0 && len(suggestions) > limit {
+		suggestions = suggestions[:limit]
+	}
+	return suggestions
+}
+
+// score rates txn as the payment rec settled.
+func (sg *suggester) score(rec *domain.SettlementRecord, txn *domain.Transaction) domain.MatchSuggestion {
+	f := domain.SuggestionFeatures{
+		Amount:    roundScore(amountFeature(rec, txn)),
+		Time:      roundScore(timeFeature(rec, txn, sg.window)),
+		Reference: roundScore(referenceFeature(rec.ProcessorTransactionID, txn.ProcessorReference, sg.prefixes[rec.Processor])),
+	}
+	if sg.merchants[batchKey(rec.Processor, rec.BatchID)][txn.MerchantID] {
+		f.Merchant = 1
+	}
+	return domain.MatchSuggestion{Transaction: txn, Score: sg.cfg.Weights.score(f), Features: f}
+}
+
+// amountFeature compares the record's gross amount with the transaction's,
+// in their own currency when they share one so that FX rounding does not
+// count, falling to 0 at a difference of suggestionAmountSpan.
+func amountFeature(rec *domain.SettlementRecord, txn *domain.Transaction) float64 {
+	expected, actual := txn.USDAmount, rec.USDGrossAmount
+	if rec.Currency == txn.Currency {
+		expected, actual = txn.Amount, rec.GrossAmount
+	}
+	if expected <= 0 {
+		return 0
+	}
+	return math.Max(0, 1-math.Abs(actual-expected)/expected/suggestionAmountSpan)
+}
+
+// timeFeature is 1 for a record dated within the settlement window after the
+// capture, give or take the day a settlement date spans, and 0 for one dated
+// earlier. Later it falls, reaching 0 two windows on.
+func timeFeature(rec *domain.SettlementRecord, txn *domain.Transaction, window time.Duration) float64 {
+	captured := txn.CreatedAt
+	if txn.CapturedAt != nil {
+		captured = *txn.CapturedAt
+	}
+	lag := rec.SettlementDate.Sub(captured)
+	switch {
+	case lag < -24*time.Hour:
+		return 0
+	case lag <= window+24*time.Hour:
+		return 1
+	}
+	return math.Max(0, 1-float64(lag-window-24*time.Hour)/float64(2*window))
+}
+
+// referenceFeature compares the part of two references that tells payments
+// apart: what follows the processor's usual prefix or, for a reference
+// without it, its last part. An orphan's reference is often the right serial
+// number under a wrong prefix, or the right prefix with a mistyped serial.
+func referenceFeature(orphanRef, candidateRef, prefix string) float64 {
+	a := strings.ToUpper(refSerial(orphanRef, prefix))
+	b := strings.ToUpper(refSerial(candidateRef, prefix))
+	n := max(len([]rune(a)), len([]rune(b)))
+	if n == 0 {
+		return 0
+	}
+	return 1 - float64(editDistance(a, b))/float64(n)
+}
+
+// refPrefix returns the prefix every one of refs shares, up to its last
+// separator: "AP-TXN-001" and "AP-TXN-002" share "AP-TXN-", not "AP-TXN-00".
+func refPrefix(refs []string) string {
+	prefix := refs[0]
+	for _, ref := range refs[1:] {
+		n := 0
+		for n < len(prefix) && n < len(ref) && prefix[n] == ref[n] {
+			n++
+		}
+		prefix = prefix[:n]
+	}
+	return prefix[:strings.LastIndexAny(prefix, refSeparators)+1]
+}
+
+func refSerial(ref, prefix string) string {
+	if prefix != "" && strings.HasPrefix(ref, prefix) {
+		return ref[len(prefix):]
+	}
+	return ref[strings.LastIndexAny(ref, refSeparators)+1:]
+}
+
+// editDistance is the Levenshtein distance between a and b, in runes.
+func editDistance(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	prev := make([]int, len(rb)+1)
+	cur := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		cur[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(rb)]
+}
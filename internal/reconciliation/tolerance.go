@@ -0,0 +1,78 @@
+package reconciliation
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Tolerances are the default mismatch tolerances and the settlement window
+// detection runs with. Merchants may override the absolute tolerance.
+type Tolerances struct {
+	// MismatchPct is the relative gross difference treated as FX rounding
+	// noise.
+	MismatchPct float64
+	// MismatchAbsUSD is the absolute gross difference below which a
+	// mismatch is ignored.
+	MismatchAbsUSD float64
+	// SettlementWindow is how long a transaction or payout may wait for its
+	// settlement record before it is reported missing.
+	SettlementWindow time.Duration
+	// FeeScheduleVersion labels the processor fee schedule operations is
+	// using. It is recorded with each discrepancy but does not change
+	// detection.
+	FeeScheduleVersion string
+}
+
+// DefaultTolerances are the tolerances used when none are configured.
+func DefaultTolerances() Tolerances {
+	return Tolerances{MismatchPct: 0.005, MismatchAbsUSD: 0.10, SettlementWindow: 48 * time.Hour}
+}
+
+// TolerancesFromEnv reads MISMATCH_PCT_TOLERANCE (default 0.5),
+// MISMATCH_ABS_TOLERANCE_USD (default 0.10), SETTLEMENT_WINDOW_HOURS
+// (default 48) and FEE_SCHEDULE_VERSION.
+func TolerancesFromEnv() (Tolerances, error) {
+	t := DefaultTolerances()
+
+	if v := os.Getenv("MISMATCH_PCT_TOLERANCE"); v != "" {
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil || f < 0 || f >= 100 {
+			return t, fmt.Errorf("MISMATCH_PCT_TOLERANCE must be a percentage from 0 to 100, got %q", v)
+		}
+		t.MismatchPct = f / 100
+	}
+	if v := os.Getenv("MISMATCH_ABS_TOLERANCE_USD"); v != "" {
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil || f < 0 {
+			return t, fmt.Errorf("MISMATCH_ABS_TOLERANCE_USD must be a non-negative amount, got %q", v)
+		}
+		t.MismatchAbsUSD = f
+	}
+	if v := os.Getenv("SETTLEMENT_WINDOW_HOURS"); v != "" {
+		h, err := strconv.Atoi(v)
+		if err != nil || h <= 0 {
+			return t, fmt.Errorf("SETTLEMENT_WINDOW_HOURS must be a positive number of hours, got %q", v)
+		}
+		t.SettlementWindow = time.Duration(h) * time.Hour
+	}
+	t.FeeScheduleVersion = os.Getenv("FEE_SCHEDULE_VERSION")
+	return t, nil
+}
+
+// SetTolerances replaces the tolerances used by detection.
+func (s *Service) SetTolerances(t Tolerances) {
+	s.tol = t
+}
+
+// within reports whether a gross difference of diff against the expected
+// amount is FX rounding noise or smaller than absTolerance.
+func (t Tolerances) within(expected, diff, absTolerance float64) bool {
+	absDiff := math.Abs(diff)
+	if expected > 0 && absDiff/expected <= t.MismatchPct {
+		return true
+	}
+	return absDiff < absTolerance
+}
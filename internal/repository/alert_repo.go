@@ -0,0 +1,130 @@
+package repository
+
+import (
+	"database/sql"
+	"strings"
+	"time"
+
+	"github.com/wakala/reconciler/internal/domain"
+)
+
+type AlertRepo struct {
+	db *sql.DB
+}
+
+func NewAlertRepo(db *sql.DB) *AlertRepo {
+	return &AlertRepo{db: db}
+}
+
+// Insert stores an alert unless one with the same ID already exists. It
+// reports whether a new row was written.
+func (r *AlertRepo) Insert(a *domain.Alert) (bool, error) {
+	res, err := r.db.Exec(
+		`INSERT OR IGNORE INTO alerts
+		(id, type, processor, severity, reference, message, created_at, resolved_at)
+		VALUES (?,?,?,?,?,?,?,?)`,
+		a.ID, string(a.Type), string(a.Processor), string(a.Severity),
+		a.Reference, a.Message, a.CreatedAt.Format(time.RFC3339),
+		formatNullableTime(a.ResolvedAt),
+	)
+	if err != nil {
+		return false, err
+	}
+	n, _ := res.RowsAffected()
+	return n > 0, nil
+}
+
+// Resolve marks an open alert as resolved. Resolving an unknown or already
+// resolved alert is a no-op.
+func (r *AlertRepo) Resolve(id string, at time.Time) error {
+	_, err := r.db.Exec(
+		"UPDATE alerts SET resolved_at = ? WHERE id = ? AND resolved_at IS NULL",
+		at.Format(time.RFC3339), id,
+	)
+	return err
+}
+
+// ResolveByReference resolves the open alerts of a type for one processor
+// and reference.
+func (r *AlertRepo) ResolveByReference(alertType domain.AlertType, processor domain.Processor, reference string, at time.Time) error {
+	_, err := r.db.Exec(
+		"UPDATE alerts SET resolved_at = ? WHERE type = ? AND processor = ? AND reference = ? AND resolved_at IS NULL",
+		at.Format(time.RFC3339), alertType, processor, reference,
+	)
+	return err
+}
+
+type AlertFilter struct {
+	Type      string
+	Processor string
+	// Status is "open", "resolved" or "" for all alerts.
+	Status string
+	Page   int
+	Limit  int
+}
+
+func (r *AlertRepo) List(f AlertFilter) ([]domain.Alert, int, error) {
+	var clauses []string
+	var args []any
+	if f.Type != "" {
+		clauses = append(clauses, "type = ?")
+		args = append(args, f.Type)
+	}
+	if f.Processor != "" {
+		clauses = append(clauses, "processor = ?")
+		args = append(args, f.Processor)
+	}
+	switch f.Status {
+	case "open":
+		clauses = append(clauses, "resolved_at IS NULL")
+	case "resolved":
+		clauses = append(clauses, "resolved_at IS NOT NULL")
+	}
+	where := ""
+	if len(clauses) > 0 {
+		where = " WHERE " + strings.Join(clauses, " AND ")
+	}
+
+	var total int
+	if err := r.db.QueryRow("SELECT COUNT(*) FROM alerts"+where, args...).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	if f.Limit <= 0 {
+		f.Limit = 50
+	}
+	if f.Page <= 0 {
+		f.Page = 1
+	}
+	offset := (f.Page - 1) * f.Limit
+
+	q := "SELECT * FROM alerts" + where + " ORDER BY created_at DESC, id LIMIT ? OFFSET ?"
+	args = append(args, f.Limit, offset)
+
+	rows, err := r.db.Query(q, args...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	var alerts []domain.Alert
+	for rows.Next() {
+		var a domain.Alert
+		var atype, proc, sev, createdAt string
+		var resolvedAt sql.NullString
+		if err := rows.Scan(&a.ID, &atype, &proc, &sev, &a.Reference, &a.Message,
+			&createdAt, &resolvedAt); err != nil {
+			return nil, 0, err
+		}
+		a.Type = domain.AlertType(atype)
+		a.Processor = domain.Processor(proc)
+		a.Severity = domain.Severity(sev)
+		a.CreatedAt, _ = time.Parse(time.RFC3339, createdAt)
+		if resolvedAt.Valid {
+			t, _ := time.Parse(time.RFC3339, resolvedAt.String)
+			a.ResolvedAt = &t
+		}
+		alerts = append(alerts, a)
+	}
+	return alerts, total, rows.Err()
+}
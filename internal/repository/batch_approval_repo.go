@@ -0,0 +1,119 @@
+package repository
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/wakala/reconciler/internal/domain"
+)
+
+// ErrBatchApproved is returned when approving a batch that already is.
+var ErrBatchApproved = errors.New("batch is already approved")
+
+// BatchApprovalRepo stores the approvals settlement batches need before
+// their transactions are settled.
+type BatchApprovalRepo struct {
+	db dbtx
+}
+
+func NewBatchApprovalRepo(db *sql.DB) *BatchApprovalRepo {
+	return &BatchApprovalRepo{db: db}
+}
+
+// batchApprovalSelect reads approvals with the number of transactions each
+// holds pending.
+const batchApprovalSelect = `
+	SELECT ba.processor, ba.batch_id, ba.status, ba.record_count, ba.usd_gross_amount, ba.requested_at,
+		ba.approved_by, ba.approved_at, ba.note,
+		(SELECT COUNT(*) FROM settlement_records sr JOIN transactions t ON t.id = sr.wakala_transaction_id
+			WHERE sr.processor = ba.processor AND sr.batch_id = ba.batch_id AND t.status = ?)
+	FROM batch_approvals ba`
+
+// Request records that a batch needs approval, or refreshes its totals
+// while it is pending. An approved batch is left as it is.
+func (r *BatchApprovalRepo) Request(a *domain.BatchApproval) error {
+	_, err := r.db.Exec(
+		`INSERT INTO batch_approvals (processor, batch_id, status, record_count, usd_gross_amount, requested_at)
+		VALUES (?,?,?,?,?,?)
+		ON CONFLICT(processor, batch_id) DO UPDATE SET
+			record_count = excluded.record_count,
+			usd_gross_amount = excluded.usd_gross_amount
+		WHERE status = ?`,
+		string(a.Processor), a.BatchID, string(domain.BatchApprovalPending), a.RecordCount, a.USDGrossAmount,
+		a.RequestedAt.UTC().Format(time.RFC3339), string(domain.BatchApprovalPending),
+	)
+	return err
+}
+
+// Get returns a batch's approval. It returns sql.ErrNoRows when the batch
+// never needed one.
+func (r *BatchApprovalRepo) Get(processor, batchID string) (*domain.BatchApproval, error) {
+	return scanBatchApproval(r.db.QueryRow(
+		batchApprovalSelect+" WHERE ba.processor = ? AND ba.batch_id = ?",
+		string(domain.StatusPendingConfirmation), processor, batchID,
+	))
+}
+
+// List returns the approvals with status, or all when it is empty, oldest
+// request first.
+func (r *BatchApprovalRepo) List(status domain.BatchApprovalStatus) ([]domain.BatchApproval, error) {
+	q := batchApprovalSelect
+	args := []any{string(domain.StatusPendingConfirmation)}
+	if status != "" {
+		q += " WHERE ba.status = ?"
+		args = append(args, string(status))
+	}
+	rows, err := r.db.Query(q+" ORDER BY ba.requested_at, ba.processor, ba.batch_id", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := []domain.BatchApproval{}
+	for rows.Next() {
+		a, err := scanBatchApproval(rows)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, *a)
+	}
+	return result, rows.Err()
+}
+
+// Approve marks a pending batch approved. It returns sql.ErrNoRows when the
+// batch has no approval and ErrBatchApproved when it is already approved.
+func (r *BatchApprovalRepo) Approve(processor, batchID, user, note string, at time.Time) error {
+	res, err := r.db.Exec(
+		`UPDATE batch_approvals SET status = ?, approved_by = ?, approved_at = ?, note = ?
+		WHERE processor = ? AND batch_id = ? AND status = ?`,
+		string(domain.BatchApprovalApproved), user, at.UTC().Format(time.RFC3339), note,
+		processor, batchID, string(domain.BatchApprovalPending),
+	)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		return nil
+	}
+	if _, err := r.Get(processor, batchID); err != nil {
+		return err
+	}
+	return ErrBatchApproved
+}
+
+func scanBatchApproval(row interface{ Scan(...any) error }) (*domain.BatchApproval, error) {
+	var a domain.BatchApproval
+	var requestedAt string
+	var approvedAt sql.NullString
+	if err := row.Scan(&a.Processor, &a.BatchID, &a.Status, &a.RecordCount, &a.USDGrossAmount, &requestedAt,
+		&a.ApprovedBy, &approvedAt, &a.Note, &a.PendingTransactions); err != nil {
+		return nil, err
+	}
+	a.RequestedAt, _ = time.Parse(time.RFC3339, requestedAt)
+	if approvedAt.Valid {
+		t, _ := time.Parse(time.RFC3339, approvedAt.String)
+		a.ApprovedAt = &t
+	}
+	return &a, nil
+}
@@ -0,0 +1,223 @@
+package repository
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/wakala/reconciler/internal/domain"
+)
+
+type CaseRepo struct {
+	db dbtx
+}
+
+func NewCaseRepo(db *sql.DB) *CaseRepo {
+	return &CaseRepo{db: db}
+}
+
+// caseSelect reads cases with their member counts and the impact of their
+// current members.
+const caseSelect = `SELECT c.id, c.title, c.group_key, c.created_by, c.created_at, c.resolved_by, c.resolved_at, c.note,
+	COUNT(m.discrepancy_id), COUNT(d.id), COALESCE(SUM(ABS(d.difference_usd)), 0)
+	FROM discrepancy_cases c
+	LEFT JOIN case_members m ON m.case_id = c.id
+	LEFT JOIN discrepancies d ON d.id = m.discrepancy_id `
+
+// Create stores a new case, without members.
+func (r *CaseRepo) Create(c *domain.DiscrepancyCase) error {
+	_, err := r.db.Exec(
+		"INSERT INTO discrepancy_cases (id, title, group_key, created_by, created_at) VALUES (?,?,?,?,?)",
+		c.ID, c.Title, c.GroupKey, c.CreatedBy, c.CreatedAt.Format(time.RFC3339),
+	)
+	return err
+}
+
+// Get returns a case, or sql.ErrNoRows when there is no such case.
+func (r *CaseRepo) Get(id string) (*domain.DiscrepancyCase, error) {
+	cases, err := r.list("WHERE c.id = ? GROUP BY c.id", id)
+	if err != nil {
+		return nil, err
+	}
+	if len(cases) == 0 {
+		return nil, sql.ErrNoRows
+	}
+	return &cases[0], nil
+}
+
+// List returns the cases, open or resolved if status is set, newest first.
+func (r *CaseRepo) List(status domain.CaseStatus) ([]domain.DiscrepancyCase, error) {
+	switch status {
+	case domain.CaseOpen:
+		return r.list("WHERE c.resolved_at IS NULL GROUP BY c.id ORDER BY c.created_at DESC, c.id DESC")
+	case domain.CaseResolved:
+		return r.list("WHERE c.resolved_at IS NOT NULL GROUP BY c.id ORDER BY c.created_at DESC, c.id DESC")
+	}
+	return r.list("GROUP BY c.id ORDER BY c.created_at DESC, c.id DESC")
+}
+
+// OpenGroups returns the IDs of the open cases the reconciler opened, by
+// group key.
+func (r *CaseRepo) OpenGroups() (map[string]string, error) {
+	rows, err := r.db.Query("SELECT group_key, id FROM discrepancy_cases WHERE group_key != '' AND resolved_at IS NULL")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	groups := map[string]string{}
+	for rows.Next() {
+		var key, id string
+		if err := rows.Scan(&key, &id); err != nil {
+			return nil, err
+		}
+		groups[key] = id
+	}
+	return groups, rows.Err()
+}
+
+// ListUngrouped returns the current discrepancies that are in no case and
+// were never taken out of one, with their merchants and batches.
+func (r *CaseRepo) ListUngrouped() ([]domain.Discrepancy, error) {
+	rows, err := r.db.Query(`SELECT * FROM discrepancies
+		WHERE id NOT IN (SELECT discrepancy_id FROM case_members) ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	discs, err := scanDiscrepancies(rows)
+	if err != nil {
+		return nil, err
+	}
+	return discs, (&DiscrepancyRepo{db: r.db}).attachAttributions(discs)
+}
+
+// AddMember puts a discrepancy in a case, taking it out of any other, and
+// returns the case it was in before, or "".
+func (r *CaseRepo) AddMember(caseID, discID, by string, at time.Time) (string, error) {
+	var prev string
+	err := r.db.QueryRow("SELECT case_id FROM case_members WHERE discrepancy_id = ?", discID).Scan(&prev)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return "", err
+	}
+	_, err = r.db.Exec(
+		"INSERT OR REPLACE INTO case_members (discrepancy_id, case_id, added_by, added_at) VALUES (?,?,?,?)",
+		discID, caseID, by, at.Format(time.RFC3339),
+	)
+	return prev, err
+}
+
+// RemoveMember takes a discrepancy out of a case, and keeps it out of the
+// cases the reconciler opens. It returns sql.ErrNoRows when the discrepancy
+// is not in the case.
+func (r *CaseRepo) RemoveMember(caseID, discID, by string, at time.Time) error {
+	res, err := r.db.Exec(
+		"UPDATE case_members SET case_id = '', added_by = ?, added_at = ? WHERE discrepancy_id = ? AND case_id = ?",
+		by, at.Format(time.RFC3339), discID, caseID,
+	)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// MemberIDs returns the IDs of a case's discrepancies, current or not.
+func (r *CaseRepo) MemberIDs(caseID string) ([]string, error) {
+	return r.memberIDs("SELECT discrepancy_id FROM case_members WHERE case_id = ? ORDER BY discrepancy_id", caseID)
+}
+
+func (r *CaseRepo) memberIDs(query string, args ...any) ([]string, error) {
+	rows, err := r.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// ResolveMembers gives every discrepancy of a case that has no resolution
+// the one res describes, and returns their IDs. Members resolved otherwise,
+// such as in Jira, keep theirs.
+func (r *CaseRepo) ResolveMembers(caseID string, res *domain.DiscrepancyResolution) ([]string, error) {
+	ids, err := r.memberIDs(`SELECT discrepancy_id FROM case_members WHERE case_id = ?
+		AND discrepancy_id NOT IN (SELECT discrepancy_id FROM discrepancy_resolutions) ORDER BY discrepancy_id`, caseID)
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range ids {
+		if _, err := r.db.Exec(
+			`INSERT INTO discrepancy_resolutions (discrepancy_id, source, reference, status, resolved_by, resolved_at)
+			VALUES (?,?,?,?,?,?)`,
+			id, res.Source, res.Reference, res.Status, res.ResolvedBy, res.ResolvedAt.Format(time.RFC3339),
+		); err != nil {
+			return nil, err
+		}
+	}
+	return ids, nil
+}
+
+// UnresolveMembers withdraws the resolutions resolving a case gave its
+// discrepancies, including those since taken out of it, and returns their
+// IDs.
+func (r *CaseRepo) UnresolveMembers(caseID string) ([]string, error) {
+	ids, err := r.memberIDs(`SELECT discrepancy_id FROM discrepancy_resolutions
+		WHERE source = 'case' AND reference = ? ORDER BY discrepancy_id`, caseID)
+	if err != nil {
+		return nil, err
+	}
+	_, err = r.db.Exec("DELETE FROM discrepancy_resolutions WHERE source = 'case' AND reference = ?", caseID)
+	return ids, err
+}
+
+// SetResolved marks a case resolved by who, at at, with a note, or open
+// again when at is nil.
+func (r *CaseRepo) SetResolved(id, by string, at *time.Time, note string) error {
+	var resolvedAt any
+	if at != nil {
+		resolvedAt = at.Format(time.RFC3339)
+	}
+	_, err := r.db.Exec("UPDATE discrepancy_cases SET resolved_by = ?, resolved_at = ?, note = ? WHERE id = ?",
+		by, resolvedAt, note, id)
+	return err
+}
+
+func (r *CaseRepo) list(where string, args ...any) ([]domain.DiscrepancyCase, error) {
+	rows, err := r.db.Query(caseSelect+where, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	cases := []domain.DiscrepancyCase{}
+	for rows.Next() {
+		var c domain.DiscrepancyCase
+		var createdAt string
+		var resolvedAt sql.NullString
+		if err := rows.Scan(&c.ID, &c.Title, &c.GroupKey, &c.CreatedBy, &createdAt, &c.ResolvedBy, &resolvedAt, &c.Note,
+			&c.Members, &c.Current, &c.ImpactUSD); err != nil {
+			return nil, err
+		}
+		c.CreatedAt, _ = time.Parse(time.RFC3339, createdAt)
+		c.Status = domain.CaseOpen
+		if resolvedAt.Valid {
+			t, _ := time.Parse(time.RFC3339, resolvedAt.String)
+			c.ResolvedAt = &t
+			c.Status = domain.CaseResolved
+		}
+		cases = append(cases, c)
+	}
+	return cases, rows.Err()
+}
@@ -0,0 +1,203 @@
+package repository
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/wakala/reconciler/internal/domain"
+)
+
+// ErrCertificateSigned is returned when signing off a certificate that
+// already has a sign-off.
+var ErrCertificateSigned = errors.New("certificate is already signed off")
+
+type CertificateRepo struct {
+	db *sql.DB
+}
+
+func NewCertificateRepo(db *sql.DB) *CertificateRepo {
+	return &CertificateRepo{db: db}
+}
+
+// BuildContent computes the current reconciled state of a batch. It returns
+// sql.ErrNoRows when no report has that batch ID.
+func (r *CertificateRepo) BuildContent(processor, batchID string) (*domain.CertificateContent, error) {
+	c := &domain.CertificateContent{
+		Processor:        domain.Processor(processor),
+		BatchID:          batchID,
+		Reports:          []domain.CertificateReport{},
+		ExceptionsByType: map[domain.DiscrepancyType]int{},
+	}
+
+	rows, err := r.db.Query(
+		"SELECT id, file_hash, record_count FROM settlement_reports WHERE processor = ? AND batch_id = ? ORDER BY ingested_at, id",
+		processor, batchID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var rep domain.CertificateReport
+		if err := rows.Scan(&rep.ID, &rep.FileHash, &rep.RecordCount); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		c.Reports = append(c.Reports, rep)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(c.Reports) == 0 {
+		return nil, sql.ErrNoRows
+	}
+
+	// A record has at most one discrepancy (a mismatch or an orphan), but
+	// group anyway so a record is never counted twice.
+	rows, err = r.db.Query(`
+		SELECT sr.wakala_transaction_id IS NOT NULL, COALESCE(d.type, ''), COALESCE(d.impact, 0),
+			sr.usd_gross_amount, sr.usd_net_amount
+		FROM settlement_records sr
+		LEFT JOIN (
+			SELECT settlement_id, MIN(type) AS type, SUM(ABS(difference_usd)) AS impact
+			FROM discrepancies WHERE settlement_id IS NOT NULL AND settlement_id != ''
+			GROUP BY settlement_id
+		) d ON d.settlement_id = sr.id
+		WHERE sr.processor = ? AND sr.batch_id = ?
+	`, processor, batchID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var linked bool
+		var discType string
+		var impact, gross, net float64
+		if err := rows.Scan(&linked, &discType, &impact, &gross, &net); err != nil {
+			return nil, err
+		}
+		c.Records++
+		c.USDGrossAmount += gross
+		c.USDNetAmount += net
+		switch {
+		case discType != "":
+			c.Exceptions++
+			c.ExceptionsByType[domain.DiscrepancyType(discType)]++
+			c.ExceptionImpactUSD += impact
+		case linked:
+			c.Matched++
+		default:
+			c.Unreconciled++
+		}
+	}
+	return c, rows.Err()
+}
+
+// Insert stores a generated certificate.
+func (r *CertificateRepo) Insert(c *domain.BatchCertificate) error {
+	content, err := json.Marshal(c.CertificateContent)
+	if err != nil {
+		return err
+	}
+	_, err = r.db.Exec(
+		`INSERT INTO batch_certificates
+		(id, processor, batch_id, content_hash, content_json, generated_by, generated_at)
+		VALUES (?,?,?,?,?,?,?)`,
+		c.ID, string(c.Processor), c.BatchID, c.ContentHash, string(content),
+		c.GeneratedBy, c.GeneratedAt.Format(time.RFC3339),
+	)
+	return err
+}
+
+const certificateSelect = `
+	SELECT c.id, c.content_hash, c.content_json, c.generated_by, c.generated_at,
+		s.user_id, s.comment, s.signed_at
+	FROM batch_certificates c
+	LEFT JOIN certificate_signoffs s ON s.certificate_id = c.id`
+
+// GetByID returns a certificate with its sign-off. It returns sql.ErrNoRows
+// when absent.
+func (r *CertificateRepo) GetByID(id string) (*domain.BatchCertificate, error) {
+	certs, err := r.query(certificateSelect+" WHERE c.id = ?", id)
+	if err != nil {
+		return nil, err
+	}
+	if len(certs) == 0 {
+		return nil, sql.ErrNoRows
+	}
+	return &certs[0], nil
+}
+
+// FindByHash returns the batch's certificate with the given content hash.
+// It returns sql.ErrNoRows when none has been generated.
+func (r *CertificateRepo) FindByHash(processor, batchID, hash string) (*domain.BatchCertificate, error) {
+	certs, err := r.query(
+		certificateSelect+" WHERE c.processor = ? AND c.batch_id = ? AND c.content_hash = ? ORDER BY c.generated_at LIMIT 1",
+		processor, batchID, hash,
+	)
+	if err != nil {
+		return nil, err
+	}
+	if len(certs) == 0 {
+		return nil, sql.ErrNoRows
+	}
+	return &certs[0], nil
+}
+
+// ListByBatch returns a batch's certificates, newest first.
+func (r *CertificateRepo) ListByBatch(processor, batchID string) ([]domain.BatchCertificate, error) {
+	return r.query(
+		certificateSelect+" WHERE c.processor = ? AND c.batch_id = ? ORDER BY c.generated_at DESC, c.id DESC",
+		processor, batchID,
+	)
+}
+
+// SignOff records the approval of a certificate. It returns
+// ErrCertificateSigned if the certificate already has one.
+func (r *CertificateRepo) SignOff(id string, s *domain.CertificateSignOff) error {
+	res, err := r.db.Exec(
+		"INSERT OR IGNORE INTO certificate_signoffs (certificate_id, user_id, comment, signed_at) VALUES (?,?,?,?)",
+		id, s.UserID, s.Comment, s.SignedAt.Format(time.RFC3339),
+	)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrCertificateSigned
+	}
+	return nil
+}
+
+func (r *CertificateRepo) query(q string, args ...any) ([]domain.BatchCertificate, error) {
+	rows, err := r.db.Query(q, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	certs := []domain.BatchCertificate{}
+	for rows.Next() {
+		var c domain.BatchCertificate
+		var content, generatedAt string
+		var signUser, signComment, signedAt sql.NullString
+		err := rows.Scan(&c.ID, &c.ContentHash, &content, &c.GeneratedBy, &generatedAt,
+			&signUser, &signComment, &signedAt)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal([]byte(content), &c.CertificateContent); err != nil {
+			return nil, fmt.Errorf("certificate %s content: %w", c.ID, err)
+		}
+		c.GeneratedAt, _ = time.Parse(time.RFC3339, generatedAt)
+		if signUser.Valid {
+			c.SignOff = &domain.CertificateSignOff{UserID: signUser.String, Comment: signComment.String}
+			c.SignOff.SignedAt, _ = time.Parse(time.RFC3339, signedAt.String)
+		}
+		certs = append(certs, c)
+	}
+	return certs, rows.Err()
+}
@@ -0,0 +1,253 @@
+package repository
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// Processor references are encrypted at rest when column encryption keys
+// are configured. A sealed value is stored in place of the plaintext as
+//
+//	enc1:<key id>:<base64url(nonce || AES-256-GCM ciphertext)>
+//
+// The nonce is an HMAC of the plaintext, so a value always seals to the
+// same ciphertext under the same key. That is what keeps the unique
+// reference index, equality lookups and matching working on encrypted
+// columns; the cost is that equal references are visibly equal in the
+// file. Values without the prefix are plaintext written before encryption
+// was enabled and are read as they are.
+const sealedPrefix = "enc1:"
+
+// encryptedColumns are the columns sealed with the column cipher. chunk is
+// how many values rotation reads at a time, streamChunk when zero; whole
+// report files are rotated a few at a time.
+//
+// Merchant IDs are deliberately left out. transactions.merchant_id and its
+// copies in discrepancy_attributions, open_discrepancy_snapshots,
+// payout_holds, merchant_tolerances, routing_rules and dashboard_views are
+// grouped, sorted and joined on in SQL, and shown in dashboards and
+// exports; sealed values would keep only equality. The parsers ignore the
+// merchant reference columns of processor reports, so the sealed report
+// file is the only place they are kept.
+var encryptedColumns = []struct {
+	table, column string
+	chunk         int
+}{
+	{table: "transactions", column: "processor_reference"},
+	{table: "settlement_records", column: "processor_transaction_id"},
+	{table: "quarantined_transactions", column: "processor_reference"},
+	{table: "quarantined_transactions", column: "payload"},
+	{table: "report_files", column: "data", chunk: 8},
+}
+
+var columnKeyIDPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,32}$`)
+
+// ColumnKey is a 32-byte column encryption key and the ID stored with the
+// values it seals.
+type ColumnKey struct {
+	ID     string
+	Secret []byte
+}
+
+type columnKey struct {
+	id   string
+	aead cipher.AEAD
+	// nonceKey derives nonces. It and the AES key are derived separately
+	// from the secret so that no key is used by two primitives.
+	nonceKey []byte
+}
+
+// ColumnCipher seals and opens encrypted column values. The first key is
+// the active one that new values are sealed with; the others are retired
+// keys that are still read until RotateColumnKeys has re-encrypted their
+// values.
+type ColumnCipher struct {
+	keys []*columnKey
+	byID map[string]*columnKey
+}
+
+// NewColumnCipher creates a cipher whose active key is keys[0].
+func NewColumnCipher(keys []ColumnKey) (*ColumnCipher, error) {
+	if len(keys) == 0 {
+		return nil, errors.New("no column encryption keys")
+	}
+	c := &ColumnCipher{byID: make(map[string]*columnKey)}
+	for _, k := range keys {
+		if !columnKeyIDPattern.MatchString(k.ID) {
+			return nil, fmt.Errorf("key ID %q must be 1-32 letters, digits, '-' or '_'", k.ID)
+		}
+		if len(k.Secret) != 32 {
+			return nil, fmt.Errorf("key %s must be 32 bytes, got %d", k.ID, len(k.Secret))
+		}
+		if _, dup := c.byID[k.ID]; dup {
+			return nil, fmt.Errorf("key %s is listed twice", k.ID)
+		}
+		block, err := aes.NewCipher(deriveKey(k.Secret, "column encryption"))
+		if err != nil {
+			return nil, err
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		ck := &columnKey{id: k.ID, aead: aead, nonceKey: deriveKey(k.Secret, "column nonce")}
+		c.keys = append(c.keys, ck)
+		c.byID[k.ID] = ck
+	}
+	return c, nil
+}
+
+func deriveKey(secret []byte, purpose string) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte("wakala " + purpose))
+	return mac.Sum(nil)
+}
+
+// ActiveKeyID returns the ID of the key new values are sealed with.
+func (c *ColumnCipher) ActiveKeyID() string { return c.keys[0].id }
+
+func (c *ColumnCipher) seal(k *columnKey, v string) string {
+	mac := hmac.New(sha256.New, k.nonceKey)
+	mac.Write([]byte(v))
+	nonce := mac.Sum(nil)[:k.aead.NonceSize()]
+	sealed := k.aead.Seal(nonce, nonce, []byte(v), nil)
+	return sealedPrefix + k.id + ":" + base64.RawURLEncoding.EncodeToString(sealed)
+}
+
+// open returns the plaintext of a stored value and the ID of the key it was
+// sealed with, which is "" for a plaintext value.
+func (c *ColumnCipher) open(v string) (string, string, error) {
+	rest, ok := strings.CutPrefix(v, sealedPrefix)
+	if !ok {
+		return v, "", nil
+	}
+	id, data, ok := strings.Cut(rest, ":")
+	if !ok {
+		return "", "", errors.New("malformed encrypted value")
+	}
+	if c == nil {
+		return "", id, fmt.Errorf("value is encrypted with key %s but column encryption is not configured", id)
+	}
+	k, ok := c.byID[id]
+	if !ok {
+		return "", id, fmt.Errorf("value is encrypted with unknown key %s", id)
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(data)
+	if err != nil || len(raw) < k.aead.NonceSize() {
+		return "", id, errors.New("malformed encrypted value")
+	}
+	plain, err := k.aead.Open(nil, raw[:k.aead.NonceSize()], raw[k.aead.NonceSize():], nil)
+	if err != nil {
+		return "", id, fmt.Errorf("decrypt value sealed with key %s: %w", id, err)
+	}
+	return string(plain), id, nil
+}
+
+// columnCipher is the cipher used by every repository. It is set once at
+// startup by SetColumnCipher; nil stores values in plaintext.
+var columnCipher *ColumnCipher
+
+// SetColumnCipher enables column encryption. It must be called before
+// InitDB, which may already move transactions to the quarantine.
+func SetColumnCipher(c *ColumnCipher) {
+	columnCipher = c
+}
+
+// sealColumn returns v as it is stored in an encrypted column.
+func sealColumn(v string) string {
+	if columnCipher == nil {
+		return v
+	}
+	return columnCipher.seal(columnCipher.keys[0], v)
+}
+
+// activeColumnKeyID returns the ID of the key sealColumn seals with, or ""
+// when values are stored in plaintext.
+func activeColumnKeyID() string {
+	if columnCipher == nil {
+		return ""
+	}
+	return columnCipher.ActiveKeyID()
+}
+
+// openColumn returns the plaintext of a value read from an encrypted column.
+func openColumn(v string) (string, error) {
+	plain, _, err := columnCipher.open(v)
+	return plain, err
+}
+
+// columnLookups returns every form v may be stored in: sealed with the
+// active key, then with each retired key, then as plaintext. Lookups by an
+// encrypted column must match any of them until rotation has finished.
+func columnLookups(v string) []string {
+	if columnCipher == nil {
+		return []string{v}
+	}
+	forms := make([]string, 0, len(columnCipher.keys)+1)
+	for _, k := range columnCipher.keys {
+		forms = append(forms, columnCipher.seal(k, v))
+	}
+	return append(forms, v)
+}
+
+// ColumnKeysFromEnv reads the column encryption keys from
+// COLUMN_ENCRYPTION_KEYS, a comma-separated list of id:base64-key entries
+// such as "2026b:...,2026a:...", or from the file named by
+// COLUMN_ENCRYPTION_KEYS_FILE, one entry per line, which is where a KMS or
+// secrets agent would write them. The first key is the active one. Keys
+// are 32 random bytes, e.g. from `openssl rand -base64 32`. It returns nil
+// when neither is set.
+func ColumnKeysFromEnv() ([]ColumnKey, error) {
+	inline := os.Getenv("COLUMN_ENCRYPTION_KEYS")
+	path := os.Getenv("COLUMN_ENCRYPTION_KEYS_FILE")
+	var entries []string
+	switch {
+	case inline != "" && path != "":
+		return nil, errors.New("set only one of COLUMN_ENCRYPTION_KEYS and COLUMN_ENCRYPTION_KEYS_FILE")
+	case inline != "":
+		entries = strings.Split(inline, ",")
+	case path != "":
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, fmt.Errorf("read COLUMN_ENCRYPTION_KEYS_FILE: %w", err)
+		}
+		defer f.Close()
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			if line := strings.TrimSpace(scanner.Text()); line != "" && !strings.HasPrefix(line, "#") {
+				entries = append(entries, line)
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, fmt.Errorf("read COLUMN_ENCRYPTION_KEYS_FILE: %w", err)
+		}
+		if len(entries) == 0 {
+			return nil, fmt.Errorf("COLUMN_ENCRYPTION_KEYS_FILE %s has no keys", path)
+		}
+	default:
+		return nil, nil
+	}
+
+	keys := make([]ColumnKey, 0, len(entries))
+	for _, entry := range entries {
+		id, encoded, ok := strings.Cut(strings.TrimSpace(entry), ":")
+		if !ok {
+			return nil, fmt.Errorf("column encryption key entries must be id:base64-key, got one with no ':'")
+		}
+		secret, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+		if err != nil {
+			return nil, fmt.Errorf("column encryption key %s is not valid base64", id)
+		}
+		keys = append(keys, ColumnKey{ID: strings.TrimSpace(id), Secret: secret})
+	}
+	return keys, nil
+}
@@ -0,0 +1,59 @@
+package repository
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/wakala/reconciler/internal/domain"
+)
+
+type ConnectorRepo struct {
+	db *sql.DB
+}
+
+func NewConnectorRepo(db *sql.DB) *ConnectorRepo {
+	return &ConnectorRepo{db: db}
+}
+
+// Get returns a connector's saved state. It returns sql.ErrNoRows when the
+// connector has never run.
+func (r *ConnectorRepo) Get(name string) (*domain.ConnectorState, error) {
+	var st domain.ConnectorState
+	var proc string
+	var lastRun, lastSuccess sql.NullString
+	err := r.db.QueryRow(
+		"SELECT * FROM connector_state WHERE name = ?", name,
+	).Scan(&st.Name, &proc, &st.Cursor, &lastRun, &lastSuccess, &st.LastError, &st.RecordsPulled)
+	if err != nil {
+		return nil, err
+	}
+	st.Processor = domain.Processor(proc)
+	if lastRun.Valid {
+		t, _ := time.Parse(time.RFC3339, lastRun.String)
+		st.LastRunAt = &t
+	}
+	if lastSuccess.Valid {
+		t, _ := time.Parse(time.RFC3339, lastSuccess.String)
+		st.LastSuccessAt = &t
+	}
+	return &st, nil
+}
+
+// Save inserts or replaces a connector's state.
+func (r *ConnectorRepo) Save(st *domain.ConnectorState) error {
+	_, err := r.db.Exec(
+		`INSERT INTO connector_state
+		(name, processor, cursor, last_run_at, last_success_at, last_error, records_pulled)
+		VALUES (?,?,?,?,?,?,?)
+		ON CONFLICT(name) DO UPDATE SET
+			processor = excluded.processor,
+			cursor = excluded.cursor,
+			last_run_at = excluded.last_run_at,
+			last_success_at = excluded.last_success_at,
+			last_error = excluded.last_error,
+			records_pulled = excluded.records_pulled`,
+		st.Name, string(st.Processor), st.Cursor, formatNullableTime(st.LastRunAt),
+		formatNullableTime(st.LastSuccessAt), st.LastError, st.RecordsPulled,
+	)
+	return err
+}
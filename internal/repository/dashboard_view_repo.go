@@ -0,0 +1,261 @@
+package repository
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/wakala/reconciler/internal/domain"
+)
+
+// ErrDuplicateViewName is returned by Insert and Update when the user already
+// has another view with the same name.
+var ErrDuplicateViewName = errors.New("a dashboard view with this name already exists")
+
+type DashboardViewRepo struct {
+	db *sql.DB
+}
+
+func NewDashboardViewRepo(db *sql.DB) *DashboardViewRepo {
+	return &DashboardViewRepo{db: db}
+}
+
+// Insert stores a new view. A default view replaces the user's previous
+// default in the same transaction.
+func (r *DashboardViewRepo) Insert(v *domain.DashboardView) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := checkViewName(tx, v); err != nil {
+		return err
+	}
+	if v.Default {
+		if err := clearDefaultView(tx, v.UserID); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.Exec(
+		`INSERT INTO dashboard_views (id, user_id, name, processors, currencies, merchant_id,
+			date_from, date_to, last_days, is_default, created_at, updated_at)
+		VALUES (?,?,?,?,?,?,?,?,?,?,?,?)`,
+		v.ID, v.UserID, v.Name, strings.Join(v.Processors, ","), strings.Join(v.Currencies, ","), v.MerchantID,
+		v.From, v.To, v.LastDays, v.Default, v.CreatedAt.Format(time.RFC3339), v.UpdatedAt.Format(time.RFC3339),
+	); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Update replaces a view owned by v.UserID, keeping its creation time. It
+// returns sql.ErrNoRows when no such view exists.
+func (r *DashboardViewRepo) Update(v *domain.DashboardView) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := checkViewName(tx, v); err != nil {
+		return err
+	}
+	if v.Default {
+		if err := clearDefaultView(tx, v.UserID); err != nil {
+			return err
+		}
+	}
+	res, err := tx.Exec(
+		`UPDATE dashboard_views SET name = ?, processors = ?, currencies = ?, merchant_id = ?,
+			date_from = ?, date_to = ?, last_days = ?, is_default = ?, updated_at = ?
+		WHERE id = ? AND user_id = ?`,
+		v.Name, strings.Join(v.Processors, ","), strings.Join(v.Currencies, ","), v.MerchantID,
+		v.From, v.To, v.LastDays, v.Default, v.UpdatedAt.Format(time.RFC3339), v.ID, v.UserID,
+	)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return tx.Commit()
+}
+
+func checkViewName(tx *sql.Tx, v *domain.DashboardView) error {
+	var n int
+	if err := tx.QueryRow("SELECT COUNT(*) FROM dashboard_views WHERE user_id = ? AND name = ? AND id != ?",
+		v.UserID, v.Name, v.ID).Scan(&n); err != nil {
+		return err
+	}
+	if n > 0 {
+		return ErrDuplicateViewName
+	}
+	return nil
+}
+
+func clearDefaultView(tx *sql.Tx, userID string) error {
+	_, err := tx.Exec("UPDATE dashboard_views SET is_default = 0 WHERE user_id = ? AND is_default = 1", userID)
+	return err
+}
+
+// ListByUser returns a user's views, the default first and the rest by name.
+func (r *DashboardViewRepo) ListByUser(userID string) ([]domain.DashboardView, error) {
+	rows, err := r.db.Query(
+		"SELECT * FROM dashboard_views WHERE user_id = ? ORDER BY is_default DESC, name", userID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	views := []domain.DashboardView{}
+	for rows.Next() {
+		v, err := scanDashboardView(rows)
+		if err != nil {
+			return nil, err
+		}
+		views = append(views, *v)
+	}
+	return views, rows.Err()
+}
+
+// GetForUser returns a single view owned by the given user.
+func (r *DashboardViewRepo) GetForUser(id, userID string) (*domain.DashboardView, error) {
+	return scanDashboardView(r.db.QueryRow(
+		"SELECT * FROM dashboard_views WHERE id = ? AND user_id = ?", id, userID,
+	))
+}
+
+// DefaultForUser returns the user's default view, or sql.ErrNoRows when they
+// have none.
+func (r *DashboardViewRepo) DefaultForUser(userID string) (*domain.DashboardView, error) {
+	return scanDashboardView(r.db.QueryRow(
+		"SELECT * FROM dashboard_views WHERE user_id = ? AND is_default = 1", userID,
+	))
+}
+
+// DeleteForUser removes a view owned by the given user. It returns
+// sql.ErrNoRows when no such view exists.
+func (r *DashboardViewRepo) DeleteForUser(id, userID string) error {
+	res, err := r.db.Exec("DELETE FROM dashboard_views WHERE id = ? AND user_id = ?", id, userID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+func scanDashboardView(row interface{ Scan(...any) error }) (*domain.DashboardView, error) {
+	var v domain.DashboardView
+	var processors, currencies, createdAt, updatedAt string
+	if err := row.Scan(&v.ID, &v.UserID, &v.Name, &processors, &currencies, &v.MerchantID,
+		&v.From, &v.To, &v.LastDays, &v.Default, &createdAt, &updatedAt); err != nil {
+		return nil, err
+	}
+	v.Processors = splitList(processors)
+	v.Currencies = splitList(currencies)
+	v.CreatedAt, _ = time.Parse(time.RFC3339, createdAt)
+	v.UpdatedAt, _ = time.Parse(time.RFC3339, updatedAt)
+	return &v, nil
+}
+
+func splitList(s string) []string {
+	if s == "" {
+		return []string{}
+	}
+	return strings.Split(s, ",")
+}
+
+// DashboardScope narrows the dashboard figures. The zero value covers
+// everything. From and To bound transaction creation times, To exclusive;
+// a discrepancy is dated by its transaction, or by its settlement record
+// when it has none.
+type DashboardScope struct {
+	Processors []string
+	Currencies []string
+	MerchantID string
+	From, To   *time.Time
+}
+
+// transactionWhere returns the WHERE clause, empty for the zero scope, and
+// its arguments for a query over transactions.
+func (s DashboardScope) transactionWhere() (string, []any) {
+	var clauses []string
+	var args []any
+	if len(s.Processors) > 0 {
+		clauses = append(clauses, "processor IN ("+placeholders(len(s.Processors))+")")
+		args = appendStrings(args, s.Processors)
+	}
+	if len(s.Currencies) > 0 {
+		clauses = append(clauses, "currency IN ("+placeholders(len(s.Currencies))+")")
+		args = appendStrings(args, s.Currencies)
+	}
+	if s.MerchantID != "" {
+		clauses = append(clauses, "merchant_id = ?")
+		args = append(args, s.MerchantID)
+	}
+	if s.From != nil {
+		clauses = append(clauses, "created_at >= ?")
+		args = append(args, s.From.UTC().Format(time.RFC3339))
+	}
+	if s.To != nil {
+		clauses = append(clauses, "created_at < ?")
+		args = append(args, s.To.UTC().Format(time.RFC3339))
+	}
+	return whereClause(clauses), args
+}
+
+// discrepancyWhere is transactionWhere for a query over discrepancies d.
+func (s DashboardScope) discrepancyWhere() (string, []any) {
+	var clauses []string
+	var args []any
+	if len(s.Processors) > 0 {
+		clauses = append(clauses, "d.processor IN ("+placeholders(len(s.Processors))+")")
+		args = appendStrings(args, s.Processors)
+	}
+	if len(s.Currencies) > 0 {
+		clauses = append(clauses, "d.currency IN ("+placeholders(len(s.Currencies))+")")
+		args = appendStrings(args, s.Currencies)
+	}
+	if s.MerchantID != "" {
+		clauses = append(clauses, "d.id IN (SELECT discrepancy_id FROM discrepancy_attributions WHERE merchant_id = ?)")
+		args = append(args, s.MerchantID)
+	}
+	if s.From != nil {
+		clauses = append(clauses, discrepancyDateSQL+" >= ?")
+		args = append(args, s.From.UTC().Format(time.RFC3339))
+	}
+	if s.To != nil {
+		clauses = append(clauses, discrepancyDateSQL+" < ?")
+		args = append(args, s.To.UTC().Format(time.RFC3339))
+	}
+	return whereClause(clauses), args
+}
+
+// discrepancyDateSQL dates a discrepancy d by its transaction's creation
+// time, or its settlement record's date when it has no transaction.
+const discrepancyDateSQL = `COALESCE(
+	(SELECT t.created_at FROM transactions t WHERE t.id = d.transaction_id),
+	(SELECT sr.settlement_date FROM settlement_records sr WHERE sr.id = d.settlement_id))`
+
+func placeholders(n int) string {
+	return strings.TrimSuffix(strings.Repeat("?,", n), ",")
+}
+
+func appendStrings(args []any, values []string) []any {
+	for _, v := range values {
+		args = append(args, v)
+	}
+	return args
+}
+
+func whereClause(clauses []string) string {
+	if len(clauses) == 0 {
+		return ""
+	}
+	return " WHERE " + strings.Join(clauses, " AND ")
+}
@@ -0,0 +1,43 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// DataVersion tells whether the database changed since it was last asked,
+// without reading any table. It holds one connection of the pool that never
+// writes, on which SQLite's data_version changes whenever any other
+// connection, in this process or another, commits.
+type DataVersion struct {
+	mu   sync.Mutex
+	conn *sql.Conn
+	// epoch tells this DataVersion's values from those of earlier processes,
+	// which count from the same start.
+	epoch int64
+}
+
+// NewDataVersion takes a connection from db for the lifetime of the
+// process.
+func NewDataVersion(db *sql.DB) (*DataVersion, error) {
+	conn, err := db.Conn(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	return &DataVersion{conn: conn, epoch: time.Now().UnixNano()}, nil
+}
+
+// Current returns a version that changes whenever a write to the database
+// is committed. Versions read by different processes never compare equal.
+func (v *DataVersion) Current() (string, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	var n int64
+	if err := v.conn.QueryRowContext(context.Background(), "PRAGMA data_version").Scan(&n); err != nil {
+		return "", fmt.Errorf("data_version: %w", err)
+	}
+	return fmt.Sprintf("%d.%d", v.epoch, n), nil
+}
@@ -3,14 +3,32 @@ package repository
 import (
 	"database/sql"
 	"fmt"
+	"strings"
+	"sync/atomic"
 
 	_ "modernc.org/sqlite"
 )
 
+// memDBSeq names in-memory databases so each InitDB(":memory:") gets its own.
+var memDBSeq atomic.Int64
+
 // InitDB opens (or creates) a SQLite database at the given path and ensures
 // all required tables exist. Pass ":memory:" for an in-memory database.
 func InitDB(dsn string) (*sql.DB, error) {
-	db, err := sql.Open("sqlite", dsn)
+	// A plain ":memory:" DSN gives every pooled connection its own empty
+	// database. A named memdb database is shared by all connections of the
+	// pool and locks like a file, and is gone when the pool closes.
+	if dsn == ":memory:" {
+		dsn = fmt.Sprintf("file:/wakala-%d?vfs=memdb", memDBSeq.Add(1))
+	}
+
+	// busy_timeout is applied via the DSN so every pooled connection waits
+	// for the write lock instead of failing with SQLITE_BUSY when concurrent
+	// requests write at once. Transactions begin IMMEDIATE, taking the write
+	// lock up front: a deferred one that reads and then writes, such as an
+	// amendment reading the next version, would otherwise fail with
+	// SQLITE_BUSY rather than wait when another writer got there first.
+	db, err := sql.Open("sqlite", withPragmas(dsn, "busy_timeout(5000)", "foreign_keys(1)")+"&_txlock=immediate")
 	if err != nil {
 		return nil, fmt.Errorf("open db: %w", err)
 	}
@@ -34,6 +52,36 @@ func InitDB(dsn string) (*sql.DB, error) {
 	return db, nil
 }
 
+// OpenReadOnly opens a second, read-only connection pool to an existing
+// SQLite database so dashboard and analytics queries do not compete with
+// ingestion writes. query_only is applied via the DSN so that every pooled
+// connection gets it, not just the first.
+func OpenReadOnly(dsn string) (*sql.DB, error) {
+	db, err := sql.Open("sqlite", withPragmas(dsn, "query_only(1)", "busy_timeout(5000)"))
+	if err != nil {
+		return nil, fmt.Errorf("open read-only db: %w", err)
+	}
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("ping read-only db: %w", err)
+	}
+	return db, nil
+}
+
+// withPragmas appends _pragma DSN parameters, which the driver applies to
+// each new connection.
+func withPragmas(dsn string, pragmas ...string) string {
+	sep := "?"
+	if strings.Contains(dsn, "?") {
+		sep = "&"
+	}
+	for _, p := range pragmas {
+		dsn += sep + "_pragma=" + p
+		sep = "&"
+	}
+	return dsn
+}
+
 func createTables(db *sql.DB) error {
 	stmts := []string{
 		`CREATE TABLE IF NOT EXISTS transactions (
@@ -52,9 +100,68 @@ func createTables(db *sql.DB) error {
 			settled_at DATETIME
 		)`,
 		`CREATE INDEX IF NOT EXISTS idx_transactions_processor ON transactions(processor)`,
-		`CREATE INDEX IF NOT EXISTS idx_transactions_status ON transactions(status)`,
-		`CREATE INDEX IF NOT EXISTS idx_transactions_processor_ref ON transactions(processor_reference)`,
 		`CREATE INDEX IF NOT EXISTS idx_transactions_created_at ON transactions(created_at)`,
+		// Missing-settlement detection ranges over captured transactions by
+		// capture time. It replaces a status-only index.
+		`DROP INDEX IF EXISTS idx_transactions_status`,
+		`CREATE INDEX IF NOT EXISTS idx_transactions_status_captured ON transactions(status, captured_at)`,
+		// Matching looks transactions up by processor and reference; the
+		// unique index is created by ensureUniqueProcessorRefs.
+		`DROP INDEX IF EXISTS idx_transactions_processor_ref`,
+
+		// Transactions moved out of the ledger because their processor
+		// reference was already taken; see ensureUniqueProcessorRefs.
+		// payload is the transaction and its amendments as JSON.
+		`CREATE TABLE IF NOT EXISTS quarantined_transactions (
+			id TEXT PRIMARY KEY,
+			processor TEXT NOT NULL,
+			processor_reference TEXT NOT NULL,
+			kept_id TEXT NOT NULL,
+			quarantined_at DATETIME NOT NULL,
+			payload TEXT NOT NULL
+		)`,
+
+		// Transactions that are not inbound collections. A transaction with
+		// no row here is inbound.
+		`CREATE TABLE IF NOT EXISTS transaction_directions (
+			transaction_id TEXT PRIMARY KEY,
+			direction TEXT NOT NULL
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_transaction_directions_direction ON transaction_directions(direction)`,
+
+		// The legs of cross-border transfers. A transfer has at most one leg
+		// per role.
+		`CREATE TABLE IF NOT EXISTS transfer_legs (
+			transaction_id TEXT PRIMARY KEY,
+			transfer_id TEXT NOT NULL,
+			role TEXT NOT NULL,
+			UNIQUE (transfer_id, role)
+		)`,
+
+		// Reconciliation status of each transaction as of the last run that
+		// saw it. A transaction with no row here is unreconciled.
+		`CREATE TABLE IF NOT EXISTS transaction_reconciliation (
+			transaction_id TEXT PRIMARY KEY,
+			status TEXT NOT NULL
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_transaction_reconciliation_status ON transaction_reconciliation(status)`,
+
+		`CREATE TABLE IF NOT EXISTS transaction_amendments (
+			id TEXT PRIMARY KEY,
+			transaction_id TEXT NOT NULL,
+			version INTEGER NOT NULL,
+			event_id TEXT NOT NULL DEFAULT '',
+			reason TEXT NOT NULL,
+			previous_amount REAL NOT NULL,
+			previous_usd_amount REAL NOT NULL,
+			amount REAL NOT NULL,
+			usd_amount REAL NOT NULL,
+			amended_at DATETIME NOT NULL,
+			recorded_at DATETIME NOT NULL,
+			UNIQUE (transaction_id, version),
+			FOREIGN KEY (transaction_id) REFERENCES transactions(id)
+		)`,
+		`CREATE UNIQUE INDEX IF NOT EXISTS idx_transaction_amendments_event ON transaction_amendments(transaction_id, event_id) WHERE event_id != ''`,
 
 		`CREATE TABLE IF NOT EXISTS settlement_reports (
 			id TEXT PRIMARY KEY,
@@ -66,6 +173,134 @@ func createTables(db *sql.DB) error {
 			ingested_at DATETIME NOT NULL
 		)`,
 		`CREATE INDEX IF NOT EXISTS idx_settlement_reports_processor ON settlement_reports(processor)`,
+		`CREATE INDEX IF NOT EXISTS idx_settlement_reports_batch ON settlement_reports(processor, batch_id)`,
+
+		`CREATE TABLE IF NOT EXISTS settlement_corrections (
+			id TEXT PRIMARY KEY,
+			settlement_id TEXT NOT NULL,
+			user_id TEXT NOT NULL,
+			reason TEXT NOT NULL,
+			before_json TEXT NOT NULL,
+			after_json TEXT NOT NULL,
+			created_at DATETIME NOT NULL,
+			FOREIGN KEY (settlement_id) REFERENCES settlement_records(id)
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_settlement_corrections_settlement ON settlement_corrections(settlement_id)`,
+
+		// Reviewers' decisions on match suggestions for orphaned records,
+		// with the score and features each suggestion had. An accepted pair
+		// is a match by hand, kept when the references disagree.
+		`CREATE TABLE IF NOT EXISTS suggestion_feedback (
+			settlement_id TEXT NOT NULL,
+			transaction_id TEXT NOT NULL,
+			processor TEXT NOT NULL,
+			decision TEXT NOT NULL,
+			score REAL NOT NULL,
+			amount_score REAL NOT NULL,
+			time_score REAL NOT NULL,
+			merchant_score REAL NOT NULL,
+			reference_score REAL NOT NULL,
+			user_id TEXT NOT NULL,
+			note TEXT NOT NULL DEFAULT '',
+			decided_at DATETIME NOT NULL,
+			PRIMARY KEY (settlement_id, transaction_id)
+		)`,
+
+		// Original uploaded files, once per file, and the reports stored from
+		// each. data is sealed like the processor reference columns, since
+		// the file holds the same references.
+		`CREATE TABLE IF NOT EXISTS report_files (
+			hash TEXT PRIMARY KEY,
+			filename TEXT NOT NULL,
+			size INTEGER NOT NULL,
+			data TEXT NOT NULL,
+			stored_at DATETIME NOT NULL
+		)`,
+		`CREATE TABLE IF NOT EXISTS report_file_links (
+			report_id TEXT PRIMARY KEY,
+			file_hash TEXT NOT NULL,
+			FOREIGN KEY (report_id) REFERENCES settlement_reports(id),
+			FOREIGN KEY (file_hash) REFERENCES report_files(hash)
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_report_file_links_file ON report_file_links(file_hash)`,
+		// Files kept in a blob store rather than in report_files.data, and
+		// the column key their object is sealed with ('' for plaintext).
+		`CREATE TABLE IF NOT EXISTS report_file_blobs (
+			hash TEXT PRIMARY KEY REFERENCES report_files(hash),
+			key TEXT NOT NULL,
+			key_id TEXT NOT NULL DEFAULT ''
+		)`,
+		// Blobs of purged files still to delete from the store. Like leases
+		// they describe the store rather than the data, so resets and
+		// snapshot restores leave them.
+		`CREATE TABLE IF NOT EXISTS blob_deletions (
+			key TEXT PRIMARY KEY,
+			requested_at DATETIME NOT NULL
+		)`,
+		// Queued ingestion jobs that failed their last attempt. The file is
+		// kept in report_files, linked to no report, while the dead letter
+		// is open.
+		`CREATE TABLE IF NOT EXISTS ingest_dead_letters (
+			id TEXT PRIMARY KEY,
+			processor TEXT NOT NULL,
+			format TEXT NOT NULL,
+			backfill INTEGER NOT NULL DEFAULT 0,
+			file_hash TEXT NOT NULL,
+			filename TEXT NOT NULL,
+			sidecars TEXT NOT NULL DEFAULT '[]',
+			provenance TEXT NOT NULL DEFAULT '',
+			error TEXT NOT NULL,
+			attempts INTEGER NOT NULL,
+			submitted_at DATETIME NOT NULL,
+			failed_at DATETIME NOT NULL,
+			status TEXT NOT NULL,
+			resolved_at DATETIME,
+			resolved_by TEXT NOT NULL DEFAULT '',
+			retry_job_id TEXT NOT NULL DEFAULT ''
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_ingest_dead_letters_status ON ingest_dead_letters(status, failed_at)`,
+		`CREATE TABLE IF NOT EXISTS report_provenance (
+			report_id TEXT PRIMARY KEY,
+			source TEXT NOT NULL,
+			mailbox TEXT NOT NULL,
+			message_id TEXT NOT NULL,
+			sender TEXT NOT NULL,
+			subject TEXT NOT NULL,
+			received_at DATETIME NOT NULL,
+			rule TEXT NOT NULL,
+			FOREIGN KEY (report_id) REFERENCES settlement_reports(id)
+		)`,
+		`CREATE TABLE IF NOT EXISTS report_verifications (
+			report_id TEXT PRIMARY KEY,
+			status TEXT NOT NULL,
+			method TEXT NOT NULL,
+			sidecar TEXT NOT NULL,
+			signer TEXT NOT NULL,
+			checked_at DATETIME NOT NULL,
+			FOREIGN KEY (report_id) REFERENCES settlement_reports(id)
+		)`,
+		`CREATE TABLE IF NOT EXISTS report_control_totals (
+			report_id TEXT PRIMARY KEY,
+			line INTEGER NOT NULL,
+			gross REAL NOT NULL,
+			fee REAL NOT NULL,
+			net REAL NOT NULL,
+			parsed_gross REAL NOT NULL,
+			parsed_fee REAL NOT NULL,
+			parsed_net REAL NOT NULL,
+			matched INTEGER NOT NULL,
+			FOREIGN KEY (report_id) REFERENCES settlement_reports(id)
+		)`,
+
+		`CREATE TABLE IF NOT EXISTS report_warnings (
+			report_id TEXT NOT NULL,
+			seq INTEGER NOT NULL,
+			line INTEGER NOT NULL,
+			kind TEXT NOT NULL,
+			message TEXT NOT NULL,
+			PRIMARY KEY (report_id, seq),
+			FOREIGN KEY (report_id) REFERENCES settlement_reports(id)
+		)`,
 
 		`CREATE TABLE IF NOT EXISTS settlement_records (
 			id TEXT PRIMARY KEY,
@@ -86,6 +321,30 @@ func createTables(db *sql.DB) error {
 		`CREATE INDEX IF NOT EXISTS idx_settlement_records_report ON settlement_records(report_id)`,
 		`CREATE INDEX IF NOT EXISTS idx_settlement_records_proc_txn ON settlement_records(processor_transaction_id)`,
 		`CREATE INDEX IF NOT EXISTS idx_settlement_records_wakala_txn ON settlement_records(wakala_transaction_id)`,
+		`CREATE INDEX IF NOT EXISTS idx_settlement_records_batch_txn ON settlement_records(processor, batch_id, processor_transaction_id)`,
+
+		// Penalty and adjustment rows, classified by adjustment code. They are
+		// settlement records but never match a transaction.
+		`CREATE TABLE IF NOT EXISTS settlement_adjustments (
+			settlement_id TEXT PRIMARY KEY,
+			code TEXT NOT NULL,
+			category TEXT NOT NULL
+		)`,
+
+		// The fee components of records whose reports list them in separate
+		// columns, in the record's currency.
+		`CREATE TABLE IF NOT EXISTS settlement_fees (
+			settlement_id TEXT NOT NULL,
+			component TEXT NOT NULL,
+			amount REAL NOT NULL,
+			PRIMARY KEY (settlement_id, component)
+		)`,
+
+		// The tax withheld on records' fees, in the record's currency.
+		`CREATE TABLE IF NOT EXISTS settlement_taxes (
+			settlement_id TEXT PRIMARY KEY,
+			amount REAL NOT NULL
+		)`,
 
 		`CREATE TABLE IF NOT EXISTS discrepancies (
 			id TEXT PRIMARY KEY,
@@ -104,13 +363,445 @@ func createTables(db *sql.DB) error {
 		`CREATE INDEX IF NOT EXISTS idx_discrepancies_type ON discrepancies(type)`,
 		`CREATE INDEX IF NOT EXISTS idx_discrepancies_severity ON discrepancies(severity)`,
 		`CREATE INDEX IF NOT EXISTS idx_discrepancies_processor ON discrepancies(processor)`,
+
+		`CREATE TABLE IF NOT EXISTS discrepancy_tags (
+			discrepancy_id TEXT NOT NULL,
+			tag TEXT NOT NULL,
+			created_at DATETIME NOT NULL,
+			PRIMARY KEY (discrepancy_id, tag)
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_discrepancy_tags_tag ON discrepancy_tags(tag)`,
+
+		// Activity log of each discrepancy, keyed like tags so it outlives
+		// re-runs.
+		`CREATE TABLE IF NOT EXISTS discrepancy_activity (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			discrepancy_id TEXT NOT NULL,
+			at DATETIME NOT NULL,
+			actor TEXT NOT NULL,
+			action TEXT NOT NULL,
+			from_value TEXT NOT NULL DEFAULT '',
+			to_value TEXT NOT NULL DEFAULT ''
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_discrepancy_activity_disc ON discrepancy_activity(discrepancy_id, id)`,
+
+		// Merchant and batch of each discrepancy, written with it so lists can
+		// filter on them without joining back to transactions and settlements.
+		`CREATE TABLE IF NOT EXISTS discrepancy_attributions (
+			discrepancy_id TEXT PRIMARY KEY,
+			merchant_id TEXT,
+			batch_id TEXT
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_discrepancy_attributions_merchant ON discrepancy_attributions(merchant_id)`,
+		`CREATE INDEX IF NOT EXISTS idx_discrepancy_attributions_batch ON discrepancy_attributions(batch_id)`,
+
+		`CREATE TABLE IF NOT EXISTS discrepancy_policies (
+			discrepancy_id TEXT PRIMARY KEY,
+			version TEXT NOT NULL,
+			policy_json TEXT NOT NULL
+		)`,
+
+		// Probable cause of each amount mismatch the detector could explain.
+		`CREATE TABLE IF NOT EXISTS discrepancy_causes (
+			discrepancy_id TEXT PRIMARY KEY,
+			cause TEXT NOT NULL,
+			detail TEXT NOT NULL
+		)`,
+
+		// One row per spell a discrepancy was open. Discrepancies are rebuilt
+		// on every run; this table is what remembers when each appeared and
+		// disappeared.
+		`CREATE TABLE IF NOT EXISTS discrepancy_lifecycle (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			discrepancy_id TEXT NOT NULL,
+			type TEXT NOT NULL,
+			processor TEXT NOT NULL,
+			severity TEXT NOT NULL,
+			opened_at DATETIME NOT NULL,
+			resolved_at DATETIME
+		)`,
+		`CREATE UNIQUE INDEX IF NOT EXISTS idx_discrepancy_lifecycle_open ON discrepancy_lifecycle(discrepancy_id) WHERE resolved_at IS NULL`,
+		`CREATE INDEX IF NOT EXISTS idx_discrepancy_lifecycle_opened ON discrepancy_lifecycle(opened_at)`,
+		`CREATE INDEX IF NOT EXISTS idx_discrepancy_lifecycle_resolved ON discrepancy_lifecycle(resolved_at)`,
+
+		// End-of-day copies of the dashboard: the last capture of each UTC day
+		// and the discrepancies open at the time. See HistoryRepo.
+		`CREATE TABLE IF NOT EXISTS daily_snapshots (
+			day TEXT PRIMARY KEY,
+			captured_at DATETIME NOT NULL,
+			figures_json TEXT NOT NULL
+		)`,
+		`CREATE TABLE IF NOT EXISTS open_discrepancy_snapshots (
+			day TEXT NOT NULL REFERENCES daily_snapshots(day),
+			discrepancy_id TEXT NOT NULL,
+			type TEXT NOT NULL,
+			severity TEXT NOT NULL,
+			processor TEXT NOT NULL,
+			currency TEXT NOT NULL,
+			merchant_id TEXT,
+			difference_usd REAL NOT NULL,
+			PRIMARY KEY (day, discrepancy_id)
+		)`,
+
+		// Certificates are immutable once generated; content_json is exactly
+		// what content_hash was computed over.
+		`CREATE TABLE IF NOT EXISTS batch_certificates (
+			id TEXT PRIMARY KEY,
+			processor TEXT NOT NULL,
+			batch_id TEXT NOT NULL,
+			content_hash TEXT NOT NULL,
+			content_json TEXT NOT NULL,
+			generated_by TEXT NOT NULL,
+			generated_at DATETIME NOT NULL
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_batch_certificates_batch ON batch_certificates(processor, batch_id)`,
+
+		// Approval of batches whose matched transactions wait to be settled.
+		`CREATE TABLE IF NOT EXISTS batch_approvals (
+			processor TEXT NOT NULL,
+			batch_id TEXT NOT NULL,
+			status TEXT NOT NULL,
+			record_count INTEGER NOT NULL,
+			usd_gross_amount REAL NOT NULL,
+			requested_at DATETIME NOT NULL,
+			approved_by TEXT NOT NULL DEFAULT '',
+			approved_at DATETIME,
+			note TEXT NOT NULL DEFAULT '',
+			PRIMARY KEY (processor, batch_id)
+		)`,
+
+		`CREATE TABLE IF NOT EXISTS certificate_signoffs (
+			certificate_id TEXT PRIMARY KEY REFERENCES batch_certificates(id),
+			user_id TEXT NOT NULL,
+			comment TEXT NOT NULL DEFAULT '',
+			signed_at DATETIME NOT NULL
+		)`,
+
+		// A period is closed while it has a row with no reopened_at.
+		`CREATE TABLE IF NOT EXISTS period_closes (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			period TEXT NOT NULL,
+			closed_by TEXT NOT NULL,
+			closed_at DATETIME NOT NULL,
+			figures_json TEXT NOT NULL,
+			reopened_by TEXT,
+			reopened_at DATETIME,
+			reopen_reason TEXT NOT NULL DEFAULT ''
+		)`,
+		`CREATE UNIQUE INDEX IF NOT EXISTS idx_period_closes_open ON period_closes(period) WHERE reopened_at IS NULL`,
+
+		`CREATE TABLE IF NOT EXISTS pending_adjustments (
+			id TEXT PRIMARY KEY,
+			kind TEXT NOT NULL,
+			reference TEXT NOT NULL,
+			periods TEXT NOT NULL,
+			summary TEXT NOT NULL,
+			status TEXT NOT NULL,
+			requested_by TEXT NOT NULL DEFAULT '',
+			created_at DATETIME NOT NULL,
+			decided_by TEXT NOT NULL DEFAULT '',
+			decided_at DATETIME,
+			note TEXT NOT NULL DEFAULT '',
+			payload_json TEXT NOT NULL,
+			result_json TEXT NOT NULL DEFAULT ''
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_pending_adjustments_status ON pending_adjustments(status)`,
+
+		// Totals of rows deleted by retention purges, so volumes by month
+		// outlive the rows; see RetentionRepo.Purge.
+		`CREATE TABLE IF NOT EXISTS retention_aggregates (
+			kind TEXT NOT NULL,
+			period TEXT NOT NULL,
+			processor TEXT NOT NULL,
+			currency TEXT NOT NULL,
+			count INTEGER NOT NULL,
+			amount REAL NOT NULL,
+			usd_amount REAL NOT NULL,
+			PRIMARY KEY (kind, period, processor, currency)
+		)`,
+		`CREATE TABLE IF NOT EXISTS purge_reports (
+			id TEXT PRIMARY KEY,
+			mode TEXT NOT NULL,
+			requested_by TEXT NOT NULL,
+			purged_at DATETIME NOT NULL,
+			report_json TEXT NOT NULL
+		)`,
+
+		`CREATE TABLE IF NOT EXISTS saved_filters (
+			id TEXT PRIMARY KEY,
+			user_id TEXT NOT NULL,
+			name TEXT NOT NULL,
+			query TEXT NOT NULL,
+			created_at DATETIME NOT NULL
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_saved_filters_user ON saved_filters(user_id)`,
+
+		// Lists are comma-separated; dates are YYYY-MM-DD. A user has at most
+		// one default view.
+		`CREATE TABLE IF NOT EXISTS dashboard_views (
+			id TEXT PRIMARY KEY,
+			user_id TEXT NOT NULL,
+			name TEXT NOT NULL,
+			processors TEXT NOT NULL,
+			currencies TEXT NOT NULL,
+			merchant_id TEXT NOT NULL,
+			date_from TEXT NOT NULL,
+			date_to TEXT NOT NULL,
+			last_days INTEGER NOT NULL,
+			is_default INTEGER NOT NULL,
+			created_at DATETIME NOT NULL,
+			updated_at DATETIME NOT NULL
+		)`,
+		`CREATE UNIQUE INDEX IF NOT EXISTS idx_dashboard_views_user_name ON dashboard_views(user_id, name)`,
+		`CREATE UNIQUE INDEX IF NOT EXISTS idx_dashboard_views_default ON dashboard_views(user_id) WHERE is_default = 1`,
+
+		`CREATE TABLE IF NOT EXISTS alerts (
+			id TEXT PRIMARY KEY,
+			type TEXT NOT NULL,
+			processor TEXT NOT NULL,
+			severity TEXT NOT NULL,
+			reference TEXT NOT NULL,
+			message TEXT NOT NULL,
+			created_at DATETIME NOT NULL,
+			resolved_at DATETIME
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_alerts_type_processor ON alerts(type, processor)`,
+
+		// Merchants whose payouts are on hold for open discrepancies; a row
+		// is deleted when its hold is released.
+		`CREATE TABLE IF NOT EXISTS payout_holds (
+			merchant_id TEXT PRIMARY KEY,
+			discrepancies INTEGER NOT NULL,
+			open_usd REAL NOT NULL,
+			held_since DATETIME NOT NULL,
+			updated_at DATETIME NOT NULL
+		)`,
+
+		`CREATE TABLE IF NOT EXISTS merchant_tolerances (
+			merchant_id TEXT PRIMARY KEY,
+			abs_tolerance_usd REAL NOT NULL,
+			updated_at DATETIME NOT NULL
+		)`,
+
+		`CREATE TABLE IF NOT EXISTS rule_flags (
+			rule TEXT NOT NULL,
+			processor TEXT NOT NULL DEFAULT '',
+			enabled INTEGER NOT NULL,
+			updated_by TEXT NOT NULL DEFAULT '',
+			updated_at DATETIME NOT NULL,
+			PRIMARY KEY (rule, processor)
+		)`,
+
+		// Rules routing new discrepancies to their owners, and who each
+		// discrepancy was routed to, keyed like tags so it outlives re-runs.
+		`CREATE TABLE IF NOT EXISTS routing_rules (
+			id TEXT PRIMARY KEY,
+			position INTEGER NOT NULL,
+			processor TEXT NOT NULL DEFAULT '',
+			min_severity TEXT NOT NULL DEFAULT '',
+			merchant_id TEXT NOT NULL DEFAULT '',
+			type TEXT NOT NULL DEFAULT '',
+			team TEXT NOT NULL DEFAULT '',
+			assignee TEXT NOT NULL DEFAULT '',
+			notify TEXT NOT NULL DEFAULT '',
+			updated_by TEXT NOT NULL DEFAULT '',
+			updated_at DATETIME NOT NULL
+		)`,
+		`CREATE TABLE IF NOT EXISTS discrepancy_assignments (
+			discrepancy_id TEXT PRIMARY KEY,
+			team TEXT NOT NULL DEFAULT '',
+			assignee TEXT NOT NULL DEFAULT '',
+			rule_id TEXT NOT NULL,
+			assigned_at DATETIME NOT NULL
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_discrepancy_assignments_team ON discrepancy_assignments(team)`,
+		`CREATE INDEX IF NOT EXISTS idx_discrepancy_assignments_assignee ON discrepancy_assignments(assignee)`,
+
+		// External tickets linked to discrepancies, keyed like tags.
+		`CREATE TABLE IF NOT EXISTS discrepancy_tickets (
+			discrepancy_id TEXT PRIMARY KEY,
+			system TEXT NOT NULL,
+			ticket_id TEXT NOT NULL,
+			url TEXT NOT NULL DEFAULT '',
+			linked_by TEXT NOT NULL,
+			linked_at DATETIME NOT NULL
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_discrepancy_tickets_ticket_id ON discrepancy_tickets(ticket_id)`,
+
+		// Discrepancies resolved in an external workflow, keyed like tags.
+		`CREATE TABLE IF NOT EXISTS discrepancy_resolutions (
+			discrepancy_id TEXT PRIMARY KEY,
+			source TEXT NOT NULL,
+			reference TEXT NOT NULL DEFAULT '',
+			status TEXT NOT NULL DEFAULT '',
+			resolved_by TEXT NOT NULL,
+			resolved_at DATETIME NOT NULL
+		)`,
+
+		// Jira issues of discrepancies, and where their sync stands. An issue
+		// linked by hand may cover several discrepancies.
+		`CREATE TABLE IF NOT EXISTS jira_issues (
+			discrepancy_id TEXT PRIMARY KEY,
+			issue_key TEXT NOT NULL,
+			state TEXT NOT NULL,
+			status TEXT NOT NULL DEFAULT '',
+			last_error TEXT NOT NULL DEFAULT '',
+			created_at DATETIME NOT NULL,
+			updated_at DATETIME NOT NULL
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_jira_issues_key ON jira_issues(issue_key)`,
+		`CREATE INDEX IF NOT EXISTS idx_jira_issues_state ON jira_issues(state)`,
+
+		// Cases grouping discrepancies, and their members keyed like tags. A
+		// member row with an empty case_id is a discrepancy taken out of its
+		// case, which is not grouped again automatically.
+		`CREATE TABLE IF NOT EXISTS discrepancy_cases (
+			id TEXT PRIMARY KEY,
+			title TEXT NOT NULL,
+			group_key TEXT NOT NULL DEFAULT '',
+			created_by TEXT NOT NULL,
+			created_at DATETIME NOT NULL,
+			resolved_by TEXT NOT NULL DEFAULT '',
+			resolved_at DATETIME,
+			note TEXT NOT NULL DEFAULT ''
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_discrepancy_cases_group_key ON discrepancy_cases(group_key)`,
+		`CREATE TABLE IF NOT EXISTS case_members (
+			discrepancy_id TEXT PRIMARY KEY,
+			case_id TEXT NOT NULL,
+			added_by TEXT NOT NULL,
+			added_at DATETIME NOT NULL
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_case_members_case ON case_members(case_id)`,
+
+		`CREATE TABLE IF NOT EXISTS transform_scripts (
+			processor TEXT PRIMARY KEY,
+			version INTEGER NOT NULL,
+			steps TEXT NOT NULL,
+			updated_at DATETIME NOT NULL,
+			updated_by TEXT NOT NULL DEFAULT ''
+		)`,
+
+		`CREATE TABLE IF NOT EXISTS processor_contacts (
+			processor TEXT PRIMARY KEY,
+			ops_email TEXT NOT NULL DEFAULT '',
+			dispute_portal_url TEXT NOT NULL DEFAULT '',
+			sla_terms TEXT NOT NULL DEFAULT '',
+			escalation TEXT NOT NULL DEFAULT '[]',
+			updated_at DATETIME NOT NULL,
+			updated_by TEXT NOT NULL DEFAULT ''
+		)`,
+
+		`CREATE TABLE IF NOT EXISTS idempotency_keys (
+			scope TEXT NOT NULL,
+			key TEXT NOT NULL,
+			fingerprint TEXT NOT NULL,
+			job_id TEXT NOT NULL DEFAULT '',
+			status_code INTEGER NOT NULL DEFAULT 0,
+			response TEXT NOT NULL DEFAULT '',
+			created_at DATETIME NOT NULL,
+			PRIMARY KEY (scope, key)
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_idempotency_keys_created ON idempotency_keys(created_at)`,
+
+		`CREATE TABLE IF NOT EXISTS connector_state (
+			name TEXT PRIMARY KEY,
+			processor TEXT NOT NULL,
+			cursor TEXT NOT NULL DEFAULT '',
+			last_run_at DATETIME,
+			last_success_at DATETIME,
+			last_error TEXT NOT NULL DEFAULT '',
+			records_pulled INTEGER NOT NULL DEFAULT 0
+		)`,
+
+		`CREATE TABLE IF NOT EXISTS leases (
+			name TEXT PRIMARY KEY,
+			holder TEXT NOT NULL,
+			acquired_at DATETIME NOT NULL,
+			expires_at DATETIME NOT NULL
+		)`,
 	}
 
 	for _, stmt := range stmts {
 		if _, err := db.Exec(stmt); err != nil {
-			return fmt.Errorf("exec %q: %w", stmt[:60], err)
+			return fmt.Errorf("exec %q: %w", stmt[:min(len(stmt), 60)], err)
 		}
 	}
 
-	return nil
+	return ensureUniqueProcessorRefs(db)
+}
+
+// dataTables lists the tables ResetData empties, children before parents.
+// Saved filters, merchant tolerances, rule flags, routing rules, transform
+// scripts and processor contacts are configuration and are kept.
+var dataTables = []string{
+	"discrepancy_assignments",
+	"discrepancy_tickets",
+	"discrepancy_resolutions",
+	"jira_issues",
+	"case_members",
+	"discrepancy_cases",
+	"discrepancy_activity",
+	"discrepancy_tags",
+	"discrepancy_policies",
+	"discrepancy_causes",
+	"discrepancy_attributions",
+	"discrepancy_lifecycle",
+	"discrepancies",
+	"open_discrepancy_snapshots",
+	"daily_snapshots",
+	"alerts",
+	"payout_holds",
+	"certificate_signoffs",
+	"batch_certificates",
+	"batch_approvals",
+	"pending_adjustments",
+	"period_closes",
+	"retention_aggregates",
+	"purge_reports",
+	"report_warnings",
+	"report_file_links",
+	"ingest_dead_letters",
+	"report_file_blobs",
+	"report_files",
+	"report_provenance",
+	"report_verifications",
+	"report_control_totals",
+	"suggestion_feedback",
+	"settlement_corrections",
+	"settlement_adjustments",
+	"settlement_fees",
+	"settlement_taxes",
+	"settlement_records",
+	"settlement_reports",
+	"transfer_legs",
+	"transaction_directions",
+	"transaction_reconciliation",
+	"transaction_amendments",
+	"transactions",
+	"quarantined_transactions",
+	"idempotency_keys",
+	"connector_state",
+}
+
+// snapshotTables is every table but leases, which belong to the running
+// instances rather than the data, and blob_deletions, children before
+// parents.
+var snapshotTables = append(append([]string{}, dataTables...), "saved_filters", "dashboard_views", "merchant_tolerances", "rule_flags", "routing_rules", "transform_scripts", "processor_contacts")
+
+// ResetData deletes every transaction, report, settlement and derived row in
+// one transaction, leaving the schema and configuration in place.
+func ResetData(db *sql.DB) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("begin: %w", err)
+	}
+	defer tx.Rollback()
+
+	for _, table := range dataTables {
+		if _, err := tx.Exec("DELETE FROM " + table); err != nil {
+			return fmt.Errorf("clear %s: %w", table, err)
+		}
+	}
+	return tx.Commit()
 }
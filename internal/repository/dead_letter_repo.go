@@ -0,0 +1,260 @@
+package repository
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/wakala/reconciler/internal/blob"
+	"github.com/wakala/reconciler/internal/domain"
+)
+
+type DeadLetterRepo struct {
+	db    *sql.DB
+	blobs blob.Store
+}
+
+func NewDeadLetterRepo(db *sql.DB) *DeadLetterRepo {
+	return &DeadLetterRepo{db: db}
+}
+
+// SetBlobStore keeps the files of new dead letters in store, under the
+// same keys as report files.
+func (r *DeadLetterRepo) SetBlobStore(store blob.Store) {
+	r.blobs = store
+}
+
+// deadLetterSidecar is how a dead letter's sidecar files are stored in its
+// sidecars column.
+type deadLetterSidecar struct {
+	Filename string `json:"filename"`
+	Data     []byte `json:"data"`
+}
+
+// Insert stores a dead letter and keeps its file in report_files, unlinked
+// to any report. A file already stored is not stored again.
+func (r *DeadLetterRepo) Insert(dl *domain.DeadLetter) error {
+	data := sealColumn(string(dl.File.Data))
+	var key string
+	if r.blobs != nil {
+		var stored bool
+		if err := r.db.QueryRow("SELECT EXISTS (SELECT 1 FROM report_files WHERE hash = ?)", dl.File.Hash).Scan(&stored); err != nil {
+			return fmt.Errorf("look up file: %w", err)
+		}
+		if !stored {
+			key = reportFileKey(dl.File.Hash)
+			if err := r.blobs.Put(context.Background(), key, []byte(data)); err != nil {
+				return fmt.Errorf("store file in %s: %w", r.blobs, err)
+			}
+			data = sealColumn("")
+		}
+	}
+
+	sidecars := make([]deadLetterSidecar, len(dl.Sidecars))
+	for i, sc := range dl.Sidecars {
+		sidecars[i] = deadLetterSidecar{Filename: sc.Filename, Data: sc.Data}
+	}
+	sidecarJSON, err := json.Marshal(sidecars)
+	if err != nil {
+		return fmt.Errorf("encode sidecars: %w", err)
+	}
+	provenance := ""
+	if dl.Provenance != nil {
+		data, err := json.Marshal(dl.Provenance)
+		if err != nil {
+			return fmt.Errorf("encode provenance: %w", err)
+		}
+		provenance = string(data)
+	}
+
+	tx, err := r.db.Begin()
+	if err != nil {
+		return fmt.Errorf("begin: %w", err)
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(
+		`INSERT INTO report_files (hash, filename, size, data, stored_at) VALUES (?,?,?,?,?)
+		ON CONFLICT (hash) DO NOTHING`,
+		dl.File.Hash, dl.File.Filename, len(dl.File.Data), data, dl.FailedAt.Format(time.RFC3339),
+	)
+	if err != nil {
+		return fmt.Errorf("insert file: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n == 1 && key != "" {
+		if _, err := tx.Exec(
+			"INSERT INTO report_file_blobs (hash, key, key_id) VALUES (?,?,?)", dl.File.Hash, key, activeColumnKeyID(),
+		); err != nil {
+			return fmt.Errorf("insert file blob: %w", err)
+		}
+	}
+	if _, err := tx.Exec(
+		`INSERT INTO ingest_dead_letters
+		(id, processor, format, backfill, file_hash, filename, sidecars, provenance, error, attempts,
+			submitted_at, failed_at, status)
+		VALUES (?,?,?,?,?,?,?,?,?,?,?,?,?)`,
+		dl.ID, string(dl.Processor), dl.Format, dl.Backfill, dl.File.Hash, dl.File.Filename,
+		string(sidecarJSON), provenance, dl.Error, dl.Attempts,
+		dl.SubmittedAt.Format(time.RFC3339), dl.FailedAt.Format(time.RFC3339), string(domain.DeadLetterOpen),
+	); err != nil {
+		return fmt.Errorf("insert dead letter: %w", err)
+	}
+	return tx.Commit()
+}
+
+type DeadLetterFilter struct {
+	Processor string
+	// Status is "open", "retried", "discarded" or "" for all dead letters.
+	Status string
+	Page   int
+	Limit  int
+}
+
+const deadLetterSelect = `SELECT d.id, d.processor, d.format, d.backfill, d.file_hash, d.filename,
+	COALESCE(f.size, 0), COALESCE(f.stored_at, ''), d.sidecars, d.provenance, d.error, d.attempts,
+	d.submitted_at, d.failed_at, d.status, d.resolved_at, d.resolved_by, d.retry_job_id
+	FROM ingest_dead_letters d
+	LEFT JOIN report_files f ON f.hash = d.file_hash`
+
+// List returns dead letters, most recent failure first.
+func (r *DeadLetterRepo) List(f DeadLetterFilter) ([]domain.DeadLetter, int, error) {
+	var clauses []string
+	var args []any
+	if f.Processor != "" {
+		clauses = append(clauses, "d.processor = ?")
+		args = append(args, f.Processor)
+	}
+	if f.Status != "" {
+		clauses = append(clauses, "d.status = ?")
+		args = append(args, f.Status)
+	}
+	where := ""
+	if len(clauses) > 0 {
+		where = " WHERE " + strings.Join(clauses, " AND ")
+	}
+
+	var total int
+	if err := r.db.QueryRow("SELECT COUNT(*) FROM ingest_dead_letters d"+where, args...).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	if f.Limit <= 0 {
+		f.Limit = 50
+	}
+	if f.Page <= 0 {
+		f.Page = 1
+	}
+	offset := (f.Page - 1) * f.Limit
+
+	rows, err := r.db.Query(deadLetterSelect+where+" ORDER BY d.failed_at DESC, d.id LIMIT ? OFFSET ?",
+		append(args, f.Limit, offset)...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	letters := []domain.DeadLetter{}
+	for rows.Next() {
+		dl, err := scanDeadLetter(rows)
+		if err != nil {
+			return nil, 0, err
+		}
+		letters = append(letters, *dl)
+	}
+	return letters, total, rows.Err()
+}
+
+// Get returns a dead letter with its sidecar files. It returns
+// sql.ErrNoRows for an unknown ID.
+func (r *DeadLetterRepo) Get(id string) (*domain.DeadLetter, error) {
+	return scanDeadLetter(r.db.QueryRow(deadLetterSelect+" WHERE d.id = ?", id))
+}
+
+// GetFile returns the file a dead letter was submitted with. It returns
+// sql.ErrNoRows when the dead letter is unknown or its file was purged.
+func (r *DeadLetterRepo) GetFile(id string) (*domain.ReportFile, error) {
+	var f domain.ReportFile
+	var data, storedAt, key string
+	err := r.db.QueryRow(`
+		SELECT f.hash, d.filename, f.size, f.data, f.stored_at, COALESCE(b.key, '') FROM ingest_dead_letters d
+		JOIN report_files f ON f.hash = d.file_hash
+		LEFT JOIN report_file_blobs b ON b.hash = f.hash
+		WHERE d.id = ?`, id,
+	).Scan(&f.Hash, &f.Filename, &f.Size, &data, &storedAt, &key)
+	if err != nil {
+		return nil, err
+	}
+	if key != "" {
+		if r.blobs == nil {
+			return nil, fmt.Errorf("dead letter file %s is kept in a blob store, but none is configured", f.Hash)
+		}
+		stored, err := r.blobs.Get(context.Background(), key)
+		if err != nil {
+			return nil, fmt.Errorf("dead letter file %s: %w", f.Hash, err)
+		}
+		data = string(stored)
+	}
+	plain, err := openColumn(data)
+	if err != nil {
+		return nil, fmt.Errorf("dead letter file %s: %w", f.Hash, err)
+	}
+	f.Data = []byte(plain)
+	f.StoredAt, _ = time.Parse(time.RFC3339, storedAt)
+	return &f, nil
+}
+
+// Resolve closes an open dead letter as retried or discarded. It reports
+// false when the dead letter is unknown or already closed.
+func (r *DeadLetterRepo) Resolve(id string, status domain.DeadLetterStatus, by, retryJobID string, at time.Time) (bool, error) {
+	res, err := r.db.Exec(
+		`UPDATE ingest_dead_letters SET status = ?, resolved_at = ?, resolved_by = ?, retry_job_id = ?
+		WHERE id = ? AND status = ?`,
+		string(status), at.Format(time.RFC3339), by, retryJobID, id, string(domain.DeadLetterOpen),
+	)
+	if err != nil {
+		return false, err
+	}
+	n, _ := res.RowsAffected()
+	return n > 0, nil
+}
+
+func scanDeadLetter(row interface{ Scan(...any) error }) (*domain.DeadLetter, error) {
+	var dl domain.DeadLetter
+	var proc, storedAt, sidecarJSON, provenance, submittedAt, failedAt, status string
+	var resolvedAt sql.NullString
+	if err := row.Scan(&dl.ID, &proc, &dl.Format, &dl.Backfill, &dl.File.Hash, &dl.File.Filename,
+		&dl.File.Size, &storedAt, &sidecarJSON, &provenance, &dl.Error, &dl.Attempts,
+		&submittedAt, &failedAt, &status, &resolvedAt, &dl.ResolvedBy, &dl.RetryJobID); err != nil {
+		return nil, err
+	}
+	dl.Processor = domain.Processor(proc)
+	dl.Status = domain.DeadLetterStatus(status)
+	dl.File.StoredAt, _ = time.Parse(time.RFC3339, storedAt)
+	dl.SubmittedAt, _ = time.Parse(time.RFC3339, submittedAt)
+	dl.FailedAt, _ = time.Parse(time.RFC3339, failedAt)
+	if resolvedAt.Valid {
+		t, _ := time.Parse(time.RFC3339, resolvedAt.String)
+		dl.ResolvedAt = &t
+	}
+
+	var sidecars []deadLetterSidecar
+	if err := json.Unmarshal([]byte(sidecarJSON), &sidecars); err != nil {
+		return nil, fmt.Errorf("dead letter %s sidecars: %w", dl.ID, err)
+	}
+	for _, sc := range sidecars {
+		dl.Sidecars = append(dl.Sidecars, domain.ReportFile{
+			Hash: fmt.Sprintf("%x", sha256.Sum256(sc.Data)), Filename: sc.Filename, Size: len(sc.Data), Data: sc.Data,
+		})
+	}
+	if provenance != "" {
+		dl.Provenance = &domain.ReportProvenance{}
+		if err := json.Unmarshal([]byte(provenance), dl.Provenance); err != nil {
+			return nil, fmt.Errorf("dead letter %s provenance: %w", dl.ID, err)
+		}
+	}
+	return &dl, nil
+}
@@ -0,0 +1,210 @@
+package repository
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/wakala/reconciler/internal/domain"
+)
+
+// Matching derives state from settlement records: the record's link to its
+// transaction and the transaction's settled status and date. The methods
+// here find and repair that state when it no longer follows from the
+// records, e.g. after rows were edited or deleted by hand.
+
+// LinkRepair is a settlement record whose link to a transaction was
+// cleared. Reason is "transaction_missing" or "reference_mismatch".
+type LinkRepair struct {
+	SettlementID  string `json:"settlement_id"`
+	TransactionID string `json:"transaction_id"`
+	Reason        string `json:"reason"`
+}
+
+// StatusRepair is a transaction whose status or settlement date was
+// corrected to agree with its matched records.
+type StatusRepair struct {
+	TransactionID string                   `json:"transaction_id"`
+	From          domain.TransactionStatus `json:"from"`
+	To            domain.TransactionStatus `json:"to"`
+	SettledAt     *time.Time               `json:"settled_at,omitempty"`
+}
+
+// ClearStaleLinks unmatches records linked to a transaction that no longer
+// exists, or whose processor or reference no longer agrees with the
+// record's, so the next matching run links them afresh. A link made by
+// accepting a match suggestion is kept although the references differ.
+func (r *SettlementRepo) ClearStaleLinks() ([]LinkRepair, error) {
+	rows, err := r.db.Query(`
+		SELECT sr.id, sr.processor, sr.processor_transaction_id, sr.wakala_transaction_id,
+			t.id IS NULL, COALESCE(t.processor, ''), COALESCE(t.processor_reference, ''),
+			EXISTS (SELECT 1 FROM suggestion_feedback f
+				WHERE f.settlement_id = sr.id AND f.transaction_id = sr.wakala_transaction_id AND f.decision = ?)
+		FROM settlement_records sr
+		LEFT JOIN transactions t ON t.id = sr.wakala_transaction_id
+		WHERE sr.wakala_transaction_id IS NOT NULL`, string(domain.SuggestionAccepted))
+	if err != nil {
+		return nil, err
+	}
+	repairs := []LinkRepair{}
+	for rows.Next() {
+		var recID, recProc, recRef, txnID, txnProc, txnRef string
+		var missing, accepted bool
+		if err := rows.Scan(&recID, &recProc, &recRef, &txnID, &missing, &txnProc, &txnRef, &accepted); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		if missing {
+			repairs = append(repairs, LinkRepair{SettlementID: recID, TransactionID: txnID, Reason: "transaction_missing"})
+			continue
+		}
+		// The references are compared decrypted: the two columns may be
+		// sealed with different keys while a rotation is under way.
+		if recRef, err = openColumn(recRef); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("settlement record %s: %w", recID, err)
+		}
+		if txnRef, err = openColumn(txnRef); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("transaction %s: %w", txnID, err)
+		}
+		if recProc != txnProc || (recRef != txnRef && !accepted) {
+			repairs = append(repairs, LinkRepair{SettlementID: recID, TransactionID: txnID, Reason: "reference_mismatch"})
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, rep := range repairs {
+		if _, err := r.db.Exec("UPDATE settlement_records SET wakala_transaction_id = NULL WHERE id = ?", rep.SettlementID); err != nil {
+			return nil, fmt.Errorf("unlink %s: %w", rep.SettlementID, err)
+		}
+	}
+	return repairs, nil
+}
+
+// DeleteOrphanedAdjustments removes adjustment classifications of settlement
+// records that no longer exist, and returns how many.
+func (r *SettlementRepo) DeleteOrphanedAdjustments() (int, error) {
+	res, err := r.db.Exec(
+		"DELETE FROM settlement_adjustments WHERE settlement_id NOT IN (SELECT id FROM settlement_records)",
+	)
+	if err != nil {
+		return 0, err
+	}
+	n, _ := res.RowsAffected()
+	return int(n), nil
+}
+
+// DeleteOrphanedFees removes fee components and withheld taxes of
+// settlement records that no longer exist, and returns how many of each,
+// by table.
+func (r *SettlementRepo) DeleteOrphanedFees() (map[string]int, error) {
+	removed := map[string]int{}
+	for _, table := range []string{"settlement_fees", "settlement_taxes"} {
+		res, err := r.db.Exec(
+			"DELETE FROM " + table + " WHERE settlement_id NOT IN (SELECT id FROM settlement_records)",
+		)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", table, err)
+		}
+		n, _ := res.RowsAffected()
+		removed[table] = int(n)
+	}
+	return removed, nil
+}
+
+// DeleteOrphanedLinks removes the direction, transfer leg and
+// reconciliation status rows of transactions that no longer exist, and
+// returns how many of each.
+func (r *TransactionRepo) DeleteOrphanedLinks() (map[string]int, error) {
+	removed := make(map[string]int)
+	for _, table := range []string{"transaction_directions", "transfer_legs", "transaction_reconciliation"} {
+		res, err := r.db.Exec("DELETE FROM " + table + " WHERE transaction_id NOT IN (SELECT id FROM transactions)")
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", table, err)
+		}
+		n, _ := res.RowsAffected()
+		removed[table] = int(n)
+	}
+	return removed, nil
+}
+
+// RepairSettledStatuses makes every transaction with a matched record
+// settled, on the date of one of its records (the latest, when it has to
+// be chosen), and returns every other settled or pending transaction to
+// captured, or to authorized when it has no capture time. A transaction
+// pending confirmation stays so while its record's batch awaits approval.
+func (r *TransactionRepo) RepairSettledStatuses() ([]StatusRepair, error) {
+	repairs := []StatusRepair{}
+
+	rows, err := r.db.Query(`
+		SELECT t.id, t.status, MAX(sr.settlement_date)
+		FROM transactions t
+		JOIN settlement_records sr ON sr.wakala_transaction_id = t.id
+		WHERE NOT (t.status = ? AND EXISTS (SELECT 1 FROM batch_approvals ba
+			WHERE ba.processor = sr.processor AND ba.batch_id = sr.batch_id AND ba.status = ?))
+		GROUP BY t.id
+		HAVING t.status != 'settled' OR t.settled_at IS NULL
+			OR SUM(sr.settlement_date = t.settled_at) = 0`,
+		string(domain.StatusPendingConfirmation), string(domain.BatchApprovalPending))
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var rep StatusRepair
+		var from, settledAt string
+		if err := rows.Scan(&rep.TransactionID, &from, &settledAt); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		t, _ := time.Parse(time.RFC3339, settledAt)
+		rep.From, rep.To, rep.SettledAt = domain.TransactionStatus(from), domain.StatusSettled, &t
+		repairs = append(repairs, rep)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows, err = r.db.Query(`
+		SELECT id, status, captured_at IS NULL FROM transactions t
+		WHERE status IN (?, ?)
+			AND NOT EXISTS (SELECT 1 FROM settlement_records sr WHERE sr.wakala_transaction_id = t.id)`,
+		string(domain.StatusSettled), string(domain.StatusPendingConfirmation))
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		rep := StatusRepair{To: domain.StatusCaptured}
+		var uncaptured bool
+		if err := rows.Scan(&rep.TransactionID, &rep.From, &uncaptured); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		if uncaptured {
+			rep.To = domain.StatusAuthorized
+		}
+		repairs = append(repairs, rep)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, rep := range repairs {
+		var settledAt sql.NullString
+		if rep.SettledAt != nil {
+			settledAt = sql.NullString{String: rep.SettledAt.Format(time.RFC3339), Valid: true}
+		}
+		if _, err := r.db.Exec(
+			"UPDATE transactions SET status = ?, settled_at = ? WHERE id = ?",
+			string(rep.To), settledAt, rep.TransactionID,
+		); err != nil {
+			return nil, fmt.Errorf("update %s: %w", rep.TransactionID, err)
+		}
+	}
+	return repairs, nil
+}
@@ -0,0 +1,245 @@
+package repository
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/wakala/reconciler/internal/domain"
+)
+
+// DiagnosticsRepo reads the health and data freshness figures on-call checks
+// first: how big the database is and how far behind ingestion and matching
+// are.
+type DiagnosticsRepo struct {
+	db *sql.DB
+	// path is the database file, or "" for an in-memory database.
+	path string
+}
+
+func NewDiagnosticsRepo(db *sql.DB, path string) *DiagnosticsRepo {
+	return &DiagnosticsRepo{db: db, path: path}
+}
+
+// DatabaseSize is the size of the database file and its write-ahead log.
+type DatabaseSize struct {
+	SizeBytes     int64 `json:"size_bytes"`
+	PageCount     int   `json:"page_count"`
+	FreelistCount int   `json:"freelist_count"`
+	// WALBytes is set when the database is a file and the log exists.
+	WALBytes *int64 `json:"wal_bytes,omitempty"`
+}
+
+// ProcessorIngest is the latest report ingested from a processor.
+type ProcessorIngest struct {
+	Processor  domain.Processor `json:"processor"`
+	ReportID   string           `json:"report_id"`
+	BatchID    string           `json:"batch_id"`
+	IngestedAt time.Time        `json:"ingested_at"`
+	AgeSeconds int64            `json:"age_seconds"`
+	Reports    int              `json:"reports"`
+}
+
+// OldestUnmatched is the oldest settlement record still waiting for its
+// transaction. Unmatched counts every such record; adjustment rows, which
+// never match, are left out.
+type OldestUnmatched struct {
+	SettlementID   string           `json:"settlement_id"`
+	Processor      domain.Processor `json:"processor"`
+	BatchID        string           `json:"batch_id"`
+	SettlementDate time.Time        `json:"settlement_date"`
+	AgeSeconds     int64            `json:"age_seconds"`
+	Unmatched      int              `json:"unmatched"`
+}
+
+// OldestUnsettled is the oldest captured transaction with no settlement
+// record. Unsettled counts every such transaction, inside the settlement
+// window or not.
+type OldestUnsettled struct {
+	TransactionID string           `json:"transaction_id"`
+	Processor     domain.Processor `json:"processor"`
+	CapturedAt    time.Time        `json:"captured_at"`
+	AgeSeconds    int64            `json:"age_seconds"`
+	Unsettled     int              `json:"unsettled"`
+}
+
+// OpenImpact is the open discrepancies of one processor and severity:
+// how many there are and the sum of their absolute differences.
+type OpenImpact struct {
+	Processor domain.Processor `json:"processor"`
+	Severity  domain.Severity  `json:"severity"`
+	Count     int              `json:"count"`
+	ImpactUSD float64          `json:"impact_usd"`
+}
+
+// Exposure is the money a processor has authorized or captured and not yet
+// settled, counted as the dashboard counts it.
+type Exposure struct {
+	Processor    domain.Processor `json:"processor"`
+	Transactions int              `json:"transactions"`
+	USD          float64          `json:"usd"`
+}
+
+// DatabaseSize returns the current size of the database.
+func (r *DiagnosticsRepo) DatabaseSize() (*DatabaseSize, error) {
+	var size DatabaseSize
+	var pageSize int64
+	if err := r.db.QueryRow("PRAGMA page_size").Scan(&pageSize); err != nil {
+		return nil, fmt.Errorf("page_size: %w", err)
+	}
+	if err := r.db.QueryRow("PRAGMA page_count").Scan(&size.PageCount); err != nil {
+		return nil, fmt.Errorf("page_count: %w", err)
+	}
+	if err := r.db.QueryRow("PRAGMA freelist_count").Scan(&size.FreelistCount); err != nil {
+		return nil, fmt.Errorf("freelist_count: %w", err)
+	}
+	size.SizeBytes = pageSize * int64(size.PageCount)
+	if r.path != "" {
+		if fi, err := os.Stat(r.path + "-wal"); err == nil {
+			wal := fi.Size()
+			size.WALBytes = &wal
+		}
+	}
+	return &size, nil
+}
+
+// LastIngests returns the latest ingested report of each processor, with
+// its age as of now, ordered by processor.
+func (r *DiagnosticsRepo) LastIngests(now time.Time) ([]ProcessorIngest, error) {
+	// With MAX, SQLite takes the bare columns from the row holding the
+	// maximum, so id and batch_id are those of the latest report.
+	rows, err := r.db.Query(`
+		SELECT processor, id, batch_id, MAX(ingested_at), COUNT(*)
+		FROM settlement_reports
+		GROUP BY processor
+		ORDER BY processor`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ingests := []ProcessorIngest{}
+	for rows.Next() {
+		var in ProcessorIngest
+		var proc, ingestedAt string
+		if err := rows.Scan(&proc, &in.ReportID, &in.BatchID, &ingestedAt, &in.Reports); err != nil {
+			return nil, err
+		}
+		in.Processor = domain.Processor(proc)
+		in.IngestedAt, _ = time.Parse(time.RFC3339, ingestedAt)
+		in.AgeSeconds = ageSeconds(now, in.IngestedAt)
+		ingests = append(ingests, in)
+	}
+	return ingests, rows.Err()
+}
+
+// OldestUnmatchedSettlement returns the oldest unmatched settlement record
+// by settlement date, or nil when every record is matched.
+func (r *DiagnosticsRepo) OldestUnmatchedSettlement(now time.Time) (*OldestUnmatched, error) {
+	var o OldestUnmatched
+	if err := r.db.QueryRow("SELECT COUNT(*) FROM (" + unmatchedRecordsSQL + ")").Scan(&o.Unmatched); err != nil {
+		return nil, err
+	}
+	if o.Unmatched == 0 {
+		return nil, nil
+	}
+	var proc, date string
+	err := r.db.QueryRow(
+		"SELECT id, processor, batch_id, settlement_date FROM ("+unmatchedRecordsSQL+") ORDER BY settlement_date, id LIMIT 1",
+	).Scan(&o.SettlementID, &proc, &o.BatchID, &date)
+	if err != nil {
+		return nil, err
+	}
+	o.Processor = domain.Processor(proc)
+	o.SettlementDate, _ = time.Parse(time.RFC3339, date)
+	o.AgeSeconds = ageSeconds(now, o.SettlementDate)
+	return &o, nil
+}
+
+// OldestUnsettledCapture returns the captured transaction with no
+// settlement record that was captured first, or nil when there is none.
+func (r *DiagnosticsRepo) OldestUnsettledCapture(now time.Time) (*OldestUnsettled, error) {
+	const unsettled = `FROM transactions t
+		WHERE t.status = 'captured' AND t.captured_at IS NOT NULL
+			AND NOT EXISTS (SELECT 1 FROM settlement_records sr WHERE sr.wakala_transaction_id = t.id)`
+
+	var o OldestUnsettled
+	if err := r.db.QueryRow("SELECT COUNT(*) " + unsettled).Scan(&o.Unsettled); err != nil {
+		return nil, err
+	}
+	if o.Unsettled == 0 {
+		return nil, nil
+	}
+	var proc, capturedAt string
+	err := r.db.QueryRow("SELECT t.id, t.processor, t.captured_at "+unsettled+" ORDER BY t.captured_at, t.id LIMIT 1").
+		Scan(&o.TransactionID, &proc, &capturedAt)
+	if err != nil {
+		return nil, err
+	}
+	o.Processor = domain.Processor(proc)
+	o.CapturedAt, _ = time.Parse(time.RFC3339, capturedAt)
+	o.AgeSeconds = ageSeconds(now, o.CapturedAt)
+	return &o, nil
+}
+
+// OpenImpacts returns the open discrepancies, those with no resolution,
+// grouped by processor and severity.
+func (r *DiagnosticsRepo) OpenImpacts() ([]OpenImpact, error) {
+	rows, err := r.db.Query(`
+		SELECT processor, severity, COUNT(*), COALESCE(SUM(ABS(difference_usd)), 0)
+		FROM discrepancies
+		WHERE id NOT IN (SELECT discrepancy_id FROM discrepancy_resolutions)
+		GROUP BY processor, severity
+		ORDER BY processor, severity`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	impacts := []OpenImpact{}
+	for rows.Next() {
+		var o OpenImpact
+		var proc, sev string
+		if err := rows.Scan(&proc, &sev, &o.Count, &o.ImpactUSD); err != nil {
+			return nil, err
+		}
+		o.Processor, o.Severity = domain.Processor(proc), domain.Severity(sev)
+		impacts = append(impacts, o)
+	}
+	return impacts, rows.Err()
+}
+
+// UnsettledExposures returns the unsettled transactions of each processor
+// that has any, ordered by processor.
+func (r *DiagnosticsRepo) UnsettledExposures() ([]Exposure, error) {
+	rows, err := r.db.Query(`
+		SELECT processor, COUNT(*), COALESCE(SUM(usd_amount), 0)
+		FROM transactions
+		WHERE status IN ('authorized', 'captured')
+		GROUP BY processor
+		ORDER BY processor`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	exposures := []Exposure{}
+	for rows.Next() {
+		var e Exposure
+		var proc string
+		if err := rows.Scan(&proc, &e.Transactions, &e.USD); err != nil {
+			return nil, err
+		}
+		e.Processor = domain.Processor(proc)
+		exposures = append(exposures, e)
+	}
+	return exposures, rows.Err()
+}
+
+func ageSeconds(now, t time.Time) int64 {
+	if t.IsZero() || t.After(now) {
+		return 0
+	}
+	return int64(now.Sub(t) / time.Second)
+}
@@ -2,7 +2,11 @@ package repository
 
 import (
 	"database/sql"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 
@@ -10,13 +14,27 @@ import (
 )
 
 type DiscrepancyRepo struct {
-	db *sql.DB
+	db  dbtx
+	rdb *sql.DB
 }
 
 func NewDiscrepancyRepo(db *sql.DB) *DiscrepancyRepo {
 	return &DiscrepancyRepo{db: db}
 }
 
+// SetReader routes dashboard, list and summary queries to a separate
+// read-only connection pool. Reconciliation reads stay on the primary.
+func (r *DiscrepancyRepo) SetReader(rdb *sql.DB) {
+	r.rdb = rdb
+}
+
+func (r *DiscrepancyRepo) reader() dbtx {
+	if r.rdb != nil {
+		return limited(r.rdb)
+	}
+	return limited(r.db)
+}
+
 func (r *DiscrepancyRepo) Insert(d *domain.Discrepancy) error {
 	var txnID, settID any
 	if d.TransactionID != "" {
@@ -26,7 +44,13 @@ func (r *DiscrepancyRepo) Insert(d *domain.Discrepancy) error {
 		settID = d.SettlementID
 	}
 
-	_, err := r.db.Exec(
+	tx, err := begin(r.db)
+	if err != nil {
+		return fmt.Errorf("begin: %w", err)
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(
 		`INSERT INTO discrepancies
 		(id, type, transaction_id, settlement_id, processor, expected_usd,
 		 actual_usd, difference_usd, currency, severity, description, detected_at)
@@ -35,11 +59,17 @@ func (r *DiscrepancyRepo) Insert(d *domain.Discrepancy) error {
 		d.ExpectedUSD, d.ActualUSD, d.DifferenceUSD, d.Currency,
 		string(d.Severity), d.Description, d.DetectedAt.Format(time.RFC3339),
 	)
-	return err
+	if err != nil {
+		return err
+	}
+	if err := insertAttribution(tx, d); err != nil {
+		return err
+	}
+	return tx.Commit()
 }
 
 func (r *DiscrepancyRepo) BulkInsert(discs []domain.Discrepancy) (int, error) {
-	tx, err := r.db.Begin()
+	tx, err := begin(r.db)
 	if err != nil {
 		return 0, fmt.Errorf("begin: %w", err)
 	}
@@ -76,6 +106,37 @@ func (r *DiscrepancyRepo) BulkInsert(discs []domain.Discrepancy) (int, error) {
 		}
 		ra, _ := res.RowsAffected()
 		inserted += int(ra)
+		if ra == 0 {
+			continue
+		}
+
+		if err := insertAttribution(tx, d); err != nil {
+			return inserted, fmt.Errorf("insert attribution %d: %w", i, err)
+		}
+		if d.Policy != nil {
+			policy, err := json.Marshal(d.Policy)
+			if err != nil {
+				return inserted, fmt.Errorf("marshal policy %d: %w", i, err)
+			}
+			// The snapshot is of the rules the discrepancy was first
+			// detected under; later runs keep it.
+			_, err = tx.Exec(
+				"INSERT OR IGNORE INTO discrepancy_policies (discrepancy_id, version, policy_json) VALUES (?,?,?)",
+				d.ID, d.Policy.Version, string(policy),
+			)
+			if err != nil {
+				return inserted, fmt.Errorf("insert policy %d: %w", i, err)
+			}
+		}
+		if c := d.ProbableCause; c != nil {
+			_, err = tx.Exec(
+				"INSERT OR REPLACE INTO discrepancy_causes (discrepancy_id, cause, detail) VALUES (?,?,?)",
+				d.ID, string(c.Cause), c.Detail,
+			)
+			if err != nil {
+				return inserted, fmt.Errorf("insert cause %d: %w", i, err)
+			}
+		}
 	}
 
 	if err := tx.Commit(); err != nil {
@@ -84,6 +145,25 @@ func (r *DiscrepancyRepo) BulkInsert(discs []domain.Discrepancy) (int, error) {
 	return inserted, nil
 }
 
+// insertAttribution records the merchant and batch of d, if it has either.
+func insertAttribution(db dbtx, d *domain.Discrepancy) error {
+	if d.MerchantID == "" && d.BatchID == "" {
+		return nil
+	}
+	var merchantID, batchID any
+	if d.MerchantID != "" {
+		merchantID = d.MerchantID
+	}
+	if d.BatchID != "" {
+		batchID = d.BatchID
+	}
+	_, err := db.Exec(
+		"INSERT OR REPLACE INTO discrepancy_attributions (discrepancy_id, merchant_id, batch_id) VALUES (?,?,?)",
+		d.ID, merchantID, batchID,
+	)
+	return err
+}
+
 // GetByTransactionID returns all discrepancies related to a transaction.
 func (r *DiscrepancyRepo) GetByTransactionID(txnID string) ([]domain.Discrepancy, error) {
 	rows, err := r.db.Query(
@@ -93,13 +173,81 @@ func (r *DiscrepancyRepo) GetByTransactionID(txnID string) ([]domain.Discrepancy
 		return nil, err
 	}
 	defer rows.Close()
-	return scanDiscrepancies(rows)
+
+	discs, err := scanDiscrepancies(rows)
+	if err != nil {
+		return nil, err
+	}
+	if err := r.attach(discs); err != nil {
+		return nil, err
+	}
+	return discs, nil
+}
+
+// GetByTransactionIDs returns the discrepancies of each of the given
+// transactions, keyed by transaction ID, newest first.
+func (r *DiscrepancyRepo) GetByTransactionIDs(txnIDs []string) (map[string][]domain.Discrepancy, error) {
+	byTxn := make(map[string][]domain.Discrepancy)
+	if len(txnIDs) == 0 {
+		return byTxn, nil
+	}
+	args := make([]any, len(txnIDs))
+	for i, id := range txnIDs {
+		args[i] = id
+	}
+	rows, err := r.reader().Query(
+		"SELECT * FROM discrepancies WHERE transaction_id IN ("+strings.TrimSuffix(strings.Repeat("?,", len(txnIDs)), ",")+") ORDER BY detected_at DESC", args...,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	discs, err := scanDiscrepancies(rows)
+	if err != nil {
+		return nil, err
+	}
+	if err := r.attach(discs); err != nil {
+		return nil, err
+	}
+	for _, d := range discs {
+		byTxn[d.TransactionID] = append(byTxn[d.TransactionID], d)
+	}
+	return byTxn, nil
+}
+
+// GetBySettlementID returns discrepancies raised against a settlement record.
+func (r *DiscrepancyRepo) GetBySettlementID(settlementID string) ([]domain.Discrepancy, error) {
+	rows, err := r.db.Query(
+		"SELECT * FROM discrepancies WHERE settlement_id = ? ORDER BY detected_at DESC", settlementID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	discs, err := scanDiscrepancies(rows)
+	if err != nil {
+		return nil, err
+	}
+	if err := r.attach(discs); err != nil {
+		return nil, err
+	}
+	return discs, nil
 }
 
 type DiscrepancyFilter struct {
 	Type      string
 	Severity  string
 	Processor string
+	Merchant  string
+	BatchID   string
+	Tag       string
+	Team      string
+	Assignee  string
+	TicketID  string
+	Status    string // open or resolved, by the discrepancy's Resolution
+	CaseID    string
 	From      *time.Time
 	To        *time.Time
 	Page      int
@@ -110,7 +258,7 @@ func (r *DiscrepancyRepo) List(f DiscrepancyFilter) ([]domain.Discrepancy, int,
 	where, args := buildDiscrepancyWhere(f)
 
 	var total int
-	if err := r.db.QueryRow("SELECT COUNT(*) FROM discrepancies"+where, args...).Scan(&total); err != nil {
+	if err := r.reader().QueryRow("SELECT COUNT(*) FROM discrepancies"+where, args...).Scan(&total); err != nil {
 		return nil, 0, err
 	}
 
@@ -125,26 +273,74 @@ func (r *DiscrepancyRepo) List(f DiscrepancyFilter) ([]domain.Discrepancy, int,
 	q := "SELECT * FROM discrepancies" + where + " ORDER BY detected_at DESC LIMIT ? OFFSET ?"
 	args = append(args, f.Limit, offset)
 
-	rows, err := r.db.Query(q, args...)
+	rows, err := r.reader().Query(q, args...)
 	if err != nil {
 		return nil, 0, err
 	}
 	defer rows.Close()
 
 	discs, err := scanDiscrepancies(rows)
-	return discs, total, err
+	if err != nil {
+		return nil, 0, err
+	}
+	if err := r.attach(discs); err != nil {
+		return nil, 0, err
+	}
+	return discs, total, nil
+}
+
+// Each calls fn for every discrepancy matching f, in ID order, with its
+// tags and attributions. Page and Limit are ignored. Rows are read in
+// chunks, so discrepancies rebuilt by a run during the iteration may be
+// seen before or after the rebuild, but never twice. An error from fn stops
+// the iteration and is returned.
+func (r *DiscrepancyRepo) Each(f DiscrepancyFilter, fn func(*domain.Discrepancy) error) error {
+	where, args := buildDiscrepancyWhere(f)
+	q := "SELECT * FROM discrepancies" + afterKey(where, "id") + " ORDER BY id LIMIT ?"
+
+	after := ""
+	for {
+		rows, err := r.reader().Query(q, append(args, after, streamChunk)...)
+		if err != nil {
+			return err
+		}
+		discs, err := scanDiscrepancies(rows)
+		rows.Close()
+		if err != nil {
+			return err
+		}
+		if err := r.attach(discs); err != nil {
+			return err
+		}
+		for i := range discs {
+			if err := fn(&discs[i]); err != nil {
+				return err
+			}
+		}
+		if len(discs) < streamChunk {
+			return nil
+		}
+		after = discs[len(discs)-1].ID
+	}
 }
 
 type DiscrepancySummary struct {
-	TotalCount    int                `json:"total_count"`
-	TotalImpact   float64            `json:"total_impact_usd"`
-	ByType        map[string]int     `json:"by_type"`
-	BySeverity    map[string]int     `json:"by_severity"`
-	ByProcessor   map[string]int     `json:"by_processor"`
-	ImpactByProc  map[string]float64 `json:"impact_by_processor"`
+	TotalCount   int                `json:"total_count"`
+	TotalImpact  float64            `json:"total_impact_usd"`
+	ByType       map[string]int     `json:"by_type"`
+	BySeverity   map[string]int     `json:"by_severity"`
+	ByProcessor  map[string]int     `json:"by_processor"`
+	ImpactByProc map[string]float64 `json:"impact_by_processor"`
+	// GroupBy and Groups are set when the caller asks for a breakdown by
+	// other dimensions; see GroupBy.
+	GroupBy []string           `json:"group_by,omitempty"`
+	Groups  []DiscrepancyGroup `json:"groups,omitempty"`
+	// AsOf is set when the summary was read from a daily snapshot.
+	AsOf *AsOf `json:"as_of,omitempty"`
 }
 
-func (r *DiscrepancyRepo) GetSummary() (*DiscrepancySummary, error) {
+// GetSummary counts the discrepancies in scope.
+func (r *DiscrepancyRepo) GetSummary(scope DashboardScope) (*DiscrepancySummary, error) {
 	s := &DiscrepancySummary{
 		ByType:       make(map[string]int),
 		BySeverity:   make(map[string]int),
@@ -152,122 +348,1154 @@ func (r *DiscrepancyRepo) GetSummary() (*DiscrepancySummary, error) {
 		ImpactByProc: make(map[string]float64),
 	}
 
-	if err := r.db.QueryRow(
-		"SELECT COUNT(*), COALESCE(SUM(ABS(difference_usd)),0) FROM discrepancies",
+	where, args := scope.discrepancyWhere()
+	if err := r.reader().QueryRow(
+		"SELECT COUNT(*), COALESCE(SUM(ABS(d.difference_usd)),0) FROM discrepancies d"+where, args...,
 	).Scan(&s.TotalCount, &s.TotalImpact); err != nil {
 		return nil, err
 	}
-
-	if err := scanGroupCount(r.db, "type", s.ByType); err != nil {
+	err := s.fill(func(dim string) ([]DiscrepancyGroup, error) {
+		return groupDiscrepancies(r.reader(), []string{dim}, scope)
+	})
+	if err != nil {
 		return nil, err
 	}
-	if err := scanGroupCount(r.db, "severity", s.BySeverity); err != nil {
-		return nil, err
+	return s, nil
+}
+
+// fill sets the summary's breakdowns by type, severity and processor from
+// the groups by each that group returns.
+func (s *DiscrepancySummary) fill(group func(dim string) ([]DiscrepancyGroup, error)) error {
+	for dim, counts := range map[string]map[string]int{
+		"type": s.ByType, "severity": s.BySeverity, "processor": s.ByProcessor,
+	} {
+		groups, err := group(dim)
+		if err != nil {
+			return err
+		}
+		for _, g := range groups {
+			counts[g.Keys[dim]] = g.Count
+			if dim == "processor" {
+				s.ImpactByProc[g.Keys[dim]] = g.ImpactUSD
+			}
+		}
+	}
+	return nil
+}
+
+// discrepancyDimensions are the fields discrepancies can be grouped by and
+// the SQL each groups on. Only these fixed expressions are ever written into
+// a query. Merchant is the one recorded at detection; orphaned settlements
+// have none and group as "unknown".
+var discrepancyDimensions = map[string]string{
+	"type":      "d.type",
+	"severity":  "d.severity",
+	"processor": "d.processor",
+	"currency":  "d.currency",
+	"merchant":  "COALESCE(a.merchant_id, 'unknown')",
+}
+
+// DiscrepancyDimensions returns the names GroupBy accepts, sorted.
+func DiscrepancyDimensions() []string {
+	names := make([]string, 0, len(discrepancyDimensions))
+	for name := range discrepancyDimensions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// DiscrepancyGroup is the count and USD impact of the discrepancies sharing
+// one value of each grouped dimension.
+type DiscrepancyGroup struct {
+	Keys      map[string]string `json:"keys"`
+	Count     int               `json:"count"`
+	ImpactUSD float64           `json:"impact_usd"`
+}
+
+// GroupBy counts discrepancies by the given dimensions together, largest
+// groups first. It returns an error naming the valid dimensions if one is
+// unknown.
+func (r *DiscrepancyRepo) GroupBy(dims ...string) ([]DiscrepancyGroup, error) {
+	return groupDiscrepancies(r.reader(), dims, DashboardScope{})
+}
+
+func groupDiscrepancies(db dbtx, dims []string, scope DashboardScope) ([]DiscrepancyGroup, error) {
+	from := "discrepancies d"
+	for _, dim := range dims {
+		if dim == "merchant" {
+			from += " LEFT JOIN discrepancy_attributions a ON a.discrepancy_id = d.id"
+			break
+		}
+	}
+	where, args := scope.discrepancyWhere()
+	return groupRows(db, dims, discrepancyDimensions, from+where, args)
+}
+
+// ValidateDimensions returns an error naming the valid dimensions if one of
+// dims is unknown or given twice, or if there are none.
+func ValidateDimensions(dims []string) error {
+	if len(dims) == 0 {
+		return errors.New("at least one dimension is required")
+	}
+	seen := make(map[string]bool, len(dims))
+	for _, dim := range dims {
+		if _, ok := discrepancyDimensions[dim]; !ok {
+			return fmt.Errorf("unknown dimension %q: must be one of %s",
+				dim, strings.Join(DiscrepancyDimensions(), ", "))
+		}
+		if seen[dim] {
+			return fmt.Errorf("dimension %q given twice", dim)
+		}
+		seen[dim] = true
 	}
-	if err := scanGroupCount(r.db, "processor", s.ByProcessor); err != nil {
+	return nil
+}
+
+// groupRows counts the rows of from, a FROM clause with its WHERE, by dims,
+// each grouped on its SQL in dimensions, largest groups first.
+func groupRows(db dbtx, dims []string, dimensions map[string]string, from string, args []any) ([]DiscrepancyGroup, error) {
+	if err := ValidateDimensions(dims); err != nil {
 		return nil, err
 	}
+	exprs := make([]string, len(dims))
+	positions := make([]string, len(dims))
+	for i, dim := range dims {
+		exprs[i] = dimensions[dim]
+		positions[i] = strconv.Itoa(i + 1)
+	}
 
-	rows, err := r.db.Query(
-		"SELECT processor, COALESCE(SUM(ABS(difference_usd)),0) FROM discrepancies GROUP BY processor",
-	)
+	q := "SELECT " + strings.Join(exprs, ", ") +
+		", COUNT(*), COALESCE(SUM(ABS(d.difference_usd)),0) FROM " + from +
+		" GROUP BY " + strings.Join(positions, ", ") +
+		" ORDER BY COUNT(*) DESC, " + strings.Join(positions, ", ")
+
+	rows, err := db.Query(q, args...)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
+
+	groups := []DiscrepancyGroup{}
 	for rows.Next() {
-		var p string
-		var v float64
-		if err := rows.Scan(&p, &v); err != nil {
+		values := make([]string, len(dims))
+		dest := make([]any, 0, len(dims)+2)
+		for i := range values {
+			dest = append(dest, &values[i])
+		}
+		var g DiscrepancyGroup
+		dest = append(dest, &g.Count, &g.ImpactUSD)
+		if err := rows.Scan(dest...); err != nil {
 			return nil, err
 		}
-		s.ImpactByProc[p] = v
+		g.Keys = make(map[string]string, len(dims))
+		for i, dim := range dims {
+			g.Keys[dim] = values[i]
+		}
+		groups = append(groups, g)
 	}
+	return groups, rows.Err()
+}
 
-	return s, rows.Err()
+// Exists reports whether a discrepancy with the given ID is currently stored.
+func (r *DiscrepancyRepo) Exists(id string) (bool, error) {
+	var count int
+	err := r.db.QueryRow("SELECT COUNT(*) FROM discrepancies WHERE id = ?", id).Scan(&count)
+	return count > 0, err
 }
 
-// ClearAll removes all discrepancies (useful before re-running reconciliation).
-func (r *DiscrepancyRepo) ClearAll() error {
-	_, err := r.db.Exec("DELETE FROM discrepancies")
-	return err
+// AddTags attaches tags to a discrepancy. Tags are stored separately from the
+// discrepancy row and keyed by its deterministic ID, so they survive full
+// reconciliation re-runs.
+func (r *DiscrepancyRepo) AddTags(discID string, tags []string) error {
+	tx, err := begin(r.db)
+	if err != nil {
+		return fmt.Errorf("begin: %w", err)
+	}
+	defer tx.Rollback()
+
+	now := time.Now().UTC().Format(time.RFC3339)
+	for _, tag := range tags {
+		if _, err := tx.Exec(
+			"INSERT OR IGNORE INTO discrepancy_tags (discrepancy_id, tag, created_at) VALUES (?,?,?)",
+			discID, tag, now,
+		); err != nil {
+			return fmt.Errorf("insert tag %q: %w", tag, err)
+		}
+	}
+	return tx.Commit()
 }
 
-type ProcessorDiscrepancyStat struct {
-	Processor        string  `json:"processor"`
-	DiscrepancyCount int     `json:"discrepancy_count"`
-	ImpactUSD        float64 `json:"discrepancy_impact_usd"`
+// RemoveTag detaches a tag from a discrepancy. It returns sql.ErrNoRows when
+// the tag was not present.
+func (r *DiscrepancyRepo) RemoveTag(discID, tag string) error {
+	res, err := r.db.Exec(
+		"DELETE FROM discrepancy_tags WHERE discrepancy_id = ? AND tag = ?", discID, tag,
+	)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
 }
 
-func (r *DiscrepancyRepo) GetStatsByProcessor() ([]ProcessorDiscrepancyStat, error) {
-	rows, err := r.db.Query(`
-		SELECT processor, COUNT(*), COALESCE(SUM(ABS(difference_usd)),0)
-		FROM discrepancies GROUP BY processor
-	`)
+// GetTags returns the sorted tags on a discrepancy.
+func (r *DiscrepancyRepo) GetTags(discID string) ([]string, error) {
+	rows, err := r.db.Query(
+		"SELECT tag FROM discrepancy_tags WHERE discrepancy_id = ? ORDER BY tag", discID,
+	)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	var stats []ProcessorDiscrepancyStat
+	var tags []string
 	for rows.Next() {
-		var s ProcessorDiscrepancyStat
-		if err := rows.Scan(&s.Processor, &s.DiscrepancyCount, &s.ImpactUSD); err != nil {
+		var t string
+		if err := rows.Scan(&t); err != nil {
 			return nil, err
 		}
-		stats = append(stats, s)
+		tags = append(tags, t)
 	}
-	return stats, rows.Err()
+	return tags, rows.Err()
 }
 
-// --- helpers ---
+// ListUnassigned returns the current discrepancies no routing rule has
+// assigned yet, with their attributions, in ID order.
+func (r *DiscrepancyRepo) ListUnassigned() ([]domain.Discrepancy, error) {
+	rows, err := r.db.Query(`SELECT * FROM discrepancies
+		WHERE id NOT IN (SELECT discrepancy_id FROM discrepancy_assignments) ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
 
-func buildDiscrepancyWhere(f DiscrepancyFilter) (string, []any) {
-	var clauses []string
-	var args []any
+	discs, err := scanDiscrepancies(rows)
+	if err != nil {
+		return nil, err
+	}
+	return discs, r.attachAttributions(discs)
+}
 
-	if f.Type != "" {
-		clauses = append(clauses, "type = ?")
-		args = append(args, f.Type)
+// Assign records who a discrepancy was routed to. A discrepancy keeps its
+// first assignment; assigning it again does nothing.
+func (r *DiscrepancyRepo) Assign(discID string, a *domain.DiscrepancyAssignment) error {
+	_, err := r.db.Exec(
+		`INSERT OR IGNORE INTO discrepancy_assignments (discrepancy_id, team, assignee, rule_id, assigned_at)
+		VALUES (?,?,?,?,?)`,
+		discID, a.Team, a.Assignee, a.RuleID, a.AssignedAt.Format(time.RFC3339),
+	)
+	return err
+}
+
+// SetTicket links a discrepancy to an external ticket, replacing the link it
+// had, and returns the one replaced, or nil.
+func (r *DiscrepancyRepo) SetTicket(discID string, t *domain.ExternalTicket) (*domain.ExternalTicket, error) {
+	tx, err := begin(r.db)
+	if err != nil {
+		return nil, fmt.Errorf("begin: %w", err)
 	}
-	if f.Severity != "" {
-		clauses = append(clauses, "severity = ?")
-		args = append(args, f.Severity)
+	defer tx.Rollback()
+
+	prev, err := getTicket(tx, discID)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, err
 	}
-	if f.Processor != "" {
-		clauses = append(clauses, "processor = ?")
-		args = append(args, f.Processor)
+	if _, err := tx.Exec(
+		`INSERT OR REPLACE INTO discrepancy_tickets (discrepancy_id, system, ticket_id, url, linked_by, linked_at)
+		VALUES (?,?,?,?,?,?)`,
+		discID, t.System, t.TicketID, t.URL, t.LinkedBy, t.LinkedAt.Format(time.RFC3339),
+	); err != nil {
+		return nil, err
 	}
-	if f.From != nil {
-		clauses = append(clauses, "detected_at >= ?")
-		args = append(args, f.From.Format(time.RFC3339))
+	return prev, tx.Commit()
+}
+
+// RemoveTicket removes a discrepancy's ticket link and returns it. It
+// returns sql.ErrNoRows when the discrepancy had none.
+func (r *DiscrepancyRepo) RemoveTicket(discID string) (*domain.ExternalTicket, error) {
+	tx, err := begin(r.db)
+	if err != nil {
+		return nil, fmt.Errorf("begin: %w", err)
 	}
-	if f.To != nil {
-		clauses = append(clauses, "detected_at <= ?")
-		args = append(args, f.To.Format(time.RFC3339))
+	defer tx.Rollback()
+
+	prev, err := getTicket(tx, discID)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := tx.Exec("DELETE FROM discrepancy_tickets WHERE discrepancy_id = ?", discID); err != nil {
+		return nil, err
 	}
+	return prev, tx.Commit()
+}
 
-	if len(clauses) == 0 {
-		return "", nil
+// Resolve marks a discrepancy resolved in an external workflow, replacing
+// any resolution it had.
+func (r *DiscrepancyRepo) Resolve(discID string, res *domain.DiscrepancyResolution) error {
+	_, err := r.db.Exec(
+		`INSERT OR REPLACE INTO discrepancy_resolutions (discrepancy_id, source, reference, status, resolved_by, resolved_at)
+		VALUES (?,?,?,?,?,?)`,
+		discID, res.Source, res.Reference, res.Status, res.ResolvedBy, res.ResolvedAt.Format(time.RFC3339),
+	)
+	return err
+}
+
+// Unresolve withdraws a discrepancy's resolution. It returns sql.ErrNoRows
+// when it had none.
+func (r *DiscrepancyRepo) Unresolve(discID string) error {
+	res, err := r.db.Exec("DELETE FROM discrepancy_resolutions WHERE discrepancy_id = ?", discID)
+	if err != nil {
+		return err
 	}
-	return " WHERE " + strings.Join(clauses, " AND "), args
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+func getTicket(db dbtx, discID string) (*domain.ExternalTicket, error) {
+	var t domain.ExternalTicket
+	var linkedAt string
+	err := db.QueryRow(
+		"SELECT system, ticket_id, url, linked_by, linked_at FROM discrepancy_tickets WHERE discrepancy_id = ?", discID,
+	).Scan(&t.System, &t.TicketID, &t.URL, &t.LinkedBy, &linkedAt)
+	if err != nil {
+		return nil, err
+	}
+	t.LinkedAt, _ = time.Parse(time.RFC3339, linkedAt)
+	return &t, nil
 }
 
-func scanGroupCount(db *sql.DB, col string, m map[string]int) error {
-	rows, err := db.Query(
-		"SELECT " + col + ", COUNT(*) FROM discrepancies GROUP BY " + col,
+// AddActivity appends an entry to a discrepancy's activity log and sets its
+// ID.
+func (r *DiscrepancyRepo) AddActivity(a *domain.DiscrepancyActivity) error {
+	res, err := r.db.Exec(
+		`INSERT INTO discrepancy_activity (discrepancy_id, at, actor, action, from_value, to_value)
+		VALUES (?,?,?,?,?,?)`,
+		a.DiscrepancyID, a.At.Format(time.RFC3339), a.Actor, string(a.Action), a.From, a.To,
 	)
 	if err != nil {
 		return err
 	}
+	a.ID, err = res.LastInsertId()
+	return err
+}
+
+// GetActivity returns a discrepancy's activity log, oldest first.
+func (r *DiscrepancyRepo) GetActivity(discID string) ([]domain.DiscrepancyActivity, error) {
+	rows, err := r.reader().Query(
+		"SELECT * FROM discrepancy_activity WHERE discrepancy_id = ? ORDER BY id", discID,
+	)
+	if err != nil {
+		return nil, err
+	}
 	defer rows.Close()
+
+	result := []domain.DiscrepancyActivity{}
 	for rows.Next() {
-		var k string
-		var v int
-		if err := rows.Scan(&k, &v); err != nil {
-			return err
+		var a domain.DiscrepancyActivity
+		var at, action string
+		if err := rows.Scan(&a.ID, &a.DiscrepancyID, &at, &a.Actor, &action, &a.From, &a.To); err != nil {
+			return nil, err
+		}
+		a.At, _ = time.Parse(time.RFC3339, at)
+		a.Action = domain.ActivityAction(action)
+		result = append(result, a)
+	}
+	return result, rows.Err()
+}
+
+// ListMismatches returns the current amount mismatches with their tags and
+// resolutions.
+func (r *DiscrepancyRepo) ListMismatches() ([]domain.Discrepancy, error) {
+	rows, err := r.db.Query("SELECT * FROM discrepancies WHERE type = ? ORDER BY id", string(domain.DiscrepancyAmountMismatch))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	discs, err := scanDiscrepancies(rows)
+	if err != nil {
+		return nil, err
+	}
+	if err := r.attachTags(discs); err != nil {
+		return nil, err
+	}
+	return discs, r.attachResolutions(discs)
+}
+
+// ListAll returns every current discrepancy, without tags or attributions.
+func (r *DiscrepancyRepo) ListAll() ([]domain.Discrepancy, error) {
+	rows, err := r.db.Query("SELECT * FROM discrepancies ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return scanDiscrepancies(rows)
+}
+
+// UpdateSeverity sets a discrepancy's severity.
+func (r *DiscrepancyRepo) UpdateSeverity(id string, sev domain.Severity) error {
+	_, err := r.db.Exec("UPDATE discrepancies SET severity = ? WHERE id = ?", string(sev), id)
+	return err
+}
+
+// ClearAll removes all discrepancies (useful before re-running reconciliation).
+// Their policy snapshots are kept, so a discrepancy raised again keeps the
+// rules it was first detected under.
+func (r *DiscrepancyRepo) ClearAll() error {
+	if _, err := r.db.Exec("DELETE FROM discrepancy_causes"); err != nil {
+		return err
+	}
+	if _, err := r.db.Exec("DELETE FROM discrepancy_attributions"); err != nil {
+		return err
+	}
+	_, err := r.db.Exec("DELETE FROM discrepancies")
+	return err
+}
+
+// RunScope narrows a reconciliation run to one processor and/or a date
+// range. The zero value covers everything. From and To bound transaction
+// creation times, To exclusive; a discrepancy is dated by its transaction,
+// or by its settlement record when it has none, as in DashboardScope.
+type RunScope struct {
+	Processor string     `json:"processor,omitempty"`
+	From      *time.Time `json:"from,omitempty"`
+	To        *time.Time `json:"to,omitempty"`
+}
+
+// IsZero reports whether the scope covers everything.
+func (s RunScope) IsZero() bool {
+	return s.Processor == "" && s.From == nil && s.To == nil
+}
+
+// String describes the scope for the log, To shown as the last day covered.
+func (s RunScope) String() string {
+	var parts []string
+	if s.Processor != "" {
+		parts = append(parts, "processor "+s.Processor)
+	}
+	if s.From != nil {
+		parts = append(parts, "from "+s.From.UTC().Format("2006-01-02"))
+	}
+	if s.To != nil {
+		parts = append(parts, "to "+s.To.UTC().Add(-time.Nanosecond).Format("2006-01-02"))
+	}
+	if len(parts) == 0 {
+		return "everything"
+	}
+	return strings.Join(parts, " ")
+}
+
+// CoversProcessor reports whether the scope includes processor's records.
+func (s RunScope) CoversProcessor(processor domain.Processor) bool {
+	return s.Processor == "" || s.Processor == string(processor)
+}
+
+// Covers reports whether the scope includes a discrepancy of processor
+// dated at.
+func (s RunScope) Covers(processor domain.Processor, at time.Time) bool {
+	if !s.CoversProcessor(processor) {
+		return false
+	}
+	if s.From != nil && at.Before(*s.From) {
+		return false
+	}
+	return s.To == nil || at.Before(*s.To)
+}
+
+// ClearScope is ClearAll for the discrepancies in scope; the rest are kept.
+func (r *DiscrepancyRepo) ClearScope(s RunScope) error {
+	var clauses []string
+	var args []any
+	if s.Processor != "" {
+		clauses = append(clauses, "d.processor = ?")
+		args = append(args, s.Processor)
+	}
+	if s.From != nil {
+		clauses = append(clauses, discrepancyDateSQL+" >= ?")
+		args = append(args, s.From.UTC().Format(time.RFC3339))
+	}
+	if s.To != nil {
+		clauses = append(clauses, discrepancyDateSQL+" < ?")
+		args = append(args, s.To.UTC().Format(time.RFC3339))
+	}
+	inScope := "SELECT d.id FROM discrepancies d" + whereClause(clauses)
+
+	if _, err := r.db.Exec("DELETE FROM discrepancy_causes WHERE discrepancy_id IN ("+inScope+")", args...); err != nil {
+		return err
+	}
+	if _, err := r.db.Exec("DELETE FROM discrepancy_attributions WHERE discrepancy_id IN ("+inScope+")", args...); err != nil {
+		return err
+	}
+	_, err := r.db.Exec("DELETE FROM discrepancies WHERE id IN ("+inScope+")", args...)
+	return err
+}
+
+// GetByID returns one discrepancy with its tags and detection policy. It
+// returns sql.ErrNoRows when absent.
+func (r *DiscrepancyRepo) GetByID(id string) (*domain.Discrepancy, error) {
+	rows, err := r.reader().Query("SELECT * FROM discrepancies WHERE id = ?", id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	discs, err := scanDiscrepancies(rows)
+	if err != nil {
+		return nil, err
+	}
+	if len(discs) == 0 {
+		return nil, sql.ErrNoRows
+	}
+	if err := r.attach(discs); err != nil {
+		return nil, err
+	}
+	d := &discs[0]
+
+	var policy string
+	err = r.reader().QueryRow(
+		"SELECT policy_json FROM discrepancy_policies WHERE discrepancy_id = ?", id,
+	).Scan(&policy)
+	switch {
+	case err == sql.ErrNoRows:
+		// Detected before policies were recorded.
+	case err != nil:
+		return nil, err
+	default:
+		d.Policy = &domain.ReconciliationPolicy{}
+		if err := json.Unmarshal([]byte(policy), d.Policy); err != nil {
+			return nil, fmt.Errorf("discrepancy %s policy: %w", id, err)
+		}
+	}
+	return d, nil
+}
+
+// TopByImpact returns the n discrepancies with the largest absolute USD
+// difference, with their ticket links.
+func (r *DiscrepancyRepo) TopByImpact(n int) ([]domain.Discrepancy, error) {
+	rows, err := r.reader().Query(
+		"SELECT * FROM discrepancies ORDER BY ABS(difference_usd) DESC, id LIMIT ?", n,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	discs, err := scanDiscrepancies(rows)
+	if err != nil {
+		return nil, err
+	}
+	return discs, r.attachTickets(discs)
+}
+
+type ProcessorDiscrepancyStat struct {
+	Processor        string  `json:"processor"`
+	DiscrepancyCount int     `json:"discrepancy_count"`
+	ImpactUSD        float64 `json:"discrepancy_impact_usd"`
+}
+
+func (r *DiscrepancyRepo) GetStatsByProcessor(scope DashboardScope) ([]ProcessorDiscrepancyStat, error) {
+	where, args := scope.discrepancyWhere()
+	rows, err := r.reader().Query(`
+		SELECT d.processor, COUNT(*), COALESCE(SUM(ABS(d.difference_usd)),0)
+		FROM discrepancies d`+where+` GROUP BY d.processor`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var stats []ProcessorDiscrepancyStat
+	for rows.Next() {
+		var s ProcessorDiscrepancyStat
+		if err := rows.Scan(&s.Processor, &s.DiscrepancyCount, &s.ImpactUSD); err != nil {
+			return nil, err
+		}
+		stats = append(stats, s)
+	}
+	return stats, rows.Err()
+}
+
+// Offender is a merchant or batch ranked by the USD impact of its open
+// discrepancies, those with no resolution. Processor is only set for batches, whose IDs are per
+// processor.
+type Offender struct {
+	ID                string  `json:"id"`
+	Processor         string  `json:"processor,omitempty"`
+	DiscrepancyCount  int     `json:"discrepancy_count"`
+	HighSeverityCount int     `json:"high_severity_count"`
+	ImpactUSD         float64 `json:"discrepancy_impact_usd"`
+}
+
+// TopMerchants returns the n merchants with the largest discrepancy impact.
+// A merchant's discrepancies across all processors count together.
+// Discrepancies without a merchant, such as orphaned settlements, are left
+// out. A non-empty processor limits the ranking to that processor.
+func (r *DiscrepancyRepo) TopMerchants(processor string, n int) ([]Offender, error) {
+	return r.topOffenders("a.merchant_id", "", processor, n)
+}
+
+// TopBatches returns the n batches with the largest discrepancy impact.
+// Discrepancies without a batch, such as missing settlements, are left out.
+func (r *DiscrepancyRepo) TopBatches(processor string, n int) ([]Offender, error) {
+	return r.topOffenders("a.batch_id", "d.processor", processor, n)
+}
+
+func (r *DiscrepancyRepo) topOffenders(idExpr, procExpr, processor string, n int) ([]Offender, error) {
+	if procExpr == "" {
+		procExpr = "''"
+	}
+	q := "SELECT " + idExpr + ", " + procExpr + `, COUNT(*),
+		SUM(CASE WHEN d.severity IN ('HIGH','CRITICAL') THEN 1 ELSE 0 END),
+		COALESCE(SUM(ABS(d.difference_usd)),0)
+		FROM discrepancies d
+		JOIN discrepancy_attributions a ON a.discrepancy_id = d.id
+		WHERE ` + idExpr + ` != ''
+			AND d.id NOT IN (SELECT discrepancy_id FROM discrepancy_resolutions)`
+	var args []any
+	if processor != "" {
+		q += " AND d.processor = ?"
+		args = append(args, processor)
+	}
+	q += " GROUP BY 1, 2 ORDER BY 5 DESC, 3 DESC, 1, 2 LIMIT ?"
+	args = append(args, n)
+
+	rows, err := r.reader().Query(q, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	offenders := []Offender{}
+	for rows.Next() {
+		var o Offender
+		if err := rows.Scan(&o.ID, &o.Processor, &o.DiscrepancyCount, &o.HighSeverityCount, &o.ImpactUSD); err != nil {
+			return nil, err
+		}
+		offenders = append(offenders, o)
+	}
+	return offenders, rows.Err()
+}
+
+// ListUnopened returns the current discrepancies with no open spell: those
+// the next SyncLifecycle opens.
+func (r *DiscrepancyRepo) ListUnopened() ([]domain.Discrepancy, error) {
+	rows, err := r.db.Query(`SELECT * FROM discrepancies
+		WHERE id NOT IN (SELECT discrepancy_id FROM discrepancy_lifecycle WHERE resolved_at IS NULL) ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return scanDiscrepancies(rows)
+}
+
+// LatestLifecycleAt returns the time of the latest spell opened or resolved,
+// or the zero time when none has been recorded.
+func (r *DiscrepancyRepo) LatestLifecycleAt() (time.Time, error) {
+	var latest sql.NullString
+	err := r.db.QueryRow(
+		"SELECT MAX(MAX(opened_at, COALESCE(resolved_at, opened_at))) FROM discrepancy_lifecycle",
+	).Scan(&latest)
+	if err != nil || !latest.Valid {
+		return time.Time{}, err
+	}
+	return time.Parse(time.RFC3339, latest.String)
+}
+
+// SyncLifecycle records, after a full run, which discrepancies appeared and
+// which disappeared since the previous run, both at time at. A discrepancy
+// that comes back after being resolved starts a new open spell.
+func (r *DiscrepancyRepo) SyncLifecycle(at time.Time) (opened, resolved int, err error) {
+	ts := at.UTC().Format(time.RFC3339)
+
+	tx, err := begin(r.db)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer tx.Rollback()
+
+	// An as-of run earlier than the opening run must not resolve a spell
+	// before it started.
+	res, err := tx.Exec(`
+		UPDATE discrepancy_lifecycle SET resolved_at = MAX(?, opened_at)
+		WHERE resolved_at IS NULL AND discrepancy_id NOT IN (SELECT id FROM discrepancies)
+	`, ts)
+	if err != nil {
+		return 0, 0, fmt.Errorf("resolve: %w", err)
+	}
+	n, _ := res.RowsAffected()
+	resolved = int(n)
+
+	res, err = tx.Exec(`
+		INSERT INTO discrepancy_lifecycle (discrepancy_id, type, processor, severity, opened_at)
+		SELECT id, type, processor, severity, ? FROM discrepancies
+		WHERE id NOT IN (SELECT discrepancy_id FROM discrepancy_lifecycle WHERE resolved_at IS NULL)
+	`, ts)
+	if err != nil {
+		return 0, 0, fmt.Errorf("open: %w", err)
+	}
+	n, _ = res.RowsAffected()
+	opened = int(n)
+
+	return opened, resolved, tx.Commit()
+}
+
+// OpenSince returns, by ID, the discrepancies of type t and since when each
+// has been open: the start of its open spell, or its detection time until a
+// full run records one.
+func (r *DiscrepancyRepo) OpenSince(t domain.DiscrepancyType) (map[string]time.Time, error) {
+	rows, err := r.db.Query(`
+		SELECT d.id, COALESCE(l.opened_at, d.detected_at) FROM discrepancies d
+		LEFT JOIN discrepancy_lifecycle l ON l.discrepancy_id = d.id AND l.resolved_at IS NULL
+		WHERE d.type = ?`, string(t),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	since := make(map[string]time.Time)
+	for rows.Next() {
+		var id, openedAt string
+		if err := rows.Scan(&id, &openedAt); err != nil {
+			return nil, err
+		}
+		since[id], _ = time.Parse(time.RFC3339, openedAt)
+	}
+	return since, rows.Err()
+}
+
+// DiscrepancyFlowFilter narrows GetFlow to one processor and/or type, over
+// [From, To).
+type DiscrepancyFlowFilter struct {
+	Processor string
+	Type      string
+	From      time.Time
+	To        time.Time
+}
+
+// DiscrepancyFlowDay is the number of discrepancies opened and resolved on
+// one UTC day.
+type DiscrepancyFlowDay struct {
+	Day      string
+	Opened   int
+	Resolved int
+}
+
+// GetFlow returns the number of discrepancies open at f.From and the days in
+// the range on which any were opened or resolved, oldest first.
+func (r *DiscrepancyRepo) GetFlow(f DiscrepancyFlowFilter) (int, []DiscrepancyFlowDay, error) {
+	var clauses []string
+	var args []any
+	if f.Processor != "" {
+		clauses = append(clauses, "processor = ?")
+		args = append(args, f.Processor)
+	}
+	if f.Type != "" {
+		clauses = append(clauses, "type = ?")
+		args = append(args, f.Type)
+	}
+	filter := ""
+	if len(clauses) > 0 {
+		filter = " AND " + strings.Join(clauses, " AND ")
+	}
+	from := f.From.UTC().Format(time.RFC3339)
+	to := f.To.UTC().Format(time.RFC3339)
+
+	var openAtStart int
+	err := r.reader().QueryRow(
+		"SELECT COUNT(*) FROM discrepancy_lifecycle WHERE opened_at < ? AND (resolved_at IS NULL OR resolved_at >= ?)"+filter,
+		append([]any{from, from}, args...)...,
+	).Scan(&openAtStart)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	rows, err := r.reader().Query(`
+		SELECT day, SUM(opened), SUM(resolved) FROM (
+			SELECT substr(opened_at, 1, 10) AS day, 1 AS opened, 0 AS resolved
+			FROM discrepancy_lifecycle WHERE opened_at >= ? AND opened_at < ?`+filter+`
+			UNION ALL
+			SELECT substr(resolved_at, 1, 10), 0, 1
+			FROM discrepancy_lifecycle WHERE resolved_at >= ? AND resolved_at < ?`+filter+`
+		) GROUP BY day ORDER BY day
+	`, append(append(append([]any{from, to}, args...), from, to), args...)...)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer rows.Close()
+
+	var days []DiscrepancyFlowDay
+	for rows.Next() {
+		var d DiscrepancyFlowDay
+		if err := rows.Scan(&d.Day, &d.Opened, &d.Resolved); err != nil {
+			return 0, nil, err
+		}
+		days = append(days, d)
+	}
+	return openAtStart, days, rows.Err()
+}
+
+// --- helpers ---
+
+func buildDiscrepancyWhere(f DiscrepancyFilter) (string, []any) {
+	var clauses []string
+	var args []any
+
+	if f.Type != "" {
+		clauses = append(clauses, "type = ?")
+		args = append(args, f.Type)
+	}
+	if f.Severity != "" {
+		clauses = append(clauses, "severity = ?")
+		args = append(args, f.Severity)
+	}
+	if f.Processor != "" {
+		clauses = append(clauses, "processor = ?")
+		args = append(args, f.Processor)
+	}
+	if f.Merchant != "" {
+		clauses = append(clauses, "id IN (SELECT discrepancy_id FROM discrepancy_attributions WHERE merchant_id = ?)")
+		args = append(args, f.Merchant)
+	}
+	if f.BatchID != "" {
+		clauses = append(clauses, "id IN (SELECT discrepancy_id FROM discrepancy_attributions WHERE batch_id = ?)")
+		args = append(args, f.BatchID)
+	}
+	if f.Tag != "" {
+		clauses = append(clauses, "id IN (SELECT discrepancy_id FROM discrepancy_tags WHERE tag = ?)")
+		args = append(args, f.Tag)
+	}
+	if f.Team != "" {
+		clauses = append(clauses, "id IN (SELECT discrepancy_id FROM discrepancy_assignments WHERE team = ?)")
+		args = append(args, f.Team)
+	}
+	if f.Assignee != "" {
+		clauses = append(clauses, "id IN (SELECT discrepancy_id FROM discrepancy_assignments WHERE assignee = ?)")
+		args = append(args, f.Assignee)
+	}
+	if f.TicketID != "" {
+		clauses = append(clauses, "id IN (SELECT discrepancy_id FROM discrepancy_tickets WHERE ticket_id = ?)")
+		args = append(args, f.TicketID)
+	}
+	if f.CaseID != "" {
+		clauses = append(clauses, "id IN (SELECT discrepancy_id FROM case_members WHERE case_id = ?)")
+		args = append(args, f.CaseID)
+	}
+	switch f.Status {
+	case "open":
+		clauses = append(clauses, "id NOT IN (SELECT discrepancy_id FROM discrepancy_resolutions)")
+	case "resolved":
+		clauses = append(clauses, "id IN (SELECT discrepancy_id FROM discrepancy_resolutions)")
+	}
+	if f.From != nil {
+		clauses = append(clauses, "detected_at >= ?")
+		args = append(args, f.From.Format(time.RFC3339))
+	}
+	if f.To != nil {
+		clauses = append(clauses, "detected_at <= ?")
+		args = append(args, f.To.Format(time.RFC3339))
+	}
+
+	if len(clauses) == 0 {
+		return "", nil
+	}
+	return " WHERE " + strings.Join(clauses, " AND "), args
+}
+
+// attach loads the attributions, causes, assignments, tickets, resolutions
+// and tags of each discrepancy.
+func (r *DiscrepancyRepo) attach(discs []domain.Discrepancy) error {
+	if err := r.attachAttributions(discs); err != nil {
+		return err
+	}
+	if err := r.attachCauses(discs); err != nil {
+		return err
+	}
+	if err := r.attachAssignments(discs); err != nil {
+		return err
+	}
+	if err := r.attachTickets(discs); err != nil {
+		return err
+	}
+	if err := r.attachResolutions(discs); err != nil {
+		return err
+	}
+	if err := r.attachCases(discs); err != nil {
+		return err
+	}
+	return r.attachTags(discs)
+}
+
+// attachResolutions loads the resolution of each discrepancy that has one
+// in a single query.
+func (r *DiscrepancyRepo) attachResolutions(discs []domain.Discrepancy) error {
+	if len(discs) == 0 {
+		return nil
+	}
+
+	placeholders := make([]string, len(discs))
+	args := make([]any, len(discs))
+	index := make(map[string]int, len(discs))
+	for i, d := range discs {
+		placeholders[i] = "?"
+		args[i] = d.ID
+		index[d.ID] = i
+	}
+
+	rows, err := r.db.Query(
+		"SELECT discrepancy_id, source, reference, status, resolved_by, resolved_at FROM discrepancy_resolutions WHERE discrepancy_id IN ("+
+			strings.Join(placeholders, ",")+")",
+		args...,
+	)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id, resolvedAt string
+		var res domain.DiscrepancyResolution
+		if err := rows.Scan(&id, &res.Source, &res.Reference, &res.Status, &res.ResolvedBy, &resolvedAt); err != nil {
+			return err
+		}
+		res.ResolvedAt, _ = time.Parse(time.RFC3339, resolvedAt)
+		if i, ok := index[id]; ok {
+			discs[i].Resolution = &res
+		}
+	}
+	return rows.Err()
+}
+
+// attachCases loads the case of each discrepancy in one in a single query.
+func (r *DiscrepancyRepo) attachCases(discs []domain.Discrepancy) error {
+	if len(discs) == 0 {
+		return nil
+	}
+
+	placeholders := make([]string, len(discs))
+	args := make([]any, len(discs))
+	index := make(map[string]int, len(discs))
+	for i, d := range discs {
+		placeholders[i] = "?"
+		args[i] = d.ID
+		index[d.ID] = i
+	}
+
+	rows, err := r.db.Query(
+		"SELECT discrepancy_id, case_id FROM case_members WHERE case_id != '' AND discrepancy_id IN ("+
+			strings.Join(placeholders, ",")+")",
+		args...,
+	)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id, caseID string
+		if err := rows.Scan(&id, &caseID); err != nil {
+			return err
+		}
+		if i, ok := index[id]; ok {
+			discs[i].CaseID = caseID
+		}
+	}
+	return rows.Err()
+}
+
+// attachTickets loads the ticket link of each discrepancy that has one in a
+// single query.
+func (r *DiscrepancyRepo) attachTickets(discs []domain.Discrepancy) error {
+	if len(discs) == 0 {
+		return nil
+	}
+
+	placeholders := make([]string, len(discs))
+	args := make([]any, len(discs))
+	index := make(map[string]int, len(discs))
+	for i, d := range discs {
+		placeholders[i] = "?"
+		args[i] = d.ID
+		index[d.ID] = i
+	}
+
+	rows, err := r.db.Query(
+		"SELECT discrepancy_id, system, ticket_id, url, linked_by, linked_at FROM discrepancy_tickets WHERE discrepancy_id IN ("+
+			strings.Join(placeholders, ",")+")",
+		args...,
+	)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id, linkedAt string
+		var t domain.ExternalTicket
+		if err := rows.Scan(&id, &t.System, &t.TicketID, &t.URL, &t.LinkedBy, &linkedAt); err != nil {
+			return err
+		}
+		t.LinkedAt, _ = time.Parse(time.RFC3339, linkedAt)
+		if i, ok := index[id]; ok {
+			discs[i].Ticket = &t
+		}
+	}
+	return rows.Err()
+}
+
+// attachAssignments loads the assignment of each discrepancy that has one
+// in a single query.
+func (r *DiscrepancyRepo) attachAssignments(discs []domain.Discrepancy) error {
+	if len(discs) == 0 {
+		return nil
+	}
+
+	placeholders := make([]string, len(discs))
+	args := make([]any, len(discs))
+	index := make(map[string]int, len(discs))
+	for i, d := range discs {
+		placeholders[i] = "?"
+		args[i] = d.ID
+		index[d.ID] = i
+	}
+
+	rows, err := r.db.Query(
+		"SELECT discrepancy_id, team, assignee, rule_id, assigned_at FROM discrepancy_assignments WHERE discrepancy_id IN ("+
+			strings.Join(placeholders, ",")+")",
+		args...,
+	)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id, assignedAt string
+		var a domain.DiscrepancyAssignment
+		if err := rows.Scan(&id, &a.Team, &a.Assignee, &a.RuleID, &assignedAt); err != nil {
+			return err
+		}
+		a.AssignedAt, _ = time.Parse(time.RFC3339, assignedAt)
+		if i, ok := index[id]; ok {
+			discs[i].Assignment = &a
+		}
+	}
+	return rows.Err()
+}
+
+// attachCauses loads the probable cause of each discrepancy that has one in
+// a single query.
+func (r *DiscrepancyRepo) attachCauses(discs []domain.Discrepancy) error {
+	if len(discs) == 0 {
+		return nil
+	}
+
+	placeholders := make([]string, len(discs))
+	args := make([]any, len(discs))
+	index := make(map[string]int, len(discs))
+	for i, d := range discs {
+		placeholders[i] = "?"
+		args[i] = d.ID
+		index[d.ID] = i
+	}
+
+	rows, err := r.db.Query(
+		"SELECT discrepancy_id, cause, detail FROM discrepancy_causes WHERE discrepancy_id IN ("+
+			strings.Join(placeholders, ",")+")",
+		args...,
+	)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id, cause, detail string
+		if err := rows.Scan(&id, &cause, &detail); err != nil {
+			return err
+		}
+		if i, ok := index[id]; ok {
+			discs[i].ProbableCause = &domain.ProbableCause{Cause: domain.CauseKind(cause), Detail: detail}
+		}
+	}
+	return rows.Err()
+}
+
+// attachAttributions loads the merchant and batch of each discrepancy in a
+// single query.
+func (r *DiscrepancyRepo) attachAttributions(discs []domain.Discrepancy) error {
+	if len(discs) == 0 {
+		return nil
+	}
+
+	placeholders := make([]string, len(discs))
+	args := make([]any, len(discs))
+	index := make(map[string]int, len(discs))
+	for i, d := range discs {
+		placeholders[i] = "?"
+		args[i] = d.ID
+		index[d.ID] = i
+	}
+
+	rows, err := r.db.Query(
+		"SELECT discrepancy_id, COALESCE(merchant_id,''), COALESCE(batch_id,'') FROM discrepancy_attributions WHERE discrepancy_id IN ("+
+			strings.Join(placeholders, ",")+")",
+		args...,
+	)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id, merchantID, batchID string
+		if err := rows.Scan(&id, &merchantID, &batchID); err != nil {
+			return err
+		}
+		if i, ok := index[id]; ok {
+			discs[i].MerchantID = merchantID
+			discs[i].BatchID = batchID
+		}
+	}
+	return rows.Err()
+}
+
+// attachTags loads the tags for each discrepancy in a single query.
+func (r *DiscrepancyRepo) attachTags(discs []domain.Discrepancy) error {
+	if len(discs) == 0 {
+		return nil
+	}
+
+	placeholders := make([]string, len(discs))
+	args := make([]any, len(discs))
+	index := make(map[string]int, len(discs))
+	for i, d := range discs {
+		placeholders[i] = "?"
+		args[i] = d.ID
+		index[d.ID] = i
+	}
+
+	rows, err := r.db.Query(
+		"SELECT discrepancy_id, tag FROM discrepancy_tags WHERE discrepancy_id IN ("+
+			strings.Join(placeholders, ",")+") ORDER BY tag",
+		args...,
+	)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id, tag string
+		if err := rows.Scan(&id, &tag); err != nil {
+			return err
+		}
+		if i, ok := index[id]; ok {
+			discs[i].Tags = append(discs[i].Tags, tag)
 		}
-		m[k] = v
 	}
 	return rows.Err()
 }
@@ -0,0 +1,261 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/wakala/reconciler/internal/blob"
+)
+
+// ErrRotating is returned by Rotate while another rotation is in progress.
+var ErrRotating = errors.New("key rotation is already running")
+
+// EncryptedColumn counts the values of one encrypted column by the key they
+// are sealed with. Plaintext values predate encryption.
+type EncryptedColumn struct {
+	Table     string         `json:"table"`
+	Column    string         `json:"column"`
+	Plaintext int            `json:"plaintext"`
+	ByKey     map[string]int `json:"by_key"`
+}
+
+// EncryptionStatus is the active key and how far each encrypted column is
+// from being sealed with it.
+type EncryptionStatus struct {
+	ActiveKey string            `json:"active_key"`
+	Columns   []EncryptedColumn `json:"columns"`
+	// Pending is the number of values not sealed with the active key.
+	Pending int `json:"pending"`
+}
+
+// EncryptionRepo reports on and rotates the keys of encrypted columns. It
+// is only created when column encryption is configured.
+type EncryptionRepo struct {
+	db    *sql.DB
+	blobs blob.Store
+	mu    sync.Mutex
+}
+
+func NewEncryptionRepo(db *sql.DB) *EncryptionRepo {
+	return &EncryptionRepo{db: db}
+}
+
+// SetBlobStore makes Rotate re-seal the report files kept in store too.
+func (r *EncryptionRepo) SetBlobStore(store blob.Store) {
+	r.blobs = store
+}
+
+// Status counts every encrypted column's values by key.
+func (r *EncryptionRepo) Status() (*EncryptionStatus, error) {
+	active := columnCipher.ActiveKeyID()
+	status := &EncryptionStatus{ActiveKey: active, Columns: []EncryptedColumn{}}
+	for _, ec := range encryptedColumns {
+		col := EncryptedColumn{Table: ec.table, Column: ec.column, ByKey: map[string]int{}}
+		rows, err := r.db.Query(fmt.Sprintf(
+			`SELECT CASE WHEN substr(%[1]s, 1, 5) = 'enc1:'
+				THEN substr(%[1]s, 6, instr(substr(%[1]s, 6), ':') - 1) ELSE '' END AS key_id,
+				COUNT(*)
+			FROM %[2]s GROUP BY key_id`, ec.column, ec.table))
+		if err != nil {
+			return nil, fmt.Errorf("count %s.%s: %w", ec.table, ec.column, err)
+		}
+		for rows.Next() {
+			var keyID string
+			var n int
+			if err := rows.Scan(&keyID, &n); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			if keyID == "" {
+				col.Plaintext = n
+			} else {
+				col.ByKey[keyID] = n
+			}
+			if keyID != active {
+				status.Pending += n
+			}
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+		status.Columns = append(status.Columns, col)
+	}
+
+	// Report files in a blob store are counted by the key recorded for
+	// their object, under a pseudo column.
+	col := EncryptedColumn{Table: "report_file_blobs", Column: "object", ByKey: map[string]int{}}
+	rows, err := r.db.Query("SELECT key_id, COUNT(*) FROM report_file_blobs GROUP BY key_id")
+	if err != nil {
+		return nil, fmt.Errorf("count report file blobs: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var keyID string
+		var n int
+		if err := rows.Scan(&keyID, &n); err != nil {
+			return nil, err
+		}
+		if keyID == "" {
+			col.Plaintext = n
+		} else {
+			col.ByKey[keyID] = n
+		}
+		if keyID != active {
+			status.Pending += n
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	status.Columns = append(status.Columns, col)
+	return status, nil
+}
+
+// Rotate re-seals with the active key every value sealed with a retired key
+// or still in plaintext, and returns how many it changed. It works through
+// each column in chunks, one transaction each, so ingestion can interleave;
+// a value changed since it was read is left for the next rotation. Once
+// Status reports nothing pending, retired keys can be removed.
+func (r *EncryptionRepo) Rotate() (int, error) {
+	if !r.mu.TryLock() {
+		return 0, ErrRotating
+	}
+	defer r.mu.Unlock()
+
+	prefix := sealedPrefix + columnCipher.ActiveKeyID() + ":"
+	total := 0
+	for _, ec := range encryptedColumns {
+		limit := ec.chunk
+		if limit == 0 {
+			limit = streamChunk
+		}
+		n, err := r.rotateColumn(ec.table, ec.column, prefix, limit)
+		total += n
+		if err != nil {
+			return total, fmt.Errorf("rotate %s.%s: %w", ec.table, ec.column, err)
+		}
+	}
+	n, err := r.rotateBlobs()
+	total += n
+	if err != nil {
+		return total, fmt.Errorf("rotate report file blobs: %w", err)
+	}
+	return total, nil
+}
+
+// rotateBlobs re-seals the report files in the blob store that are not
+// sealed with the active key, one object at a time. Each object is
+// rewritten under its key before its row records the new key, so a failure
+// leaves it readable with either.
+func (r *EncryptionRepo) rotateBlobs() (int, error) {
+	active := columnCipher.ActiveKeyID()
+	rows, err := r.db.Query("SELECT hash, key, key_id FROM report_file_blobs WHERE key_id != ? ORDER BY hash", active)
+	if err != nil {
+		return 0, err
+	}
+	type stored struct{ hash, key, keyID string }
+	var pending []stored
+	for rows.Next() {
+		var s stored
+		if err := rows.Scan(&s.hash, &s.key, &s.keyID); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		pending = append(pending, s)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	if len(pending) > 0 && r.blobs == nil {
+		return 0, fmt.Errorf("%d report files are kept in a blob store, but none is configured", len(pending))
+	}
+
+	ctx := context.Background()
+	changed := 0
+	for _, s := range pending {
+		data, err := r.blobs.Get(ctx, s.key)
+		if err != nil {
+			return changed, fmt.Errorf("file %s: %w", s.hash, err)
+		}
+		plain, err := openColumn(string(data))
+		if err != nil {
+			return changed, fmt.Errorf("file %s: %w", s.hash, err)
+		}
+		if err := r.blobs.Put(ctx, s.key, []byte(sealColumn(plain))); err != nil {
+			return changed, fmt.Errorf("file %s: %w", s.hash, err)
+		}
+		if _, err := r.db.Exec(
+			"UPDATE report_file_blobs SET key_id = ? WHERE hash = ? AND key_id = ?", active, s.hash, s.keyID,
+		); err != nil {
+			return changed, fmt.Errorf("file %s: %w", s.hash, err)
+		}
+		changed++
+	}
+	return changed, nil
+}
+
+func (r *EncryptionRepo) rotateColumn(table, column, activePrefix string, limit int) (int, error) {
+	query := fmt.Sprintf(
+		"SELECT rowid, %[1]s FROM %[2]s WHERE rowid > ? AND substr(%[1]s, 1, ?) != ? ORDER BY rowid LIMIT %[3]d",
+		column, table, limit)
+	update := fmt.Sprintf("UPDATE %s SET %[2]s = ? WHERE rowid = ? AND %[2]s = ?", table, column)
+
+	changed := 0
+	var after int64
+	for {
+		type stored struct {
+			rowid int64
+			value string
+		}
+		rows, err := r.db.Query(query, after, len(activePrefix), activePrefix)
+		if err != nil {
+			return changed, err
+		}
+		var chunk []stored
+		for rows.Next() {
+			var s stored
+			if err := rows.Scan(&s.rowid, &s.value); err != nil {
+				rows.Close()
+				return changed, err
+			}
+			chunk = append(chunk, s)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return changed, err
+		}
+		if len(chunk) == 0 {
+			return changed, nil
+		}
+
+		tx, err := r.db.Begin()
+		if err != nil {
+			return changed, fmt.Errorf("begin: %w", err)
+		}
+		n := 0
+		for _, s := range chunk {
+			plain, err := openColumn(s.value)
+			if err != nil {
+				tx.Rollback()
+				return changed, fmt.Errorf("row %d: %w", s.rowid, err)
+			}
+			res, err := tx.Exec(update, sealColumn(plain), s.rowid, s.value)
+			if err != nil {
+				tx.Rollback()
+				return changed, fmt.Errorf("row %d: %w", s.rowid, err)
+			}
+			ra, _ := res.RowsAffected()
+			n += int(ra)
+		}
+		if err := tx.Commit(); err != nil {
+			return changed, fmt.Errorf("commit: %w", err)
+		}
+		changed += n
+		after = chunk[len(chunk)-1].rowid
+	}
+}
@@ -0,0 +1,147 @@
+package repository
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// HistoryRepo stores end-of-day copies of the dashboard, so a past day can
+// be read back as it was shown rather than recomputed from today's rows.
+type HistoryRepo struct {
+	db dbtx
+}
+
+func NewHistoryRepo(db *sql.DB) *HistoryRepo {
+	return &HistoryRepo{db: db}
+}
+
+// DailyFigures are the dashboard's transaction figures over every
+// processor and currency.
+type DailyFigures struct {
+	Transactions DashboardStats    `json:"transactions"`
+	ByProcessor  []ProcessorVolume `json:"by_processor"`
+	ByCurrency   []CurrencyVolume  `json:"by_currency"`
+}
+
+// DailySnapshot is the last capture of a day.
+type DailySnapshot struct {
+	Day        string
+	CapturedAt time.Time
+	Figures    DailyFigures
+}
+
+// AsOf says which snapshot answered a read as of the end of Date:
+// SnapshotDate's, the last captured on or before it.
+type AsOf struct {
+	Date         string    `json:"date"`
+	SnapshotDate string    `json:"snapshot_date"`
+	CapturedAt   time.Time `json:"captured_at"`
+}
+
+// openDimensions are discrepancyDimensions over open_discrepancy_snapshots
+// d, where the merchant was copied at capture.
+var openDimensions = map[string]string{
+	"type":      "d.type",
+	"severity":  "d.severity",
+	"processor": "d.processor",
+	"currency":  "d.currency",
+	"merchant":  "COALESCE(d.merchant_id, 'unknown')",
+}
+
+// Capture records the current figures and open discrepancies as day's
+// snapshot, replacing an earlier capture of the same day, so each day keeps
+// the last.
+func (r *HistoryRepo) Capture(day string, at time.Time) error {
+	tx, err := begin(r.db)
+	if err != nil {
+		return fmt.Errorf("begin: %w", err)
+	}
+	defer tx.Rollback()
+
+	txns := &TransactionRepo{db: tx.Tx}
+	var f DailyFigures
+	stats, err := txns.GetDashboardStats(DashboardScope{})
+	if err != nil {
+		return fmt.Errorf("dashboard stats: %w", err)
+	}
+	f.Transactions = *stats
+	if f.ByProcessor, err = txns.GetVolumeByProcessor(DashboardScope{}); err != nil {
+		return fmt.Errorf("volume by processor: %w", err)
+	}
+	if f.ByCurrency, err = txns.GetVolumeByCurrency(DashboardScope{}); err != nil {
+		return fmt.Errorf("volume by currency: %w", err)
+	}
+	figures, err := json.Marshal(f)
+	if err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec("DELETE FROM open_discrepancy_snapshots WHERE day = ?", day); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(
+		`INSERT INTO daily_snapshots (day, captured_at, figures_json) VALUES (?,?,?)
+		ON CONFLICT(day) DO UPDATE SET captured_at = excluded.captured_at, figures_json = excluded.figures_json`,
+		day, at.UTC().Format(time.RFC3339), string(figures),
+	); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(
+		`INSERT INTO open_discrepancy_snapshots
+			(day, discrepancy_id, type, severity, processor, currency, merchant_id, difference_usd)
+		SELECT ?, d.id, d.type, d.severity, d.processor, d.currency, a.merchant_id, d.difference_usd
+		FROM discrepancies d LEFT JOIN discrepancy_attributions a ON a.discrepancy_id = d.id`, day,
+	); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Latest returns the snapshot the dashboard showed at the end of day: that
+// day's, or the one before it nearest to it when nothing was captured that
+// day. It returns sql.ErrNoRows when there is none that early.
+func (r *HistoryRepo) Latest(day string) (*DailySnapshot, error) {
+	var snap DailySnapshot
+	var capturedAt, figures string
+	err := r.db.QueryRow(
+		"SELECT day, captured_at, figures_json FROM daily_snapshots WHERE day <= ? ORDER BY day DESC LIMIT 1", day,
+	).Scan(&snap.Day, &capturedAt, &figures)
+	if err != nil {
+		return nil, err
+	}
+	snap.CapturedAt, _ = time.Parse(time.RFC3339, capturedAt)
+	if err := json.Unmarshal([]byte(figures), &snap.Figures); err != nil {
+		return nil, fmt.Errorf("snapshot %s: %w", snap.Day, err)
+	}
+	return &snap, nil
+}
+
+// Summary is GetSummary over the discrepancies open at day's capture.
+func (r *HistoryRepo) Summary(day string) (*DiscrepancySummary, error) {
+	s := &DiscrepancySummary{
+		ByType:       make(map[string]int),
+		BySeverity:   make(map[string]int),
+		ByProcessor:  make(map[string]int),
+		ImpactByProc: make(map[string]float64),
+	}
+	if err := r.db.QueryRow(
+		"SELECT COUNT(*), COALESCE(SUM(ABS(difference_usd)),0) FROM open_discrepancy_snapshots WHERE day = ?", day,
+	).Scan(&s.TotalCount, &s.TotalImpact); err != nil {
+		return nil, err
+	}
+	err := s.fill(func(dim string) ([]DiscrepancyGroup, error) {
+		return r.GroupBy(day, dim)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// GroupBy is DiscrepancyRepo.GroupBy over the discrepancies open at day's
+// capture.
+func (r *HistoryRepo) GroupBy(day string, dims ...string) ([]DiscrepancyGroup, error) {
+	return groupRows(r.db, dims, openDimensions, "open_discrepancy_snapshots d WHERE d.day = ?", []any{day})
+}
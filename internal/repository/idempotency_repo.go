@@ -0,0 +1,82 @@
+package repository
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/wakala/reconciler/internal/domain"
+)
+
+// idempotencyKeyTTL is how long a key is remembered after first use.
+const idempotencyKeyTTL = 24 * time.Hour
+
+type IdempotencyRepo struct {
+	db *sql.DB
+}
+
+func NewIdempotencyRepo(db *sql.DB) *IdempotencyRepo {
+	return &IdempotencyRepo{db: db}
+}
+
+// Claim records the first use of a key. It reports true if this call created
+// the key; otherwise it returns the existing record so the caller can replay
+// or reject. The insert is atomic, so of two concurrent requests with the
+// same key exactly one claims it. Expired keys are purged first.
+func (r *IdempotencyRepo) Claim(scope, key, fingerprint string, now time.Time) (*domain.IdempotencyKey, bool, error) {
+	if _, err := r.db.Exec(
+		"DELETE FROM idempotency_keys WHERE created_at < ?",
+		now.Add(-idempotencyKeyTTL).Format(time.RFC3339),
+	); err != nil {
+		return nil, false, err
+	}
+
+	res, err := r.db.Exec(
+		`INSERT OR IGNORE INTO idempotency_keys
+		(scope, key, fingerprint, job_id, status_code, response, created_at)
+		VALUES (?,?,?,'',0,'',?)`,
+		scope, key, fingerprint, now.Format(time.RFC3339),
+	)
+	if err != nil {
+		return nil, false, err
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		return &domain.IdempotencyKey{Scope: scope, Key: key, Fingerprint: fingerprint, CreatedAt: now}, true, nil
+	}
+
+	k, err := r.get(scope, key)
+	return k, false, err
+}
+
+func (r *IdempotencyRepo) get(scope, key string) (*domain.IdempotencyKey, error) {
+	var k domain.IdempotencyKey
+	var response, createdAt string
+	err := r.db.QueryRow(
+		"SELECT * FROM idempotency_keys WHERE scope = ? AND key = ?", scope, key,
+	).Scan(&k.Scope, &k.Key, &k.Fingerprint, &k.JobID, &k.StatusCode, &response, &createdAt)
+	if err != nil {
+		return nil, err
+	}
+	k.Response = []byte(response)
+	k.CreatedAt, _ = time.Parse(time.RFC3339, createdAt)
+	return &k, nil
+}
+
+// SetJob links a claimed key to the job started for it.
+func (r *IdempotencyRepo) SetJob(scope, key, jobID string) error {
+	_, err := r.db.Exec(
+		"UPDATE idempotency_keys SET job_id = ? WHERE scope = ? AND key = ?",
+		jobID, scope, key,
+	)
+	return err
+}
+
+// Complete stores the response to replay for a key. The first stored
+// response wins.
+func (r *IdempotencyRepo) Complete(scope, key string, status int, response []byte) error {
+	_, err := r.db.Exec(
+		`UPDATE idempotency_keys SET status_code = ?, response = ?
+		WHERE scope = ? AND key = ? AND status_code = 0`,
+		status, string(response), scope, key,
+	)
+	return err
+}
@@ -0,0 +1,137 @@
+package repository
+
+import (
+	"database/sql"
+	"strings"
+	"time"
+
+	"github.com/wakala/reconciler/internal/domain"
+)
+
+type JiraIssueRepo struct {
+	db dbtx
+}
+
+func NewJiraIssueRepo(db *sql.DB) *JiraIssueRepo {
+	return &JiraIssueRepo{db: db}
+}
+
+// Untracked returns up to limit current discrepancies of the given
+// severities that have no Jira issue, largest absolute USD difference first,
+// with their ticket links. Discrepancies linked to a ticket in another
+// system are left out: they are tracked there.
+func (r *JiraIssueRepo) Untracked(sevs []domain.Severity, limit int) ([]domain.Discrepancy, error) {
+	if len(sevs) == 0 {
+		return nil, nil
+	}
+	placeholders := make([]string, len(sevs))
+	args := make([]any, 0, len(sevs)+1)
+	for i, sev := range sevs {
+		placeholders[i] = "?"
+		args = append(args, string(sev))
+	}
+	rows, err := r.db.Query(`SELECT * FROM discrepancies
+		WHERE severity IN (`+strings.Join(placeholders, ",")+`)
+		AND id NOT IN (SELECT discrepancy_id FROM jira_issues)
+		AND id NOT IN (SELECT discrepancy_id FROM discrepancy_tickets WHERE system != 'jira')
+		ORDER BY ABS(difference_usd) DESC, id LIMIT ?`, append(args, limit)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	discs, err := scanDiscrepancies(rows)
+	if err != nil {
+		return nil, err
+	}
+	return discs, (&DiscrepancyRepo{db: r.db}).attachTickets(discs)
+}
+
+// Insert stores the issue of a discrepancy.
+func (r *JiraIssueRepo) Insert(issue *domain.JiraIssue) error {
+	_, err := r.db.Exec(
+		`INSERT INTO jira_issues (discrepancy_id, issue_key, state, status, last_error, created_at, updated_at)
+		VALUES (?,?,?,?,?,?,?)`,
+		issue.DiscrepancyID, issue.Key, string(issue.State), issue.Status, issue.LastError,
+		issue.CreatedAt.Format(time.RFC3339), issue.UpdatedAt.Format(time.RFC3339),
+	)
+	return err
+}
+
+// Update stores an issue's state, status and last error.
+func (r *JiraIssueRepo) Update(issue *domain.JiraIssue) error {
+	_, err := r.db.Exec(
+		"UPDATE jira_issues SET state = ?, status = ?, last_error = ?, updated_at = ? WHERE discrepancy_id = ?",
+		string(issue.State), issue.Status, issue.LastError, issue.UpdatedAt.Format(time.RFC3339), issue.DiscrepancyID,
+	)
+	return err
+}
+
+// ListByKey returns the discrepancies' issues with the given key; an issue
+// linked by hand may cover several.
+func (r *JiraIssueRepo) ListByKey(key string) ([]domain.JiraIssue, error) {
+	return r.list("WHERE issue_key = ? ORDER BY discrepancy_id", key)
+}
+
+// Gone returns the open issues none of whose discrepancies is still
+// raised.
+func (r *JiraIssueRepo) Gone() ([]domain.JiraIssue, error) {
+	return r.list(`WHERE state = ? AND issue_key NOT IN (
+		SELECT j.issue_key FROM jira_issues j JOIN discrepancies d ON d.id = j.discrepancy_id)`, string(domain.JiraIssueOpen))
+}
+
+// Returned returns the issues the reconciler resolved whose discrepancy is
+// raised again.
+func (r *JiraIssueRepo) Returned() ([]domain.JiraIssue, error) {
+	return r.list("WHERE state = ? AND discrepancy_id IN (SELECT id FROM discrepancies)", string(domain.JiraIssueResolvedHere))
+}
+
+// Failing returns the issues whose last transition failed, most recently
+// updated first.
+func (r *JiraIssueRepo) Failing(limit int) ([]domain.JiraIssue, error) {
+	return r.list("WHERE last_error != '' ORDER BY updated_at DESC, discrepancy_id LIMIT ?", limit)
+}
+
+// CountByState returns how many issues are in each state.
+func (r *JiraIssueRepo) CountByState() (map[string]int, error) {
+	rows, err := r.db.Query("SELECT state, COUNT(*) FROM jira_issues GROUP BY state")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := map[string]int{}
+	for rows.Next() {
+		var state string
+		var n int
+		if err := rows.Scan(&state, &n); err != nil {
+			return nil, err
+		}
+		counts[state] = n
+	}
+	return counts, rows.Err()
+}
+
+func (r *JiraIssueRepo) list(where string, args ...any) ([]domain.JiraIssue, error) {
+	rows, err := r.db.Query(
+		"SELECT discrepancy_id, issue_key, state, status, last_error, created_at, updated_at FROM jira_issues "+where, args...,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var issues []domain.JiraIssue
+	for rows.Next() {
+		var issue domain.JiraIssue
+		var state, createdAt, updatedAt string
+		if err := rows.Scan(&issue.DiscrepancyID, &issue.Key, &state, &issue.Status, &issue.LastError, &createdAt, &updatedAt); err != nil {
+			return nil, err
+		}
+		issue.State = domain.JiraIssueState(state)
+		issue.CreatedAt, _ = time.Parse(time.RFC3339, createdAt)
+		issue.UpdatedAt, _ = time.Parse(time.RFC3339, updatedAt)
+		issues = append(issues, issue)
+	}
+	return issues, rows.Err()
+}
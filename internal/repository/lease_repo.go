@@ -0,0 +1,58 @@
+package repository
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/wakala/reconciler/internal/domain"
+)
+
+type LeaseRepo struct {
+	db *sql.DB
+}
+
+func NewLeaseRepo(db *sql.DB) *LeaseRepo {
+	return &LeaseRepo{db: db}
+}
+
+// Acquire takes or renews the lease called name for holder until now+ttl,
+// in one statement so two instances cannot both win it. It reports false
+// while another holder's lease has not expired.
+func (r *LeaseRepo) Acquire(name, holder string, now time.Time, ttl time.Duration) (bool, error) {
+	res, err := r.db.Exec(
+		`INSERT INTO leases (name, holder, acquired_at, expires_at) VALUES (?,?,?,?)
+		ON CONFLICT(name) DO UPDATE SET
+			holder = excluded.holder,
+			acquired_at = CASE WHEN leases.holder = excluded.holder THEN leases.acquired_at ELSE excluded.acquired_at END,
+			expires_at = excluded.expires_at
+		WHERE leases.holder = excluded.holder OR leases.expires_at <= ?`,
+		name, holder, now.UTC().Format(time.RFC3339), now.Add(ttl).UTC().Format(time.RFC3339),
+		now.UTC().Format(time.RFC3339),
+	)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// Release gives up holder's lease, so another instance can take it without
+// waiting for it to expire.
+func (r *LeaseRepo) Release(name, holder string) error {
+	_, err := r.db.Exec("DELETE FROM leases WHERE name = ? AND holder = ?", name, holder)
+	return err
+}
+
+// Get returns the lease called name. It returns sql.ErrNoRows when no
+// instance has held it, or the last holder released it.
+func (r *LeaseRepo) Get(name string) (*domain.Lease, error) {
+	var l domain.Lease
+	var acquired, expires string
+	err := r.db.QueryRow("SELECT * FROM leases WHERE name = ?", name).Scan(&l.Name, &l.Holder, &acquired, &expires)
+	if err != nil {
+		return nil, err
+	}
+	l.AcquiredAt, _ = time.Parse(time.RFC3339, acquired)
+	l.ExpiresAt, _ = time.Parse(time.RFC3339, expires)
+	return &l, nil
+}
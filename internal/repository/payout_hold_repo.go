@@ -0,0 +1,112 @@
+package repository
+
+import (
+	"database/sql"
+	"strings"
+	"time"
+
+	"github.com/wakala/reconciler/internal/domain"
+)
+
+// PayoutHoldRepo stores the merchants whose payouts are on hold.
+type PayoutHoldRepo struct {
+	db dbtx
+}
+
+func NewPayoutHoldRepo(db *sql.DB) *PayoutHoldRepo {
+	return &PayoutHoldRepo{db: db}
+}
+
+// Exposure returns, for each merchant with open discrepancies of one of
+// severities (those with no resolution), their count and summed absolute USD difference, by merchant
+// ID. HeldSince and UpdatedAt are left zero.
+func (r *PayoutHoldRepo) Exposure(severities []domain.Severity) ([]domain.PayoutHold, error) {
+	if len(severities) == 0 {
+		return nil, nil
+	}
+	args := make([]any, len(severities))
+	for i, sev := range severities {
+		args[i] = string(sev)
+	}
+	rows, err := r.db.Query(`
+		SELECT a.merchant_id, COUNT(*), ROUND(SUM(ABS(d.difference_usd)), 2)
+		FROM discrepancies d
+		JOIN discrepancy_attributions a ON a.discrepancy_id = d.id
+		WHERE a.merchant_id IS NOT NULL AND a.merchant_id != ''
+			AND d.severity IN (?`+strings.Repeat(",?", len(severities)-1)+`)
+			AND d.id NOT IN (SELECT discrepancy_id FROM discrepancy_resolutions)
+		GROUP BY a.merchant_id
+		ORDER BY a.merchant_id`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []domain.PayoutHold
+	for rows.Next() {
+		var h domain.PayoutHold
+		if err := rows.Scan(&h.MerchantID, &h.Discrepancies, &h.OpenUSD); err != nil {
+			return nil, err
+		}
+		result = append(result, h)
+	}
+	return result, rows.Err()
+}
+
+// Upsert places or refreshes a merchant's hold. The held_since of an
+// existing hold is kept.
+func (r *PayoutHoldRepo) Upsert(h *domain.PayoutHold) error {
+	_, err := r.db.Exec(
+		`INSERT INTO payout_holds (merchant_id, discrepancies, open_usd, held_since, updated_at)
+		VALUES (?,?,?,?,?)
+		ON CONFLICT(merchant_id) DO UPDATE SET
+			discrepancies = excluded.discrepancies,
+			open_usd = excluded.open_usd,
+			updated_at = excluded.updated_at`,
+		h.MerchantID, h.Discrepancies, h.OpenUSD,
+		h.HeldSince.UTC().Format(time.RFC3339), h.UpdatedAt.UTC().Format(time.RFC3339),
+	)
+	return err
+}
+
+// Delete releases a merchant's hold.
+func (r *PayoutHoldRepo) Delete(merchantID string) error {
+	_, err := r.db.Exec("DELETE FROM payout_holds WHERE merchant_id = ?", merchantID)
+	return err
+}
+
+// List returns every hold, by merchant ID.
+func (r *PayoutHoldRepo) List() ([]domain.PayoutHold, error) {
+	rows, err := r.db.Query("SELECT * FROM payout_holds ORDER BY merchant_id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := []domain.PayoutHold{}
+	for rows.Next() {
+		h, err := scanPayoutHold(rows)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, *h)
+	}
+	return result, rows.Err()
+}
+
+// Get returns a merchant's hold, or sql.ErrNoRows when its payouts are not
+// held.
+func (r *PayoutHoldRepo) Get(merchantID string) (*domain.PayoutHold, error) {
+	return scanPayoutHold(r.db.QueryRow("SELECT * FROM payout_holds WHERE merchant_id = ?", merchantID))
+}
+
+func scanPayoutHold(row interface{ Scan(...any) error }) (*domain.PayoutHold, error) {
+	var h domain.PayoutHold
+	var heldSince, updatedAt string
+	if err := row.Scan(&h.MerchantID, &h.Discrepancies, &h.OpenUSD, &heldSince, &updatedAt); err != nil {
+		return nil, err
+	}
+	h.HeldSince, _ = time.Parse(time.RFC3339, heldSince)
+	h.UpdatedAt, _ = time.Parse(time.RFC3339, updatedAt)
+	return &h, nil
+}
@@ -0,0 +1,311 @@
+package repository
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/wakala/reconciler/internal/domain"
+)
+
+var (
+	// ErrPeriodClosed is returned when closing a period that is already
+	// closed.
+	ErrPeriodClosed = errors.New("period is already closed")
+	// ErrAdjustmentDecided is returned when approving or rejecting an
+	// adjustment that is no longer pending.
+	ErrAdjustmentDecided = errors.New("adjustment has already been decided")
+)
+
+type PeriodRepo struct {
+	db *sql.DB
+}
+
+func NewPeriodRepo(db *sql.DB) *PeriodRepo {
+	return &PeriodRepo{db: db}
+}
+
+// Close records the close of a period. It returns ErrPeriodClosed if the
+// period is already closed.
+func (r *PeriodRepo) Close(c *domain.PeriodClose) error {
+	figures, err := json.Marshal(c.Figures)
+	if err != nil {
+		return err
+	}
+
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var open int
+	if err := tx.QueryRow(
+		"SELECT COUNT(*) FROM period_closes WHERE period = ? AND reopened_at IS NULL", c.Period,
+	).Scan(&open); err != nil {
+		return err
+	}
+	if open > 0 {
+		return ErrPeriodClosed
+	}
+	if _, err := tx.Exec(
+		"INSERT INTO period_closes (period, closed_by, closed_at, figures_json) VALUES (?,?,?,?)",
+		c.Period, c.ClosedBy, c.ClosedAt.Format(time.RFC3339), string(figures),
+	); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Reopen ends the current close of a period. It returns sql.ErrNoRows when
+// the period is not closed.
+func (r *PeriodRepo) Reopen(period, user, reason string, at time.Time) error {
+	res, err := r.db.Exec(
+		`UPDATE period_closes SET reopened_by = ?, reopened_at = ?, reopen_reason = ?
+		WHERE period = ? AND reopened_at IS NULL`,
+		user, at.Format(time.RFC3339), reason, period,
+	)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+const periodCloseSelect = `SELECT period, closed_by, closed_at, figures_json,
+	COALESCE(reopened_by, ''), reopened_at, reopen_reason FROM period_closes`
+
+// GetClose returns the current close of a period. It returns sql.ErrNoRows
+// when the period is open.
+func (r *PeriodRepo) GetClose(period string) (*domain.PeriodClose, error) {
+	closes, err := r.queryCloses(periodCloseSelect+" WHERE period = ? AND reopened_at IS NULL", period)
+	if err != nil {
+		return nil, err
+	}
+	if len(closes) == 0 {
+		return nil, sql.ErrNoRows
+	}
+	return &closes[0], nil
+}
+
+// ListCloses returns every close, including reopened ones, newest first. An
+// empty period returns all periods.
+func (r *PeriodRepo) ListCloses(period string) ([]domain.PeriodClose, error) {
+	if period != "" {
+		return r.queryCloses(periodCloseSelect+" WHERE period = ? ORDER BY id DESC", period)
+	}
+	return r.queryCloses(periodCloseSelect + " ORDER BY period DESC, id DESC")
+}
+
+// ClosedAmong returns which of periods are currently closed, sorted.
+func (r *PeriodRepo) ClosedAmong(periods []string) ([]string, error) {
+	if len(periods) == 0 {
+		return nil, nil
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("?,", len(periods)), ",")
+	args := make([]any, len(periods))
+	for i, p := range periods {
+		args[i] = p
+	}
+	rows, err := r.db.Query(
+		"SELECT DISTINCT period FROM period_closes WHERE reopened_at IS NULL AND period IN ("+placeholders+")",
+		args...,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var closed []string
+	for rows.Next() {
+		var p string
+		if err := rows.Scan(&p); err != nil {
+			return nil, err
+		}
+		closed = append(closed, p)
+	}
+	sort.Strings(closed)
+	return closed, rows.Err()
+}
+
+// Figures computes a period's numbers as they stand now.
+func (r *PeriodRepo) Figures(period string) (*domain.PeriodFigures, error) {
+	var f domain.PeriodFigures
+	err := r.db.QueryRow(
+		"SELECT COUNT(*), COALESCE(SUM(usd_amount),0) FROM transactions WHERE substr(captured_at,1,7) = ?", period,
+	).Scan(&f.Transactions, &f.TransactionUSD)
+	if err != nil {
+		return nil, fmt.Errorf("transactions: %w", err)
+	}
+	err = r.db.QueryRow(
+		`SELECT COUNT(*), COALESCE(SUM(usd_gross_amount),0), COALESCE(SUM(usd_net_amount),0)
+		FROM settlement_records WHERE substr(settlement_date,1,7) = ?`, period,
+	).Scan(&f.SettlementRecords, &f.SettledUSDGross, &f.SettledUSDNet)
+	if err != nil {
+		return nil, fmt.Errorf("settlements: %w", err)
+	}
+	err = r.db.QueryRow(`
+		SELECT COUNT(*), COALESCE(SUM(ABS(d.difference_usd)),0)
+		FROM discrepancies d
+		LEFT JOIN settlement_records sr ON sr.id = d.settlement_id
+		LEFT JOIN transactions t ON t.id = d.transaction_id
+		WHERE substr(COALESCE(sr.settlement_date, t.captured_at),1,7) = ?
+	`, period).Scan(&f.Discrepancies, &f.DiscrepancyImpactUSD)
+	if err != nil {
+		return nil, fmt.Errorf("discrepancies: %w", err)
+	}
+	return &f, nil
+}
+
+func (r *PeriodRepo) queryCloses(q string, args ...any) ([]domain.PeriodClose, error) {
+	rows, err := r.db.Query(q, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	closes := []domain.PeriodClose{}
+	for rows.Next() {
+		var c domain.PeriodClose
+		var closedAt, figures string
+		var reopenedAt sql.NullString
+		if err := rows.Scan(&c.Period, &c.ClosedBy, &closedAt, &figures,
+			&c.ReopenedBy, &reopenedAt, &c.ReopenReason); err != nil {
+			return nil, err
+		}
+		c.ClosedAt, _ = time.Parse(time.RFC3339, closedAt)
+		if err := json.Unmarshal([]byte(figures), &c.Figures); err != nil {
+			return nil, fmt.Errorf("period %s figures: %w", c.Period, err)
+		}
+		if reopenedAt.Valid {
+			t, _ := time.Parse(time.RFC3339, reopenedAt.String)
+			c.ReopenedAt = &t
+		}
+		closes = append(closes, c)
+	}
+	return closes, rows.Err()
+}
+
+// --- Pending adjustments ---
+
+// InsertAdjustment queues a change held back by a closed period.
+func (r *PeriodRepo) InsertAdjustment(a *domain.PendingAdjustment) error {
+	_, err := r.db.Exec(
+		`INSERT INTO pending_adjustments
+		(id, kind, reference, periods, summary, status, requested_by, created_at, payload_json)
+		VALUES (?,?,?,?,?,?,?,?,?)`,
+		a.ID, string(a.Kind), a.Reference, strings.Join(a.Periods, ","), a.Summary,
+		string(a.Status), a.RequestedBy, a.CreatedAt.Format(time.RFC3339), string(a.Payload),
+	)
+	return err
+}
+
+const adjustmentSelect = `SELECT id, kind, reference, periods, summary, status, requested_by,
+	created_at, decided_by, decided_at, note, payload_json, result_json FROM pending_adjustments`
+
+// GetAdjustment returns one adjustment with its payload. It returns
+// sql.ErrNoRows when absent.
+func (r *PeriodRepo) GetAdjustment(id string) (*domain.PendingAdjustment, error) {
+	adjs, err := r.queryAdjustments(adjustmentSelect+" WHERE id = ?", id)
+	if err != nil {
+		return nil, err
+	}
+	if len(adjs) == 0 {
+		return nil, sql.ErrNoRows
+	}
+	return &adjs[0], nil
+}
+
+// FindPendingAdjustment returns the pending adjustment of a kind for a
+// reference, so the same held-back change is not queued twice. It returns
+// sql.ErrNoRows when there is none.
+func (r *PeriodRepo) FindPendingAdjustment(kind domain.AdjustmentKind, reference string) (*domain.PendingAdjustment, error) {
+	adjs, err := r.queryAdjustments(
+		adjustmentSelect+" WHERE kind = ? AND reference = ? AND status = ? ORDER BY created_at LIMIT 1",
+		string(kind), reference, string(domain.AdjustmentPending),
+	)
+	if err != nil {
+		return nil, err
+	}
+	if len(adjs) == 0 {
+		return nil, sql.ErrNoRows
+	}
+	return &adjs[0], nil
+}
+
+// ListAdjustments returns adjustments, oldest first, filtered by status and
+// by a period they touch when those are non-empty.
+func (r *PeriodRepo) ListAdjustments(status, period string) ([]domain.PendingAdjustment, error) {
+	var clauses []string
+	var args []any
+	if status != "" {
+		clauses = append(clauses, "status = ?")
+		args = append(args, status)
+	}
+	if period != "" {
+		clauses = append(clauses, "(',' || periods || ',') LIKE ?")
+		args = append(args, "%,"+period+",%")
+	}
+	where := ""
+	if len(clauses) > 0 {
+		where = " WHERE " + strings.Join(clauses, " AND ")
+	}
+	return r.queryAdjustments(adjustmentSelect+where+" ORDER BY created_at, id", args...)
+}
+
+// DecideAdjustment approves or rejects a pending adjustment, storing the
+// result of applying it. It returns ErrAdjustmentDecided if the adjustment
+// is no longer pending.
+func (r *PeriodRepo) DecideAdjustment(id string, status domain.AdjustmentStatus, user, note string, result json.RawMessage, at time.Time) error {
+	res, err := r.db.Exec(
+		`UPDATE pending_adjustments SET status = ?, decided_by = ?, decided_at = ?, note = ?, result_json = ?
+		WHERE id = ? AND status = ?`,
+		string(status), user, at.Format(time.RFC3339), note, string(result), id, string(domain.AdjustmentPending),
+	)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrAdjustmentDecided
+	}
+	return nil
+}
+
+func (r *PeriodRepo) queryAdjustments(q string, args ...any) ([]domain.PendingAdjustment, error) {
+	rows, err := r.db.Query(q, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	adjs := []domain.PendingAdjustment{}
+	for rows.Next() {
+		var a domain.PendingAdjustment
+		var kind, periods, status, createdAt, payload, result string
+		var decidedAt sql.NullString
+		if err := rows.Scan(&a.ID, &kind, &a.Reference, &periods, &a.Summary, &status, &a.RequestedBy,
+			&createdAt, &a.DecidedBy, &decidedAt, &a.Note, &payload, &result); err != nil {
+			return nil, err
+		}
+		a.Kind = domain.AdjustmentKind(kind)
+		a.Status = domain.AdjustmentStatus(status)
+		a.Periods = strings.Split(periods, ",")
+		a.CreatedAt, _ = time.Parse(time.RFC3339, createdAt)
+		if decidedAt.Valid {
+			t, _ := time.Parse(time.RFC3339, decidedAt.String)
+			a.DecidedAt = &t
+		}
+		a.Payload = json.RawMessage(payload)
+		if result != "" {
+			a.Result = json.RawMessage(result)
+		}
+		adjs = append(adjs, a)
+	}
+	return adjs, rows.Err()
+}
@@ -0,0 +1,96 @@
+package repository
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/wakala/reconciler/internal/domain"
+)
+
+type ProcessorContactRepo struct {
+	db dbtx
+}
+
+func NewProcessorContactRepo(db *sql.DB) *ProcessorContactRepo {
+	return &ProcessorContactRepo{db: db}
+}
+
+// Upsert creates or replaces a processor's contact.
+func (r *ProcessorContactRepo) Upsert(c *domain.ProcessorContact) error {
+	escalation, err := json.Marshal(c.Escalation)
+	if err != nil {
+		return fmt.Errorf("marshal escalation: %w", err)
+	}
+	_, err = r.db.Exec(
+		`INSERT INTO processor_contacts (processor, ops_email, dispute_portal_url, sla_terms, escalation, updated_at, updated_by)
+		VALUES (?,?,?,?,?,?,?)
+		ON CONFLICT(processor) DO UPDATE SET
+			ops_email = excluded.ops_email,
+			dispute_portal_url = excluded.dispute_portal_url,
+			sla_terms = excluded.sla_terms,
+			escalation = excluded.escalation,
+			updated_at = excluded.updated_at,
+			updated_by = excluded.updated_by`,
+		c.Processor, c.OpsEmail, c.DisputePortalURL, c.SLATerms, string(escalation), c.UpdatedAt.Format(time.RFC3339), c.UpdatedBy,
+	)
+	return err
+}
+
+// Get returns a processor's contact, or sql.ErrNoRows if it has none.
+func (r *ProcessorContactRepo) Get(proc domain.Processor) (*domain.ProcessorContact, error) {
+	rows, err := r.db.Query("SELECT * FROM processor_contacts WHERE processor = ?", proc)
+	if err != nil {
+		return nil, err
+	}
+	contacts, err := scanProcessorContacts(rows)
+	if err != nil {
+		return nil, err
+	}
+	if len(contacts) == 0 {
+		return nil, sql.ErrNoRows
+	}
+	return &contacts[0], nil
+}
+
+func (r *ProcessorContactRepo) List() ([]domain.ProcessorContact, error) {
+	rows, err := r.db.Query("SELECT * FROM processor_contacts ORDER BY processor")
+	if err != nil {
+		return nil, err
+	}
+	return scanProcessorContacts(rows)
+}
+
+// Delete removes a processor's contact. It returns sql.ErrNoRows when the
+// processor had none.
+func (r *ProcessorContactRepo) Delete(proc domain.Processor) error {
+	res, err := r.db.Exec("DELETE FROM processor_contacts WHERE processor = ?", proc)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+func scanProcessorContacts(rows *sql.Rows) ([]domain.ProcessorContact, error) {
+	defer rows.Close()
+
+	result := []domain.ProcessorContact{}
+	for rows.Next() {
+		var c domain.ProcessorContact
+		var escalation, updatedAt string
+		if err := rows.Scan(&c.Processor, &c.OpsEmail, &c.DisputePortalURL, &c.SLATerms, &escalation,
+			&updatedAt, &c.UpdatedBy); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal([]byte(escalation), &c.Escalation); err != nil {
+			return nil, fmt.Errorf("processor contact %s: %w", c.Processor, err)
+		}
+		c.UpdatedAt, _ = time.Parse(time.RFC3339, updatedAt)
+		result = append(result, c)
+	}
+	return result, rows.Err()
+}
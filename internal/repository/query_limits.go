@@ -0,0 +1,154 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+// ErrQueryTimeout is returned, wrapped, when a read runs past the query
+// timeout and SQLite interrupts it.
+var ErrQueryTimeout = errors.New("query timed out")
+
+// QueryLimits bounds the dashboard, list and summary reads of the
+// transaction, settlement and discrepancy repositories, so that one greedy
+// request cannot hold a connection, or the WAL, for minutes. Writes and
+// reads inside a unit of work are never limited: interrupting them would
+// abort a reconciliation or an ingest halfway.
+type QueryLimits struct {
+	// Timeout interrupts a read that has not produced its first row by
+	// then, and ends the iteration of one still being read. 0 disables it.
+	Timeout time.Duration
+	// SlowThreshold logs the reads that take at least this long to their
+	// first row. 0 disables the log.
+	SlowThreshold time.Duration
+}
+
+// DefaultQueryLimits are the limits when the environment sets none.
+var DefaultQueryLimits = QueryLimits{Timeout: 15 * time.Second, SlowThreshold: 500 * time.Millisecond}
+
+var queryLimits atomic.Pointer[QueryLimits]
+
+// SetQueryLimits sets the limits of reads started from now on.
+func SetQueryLimits(l QueryLimits) {
+	queryLimits.Store(&l)
+}
+
+// QueryLimitsFromEnv reads:
+//
+//	QUERY_TIMEOUT         longest read, e.g. 15s (default 15s); off disables
+//	SLOW_QUERY_THRESHOLD  log reads at least this slow (default 500ms); off disables
+func QueryLimitsFromEnv() (QueryLimits, error) {
+	l := DefaultQueryLimits
+	for _, s := range []struct {
+		name string
+		dst  *time.Duration
+	}{
+		{"QUERY_TIMEOUT", &l.Timeout},
+		{"SLOW_QUERY_THRESHOLD", &l.SlowThreshold},
+	} {
+		v := os.Getenv(s.name)
+		if v == "" {
+			continue
+		}
+		if v == "off" {
+			*s.dst = 0
+			continue
+		}
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return l, fmt.Errorf("%s must be a positive duration such as 10s, or off, got %q", s.name, v)
+		}
+		*s.dst = d
+	}
+	return l, nil
+}
+
+// IsQueryTimeout reports whether err comes from a read that ran past the
+// query timeout, when it was sent or while its rows were read. Only
+// limited reads have a deadline, so any interrupted statement is one.
+func IsQueryTimeout(err error) bool {
+	var se *sqlite.Error
+	return errors.Is(err, ErrQueryTimeout) || errors.Is(err, context.DeadlineExceeded) ||
+		(errors.As(err, &se) && se.Code() == sqlite3.SQLITE_INTERRUPT)
+}
+
+// limited returns db with the query limits applied to its reads. A
+// transaction is returned as it is.
+func limited(db dbtx) dbtx {
+	l := queryLimits.Load()
+	pool, ok := db.(*sql.DB)
+	if l == nil || !ok || (l.Timeout == 0 && l.SlowThreshold == 0) {
+		return db
+	}
+	return &limitedDB{DB: pool, limits: *l}
+}
+
+// limitedDB runs Query and QueryRow under the query limits. Exec and
+// Prepare are the pool's own.
+type limitedDB struct {
+	*sql.DB
+	limits QueryLimits
+}
+
+func (db *limitedDB) Query(query string, args ...any) (*sql.Rows, error) {
+	ctx := db.context()
+	start := time.Now()
+	rows, err := db.DB.QueryContext(ctx, query, args...)
+	db.logSlow(query, start)
+	if err != nil {
+		return nil, db.timeoutErr(ctx, err)
+	}
+	return rows, nil
+}
+
+// QueryRow leaves an interrupted query's error to Scan, where
+// IsQueryTimeout recognizes it.
+func (db *limitedDB) QueryRow(query string, args ...any) *sql.Row {
+	start := time.Now()
+	row := db.DB.QueryRowContext(db.context(), query, args...)
+	db.logSlow(query, start)
+	return row
+}
+
+// context returns the context of one read. The rows are read after Query
+// returns, so it is not cancelled early: its timer goes when the deadline
+// passes.
+func (db *limitedDB) context() context.Context {
+	if db.limits.Timeout == 0 {
+		return context.Background()
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), db.limits.Timeout)
+	_ = cancel
+	return ctx
+}
+
+func (db *limitedDB) timeoutErr(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return fmt.Errorf("%w after %s", ErrQueryTimeout, db.limits.Timeout)
+	}
+	return err
+}
+
+// logSlow logs query when it took at least the slow threshold. Arguments
+// are left out: they can be processor references.
+func (db *limitedDB) logSlow(query string, start time.Time) {
+	elapsed := time.Since(start)
+	if db.limits.SlowThreshold == 0 || elapsed < db.limits.SlowThreshold {
+		return
+	}
+	query = strings.Join(strings.Fields(query), " ")
+	if len(query) > 300 {
+		query = query[:300] + "…"
+	}
+	log.Printf("[db] slow query (%s): %s", elapsed.Round(time.Millisecond), query)
+}
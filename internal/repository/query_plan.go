@@ -0,0 +1,86 @@
+package repository
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+)
+
+// hotQuery is a query on the reconciliation path and the indexes its plan
+// must use to stay fast as the tables grow.
+type hotQuery struct {
+	name    string
+	sql     string
+	indexes []string
+}
+
+// hotQueries are checked by CheckQueryPlans. The SQL is the same constant
+// the repository runs, so the check cannot drift from the query.
+var hotQueries = []hotQuery{
+	{
+		name:    "missing settlements",
+		sql:     capturedWithoutRecordSQL(false),
+		indexes: []string{"idx_transactions_status_captured", "idx_settlement_records_wakala_txn"},
+	},
+	{
+		name:    "missing payouts",
+		sql:     capturedWithoutRecordSQL(true),
+		indexes: []string{"idx_transactions_status_captured", "idx_settlement_records_wakala_txn"},
+	},
+	{
+		name:    "match by processor reference",
+		sql:     transactionByRefSQL,
+		indexes: []string{"idx_transactions_proc_ref"},
+	},
+	{
+		name:    "unmatched settlement records",
+		sql:     unmatchedRecordsSQL,
+		indexes: []string{"idx_settlement_records_wakala_txn"},
+	},
+}
+
+// CheckQueryPlans runs EXPLAIN QUERY PLAN on the reconciliation path's hot
+// queries and returns a problem for each one whose plan does not use its
+// indexes, such as after an index was dropped by hand or a query was changed
+// without its index. A misplanned query still works, only slowly, so the
+// caller decides whether to warn or stop.
+func CheckQueryPlans(db *sql.DB) ([]string, error) {
+	var problems []string
+	for _, q := range hotQueries {
+		plan, err := explain(db, q.sql)
+		if err != nil {
+			return nil, fmt.Errorf("explain %s: %w", q.name, err)
+		}
+		for _, idx := range q.indexes {
+			if !strings.Contains(plan, " "+idx+" ") && !strings.HasSuffix(plan, " "+idx) {
+				problems = append(problems, fmt.Sprintf("%s does not use %s: %s", q.name, idx, plan))
+			}
+		}
+	}
+	return problems, nil
+}
+
+// explain returns the steps of a query's plan joined by "; ". Placeholders
+// are bound to empty strings; SQLite plans without looking at the values.
+func explain(db *sql.DB, query string) (string, error) {
+	args := make([]any, strings.Count(query, "?"))
+	for i := range args {
+		args[i] = ""
+	}
+	rows, err := db.Query("EXPLAIN QUERY PLAN "+query, args...)
+	if err != nil {
+		return "", err
+	}
+	defer rows.Close()
+
+	var steps []string
+	for rows.Next() {
+		var id, parent, notUsed int
+		var detail string
+		if err := rows.Scan(&id, &parent, &notUsed, &detail); err != nil {
+			return "", err
+		}
+		steps = append(steps, detail)
+	}
+	return strings.Join(steps, "; "), rows.Err()
+}
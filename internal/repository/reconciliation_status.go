@@ -0,0 +1,49 @@
+package repository
+
+import (
+	"strings"
+
+	"github.com/wakala/reconciler/internal/domain"
+)
+
+// reconciliationStatusSQL derives each transaction's reconciliation status
+// from its settled status and open discrepancies. A missing-settlement
+// discrepancy on a transaction that has since settled, e.g. through a
+// webhook, is stale until the next run and does not count.
+const reconciliationStatusSQL = `
+	INSERT INTO transaction_reconciliation (transaction_id, status)
+	SELECT t.id, CASE
+		WHEN EXISTS (SELECT 1 FROM discrepancies d JOIN discrepancy_tags g ON g.discrepancy_id = d.id
+			WHERE d.transaction_id = t.id AND g.tag = ?) THEN ?
+		WHEN t.status != 'settled' AND EXISTS (SELECT 1 FROM discrepancies d
+			WHERE d.transaction_id = t.id AND d.type IN ('MISSING_SETTLEMENT', 'MISSING_PAYOUT')) THEN ?
+		WHEN EXISTS (SELECT 1 FROM discrepancies d
+			WHERE d.transaction_id = t.id AND d.type IN ('AMOUNT_MISMATCH', 'OVERPAID')) THEN ?
+		WHEN t.status = 'settled' THEN ?
+		ELSE ? END
+	FROM transactions t
+	WHERE 1`
+
+// RefreshReconciliationStatus rederives the reconciliation status of the
+// given transactions, or of every transaction when ids is empty, from the
+// current discrepancies and tags.
+func (r *TransactionRepo) RefreshReconciliationStatus(ids ...string) error {
+	q := reconciliationStatusSQL
+	args := []any{
+		domain.InvestigationTag,
+		string(domain.ReconUnderInvestigation),
+		string(domain.ReconMissingSettlement),
+		string(domain.ReconSettledWithVariance),
+		string(domain.ReconSettledClean),
+		string(domain.ReconUnreconciled),
+	}
+	if len(ids) > 0 {
+		q += " AND t.id IN (" + strings.TrimSuffix(strings.Repeat("?,", len(ids)), ",") + ")"
+		for _, id := range ids {
+			args = append(args, id)
+		}
+	}
+	q += " ON CONFLICT(transaction_id) DO UPDATE SET status = excluded.status"
+	_, err := r.db.Exec(q, args...)
+	return err
+}
@@ -0,0 +1,243 @@
+package repository
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/wakala/reconciler/internal/domain"
+)
+
+// ErrDuplicateReference is matched by a DuplicateReferenceError.
+var ErrDuplicateReference = errors.New("processor reference is already used by another transaction")
+
+// ReferenceConflict is a transaction refused because another transaction of
+// the same processor already has its processor reference.
+type ReferenceConflict struct {
+	TransactionID         string           `json:"transaction_id"`
+	Processor             domain.Processor `json:"processor"`
+	ProcessorReference    string           `json:"processor_reference"`
+	ExistingTransactionID string           `json:"existing_transaction_id"`
+}
+
+// DuplicateReferenceError is returned by Insert and BulkInsert when
+// transactions reuse a processor reference. Nothing is stored; Conflicts
+// lists every offending transaction, including ones that clash with an
+// earlier row of the same load.
+type DuplicateReferenceError struct {
+	Conflicts []ReferenceConflict
+}
+
+func (e *DuplicateReferenceError) Error() string {
+	c := e.Conflicts[0]
+	msg := fmt.Sprintf("transaction %s: %s reference %s is already used by %s",
+		c.TransactionID, c.Processor, c.ProcessorReference, c.ExistingTransactionID)
+	if len(e.Conflicts) > 1 {
+		msg += fmt.Sprintf(" (and %d more)", len(e.Conflicts)-1)
+	}
+	return msg
+}
+
+func (e *DuplicateReferenceError) Unwrap() error { return ErrDuplicateReference }
+
+// referenceConflict is called after INSERT OR IGNORE skipped tx. A skip is
+// either a reload of an existing ID, which is not an error, or the unique
+// processor reference index refusing a different transaction, which is
+// returned as a conflict. With column encryption it is also called after a
+// stored row: the index cannot see the reference stored under a retired
+// key or in plaintext, so every form is looked up.
+func referenceConflict(db dbtx, tx *domain.Transaction) (*ReferenceConflict, error) {
+	for _, form := range columnLookups(tx.ProcessorReference) {
+		var existing string
+		err := db.QueryRow(transactionIDByRefSQL, string(tx.Processor), form).Scan(&existing)
+		if errors.Is(err, sql.ErrNoRows) || existing == tx.ID {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("look up reference of %s: %w", tx.ID, err)
+		}
+		return &ReferenceConflict{
+			TransactionID:         tx.ID,
+			Processor:             tx.Processor,
+			ProcessorReference:    tx.ProcessorReference,
+			ExistingTransactionID: existing,
+		}, nil
+	}
+	return nil, nil
+}
+
+const transactionIDByRefSQL = "SELECT id FROM transactions WHERE processor = ? AND processor_reference = ?"
+
+// ensureUniqueProcessorRefs creates the unique index on a transaction's
+// processor and processor reference. A database written before the index
+// may hold several transactions per reference; in each such group the one
+// a settlement record is matched to is kept, or else the oldest, and the
+// rest are moved to quarantined_transactions with their amendments, in the
+// same transaction as the index. Records matched to a quarantined
+// transaction are unmatched, so the next run matches them to the kept one.
+func ensureUniqueProcessorRefs(db *sql.DB) error {
+	var exists int
+	if err := db.QueryRow(
+		"SELECT COUNT(*) FROM sqlite_master WHERE type = 'index' AND name = 'idx_transactions_proc_ref'",
+	).Scan(&exists); err != nil {
+		return fmt.Errorf("check processor reference index: %w", err)
+	}
+	if exists > 0 {
+		return nil
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("begin: %w", err)
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(`
+		SELECT id, kept_id FROM (
+			SELECT t.id,
+				ROW_NUMBER() OVER w AS rank,
+				FIRST_VALUE(t.id) OVER w AS kept_id
+			FROM transactions t
+			WINDOW w AS (
+				PARTITION BY t.processor, t.processor_reference
+				ORDER BY EXISTS (SELECT 1 FROM settlement_records sr WHERE sr.wakala_transaction_id = t.id) DESC,
+					t.created_at, t.id
+			)
+		) WHERE rank > 1`)
+	if err != nil {
+		return fmt.Errorf("find duplicate processor references: %w", err)
+	}
+	dupes := make(map[string]string)
+	for rows.Next() {
+		var id, keptID string
+		if err := rows.Scan(&id, &keptID); err != nil {
+			rows.Close()
+			return err
+		}
+		dupes[id] = keptID
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	for id, keptID := range dupes {
+		if err := quarantineTransaction(tx, id, keptID, now); err != nil {
+			return fmt.Errorf("quarantine %s: %w", id, err)
+		}
+	}
+
+	if _, err := tx.Exec(
+		"CREATE UNIQUE INDEX idx_transactions_proc_ref ON transactions(processor, processor_reference)",
+	); err != nil {
+		return fmt.Errorf("create processor reference index: %w", err)
+	}
+	return tx.Commit()
+}
+
+// quarantineTransaction moves one transaction and its amendments, links and
+// matches out of the ledger.
+func quarantineTransaction(tx *sql.Tx, id, keptID string, at time.Time) error {
+	repo := &TransactionRepo{db: tx}
+	txn, err := repo.GetByID(id)
+	if err != nil {
+		return err
+	}
+	q := domain.QuarantinedTransaction{Transaction: *txn, KeptID: keptID, QuarantinedAt: at}
+
+	rows, err := tx.Query("SELECT * FROM transaction_amendments WHERE transaction_id = ? ORDER BY version", id)
+	if err != nil {
+		return err
+	}
+	q.Amendments = []domain.TransactionAmendment{}
+	for rows.Next() {
+		a, err := scanAmendment(rows)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		q.Amendments = append(q.Amendments, *a)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	payload, err := json.Marshal(q)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec(
+		`INSERT INTO quarantined_transactions (id, processor, processor_reference, kept_id, quarantined_at, payload)
+		VALUES (?,?,?,?,?,?)`,
+		id, string(txn.Processor), sealColumn(txn.ProcessorReference), keptID, at.Format(time.RFC3339), sealColumn(string(payload)),
+	); err != nil {
+		return err
+	}
+
+	for _, stmt := range []string{
+		"UPDATE settlement_records SET wakala_transaction_id = NULL WHERE wakala_transaction_id = ?",
+		"DELETE FROM transaction_amendments WHERE transaction_id = ?",
+		"DELETE FROM transaction_directions WHERE transaction_id = ?",
+		"DELETE FROM transfer_legs WHERE transaction_id = ?",
+		"DELETE FROM transaction_reconciliation WHERE transaction_id = ?",
+		"DELETE FROM transactions WHERE id = ?",
+	} {
+		if _, err := tx.Exec(stmt, id); err != nil {
+			return fmt.Errorf("%s: %w", strings.Fields(stmt)[0], err)
+		}
+	}
+	return nil
+}
+
+// ListQuarantined returns the quarantined transactions, most recently
+// quarantined first.
+func (r *TransactionRepo) ListQuarantined() ([]domain.QuarantinedTransaction, error) {
+	rows, err := r.reader().Query("SELECT payload FROM quarantined_transactions ORDER BY quarantined_at DESC, id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := []domain.QuarantinedTransaction{}
+	for rows.Next() {
+		var payload string
+		if err := rows.Scan(&payload); err != nil {
+			return nil, err
+		}
+		payload, err := openColumn(payload)
+		if err != nil {
+			return nil, fmt.Errorf("quarantined transaction: %w", err)
+		}
+		var q domain.QuarantinedTransaction
+		if err := json.Unmarshal([]byte(payload), &q); err != nil {
+			return nil, fmt.Errorf("decode quarantined transaction: %w", err)
+		}
+		result = append(result, q)
+	}
+	return result, rows.Err()
+}
+
+// CountQuarantined returns the number of quarantined transactions.
+func (r *TransactionRepo) CountQuarantined() (int, error) {
+	var n int
+	err := r.db.QueryRow("SELECT COUNT(*) FROM quarantined_transactions").Scan(&n)
+	return n, err
+}
+
+// DeleteQuarantined discards a reviewed quarantined transaction. It returns
+// sql.ErrNoRows when there is none with the ID.
+func (r *TransactionRepo) DeleteQuarantined(id string) error {
+	res, err := r.db.Exec("DELETE FROM quarantined_transactions WHERE id = ?", id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
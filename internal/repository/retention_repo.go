@@ -0,0 +1,515 @@
+package repository
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/wakala/reconciler/internal/blob"
+	"github.com/wakala/reconciler/internal/domain"
+)
+
+// anonPrefix starts every reference and ID written by an anonymizing purge;
+// anonMerchant replaces merchant IDs.
+const (
+	anonPrefix   = "ANON-"
+	anonMerchant = "ANON"
+)
+
+// RetentionCutoffs says which rows a purge reaches: those dated before the
+// cutoff of their processor, or before Default for processors without one.
+// Rows of a processor with neither are kept.
+type RetentionCutoffs struct {
+	Default     *time.Time
+	ByProcessor map[domain.Processor]time.Time
+}
+
+// where returns an SQL condition on the processor column and col for rows
+// past their cutoff.
+func (c RetentionCutoffs) where(col string) (string, []any) {
+	var clauses, listed []string
+	var args, listedArgs []any
+	for proc, t := range c.ByProcessor {
+		clauses = append(clauses, "(processor = ? AND "+col+" < ?)")
+		args = append(args, string(proc), t.Format(time.RFC3339))
+		listed = append(listed, "?")
+		listedArgs = append(listedArgs, string(proc))
+	}
+	if c.Default != nil {
+		clause := col + " < ?"
+		if len(listed) > 0 {
+			clause = "(processor NOT IN (" + strings.Join(listed, ",") + ") AND " + clause + ")"
+			args = append(args, listedArgs...)
+		}
+		clauses = append(clauses, clause)
+		args = append(args, c.Default.Format(time.RFC3339))
+	}
+	if len(clauses) == 0 {
+		return "0", nil
+	}
+	return "(" + strings.Join(clauses, " OR ") + ")", args
+}
+
+// RetentionRepo purges rows past their retention period and keeps the
+// purge reports and the aggregates of deleted rows.
+type RetentionRepo struct {
+	db    *sql.DB
+	blobs blob.Store
+}
+
+func NewRetentionRepo(db *sql.DB) *RetentionRepo {
+	return &RetentionRepo{db: db}
+}
+
+// SetBlobStore makes DeleteQueuedBlobs delete the purged files kept in
+// store.
+func (r *RetentionRepo) SetBlobStore(store blob.Store) {
+	r.blobs = store
+}
+
+// Purge anonymizes or deletes, in one transaction, the transactions created
+// before their cutoff and the settlement records matched to them or, when
+// unmatched, settled before it. With it go the transactions' amendments,
+// directions and transfer legs, the records' corrections and adjustments,
+// the discrepancies raised on either with their tags, activity and policy,
+// quarantined transactions and the parse warnings and original files of old
+// reports, which quote report rows. Discrepancy lifecycle rows are kept for flow
+// analytics under an anonymous ID, with open spells closed at the purge.
+//
+// Transactions and records with a pending adjustment are skipped until it
+// is decided. Reports, batch certificates and period closes are kept: they
+// hold no references beyond batch IDs and are the accounting record.
+//
+// report carries the mode, cutoffs and requester and is filled with the
+// counts and aggregates. Unless it is a dry run, which rolls everything
+// back, it is stored and, in delete mode, the aggregates are added to the
+// retention aggregates.
+func (r *RetentionRepo) Purge(cutoffs RetentionCutoffs, report *domain.PurgeReport) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return fmt.Errorf("begin: %w", err)
+	}
+	defer tx.Rollback()
+
+	if err := selectPurged(tx, cutoffs, report); err != nil {
+		return err
+	}
+
+	if err := purgeAggregates(tx, report); err != nil {
+		return fmt.Errorf("aggregate: %w", err)
+	}
+	if report.Discrepancies, err = purgeDiscrepancies(tx, report.PurgedAt); err != nil {
+		return fmt.Errorf("discrepancies: %w", err)
+	}
+	if report.Mode == domain.RetentionDelete {
+		err = deletePurged(tx)
+	} else {
+		err = anonymizePurged(tx)
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %w", report.Mode, err)
+	}
+
+	where, args := cutoffs.where("quarantined_at")
+	if report.QuarantinedTransactions, err = execCount(tx, "DELETE FROM quarantined_transactions WHERE "+where, args...); err != nil {
+		return fmt.Errorf("quarantined transactions: %w", err)
+	}
+	where, args = cutoffs.where("report_date")
+	if report.ReportWarnings, err = execCount(tx,
+		"DELETE FROM report_warnings WHERE report_id IN (SELECT id FROM settlement_reports WHERE "+where+")", args...,
+	); err != nil {
+		return fmt.Errorf("report warnings: %w", err)
+	}
+	if _, err := tx.Exec(
+		"DELETE FROM report_file_links WHERE report_id IN (SELECT id FROM settlement_reports WHERE "+where+")", args...,
+	); err != nil {
+		return fmt.Errorf("report file links: %w", err)
+	}
+	if _, err := tx.Exec(
+		"DELETE FROM report_provenance WHERE report_id IN (SELECT id FROM settlement_reports WHERE "+where+")", args...,
+	); err != nil {
+		return fmt.Errorf("report provenance: %w", err)
+	}
+	if _, err := tx.Exec(
+		"DELETE FROM report_verifications WHERE report_id IN (SELECT id FROM settlement_reports WHERE "+where+")", args...,
+	); err != nil {
+		return fmt.Errorf("report verifications: %w", err)
+	}
+	if _, err := tx.Exec(
+		"DELETE FROM report_control_totals WHERE report_id IN (SELECT id FROM settlement_reports WHERE "+where+")", args...,
+	); err != nil {
+		return fmt.Errorf("report control totals: %w", err)
+	}
+	// Files of open dead letters are kept until they are retried or
+	// discarded.
+	const unlinked = `hash NOT IN (SELECT file_hash FROM report_file_links)
+		AND hash NOT IN (SELECT file_hash FROM ingest_dead_letters WHERE status = 'open')`
+	if _, err := tx.Exec(
+		"INSERT OR IGNORE INTO blob_deletions (key, requested_at) SELECT key, ? FROM report_file_blobs WHERE "+unlinked,
+		report.PurgedAt.Format(time.RFC3339),
+	); err != nil {
+		return fmt.Errorf("queue report file blobs: %w", err)
+	}
+	if _, err := tx.Exec("DELETE FROM report_file_blobs WHERE " + unlinked); err != nil {
+		return fmt.Errorf("report file blobs: %w", err)
+	}
+	if report.ReportFiles, err = execCount(tx, "DELETE FROM report_files WHERE "+unlinked); err != nil {
+		return fmt.Errorf("report files: %w", err)
+	}
+
+	if report.DryRun {
+		return nil
+	}
+	if report.Mode == domain.RetentionDelete {
+		for _, a := range report.Aggregates {
+			if _, err := tx.Exec(
+				`INSERT INTO retention_aggregates (kind, period, processor, currency, count, amount, usd_amount)
+				VALUES (?,?,?,?,?,?,?)
+				ON CONFLICT (kind, period, processor, currency) DO UPDATE SET
+					count = count + excluded.count,
+					amount = amount + excluded.amount,
+					usd_amount = usd_amount + excluded.usd_amount`,
+				a.Kind, a.Period, string(a.Processor), a.Currency, a.Count, a.Amount, a.USDAmount,
+			); err != nil {
+				return fmt.Errorf("store aggregates: %w", err)
+			}
+		}
+	}
+	payload, err := json.Marshal(report)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec(
+		"INSERT INTO purge_reports (id, mode, requested_by, purged_at, report_json) VALUES (?,?,?,?,?)",
+		report.ID, string(report.Mode), report.RequestedBy, report.PurgedAt.Format(time.RFC3339), string(payload),
+	); err != nil {
+		return fmt.Errorf("store report: %w", err)
+	}
+	if err := dropPurgeTables(tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// DeleteQueuedBlobs deletes from the blob store the files of purged
+// reports, which Purge queues in its transaction, and returns how many it
+// deleted. A blob that fails to delete stays queued for the next call.
+// Without a blob store it does nothing.
+func (r *RetentionRepo) DeleteQueuedBlobs() (int, error) {
+	if r.blobs == nil {
+		return 0, nil
+	}
+	rows, err := r.db.Query("SELECT key FROM blob_deletions ORDER BY key")
+	if err != nil {
+		return 0, err
+	}
+	var keys []string
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		keys = append(keys, key)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	deleted := 0
+	var failed []string
+	var lastErr error
+	for _, key := range keys {
+		if err := r.blobs.Delete(context.Background(), key); err != nil {
+			failed, lastErr = append(failed, key), err
+			continue
+		}
+		if _, err := r.db.Exec("DELETE FROM blob_deletions WHERE key = ?", key); err != nil {
+			return deleted, err
+		}
+		deleted++
+	}
+	if lastErr != nil {
+		return deleted, fmt.Errorf("%d of %d purged files left in %s: %w", len(failed), len(keys), r.blobs, lastErr)
+	}
+	return deleted, nil
+}
+
+// selectPurged fills temp tables with the IDs of the transactions and
+// settlement records to purge. The tables live on the transaction's
+// connection; a rollback drops them with everything else. An anonymizing
+// purge does not select rows an earlier one already rewrote.
+func selectPurged(tx *sql.Tx, cutoffs RetentionCutoffs, report *domain.PurgeReport) error {
+	const pendingAmendments = "SELECT reference FROM pending_adjustments WHERE status = 'pending' AND kind = 'amendment'"
+	const pendingCorrections = "SELECT reference FROM pending_adjustments WHERE status = 'pending' AND kind = 'correction'"
+
+	if err := dropPurgeTables(tx); err != nil {
+		return err
+	}
+	var notAnonTxn, notAnonRecord string
+	if report.Mode == domain.RetentionAnonymize {
+		notAnonTxn = " AND processor_reference != '" + anonPrefix + "' || id"
+		notAnonRecord = " AND id NOT LIKE 'SR-" + anonPrefix + "%'"
+	}
+
+	where, args := cutoffs.where("created_at")
+	candidates := "FROM transactions WHERE " + where + notAnonTxn
+	var total int
+	if err := tx.QueryRow("SELECT COUNT(*) "+candidates, args...).Scan(&total); err != nil {
+		return fmt.Errorf("count transactions: %w", err)
+	}
+	if _, err := tx.Exec(
+		`CREATE TEMP TABLE purge_transactions AS SELECT id `+candidates+`
+			AND id NOT IN (`+pendingAmendments+`)
+			AND id NOT IN (SELECT wakala_transaction_id FROM settlement_records
+				WHERE wakala_transaction_id IS NOT NULL AND id IN (`+pendingCorrections+`))`,
+		args...,
+	); err != nil {
+		return fmt.Errorf("select transactions: %w", err)
+	}
+	if err := tx.QueryRow("SELECT COUNT(*) FROM purge_transactions").Scan(&report.Transactions); err != nil {
+		return err
+	}
+	if skipped := total - report.Transactions; skipped > 0 {
+		report.Skipped = map[string]int{"transactions_with_pending_adjustments": skipped}
+	}
+
+	where, args = cutoffs.where("settlement_date")
+	if _, err := tx.Exec(
+		`CREATE TEMP TABLE purge_records AS SELECT id FROM settlement_records
+		WHERE (wakala_transaction_id IN (SELECT id FROM purge_transactions)
+			OR (wakala_transaction_id IS NULL AND `+where+` AND id NOT IN (`+pendingCorrections+`)))`+notAnonRecord,
+		args...,
+	); err != nil {
+		return fmt.Errorf("select settlement records: %w", err)
+	}
+	return tx.QueryRow("SELECT COUNT(*) FROM purge_records").Scan(&report.SettlementRecords)
+}
+
+func dropPurgeTables(tx *sql.Tx) error {
+	for _, table := range []string{"purge_transactions", "purge_records"} {
+		if _, err := tx.Exec("DROP TABLE IF EXISTS temp." + table); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func purgeAggregates(tx *sql.Tx, report *domain.PurgeReport) error {
+	rows, err := tx.Query(`
+		SELECT 'transaction', substr(created_at, 1, 7) AS period, processor, currency,
+			COUNT(*), SUM(amount), SUM(usd_amount)
+		FROM transactions WHERE id IN (SELECT id FROM purge_transactions)
+		GROUP BY period, processor, currency
+		UNION ALL
+		SELECT 'settlement', substr(settlement_date, 1, 7) AS period, processor, currency,
+			COUNT(*), SUM(gross_amount), SUM(usd_gross_amount)
+		FROM settlement_records WHERE id IN (SELECT id FROM purge_records)
+		GROUP BY period, processor, currency
+		ORDER BY 1 DESC, 2, 3, 4`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	report.Aggregates = []domain.RetentionAggregate{}
+	for rows.Next() {
+		var a domain.RetentionAggregate
+		var proc string
+		if err := rows.Scan(&a.Kind, &a.Period, &proc, &a.Currency, &a.Count, &a.Amount, &a.USDAmount); err != nil {
+			return err
+		}
+		a.Processor = domain.Processor(proc)
+		report.Aggregates = append(report.Aggregates, a)
+	}
+	return rows.Err()
+}
+
+// purgeDiscrepancies removes the discrepancies raised on purged rows and
+// returns how many were current. Discrepancy IDs are "DISC-XX-" and the ID
+// of the transaction or record they are about, which is how tags, activity,
+// lifecycle and daily snapshot rows of discrepancies no longer current are
+// found too. Cases left without members are removed.
+func purgeDiscrepancies(tx *sql.Tx, at time.Time) (int, error) {
+	const subject = `substr(%s, 9) IN (SELECT id FROM purge_transactions UNION ALL SELECT id FROM purge_records)`
+
+	n, err := execCount(tx, "DELETE FROM discrepancies WHERE "+fmt.Sprintf(subject, "id"))
+	if err != nil {
+		return 0, err
+	}
+	for _, table := range []string{"discrepancy_tags", "discrepancy_assignments", "discrepancy_tickets", "discrepancy_resolutions", "jira_issues", "case_members", "discrepancy_activity", "discrepancy_policies", "discrepancy_causes", "discrepancy_attributions"} {
+		if _, err := tx.Exec("DELETE FROM " + table + " WHERE " + fmt.Sprintf(subject, "discrepancy_id")); err != nil {
+			return 0, fmt.Errorf("%s: %w", table, err)
+		}
+	}
+	if _, err := tx.Exec("DELETE FROM discrepancy_cases WHERE id NOT IN (SELECT case_id FROM case_members)"); err != nil {
+		return 0, fmt.Errorf("discrepancy_cases: %w", err)
+	}
+	if _, err := tx.Exec(
+		"UPDATE discrepancy_lifecycle SET discrepancy_id = '"+anonPrefix+"' || id, resolved_at = COALESCE(resolved_at, ?) WHERE "+
+			fmt.Sprintf(subject, "discrepancy_id"),
+		at.Format(time.RFC3339),
+	); err != nil {
+		return 0, fmt.Errorf("discrepancy_lifecycle: %w", err)
+	}
+	if _, err := tx.Exec(
+		"UPDATE open_discrepancy_snapshots SET discrepancy_id = '" + anonPrefix + "' || rowid, " +
+			"merchant_id = CASE WHEN merchant_id IS NULL THEN NULL ELSE '" + anonMerchant + "' END WHERE " +
+			fmt.Sprintf(subject, "discrepancy_id"),
+	); err != nil {
+		return 0, fmt.Errorf("open_discrepancy_snapshots: %w", err)
+	}
+	return n, nil
+}
+
+func deletePurged(tx *sql.Tx) error {
+	for _, stmt := range []string{
+		"DELETE FROM suggestion_feedback WHERE settlement_id IN (SELECT id FROM purge_records) OR transaction_id IN (SELECT id FROM purge_transactions)",
+		"DELETE FROM settlement_corrections WHERE settlement_id IN (SELECT id FROM purge_records)",
+		"DELETE FROM settlement_adjustments WHERE settlement_id IN (SELECT id FROM purge_records)",
+		"DELETE FROM settlement_fees WHERE settlement_id IN (SELECT id FROM purge_records)",
+		"DELETE FROM settlement_taxes WHERE settlement_id IN (SELECT id FROM purge_records)",
+		"DELETE FROM settlement_records WHERE id IN (SELECT id FROM purge_records)",
+		"DELETE FROM transaction_amendments WHERE transaction_id IN (SELECT id FROM purge_transactions)",
+		"DELETE FROM transaction_directions WHERE transaction_id IN (SELECT id FROM purge_transactions)",
+		"DELETE FROM transfer_legs WHERE transaction_id IN (SELECT id FROM purge_transactions)",
+		"DELETE FROM transaction_reconciliation WHERE transaction_id IN (SELECT id FROM purge_transactions)",
+		"DELETE FROM transactions WHERE id IN (SELECT id FROM purge_transactions)",
+	} {
+		if _, err := tx.Exec(stmt); err != nil {
+			return fmt.Errorf("%s: %w", strings.Fields(stmt)[2], err)
+		}
+	}
+	return nil
+}
+
+// anonymizePurged rewrites the identifying values of purged rows.
+// Settlement record IDs are built from the processor reference, so records
+// get a new ID, a hash of the old one, and their corrections, adjustments,
+// fee components, taxes and suggestion feedback follow; foreign keys are checked at commit.
+func anonymizePurged(tx *sql.Tx) error {
+	for _, stmt := range []string{
+		"UPDATE transactions SET processor_reference = '" + anonPrefix + "' || id, merchant_id = '" + anonMerchant + "' WHERE id IN (SELECT id FROM purge_transactions)",
+		"UPDATE transaction_amendments SET reason = '', event_id = '' WHERE transaction_id IN (SELECT id FROM purge_transactions)",
+		"UPDATE settlement_corrections SET reason = '' WHERE settlement_id IN (SELECT id FROM purge_records)",
+		"UPDATE suggestion_feedback SET note = '' WHERE settlement_id IN (SELECT id FROM purge_records) OR transaction_id IN (SELECT id FROM purge_transactions)",
+		"PRAGMA defer_foreign_keys = ON",
+	} {
+		if _, err := tx.Exec(stmt); err != nil {
+			return fmt.Errorf("%s: %w", strings.Fields(stmt)[1], err)
+		}
+	}
+
+	rows, err := tx.Query("SELECT id FROM purge_records")
+	if err != nil {
+		return err
+	}
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		sum := sha256.Sum256([]byte(id))
+		ref := anonPrefix + hex.EncodeToString(sum[:10])
+		newID := "SR-" + ref
+		if _, err := tx.Exec("UPDATE settlement_records SET id = ?, processor_transaction_id = ? WHERE id = ?", newID, ref, id); err != nil {
+			return fmt.Errorf("record %s: %w", id, err)
+		}
+		if _, err := tx.Exec("UPDATE settlement_corrections SET settlement_id = ? WHERE settlement_id = ?", newID, id); err != nil {
+			return fmt.Errorf("corrections of %s: %w", id, err)
+		}
+		if _, err := tx.Exec("UPDATE settlement_adjustments SET settlement_id = ? WHERE settlement_id = ?", newID, id); err != nil {
+			return fmt.Errorf("adjustment of %s: %w", id, err)
+		}
+		if _, err := tx.Exec("UPDATE settlement_fees SET settlement_id = ? WHERE settlement_id = ?", newID, id); err != nil {
+			return fmt.Errorf("fees of %s: %w", id, err)
+		}
+		if _, err := tx.Exec("UPDATE settlement_taxes SET settlement_id = ? WHERE settlement_id = ?", newID, id); err != nil {
+			return fmt.Errorf("tax of %s: %w", id, err)
+		}
+		if _, err := tx.Exec("UPDATE suggestion_feedback SET settlement_id = ? WHERE settlement_id = ?", newID, id); err != nil {
+			return fmt.Errorf("suggestion feedback of %s: %w", id, err)
+		}
+	}
+	return nil
+}
+
+func execCount(tx *sql.Tx, query string, args ...any) (int, error) {
+	res, err := tx.Exec(query, args...)
+	if err != nil {
+		return 0, err
+	}
+	n, _ := res.RowsAffected()
+	return int(n), nil
+}
+
+// ListReports returns the stored purge reports, newest first.
+func (r *RetentionRepo) ListReports() ([]domain.PurgeReport, error) {
+	rows, err := r.db.Query("SELECT report_json FROM purge_reports ORDER BY purged_at DESC, id DESC")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	reports := []domain.PurgeReport{}
+	for rows.Next() {
+		var payload string
+		if err := rows.Scan(&payload); err != nil {
+			return nil, err
+		}
+		var rpt domain.PurgeReport
+		if err := json.Unmarshal([]byte(payload), &rpt); err != nil {
+			return nil, fmt.Errorf("decode purge report: %w", err)
+		}
+		reports = append(reports, rpt)
+	}
+	return reports, rows.Err()
+}
+
+// CountReports returns the number of stored purge reports.
+func (r *RetentionRepo) CountReports() (int, error) {
+	var n int
+	err := r.db.QueryRow("SELECT COUNT(*) FROM purge_reports").Scan(&n)
+	return n, err
+}
+
+// Aggregates returns the totals of every row deleted by a purge, by kind,
+// month, processor and currency.
+func (r *RetentionRepo) Aggregates() ([]domain.RetentionAggregate, error) {
+	rows, err := r.db.Query(
+		`SELECT kind, period, processor, currency, count, amount, usd_amount
+		FROM retention_aggregates ORDER BY kind DESC, period, processor, currency`,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	aggs := []domain.RetentionAggregate{}
+	for rows.Next() {
+		var a domain.RetentionAggregate
+		var proc string
+		if err := rows.Scan(&a.Kind, &a.Period, &proc, &a.Currency, &a.Count, &a.Amount, &a.USDAmount); err != nil {
+			return nil, err
+		}
+		a.Processor = domain.Processor(proc)
+		aggs = append(aggs, a)
+	}
+	return aggs, rows.Err()
+}
@@ -0,0 +1,100 @@
+package repository
+
+import (
+	"database/sql"
+	"strings"
+	"time"
+
+	"github.com/wakala/reconciler/internal/domain"
+)
+
+type RoutingRuleRepo struct {
+	db dbtx
+}
+
+func NewRoutingRuleRepo(db *sql.DB) *RoutingRuleRepo {
+	return &RoutingRuleRepo{db: db}
+}
+
+// Create stores a new rule. A rule without a position goes after the last
+// one.
+func (r *RoutingRuleRepo) Create(rule *domain.RoutingRule) error {
+	if rule.Position <= 0 {
+		if err := r.db.QueryRow("SELECT COALESCE(MAX(position), 0) + 1 FROM routing_rules").Scan(&rule.Position); err != nil {
+			return err
+		}
+	}
+	_, err := r.db.Exec(
+		`INSERT INTO routing_rules (id, position, processor, min_severity, merchant_id, type, team, assignee, notify, updated_by, updated_at)
+		VALUES (?,?,?,?,?,?,?,?,?,?,?)`,
+		rule.ID, rule.Position, rule.Processor, rule.MinSeverity, rule.MerchantID, rule.Type,
+		rule.Team, rule.Assignee, strings.Join(rule.Notify, ","), rule.UpdatedBy, rule.UpdatedAt.Format(time.RFC3339),
+	)
+	return err
+}
+
+// Update replaces a rule. A rule without a position keeps its own. It
+// returns sql.ErrNoRows when there is no such rule.
+func (r *RoutingRuleRepo) Update(rule *domain.RoutingRule) error {
+	res, err := r.db.Exec(
+		`UPDATE routing_rules SET
+			position = CASE WHEN ? > 0 THEN ? ELSE position END,
+			processor = ?, min_severity = ?, merchant_id = ?, type = ?,
+			team = ?, assignee = ?, notify = ?, updated_by = ?, updated_at = ?
+		WHERE id = ?`,
+		rule.Position, rule.Position, rule.Processor, rule.MinSeverity, rule.MerchantID, rule.Type,
+		rule.Team, rule.Assignee, strings.Join(rule.Notify, ","), rule.UpdatedBy, rule.UpdatedAt.Format(time.RFC3339),
+		rule.ID,
+	)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return r.db.QueryRow("SELECT position FROM routing_rules WHERE id = ?", rule.ID).Scan(&rule.Position)
+}
+
+// Delete removes a rule. Discrepancies it assigned keep their assignment.
+// It returns sql.ErrNoRows when there is no such rule.
+func (r *RoutingRuleRepo) Delete(id string) error {
+	res, err := r.db.Exec("DELETE FROM routing_rules WHERE id = ?", id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// List returns every rule in the order they are tried: by position, and
+// rules sharing a position by ID.
+func (r *RoutingRuleRepo) List() ([]domain.RoutingRule, error) {
+	rows, err := r.db.Query(`SELECT id, position, processor, min_severity, merchant_id, type, team, assignee, notify, updated_by, updated_at
+		FROM routing_rules ORDER BY position, id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []domain.RoutingRule
+	for rows.Next() {
+		var rule domain.RoutingRule
+		var proc, sev, dtype, notify, updatedAt string
+		if err := rows.Scan(&rule.ID, &rule.Position, &proc, &sev, &rule.MerchantID, &dtype,
+			&rule.Team, &rule.Assignee, &notify, &rule.UpdatedBy, &updatedAt); err != nil {
+			return nil, err
+		}
+		rule.Processor = domain.Processor(proc)
+		rule.MinSeverity = domain.Severity(sev)
+		rule.Type = domain.DiscrepancyType(dtype)
+		rule.Notify = []string{}
+		if notify != "" {
+			rule.Notify = strings.Split(notify, ",")
+		}
+		rule.UpdatedAt, _ = time.Parse(time.RFC3339, updatedAt)
+		result = append(result, rule)
+	}
+	return result, rows.Err()
+}
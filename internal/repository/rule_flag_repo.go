@@ -0,0 +1,67 @@
+package repository
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/wakala/reconciler/internal/domain"
+)
+
+type RuleFlagRepo struct {
+	db dbtx
+}
+
+func NewRuleFlagRepo(db *sql.DB) *RuleFlagRepo {
+	return &RuleFlagRepo{db: db}
+}
+
+// Upsert creates or replaces the flag of a rule for its processor, or for
+// all processors when the processor is empty.
+func (r *RuleFlagRepo) Upsert(f *domain.RuleFlag) error {
+	_, err := r.db.Exec(
+		`INSERT INTO rule_flags (rule, processor, enabled, updated_by, updated_at)
+		VALUES (?,?,?,?,?)
+		ON CONFLICT(rule, processor) DO UPDATE SET
+			enabled = excluded.enabled,
+			updated_by = excluded.updated_by,
+			updated_at = excluded.updated_at`,
+		f.Rule, f.Processor, f.Enabled, f.UpdatedBy, f.UpdatedAt.Format(time.RFC3339),
+	)
+	return err
+}
+
+// Delete removes a rule's flag for a processor, or its flag for all
+// processors when proc is empty. It returns sql.ErrNoRows when there was no
+// such flag.
+func (r *RuleFlagRepo) Delete(rule string, proc domain.Processor) error {
+	res, err := r.db.Exec("DELETE FROM rule_flags WHERE rule = ? AND processor = ?", rule, proc)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// List returns every flag, by rule and then processor, each rule's flag for
+// all processors first.
+func (r *RuleFlagRepo) List() ([]domain.RuleFlag, error) {
+	rows, err := r.db.Query("SELECT * FROM rule_flags ORDER BY rule, processor")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []domain.RuleFlag
+	for rows.Next() {
+		var f domain.RuleFlag
+		var updatedAt string
+		if err := rows.Scan(&f.Rule, &f.Processor, &f.Enabled, &f.UpdatedBy, &updatedAt); err != nil {
+			return nil, err
+		}
+		f.UpdatedAt, _ = time.Parse(time.RFC3339, updatedAt)
+		result = append(result, f)
+	}
+	return result, rows.Err()
+}
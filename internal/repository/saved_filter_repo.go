@@ -0,0 +1,100 @@
+package repository
+
+import (
+	"database/sql"
+	"net/url"
+	"time"
+
+	"github.com/wakala/reconciler/internal/domain"
+)
+
+type SavedFilterRepo struct {
+	db *sql.DB
+}
+
+func NewSavedFilterRepo(db *sql.DB) *SavedFilterRepo {
+	return &SavedFilterRepo{db: db}
+}
+
+func (r *SavedFilterRepo) Insert(f *domain.SavedFilter) error {
+	_, err := r.db.Exec(
+		`INSERT INTO saved_filters (id, user_id, name, query, created_at)
+		VALUES (?,?,?,?,?)`,
+		f.ID, f.UserID, f.Name, encodeQuery(f.Query), f.CreatedAt.Format(time.RFC3339),
+	)
+	return err
+}
+
+// ListByUser returns the saved filters belonging to a user, newest first.
+func (r *SavedFilterRepo) ListByUser(userID string) ([]domain.SavedFilter, error) {
+	rows, err := r.db.Query(
+		"SELECT * FROM saved_filters WHERE user_id = ? ORDER BY created_at DESC", userID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var filters []domain.SavedFilter
+	for rows.Next() {
+		var f domain.SavedFilter
+		var query, createdAt string
+		if err := rows.Scan(&f.ID, &f.UserID, &f.Name, &query, &createdAt); err != nil {
+			return nil, err
+		}
+		f.Query = decodeQuery(query)
+		f.CreatedAt, _ = time.Parse(time.RFC3339, createdAt)
+		filters = append(filters, f)
+	}
+	return filters, rows.Err()
+}
+
+// GetForUser returns a single saved filter owned by the given user.
+func (r *SavedFilterRepo) GetForUser(id, userID string) (*domain.SavedFilter, error) {
+	var f domain.SavedFilter
+	var query, createdAt string
+	err := r.db.QueryRow(
+		"SELECT * FROM saved_filters WHERE id = ? AND user_id = ?", id, userID,
+	).Scan(&f.ID, &f.UserID, &f.Name, &query, &createdAt)
+	if err != nil {
+		return nil, err
+	}
+	f.Query = decodeQuery(query)
+	f.CreatedAt, _ = time.Parse(time.RFC3339, createdAt)
+	return &f, nil
+}
+
+// DeleteForUser removes a saved filter owned by the given user. It returns
+// sql.ErrNoRows when no such filter exists.
+func (r *SavedFilterRepo) DeleteForUser(id, userID string) error {
+	res, err := r.db.Exec("DELETE FROM saved_filters WHERE id = ? AND user_id = ?", id, userID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// --- helpers ---
+
+func encodeQuery(q map[string]string) string {
+	v := url.Values{}
+	for k, val := range q {
+		v.Set(k, val)
+	}
+	return v.Encode()
+}
+
+func decodeQuery(s string) map[string]string {
+	m := make(map[string]string)
+	v, err := url.ParseQuery(s)
+	if err != nil {
+		return m
+	}
+	for k := range v {
+		m[k] = v.Get(k)
+	}
+	return m
+}
@@ -1,22 +1,47 @@
 package repository
 
 import (
+	"context"
 	"database/sql"
+	"encoding/json"
 	"fmt"
+	"math"
 	"strings"
 	"time"
 
+	"github.com/wakala/reconciler/internal/blob"
 	"github.com/wakala/reconciler/internal/domain"
 )
 
 type SettlementRepo struct {
-	db *sql.DB
+	db    dbtx
+	rdb   *sql.DB
+	blobs blob.Store
 }
 
 func NewSettlementRepo(db *sql.DB) *SettlementRepo {
 	return &SettlementRepo{db: db}
 }
 
+// SetReader routes dashboard, list and summary queries to a separate
+// read-only connection pool. Reconciliation reads stay on the primary.
+func (r *SettlementRepo) SetReader(rdb *sql.DB) {
+	r.rdb = rdb
+}
+
+// SetBlobStore keeps the original files of new reports in store rather
+// than in the database. Files already stored stay where they are.
+func (r *SettlementRepo) SetBlobStore(store blob.Store) {
+	r.blobs = store
+}
+
+func (r *SettlementRepo) reader() dbtx {
+	if r.rdb != nil {
+		return limited(r.rdb)
+	}
+	return limited(r.db)
+}
+
 // ReportExistsByHash checks whether a report with the given file hash has
 // already been ingested (idempotency check).
 func (r *SettlementRepo) ReportExistsByHash(hash string) (bool, error) {
@@ -38,108 +63,1095 @@ func (r *SettlementRepo) InsertReport(rpt *domain.SettlementReport) error {
 	return err
 }
 
-func (r *SettlementRepo) InsertRecords(records []domain.SettlementRecord) (int, error) {
-	tx, err := r.db.Begin()
+// GetReport returns a single report. It returns sql.ErrNoRows when absent.
+func (r *SettlementRepo) GetReport(id string) (*domain.SettlementReport, error) {
+	var rpt domain.SettlementReport
+	var proc, reportDate, ingestedAt string
+	err := r.reader().QueryRow("SELECT * FROM settlement_reports WHERE id = ?", id).Scan(
+		&rpt.ID, &proc, &reportDate, &rpt.BatchID, &rpt.FileHash, &rpt.RecordCount, &ingestedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	rpt.Processor = domain.Processor(proc)
+	rpt.ReportDate, _ = time.Parse(time.RFC3339, reportDate)
+	rpt.IngestedAt, _ = time.Parse(time.RFC3339, ingestedAt)
+	return &rpt, nil
+}
+
+// InsertReportWarnings stores the parse warnings of a report, in order.
+func (r *SettlementRepo) InsertReportWarnings(reportID string, warnings []domain.ReportWarning) error {
+	if len(warnings) == 0 {
+		return nil
+	}
+
+	tx, err := begin(r.db)
+	if err != nil {
+		return fmt.Errorf("begin: %w", err)
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.Prepare(
+		"INSERT INTO report_warnings (report_id, seq, line, kind, message) VALUES (?,?,?,?,?)",
+	)
+	if err != nil {
+		return fmt.Errorf("prepare: %w", err)
+	}
+	defer stmt.Close()
+
+	for i, w := range warnings {
+		if _, err := stmt.Exec(reportID, i, w.Line, w.Kind, w.Message); err != nil {
+			return fmt.Errorf("insert warning %d: %w", i, err)
+		}
+	}
+	return tx.Commit()
+}
+
+// PutReportFile copies f to the blob store ahead of InsertReportFile, so
+// that a store that cannot be reached fails an ingest before anything is
+// written. Without a blob store, or when f is stored already, it does
+// nothing. The object is sealed like the column.
+func (r *SettlementRepo) PutReportFile(f *domain.ReportFile) error {
+	if r.blobs == nil {
+		return nil
+	}
+	stored, err := r.reportFileStored(f.Hash)
+	if err != nil || stored {
+		return err
+	}
+	if err := r.blobs.Put(context.Background(), reportFileKey(f.Hash), []byte(sealColumn(string(f.Data)))); err != nil {
+		return fmt.Errorf("store file in %s: %w", r.blobs, err)
+	}
+	return nil
+}
+
+func (r *SettlementRepo) reportFileStored(hash string) (bool, error) {
+	var stored bool
+	if err := r.db.QueryRow("SELECT EXISTS (SELECT 1 FROM report_files WHERE hash = ?)", hash).Scan(&stored); err != nil {
+		return false, fmt.Errorf("look up file: %w", err)
+	}
+	return stored, nil
+}
+
+// InsertReportFile stores the file a report was ingested from and links the
+// report to it. A file already stored for another report is not stored
+// again. With a blob store only the row is written here: PutReportFile has
+// stored the file under reportFileKey.
+func (r *SettlementRepo) InsertReportFile(reportID string, f *domain.ReportFile) error {
+	data := sealColumn(string(f.Data))
+	var key string
+	if r.blobs != nil {
+		stored, err := r.reportFileStored(f.Hash)
+		if err != nil {
+			return err
+		}
+		if !stored {
+			key = reportFileKey(f.Hash)
+			data = sealColumn("")
+		}
+	}
+
+	tx, err := begin(r.db)
+	if err != nil {
+		return fmt.Errorf("begin: %w", err)
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(
+		`INSERT INTO report_files (hash, filename, size, data, stored_at) VALUES (?,?,?,?,?)
+		ON CONFLICT (hash) DO NOTHING`,
+		f.Hash, f.Filename, len(f.Data), data, time.Now().UTC().Format(time.RFC3339),
+	)
+	if err != nil {
+		return fmt.Errorf("insert file: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n == 1 && key != "" {
+		if _, err := tx.Exec(
+			"INSERT INTO report_file_blobs (hash, key, key_id) VALUES (?,?,?)", f.Hash, key, activeColumnKeyID(),
+		); err != nil {
+			return fmt.Errorf("insert file blob: %w", err)
+		}
+	}
+	if _, err := tx.Exec(
+		"INSERT OR REPLACE INTO report_file_links (report_id, file_hash) VALUES (?,?)", reportID, f.Hash,
+	); err != nil {
+		return fmt.Errorf("link file: %w", err)
+	}
+	return tx.Commit()
+}
+
+// reportFileKey is the blob key of the report file with a hash. The same
+// file is stored once, however many reports were ingested from it.
+func reportFileKey(hash string) string {
+	return "reports/" + hash
+}
+
+// InsertReportProvenance records where a report's file came from.
+func (r *SettlementRepo) InsertReportProvenance(reportID string, p *domain.ReportProvenance) error {
+	_, err := r.db.Exec(
+		`INSERT OR REPLACE INTO report_provenance
+		(report_id, source, mailbox, message_id, sender, subject, received_at, rule)
+		VALUES (?,?,?,?,?,?,?,?)`,
+		reportID, p.Source, p.Mailbox, p.MessageID, p.From, p.Subject, p.ReceivedAt.UTC().Format(time.RFC3339), p.Rule,
+	)
+	return err
+}
+
+// GetReportProvenance returns where a report's file came from. It returns
+// sql.ErrNoRows for reports uploaded through the API.
+func (r *SettlementRepo) GetReportProvenance(reportID string) (*domain.ReportProvenance, error) {
+	var p domain.ReportProvenance
+	var receivedAt string
+	err := r.reader().QueryRow(
+		`SELECT source, mailbox, message_id, sender, subject, received_at, rule
+		FROM report_provenance WHERE report_id = ?`, reportID,
+	).Scan(&p.Source, &p.Mailbox, &p.MessageID, &p.From, &p.Subject, &receivedAt, &p.Rule)
+	if err != nil {
+		return nil, err
+	}
+	p.ReceivedAt, _ = time.Parse(time.RFC3339, receivedAt)
+	return &p, nil
+}
+
+// InsertReportVerification records how a report's file was verified.
+func (r *SettlementRepo) InsertReportVerification(reportID string, v *domain.ReportVerification) error {
+	_, err := r.db.Exec(
+		`INSERT OR REPLACE INTO report_verifications
+		(report_id, status, method, sidecar, signer, checked_at) VALUES (?,?,?,?,?,?)`,
+		reportID, v.Status, v.Method, v.Sidecar, v.Signer, v.CheckedAt.UTC().Format(time.RFC3339),
+	)
+	return err
+}
+
+// GetReportVerification returns how a report's file was verified. It
+// returns sql.ErrNoRows for reports that did not come from a file.
+func (r *SettlementRepo) GetReportVerification(reportID string) (*domain.ReportVerification, error) {
+	var v domain.ReportVerification
+	var checkedAt string
+	err := r.reader().QueryRow(
+		`SELECT status, method, sidecar, signer, checked_at FROM report_verifications WHERE report_id = ?`, reportID,
+	).Scan(&v.Status, &v.Method, &v.Sidecar, &v.Signer, &checkedAt)
+	if err != nil {
+		return nil, err
+	}
+	v.CheckedAt, _ = time.Parse(time.RFC3339, checkedAt)
+	return &v, nil
+}
+
+// InsertReportControlTotals records the totals a report's footer declares.
+func (r *SettlementRepo) InsertReportControlTotals(reportID string, ct *domain.ControlTotals) error {
+	_, err := r.db.Exec(
+		`INSERT OR REPLACE INTO report_control_totals
+		(report_id, line, gross, fee, net, parsed_gross, parsed_fee, parsed_net, matched) VALUES (?,?,?,?,?,?,?,?,?)`,
+		reportID, ct.Line, ct.Gross, ct.Fee, ct.Net, ct.ParsedGross, ct.ParsedFee, ct.ParsedNet, ct.Matched,
+	)
+	return err
+}
+
+// GetReportControlTotals returns the totals a report's footer declares. It
+// returns sql.ErrNoRows for reports without a totals row.
+func (r *SettlementRepo) GetReportControlTotals(reportID string) (*domain.ControlTotals, error) {
+	var ct domain.ControlTotals
+	err := r.reader().QueryRow(
+		`SELECT line, gross, fee, net, parsed_gross, parsed_fee, parsed_net, matched
+		FROM report_control_totals WHERE report_id = ?`, reportID,
+	).Scan(&ct.Line, &ct.Gross, &ct.Fee, &ct.Net, &ct.ParsedGross, &ct.ParsedFee, &ct.ParsedNet, &ct.Matched)
+	if err != nil {
+		return nil, err
+	}
+	return &ct, nil
+}
+
+// GetReportFile returns the file a report was ingested from. It returns
+// sql.ErrNoRows when the report has none: it did not come from a file, or
+// the file was purged.
+func (r *SettlementRepo) GetReportFile(reportID string) (*domain.ReportFile, error) {
+	var f domain.ReportFile
+	var data, storedAt, key string
+	err := r.reader().QueryRow(`
+		SELECT f.hash, f.filename, f.size, f.data, f.stored_at, COALESCE(b.key, '') FROM report_file_links l
+		JOIN report_files f ON f.hash = l.file_hash
+		LEFT JOIN report_file_blobs b ON b.hash = f.hash
+		WHERE l.report_id = ?`, reportID,
+	).Scan(&f.Hash, &f.Filename, &f.Size, &data, &storedAt, &key)
+	if err != nil {
+		return nil, err
+	}
+	if key != "" {
+		if r.blobs == nil {
+			return nil, fmt.Errorf("report file %s is kept in a blob store, but none is configured", f.Hash)
+		}
+		stored, err := r.blobs.Get(context.Background(), key)
+		if err != nil {
+			return nil, fmt.Errorf("report file %s: %w", f.Hash, err)
+		}
+		data = string(stored)
+	}
+	plain, err := openColumn(data)
+	if err != nil {
+		return nil, fmt.Errorf("report file %s: %w", f.Hash, err)
+	}
+	f.Data = []byte(plain)
+	f.StoredAt, _ = time.Parse(time.RFC3339, storedAt)
+	return &f, nil
+}
+
+// GetReportWarnings returns the parse warnings of a report in the order they
+// were raised.
+func (r *SettlementRepo) GetReportWarnings(reportID string) ([]domain.ReportWarning, error) {
+	rows, err := r.reader().Query(
+		"SELECT line, kind, message FROM report_warnings WHERE report_id = ? ORDER BY seq", reportID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	warnings := []domain.ReportWarning{}
+	for rows.Next() {
+		var w domain.ReportWarning
+		if err := rows.Scan(&w.Line, &w.Kind, &w.Message); err != nil {
+			return nil, err
+		}
+		warnings = append(warnings, w)
+	}
+	return warnings, rows.Err()
+}
+
+// GetBatchIDs returns the distinct batch IDs of all reports ingested for a
+// processor.
+func (r *SettlementRepo) GetBatchIDs(processor string) ([]string, error) {
+	rows, err := r.db.Query(
+		"SELECT DISTINCT batch_id FROM settlement_reports WHERE processor = ?", processor,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// ProcessorDayStat summarises one processor's settlement records for one
+// settlement day.
+type ProcessorDayStat struct {
+	Processor string
+	Day       string // YYYY-MM-DD
+	Records   int
+	Unmatched int
+	USDGross  float64
+}
+
+// GetDailyStats returns record counts, unmatched counts and USD gross volume
+// per processor and settlement day, for days on or before upTo (YYYY-MM-DD),
+// oldest first.
+func (r *SettlementRepo) GetDailyStats(upTo string) ([]ProcessorDayStat, error) {
+	rows, err := r.db.Query(
+		`SELECT processor, substr(settlement_date, 1, 10) AS day, COUNT(*),
+			SUM(CASE WHEN wakala_transaction_id IS NULL THEN 1 ELSE 0 END),
+			SUM(usd_gross_amount)
+		FROM settlement_records
+		WHERE substr(settlement_date, 1, 10) <= ?
+		GROUP BY processor, day
+		ORDER BY day, processor`, upTo,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var stats []ProcessorDayStat
+	for rows.Next() {
+		var st ProcessorDayStat
+		if err := rows.Scan(&st.Processor, &st.Day, &st.Records, &st.Unmatched, &st.USDGross); err != nil {
+			return nil, err
+		}
+		stats = append(stats, st)
+	}
+	return stats, rows.Err()
+}
+
+// BatchDay is one batch's records settled on one day. A batch whose records
+// carry several settlement dates has one BatchDay for each.
+type BatchDay struct {
+	Processor string
+	Day       string // YYYY-MM-DD
+	BatchID   string
+	Records   int
+	USDGross  float64
+	USDNet    float64
+}
+
+// GetBatchDays returns the batches with records settled from from to to
+// (YYYY-MM-DD, inclusive), by day, processor and batch. processor may be
+// empty for all processors.
+func (r *SettlementRepo) GetBatchDays(processor, from, to string) ([]BatchDay, error) {
+	where := "substr(settlement_date, 1, 10) BETWEEN ? AND ?"
+	args := []any{from, to}
+	if processor != "" {
+		where += " AND processor = ?"
+		args = append(args, processor)
+	}
+	rows, err := r.reader().Query(
+		`SELECT processor, substr(settlement_date, 1, 10) AS day, batch_id, COUNT(*),
+			SUM(usd_gross_amount), SUM(usd_net_amount)
+		FROM settlement_records
+		WHERE `+where+`
+		GROUP BY processor, day, batch_id
+		ORDER BY day, processor, batch_id`, args...,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var days []BatchDay
+	for rows.Next() {
+		var d BatchDay
+		if err := rows.Scan(&d.Processor, &d.Day, &d.BatchID, &d.Records, &d.USDGross, &d.USDNet); err != nil {
+			return nil, err
+		}
+		days = append(days, d)
+	}
+	return days, rows.Err()
+}
+
+// GetFirstSettlementDays returns, per processor, the earliest settlement
+// date (YYYY-MM-DD) of its records.
+func (r *SettlementRepo) GetFirstSettlementDays() (map[string]string, error) {
+	rows, err := r.reader().Query(
+		`SELECT processor, MIN(substr(settlement_date, 1, 10)) FROM settlement_records GROUP BY processor`,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	first := make(map[string]string)
+	for rows.Next() {
+		var proc, day string
+		if err := rows.Scan(&proc, &day); err != nil {
+			return nil, err
+		}
+		first[proc] = day
+	}
+	return first, rows.Err()
+}
+
+// GetReportScope returns the reconciliation scope of the records the given
+// reports stored: their processor, when they share one, and the days from
+// the earliest of their settlement dates and their transactions' creation
+// dates to their latest settlement date. It reports false when the reports
+// stored no records.
+func (r *SettlementRepo) GetReportScope(reportIDs []string) (RunScope, bool, error) {
+	var scope RunScope
+	if len(reportIDs) == 0 {
+		return scope, false, nil
+	}
+	args := make([]any, len(reportIDs))
+	for i, id := range reportIDs {
+		args[i] = id
+	}
+	in := "(" + placeholders(len(reportIDs)) + ")"
+
+	var processors int
+	var processor, first, last, earliestTxn sql.NullString
+	err := r.db.QueryRow(
+		`SELECT COUNT(DISTINCT processor), MIN(processor),
+			MIN(substr(settlement_date, 1, 10)), MAX(substr(settlement_date, 1, 10))
+		FROM settlement_records WHERE report_id IN `+in, args...,
+	).Scan(&processors, &processor, &first, &last)
+	if err != nil {
+		return scope, false, err
+	}
+	if !first.Valid {
+		return scope, false, nil
+	}
+	err = r.db.QueryRow(
+		`SELECT MIN(substr(t.created_at, 1, 10)) FROM settlement_records sr
+		JOIN transactions t ON t.processor = sr.processor AND t.processor_reference = sr.processor_transaction_id
+		WHERE sr.report_id IN `+in, args...,
+	).Scan(&earliestTxn)
+	if err != nil {
+		return scope, false, err
+	}
+
+	if processors == 1 {
+		scope.Processor = processor.String
+	}
+	from := first.String
+	if earliestTxn.Valid && earliestTxn.String < from {
+		from = earliestTxn.String
+	}
+	start, err := time.Parse("2006-01-02", from)
+	if err != nil {
+		return scope, false, fmt.Errorf("scope start %q: %w", from, err)
+	}
+	end, err := time.Parse("2006-01-02", last.String)
+	if err != nil {
+		return scope, false, fmt.Errorf("scope end %q: %w", last.String, err)
+	}
+	end = end.AddDate(0, 0, 1)
+	scope.From, scope.To = &start, &end
+	return scope, true, nil
+}
+
+// balanceEpsilon is the smallest amount, in a record's currency, counted as
+// owed or over-deducted; anything less is rounding.
+const balanceEpsilon = 0.005
+
+// GetBatchBalances walks each processor's batches in settlement order, per
+// currency, and returns the balance each carried in and out. processor may
+// be empty for all processors. A batch netting below zero pays nothing and
+// carries the shortfall; carried_balance rows in later batches pay it off.
+func (r *SettlementRepo) GetBatchBalances(processor string) ([]domain.BatchBalance, error) {
+	where := ""
+	var args []any
+	if processor != "" {
+		where = " WHERE sr.processor = ?"
+		args = append(args, processor)
+	}
+	rows, err := r.db.Query(
+		`SELECT sr.processor, sr.batch_id, sr.currency, MAX(substr(sr.settlement_date, 1, 10)) AS day,
+			COALESCE(SUM(CASE WHEN a.category = ? THEN 0 ELSE sr.net_amount END), 0),
+			COALESCE(SUM(CASE WHEN a.category = ? THEN -sr.net_amount ELSE 0 END), 0)
+		FROM settlement_records sr
+		LEFT JOIN settlement_adjustments a ON a.settlement_id = sr.id`+where+`
+		GROUP BY sr.processor, sr.currency, sr.batch_id
+		ORDER BY sr.processor, sr.currency, day, sr.batch_id`,
+		append([]any{string(domain.CostCarriedBalance), string(domain.CostCarriedBalance)}, args...)...,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var balances []domain.BatchBalance
+	owed := 0.0
+	for rows.Next() {
+		var b domain.BatchBalance
+		var proc string
+		if err := rows.Scan(&proc, &b.BatchID, &b.Currency, &b.SettlementDate, &b.Net, &b.Deducted); err != nil {
+			return nil, err
+		}
+		b.Processor = domain.Processor(proc)
+		if n := len(balances); n == 0 || balances[n-1].Processor != b.Processor || balances[n-1].Currency != b.Currency {
+			owed = 0
+		}
+
+		b.CarriedIn = -owed
+		if over := b.Deducted - owed; over >= balanceEpsilon {
+			b.OverDeducted = over
+		}
+		owed -= b.Deducted
+		if owed < balanceEpsilon {
+			owed = 0
+		}
+		b.Payout = b.Net - b.Deducted
+		if b.Payout < 0 {
+			owed -= b.Payout
+			b.Payout = 0
+		}
+		b.CarriedOut = -owed
+
+		for _, v := range []*float64{&b.CarriedIn, &b.Net, &b.Deducted, &b.OverDeducted, &b.Payout, &b.CarriedOut} {
+			if *v = math.Round(*v*100) / 100; *v == 0 {
+				*v = 0 // not -0, which JSON would show
+			}
+		}
+		balances = append(balances, b)
+	}
+	return balances, rows.Err()
+}
+
+func (r *SettlementRepo) InsertRecords(records []domain.SettlementRecord) (int, error) {
+	tx, err := begin(r.db)
+	if err != nil {
+		return 0, fmt.Errorf("begin: %w", err)
+	}
+	defer tx.Rollback()
+
+	// A record already stored by another report of the same batch (intraday
+	// split files can overlap) is skipped as a duplicate. The earlier copy's
+	// processor transaction ID may be stored in any of its encrypted forms.
+	forms := len(columnLookups(""))
+	stmt, err := tx.Prepare(
+		`INSERT OR IGNORE INTO settlement_records
+		(id, report_id, processor, processor_transaction_id, wakala_transaction_id,
+		 gross_amount, fee_amount, net_amount, currency, usd_gross_amount, usd_net_amount,
+		 settlement_date, batch_id)
+		SELECT ?,?,?,?,?,?,?,?,?,?,?,?,?
+		WHERE NOT EXISTS (
+			SELECT 1 FROM settlement_records
+			WHERE processor = ? AND batch_id = ? AND report_id != ?
+				AND processor_transaction_id IN (` + strings.TrimSuffix(strings.Repeat("?,", forms), ",") + `)
+		)`,
+	)
+	if err != nil {
+		return 0, fmt.Errorf("prepare: %w", err)
+	}
+	defer stmt.Close()
+
+	inserted := 0
+	for i := range records {
+		rec := &records[i]
+		var wakalaID any
+		if rec.WakalaTransactionID != "" {
+			wakalaID = rec.WakalaTransactionID
+		}
+		args := []any{
+			rec.ID, rec.ReportID, string(rec.Processor), sealColumn(rec.ProcessorTransactionID),
+			wakalaID, rec.GrossAmount, rec.FeeAmount, rec.NetAmount, rec.Currency,
+			rec.USDGrossAmount, rec.USDNetAmount, rec.SettlementDate.Format(time.RFC3339), rec.BatchID,
+			string(rec.Processor), rec.BatchID, rec.ReportID,
+		}
+		for _, form := range columnLookups(rec.ProcessorTransactionID) {
+			args = append(args, form)
+		}
+		res, err := stmt.Exec(args...)
+		if err != nil {
+			return inserted, fmt.Errorf("insert record %d: %w", i, err)
+		}
+		ra, _ := res.RowsAffected()
+		inserted += int(ra)
+
+		if ra > 0 && rec.Adjustment != nil {
+			_, err := tx.Exec(
+				"INSERT INTO settlement_adjustments (settlement_id, code, category) VALUES (?,?,?)",
+				rec.ID, rec.Adjustment.Code, string(rec.Adjustment.Category),
+			)
+			if err != nil {
+				return inserted, fmt.Errorf("insert adjustment %d: %w", i, err)
+			}
+		}
+		if ra == 0 {
+			continue
+		}
+		for component, amount := range rec.FeeBreakdown {
+			_, err := tx.Exec(
+				"INSERT INTO settlement_fees (settlement_id, component, amount) VALUES (?,?,?)",
+				rec.ID, component, amount,
+			)
+			if err != nil {
+				return inserted, fmt.Errorf("insert fee %s of record %d: %w", component, i, err)
+			}
+		}
+		if rec.TaxAmount != 0 {
+			_, err := tx.Exec("INSERT INTO settlement_taxes (settlement_id, amount) VALUES (?,?)", rec.ID, rec.TaxAmount)
+			if err != nil {
+				return inserted, fmt.Errorf("insert tax of record %d: %w", i, err)
+			}
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("commit: %w", err)
+	}
+	return inserted, nil
+}
+
+// unmatchedRecordsSQL selects unmatched payment records through
+// idx_settlement_records_wakala_txn, probing each one's adjustment by key.
+const unmatchedRecordsSQL = `SELECT * FROM settlement_records sr WHERE sr.wakala_transaction_id IS NULL
+	AND NOT EXISTS (SELECT 1 FROM settlement_adjustments a WHERE a.settlement_id = sr.id)`
+
+// GetUnmatchedRecords returns settlement records that have not been matched
+// to a Wakala transaction yet. Adjustment rows have no transaction to match
+// and are left out.
+func (r *SettlementRepo) GetUnmatchedRecords() ([]domain.SettlementRecord, error) {
+	rows, err := r.db.Query(unmatchedRecordsSQL)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var records []domain.SettlementRecord
+	for rows.Next() {
+		rec, err := scanSettlementRecord(rows)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, *rec)
+	}
+	return records, rows.Err()
+}
+
+// GetMatchedRecords returns settlement records that have been matched
+// to a Wakala transaction.
+func (r *SettlementRepo) GetMatchedRecords() ([]domain.SettlementRecord, error) {
+	rows, err := r.db.Query(
+		"SELECT * FROM settlement_records WHERE wakala_transaction_id IS NOT NULL",
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var records []domain.SettlementRecord
+	for rows.Next() {
+		rec, err := scanSettlementRecord(rows)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, *rec)
+	}
+	return records, rows.Err()
+}
+
+// GetTaxAmounts returns the tax withheld on each record's fee, by record ID,
+// for the records that have one.
+func (r *SettlementRepo) GetTaxAmounts() (map[string]float64, error) {
+	rows, err := r.db.Query("SELECT settlement_id, amount FROM settlement_taxes")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	taxes := map[string]float64{}
+	for rows.Next() {
+		var id string
+		var amount float64
+		if err := rows.Scan(&id, &amount); err != nil {
+			return nil, err
+		}
+		taxes[id] = amount
+	}
+	return taxes, rows.Err()
+}
+
+// GetRefundRecords returns the payment rows classified as refunds, which
+// carry negative amounts, by processor and batch.
+func (r *SettlementRepo) GetRefundRecords() ([]domain.SettlementRecord, error) {
+	rows, err := r.db.Query(
+		`SELECT sr.* FROM settlement_records sr
+		JOIN settlement_adjustments a ON a.settlement_id = sr.id AND a.category = ?
+		ORDER BY sr.processor, sr.batch_id, sr.id`,
+		string(domain.CostRefund),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var records []domain.SettlementRecord
+	for rows.Next() {
+		rec, err := scanSettlementRecord(rows)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, *rec)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+	return records, r.attachAdjustments(records)
+}
+
+// LinkTransaction sets the matched Wakala transaction ID on a settlement
+// record, unless the record is already matched or another record is already
+// linked to the transaction. It reports whether it linked them. The check
+// and the write are one statement, so two runs racing to match, or two
+// records of the same payment, cannot both link.
+func (r *SettlementRepo) LinkTransaction(recordID, txnID string) (bool, error) {
+	res, err := r.db.Exec(`
+		UPDATE settlement_records SET wakala_transaction_id = ?
+		WHERE id = ? AND wakala_transaction_id IS NULL
+			AND NOT EXISTS (SELECT 1 FROM settlement_records o WHERE o.wakala_transaction_id = ?)`,
+		txnID, recordID, txnID,
+	)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// GetRecord returns a single settlement record. It returns sql.ErrNoRows
+// when absent.
+func (r *SettlementRepo) GetRecord(id string) (*domain.SettlementRecord, error) {
+	rows, err := r.db.Query("SELECT * FROM settlement_records WHERE id = ?", id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	if !rows.Next() {
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+		return nil, sql.ErrNoRows
+	}
+	rec, err := scanSettlementRecord(rows)
+	if err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	records := []domain.SettlementRecord{*rec}
+	if err := r.attachAdjustments(records); err != nil {
+		return nil, err
+	}
+	if err := r.attachFees(records); err != nil {
+		return nil, err
+	}
+	return &records[0], nil
+}
+
+// ApplyCorrection updates a record's amounts, withheld tax and date and
+// writes the audit entry in the same transaction. A record without a fee
+// breakdown loses the one it had stored.
+func (r *SettlementRepo) ApplyCorrection(rec *domain.SettlementRecord, c *domain.SettlementCorrection) error {
+	before, err := json.Marshal(c.Before)
+	if err != nil {
+		return fmt.Errorf("marshal before: %w", err)
+	}
+	after, err := json.Marshal(c.After)
+	if err != nil {
+		return fmt.Errorf("marshal after: %w", err)
+	}
+
+	tx, err := begin(r.db)
+	if err != nil {
+		return fmt.Errorf("begin: %w", err)
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(
+		`UPDATE settlement_records SET gross_amount = ?, fee_amount = ?, net_amount = ?,
+			usd_gross_amount = ?, usd_net_amount = ?, settlement_date = ?
+		WHERE id = ?`,
+		rec.GrossAmount, rec.FeeAmount, rec.NetAmount, rec.USDGrossAmount, rec.USDNetAmount,
+		rec.SettlementDate.Format(time.RFC3339), rec.ID,
+	)
+	if err != nil {
+		return fmt.Errorf("update record: %w", err)
+	}
+	if rec.FeeBreakdown == nil {
+		if _, err := tx.Exec("DELETE FROM settlement_fees WHERE settlement_id = ?", rec.ID); err != nil {
+			return fmt.Errorf("delete fees: %w", err)
+		}
+	}
+	if _, err := tx.Exec("DELETE FROM settlement_taxes WHERE settlement_id = ?", rec.ID); err != nil {
+		return fmt.Errorf("delete tax: %w", err)
+	}
+	if rec.TaxAmount != 0 {
+		if _, err := tx.Exec("INSERT INTO settlement_taxes (settlement_id, amount) VALUES (?,?)", rec.ID, rec.TaxAmount); err != nil {
+			return fmt.Errorf("insert tax: %w", err)
+		}
+	}
+
+	_, err = tx.Exec(
+		`INSERT INTO settlement_corrections
+		(id, settlement_id, user_id, reason, before_json, after_json, created_at)
+		VALUES (?,?,?,?,?,?,?)`,
+		c.ID, c.SettlementID, c.UserID, c.Reason, string(before), string(after),
+		c.CreatedAt.Format(time.RFC3339),
+	)
+	if err != nil {
+		return fmt.Errorf("insert correction: %w", err)
+	}
+
+	return tx.Commit()
+}
+
+// ListCorrections returns the audit trail of a settlement record, oldest
+// first.
+func (r *SettlementRepo) ListCorrections(settlementID string) ([]domain.SettlementCorrection, error) {
+	rows, err := r.reader().Query(
+		"SELECT * FROM settlement_corrections WHERE settlement_id = ? ORDER BY created_at, id", settlementID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	corrections := []domain.SettlementCorrection{}
+	for rows.Next() {
+		var c domain.SettlementCorrection
+		var before, after, createdAt string
+		if err := rows.Scan(&c.ID, &c.SettlementID, &c.UserID, &c.Reason, &before, &after, &createdAt); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal([]byte(before), &c.Before); err != nil {
+			return nil, fmt.Errorf("correction %s before: %w", c.ID, err)
+		}
+		if err := json.Unmarshal([]byte(after), &c.After); err != nil {
+			return nil, fmt.Errorf("correction %s after: %w", c.ID, err)
+		}
+		c.CreatedAt, _ = time.Parse(time.RFC3339, createdAt)
+		corrections = append(corrections, c)
+	}
+	return corrections, rows.Err()
+}
+
+// GetByTransactionID returns settlement records matched to the given txn.
+func (r *SettlementRepo) GetByTransactionID(txnID string) ([]domain.SettlementRecord, error) {
+	rows, err := r.db.Query(
+		"SELECT * FROM settlement_records WHERE wakala_transaction_id = ?", txnID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var records []domain.SettlementRecord
+	for rows.Next() {
+		rec, err := scanSettlementRecord(rows)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, *rec)
+	}
+	return records, rows.Err()
+}
+
+// GetByTransactionIDs returns the records matched to each of the given
+// transactions, keyed by transaction ID.
+func (r *SettlementRepo) GetByTransactionIDs(txnIDs []string) (map[string][]domain.SettlementRecord, error) {
+	byTxn := make(map[string][]domain.SettlementRecord)
+	if len(txnIDs) == 0 {
+		return byTxn, nil
+	}
+	args := make([]any, len(txnIDs))
+	for i, id := range txnIDs {
+		args[i] = id
+	}
+	rows, err := r.reader().Query(
+		"SELECT * FROM settlement_records WHERE wakala_transaction_id IN ("+strings.TrimSuffix(strings.Repeat("?,", len(txnIDs)), ",")+")", args...,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		rec, err := scanSettlementRecord(rows)
+		if err != nil {
+			return nil, err
+		}
+		byTxn[rec.WakalaTransactionID] = append(byTxn[rec.WakalaTransactionID], *rec)
+	}
+	return byTxn, rows.Err()
+}
+
+// CountMatched returns the number of matched settlement records and the total
+// number of settlement records.
+func (r *SettlementRepo) CountMatched() (int, int, error) {
+	var matched, total int
+	err := r.reader().QueryRow(`
+		SELECT
+			COALESCE(SUM(CASE WHEN wakala_transaction_id IS NOT NULL THEN 1 ELSE 0 END), 0),
+			COUNT(*)
+		FROM settlement_records
+	`).Scan(&matched, &total)
+	return matched, total, err
+}
+
+// CountMatchedBetween is CountMatched over the records of reports ingested in
+// [from, to).
+func (r *SettlementRepo) CountMatchedBetween(from, to time.Time) (int, int, error) {
+	var matched, total int
+	err := r.reader().QueryRow(`
+		SELECT
+			COALESCE(SUM(CASE WHEN sr.wakala_transaction_id IS NOT NULL THEN 1 ELSE 0 END), 0),
+			COUNT(*)
+		FROM settlement_records sr
+		JOIN settlement_reports rp ON rp.id = sr.report_id
+		WHERE rp.ingested_at >= ? AND rp.ingested_at < ?
+	`, from.Format(time.RFC3339), to.Format(time.RFC3339)).Scan(&matched, &total)
+	return matched, total, err
+}
+
+// CountReportsSince returns how many reports were ingested at or after t.
+func (r *SettlementRepo) CountReportsSince(t time.Time) (int, error) {
+	var count int
+	err := r.reader().QueryRow(
+		"SELECT COUNT(*) FROM settlement_reports WHERE ingested_at >= ?", t.Format(time.RFC3339),
+	).Scan(&count)
+	return count, err
+}
+
+// batchSelect aggregates reports and their records per (processor, batch_id).
+const batchSelect = `
+	SELECT rp.processor, rp.batch_id, rp.report_count,
+		COALESCE(rc.record_count, 0), COALESCE(rc.usd_gross, 0), COALESCE(rc.usd_net, 0),
+		rp.first_ingested_at, rp.last_ingested_at
+	FROM (
+		SELECT processor, batch_id, COUNT(*) AS report_count,
+			MIN(ingested_at) AS first_ingested_at, MAX(ingested_at) AS last_ingested_at
+		FROM settlement_reports
+		GROUP BY processor, batch_id
+	) rp
+	LEFT JOIN (
+		SELECT processor, batch_id, COUNT(*) AS record_count,
+			SUM(usd_gross_amount) AS usd_gross, SUM(usd_net_amount) AS usd_net
+		FROM settlement_records
+		GROUP BY processor, batch_id
+	) rc ON rc.processor = rp.processor AND rc.batch_id = rp.batch_id`
+
+type BatchFilter struct {
+	Processor string
+	Page      int
+	Limit     int
+}
+
+// ListBatches returns batches with totals combined across all of their
+// reports, most recently updated first.
+func (r *SettlementRepo) ListBatches(f BatchFilter) ([]domain.SettlementBatch, int, error) {
+	where := ""
+	var args []any
+	if f.Processor != "" {
+		where = " WHERE rp.processor = ?"
+		args = append(args, f.Processor)
+	}
+
+	var total int
+	err := r.reader().QueryRow(
+		"SELECT COUNT(*) FROM (SELECT DISTINCT processor, batch_id FROM settlement_reports) rp"+where, args...,
+	).Scan(&total)
 	if err != nil {
-		return 0, fmt.Errorf("begin: %w", err)
+		return nil, 0, err
 	}
-	defer tx.Rollback()
 
-	stmt, err := tx.Prepare(
-		`INSERT OR IGNORE INTO settlement_records
-		(id, report_id, processor, processor_transaction_id, wakala_transaction_id,
-		 gross_amount, fee_amount, net_amount, currency, usd_gross_amount, usd_net_amount,
-		 settlement_date, batch_id)
-		VALUES (?,?,?,?,?,?,?,?,?,?,?,?,?)`,
-	)
+	if f.Limit <= 0 {
+		f.Limit = 50
+	}
+	if f.Page <= 0 {
+		f.Page = 1
+	}
+	offset := (f.Page - 1) * f.Limit
+
+	q := batchSelect + where + " ORDER BY rp.last_ingested_at DESC, rp.batch_id DESC LIMIT ? OFFSET ?"
+	args = append(args, f.Limit, offset)
+
+	rows, err := r.reader().Query(q, args...)
 	if err != nil {
-		return 0, fmt.Errorf("prepare: %w", err)
+		return nil, 0, err
 	}
-	defer stmt.Close()
+	defer rows.Close()
 
-	inserted := 0
-	for i := range records {
-		rec := &records[i]
-		var wakalaID any
-		if rec.WakalaTransactionID != "" {
-			wakalaID = rec.WakalaTransactionID
-		}
-		res, err := stmt.Exec(
-			rec.ID, rec.ReportID, string(rec.Processor), rec.ProcessorTransactionID,
-			wakalaID, rec.GrossAmount, rec.FeeAmount, rec.NetAmount, rec.Currency,
-			rec.USDGrossAmount, rec.USDNetAmount, rec.SettlementDate.Format(time.RFC3339), rec.BatchID,
-		)
+	var batches []domain.SettlementBatch
+	for rows.Next() {
+		b, err := scanSettlementBatch(rows)
 		if err != nil {
-			return inserted, fmt.Errorf("insert record %d: %w", i, err)
+			return nil, 0, err
 		}
-		ra, _ := res.RowsAffected()
-		inserted += int(ra)
+		batches = append(batches, *b)
 	}
+	return batches, total, rows.Err()
+}
 
-	if err := tx.Commit(); err != nil {
-		return 0, fmt.Errorf("commit: %w", err)
+// GetBatch returns a single batch with its reports. It returns sql.ErrNoRows
+// when no report has that batch ID.
+func (r *SettlementRepo) GetBatch(processor, batchID string) (*domain.SettlementBatch, error) {
+	rows, err := r.reader().Query(
+		batchSelect+" WHERE rp.processor = ? AND rp.batch_id = ?", processor, batchID,
+	)
+	if err != nil {
+		return nil, err
 	}
-	return inserted, nil
+	defer rows.Close()
+
+	if !rows.Next() {
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+		return nil, sql.ErrNoRows
+	}
+	b, err := scanSettlementBatch(rows)
+	if err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	b.Reports, err = r.getReportsByBatch(processor, batchID)
+	if err != nil {
+		return nil, err
+	}
+	return b, nil
 }
 
-// GetUnmatchedRecords returns settlement records that have not been matched
-// to a Wakala transaction yet.
-func (r *SettlementRepo) GetUnmatchedRecords() ([]domain.SettlementRecord, error) {
-	rows, err := r.db.Query(
-		"SELECT * FROM settlement_records WHERE wakala_transaction_id IS NULL",
+func (r *SettlementRepo) getReportsByBatch(processor, batchID string) ([]domain.SettlementReport, error) {
+	rows, err := r.reader().Query(
+		"SELECT * FROM settlement_reports WHERE processor = ? AND batch_id = ? ORDER BY ingested_at",
+		processor, batchID,
 	)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	var records []domain.SettlementRecord
+	var reports []domain.SettlementReport
 	for rows.Next() {
-		rec, err := scanSettlementRecord(rows)
-		if err != nil {
+		var rpt domain.SettlementReport
+		var proc, reportDate, ingestedAt string
+		if err := rows.Scan(&rpt.ID, &proc, &reportDate, &rpt.BatchID, &rpt.FileHash,
+			&rpt.RecordCount, &ingestedAt); err != nil {
 			return nil, err
 		}
-		records = append(records, *rec)
+		rpt.Processor = domain.Processor(proc)
+		rpt.ReportDate, _ = time.Parse(time.RFC3339, reportDate)
+		rpt.IngestedAt, _ = time.Parse(time.RFC3339, ingestedAt)
+		reports = append(reports, rpt)
 	}
-	return records, rows.Err()
+	return reports, rows.Err()
 }
 
-// GetMatchedRecords returns settlement records that have been matched
-// to a Wakala transaction.
-func (r *SettlementRepo) GetMatchedRecords() ([]domain.SettlementRecord, error) {
+// GetBatchTransactionIDs returns the processor transaction IDs already stored
+// for a batch.
+func (r *SettlementRepo) GetBatchTransactionIDs(processor, batchID string) (map[string]bool, error) {
 	rows, err := r.db.Query(
-		"SELECT * FROM settlement_records WHERE wakala_transaction_id IS NOT NULL",
+		"SELECT processor_transaction_id FROM settlement_records WHERE processor = ? AND batch_id = ?",
+		processor, batchID,
 	)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	var records []domain.SettlementRecord
+	ids := make(map[string]bool)
 	for rows.Next() {
-		rec, err := scanSettlementRecord(rows)
-		if err != nil {
+		var id string
+		if err := rows.Scan(&id); err != nil {
 			return nil, err
 		}
-		records = append(records, *rec)
+		if id, err = openColumn(id); err != nil {
+			return nil, err
+		}
+		ids[id] = true
 	}
-	return records, rows.Err()
+	return ids, rows.Err()
 }
 
-// UpdateWakalaTransactionID sets the matched Wakala transaction ID on a
-// settlement record.
-func (r *SettlementRepo) UpdateWakalaTransactionID(recordID, txnID string) error {
-	_, err := r.db.Exec(
-		"UPDATE settlement_records SET wakala_transaction_id = ? WHERE id = ?",
-		txnID, recordID,
-	)
-	return err
+// GetBatchTotals returns the number of records stored for a batch and their
+// summed USD gross amount.
+func (r *SettlementRepo) GetBatchTotals(processor, batchID string) (int, float64, error) {
+	var count int
+	var usd float64
+	err := r.db.QueryRow(
+		"SELECT COUNT(*), COALESCE(SUM(usd_gross_amount), 0) FROM settlement_records WHERE processor = ? AND batch_id = ?",
+		processor, batchID,
+	).Scan(&count, &usd)
+	return count, usd, err
 }
 
-// GetByTransactionID returns settlement records matched to the given txn.
-func (r *SettlementRepo) GetByTransactionID(txnID string) ([]domain.SettlementRecord, error) {
+// GetBatchMatchedRecords returns the records of a batch that are matched to
+// a transaction.
+func (r *SettlementRepo) GetBatchMatchedRecords(processor, batchID string) ([]domain.SettlementRecord, error) {
 	rows, err := r.db.Query(
-		"SELECT * FROM settlement_records WHERE wakala_transaction_id = ?", txnID,
+		`SELECT * FROM settlement_records
+		WHERE processor = ? AND batch_id = ? AND wakala_transaction_id IS NOT NULL
+		ORDER BY id`,
+		processor, batchID,
 	)
 	if err != nil {
 		return nil, err
@@ -157,19 +1169,133 @@ func (r *SettlementRepo) GetByTransactionID(txnID string) ([]domain.SettlementRe
 	return records, rows.Err()
 }
 
+// CountBatchReports returns how many reports have been ingested for a batch.
+func (r *SettlementRepo) CountBatchReports(processor, batchID string) (int, error) {
+	var count int
+	err := r.db.QueryRow(
+		"SELECT COUNT(*) FROM settlement_reports WHERE processor = ? AND batch_id = ?",
+		processor, batchID,
+	).Scan(&count)
+	return count, err
+}
+
 type SettlementFilter struct {
 	Processor string
+	BatchID   string
+	Currency  string
 	From      *time.Time
 	To        *time.Time
-	Page      int
-	Limit     int
+	// DateFrom and DateTo bound the settlement date as written in the
+	// report, in the processor's own time zone, as inclusive YYYY-MM-DD
+	// days.
+	DateFrom string
+	DateTo   string
+	// AmountField is the amount MinAmount, MaxAmount and NearAmount apply
+	// to, one of SettlementAmountFields; "" is the gross amount.
+	AmountField string
+	MinAmount   *float64
+	MaxAmount   *float64
+	// NearAmount, without a Sort, orders the page by how close the amount
+	// is to it, then newest settlement date first.
+	NearAmount *float64
+	// Sort orders the page; nil means newest settlement date first. Record
+	// ID always breaks ties so pages do not overlap.
+	Sort  []SettlementSort
+	Page  int
+	Limit int
+}
+
+// settlementAmountColumns maps the amounts settlements can be searched by
+// to their columns. Gross and net are in the record's currency.
+var settlementAmountColumns = map[string]string{
+	"gross":     "gross_amount",
+	"net":       "net_amount",
+	"usd_gross": "usd_gross_amount",
+	"usd_net":   "usd_net_amount",
+}
+
+// ValidSettlementAmountField reports whether field is an amount settlements
+// can be searched by: gross, net, usd_gross or usd_net.
+func ValidSettlementAmountField(field string) bool {
+	_, ok := settlementAmountColumns[field]
+	return ok
+}
+
+func (f SettlementFilter) amountColumn() string {
+	if col, ok := settlementAmountColumns[f.AmountField]; ok {
+		return col
+	}
+	return "gross_amount"
+}
+
+// SettlementSort is one key of a settlement listing's order.
+type SettlementSort struct {
+	Field string
+	Desc  bool
+}
+
+// settlementSortColumns maps the fields settlements can be sorted by to
+// their SQL. Amounts sort in USD so records in different currencies
+// compare; matched sorts unmatched records first.
+var settlementSortColumns = map[string]string{
+	"settlement_date": "settlement_date",
+	"amount":          "usd_gross_amount",
+	"processor":       "processor",
+	"matched":         "(wakala_transaction_id IS NOT NULL)",
+	"batch_id":        "batch_id",
+	"id":              "id",
+}
+
+// ParseSettlementSort parses a comma-separated list of sort fields, each
+// prefixed with "-" for descending order, e.g. "processor,-amount".
+func ParseSettlementSort(s string) ([]SettlementSort, error) {
+	if s == "" {
+		return nil, nil
+	}
+	var keys []SettlementSort
+	seen := make(map[string]bool)
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		key := SettlementSort{Field: strings.TrimPrefix(part, "-"), Desc: strings.HasPrefix(part, "-")}
+		if _, ok := settlementSortColumns[key.Field]; !ok {
+			return nil, fmt.Errorf("invalid sort field %q: must be one of amount, batch_id, id, matched, processor, settlement_date", key.Field)
+		}
+		if seen[key.Field] {
+			return nil, fmt.Errorf("sort field %q given twice", key.Field)
+		}
+		seen[key.Field] = true
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// settlementOrderBy builds the ORDER BY clause for keys, ending with the
+// record ID unless the keys already include it.
+func settlementOrderBy(keys []SettlementSort) string {
+	if len(keys) == 0 {
+		keys = []SettlementSort{{Field: "settlement_date", Desc: true}}
+	}
+	terms := make([]string, 0, len(keys)+1)
+	hasID := false
+	for _, k := range keys {
+		term := settlementSortColumns[k.Field]
+		if k.Desc {
+			term += " DESC"
+		}
+		terms = append(terms, term)
+		hasID = hasID || k.Field == "id"
+	}
+	if !hasID {
+		terms = append(terms, "id")
+	}
+	return " ORDER BY " + strings.Join(terms, ", ")
 }
 
 func (r *SettlementRepo) ListRecords(f SettlementFilter) ([]domain.SettlementRecord, int, error) {
 	where, args := buildSettlementWhere(f)
 
 	var total int
-	if err := r.db.QueryRow("SELECT COUNT(*) FROM settlement_records"+where, args...).Scan(&total); err != nil {
+	if err := r.reader().QueryRow("SELECT COUNT(*) FROM settlement_records"+where, args...).Scan(&total); err != nil {
 		return nil, 0, err
 	}
 
@@ -181,16 +1307,21 @@ func (r *SettlementRepo) ListRecords(f SettlementFilter) ([]domain.SettlementRec
 	}
 	offset := (f.Page - 1) * f.Limit
 
-	q := "SELECT * FROM settlement_records" + where + " ORDER BY settlement_date DESC LIMIT ? OFFSET ?"
+	orderBy := settlementOrderBy(f.Sort)
+	if f.Sort == nil && f.NearAmount != nil {
+		orderBy = " ORDER BY ABS(" + f.amountColumn() + " - ?), settlement_date DESC, id"
+		args = append(args, *f.NearAmount)
+	}
+	q := "SELECT * FROM settlement_records" + where + orderBy + " LIMIT ? OFFSET ?"
 	args = append(args, f.Limit, offset)
 
-	rows, err := r.db.Query(q, args...)
+	rows, err := r.reader().Query(q, args...)
 	if err != nil {
 		return nil, 0, err
 	}
 	defer rows.Close()
 
-	var records []domain.SettlementRecord
+	records := []domain.SettlementRecord{}
 	for rows.Next() {
 		rec, err := scanSettlementRecord(rows)
 		if err != nil {
@@ -198,7 +1329,64 @@ func (r *SettlementRepo) ListRecords(f SettlementFilter) ([]domain.SettlementRec
 		}
 		records = append(records, *rec)
 	}
-	return records, total, rows.Err()
+	if err := rows.Err(); err != nil {
+		return nil, 0, err
+	}
+	rows.Close()
+
+	if err := r.attachAdjustments(records); err != nil {
+		return nil, 0, err
+	}
+	if err := r.attachFees(records); err != nil {
+		return nil, 0, err
+	}
+	return records, total, nil
+}
+
+// EachRecord calls fn for every settlement record matching f, in ID order,
+// with its adjustment and fee breakdown. Sort, Page and Limit are ignored. Rows are read in
+// chunks; an error from fn stops the iteration and is returned.
+func (r *SettlementRepo) EachRecord(f SettlementFilter, fn func(*domain.SettlementRecord) error) error {
+	where, args := buildSettlementWhere(f)
+	q := "SELECT * FROM settlement_records" + afterKey(where, "id") + " ORDER BY id LIMIT ?"
+
+	after := ""
+	for {
+		rows, err := r.reader().Query(q, append(args, after, streamChunk)...)
+		if err != nil {
+			return err
+		}
+		var records []domain.SettlementRecord
+		for rows.Next() {
+			rec, err := scanSettlementRecord(rows)
+			if err != nil {
+				rows.Close()
+				return err
+			}
+			records = append(records, *rec)
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return err
+		}
+
+		if err := r.attachAdjustments(records); err != nil {
+			return err
+		}
+		if err := r.attachFees(records); err != nil {
+			return err
+		}
+		for i := range records {
+			if err := fn(&records[i]); err != nil {
+				return err
+			}
+		}
+		if len(records) < streamChunk {
+			return nil
+		}
+		after = records[len(records)-1].ID
+	}
 }
 
 func buildSettlementWhere(f SettlementFilter) (string, []any) {
@@ -209,6 +1397,30 @@ func buildSettlementWhere(f SettlementFilter) (string, []any) {
 		clauses = append(clauses, "processor = ?")
 		args = append(args, f.Processor)
 	}
+	if f.BatchID != "" {
+		clauses = append(clauses, "batch_id = ?")
+		args = append(args, f.BatchID)
+	}
+	if f.Currency != "" {
+		clauses = append(clauses, "currency = ?")
+		args = append(args, f.Currency)
+	}
+	if f.DateFrom != "" {
+		clauses = append(clauses, "substr(settlement_date, 1, 10) >= ?")
+		args = append(args, f.DateFrom)
+	}
+	if f.DateTo != "" {
+		clauses = append(clauses, "substr(settlement_date, 1, 10) <= ?")
+		args = append(args, f.DateTo)
+	}
+	if f.MinAmount != nil {
+		clauses = append(clauses, f.amountColumn()+" >= ?")
+		args = append(args, *f.MinAmount)
+	}
+	if f.MaxAmount != nil {
+		clauses = append(clauses, f.amountColumn()+" <= ?")
+		args = append(args, *f.MaxAmount)
+	}
 	if f.From != nil {
 		clauses = append(clauses, "settlement_date >= ?")
 		args = append(args, f.From.Format(time.RFC3339))
@@ -224,6 +1436,275 @@ func buildSettlementWhere(f SettlementFilter) (string, []any) {
 	return " WHERE " + strings.Join(clauses, " AND "), args
 }
 
+// CostTotal is the number of rows and USD amount of one cost category.
+type CostTotal struct {
+	Count int     `json:"count"`
+	USD   float64 `json:"usd"`
+}
+
+// ProcessorFees is one processor's settlement costs by category. SalesUSD is
+// the gross of its payment rows and CostRate is total cost over sales.
+// FeeComponents splits the processing fees by component; a record without a
+// fee breakdown counts its whole fee as processing.
+type ProcessorFees struct {
+	Processor     string                            `json:"processor"`
+	SalesUSD      float64                           `json:"sales_usd"`
+	Costs         map[domain.CostCategory]CostTotal `json:"costs"`
+	FeeComponents map[string]CostTotal              `json:"fee_components"`
+	TotalCostUSD  float64                           `json:"total_cost_usd"`
+	CostRate      float64                           `json:"cost_rate"`
+}
+
+// GetFeeBreakdown totals settlement costs per processor for the records
+// matching f's processor and settlement date range; paging and sort are
+// ignored. A payment row's cost is its processing fee (gross less net and
+// any tax withheld); an adjustment row's cost is what it took off the payout
+// (its negated net), so a credit adjustment counts negative. Refunds,
+// withheld tax and carried balance deductions are listed but are not a cost
+// of processing, so they are left out of the total and the cost rate.
+func (r *SettlementRepo) GetFeeBreakdown(f SettlementFilter) ([]ProcessorFees, error) {
+	where, args := buildSettlementWhere(f)
+	rows, err := r.reader().Query(`
+		SELECT processor, COALESCE(a.category, '`+string(domain.CostProcessingFee)+`'), COUNT(*),
+			COALESCE(SUM(CASE WHEN a.category IS NULL THEN usd_gross_amount ELSE 0 END), 0),
+			COALESCE(SUM(CASE WHEN a.category IS NULL THEN usd_gross_amount - usd_net_amount - `+usdTaxSQL+` ELSE -usd_net_amount END), 0),
+			COUNT(t.settlement_id), COALESCE(SUM(`+usdTaxSQL+`), 0)
+		FROM settlement_records
+		LEFT JOIN settlement_adjustments a ON a.settlement_id = settlement_records.id
+		LEFT JOIN settlement_taxes t ON t.settlement_id = settlement_records.id`+where+`
+		GROUP BY 1, 2 ORDER BY 1`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	fees := []ProcessorFees{}
+	for rows.Next() {
+		var proc, category string
+		var count, taxed int
+		var sales, cost, tax float64
+		if err := rows.Scan(&proc, &category, &count, &sales, &cost, &taxed, &tax); err != nil {
+			return nil, err
+		}
+		if n := len(fees); n == 0 || fees[n-1].Processor != proc {
+			fees = append(fees, ProcessorFees{
+				Processor: proc,
+				Costs: map[domain.CostCategory]CostTotal{
+					domain.CostProcessingFee: {}, domain.CostPenalty: {},
+					domain.CostChargebackFee: {}, domain.CostAdjustment: {},
+					domain.CostRefund: {}, domain.CostWithholdingTax: {},
+					domain.CostCarriedBalance: {},
+				},
+				FeeComponents: map[string]CostTotal{},
+			})
+		}
+		pf := &fees[len(fees)-1]
+		pf.SalesUSD += sales
+		pf.Costs[domain.CostCategory(category)] = CostTotal{Count: count, USD: cost}
+		if cat := domain.CostCategory(category); cat != domain.CostRefund && cat != domain.CostCarriedBalance {
+			pf.TotalCostUSD += cost
+		}
+		if domain.CostCategory(category) == domain.CostProcessingFee {
+			pf.Costs[domain.CostWithholdingTax] = CostTotal{Count: taxed, USD: tax}
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for i := range fees {
+		if fees[i].SalesUSD > 0 {
+			fees[i].CostRate = fees[i].TotalCostUSD / fees[i].SalesUSD
+		}
+	}
+	return fees, r.addFeeComponents(fees, where, args)
+}
+
+// usdTaxSQL is the USD tax withheld from a settlement record joined with
+// settlement_taxes t, at the record's gross rate.
+const usdTaxSQL = "COALESCE(CASE WHEN gross_amount = 0 THEN 0 ELSE t.amount * usd_gross_amount / gross_amount END, 0)"
+
+// addFeeComponents totals the processing fees of fees' payment rows by
+// component. A component is converted to USD at its record's gross rate.
+func (r *SettlementRepo) addFeeComponents(fees []ProcessorFees, where string, args []any) error {
+	payments := " WHERE "
+	if where != "" {
+		payments = where + " AND "
+	}
+	payments += "settlement_records.id NOT IN (SELECT settlement_id FROM settlement_adjustments)"
+	rows, err := r.reader().Query(`
+		SELECT processor, COALESCE(f.component, '`+domain.FeeProcessing+`'), COUNT(*),
+			COALESCE(SUM(CASE WHEN f.component IS NULL THEN usd_gross_amount - usd_net_amount - `+usdTaxSQL+`
+				WHEN gross_amount = 0 THEN 0 ELSE f.amount * usd_gross_amount / gross_amount END), 0)
+		FROM settlement_records
+		LEFT JOIN settlement_fees f ON f.settlement_id = settlement_records.id
+		LEFT JOIN settlement_taxes t ON t.settlement_id = settlement_records.id`+payments+`
+		GROUP BY 1, 2`, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	index := make(map[string]int, len(fees))
+	for i := range fees {
+		index[fees[i].Processor] = i
+	}
+	for rows.Next() {
+		var proc, component string
+		var count int
+		var usd float64
+		if err := rows.Scan(&proc, &component, &count, &usd); err != nil {
+			return err
+		}
+		if i, ok := index[proc]; ok {
+			fees[i].FeeComponents[component] = CostTotal{Count: count, USD: usd}
+		}
+	}
+	return rows.Err()
+}
+
+// MatchedAmount is the USD gross of a matched settlement record beside the
+// amount of its transaction. Mismatch is whether the last run reported the
+// pair as an AMOUNT_MISMATCH.
+type MatchedAmount struct {
+	Processor      string
+	TransactionUSD float64
+	SettledUSD     float64
+	Mismatch       bool
+}
+
+// GetMatchedAmounts returns the amounts of every matched record matching
+// f's processor and settlement date range, whether or not they differ;
+// paging and sort are ignored.
+func (r *SettlementRepo) GetMatchedAmounts(f SettlementFilter) ([]MatchedAmount, error) {
+	where, args := buildSettlementWhere(f)
+	rows, err := r.reader().Query(`
+		SELECT sr.processor, t.usd_amount, sr.usd_gross_amount, d.id IS NOT NULL
+		FROM (SELECT * FROM settlement_records`+where+`) sr
+		JOIN transactions t ON t.id = sr.wakala_transaction_id
+		LEFT JOIN discrepancies d ON d.type = ? AND d.settlement_id = sr.id AND d.transaction_id = t.id
+		ORDER BY sr.processor`, append(args, string(domain.DiscrepancyAmountMismatch))...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	amounts := []MatchedAmount{}
+	for rows.Next() {
+		var a MatchedAmount
+		if err := rows.Scan(&a.Processor, &a.TransactionUSD, &a.SettledUSD, &a.Mismatch); err != nil {
+			return nil, err
+		}
+		amounts = append(amounts, a)
+	}
+	return amounts, rows.Err()
+}
+
+// attachAdjustments sets the adjustment of each adjustment row in records,
+// in a single query.
+func (r *SettlementRepo) attachAdjustments(records []domain.SettlementRecord) error {
+	if len(records) == 0 {
+		return nil
+	}
+
+	placeholders := make([]string, len(records))
+	args := make([]any, len(records))
+	index := make(map[string]int, len(records))
+	for i, rec := range records {
+		placeholders[i] = "?"
+		args[i] = rec.ID
+		index[rec.ID] = i
+	}
+
+	rows, err := r.db.Query(
+		"SELECT settlement_id, code, category FROM settlement_adjustments WHERE settlement_id IN ("+
+			strings.Join(placeholders, ",")+")",
+		args...,
+	)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id, code, category string
+		if err := rows.Scan(&id, &code, &category); err != nil {
+			return err
+		}
+		if i, ok := index[id]; ok {
+			records[i].Adjustment = &domain.RecordAdjustment{Code: code, Category: domain.CostCategory(category)}
+		}
+	}
+	return rows.Err()
+}
+
+// attachFees sets the fee breakdown and withheld tax of each record in
+// records that has them, in one query each.
+func (r *SettlementRepo) attachFees(records []domain.SettlementRecord) error {
+	if len(records) == 0 {
+		return nil
+	}
+
+	placeholders := make([]string, len(records))
+	args := make([]any, len(records))
+	index := make(map[string]int, len(records))
+	for i, rec := range records {
+		placeholders[i] = "?"
+		args[i] = rec.ID
+		index[rec.ID] = i
+	}
+
+	rows, err := r.db.Query(
+		"SELECT settlement_id, component, amount FROM settlement_fees WHERE settlement_id IN ("+
+			strings.Join(placeholders, ",")+")",
+		args...,
+	)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id, component string
+		var amount float64
+		if err := rows.Scan(&id, &component, &amount); err != nil {
+			return err
+		}
+		if i, ok := index[id]; ok {
+			if records[i].FeeBreakdown == nil {
+				records[i].FeeBreakdown = map[string]float64{}
+			}
+			records[i].FeeBreakdown[component] = amount
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+
+	taxes, err := r.db.Query(
+		"SELECT settlement_id, amount FROM settlement_taxes WHERE settlement_id IN ("+
+			strings.Join(placeholders, ",")+")",
+		args...,
+	)
+	if err != nil {
+		return err
+	}
+	defer taxes.Close()
+
+	for taxes.Next() {
+		var id string
+		var amount float64
+		if err := taxes.Scan(&id, &amount); err != nil {
+			return err
+		}
+		if i, ok := index[id]; ok {
+			records[i].TaxAmount = amount
+		}
+	}
+	return taxes.Err()
+}
+
 func scanSettlementRecord(rows *sql.Rows) (*domain.SettlementRecord, error) {
 	var rec domain.SettlementRecord
 	var proc, settleDateStr string
@@ -237,6 +1718,9 @@ func scanSettlementRecord(rows *sql.Rows) (*domain.SettlementRecord, error) {
 	if err != nil {
 		return nil, err
 	}
+	if rec.ProcessorTransactionID, err = openColumn(rec.ProcessorTransactionID); err != nil {
+		return nil, fmt.Errorf("settlement record %s: %w", rec.ID, err)
+	}
 
 	rec.Processor = domain.Processor(proc)
 	rec.SettlementDate, _ = time.Parse(time.RFC3339, settleDateStr)
@@ -246,3 +1730,21 @@ func scanSettlementRecord(rows *sql.Rows) (*domain.SettlementRecord, error) {
 
 	return &rec, nil
 }
+
+func scanSettlementBatch(rows *sql.Rows) (*domain.SettlementBatch, error) {
+	var b domain.SettlementBatch
+	var proc, firstStr, lastStr string
+
+	err := rows.Scan(
+		&proc, &b.BatchID, &b.ReportCount, &b.RecordCount,
+		&b.USDGrossAmount, &b.USDNetAmount, &firstStr, &lastStr,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	b.Processor = domain.Processor(proc)
+	b.FirstIngestedAt, _ = time.Parse(time.RFC3339, firstStr)
+	b.LastIngestedAt, _ = time.Parse(time.RFC3339, lastStr)
+	return &b, nil
+}
@@ -0,0 +1,259 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/wakala/reconciler/internal/blob"
+	"github.com/wakala/reconciler/internal/domain"
+)
+
+// snapshotNamePattern keeps snapshot names safe to use as file names.
+var snapshotNamePattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+const snapshotExt = ".db"
+
+// ErrInvalidSnapshotName is returned for names that are not 1-64 letters,
+// digits, '-' or '_'.
+var ErrInvalidSnapshotName = errors.New("snapshot name must be 1-64 letters, digits, '-' or '_'")
+
+// snapshotKeyPrefix starts the blob keys of snapshots.
+const snapshotKeyPrefix = "snapshots/"
+
+// SnapshotRepo saves the database to SQLite files in a directory and restores
+// it from them. It works the same for file and in-memory databases.
+type SnapshotRepo struct {
+	db    *sql.DB
+	dir   string
+	blobs blob.Store
+}
+
+func NewSnapshotRepo(db *sql.DB, dir string) *SnapshotRepo {
+	return &SnapshotRepo{db: db, dir: dir}
+}
+
+// NewBlobSnapshotRepo keeps the snapshots in store under "snapshots/". Each
+// is written to, or restored from, a temporary file in dir first; an empty
+// dir is the system's temporary directory.
+func NewBlobSnapshotRepo(db *sql.DB, store blob.Store, dir string) *SnapshotRepo {
+	if dir == "" {
+		dir = os.TempDir()
+	}
+	return &SnapshotRepo{db: db, dir: dir, blobs: store}
+}
+
+// List returns the saved snapshots, sorted by name.
+func (r *SnapshotRepo) List() ([]domain.Snapshot, error) {
+	if r.blobs != nil {
+		return r.listBlobs()
+	}
+	entries, err := os.ReadDir(r.dir)
+	if os.IsNotExist(err) {
+		return []domain.Snapshot{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	snapshots := []domain.Snapshot{}
+	for _, e := range entries {
+		name, ok := strings.CutSuffix(e.Name(), snapshotExt)
+		if !ok || e.IsDir() || !snapshotNamePattern.MatchString(name) {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			return nil, err
+		}
+		snapshots = append(snapshots, domain.Snapshot{
+			Name:      name,
+			SizeBytes: info.Size(),
+			CreatedAt: info.ModTime().UTC(),
+		})
+	}
+	sort.Slice(snapshots, func(i, j int) bool { return snapshots[i].Name < snapshots[j].Name })
+	return snapshots, nil
+}
+
+// Create saves the current database as a snapshot, replacing any snapshot
+// with the same name.
+func (r *SnapshotRepo) Create(name string) (*domain.Snapshot, error) {
+	if !snapshotNamePattern.MatchString(name) {
+		return nil, ErrInvalidSnapshotName
+	}
+	if err := os.MkdirAll(r.dir, 0o755); err != nil {
+		return nil, fmt.Errorf("create snapshot dir: %w", err)
+	}
+
+	// VACUUM INTO refuses to overwrite, so write beside the target and
+	// rename over it.
+	path := r.path(name)
+	tmp := path + ".tmp"
+	os.Remove(tmp)
+	if _, err := r.db.Exec("VACUUM INTO ?", snapshotURI(tmp, "")); err != nil {
+		os.Remove(tmp)
+		return nil, fmt.Errorf("vacuum into: %w", err)
+	}
+	if r.blobs != nil {
+		defer os.Remove(tmp)
+		return r.store(name, tmp)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return nil, err
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	return &domain.Snapshot{Name: name, SizeBytes: info.Size(), CreatedAt: info.ModTime().UTC()}, nil
+}
+
+// store copies the snapshot written to path to the blob store.
+func (r *SnapshotRepo) store(name, path string) (*domain.Snapshot, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := r.blobs.Put(context.Background(), snapshotKeyPrefix+name+snapshotExt, data); err != nil {
+		return nil, fmt.Errorf("store snapshot in %s: %w", r.blobs, err)
+	}
+	return &domain.Snapshot{Name: name, SizeBytes: int64(len(data)), CreatedAt: time.Now().UTC()}, nil
+}
+
+func (r *SnapshotRepo) listBlobs() ([]domain.Snapshot, error) {
+	objects, err := r.blobs.List(context.Background(), snapshotKeyPrefix)
+	if err != nil {
+		return nil, err
+	}
+	snapshots := []domain.Snapshot{}
+	for _, o := range objects {
+		name, ok := strings.CutSuffix(strings.TrimPrefix(o.Key, snapshotKeyPrefix), snapshotExt)
+		if !ok || !snapshotNamePattern.MatchString(name) {
+			continue
+		}
+		snapshots = append(snapshots, domain.Snapshot{Name: name, SizeBytes: o.Size, CreatedAt: o.ModTime})
+	}
+	return snapshots, nil
+}
+
+// fetch copies a snapshot from the blob store to a temporary file and
+// returns its path. It returns os.ErrNotExist when there is no such
+// snapshot.
+func (r *SnapshotRepo) fetch(name string) (string, error) {
+	data, err := r.blobs.Get(context.Background(), snapshotKeyPrefix+name+snapshotExt)
+	if errors.Is(err, blob.ErrNotFound) {
+		return "", os.ErrNotExist
+	}
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(r.dir, 0o755); err != nil {
+		return "", fmt.Errorf("create snapshot dir: %w", err)
+	}
+	f, err := os.CreateTemp(r.dir, "restore-"+name+"-*"+snapshotExt)
+	if err != nil {
+		return "", err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return "", err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+// Restore replaces the contents of every table with the snapshot's, in one
+// transaction. It returns os.ErrNotExist when there is no such snapshot.
+func (r *SnapshotRepo) Restore(name string) error {
+	if !snapshotNamePattern.MatchString(name) {
+		return ErrInvalidSnapshotName
+	}
+	path := r.path(name)
+	if r.blobs != nil {
+		var err error
+		if path, err = r.fetch(name); err != nil {
+			return err
+		}
+		defer os.Remove(path)
+	}
+	if _, err := os.Stat(path); err != nil {
+		return err
+	}
+
+	// ATTACH is per connection and cannot run inside a transaction, so pin
+	// one connection for the whole restore.
+	ctx := context.Background()
+	conn, err := r.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(ctx, "ATTACH DATABASE ? AS snapshot", snapshotURI(path, "ro")); err != nil {
+		return fmt.Errorf("attach snapshot: %w", err)
+	}
+	defer conn.ExecContext(ctx, "DETACH DATABASE snapshot")
+
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("begin: %w", err)
+	}
+	defer tx.Rollback()
+
+	for _, table := range snapshotTables {
+		if _, err := tx.Exec("DELETE FROM main." + table); err != nil {
+			return fmt.Errorf("clear %s: %w", table, err)
+		}
+	}
+	for i := len(snapshotTables) - 1; i >= 0; i-- {
+		table := snapshotTables[i]
+		if _, err := tx.Exec("INSERT INTO main." + table + " SELECT * FROM snapshot." + table); err != nil {
+			return fmt.Errorf("restore %s: %w", table, err)
+		}
+	}
+	return tx.Commit()
+}
+
+func (r *SnapshotRepo) path(name string) string {
+	return filepath.Join(r.dir, name+snapshotExt)
+}
+
+// snapshotURI names a snapshot file with the operating system's VFS. Without
+// it SQLite opens VACUUM INTO and ATTACH targets with the main database's
+// VFS, which for an in-memory database never touches disk.
+func snapshotURI(path, mode string) string {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		abs = path
+	}
+	abs = filepath.ToSlash(abs)
+	if !strings.HasPrefix(abs, "/") {
+		abs = "/" + abs // Windows drive letters
+	}
+
+	q := url.Values{}
+	q.Set("vfs", "unix")
+	if runtime.GOOS == "windows" {
+		q.Set("vfs", "win32")
+	}
+	if mode != "" {
+		q.Set("mode", mode)
+	}
+	return (&url.URL{Scheme: "file", Path: abs, RawQuery: q.Encode()}).String()
+}
@@ -0,0 +1,16 @@
+package repository
+
+// streamChunk is how many rows the Each methods read per query. They page
+// through the matching rows by primary key, so memory stays flat however
+// many rows match, and no single read holds the database open for the whole
+// iteration.
+const streamChunk = 500
+
+// afterKey adds "<key> > ?" to a WHERE clause built by one of the
+// build*Where helpers, which return "" when there is nothing to filter.
+func afterKey(where, key string) string {
+	if where == "" {
+		return " WHERE " + key + " > ?"
+	}
+	return where + " AND " + key + " > ?"
+}
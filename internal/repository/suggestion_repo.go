@@ -0,0 +1,98 @@
+package repository
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/wakala/reconciler/internal/domain"
+)
+
+// SuggestionRepo stores the decisions reviewers make on match suggestions
+// for orphaned settlement records.
+type SuggestionRepo struct {
+	db dbtx
+}
+
+func NewSuggestionRepo(db *sql.DB) *SuggestionRepo {
+	return &SuggestionRepo{db: db}
+}
+
+// Upsert records a decision, replacing any earlier one on the same record
+// and transaction.
+func (r *SuggestionRepo) Upsert(f *domain.SuggestionFeedback) error {
+	_, err := r.db.Exec(
+		`INSERT INTO suggestion_feedback (settlement_id, transaction_id, processor, decision, score,
+			amount_score, time_score, merchant_score, reference_score, user_id, note, decided_at)
+		VALUES (?,?,?,?,?,?,?,?,?,?,?,?)
+		ON CONFLICT(settlement_id, transaction_id) DO UPDATE SET
+			decision = excluded.decision,
+			score = excluded.score,
+			amount_score = excluded.amount_score,
+			time_score = excluded.time_score,
+			merchant_score = excluded.merchant_score,
+			reference_score = excluded.reference_score,
+			user_id = excluded.user_id,
+			note = excluded.note,
+			decided_at = excluded.decided_at`,
+		f.SettlementID, f.TransactionID, string(f.Processor), string(f.Decision), f.Score,
+		f.Features.Amount, f.Features.Time, f.Features.Merchant, f.Features.Reference,
+		f.UserID, f.Note, f.DecidedAt.UTC().Format(time.RFC3339),
+	)
+	return err
+}
+
+// List returns the decisions on suggestions for processor's records, or
+// for every processor when it is empty, newest first.
+func (r *SuggestionRepo) List(processor string) ([]domain.SuggestionFeedback, error) {
+	query := "SELECT * FROM suggestion_feedback"
+	var args []any
+	if processor != "" {
+		query += " WHERE processor = ?"
+		args = append(args, processor)
+	}
+	rows, err := r.db.Query(query+" ORDER BY decided_at DESC, settlement_id, transaction_id", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := []domain.SuggestionFeedback{}
+	for rows.Next() {
+		var f domain.SuggestionFeedback
+		var decidedAt string
+		if err := rows.Scan(&f.SettlementID, &f.TransactionID, &f.Processor, &f.Decision, &f.Score,
+			&f.Features.Amount, &f.Features.Time, &f.Features.Merchant, &f.Features.Reference,
+			&f.UserID, &f.Note, &decidedAt); err != nil {
+			return nil, err
+		}
+		f.DecidedAt, _ = time.Parse(time.RFC3339, decidedAt)
+		result = append(result, f)
+	}
+	return result, rows.Err()
+}
+
+// Rejected returns the transactions rejected for each settlement record, by
+// record ID.
+func (r *SuggestionRepo) Rejected() (map[string]map[string]bool, error) {
+	rows, err := r.db.Query(
+		"SELECT settlement_id, transaction_id FROM suggestion_feedback WHERE decision = ?",
+		string(domain.SuggestionRejected),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	rejected := make(map[string]map[string]bool)
+	for rows.Next() {
+		var recID, txnID string
+		if err := rows.Scan(&recID, &txnID); err != nil {
+			return nil, err
+		}
+		if rejected[recID] == nil {
+			rejected[recID] = make(map[string]bool)
+		}
+		rejected[recID][txnID] = true
+	}
+	return rejected, rows.Err()
+}
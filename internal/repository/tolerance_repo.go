@@ -0,0 +1,76 @@
+package repository
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/wakala/reconciler/internal/domain"
+)
+
+type ToleranceRepo struct {
+	db dbtx
+}
+
+func NewToleranceRepo(db *sql.DB) *ToleranceRepo {
+	return &ToleranceRepo{db: db}
+}
+
+// Upsert creates or replaces the tolerance override for a merchant.
+func (r *ToleranceRepo) Upsert(t *domain.MerchantTolerance) error {
+	_, err := r.db.Exec(
+		`INSERT INTO merchant_tolerances (merchant_id, abs_tolerance_usd, updated_at)
+		VALUES (?,?,?)
+		ON CONFLICT(merchant_id) DO UPDATE SET
+			abs_tolerance_usd = excluded.abs_tolerance_usd,
+			updated_at = excluded.updated_at`,
+		t.MerchantID, t.AbsToleranceUSD, t.UpdatedAt.Format(time.RFC3339),
+	)
+	return err
+}
+
+// Delete removes a merchant's override. It returns sql.ErrNoRows when the
+// merchant had no override.
+func (r *ToleranceRepo) Delete(merchantID string) error {
+	res, err := r.db.Exec("DELETE FROM merchant_tolerances WHERE merchant_id = ?", merchantID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+func (r *ToleranceRepo) List() ([]domain.MerchantTolerance, error) {
+	rows, err := r.db.Query("SELECT * FROM merchant_tolerances ORDER BY merchant_id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []domain.MerchantTolerance
+	for rows.Next() {
+		var t domain.MerchantTolerance
+		var updatedAt string
+		if err := rows.Scan(&t.MerchantID, &t.AbsToleranceUSD, &updatedAt); err != nil {
+			return nil, err
+		}
+		t.UpdatedAt, _ = time.Parse(time.RFC3339, updatedAt)
+		result = append(result, t)
+	}
+	return result, rows.Err()
+}
+
+// GetAll returns all overrides keyed by merchant ID, for use during a
+// reconciliation run.
+func (r *ToleranceRepo) GetAll() (map[string]float64, error) {
+	list, err := r.List()
+	if err != nil {
+		return nil, err
+	}
+	m := make(map[string]float64, len(list))
+	for _, t := range list {
+		m[t.MerchantID] = t.AbsToleranceUSD
+	}
+	return m, nil
+}
@@ -2,6 +2,7 @@ package repository
 
 import (
 	"database/sql"
+	"errors"
 	"fmt"
 	"strings"
 	"time"
@@ -10,21 +11,48 @@ import (
 )
 
 type TransactionRepo struct {
-	db *sql.DB
+	db  dbtx
+	rdb *sql.DB
 }
 
 func NewTransactionRepo(db *sql.DB) *TransactionRepo {
 	return &TransactionRepo{db: db}
 }
 
+// SetReader routes dashboard, list and summary queries to a separate
+// read-only connection pool. Reconciliation reads stay on the primary.
+func (r *TransactionRepo) SetReader(rdb *sql.DB) {
+	r.rdb = rdb
+}
+
+func (r *TransactionRepo) reader() dbtx {
+	if r.rdb != nil {
+		return limited(r.rdb)
+	}
+	return limited(r.db)
+}
+
+// Insert stores a transaction. An ID that already exists is skipped; a
+// processor reference used by another transaction returns a
+// *DuplicateReferenceError.
 func (r *TransactionRepo) Insert(tx *domain.Transaction) error {
-	_, err := r.db.Exec(
+	if err := validateTransaction(tx); err != nil {
+		return err
+	}
+
+	sqlTx, err := begin(r.db)
+	if err != nil {
+		return fmt.Errorf("begin tx: %w", err)
+	}
+	defer sqlTx.Rollback()
+
+	res, err := sqlTx.Exec(
 		`INSERT OR IGNORE INTO transactions
 		(id, processor_reference, processor, merchant_id, customer_country,
 		 merchant_country, amount, currency, usd_amount, status, created_at,
 		 captured_at, settled_at)
 		VALUES (?,?,?,?,?,?,?,?,?,?,?,?,?)`,
-		tx.ID, tx.ProcessorReference, string(tx.Processor), tx.MerchantID,
+		tx.ID, sealColumn(tx.ProcessorReference), string(tx.Processor), tx.MerchantID,
 		tx.CustomerCountry, tx.MerchantCountry, tx.Amount, tx.Currency,
 		tx.USDAmount, string(tx.Status), tx.CreatedAt.Format(time.RFC3339),
 		formatNullableTime(tx.CapturedAt), formatNullableTime(tx.SettledAt),
@@ -32,12 +60,36 @@ func (r *TransactionRepo) Insert(tx *domain.Transaction) error {
 	if err != nil {
 		return fmt.Errorf("insert transaction: %w", err)
 	}
-	return nil
+	ra, _ := res.RowsAffected()
+	if ra > 0 {
+		if err := insertLinks(sqlTx, tx); err != nil {
+			return err
+		}
+	}
+	if ra == 0 || columnCipher != nil {
+		if c, err := referenceConflict(sqlTx, tx); err != nil {
+			return err
+		} else if c != nil {
+			return &DuplicateReferenceError{Conflicts: []ReferenceConflict{*c}}
+		}
+	}
+	return sqlTx.Commit()
 }
 
+// BulkInsert stores transactions in one database transaction and returns
+// how many were new; IDs that already exist are skipped. If any reuse a
+// processor reference, nothing is stored and the *DuplicateReferenceError
+// lists them all.
 func (r *TransactionRepo) BulkInsert(txns []domain.Transaction) (int, error) {
+	for i := range txns {
+		if err := validateTransaction(&txns[i]); err != nil {
+			return 0, fmt.Errorf("row %d: %w", i, err)
+		}
+	}
+
 	inserted := 0
-	sqlTx, err := r.db.Begin()
+	var conflicts []ReferenceConflict
+	sqlTx, err := begin(r.db)
 	if err != nil {
 		return 0, fmt.Errorf("begin tx: %w", err)
 	}
@@ -58,7 +110,7 @@ func (r *TransactionRepo) BulkInsert(txns []domain.Transaction) (int, error) {
 	for i := range txns {
 		tx := &txns[i]
 		res, err := stmt.Exec(
-			tx.ID, tx.ProcessorReference, string(tx.Processor), tx.MerchantID,
+			tx.ID, sealColumn(tx.ProcessorReference), string(tx.Processor), tx.MerchantID,
 			tx.CustomerCountry, tx.MerchantCountry, tx.Amount, tx.Currency,
 			tx.USDAmount, string(tx.Status), tx.CreatedAt.Format(time.RFC3339),
 			formatNullableTime(tx.CapturedAt), formatNullableTime(tx.SettledAt),
@@ -68,6 +120,24 @@ func (r *TransactionRepo) BulkInsert(txns []domain.Transaction) (int, error) {
 		}
 		ra, _ := res.RowsAffected()
 		inserted += int(ra)
+		if ra > 0 {
+			if err := insertLinks(sqlTx, tx); err != nil {
+				return inserted, fmt.Errorf("row %d: %w", i, err)
+			}
+			if columnCipher == nil {
+				continue
+			}
+		}
+		c, err := referenceConflict(sqlTx, tx)
+		if err != nil {
+			return 0, fmt.Errorf("row %d: %w", i, err)
+		}
+		if c != nil {
+			conflicts = append(conflicts, *c)
+		}
+	}
+	if len(conflicts) > 0 {
+		return 0, &DuplicateReferenceError{Conflicts: conflicts}
 	}
 
 	if err := sqlTx.Commit(); err != nil {
@@ -76,6 +146,53 @@ func (r *TransactionRepo) BulkInsert(txns []domain.Transaction) (int, error) {
 	return inserted, nil
 }
 
+// validateTransaction checks the direction of a transaction and that one
+// linked to a transfer says which leg it is.
+func validateTransaction(tx *domain.Transaction) error {
+	switch tx.Direction {
+	case "", domain.DirectionInbound, domain.DirectionOutbound:
+	default:
+		return fmt.Errorf("transaction %s: invalid direction %q: must be inbound or outbound", tx.ID, tx.Direction)
+	}
+
+	if tx.TransferID == "" && tx.Leg == "" {
+		return nil
+	}
+	if tx.TransferID == "" {
+		return fmt.Errorf("transaction %s: leg %q without transfer_id", tx.ID, tx.Leg)
+	}
+	if !tx.Leg.Valid() {
+		return fmt.Errorf("transaction %s: invalid leg %q: must be collection or payout", tx.ID, tx.Leg)
+	}
+	return nil
+}
+
+// insertLinks records the direction of an outbound tx and links tx to its
+// transfer. A second leg with the same role in one transfer fails the
+// insert.
+func insertLinks(db dbtx, tx *domain.Transaction) error {
+	if tx.Outbound() {
+		_, err := db.Exec(
+			"INSERT INTO transaction_directions (transaction_id, direction) VALUES (?,?)",
+			tx.ID, string(tx.Direction),
+		)
+		if err != nil {
+			return fmt.Errorf("insert direction of %s: %w", tx.ID, err)
+		}
+	}
+	if tx.TransferID == "" {
+		return nil
+	}
+	_, err := db.Exec(
+		"INSERT INTO transfer_legs (transaction_id, transfer_id, role) VALUES (?,?,?)",
+		tx.ID, tx.TransferID, string(tx.Leg),
+	)
+	if err != nil {
+		return fmt.Errorf("insert %s leg of transfer %s: %w", tx.Leg, tx.TransferID, err)
+	}
+	return nil
+}
+
 func (r *TransactionRepo) Count() (int, error) {
 	var count int
 	err := r.db.QueryRow("SELECT COUNT(*) FROM transactions").Scan(&count)
@@ -84,25 +201,81 @@ func (r *TransactionRepo) Count() (int, error) {
 
 func (r *TransactionRepo) GetByID(id string) (*domain.Transaction, error) {
 	row := r.db.QueryRow("SELECT * FROM transactions WHERE id = ?", id)
-	return scanTransaction(row)
+	tx, err := scanTransaction(row)
+	if err != nil {
+		return nil, err
+	}
+	if err := r.attachLinks([]*domain.Transaction{tx}); err != nil {
+		return nil, err
+	}
+	return tx, nil
 }
 
-func (r *TransactionRepo) GetByProcessorRef(processor, ref string) (*domain.Transaction, error) {
-	row := r.db.QueryRow(
-		"SELECT * FROM transactions WHERE processor = ? AND processor_reference = ?",
-		processor, ref,
+// GetByIDs returns the transactions with the given IDs, keyed by ID, with
+// their links. IDs with no transaction are left out.
+func (r *TransactionRepo) GetByIDs(ids []string) (map[string]*domain.Transaction, error) {
+	found := make(map[string]*domain.Transaction, len(ids))
+	if len(ids) == 0 {
+		return found, nil
+	}
+	args := make([]any, len(ids))
+	for i, id := range ids {
+		args[i] = id
+	}
+	rows, err := r.reader().Query(
+		"SELECT * FROM transactions WHERE id IN ("+strings.TrimSuffix(strings.Repeat("?,", len(ids)), ",")+")", args...,
 	)
-	return scanTransaction(row)
+	if err != nil {
+		return nil, err
+	}
+	var txns []*domain.Transaction
+	for rows.Next() {
+		tx, err := scanTransactionRows(rows)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		txns = append(txns, tx)
+		found[tx.ID] = tx
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if err := r.attachLinks(txns); err != nil {
+		return nil, err
+	}
+	return found, nil
+}
+
+// transactionByRefSQL looks a transaction up by its processor reference,
+// through the unique idx_transactions_proc_ref.
+const transactionByRefSQL = "SELECT * FROM transactions WHERE processor = ? AND processor_reference = ?"
+
+// GetByProcessorRef returns the transaction with a processor reference, or
+// sql.ErrNoRows.
+func (r *TransactionRepo) GetByProcessorRef(processor, ref string) (*domain.Transaction, error) {
+	for _, form := range columnLookups(ref) {
+		tx, err := scanTransaction(r.db.QueryRow(transactionByRefSQL, processor, form))
+		if !errors.Is(err, sql.ErrNoRows) {
+			return tx, err
+		}
+	}
+	return nil, sql.ErrNoRows
 }
 
 type TransactionFilter struct {
 	Processor string
 	Status    string
 	Currency  string
-	From      *time.Time
-	To        *time.Time
-	Page      int
-	Limit     int
+	Direction string
+	// ReconciliationStatus is one of the domain.ReconciliationStatus
+	// values.
+	ReconciliationStatus string
+	From                 *time.Time
+	To                   *time.Time
+	Page                 int
+	Limit                int
 }
 
 func (r *TransactionRepo) List(f TransactionFilter) ([]domain.Transaction, int, error) {
@@ -110,7 +283,7 @@ func (r *TransactionRepo) List(f TransactionFilter) ([]domain.Transaction, int,
 
 	var total int
 	countSQL := "SELECT COUNT(*) FROM transactions" + where
-	if err := r.db.QueryRow(countSQL, args...).Scan(&total); err != nil {
+	if err := r.reader().QueryRow(countSQL, args...).Scan(&total); err != nil {
 		return nil, 0, fmt.Errorf("count: %w", err)
 	}
 
@@ -125,7 +298,7 @@ func (r *TransactionRepo) List(f TransactionFilter) ([]domain.Transaction, int,
 	querySQL := "SELECT * FROM transactions" + where + " ORDER BY created_at DESC LIMIT ? OFFSET ?"
 	args = append(args, f.Limit, offset)
 
-	rows, err := r.db.Query(querySQL, args...)
+	rows, err := r.reader().Query(querySQL, args...)
 	if err != nil {
 		return nil, 0, fmt.Errorf("query: %w", err)
 	}
@@ -139,7 +312,177 @@ func (r *TransactionRepo) List(f TransactionFilter) ([]domain.Transaction, int,
 		}
 		txns = append(txns, *tx)
 	}
-	return txns, total, rows.Err()
+	if err := rows.Err(); err != nil {
+		return nil, 0, err
+	}
+
+	ptrs := make([]*domain.Transaction, len(txns))
+	for i := range txns {
+		ptrs[i] = &txns[i]
+	}
+	if err := r.attachLinks(ptrs); err != nil {
+		return nil, 0, err
+	}
+	return txns, total, nil
+}
+
+// Each calls fn for every transaction matching f, in ID order, with its
+// direction and transfer links. Page and Limit are ignored. Rows are read in
+// chunks; an error from fn stops the iteration and is returned.
+func (r *TransactionRepo) Each(f TransactionFilter, fn func(*domain.Transaction) error) error {
+	where, args := buildTransactionWhere(f)
+	q := "SELECT * FROM transactions" + afterKey(where, "id") + " ORDER BY id LIMIT ?"
+
+	after := ""
+	for {
+		rows, err := r.reader().Query(q, append(args, after, streamChunk)...)
+		if err != nil {
+			return fmt.Errorf("query: %w", err)
+		}
+		var chunk []*domain.Transaction
+		for rows.Next() {
+			tx, err := scanTransactionRows(rows)
+			if err != nil {
+				rows.Close()
+				return fmt.Errorf("scan: %w", err)
+			}
+			chunk = append(chunk, tx)
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return err
+		}
+
+		if err := r.attachLinks(chunk); err != nil {
+			return err
+		}
+		for _, tx := range chunk {
+			if err := fn(tx); err != nil {
+				return err
+			}
+		}
+		if len(chunk) < streamChunk {
+			return nil
+		}
+		after = chunk[len(chunk)-1].ID
+	}
+}
+
+// TransactionExpand selects the summaries ListExpanded joins onto each row.
+type TransactionExpand struct {
+	Settlements   bool
+	Discrepancies bool
+}
+
+// TransactionRow is a transaction list row with the summaries asked for.
+type TransactionRow struct {
+	domain.Transaction
+	Settlement        *TransactionSettlementSummary `json:"settlement,omitempty"`
+	OpenDiscrepancies *int                          `json:"open_discrepancies,omitempty"`
+}
+
+// TransactionSettlementSummary totals the settlement records matched to a
+// transaction. SettlementDate is the latest of them; both are zero and nil
+// when the transaction has not settled.
+type TransactionSettlementSummary struct {
+	Records        int        `json:"records"`
+	USDGrossAmount float64    `json:"usd_gross_amount"`
+	USDNetAmount   float64    `json:"usd_net_amount"`
+	SettlementDate *time.Time `json:"settlement_date,omitempty"`
+}
+
+// ListExpanded is List with settlement and discrepancy summaries joined onto
+// the page of transactions in the same query.
+func (r *TransactionRepo) ListExpanded(f TransactionFilter, e TransactionExpand) ([]TransactionRow, int, error) {
+	where, args := buildTransactionWhere(f)
+
+	var total int
+	countSQL := "SELECT COUNT(*) FROM transactions" + where
+	if err := r.reader().QueryRow(countSQL, args...).Scan(&total); err != nil {
+		return nil, 0, fmt.Errorf("count: %w", err)
+	}
+
+	if f.Limit <= 0 {
+		f.Limit = 50
+	}
+	if f.Page <= 0 {
+		f.Page = 1
+	}
+	offset := (f.Page - 1) * f.Limit
+
+	// Page first so the joins only touch the rows returned.
+	cols := "page.*"
+	joins := ""
+	if e.Settlements {
+		cols += ", COALESCE(s.records, 0), COALESCE(s.usd_gross, 0), COALESCE(s.usd_net, 0), s.last_date"
+		joins += ` LEFT JOIN (
+			SELECT wakala_transaction_id, COUNT(*) AS records, ROUND(SUM(usd_gross_amount), 2) AS usd_gross,
+				ROUND(SUM(usd_net_amount), 2) AS usd_net, MAX(settlement_date) AS last_date
+			FROM settlement_records WHERE wakala_transaction_id IN (SELECT id FROM page)
+			GROUP BY wakala_transaction_id
+		) s ON s.wakala_transaction_id = page.id`
+	}
+	if e.Discrepancies {
+		cols += ", COALESCE(d.open_count, 0)"
+		joins += ` LEFT JOIN (
+			SELECT transaction_id, COUNT(*) AS open_count
+			FROM discrepancies WHERE transaction_id IN (SELECT id FROM page)
+			GROUP BY transaction_id
+		) d ON d.transaction_id = page.id`
+	}
+	querySQL := "WITH page AS (SELECT * FROM transactions" + where + " ORDER BY created_at DESC LIMIT ? OFFSET ?)" +
+		" SELECT " + cols + " FROM page" + joins + " ORDER BY page.created_at DESC"
+	args = append(args, f.Limit, offset)
+
+	rows, err := r.reader().Query(querySQL, args...)
+	if err != nil {
+		return nil, 0, fmt.Errorf("query: %w", err)
+	}
+	defer rows.Close()
+
+	txnRows := []TransactionRow{}
+	for rows.Next() {
+		var row TransactionRow
+		var extra []any
+		var settlement TransactionSettlementSummary
+		var lastDate sql.NullString
+		var open int
+		if e.Settlements {
+			extra = append(extra, &settlement.Records, &settlement.USDGrossAmount, &settlement.USDNetAmount, &lastDate)
+		}
+		if e.Discrepancies {
+			extra = append(extra, &open)
+		}
+		tx, err := scanTransactionRows(rows, extra...)
+		if err != nil {
+			return nil, 0, fmt.Errorf("scan: %w", err)
+		}
+		row.Transaction = *tx
+		if e.Settlements {
+			if lastDate.Valid {
+				t, _ := time.Parse(time.RFC3339, lastDate.String)
+				settlement.SettlementDate = &t
+			}
+			row.Settlement = &settlement
+		}
+		if e.Discrepancies {
+			row.OpenDiscrepancies = &open
+		}
+		txnRows = append(txnRows, row)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, err
+	}
+
+	ptrs := make([]*domain.Transaction, len(txnRows))
+	for i := range txnRows {
+		ptrs[i] = &txnRows[i].Transaction
+	}
+	if err := r.attachLinks(ptrs); err != nil {
+		return nil, 0, err
+	}
+	return txnRows, total, nil
 }
 
 // UpdateStatusToSettled marks a transaction as settled.
@@ -151,18 +494,50 @@ func (r *TransactionRepo) UpdateStatusToSettled(id string, settledAt time.Time)
 	return err
 }
 
-// GetCapturedWithoutSettlement returns captured transactions older than the
-// given cutoff that have no matching settlement record.
+// UpdateStatusToPendingConfirmation marks a matched transaction as waiting
+// for its settlement batch to be approved.
+func (r *TransactionRepo) UpdateStatusToPendingConfirmation(id string) error {
+	_, err := r.db.Exec(
+		"UPDATE transactions SET status = ?, settled_at = NULL WHERE id = ?",
+		string(domain.StatusPendingConfirmation), id,
+	)
+	return err
+}
+
+// GetCapturedWithoutSettlement returns captured inbound transactions older
+// than the given cutoff that have no matching settlement record.
 func (r *TransactionRepo) GetCapturedWithoutSettlement(cutoff time.Time) ([]domain.Transaction, error) {
-	query := `
+	return r.capturedWithoutRecord(cutoff, false)
+}
+
+// GetPayoutsWithoutDisbursement returns outbound transactions captured
+// (instructed) before the cutoff that no disbursement record matched.
+func (r *TransactionRepo) GetPayoutsWithoutDisbursement(cutoff time.Time) ([]domain.Transaction, error) {
+	return r.capturedWithoutRecord(cutoff, true)
+}
+
+// capturedWithoutRecordSQL selects transactions captured before a cutoff
+// that no settlement record points at. It ranges over
+// idx_transactions_status_captured and probes each candidate's records and
+// direction by key, rather than joining every transaction to its records
+// and filtering out the matched ones, which reads the whole table.
+func capturedWithoutRecordSQL(outbound bool) string {
+	direction := "NOT EXISTS"
+	if outbound {
+		direction = "EXISTS"
+	}
+	return `
 		SELECT t.* FROM transactions t
-		LEFT JOIN settlement_records sr ON sr.wakala_transaction_id = t.id
 		WHERE t.status = 'captured'
 		  AND t.captured_at < ?
-		  AND sr.id IS NULL
+		  AND NOT EXISTS (SELECT 1 FROM settlement_records sr WHERE sr.wakala_transaction_id = t.id)
+		  AND ` + direction + ` (SELECT 1 FROM transaction_directions d WHERE d.transaction_id = t.id AND d.direction = 'outbound')
 		ORDER BY t.created_at
 	`
-	rows, err := r.db.Query(query, cutoff.Format(time.RFC3339))
+}
+
+func (r *TransactionRepo) capturedWithoutRecord(cutoff time.Time, outbound bool) ([]domain.Transaction, error) {
+	rows, err := r.db.Query(capturedWithoutRecordSQL(outbound), cutoff.Format(time.RFC3339))
 	if err != nil {
 		return nil, fmt.Errorf("query: %w", err)
 	}
@@ -174,6 +549,9 @@ func (r *TransactionRepo) GetCapturedWithoutSettlement(cutoff time.Time) ([]doma
 		if err != nil {
 			return nil, fmt.Errorf("scan: %w", err)
 		}
+		if outbound {
+			tx.Direction = domain.DirectionOutbound
+		}
 		txns = append(txns, *tx)
 	}
 	return txns, rows.Err()
@@ -190,9 +568,11 @@ type DashboardStats struct {
 	UnsettledUSD      float64
 }
 
-func (r *TransactionRepo) GetDashboardStats() (*DashboardStats, error) {
+// GetDashboardStats counts the transactions in scope.
+func (r *TransactionRepo) GetDashboardStats(scope DashboardScope) (*DashboardStats, error) {
 	s := &DashboardStats{}
-	err := r.db.QueryRow(`
+	where, args := scope.transactionWhere()
+	err := r.reader().QueryRow(`
 		SELECT
 			COUNT(*),
 			COALESCE(SUM(CASE WHEN status='captured' THEN 1 ELSE 0 END), 0),
@@ -201,8 +581,7 @@ func (r *TransactionRepo) GetDashboardStats() (*DashboardStats, error) {
 			COALESCE(SUM(usd_amount), 0),
 			COALESCE(SUM(CASE WHEN status='settled' THEN usd_amount ELSE 0 END), 0),
 			COALESCE(SUM(CASE WHEN status IN ('authorized','captured') THEN usd_amount ELSE 0 END), 0)
-		FROM transactions
-	`).Scan(&s.Total, &s.Captured, &s.Settled, &s.PendingSettlement,
+		FROM transactions`+where, args...).Scan(&s.Total, &s.Captured, &s.Settled, &s.PendingSettlement,
 		&s.TotalUSD, &s.SettledUSD, &s.UnsettledUSD)
 	return s, err
 }
@@ -212,11 +591,11 @@ type ProcessorVolume struct {
 	SettledUSD float64 `json:"settled_usd"`
 }
 
-func (r *TransactionRepo) GetVolumeByProcessor() ([]ProcessorVolume, error) {
-	rows, err := r.db.Query(`
+func (r *TransactionRepo) GetVolumeByProcessor(scope DashboardScope) ([]ProcessorVolume, error) {
+	where, args := scope.transactionWhere()
+	rows, err := r.reader().Query(`
 		SELECT processor, COALESCE(SUM(CASE WHEN status='settled' THEN usd_amount ELSE 0 END), 0)
-		FROM transactions GROUP BY processor
-	`)
+		FROM transactions`+where+` GROUP BY processor`, args...)
 	if err != nil {
 		return nil, err
 	}
@@ -239,13 +618,13 @@ type CurrencyVolume struct {
 	SettledVolume float64 `json:"settled_volume"`
 }
 
-func (r *TransactionRepo) GetVolumeByCurrency() ([]CurrencyVolume, error) {
-	rows, err := r.db.Query(`
+func (r *TransactionRepo) GetVolumeByCurrency(scope DashboardScope) ([]CurrencyVolume, error) {
+	where, args := scope.transactionWhere()
+	rows, err := r.reader().Query(`
 		SELECT currency,
 			COALESCE(SUM(usd_amount), 0),
 			COALESCE(SUM(CASE WHEN status='settled' THEN usd_amount ELSE 0 END), 0)
-		FROM transactions GROUP BY currency
-	`)
+		FROM transactions`+where+` GROUP BY currency`, args...)
 	if err != nil {
 		return nil, err
 	}
@@ -262,8 +641,148 @@ func (r *TransactionRepo) GetVolumeByCurrency() ([]CurrencyVolume, error) {
 	return result, rows.Err()
 }
 
+// TransferFilter narrows a transfer list. Status is matched against the
+// derived status.
+type TransferFilter struct {
+	Status string
+	Page   int
+	Limit  int
+}
+
+// GetTransfer returns a transfer with its legs and derived status. It
+// returns sql.ErrNoRows when no transaction belongs to the transfer.
+func (r *TransactionRepo) GetTransfer(id string) (*domain.Transfer, error) {
+	transfers, err := r.loadTransfers(" WHERE l.transfer_id = ?", id)
+	if err != nil {
+		return nil, err
+	}
+	if len(transfers) == 0 {
+		return nil, sql.ErrNoRows
+	}
+	return &transfers[0], nil
+}
+
+// ListTransfers returns a page of transfers ordered by ID. Status is derived
+// from the legs, so every transfer is loaded before filtering.
+func (r *TransactionRepo) ListTransfers(f TransferFilter) ([]domain.Transfer, int, error) {
+	all, err := r.loadTransfers("")
+	if err != nil {
+		return nil, 0, err
+	}
+
+	transfers := []domain.Transfer{}
+	for _, t := range all {
+		if f.Status == "" || string(t.Status) == f.Status {
+			transfers = append(transfers, t)
+		}
+	}
+	total := len(transfers)
+
+	if f.Limit <= 0 {
+		f.Limit = 50
+	}
+	if f.Page <= 0 {
+		f.Page = 1
+	}
+	start := min((f.Page-1)*f.Limit, total)
+	end := min(start+f.Limit, total)
+	return transfers[start:end], total, nil
+}
+
+// loadTransfers reads the legs matching where, grouped into transfers, with
+// each leg's open discrepancy count.
+func (r *TransactionRepo) loadTransfers(where string, args ...any) ([]domain.Transfer, error) {
+	rows, err := r.reader().Query(`
+		SELECT t.*, l.transfer_id, l.role, COALESCE(dir.direction, ''), COALESCE(d.open_count, 0)
+		FROM transfer_legs l
+		JOIN transactions t ON t.id = l.transaction_id
+		LEFT JOIN transaction_directions dir ON dir.transaction_id = t.id
+		LEFT JOIN (
+			SELECT transaction_id, COUNT(*) AS open_count
+			FROM discrepancies WHERE transaction_id IS NOT NULL
+			GROUP BY transaction_id
+		) d ON d.transaction_id = t.id`+where+`
+		ORDER BY l.transfer_id, l.role`, args...)
+	if err != nil {
+		return nil, fmt.Errorf("query: %w", err)
+	}
+	defer rows.Close()
+
+	var transfers []domain.Transfer
+	for rows.Next() {
+		var leg domain.TransferLeg
+		var transferID, role, direction string
+		tx, err := scanTransactionRows(rows, &transferID, &role, &direction, &leg.OpenDiscrepancies)
+		if err != nil {
+			return nil, fmt.Errorf("scan: %w", err)
+		}
+		tx.Direction = domain.Direction(direction)
+		tx.TransferID, tx.Leg = transferID, domain.LegRole(role)
+		leg.Role = tx.Leg
+		leg.Transaction = *tx
+
+		if n := len(transfers); n == 0 || transfers[n-1].ID != transferID {
+			transfers = append(transfers, domain.Transfer{ID: transferID})
+		}
+		last := &transfers[len(transfers)-1]
+		last.Legs = append(last.Legs, leg)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for i := range transfers {
+		transfers[i].DeriveStatus()
+	}
+	return transfers, nil
+}
+
 // --- helpers ---
 
+// attachLinks sets the direction of each outbound transaction, the
+// transfer and leg of each one that is part of a transfer and the
+// reconciliation status of all of them, in a single query.
+func (r *TransactionRepo) attachLinks(txns []*domain.Transaction) error {
+	if len(txns) == 0 {
+		return nil
+	}
+
+	placeholders := make([]string, len(txns))
+	args := make([]any, len(txns))
+	index := make(map[string]*domain.Transaction, len(txns))
+	for i, tx := range txns {
+		placeholders[i] = "?"
+		args[i] = tx.ID
+		index[tx.ID] = tx
+	}
+	rows, err := r.db.Query(`
+		SELECT t.id, d.direction, l.transfer_id, l.role, COALESCE(rs.status, ?) FROM transactions t
+		LEFT JOIN transaction_directions d ON d.transaction_id = t.id
+		LEFT JOIN transfer_legs l ON l.transaction_id = t.id
+		LEFT JOIN transaction_reconciliation rs ON rs.transaction_id = t.id
+		WHERE t.id IN (`+strings.Join(placeholders, ",")+`)`,
+		append([]any{string(domain.ReconUnreconciled)}, args...)...,
+	)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id, recon string
+		var direction, transferID, role sql.NullString
+		if err := rows.Scan(&id, &direction, &transferID, &role, &recon); err != nil {
+			return err
+		}
+		if tx, ok := index[id]; ok {
+			tx.Direction = domain.Direction(direction.String)
+			tx.TransferID, tx.Leg = transferID.String, domain.LegRole(role.String)
+			tx.ReconciliationStatus = domain.ReconciliationStatus(recon)
+		}
+	}
+	return rows.Err()
+}
+
 func buildTransactionWhere(f TransactionFilter) (string, []any) {
 	var clauses []string
 	var args []any
@@ -280,6 +799,21 @@ func buildTransactionWhere(f TransactionFilter) (string, []any) {
 		clauses = append(clauses, "currency = ?")
 		args = append(args, f.Currency)
 	}
+	switch f.Direction {
+	case string(domain.DirectionOutbound):
+		clauses = append(clauses, "id IN (SELECT transaction_id FROM transaction_directions WHERE direction = 'outbound')")
+	case string(domain.DirectionInbound):
+		clauses = append(clauses, "id NOT IN (SELECT transaction_id FROM transaction_directions WHERE direction = 'outbound')")
+	}
+	switch f.ReconciliationStatus {
+	case "":
+	case string(domain.ReconUnreconciled):
+		clauses = append(clauses, "id NOT IN (SELECT transaction_id FROM transaction_reconciliation WHERE status != ?)")
+		args = append(args, f.ReconciliationStatus)
+	default:
+		clauses = append(clauses, "id IN (SELECT transaction_id FROM transaction_reconciliation WHERE status = ?)")
+		args = append(args, f.ReconciliationStatus)
+	}
 	if f.From != nil {
 		clauses = append(clauses, "created_at >= ?")
 		args = append(args, f.From.Format(time.RFC3339))
@@ -295,6 +829,115 @@ func buildTransactionWhere(f TransactionFilter) (string, []any) {
 	return " WHERE " + strings.Join(clauses, " AND "), args
 }
 
+// ApplyAmendment records a new amount version for a transaction and sets the
+// transaction's amount to the amendment with the latest amended_at, so an
+// event that arrives out of order is kept in the history without overriding
+// a newer amount. Version, previous amounts and recorded time are filled in.
+// An event ID already applied to the transaction returns the existing
+// amendment and false. It returns sql.ErrNoRows when the transaction does
+// not exist.
+func (r *TransactionRepo) ApplyAmendment(a *domain.TransactionAmendment) (*domain.TransactionAmendment, bool, error) {
+	tx, err := begin(r.db)
+	if err != nil {
+		return nil, false, fmt.Errorf("begin: %w", err)
+	}
+	defer tx.Rollback()
+
+	if a.EventID != "" {
+		existing, err := scanAmendment(tx.QueryRow(
+			"SELECT * FROM transaction_amendments WHERE transaction_id = ? AND event_id = ?",
+			a.TransactionID, a.EventID,
+		))
+		if err == nil {
+			return existing, false, nil
+		}
+		if err != sql.ErrNoRows {
+			return nil, false, fmt.Errorf("get amendment by event: %w", err)
+		}
+	}
+
+	err = tx.QueryRow(
+		"SELECT amount, usd_amount FROM transactions WHERE id = ?", a.TransactionID,
+	).Scan(&a.PreviousAmount, &a.PreviousUSDAmount)
+	if err != nil {
+		return nil, false, err
+	}
+	err = tx.QueryRow(
+		"SELECT COALESCE(MAX(version), 0) + 1 FROM transaction_amendments WHERE transaction_id = ?",
+		a.TransactionID,
+	).Scan(&a.Version)
+	if err != nil {
+		return nil, false, fmt.Errorf("next version: %w", err)
+	}
+	a.RecordedAt = time.Now().UTC().Truncate(time.Second)
+
+	_, err = tx.Exec(
+		`INSERT INTO transaction_amendments
+		(id, transaction_id, version, event_id, reason, previous_amount,
+		 previous_usd_amount, amount, usd_amount, amended_at, recorded_at)
+		VALUES (?,?,?,?,?,?,?,?,?,?,?)`,
+		a.ID, a.TransactionID, a.Version, a.EventID, a.Reason, a.PreviousAmount,
+		a.PreviousUSDAmount, a.Amount, a.USDAmount,
+		a.AmendedAt.UTC().Format(time.RFC3339), a.RecordedAt.Format(time.RFC3339),
+	)
+	if err != nil {
+		return nil, false, fmt.Errorf("insert amendment: %w", err)
+	}
+
+	_, err = tx.Exec(
+		`UPDATE transactions SET (amount, usd_amount) = (
+			SELECT amount, usd_amount FROM transaction_amendments
+			WHERE transaction_id = ? ORDER BY amended_at DESC, version DESC LIMIT 1
+		) WHERE id = ?`,
+		a.TransactionID, a.TransactionID,
+	)
+	if err != nil {
+		return nil, false, fmt.Errorf("update transaction amount: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, false, err
+	}
+	return a, true, nil
+}
+
+// ListAmendments returns a transaction's amount history, oldest version
+// first.
+func (r *TransactionRepo) ListAmendments(transactionID string) ([]domain.TransactionAmendment, error) {
+	rows, err := r.reader().Query(
+		"SELECT * FROM transaction_amendments WHERE transaction_id = ? ORDER BY version", transactionID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	amendments := []domain.TransactionAmendment{}
+	for rows.Next() {
+		a, err := scanAmendment(rows)
+		if err != nil {
+			return nil, err
+		}
+		amendments = append(amendments, *a)
+	}
+	return amendments, rows.Err()
+}
+
+func scanAmendment(row interface{ Scan(...any) error }) (*domain.TransactionAmendment, error) {
+	var a domain.TransactionAmendment
+	var amendedAt, recordedAt string
+	err := row.Scan(
+		&a.ID, &a.TransactionID, &a.Version, &a.EventID, &a.Reason, &a.PreviousAmount,
+		&a.PreviousUSDAmount, &a.Amount, &a.USDAmount, &amendedAt, &recordedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	a.AmendedAt, _ = time.Parse(time.RFC3339, amendedAt)
+	a.RecordedAt, _ = time.Parse(time.RFC3339, recordedAt)
+	return &a, nil
+}
+
 func formatNullableTime(t *time.Time) any {
 	if t == nil {
 		return nil
@@ -315,6 +958,9 @@ func scanTransaction(row *sql.Row) (*domain.Transaction, error) {
 	if err != nil {
 		return nil, err
 	}
+	if tx.ProcessorReference, err = openColumn(tx.ProcessorReference); err != nil {
+		return nil, fmt.Errorf("transaction %s: %w", tx.ID, err)
+	}
 
 	tx.Processor = domain.Processor(proc)
 	tx.Status = domain.TransactionStatus(status)
@@ -334,19 +980,25 @@ func scanTransaction(row *sql.Row) (*domain.Transaction, error) {
 	return &tx, nil
 }
 
-func scanTransactionRows(rows *sql.Rows) (*domain.Transaction, error) {
+// scanTransactionRows scans a transactions row. Columns selected after the
+// transaction's own are scanned into extra.
+func scanTransactionRows(rows *sql.Rows, extra ...any) (*domain.Transaction, error) {
 	var tx domain.Transaction
 	var proc, status, createdAt string
 	var capturedAtNull, settledAtNull sql.NullString
 
-	err := rows.Scan(
+	dest := []any{
 		&tx.ID, &tx.ProcessorReference, &proc, &tx.MerchantID,
 		&tx.CustomerCountry, &tx.MerchantCountry, &tx.Amount, &tx.Currency,
 		&tx.USDAmount, &status, &createdAt, &capturedAtNull, &settledAtNull,
-	)
+	}
+	err := rows.Scan(append(dest, extra...)...)
 	if err != nil {
 		return nil, err
 	}
+	if tx.ProcessorReference, err = openColumn(tx.ProcessorReference); err != nil {
+		return nil, fmt.Errorf("transaction %s: %w", tx.ID, err)
+	}
 
 	tx.Processor = domain.Processor(proc)
 	tx.Status = domain.TransactionStatus(status)
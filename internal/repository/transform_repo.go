@@ -0,0 +1,95 @@
+package repository
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/wakala/reconciler/internal/domain"
+)
+
+type TransformRepo struct {
+	db dbtx
+}
+
+func NewTransformRepo(db *sql.DB) *TransformRepo {
+	return &TransformRepo{db: db}
+}
+
+// Upsert creates or replaces a processor's transform script and sets its
+// Version, which starts at 1 and goes up by one on every replacement.
+func (r *TransformRepo) Upsert(s *domain.TransformScript) error {
+	steps, err := json.Marshal(s.Steps)
+	if err != nil {
+		return fmt.Errorf("marshal steps: %w", err)
+	}
+	return r.db.QueryRow(
+		`INSERT INTO transform_scripts (processor, version, steps, updated_at, updated_by)
+		VALUES (?,1,?,?,?)
+		ON CONFLICT(processor) DO UPDATE SET
+			version = transform_scripts.version + 1,
+			steps = excluded.steps,
+			updated_at = excluded.updated_at,
+			updated_by = excluded.updated_by
+		RETURNING version`,
+		s.Processor, string(steps), s.UpdatedAt.Format(time.RFC3339), s.UpdatedBy,
+	).Scan(&s.Version)
+}
+
+// Get returns a processor's transform script, or sql.ErrNoRows if it has
+// none.
+func (r *TransformRepo) Get(proc domain.Processor) (*domain.TransformScript, error) {
+	rows, err := r.db.Query("SELECT * FROM transform_scripts WHERE processor = ?", proc)
+	if err != nil {
+		return nil, err
+	}
+	scripts, err := scanTransformScripts(rows)
+	if err != nil {
+		return nil, err
+	}
+	if len(scripts) == 0 {
+		return nil, sql.ErrNoRows
+	}
+	return &scripts[0], nil
+}
+
+func (r *TransformRepo) List() ([]domain.TransformScript, error) {
+	rows, err := r.db.Query("SELECT * FROM transform_scripts ORDER BY processor")
+	if err != nil {
+		return nil, err
+	}
+	return scanTransformScripts(rows)
+}
+
+// Delete removes a processor's script. It returns sql.ErrNoRows when the
+// processor had none.
+func (r *TransformRepo) Delete(proc domain.Processor) error {
+	res, err := r.db.Exec("DELETE FROM transform_scripts WHERE processor = ?", proc)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+func scanTransformScripts(rows *sql.Rows) ([]domain.TransformScript, error) {
+	defer rows.Close()
+
+	var result []domain.TransformScript
+	for rows.Next() {
+		var s domain.TransformScript
+		var steps, updatedAt string
+		if err := rows.Scan(&s.Processor, &s.Version, &steps, &updatedAt, &s.UpdatedBy); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal([]byte(steps), &s.Steps); err != nil {
+			return nil, fmt.Errorf("transform script %s: %w", s.Processor, err)
+		}
+		s.UpdatedAt, _ = time.Parse(time.RFC3339, updatedAt)
+		result = append(result, s)
+	}
+	return result, rows.Err()
+}
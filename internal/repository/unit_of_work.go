@@ -0,0 +1,123 @@
+package repository
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/wakala/reconciler/internal/blob"
+)
+
+// dbtx is what the repositories need from *sql.DB or *sql.Tx, so the same
+// repository code runs standalone or inside a unit of work.
+type dbtx interface {
+	Exec(query string, args ...any) (sql.Result, error)
+	Query(query string, args ...any) (*sql.Rows, error)
+	QueryRow(query string, args ...any) *sql.Row
+	Prepare(query string) (*sql.Stmt, error)
+}
+
+// UnitOfWork runs a group of repository calls in one database transaction,
+// so they are stored together or not at all.
+type UnitOfWork struct {
+	db    *sql.DB
+	blobs blob.Store
+}
+
+func NewUnitOfWork(db *sql.DB) *UnitOfWork {
+	return &UnitOfWork{db: db}
+}
+
+// SetBlobStore gives the settlement repository of each unit of work the
+// blob store report files are kept in, as SettlementRepo.SetBlobStore does.
+func (u *UnitOfWork) SetBlobStore(store blob.Store) {
+	u.blobs = store
+}
+
+// Tx holds the repositories of one unit of work, bound to its transaction.
+// They must not be used after Run returns.
+type Tx struct {
+	Transactions   *TransactionRepo
+	Settlements    *SettlementRepo
+	Discrepancies  *DiscrepancyRepo
+	Tolerances     *ToleranceRepo
+	RuleFlags      *RuleFlagRepo
+	RoutingRules   *RoutingRuleRepo
+	JiraIssues     *JiraIssueRepo
+	Cases          *CaseRepo
+	Suggestions    *SuggestionRepo
+	PayoutHolds    *PayoutHoldRepo
+	BatchApprovals *BatchApprovalRepo
+	History        *HistoryRepo
+	Transforms     *TransformRepo
+}
+
+// Run calls fn in a new transaction. The transaction is committed if fn
+// returns nil and rolled back if it returns an error or panics.
+func (u *UnitOfWork) Run(fn func(tx *Tx) error) error {
+	sqlTx, err := u.db.Begin()
+	if err != nil {
+		return fmt.Errorf("begin: %w", err)
+	}
+	defer sqlTx.Rollback()
+
+	tx := &Tx{
+		Transactions:   &TransactionRepo{db: sqlTx},
+		Settlements:    &SettlementRepo{db: sqlTx, blobs: u.blobs},
+		Discrepancies:  &DiscrepancyRepo{db: sqlTx},
+		Tolerances:     &ToleranceRepo{db: sqlTx},
+		RuleFlags:      &RuleFlagRepo{db: sqlTx},
+		RoutingRules:   &RoutingRuleRepo{db: sqlTx},
+		JiraIssues:     &JiraIssueRepo{db: sqlTx},
+		Cases:          &CaseRepo{db: sqlTx},
+		Suggestions:    &SuggestionRepo{db: sqlTx},
+		PayoutHolds:    &PayoutHoldRepo{db: sqlTx},
+		BatchApprovals: &BatchApprovalRepo{db: sqlTx},
+		History:        &HistoryRepo{db: sqlTx},
+		Transforms:     &TransformRepo{db: sqlTx},
+	}
+	if err := fn(tx); err != nil {
+		return err
+	}
+	if err := sqlTx.Commit(); err != nil {
+		return fmt.Errorf("commit: %w", err)
+	}
+	return nil
+}
+
+// txScope is a transaction a repository method writes in. When the
+// repository is already inside a unit of work it joins that transaction,
+// and commit and rollback are left to the unit of work.
+type txScope struct {
+	*sql.Tx
+	owned bool
+}
+
+// begin starts a transaction on db, or joins db if it already is one.
+func begin(db dbtx) (*txScope, error) {
+	switch db := db.(type) {
+	case *sql.Tx:
+		return &txScope{Tx: db}, nil
+	case *sql.DB:
+		tx, err := db.Begin()
+		if err != nil {
+			return nil, err
+		}
+		return &txScope{Tx: tx, owned: true}, nil
+	default:
+		return nil, fmt.Errorf("begin: unsupported %T", db)
+	}
+}
+
+func (s *txScope) Commit() error {
+	if !s.owned {
+		return nil
+	}
+	return s.Tx.Commit()
+}
+
+func (s *txScope) Rollback() error {
+	if !s.owned {
+		return nil
+	}
+	return s.Tx.Rollback()
+}
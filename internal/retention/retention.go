@@ -0,0 +1,126 @@
+// Package retention holds the data retention policy: how long transactions
+// and settlement records are kept before a purge anonymizes or deletes
+// them.
+package retention
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/wakala/reconciler/internal/domain"
+	"github.com/wakala/reconciler/internal/repository"
+)
+
+// MinDays is the shortest retention accepted. Anything shorter would purge
+// transactions still waiting for their settlement.
+const MinDays = 30
+
+// Policy is how many days rows are kept, by processor, and what a purge
+// does to older ones.
+type Policy struct {
+	Mode domain.RetentionMode `json:"mode"`
+	// Days applies to processors not in ByProcessor; 0 keeps them forever.
+	Days        int                      `json:"days,omitempty"`
+	ByProcessor map[domain.Processor]int `json:"by_processor,omitempty"`
+}
+
+// PolicyFromEnv reads the retention policy:
+//
+//	RETENTION_DAYS               default retention in days
+//	RETENTION_DAYS_BY_PROCESSOR  per processor, e.g. afripay=365,capepay=1825
+//	RETENTION_MODE               anonymize (default) or delete
+//
+// It returns nil, nil when neither RETENTION_DAYS nor
+// RETENTION_DAYS_BY_PROCESSOR is set, in which case nothing is purged.
+func PolicyFromEnv() (*Policy, error) {
+	p := &Policy{Mode: domain.RetentionAnonymize, ByProcessor: map[domain.Processor]int{}}
+
+	if v := os.Getenv("RETENTION_DAYS"); v != "" {
+		days, err := parseDays(v)
+		if err != nil {
+			return nil, fmt.Errorf("RETENTION_DAYS: %w", err)
+		}
+		p.Days = days
+	}
+	if v := os.Getenv("RETENTION_DAYS_BY_PROCESSOR"); v != "" {
+		for _, entry := range strings.Split(v, ",") {
+			proc, days, ok := strings.Cut(strings.TrimSpace(entry), "=")
+			if !ok || strings.TrimSpace(proc) == "" {
+				return nil, fmt.Errorf("invalid RETENTION_DAYS_BY_PROCESSOR entry %q", entry)
+			}
+			n, err := parseDays(days)
+			if err != nil {
+				return nil, fmt.Errorf("RETENTION_DAYS_BY_PROCESSOR %s: %w", proc, err)
+			}
+			p.ByProcessor[domain.Processor(strings.TrimSpace(proc))] = n
+		}
+	}
+	if p.Days == 0 && len(p.ByProcessor) == 0 {
+		return nil, nil
+	}
+
+	switch mode := domain.RetentionMode(os.Getenv("RETENTION_MODE")); mode {
+	case "":
+	case domain.RetentionAnonymize, domain.RetentionDelete:
+		p.Mode = mode
+	default:
+		return nil, fmt.Errorf("RETENTION_MODE must be anonymize or delete, got %q", mode)
+	}
+	return p, nil
+}
+
+func parseDays(s string) (int, error) {
+	n, err := strconv.Atoi(strings.TrimSpace(s))
+	if err != nil || n < MinDays {
+		return 0, fmt.Errorf("must be a number of days of at least %d, got %q", MinDays, s)
+	}
+	return n, nil
+}
+
+// Cutoffs returns, as of now, the time before which each processor's rows
+// are past retention.
+func (p *Policy) Cutoffs(now time.Time) repository.RetentionCutoffs {
+	cutoffs := repository.RetentionCutoffs{ByProcessor: map[domain.Processor]time.Time{}}
+	if p.Days > 0 {
+		t := now.UTC().AddDate(0, 0, -p.Days)
+		cutoffs.Default = &t
+	}
+	for proc, days := range p.ByProcessor {
+		cutoffs.ByProcessor[proc] = now.UTC().AddDate(0, 0, -days)
+	}
+	return cutoffs
+}
+
+// Purge applies the policy as of now and returns the purge report. A dry
+// run reports what would be purged and changes nothing. Purged files kept
+// in a blob store are deleted from it once the purge is committed.
+func (p *Policy) Purge(repo *repository.RetentionRepo, now time.Time, by string, dryRun bool) (*domain.PurgeReport, error) {
+	cutoffs := p.Cutoffs(now)
+	report := &domain.PurgeReport{
+		ID:          fmt.Sprintf("PURGE-%d", now.UnixNano()),
+		Mode:        p.Mode,
+		DryRun:      dryRun,
+		RequestedBy: by,
+		PurgedAt:    now.UTC(),
+		Cutoffs:     map[string]time.Time{},
+	}
+	if cutoffs.Default != nil {
+		report.Cutoffs["*"] = *cutoffs.Default
+	}
+	for proc, t := range cutoffs.ByProcessor {
+		report.Cutoffs[string(proc)] = t
+	}
+	if err := repo.Purge(cutoffs, report); err != nil {
+		return nil, err
+	}
+	if !dryRun {
+		if _, err := repo.DeleteQueuedBlobs(); err != nil {
+			log.Printf("[retention] %v; they are deleted by the next purge", err)
+		}
+	}
+	return report, nil
+}
@@ -0,0 +1,133 @@
+package retry
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Overrides are the policy settings configured for one integration, or for
+// all of them under the name "". Nil fields keep the integration's own.
+type Overrides struct {
+	Attempts         *int
+	Backoff          *time.Duration
+	MaxBackoff       *time.Duration
+	BreakerThreshold *int
+	BreakerCooldown  *time.Duration
+}
+
+func (o Overrides) apply(p Policy) Policy {
+	if o.Attempts != nil {
+		p.Attempts = *o.Attempts
+	}
+	if o.Backoff != nil {
+		p.Backoff = *o.Backoff
+	}
+	if o.MaxBackoff != nil {
+		p.MaxBackoff = *o.MaxBackoff
+	}
+	if o.BreakerThreshold != nil {
+		p.BreakerThreshold = *o.BreakerThreshold
+	}
+	if o.BreakerCooldown != nil {
+		p.BreakerCooldown = *o.BreakerCooldown
+	}
+	return p
+}
+
+// Configure registers policy overrides by integration name. It must be
+// called before the integrations are created.
+func Configure(o map[string]Overrides) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	for name, ov := range o {
+		overrides[name] = ov
+	}
+}
+
+// OverridesFromEnv reads the policy overrides:
+//
+//	RETRY_ATTEMPTS             tries per call, including the first (>= 1)
+//	RETRY_BACKOFF              wait before the first retry, a Go duration
+//	RETRY_MAX_BACKOFF          longest wait between retries
+//	CIRCUIT_BREAKER_THRESHOLD  consecutive failures that open the circuit (0 never opens it)
+//	CIRCUIT_BREAKER_COOLDOWN   how long an open circuit refuses calls
+//
+// Each is a comma-separated list of integration=value entries, such as
+// "webhook=5,smtp=2". An entry without a name sets every integration, and
+// named entries take precedence over it.
+func OverridesFromEnv() (map[string]Overrides, error) {
+	o := make(map[string]Overrides)
+	set := func(name string, parse func(ov *Overrides, v string) bool, want string) error {
+		for _, entry := range strings.Split(os.Getenv(name), ",") {
+			entry = strings.TrimSpace(entry)
+			if entry == "" {
+				continue
+			}
+			integration, value, ok := strings.Cut(entry, "=")
+			if !ok {
+				integration, value = "", entry
+			}
+			integration, value = strings.TrimSpace(integration), strings.TrimSpace(value)
+			if ok && integration == "" {
+				return fmt.Errorf("invalid %s entry %q: want integration=value", name, entry)
+			}
+			ov := o[integration]
+			if !parse(&ov, value) {
+				return fmt.Errorf("invalid %s entry %q: want %s", name, entry, want)
+			}
+			o[integration] = ov
+		}
+		return nil
+	}
+
+	if err := set("RETRY_ATTEMPTS", func(ov *Overrides, v string) bool {
+		ov.Attempts = parseInt(v, 1)
+		return ov.Attempts != nil
+	}, "a positive integer"); err != nil {
+		return nil, err
+	}
+	if err := set("RETRY_BACKOFF", func(ov *Overrides, v string) bool {
+		ov.Backoff = parseDuration(v, false)
+		return ov.Backoff != nil
+	}, "a duration such as 2s"); err != nil {
+		return nil, err
+	}
+	if err := set("RETRY_MAX_BACKOFF", func(ov *Overrides, v string) bool {
+		ov.MaxBackoff = parseDuration(v, false)
+		return ov.MaxBackoff != nil
+	}, "a duration such as 30s"); err != nil {
+		return nil, err
+	}
+	if err := set("CIRCUIT_BREAKER_THRESHOLD", func(ov *Overrides, v string) bool {
+		ov.BreakerThreshold = parseInt(v, 0)
+		return ov.BreakerThreshold != nil
+	}, "a non-negative integer"); err != nil {
+		return nil, err
+	}
+	if err := set("CIRCUIT_BREAKER_COOLDOWN", func(ov *Overrides, v string) bool {
+		ov.BreakerCooldown = parseDuration(v, true)
+		return ov.BreakerCooldown != nil
+	}, "a positive duration such as 1m"); err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+func parseInt(v string, min int) *int {
+	n, err := strconv.Atoi(v)
+	if err != nil || n < min {
+		return nil
+	}
+	return &n
+}
+
+func parseDuration(v string, positive bool) *time.Duration {
+	d, err := time.ParseDuration(v)
+	if err != nil || d < 0 || (positive && d == 0) {
+		return nil
+	}
+	return &d
+}
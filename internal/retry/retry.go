@@ -0,0 +1,336 @@
+// Package retry retries calls to outside systems with exponential backoff,
+// and stops calling one that keeps failing until it has had time to recover.
+// Each outbound integration (webhooks, SMTP, a processor API, the report
+// mailbox) has one named Integration, shared by all its callers, with its own
+// policy, circuit breaker and counters.
+package retry
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ErrCircuitOpen is returned, wrapped, for calls refused while an
+// integration's circuit is open.
+var ErrCircuitOpen = errors.New("circuit open")
+
+// Circuit states.
+const (
+	StateClosed   = "closed"
+	StateOpen     = "open"
+	StateHalfOpen = "half_open"
+)
+
+// Policy is how an integration's calls are retried and when its circuit
+// opens.
+type Policy struct {
+	// Attempts is how many times a call is tried, including the first.
+	Attempts int
+	// Backoff is the wait before the second attempt. It doubles after each
+	// further attempt, up to MaxBackoff, and each wait is jittered down by up
+	// to half so callers that failed together do not retry together.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	// BreakerThreshold consecutive failed attempts open the circuit; 0 never
+	// opens it.
+	BreakerThreshold int
+	// BreakerCooldown is how long an open circuit refuses calls before it
+	// lets one through to test the integration.
+	BreakerCooldown time.Duration
+}
+
+// DefaultPolicy is the policy of an integration that sets no other.
+var DefaultPolicy = Policy{
+	Attempts:         3,
+	Backoff:          time.Second,
+	MaxBackoff:       30 * time.Second,
+	BreakerThreshold: 5,
+	BreakerCooldown:  time.Minute,
+}
+
+// MarshalJSON writes the durations as Go duration strings.
+func (p Policy) MarshalJSON() ([]byte, error) {
+	return json.Marshal(map[string]any{
+		"attempts":          p.Attempts,
+		"backoff":           p.Backoff.String(),
+		"max_backoff":       p.MaxBackoff.String(),
+		"breaker_threshold": p.BreakerThreshold,
+		"breaker_cooldown":  p.BreakerCooldown.String(),
+	})
+}
+
+// Stats are an integration's counters since startup and its circuit state.
+type Stats struct {
+	Name   string `json:"name"`
+	Policy Policy `json:"policy"`
+	State  string `json:"state"`
+	// Calls counts Do calls. Each finished one either Succeeded, Failed
+	// after its attempts, or was Rejected by the open circuit.
+	Calls     int64 `json:"calls"`
+	Succeeded int64 `json:"succeeded"`
+	Failed    int64 `json:"failed"`
+	Rejected  int64 `json:"rejected"`
+	// Attempts counts every try, and Retries the tries after a first.
+	Attempts            int64      `json:"attempts"`
+	Retries             int64      `json:"retries"`
+	ConsecutiveFailures int        `json:"consecutive_failures"`
+	CircuitOpened       int64      `json:"circuit_opened"`
+	OpenedAt            *time.Time `json:"opened_at,omitempty"`
+	LastError           string     `json:"last_error,omitempty"`
+	LastErrorAt         *time.Time `json:"last_error_at,omitempty"`
+	LastSuccessAt       *time.Time `json:"last_success_at,omitempty"`
+}
+
+// Integration retries and guards the calls to one outside system.
+type Integration struct {
+	name   string
+	policy Policy
+
+	mu       sync.Mutex
+	stats    Stats
+	openedAt time.Time
+	// probing is set while the one call a half-open circuit lets through
+	// is in flight.
+	probing bool
+}
+
+var (
+	registryMu   sync.Mutex
+	integrations = map[string]*Integration{}
+	overrides    = map[string]Overrides{}
+)
+
+// For returns the integration called name, creating it on first use with
+// policy and any overrides registered for it by Configure. Later calls with
+// the same name return the same integration, so every caller of one outside
+// system shares its circuit and counters.
+func For(name string, policy Policy) *Integration {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	if in, ok := integrations[name]; ok {
+		return in
+	}
+	if o, ok := overrides[""]; ok {
+		policy = o.apply(policy)
+	}
+	if o, ok := overrides[name]; ok {
+		policy = o.apply(policy)
+	}
+	in := &Integration{name: name, policy: policy}
+	in.stats = Stats{Name: name, Policy: policy, State: StateClosed}
+	integrations[name] = in
+	return in
+}
+
+// All returns the stats of every integration created so far, by name.
+func All() []Stats {
+	registryMu.Lock()
+	list := make([]*Integration, 0, len(integrations))
+	for _, in := range integrations {
+		list = append(list, in)
+	}
+	registryMu.Unlock()
+
+	all := make([]Stats, len(list))
+	for i, in := range list {
+		all[i] = in.Stats()
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].Name < all[j].Name })
+	return all
+}
+
+// Name returns the integration's name.
+func (in *Integration) Name() string { return in.name }
+
+// Policy returns the integration's policy.
+func (in *Integration) Policy() Policy { return in.policy }
+
+// Stats returns a copy of the integration's counters.
+func (in *Integration) Stats() Stats {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	st := in.stats
+	if in.stats.State != StateClosed {
+		opened := in.openedAt
+		st.OpenedAt = &opened
+	}
+	return st
+}
+
+// permanentError marks an error that retrying cannot fix.
+type permanentError struct{ err error }
+
+func (e *permanentError) Error() string { return e.err.Error() }
+func (e *permanentError) Unwrap() error { return e.err }
+
+// Permanent marks err as not worth retrying, such as a rejected request
+// rather than an unreachable server. Do returns it after one attempt, and
+// since the other side answered, it does not count towards opening the
+// circuit.
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &permanentError{err}
+}
+
+// RetryableStatus reports whether an HTTP response status is worth retrying:
+// server errors, 408 Request Timeout and 429 Too Many Requests.
+func RetryableStatus(code int) bool {
+	return code >= 500 || code == http.StatusRequestTimeout || code == http.StatusTooManyRequests
+}
+
+// Do calls fn until it succeeds, returns a Permanent error, or has been tried
+// Policy.Attempts times, waiting between attempts. It returns at once with an
+// error wrapping ErrCircuitOpen while the circuit is open, and with ctx's
+// error when ctx is done while waiting. fn should stop when ctx is done.
+func (in *Integration) Do(ctx context.Context, fn func(ctx context.Context) error) error {
+	in.mu.Lock()
+	in.stats.Calls++
+	in.mu.Unlock()
+
+	wait := in.policy.Backoff
+	for attempt := 1; ; attempt++ {
+		if err := in.allow(attempt > 1); err != nil {
+			return err
+		}
+		err := fn(ctx)
+		if err != nil && ctx.Err() != nil {
+			// Cancelled by the caller: the integration is not at fault.
+			in.release()
+			in.finish(err)
+			return err
+		}
+		var perm *permanentError
+		isPermanent := errors.As(err, &perm)
+		in.record(err, isPermanent)
+
+		switch {
+		case err == nil:
+			in.finish(nil)
+			return nil
+		case isPermanent:
+			in.finish(err)
+			return perm.err
+		case attempt >= in.policy.Attempts:
+			in.finish(err)
+			if attempt > 1 {
+				return fmt.Errorf("after %d attempts: %w", attempt, err)
+			}
+			return err
+		}
+
+		t := time.NewTimer(jitter(wait))
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			in.finish(err)
+			return ctx.Err()
+		case <-t.C:
+		}
+		if wait *= 2; in.policy.MaxBackoff > 0 && wait > in.policy.MaxBackoff {
+			wait = in.policy.MaxBackoff
+		}
+	}
+}
+
+// jitter returns a random wait between d/2 and d.
+func jitter(d time.Duration) time.Duration {
+	if d <= 1 {
+		return d
+	}
+	return d/2 + rand.N(d/2+1)
+}
+
+// allow reports, as an error, whether an attempt may be made now. Once an
+// open circuit has cooled down, one attempt is let through to test it.
+func (in *Integration) allow(retry bool) error {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	switch in.stats.State {
+	case StateOpen:
+		if time.Since(in.openedAt) < in.policy.BreakerCooldown {
+			return in.reject()
+		}
+		in.stats.State = StateHalfOpen
+		in.probing = true
+	case StateHalfOpen:
+		if in.probing {
+			return in.reject()
+		}
+		in.probing = true
+	}
+	in.stats.Attempts++
+	if retry {
+		in.stats.Retries++
+	}
+	return nil
+}
+
+func (in *Integration) reject() error {
+	in.stats.Rejected++
+	return fmt.Errorf("%s: %w after %d consecutive failures, retrying after %s; last error: %s",
+		in.name, ErrCircuitOpen, in.stats.ConsecutiveFailures,
+		in.openedAt.Add(in.policy.BreakerCooldown).UTC().Format(time.RFC3339), in.stats.LastError)
+}
+
+// release ends a half-open test attempt that came to nothing.
+func (in *Integration) release() {
+	in.mu.Lock()
+	in.probing = false
+	in.mu.Unlock()
+}
+
+// record updates the circuit after one attempt. A success or a permanent
+// error closes it; one more transient failure may open it, and a failed test
+// of a half-open circuit opens it again.
+func (in *Integration) record(err error, permanent bool) {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	now := time.Now().UTC()
+	in.probing = false
+	if err != nil {
+		in.stats.LastError = err.Error()
+		in.stats.LastErrorAt = &now
+	}
+	if err == nil || permanent {
+		if err == nil {
+			in.stats.LastSuccessAt = &now
+		}
+		in.stats.ConsecutiveFailures = 0
+		if in.stats.State != StateClosed {
+			in.stats.State = StateClosed
+			log.Printf("[retry] Circuit for %s closed after a successful attempt", in.name)
+		}
+		return
+	}
+
+	in.stats.ConsecutiveFailures++
+	threshold := in.policy.BreakerThreshold
+	if in.stats.State == StateHalfOpen || (in.stats.State == StateClosed && threshold > 0 && in.stats.ConsecutiveFailures >= threshold) {
+		in.stats.State = StateOpen
+		in.stats.CircuitOpened++
+		in.openedAt = now
+		log.Printf("[retry] WARNING: circuit for %s opened after %d consecutive failures (last: %v); calls fail fast for %s",
+			in.name, in.stats.ConsecutiveFailures, err, in.policy.BreakerCooldown)
+	}
+}
+
+// finish counts how a call ended.
+func (in *Integration) finish(err error) {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	if err == nil {
+		in.stats.Succeeded++
+	} else {
+		in.stats.Failed++
+	}
+}
@@ -0,0 +1,98 @@
+package testgen
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// writeAfriPayCSV renders rows in the csv_a format.
+func writeAfriPayCSV(spec processorSpec, rows []settlementRow, _ time.Time) ([]byte, error) {
+	return writeDelimited(',', []string{
+		"transaction_id", "merchant_ref", "settlement_date",
+		"gross_amount_kes", "fee_kes", "net_kes", "batch_id",
+	}, spec.batchID, rows)
+}
+
+// writeCapePayCSV renders rows in the pipe-delimited csv_c format.
+func writeCapePayCSV(spec processorSpec, rows []settlementRow, _ time.Time) ([]byte, error) {
+	return writeDelimited('|', []string{
+		"TXREF", "MERCHANT", "SETTLE_DATE",
+		"AMOUNT_ZAR", "DEDUCTIONS_ZAR", "NET_ZAR", "BATCH",
+	}, spec.batchID, rows)
+}
+
+func writeDelimited(comma rune, header []string, batchID string, rows []settlementRow) ([]byte, error) {
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	w.Comma = comma
+
+	w.Write(header)
+	for _, row := range rows {
+		w.Write([]string{
+			row.ref,
+			row.merchantID,
+			row.settleDate.Format("2006-01-02"),
+			fmt.Sprintf("%.2f", row.gross),
+			fmt.Sprintf("%.2f", row.fee),
+			fmt.Sprintf("%.2f", row.net),
+			batchID,
+		})
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// writeNairaGatewayJSON renders rows in the json_b format. Settlement times
+// are end of day in WAT.
+func writeNairaGatewayJSON(spec processorSpec, rows []settlementRow, reportDate time.Time) ([]byte, error) {
+	type record struct {
+		Ref           string  `json:"ref"`
+		MerchantID    string  `json:"merchant_id"`
+		AmountNGN     float64 `json:"amount_ngn"`
+		ProcessingFee float64 `json:"processing_fee_ngn"`
+		PayoutNGN     float64 `json:"payout_ngn"`
+		SettledAt     string  `json:"settled_at"`
+	}
+
+	type fileFormat struct {
+		BatchID        string   `json:"batch_id"`
+		SettlementDate string   `json:"settlement_date"`
+		Records        []record `json:"records"`
+	}
+
+	const endOfDayWAT = "T23:59:59+01:00"
+	out := fileFormat{
+		BatchID:        spec.batchID,
+		SettlementDate: reportDate.Format("2006-01-02") + endOfDayWAT,
+	}
+	for _, row := range rows {
+		out.Records = append(out.Records, record{
+			Ref:           row.ref,
+			MerchantID:    row.merchantID,
+			AmountNGN:     row.gross,
+			ProcessingFee: row.fee,
+			PayoutNGN:     row.net,
+			SettledAt:     row.settleDate.Format("2006-01-02") + endOfDayWAT,
+		})
+	}
+
+	return MarshalIndent(out)
+}
+
+// MarshalIndent encodes v the way the testdata JSON files are written: two
+// space indent with a trailing newline.
+func MarshalIndent(v any) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
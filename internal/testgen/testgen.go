@@ -0,0 +1,333 @@
+// Package testgen builds deterministic synthetic transactions and settlement
+// reports. The files in testdata/ are generated from Default(); contributors
+// can build their own scenarios to exercise parsers and reconciliation with a
+// known number of missing, mismatched and orphaned settlements.
+package testgen
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"strings"
+	"time"
+
+	"github.com/wakala/reconciler/internal/currency"
+	"github.com/wakala/reconciler/internal/domain"
+)
+
+// Scenario describes a dataset. The same scenario always produces the same
+// output.
+type Scenario struct {
+	Seed      int64
+	Start     time.Time
+	Days      int
+	Merchants int
+	// Processors are generated in order; reordering them changes the output.
+	Processors []ProcessorScenario
+}
+
+// ProcessorScenario controls the transactions and settlement report of one
+// processor.
+type ProcessorScenario struct {
+	Processor    domain.Processor
+	Transactions int
+	// MissingPct is the percentage of captured transactions left out of the
+	// settlement report.
+	MissingPct int
+	// MismatchPct is the percentage of captured transactions reported with a
+	// gross amount 3-5% higher than charged.
+	MismatchPct int
+	// Orphans is how many of the first captured transactions are reported
+	// under a reference that matches no transaction.
+	Orphans int
+}
+
+// Default is the scenario behind the files in testdata/: 155 transactions
+// over two weeks in January 2024, with 8% missing, 4% mismatched and two
+// orphaned settlements per processor.
+func Default() Scenario {
+	return Scenario{
+		Seed:      42,
+		Start:     time.Date(2024, 1, 8, 0, 0, 0, 0, time.UTC),
+		Days:      13,
+		Merchants: 20,
+		Processors: []ProcessorScenario{
+			{Processor: domain.ProcessorAfriPay, Transactions: 50, MissingPct: 8, MismatchPct: 4, Orphans: 2},
+			{Processor: domain.ProcessorNairaGateway, Transactions: 55, MissingPct: 8, MismatchPct: 4, Orphans: 2},
+			{Processor: domain.ProcessorCapePay, Transactions: 50, MissingPct: 8, MismatchPct: 4, Orphans: 2},
+		},
+	}
+}
+
+// WithMissing returns a copy of s with the missing percentage of processor p
+// set to pct.
+func (s Scenario) WithMissing(p domain.Processor, pct int) Scenario {
+	return s.withProcessor(p, func(ps *ProcessorScenario) { ps.MissingPct = pct })
+}
+
+// WithMismatch returns a copy of s with the mismatch percentage of processor
+// p set to pct.
+func (s Scenario) WithMismatch(p domain.Processor, pct int) Scenario {
+	return s.withProcessor(p, func(ps *ProcessorScenario) { ps.MismatchPct = pct })
+}
+
+// WithOrphans returns a copy of s with n orphaned settlements for processor p.
+func (s Scenario) WithOrphans(p domain.Processor, n int) Scenario {
+	return s.withProcessor(p, func(ps *ProcessorScenario) { ps.Orphans = n })
+}
+
+// Clean returns a copy of s where every captured transaction settles exactly.
+func (s Scenario) Clean() Scenario {
+	out := s.copy()
+	for i := range out.Processors {
+		out.Processors[i].MissingPct = 0
+		out.Processors[i].MismatchPct = 0
+		out.Processors[i].Orphans = 0
+	}
+	return out
+}
+
+func (s Scenario) withProcessor(p domain.Processor, fn func(*ProcessorScenario)) Scenario {
+	out := s.copy()
+	for i := range out.Processors {
+		if out.Processors[i].Processor == p {
+			fn(&out.Processors[i])
+		}
+	}
+	return out
+}
+
+func (s Scenario) copy() Scenario {
+	s.Processors = append([]ProcessorScenario(nil), s.Processors...)
+	return s
+}
+
+// Report is a generated settlement file, ready to ingest.
+type Report struct {
+	Processor domain.Processor
+	Format    string
+	Filename  string
+	Records   int
+	Data      []byte
+}
+
+// Expected counts what reconciliation should find for one processor.
+type Expected struct {
+	Captured   int `json:"captured"`
+	Missing    int `json:"missing"`
+	Mismatched int `json:"mismatched"`
+	Orphaned   int `json:"orphaned"`
+}
+
+// Dataset is the output of Generate.
+type Dataset struct {
+	Transactions []domain.Transaction
+	Reports      []Report
+	Expected     map[domain.Processor]Expected
+}
+
+// processorSpec holds what is fixed per processor: its market and the shape
+// of its settlement file.
+type processorSpec struct {
+	currency string
+	country  string
+	prefix   string
+	batchID  string
+	feeRate  float64
+	format   string
+	filename string
+	label    string
+	write    func(spec processorSpec, rows []settlementRow, reportDate time.Time) ([]byte, error)
+}
+
+var processorSpecs = map[domain.Processor]processorSpec{
+	domain.ProcessorAfriPay: {
+		currency: "KES", country: "KE", prefix: "AP-TXN", batchID: "KE-BATCH-001", feeRate: 0.015,
+		format: "csv_a", filename: "processor_a_afripay.csv", label: "AfriPay CSV", write: writeAfriPayCSV,
+	},
+	domain.ProcessorNairaGateway: {
+		currency: "NGN", country: "NG", prefix: "NG-TXN", batchID: "NG-BATCH-001", feeRate: 0.01,
+		format: "json_b", filename: "processor_b_nairagateway.json", label: "NairaGateway JSON", write: writeNairaGatewayJSON,
+	},
+	domain.ProcessorCapePay: {
+		currency: "ZAR", country: "ZA", prefix: "CP-TXN", batchID: "ZA-BATCH-001", feeRate: 0.02,
+		format: "csv_c", filename: "processor_c_capepay.csv", label: "CapePay CSV", write: writeCapePayCSV,
+	},
+}
+
+// Label returns a human-readable name for the report, e.g. "AfriPay CSV".
+func (r Report) Label() string {
+	return processorSpecs[r.Processor].label
+}
+
+// settlementRow is one line of a generated report, before formatting.
+type settlementRow struct {
+	ref        string
+	merchantID string
+	settleDate time.Time
+	gross      float64
+	fee        float64
+	net        float64
+}
+
+// Generate builds the transactions and settlement reports for s.
+func Generate(s Scenario) (*Dataset, error) {
+	for _, ps := range s.Processors {
+		if _, ok := processorSpecs[ps.Processor]; !ok {
+			return nil, fmt.Errorf("unsupported processor: %s", ps.Processor)
+		}
+		if ps.MissingPct < 0 || ps.MismatchPct < 0 || ps.MissingPct+ps.MismatchPct > 100 {
+			return nil, fmt.Errorf("%s: missing and mismatch percentages must be between 0 and 100 combined", ps.Processor)
+		}
+	}
+	if s.Days < 1 || s.Merchants < 1 {
+		return nil, fmt.Errorf("scenario needs at least one day and one merchant")
+	}
+
+	rng := rand.New(rand.NewSource(s.Seed))
+	ds := &Dataset{Expected: make(map[domain.Processor]Expected)}
+
+	merchants := make([]string, s.Merchants)
+	for i := range merchants {
+		merchants[i] = fmt.Sprintf("M%03d", i+1)
+	}
+
+	for _, ps := range s.Processors {
+		ds.Transactions = append(ds.Transactions, generateTransactions(rng, s, ps, merchants)...)
+	}
+
+	reportDate := s.Start.AddDate(0, 0, 7)
+	for _, ps := range s.Processors {
+		spec := processorSpecs[ps.Processor]
+		rows, exp := generateSettlements(rng, ps, spec, ds.Transactions)
+		data, err := spec.write(spec, rows, reportDate)
+		if err != nil {
+			return nil, fmt.Errorf("write %s report: %w", ps.Processor, err)
+		}
+		ds.Reports = append(ds.Reports, Report{
+			Processor: ps.Processor,
+			Format:    spec.format,
+			Filename:  spec.filename,
+			Records:   len(rows),
+			Data:      data,
+		})
+		ds.Expected[ps.Processor] = exp
+	}
+
+	return ds, nil
+}
+
+func generateTransactions(rng *rand.Rand, s Scenario, ps ProcessorScenario, merchants []string) []domain.Transaction {
+	spec := processorSpecs[ps.Processor]
+	txns := make([]domain.Transaction, 0, ps.Transactions)
+
+	for i := 1; i <= ps.Transactions; i++ {
+		day := rng.Intn(s.Days)
+		hour := rng.Intn(24)
+		minute := rng.Intn(60)
+		createdAt := s.Start.AddDate(0, 0, day).Add(
+			time.Duration(hour)*time.Hour + time.Duration(minute)*time.Minute,
+		)
+
+		// USD amount between 5 and 500.
+		usdAmount := round2(5 + rng.Float64()*495)
+		localAmount, _ := currency.FromUSD(usdAmount, spec.currency)
+		localAmount = round2(localAmount)
+
+		// Status distribution: 85% captured, 10% authorized, 5% failed.
+		var status domain.TransactionStatus
+		var capturedAt *time.Time
+		roll := rng.Float64()
+		switch {
+		case roll < 0.85:
+			status = domain.StatusCaptured
+			t := createdAt.Add(time.Duration(rng.Intn(120)+1) * time.Minute)
+			capturedAt = &t
+		case roll < 0.95:
+			status = domain.StatusAuthorized
+		default:
+			status = domain.StatusFailed
+		}
+
+		txns = append(txns, domain.Transaction{
+			ID:                 fmt.Sprintf("WKL-%s-%03d", strings.ToUpper(string(ps.Processor)), i),
+			ProcessorReference: fmt.Sprintf("%s-%03d", spec.prefix, i),
+			Processor:          ps.Processor,
+			MerchantID:         merchants[rng.Intn(len(merchants))],
+			CustomerCountry:    spec.country,
+			MerchantCountry:    spec.country,
+			Amount:             localAmount,
+			Currency:           spec.currency,
+			USDAmount:          usdAmount,
+			Status:             status,
+			CreatedAt:          createdAt,
+			CapturedAt:         capturedAt,
+		})
+	}
+	return txns
+}
+
+// generateSettlements reports each captured transaction of the processor the
+// day after it was created, dropping or inflating a share of them per the
+// scenario.
+func generateSettlements(rng *rand.Rand, ps ProcessorScenario, spec processorSpec, txns []domain.Transaction) ([]settlementRow, Expected) {
+	var captured []domain.Transaction
+	for _, t := range txns {
+		if t.Processor == ps.Processor && t.Status == domain.StatusCaptured {
+			captured = append(captured, t)
+		}
+	}
+
+	missingAbove := float64(100-ps.MissingPct) / 100
+	mismatchAbove := float64(100-ps.MissingPct-ps.MismatchPct) / 100
+	exp := Expected{Captured: len(captured)}
+	var rows []settlementRow
+
+	for i, txn := range captured {
+		roll := rng.Float64()
+
+		if roll > missingAbove {
+			exp.Missing++
+			continue
+		}
+
+		gross := txn.Amount
+		fee := round2(gross * spec.feeRate)
+		net := round2(gross - fee)
+
+		// Simulates a processor reporting a different charged amount.
+		mismatched := roll > mismatchAbove
+		if mismatched {
+			mismatchPct := 0.03 + rng.Float64()*0.02
+			gross = round2(gross * (1 + mismatchPct))
+			fee = round2(gross * spec.feeRate)
+			net = round2(gross - fee)
+		}
+
+		ref := txn.ProcessorReference
+		switch {
+		case i < ps.Orphans:
+			// The real transaction goes unsettled and the row matches nothing.
+			ref = fmt.Sprintf("FAKE-%s-%03d", spec.prefix[:2], i+1)
+			exp.Orphaned++
+			exp.Missing++
+		case mismatched:
+			exp.Mismatched++
+		}
+
+		rows = append(rows, settlementRow{
+			ref:        ref,
+			merchantID: txn.MerchantID,
+			settleDate: txn.CreatedAt.AddDate(0, 0, 1),
+			gross:      gross,
+			fee:        fee,
+			net:        net,
+		})
+	}
+
+	return rows, exp
+}
+
+func round2(v float64) float64 {
+	return math.Round(v*100) / 100
+}
@@ -0,0 +1,300 @@
+// Command concurrency checks that concurrent ingestion and reconciliation
+// cannot match one transaction to two settlement records or lose a match or
+// a settled status. Each round ingests the default test scenario from two
+// service stacks sharing one database file, as two server replicas would,
+// while other goroutines push webhook events that settle some of the same
+// payments again and run full reconciliations. The racehook pauses between
+// looking up a record's transaction and writing the match make the unlucky
+// interleavings happen on most rounds. Run it with the race detector:
+//
+//	go run -race -tags racehooks ./testdata/concurrency
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/wakala/reconciler/internal/domain"
+	"github.com/wakala/reconciler/internal/ingestion"
+	"github.com/wakala/reconciler/internal/racehook"
+	"github.com/wakala/reconciler/internal/reconciliation"
+	"github.com/wakala/reconciler/internal/repository"
+	"github.com/wakala/reconciler/internal/testgen"
+)
+
+// stack is one replica's services over its own connection pool.
+type stack struct {
+	db     *sql.DB
+	ingest *ingestion.Service
+	recon  *reconciliation.Service
+}
+
+func newStack(path string) (*stack, error) {
+	db, err := repository.InitDB(path)
+	if err != nil {
+		return nil, err
+	}
+	txnRepo := repository.NewTransactionRepo(db)
+	settRepo := repository.NewSettlementRepo(db)
+	discRepo := repository.NewDiscrepancyRepo(db)
+	uow := repository.NewUnitOfWork(db)
+	recon := reconciliation.NewService(txnRepo, settRepo, discRepo, repository.NewToleranceRepo(db), uow)
+	ingest := ingestion.NewService(settRepo, txnRepo, discRepo, repository.NewAlertRepo(db),
+		repository.NewPeriodRepo(db), repository.NewTransformRepo(db), recon, uow)
+	return &stack{db: db, ingest: ingest, recon: recon}, nil
+}
+
+func main() {
+	rounds := flag.Int("rounds", 5, "rounds to run, each on a fresh database")
+	reconcilers := flag.Int("reconcilers", 4, "goroutines running full reconciliations")
+	delay := flag.Duration("delay", 2*time.Millisecond, "longest racehook pause")
+	verbose := flag.Bool("v", false, "keep the services' log output")
+	flag.Parse()
+
+	if !racehook.Enabled {
+		fmt.Println("build with -tags racehooks, e.g. go run -race -tags racehooks ./testdata/concurrency")
+		os.Exit(2)
+	}
+	racehook.SetMaxDelay(*delay)
+	if !*verbose {
+		log.SetOutput(io.Discard)
+	}
+
+	ds, err := testgen.Generate(testgen.Default())
+	if err != nil {
+		panic(err)
+	}
+
+	failed := 0
+	for i := 1; i <= *rounds; i++ {
+		summary, err := runRound(ds, *reconcilers)
+		if err != nil {
+			fmt.Printf("FAIL round %d: %v\n", i, err)
+			failed++
+			continue
+		}
+		fmt.Printf("ok   round %d: %s\n", i, summary)
+	}
+	if failed > 0 {
+		fmt.Printf("%d of %d rounds failed\n", failed, *rounds)
+		os.Exit(1)
+	}
+}
+
+// runRound runs one round on a fresh database and checks the outcome.
+func runRound(ds *testgen.Dataset, reconcilers int) (string, error) {
+	dir, err := os.MkdirTemp("", "wakala-concurrency-")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "wakala.db")
+
+	var stacks [2]*stack
+	for i := range stacks {
+		if stacks[i], err = newStack(path); err != nil {
+			return "", err
+		}
+		defer stacks[i].db.Close()
+	}
+	if _, err := repository.NewTransactionRepo(stacks[0].db).BulkInsert(ds.Transactions); err != nil {
+		return "", fmt.Errorf("seed: %w", err)
+	}
+
+	var (
+		wg      sync.WaitGroup
+		errMu   sync.Mutex
+		errs    []error
+		retries int
+	)
+	// do runs fn, retrying while the other replica holds the database.
+	do := func(what string, fn func() error) {
+		defer wg.Done()
+		for attempt := 0; ; attempt++ {
+			err := fn()
+			if err == nil {
+				return
+			}
+			if busy(err) && attempt < 200 {
+				errMu.Lock()
+				retries++
+				errMu.Unlock()
+				time.Sleep(time.Duration(1+rand.Intn(10)) * time.Millisecond)
+				continue
+			}
+			errMu.Lock()
+			errs = append(errs, fmt.Errorf("%s: %w", what, err))
+			errMu.Unlock()
+			return
+		}
+	}
+
+	for i, rep := range ds.Reports {
+		st := stacks[i%2]
+		wg.Add(1)
+		go do("ingest "+rep.Filename, func() error {
+			_, err := st.ingest.IngestReport(rep.Data, string(rep.Processor), rep.Format, ingestion.IngestOptions{})
+			return err
+		})
+	}
+	events := duplicateEvents(ds)
+	for i, ev := range events {
+		st := stacks[(i+1)%2]
+		wg.Add(1)
+		go do("webhook "+ev.ProcessorTransactionID, func() error {
+			_, err := st.ingest.IngestEvent(string(ev.Processor), ev)
+			return err
+		})
+	}
+	for i := 0; i < reconcilers; i++ {
+		st := stacks[i%2]
+		wg.Add(1)
+		go do("reconcile", func() error {
+			_, err := st.recon.RunFullReconciliation()
+			return err
+		})
+	}
+	wg.Wait()
+	if len(errs) > 0 {
+		return "", errors.Join(errs...)
+	}
+
+	// A last run picks up records that arrived after every other run.
+	wg.Add(1)
+	do("final reconcile", func() error {
+		_, err := stacks[0].recon.RunFullReconciliation()
+		return err
+	})
+	if len(errs) > 0 {
+		return "", errors.Join(errs...)
+	}
+
+	matched, unmatched, err := check(stacks[0].db)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%d records matched, %d left unmatched, %d webhook duplicates, %d busy retries",
+		matched, unmatched, len(events), retries), nil
+}
+
+// duplicateEvents settles every fifth transaction of the scenario a second
+// time through the webhook, in a batch of its own, as a processor retrying
+// a settlement it already reported would.
+func duplicateEvents(ds *testgen.Dataset) []domain.SettlementRecord {
+	var events []domain.SettlementRecord
+	for i, txn := range ds.Transactions {
+		if i%5 != 0 || txn.CapturedAt == nil {
+			continue
+		}
+		fee := float64(int(txn.Amount*1.5)) / 100
+		events = append(events, domain.SettlementRecord{
+			Processor:              txn.Processor,
+			ProcessorTransactionID: txn.ProcessorReference,
+			GrossAmount:            txn.Amount,
+			FeeAmount:              fee,
+			NetAmount:              txn.Amount - fee,
+			Currency:               txn.Currency,
+			SettlementDate:         txn.CapturedAt.AddDate(0, 0, 1).UTC().Truncate(24 * time.Hour),
+		})
+	}
+	return events
+}
+
+// check verifies the invariants concurrent runs must keep and returns the
+// number of matched and unmatched payment records.
+func check(db *sql.DB) (matched, unmatched int, err error) {
+	var doubles []string
+	rows, err := db.Query(`
+		SELECT wakala_transaction_id, COUNT(*) FROM settlement_records
+		WHERE wakala_transaction_id IS NOT NULL
+		GROUP BY 1 HAVING COUNT(*) > 1`)
+	if err != nil {
+		return 0, 0, err
+	}
+	for rows.Next() {
+		var id string
+		var n int
+		if err := rows.Scan(&id, &n); err != nil {
+			rows.Close()
+			return 0, 0, err
+		}
+		doubles = append(doubles, fmt.Sprintf("%s (%d records)", id, n))
+	}
+	rows.Close()
+	if len(doubles) > 0 {
+		return 0, 0, fmt.Errorf("transactions matched more than once: %s", strings.Join(doubles, ", "))
+	}
+
+	// A report stored without all its records lost them to a failed write;
+	// the scenario has no duplicate records that would be skipped.
+	var partial int
+	if err := db.QueryRow(`
+		SELECT COUNT(*) FROM settlement_reports r
+		WHERE r.record_count != (SELECT COUNT(*) FROM settlement_records sr WHERE sr.report_id = r.id)`).Scan(&partial); err != nil {
+		return 0, 0, err
+	}
+	if partial > 0 {
+		return 0, 0, fmt.Errorf("%d reports are missing records", partial)
+	}
+
+	var unsettled int
+	if err := db.QueryRow(`
+		SELECT COUNT(*) FROM transactions t
+		WHERE t.status != ? AND EXISTS (SELECT 1 FROM settlement_records sr WHERE sr.wakala_transaction_id = t.id)`,
+		string(domain.StatusSettled)).Scan(&unsettled); err != nil {
+		return 0, 0, err
+	}
+	if unsettled > 0 {
+		return 0, 0, fmt.Errorf("%d matched transactions are not settled", unsettled)
+	}
+
+	// An unmatched record whose transaction no record settled lost its
+	// match.
+	txnRepo := repository.NewTransactionRepo(db)
+	records, err := repository.NewSettlementRepo(db).GetUnmatchedRecords()
+	if err != nil {
+		return 0, 0, err
+	}
+	var lost []string
+	for _, rec := range records {
+		txn, err := txnRepo.GetByProcessorRef(string(rec.Processor), rec.ProcessorTransactionID)
+		if errors.Is(err, sql.ErrNoRows) {
+			continue
+		}
+		if err != nil {
+			return 0, 0, err
+		}
+		var links int
+		if err := db.QueryRow("SELECT COUNT(*) FROM settlement_records WHERE wakala_transaction_id = ?", txn.ID).Scan(&links); err != nil {
+			return 0, 0, err
+		}
+		if links == 0 {
+			lost = append(lost, rec.ID)
+		}
+	}
+	if len(lost) > 0 {
+		return 0, 0, fmt.Errorf("records left unmatched although their transaction is unsettled: %s", strings.Join(lost, ", "))
+	}
+
+	if err := db.QueryRow("SELECT COUNT(*) FROM settlement_records WHERE wakala_transaction_id IS NOT NULL").Scan(&matched); err != nil {
+		return 0, 0, err
+	}
+	return matched, len(records), nil
+}
+
+// busy reports whether err is SQLite refusing a write because the other
+// replica's write got in first.
+func busy(err error) bool {
+	msg := err.Error()
+	return strings.Contains(msg, "SQLITE_BUSY") || strings.Contains(msg, "database is locked")
+}
@@ -0,0 +1,178 @@
+// Command golden checks every settlement parser against recorded output.
+// Each case parses one input file and compares the normalized records,
+// skipped rows and warnings with testdata/golden/<name>.golden.json. Run
+// with -update after an intended parser change and review the diff.
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/wakala/reconciler/internal/domain"
+	"github.com/wakala/reconciler/internal/ingestion"
+	"github.com/wakala/reconciler/internal/testgen"
+)
+
+// goldenReportID is the report ID every case is parsed under, so record IDs
+// are stable.
+const goldenReportID = "golden"
+
+type goldenCase struct {
+	name   string
+	input  string
+	format string
+}
+
+var cases = []goldenCase{
+	{"afripay", "testdata/processor_a_afripay.csv", "csv_a"},
+	{"nairagateway", "testdata/processor_b_nairagateway.json", "json_b"},
+	{"capepay", "testdata/processor_c_capepay.csv", "csv_c"},
+	{"mpesa", "testdata/mpesa_paybill_statement.csv", "csv_mpesa"},
+	{"afripay_warnings", "testdata/golden/input/afripay_warnings.csv", "csv_a"},
+	{"capepay_warnings", "testdata/golden/input/capepay_warnings.csv", "csv_c"},
+	{"afripay_bom", "testdata/golden/input/afripay_bom.csv", "csv_a"},
+	{"capepay_windows1252", "testdata/golden/input/capepay_windows1252.csv", "csv_c"},
+	{"afripay_reordered", "testdata/golden/input/afripay_reordered.csv", "csv_a"},
+	{"nairagateway_v2", "testdata/golden/input/nairagateway_v2.json", "json_b"},
+	{"afripay_totals", "testdata/golden/input/afripay_totals.csv", "csv_a"},
+	{"afripay_fee_split", "testdata/golden/input/afripay_fee_split.csv", "csv_a"},
+	{"nairagateway_wht", "testdata/golden/input/nairagateway_wht.json", "json_b"},
+}
+
+// goldenOutput is what gets recorded for a case.
+type goldenOutput struct {
+	BatchID  string                    `json:"batch_id"`
+	Records  []domain.SettlementRecord `json:"records"`
+	Skipped  []ingestion.SkippedRow    `json:"skipped"`
+	Warnings []domain.ReportWarning    `json:"warnings"`
+	// ControlTotals is left out for reports without a totals row.
+	ControlTotals *domain.ControlTotals `json:"control_totals,omitempty"`
+}
+
+func main() {
+	update := flag.Bool("update", false, "rewrite golden files from the current parser output")
+	flag.Parse()
+
+	failed := 0
+	for _, c := range cases {
+		got, err := render(c)
+		if err != nil {
+			fmt.Printf("FAIL %s: %v\n", c.name, err)
+			failed++
+			continue
+		}
+
+		path := filepath.Join("testdata", "golden", c.name+".golden.json")
+		if *update {
+			if err := os.WriteFile(path, got, 0o644); err != nil {
+				panic(err)
+			}
+			fmt.Printf("updated %s\n", path)
+			continue
+		}
+
+		want, err := os.ReadFile(path)
+		if err != nil {
+			fmt.Printf("FAIL %s: %v\n", c.name, err)
+			failed++
+			continue
+		}
+		if !bytes.Equal(got, want) {
+			fmt.Printf("FAIL %s: output differs from %s\n%s", c.name, path, firstDiff(want, got))
+			failed++
+			continue
+		}
+		fmt.Printf("ok   %s\n", c.name)
+	}
+
+	// The checked-in test data must still be what testgen.Default() produces.
+	if err := checkDefaultScenario(); err != nil {
+		fmt.Printf("FAIL testgen: %v\n", err)
+		failed++
+	} else {
+		fmt.Printf("ok   testgen\n")
+	}
+
+	if failed > 0 {
+		fmt.Printf("%d golden checks failed; if a parser change is intended, run with -update\n", failed)
+		os.Exit(1)
+	}
+}
+
+func render(c goldenCase) ([]byte, error) {
+	data, err := os.ReadFile(c.input)
+	if err != nil {
+		return nil, err
+	}
+	parsed, err := ingestion.Parse(c.format, data, goldenReportID)
+	if err != nil {
+		return nil, err
+	}
+
+	out := goldenOutput{
+		BatchID:  parsed.BatchID,
+		Records:  parsed.Records,
+		Skipped:  parsed.Skipped,
+		Warnings: parsed.Warnings,
+	}
+	out.ControlTotals = parsed.ControlTotals
+	if out.Records == nil {
+		out.Records = []domain.SettlementRecord{}
+	}
+	if out.Skipped == nil {
+		out.Skipped = []ingestion.SkippedRow{}
+	}
+	if out.Warnings == nil {
+		out.Warnings = []domain.ReportWarning{}
+	}
+	return testgen.MarshalIndent(out)
+}
+
+func checkDefaultScenario() error {
+	ds, err := testgen.Generate(testgen.Default())
+	if err != nil {
+		return err
+	}
+	txns, err := testgen.MarshalIndent(ds.Transactions)
+	if err != nil {
+		return err
+	}
+
+	files := map[string][]byte{"transactions.json": txns}
+	for _, rep := range ds.Reports {
+		files[rep.Filename] = rep.Data
+	}
+	for name, got := range files {
+		want, err := os.ReadFile(filepath.Join("testdata", name))
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(got, want) {
+			return fmt.Errorf("testdata/%s is out of date; run make generate-testdata\n%s", name, firstDiff(want, got))
+		}
+	}
+	return nil
+}
+
+// firstDiff describes the first line where want and got differ.
+func firstDiff(want, got []byte) string {
+	wl := strings.Split(string(want), "\n")
+	gl := strings.Split(string(got), "\n")
+	for i := 0; i < len(wl) || i < len(gl); i++ {
+		var w, g string
+		if i < len(wl) {
+			w = wl[i]
+		}
+		if i < len(gl) {
+			g = gl[i]
+		}
+		if w != g {
+			return fmt.Sprintf("  line %d\n    want: %s\n    got:  %s\n", i+1, strings.TrimSpace(w), strings.TrimSpace(g))
+		}
+	}
+	return ""
+}
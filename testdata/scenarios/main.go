@@ -0,0 +1,492 @@
+// Command scenarios checks reconciliation against specifications written as
+// YAML files in testdata/scenarios. Each scenario lists transactions, the
+// settlement rows processors reported for them and what reconciliation
+// should find; the runner loads it into a fresh in-memory database, sends
+// the rows through the settlement webhook path, runs a full reconciliation
+// as of the scenario's as_of time and reports every difference from the
+// expectation. See the README for the file format.
+//
+//	go run ./testdata/scenarios [-v] [file.yaml ...]
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/wakala/reconciler/internal/currency"
+	"github.com/wakala/reconciler/internal/domain"
+	"github.com/wakala/reconciler/internal/ingestion"
+	"github.com/wakala/reconciler/internal/reconciliation"
+	"github.com/wakala/reconciler/internal/repository"
+)
+
+// scenarioDir is where scenarios are found when no files are named.
+const scenarioDir = "testdata/scenarios"
+
+// defaultMerchant is the merchant of transactions that do not name one.
+const defaultMerchant = "M-SCENARIO"
+
+type scenario struct {
+	Name        string `yaml:"name"`
+	Description string `yaml:"description"`
+	// AsOf is when the reconciliation runs. Captured transactions older
+	// than the settlement window at AsOf with no settlement are missing.
+	AsOf               time.Time               `yaml:"as_of"`
+	Tolerances         *toleranceSpec          `yaml:"tolerances"`
+	MerchantTolerances []merchantToleranceSpec `yaml:"merchant_tolerances"`
+	Transactions       []transactionSpec       `yaml:"transactions"`
+	Settlements        []settlementSpec        `yaml:"settlements"`
+	Expect             expectation             `yaml:"expect"`
+}
+
+// toleranceSpec overrides the default tolerances, in the units of the
+// MISMATCH_PCT_TOLERANCE, MISMATCH_ABS_TOLERANCE_USD and
+// SETTLEMENT_WINDOW_HOURS settings.
+type toleranceSpec struct {
+	MismatchPct           *float64 `yaml:"mismatch_pct"`
+	MismatchAbsUSD        *float64 `yaml:"mismatch_abs_usd"`
+	SettlementWindowHours *int     `yaml:"settlement_window_hours"`
+}
+
+type merchantToleranceSpec struct {
+	Merchant        string  `yaml:"merchant"`
+	AbsToleranceUSD float64 `yaml:"abs_tolerance_usd"`
+}
+
+type transactionSpec struct {
+	ID        string           `yaml:"id"`
+	Processor domain.Processor `yaml:"processor"`
+	// Reference is the processor's ID for the payment, which settlement
+	// rows quote. It defaults to ID.
+	Reference string  `yaml:"reference"`
+	Merchant  string  `yaml:"merchant"`
+	Amount    float64 `yaml:"amount"`
+	Currency  string  `yaml:"currency"`
+	// USDAmount defaults to Amount at the built-in rate.
+	USDAmount  *float64                 `yaml:"usd_amount"`
+	Status     domain.TransactionStatus `yaml:"status"`
+	CreatedAt  *time.Time               `yaml:"created_at"`
+	CapturedAt *time.Time               `yaml:"captured_at"`
+}
+
+type settlementSpec struct {
+	// Processor and Currency default to those of the transaction whose
+	// reference the row quotes.
+	Processor domain.Processor `yaml:"processor"`
+	Reference string           `yaml:"reference"`
+	Gross     float64          `yaml:"gross"`
+	Fee       float64          `yaml:"fee"`
+	// Net defaults to Gross less Fee.
+	Net      *float64  `yaml:"net"`
+	Currency string    `yaml:"currency"`
+	Date     time.Time `yaml:"date"`
+	// Batch defaults to the processor's webhook batch for Date.
+	Batch string `yaml:"batch"`
+}
+
+type expectation struct {
+	// Matched is how many settlement rows end up matched to a transaction.
+	Matched *int `yaml:"matched"`
+	// Discrepancies is every discrepancy the run should leave: one that is
+	// not listed fails the scenario as much as a listed one that is absent.
+	Discrepancies []expectedDiscrepancy `yaml:"discrepancies"`
+	Transactions  []expectedTransaction `yaml:"transactions"`
+}
+
+// expectedDiscrepancy matches a discrepancy on the fields that are given.
+type expectedDiscrepancy struct {
+	Type        domain.DiscrepancyType `yaml:"type"`
+	Transaction string                 `yaml:"transaction"`
+	// Settlement is the reference quoted by the settlement row.
+	Settlement    string          `yaml:"settlement"`
+	Severity      domain.Severity `yaml:"severity"`
+	DifferenceUSD *float64        `yaml:"difference_usd"`
+}
+
+type expectedTransaction struct {
+	ID                   string                      `yaml:"id"`
+	Status               domain.TransactionStatus    `yaml:"status"`
+	ReconciliationStatus domain.ReconciliationStatus `yaml:"reconciliation_status"`
+}
+
+func main() {
+	verbose := flag.Bool("v", false, "keep the services' log output")
+	flag.Parse()
+
+	if !*verbose {
+		log.SetOutput(io.Discard)
+	}
+	files := flag.Args()
+	if len(files) == 0 {
+		var err error
+		if files, err = filepath.Glob(filepath.Join(scenarioDir, "*.yaml")); err != nil {
+			panic(err)
+		}
+		if len(files) == 0 {
+			fmt.Printf("no scenarios in %s\n", scenarioDir)
+			os.Exit(2)
+		}
+	}
+
+	failed := 0
+	for _, file := range files {
+		sc, err := load(file)
+		if err != nil {
+			fmt.Printf("FAIL %s: %v\n", file, err)
+			failed++
+			continue
+		}
+		summary, problems, err := run(sc)
+		switch {
+		case err != nil:
+			fmt.Printf("FAIL %s (%s): %v\n", sc.Name, file, err)
+			failed++
+		case len(problems) > 0:
+			fmt.Printf("FAIL %s (%s)\n", sc.Name, file)
+			for _, p := range problems {
+				fmt.Printf("    %s\n", p)
+			}
+			failed++
+		default:
+			fmt.Printf("ok   %s: %s\n", sc.Name, summary)
+		}
+	}
+	if failed > 0 {
+		fmt.Printf("%d of %d scenarios failed\n", failed, len(files))
+		os.Exit(1)
+	}
+}
+
+// load reads a scenario file, fills in defaults and checks that it can be
+// run.
+func load(file string) (*scenario, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	root, err := parseYAML(data)
+	if err != nil {
+		return nil, err
+	}
+	var sc scenario
+	if err := decode(root, &sc); err != nil {
+		return nil, err
+	}
+	if sc.Name == "" {
+		sc.Name = strings.TrimSuffix(filepath.Base(file), filepath.Ext(file))
+	}
+	if sc.AsOf.IsZero() {
+		return nil, errors.New("as_of is required: the time the reconciliation runs at")
+	}
+
+	byRef := map[string]*transactionSpec{}
+	for i := range sc.Transactions {
+		t := &sc.Transactions[i]
+		if t.ID == "" {
+			return nil, fmt.Errorf("transaction %d: id is required", i+1)
+		}
+		if !validProcessor(t.Processor) {
+			return nil, fmt.Errorf("transaction %s: processor must be afripay, nairagateway, capepay or mpesa, got %q", t.ID, t.Processor)
+		}
+		if t.Currency == "" {
+			return nil, fmt.Errorf("transaction %s: currency is required", t.ID)
+		}
+		if t.Reference == "" {
+			t.Reference = t.ID
+		}
+		if t.Merchant == "" {
+			t.Merchant = defaultMerchant
+		}
+		if t.Status == "" {
+			t.Status = domain.StatusCaptured
+		}
+		if t.CreatedAt == nil {
+			t.CreatedAt = t.CapturedAt
+		}
+		if t.CapturedAt == nil && (t.Status == domain.StatusCaptured || t.Status == domain.StatusSettled) {
+			t.CapturedAt = t.CreatedAt
+		}
+		if t.CreatedAt == nil {
+			return nil, fmt.Errorf("transaction %s: created_at or captured_at is required", t.ID)
+		}
+		byRef[string(t.Processor)+"/"+t.Reference] = t
+		byRef[t.Reference] = t
+	}
+	for i := range sc.Settlements {
+		s := &sc.Settlements[i]
+		if s.Reference == "" {
+			return nil, fmt.Errorf("settlement %d: reference is required", i+1)
+		}
+		t := byRef[s.Reference]
+		if s.Processor != "" {
+			t = byRef[string(s.Processor)+"/"+s.Reference]
+		}
+		if s.Processor == "" && t != nil {
+			s.Processor = t.Processor
+		}
+		if s.Currency == "" && t != nil {
+			s.Currency = t.Currency
+		}
+		if !validProcessor(s.Processor) {
+			return nil, fmt.Errorf("settlement %s: processor is required when the reference is no transaction's", s.Reference)
+		}
+		if s.Date.IsZero() {
+			return nil, fmt.Errorf("settlement %s: date is required", s.Reference)
+		}
+		if s.Net == nil {
+			net := s.Gross - s.Fee
+			s.Net = &net
+		}
+	}
+	for i, d := range sc.Expect.Discrepancies {
+		switch d.Type {
+		case domain.DiscrepancyMissingSettlement, domain.DiscrepancyAmountMismatch, domain.DiscrepancyOrphaned,
+			domain.DiscrepancyMissingPayout, domain.DiscrepancyOverpaid:
+		default:
+			return nil, fmt.Errorf("expect.discrepancies item %d: unknown type %q", i+1, d.Type)
+		}
+	}
+	return &sc, nil
+}
+
+func validProcessor(p domain.Processor) bool {
+	switch p {
+	case domain.ProcessorAfriPay, domain.ProcessorNairaGateway, domain.ProcessorCapePay, domain.ProcessorMPesa:
+		return true
+	}
+	return false
+}
+
+// run loads sc into a fresh database, reconciles it and returns a summary,
+// or the ways the outcome differs from the expectation.
+func run(sc *scenario) (string, []string, error) {
+	db, err := repository.InitDB(":memory:")
+	if err != nil {
+		return "", nil, err
+	}
+	defer db.Close()
+
+	txnRepo := repository.NewTransactionRepo(db)
+	settRepo := repository.NewSettlementRepo(db)
+	discRepo := repository.NewDiscrepancyRepo(db)
+	tolRepo := repository.NewToleranceRepo(db)
+	uow := repository.NewUnitOfWork(db)
+	recon := reconciliation.NewService(txnRepo, settRepo, discRepo, tolRepo, uow)
+	ingest := ingestion.NewService(settRepo, txnRepo, discRepo, repository.NewAlertRepo(db),
+		repository.NewPeriodRepo(db), repository.NewTransformRepo(db), recon, uow)
+
+	tol := reconciliation.DefaultTolerances()
+	if t := sc.Tolerances; t != nil {
+		if t.MismatchPct != nil {
+			tol.MismatchPct = *t.MismatchPct / 100
+		}
+		if t.MismatchAbsUSD != nil {
+			tol.MismatchAbsUSD = *t.MismatchAbsUSD
+		}
+		if t.SettlementWindowHours != nil {
+			tol.SettlementWindow = time.Duration(*t.SettlementWindowHours) * time.Hour
+		}
+	}
+	recon.SetTolerances(tol)
+	for _, mt := range sc.MerchantTolerances {
+		err := tolRepo.Upsert(&domain.MerchantTolerance{MerchantID: mt.Merchant, AbsToleranceUSD: mt.AbsToleranceUSD, UpdatedAt: sc.AsOf})
+		if err != nil {
+			return "", nil, fmt.Errorf("merchant tolerance %s: %w", mt.Merchant, err)
+		}
+	}
+
+	txns := make([]domain.Transaction, 0, len(sc.Transactions))
+	for _, t := range sc.Transactions {
+		usd, err := currency.ToUSD(t.Amount, t.Currency)
+		if t.USDAmount != nil {
+			usd, err = *t.USDAmount, nil
+		}
+		if err != nil {
+			return "", nil, fmt.Errorf("transaction %s: %w", t.ID, err)
+		}
+		txns = append(txns, domain.Transaction{
+			ID:                 t.ID,
+			ProcessorReference: t.Reference,
+			Processor:          t.Processor,
+			MerchantID:         t.Merchant,
+			Amount:             t.Amount,
+			Currency:           t.Currency,
+			USDAmount:          usd,
+			Status:             t.Status,
+			CreatedAt:          *t.CreatedAt,
+			CapturedAt:         t.CapturedAt,
+		})
+	}
+	if _, err := txnRepo.BulkInsert(txns); err != nil {
+		return "", nil, fmt.Errorf("load transactions: %w", err)
+	}
+	for _, s := range sc.Settlements {
+		_, err := ingest.IngestEvent(string(s.Processor), domain.SettlementRecord{
+			ProcessorTransactionID: s.Reference,
+			GrossAmount:            s.Gross,
+			FeeAmount:              s.Fee,
+			NetAmount:              *s.Net,
+			Currency:               s.Currency,
+			SettlementDate:         s.Date,
+			BatchID:                s.Batch,
+		})
+		if err != nil {
+			return "", nil, fmt.Errorf("settlement %s: %w", s.Reference, err)
+		}
+	}
+
+	if _, err := recon.RunFullReconciliationAsOf(sc.AsOf); err != nil {
+		return "", nil, fmt.Errorf("reconcile: %w", err)
+	}
+
+	actual, err := foundDiscrepancies(discRepo, settRepo)
+	if err != nil {
+		return "", nil, err
+	}
+	problems := compareDiscrepancies(sc.Expect.Discrepancies, actual)
+
+	matched, records, err := settRepo.CountMatched()
+	if err != nil {
+		return "", nil, err
+	}
+	if m := sc.Expect.Matched; m != nil && *m != matched {
+		problems = append(problems, fmt.Sprintf("expected %d settlement rows matched, got %d", *m, matched))
+	}
+	for _, want := range sc.Expect.Transactions {
+		got, err := txnRepo.GetByID(want.ID)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("transaction %s: %v", want.ID, err))
+			continue
+		}
+		if want.Status != "" && got.Status != want.Status {
+			problems = append(problems, fmt.Sprintf("transaction %s: expected status %s, got %s", want.ID, want.Status, got.Status))
+		}
+		if want.ReconciliationStatus != "" && got.ReconciliationStatus != want.ReconciliationStatus {
+			problems = append(problems, fmt.Sprintf("transaction %s: expected reconciliation status %s, got %s",
+				want.ID, want.ReconciliationStatus, got.ReconciliationStatus))
+		}
+	}
+	return fmt.Sprintf("%d of %d settlement rows matched, %d discrepancies", matched, records, len(actual)), problems, nil
+}
+
+// found is a discrepancy as a scenario refers to it.
+type found struct {
+	Type          domain.DiscrepancyType
+	Transaction   string
+	Settlement    string
+	Severity      domain.Severity
+	DifferenceUSD float64
+}
+
+func (f found) String() string {
+	s := string(f.Type)
+	if f.Transaction != "" {
+		s += " transaction=" + f.Transaction
+	}
+	if f.Settlement != "" {
+		s += " settlement=" + f.Settlement
+	}
+	return fmt.Sprintf("%s severity=%s difference_usd=%.2f", s, f.Severity, f.DifferenceUSD)
+}
+
+func foundDiscrepancies(discRepo *repository.DiscrepancyRepo, settRepo *repository.SettlementRepo) ([]found, error) {
+	discs, err := discRepo.ListAll()
+	if err != nil {
+		return nil, err
+	}
+	result := make([]found, 0, len(discs))
+	for _, d := range discs {
+		f := found{Type: d.Type, Transaction: d.TransactionID, Severity: d.Severity, DifferenceUSD: d.DifferenceUSD}
+		if d.SettlementID != "" {
+			rec, err := settRepo.GetRecord(d.SettlementID)
+			if err != nil {
+				return nil, fmt.Errorf("settlement record %s: %w", d.SettlementID, err)
+			}
+			f.Settlement = rec.ProcessorTransactionID
+		}
+		result = append(result, f)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].String() < result[j].String() })
+	return result, nil
+}
+
+// compareDiscrepancies pairs each expected discrepancy with one that was
+// found. The most specific expectations are paired first, so a vaguer one
+// cannot take the discrepancy a precise one describes.
+func compareDiscrepancies(expected []expectedDiscrepancy, actual []found) []string {
+	order := make([]int, len(expected))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool {
+		return specificity(expected[order[a]]) > specificity(expected[order[b]])
+	})
+
+	var problems []string
+	used := make([]bool, len(actual))
+	for _, i := range order {
+		want := expected[i]
+		hit := -1
+		for j, got := range actual {
+			if !used[j] && matches(want, got) {
+				hit = j
+				break
+			}
+		}
+		if hit < 0 {
+			problems = append(problems, "missing:    "+describe(want))
+			continue
+		}
+		used[hit] = true
+	}
+	for j, got := range actual {
+		if !used[j] {
+			problems = append(problems, "unexpected: "+got.String())
+		}
+	}
+	return problems
+}
+
+func specificity(d expectedDiscrepancy) int {
+	n := 0
+	for _, set := range []bool{d.Transaction != "", d.Settlement != "", d.Severity != "", d.DifferenceUSD != nil} {
+		if set {
+			n++
+		}
+	}
+	return n
+}
+
+func matches(want expectedDiscrepancy, got found) bool {
+	return want.Type == got.Type &&
+		(want.Transaction == "" || want.Transaction == got.Transaction) &&
+		(want.Settlement == "" || want.Settlement == got.Settlement) &&
+		(want.Severity == "" || want.Severity == got.Severity) &&
+		(want.DifferenceUSD == nil || math.Abs(*want.DifferenceUSD-got.DifferenceUSD) < 0.005)
+}
+
+func describe(d expectedDiscrepancy) string {
+	s := string(d.Type)
+	if d.Transaction != "" {
+		s += " transaction=" + d.Transaction
+	}
+	if d.Settlement != "" {
+		s += " settlement=" + d.Settlement
+	}
+	if d.Severity != "" {
+		s += " severity=" + string(d.Severity)
+	}
+	if d.DifferenceUSD != nil {
+		s += fmt.Sprintf(" difference_usd=%.2f", *d.DifferenceUSD)
+	}
+	return s
+}
@@ -0,0 +1,491 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The part of YAML scenario files need, so analysts can write them without
+// the tree taking a YAML dependency: block mappings and sequences indented
+// with spaces, plain, single- and double-quoted scalars, flow sequences of
+// scalars ([a, b]), literal (|) and folded (>) block scalars, and #
+// comments. Anchors, tags, flow mappings and multi-document files are not
+// supported.
+
+type nodeKind int
+
+const (
+	scalarNode nodeKind = iota
+	mapNode
+	listNode
+)
+
+// node is a parsed YAML value. Scalars are kept as text and converted when
+// decoded into the field they belong to.
+type node struct {
+	kind  nodeKind
+	line  int
+	value string
+	null  bool
+
+	keys   []string
+	fields map[string]*node
+	items  []*node
+}
+
+type yamlLine struct {
+	num    int
+	indent int
+	text   string // without indentation and comments
+	raw    string // without the line break
+}
+
+type yamlParser struct {
+	lines []yamlLine
+	pos   int
+}
+
+// parseYAML parses one YAML document.
+func parseYAML(data []byte) (*node, error) {
+	p := &yamlParser{}
+	for i, raw := range strings.Split(strings.ReplaceAll(string(data), "\r\n", "\n"), "\n") {
+		trimmed := strings.TrimLeft(raw, " ")
+		if strings.HasPrefix(trimmed, "\t") {
+			return nil, fmt.Errorf("line %d: indent with spaces, not tabs", i+1)
+		}
+		p.lines = append(p.lines, yamlLine{
+			num:    i + 1,
+			indent: len(raw) - len(trimmed),
+			text:   strings.TrimRight(stripComment(trimmed), " \t"),
+			raw:    raw,
+		})
+	}
+	p.skipBlank()
+	if p.done() {
+		return &node{kind: mapNode, fields: map[string]*node{}}, nil
+	}
+	l := p.lines[p.pos]
+	if l.text == "---" {
+		p.pos++
+		p.skipBlank()
+		if p.done() {
+			return &node{kind: mapNode, fields: map[string]*node{}}, nil
+		}
+		l = p.lines[p.pos]
+	}
+	n, err := p.parseBlock(l.indent)
+	if err != nil {
+		return nil, err
+	}
+	p.skipBlank()
+	if !p.done() {
+		return nil, fmt.Errorf("line %d: unexpected indentation", p.lines[p.pos].num)
+	}
+	return n, nil
+}
+
+// stripComment removes a # comment that is outside quotes and starts the
+// line or follows a space.
+func stripComment(s string) string {
+	var quote byte
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case quote != 0:
+			if c == '\\' && quote == '"' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			if i == 0 || strings.ContainsRune(" :-[,", rune(s[i-1])) {
+				quote = c
+			}
+		case c == '#' && (i == 0 || s[i-1] == ' ' || s[i-1] == '\t'):
+			return s[:i]
+		}
+	}
+	return s
+}
+
+func (p *yamlParser) done() bool { return p.pos >= len(p.lines) }
+
+func (p *yamlParser) skipBlank() {
+	for !p.done() && p.lines[p.pos].text == "" {
+		p.pos++
+	}
+}
+
+func isListItem(text string) bool {
+	return text == "-" || strings.HasPrefix(text, "- ")
+}
+
+func (p *yamlParser) parseBlock(indent int) (*node, error) {
+	if isListItem(p.lines[p.pos].text) {
+		return p.parseList(indent)
+	}
+	return p.parseMap(indent)
+}
+
+func (p *yamlParser) parseMap(indent int) (*node, error) {
+	n := &node{kind: mapNode, line: p.lines[p.pos].num, fields: map[string]*node{}}
+	for p.skipBlank(); !p.done(); p.skipBlank() {
+		l := p.lines[p.pos]
+		if l.indent < indent {
+			break
+		}
+		if l.indent > indent {
+			return nil, fmt.Errorf("line %d: unexpected indentation", l.num)
+		}
+		if isListItem(l.text) {
+			return nil, fmt.Errorf("line %d: a list item where a key was expected", l.num)
+		}
+		key, rest, ok := splitKey(l.text)
+		if !ok {
+			return nil, fmt.Errorf("line %d: expected \"key: value\", got %q", l.num, l.text)
+		}
+		if _, dup := n.fields[key]; dup {
+			return nil, fmt.Errorf("line %d: duplicate key %q", l.num, key)
+		}
+		p.pos++
+
+		var value *node
+		var err error
+		switch {
+		case rest == "":
+			value, err = p.parseNested(indent, l.num)
+		case strings.HasPrefix(rest, "|") || strings.HasPrefix(rest, ">"):
+			value, err = p.parseBlockScalar(indent, l.num, rest)
+		default:
+			value, err = parseInline(rest, l.num)
+		}
+		if err != nil {
+			return nil, err
+		}
+		n.keys = append(n.keys, key)
+		n.fields[key] = value
+	}
+	return n, nil
+}
+
+// parseNested parses the value of a key with nothing after its colon: a
+// deeper block, a list at the key's own indentation, or null.
+func (p *yamlParser) parseNested(indent, line int) (*node, error) {
+	p.skipBlank()
+	if !p.done() {
+		next := p.lines[p.pos]
+		if next.indent > indent || (next.indent == indent && isListItem(next.text)) {
+			return p.parseBlock(next.indent)
+		}
+	}
+	return &node{kind: scalarNode, line: line, null: true}, nil
+}
+
+func (p *yamlParser) parseList(indent int) (*node, error) {
+	n := &node{kind: listNode, line: p.lines[p.pos].num}
+	for p.skipBlank(); !p.done(); p.skipBlank() {
+		l := p.lines[p.pos]
+		if l.indent < indent || (l.indent == indent && !isListItem(l.text)) {
+			break
+		}
+		if l.indent > indent {
+			return nil, fmt.Errorf("line %d: unexpected indentation", l.num)
+		}
+		rest := strings.TrimLeft(strings.TrimPrefix(l.text, "-"), " ")
+
+		var item *node
+		var err error
+		if rest == "" {
+			p.pos++
+			p.skipBlank()
+			if p.done() || p.lines[p.pos].indent <= indent {
+				item = &node{kind: scalarNode, line: l.num, null: true}
+			} else {
+				item, err = p.parseBlock(p.lines[p.pos].indent)
+			}
+		} else if _, _, isKey := splitKey(rest); isKey || isListItem(rest) {
+			// "- key: value" starts a mapping whose keys line up with key.
+			// The line is parsed again as that mapping's first line.
+			p.lines[p.pos].indent = l.indent + len(l.text) - len(rest)
+			p.lines[p.pos].text = rest
+			item, err = p.parseBlock(p.lines[p.pos].indent)
+		} else {
+			p.pos++
+			item, err = parseInline(rest, l.num)
+		}
+		if err != nil {
+			return nil, err
+		}
+		n.items = append(n.items, item)
+	}
+	return n, nil
+}
+
+// parseBlockScalar reads a | or > scalar from the lines indented deeper
+// than its key. Trailing line breaks are kept to one, or none with "-".
+func (p *yamlParser) parseBlockScalar(indent, line int, header string) (*node, error) {
+	style, chomp := header[0], strings.TrimSpace(header[1:])
+	if chomp != "" && chomp != "-" {
+		return nil, fmt.Errorf("line %d: unsupported block scalar header %q", line, header)
+	}
+	var body []string
+	blockIndent := -1
+	for ; !p.done(); p.pos++ {
+		l := p.lines[p.pos]
+		if strings.TrimSpace(l.raw) == "" {
+			body = append(body, "")
+			continue
+		}
+		if l.indent <= indent {
+			break
+		}
+		if blockIndent < 0 {
+			blockIndent = l.indent
+		}
+		if l.indent < blockIndent {
+			return nil, fmt.Errorf("line %d: block scalar lines must be indented alike", l.num)
+		}
+		body = append(body, l.raw[blockIndent:])
+	}
+	for len(body) > 0 && body[len(body)-1] == "" {
+		body = body[:len(body)-1]
+	}
+
+	var text string
+	if style == '|' {
+		text = strings.Join(body, "\n")
+	} else {
+		var b strings.Builder
+		for i, s := range body {
+			switch {
+			case i == 0, body[i-1] == "":
+			case s == "":
+				b.WriteString("\n")
+			default:
+				b.WriteString(" ")
+			}
+			b.WriteString(s)
+		}
+		text = b.String()
+	}
+	if chomp == "" && len(body) > 0 {
+		text += "\n"
+	}
+	return &node{kind: scalarNode, line: line, value: text}, nil
+}
+
+// splitKey splits "key: value" at the first colon that is followed by a
+// space or ends the line and is outside quotes.
+func splitKey(text string) (key, rest string, ok bool) {
+	if strings.HasPrefix(text, "[") || strings.HasPrefix(text, "{") {
+		return "", "", false
+	}
+	var quote byte
+	for i := 0; i < len(text); i++ {
+		c := text[i]
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case (c == '"' || c == '\'') && i == 0:
+			quote = c
+		case c == ':' && (i == len(text)-1 || text[i+1] == ' '):
+			key = strings.TrimSpace(text[:i])
+			if k, err := unquote(key); err == nil {
+				key = k
+			}
+			return key, strings.TrimSpace(text[i+1:]), key != ""
+		}
+	}
+	return "", "", false
+}
+
+// parseInline parses a value written on its key's or item's line.
+func parseInline(text string, line int) (*node, error) {
+	if strings.HasPrefix(text, "{") {
+		return nil, fmt.Errorf("line %d: flow mappings ({...}) are not supported; use one key per line", line)
+	}
+	if strings.HasPrefix(text, "&") || strings.HasPrefix(text, "*") || strings.HasPrefix(text, "!") {
+		return nil, fmt.Errorf("line %d: anchors, aliases and tags are not supported", line)
+	}
+	if strings.HasPrefix(text, "[") {
+		if !strings.HasSuffix(text, "]") {
+			return nil, fmt.Errorf("line %d: a flow sequence must end on its line", line)
+		}
+		n := &node{kind: listNode, line: line}
+		inner := strings.TrimSpace(text[1 : len(text)-1])
+		if inner == "" {
+			return n, nil
+		}
+		for _, part := range splitFlow(inner) {
+			item, err := parseInline(strings.TrimSpace(part), line)
+			if err != nil {
+				return nil, err
+			}
+			if item.kind != scalarNode {
+				return nil, fmt.Errorf("line %d: nested flow sequences are not supported", line)
+			}
+			n.items = append(n.items, item)
+		}
+		return n, nil
+	}
+	if text == "~" || text == "null" {
+		return &node{kind: scalarNode, line: line, null: true}, nil
+	}
+	v, err := unquote(text)
+	if err != nil {
+		return nil, fmt.Errorf("line %d: %v", line, err)
+	}
+	return &node{kind: scalarNode, line: line, value: v}, nil
+}
+
+// splitFlow splits the inside of a flow sequence at commas outside quotes.
+func splitFlow(s string) []string {
+	var parts []string
+	var quote byte
+	start := 0
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == ',':
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
+
+// unquote returns a quoted scalar's text, or a plain scalar as written.
+func unquote(s string) (string, error) {
+	switch {
+	case len(s) >= 2 && s[0] == '"' && s[len(s)-1] == '"':
+		v, err := strconv.Unquote(s)
+		if err != nil {
+			return "", fmt.Errorf("invalid double-quoted string %s", s)
+		}
+		return v, nil
+	case len(s) >= 2 && s[0] == '\'' && s[len(s)-1] == '\'':
+		return strings.ReplaceAll(s[1:len(s)-1], "''", "'"), nil
+	case strings.HasPrefix(s, `"`) || strings.HasPrefix(s, "'"):
+		return "", fmt.Errorf("unterminated string %s", s)
+	}
+	return s, nil
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// timeLayouts are the forms a time may be written in. A date alone is
+// midnight UTC.
+var timeLayouts = []string{time.RFC3339, "2006-01-02T15:04:05", "2006-01-02 15:04:05", "2006-01-02 15:04", "2006-01-02"}
+
+// decode stores n in v, which must be a pointer. Struct fields are matched
+// by their yaml tag, and keys without a field are errors so that a typo
+// does not silently drop an expectation.
+func decode(n *node, v any) error {
+	return decodeValue(n, reflect.ValueOf(v).Elem())
+}
+
+func decodeValue(n *node, v reflect.Value) error {
+	if n.null {
+		v.Set(reflect.Zero(v.Type()))
+		return nil
+	}
+	if v.Type() == timeType {
+		if n.kind != scalarNode {
+			return fmt.Errorf("line %d: expected a time", n.line)
+		}
+		for _, layout := range timeLayouts {
+			if t, err := time.Parse(layout, n.value); err == nil {
+				v.Set(reflect.ValueOf(t.UTC()))
+				return nil
+			}
+		}
+		return fmt.Errorf("line %d: %q is not a time; use 2024-01-15 or 2024-01-15T10:30:00Z", n.line, n.value)
+	}
+
+	switch v.Kind() {
+	case reflect.Pointer:
+		elem := reflect.New(v.Type().Elem())
+		if err := decodeValue(n, elem.Elem()); err != nil {
+			return err
+		}
+		v.Set(elem)
+		return nil
+	case reflect.Struct:
+		if n.kind != mapNode {
+			return fmt.Errorf("line %d: expected keys and values", n.line)
+		}
+		fields := map[string]int{}
+		var names []string
+		for i := 0; i < v.NumField(); i++ {
+			if tag := v.Type().Field(i).Tag.Get("yaml"); tag != "" {
+				fields[tag] = i
+				names = append(names, tag)
+			}
+		}
+		for _, key := range n.keys {
+			i, ok := fields[key]
+			if !ok {
+				return fmt.Errorf("line %d: unknown key %q; expected one of %s", n.fields[key].line, key, strings.Join(names, ", "))
+			}
+			if err := decodeValue(n.fields[key], v.Field(i)); err != nil {
+				return fmt.Errorf("%s: %w", key, err)
+			}
+		}
+		return nil
+	case reflect.Slice:
+		if n.kind != listNode {
+			return fmt.Errorf("line %d: expected a list", n.line)
+		}
+		s := reflect.MakeSlice(v.Type(), len(n.items), len(n.items))
+		for i, item := range n.items {
+			if err := decodeValue(item, s.Index(i)); err != nil {
+				return fmt.Errorf("item %d: %w", i+1, err)
+			}
+		}
+		v.Set(s)
+		return nil
+	}
+
+	if n.kind != scalarNode {
+		return fmt.Errorf("line %d: expected a single value", n.line)
+	}
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(n.value)
+	case reflect.Float64:
+		f, err := strconv.ParseFloat(strings.ReplaceAll(n.value, "_", ""), 64)
+		if err != nil {
+			return fmt.Errorf("line %d: %q is not a number", n.line, n.value)
+		}
+		v.SetFloat(f)
+	case reflect.Int:
+		i, err := strconv.Atoi(n.value)
+		if err != nil {
+			return fmt.Errorf("line %d: %q is not a whole number", n.line, n.value)
+		}
+		v.SetInt(int64(i))
+	case reflect.Bool:
+		switch n.value {
+		case "true", "yes":
+			v.SetBool(true)
+		case "false", "no":
+			v.SetBool(false)
+		default:
+			return fmt.Errorf("line %d: %q is not true or false", n.line, n.value)
+		}
+	default:
+		return fmt.Errorf("line %d: cannot decode into %s", n.line, v.Type())
+	}
+	return nil
+}